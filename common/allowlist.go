@@ -0,0 +1,124 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/drakkan/sftpgo/v2/logger"
+)
+
+// acceptAllowList is the list of IP addresses and networks allowed to connect.
+// It is checked before any other connection check, so the defender never sees
+// the refused connections
+var acceptAllowList allowList
+
+type allowList struct {
+	sync.RWMutex
+	file string
+	// nil means that all the connections are accepted
+	list *HostList
+}
+
+// load loads the allow list from the given file, an empty file name disables
+// the allow list. On error the current list is not modified
+func (l *allowList) load(file string) error {
+	list, err := loadHostListFromFile(file)
+	if err != nil {
+		return err
+	}
+	if file != "" && (list == nil || len(list.IPAddresses)+list.Ranges.Len() == 0) {
+		// an allow list without entries would refuse all the connections
+		return fmt.Errorf("allow list %#v has no valid entries", file)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.file = file
+	l.list = list
+	return nil
+}
+
+func (l *allowList) reload() error {
+	l.RLock()
+	file := l.file
+	l.RUnlock()
+
+	if file == "" {
+		return nil
+	}
+	return l.load(file)
+}
+
+func (l *allowList) isAllowed(ip string) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	if l.list == nil {
+		return true
+	}
+	return l.list.isListed(ip)
+}
+
+// ReloadAcceptAllowList reloads the allow list for new connections, if configured
+func ReloadAcceptAllowList() error {
+	return acceptAllowList.reload()
+}
+
+// IsConnectionAccepted returns true if the allow list for new connections is not
+// configured or if it contains the specified IP address
+func IsConnectionAccepted(ip, protocol string) bool {
+	if !acceptAllowList.isAllowed(ip) {
+		logger.Log(logger.LevelDebug, protocol, "", "connection refused, ip %#v is not in the allow list", ip)
+		return false
+	}
+	return true
+}
+
+// allowListListener wraps a net.Listener and closes, within Accept, the TCP
+// connections from hosts not included in the allow list, so the refused
+// connections never reach the TLS handshake or the protocol greeting
+type allowListListener struct {
+	net.Listener
+	protocol string
+	// connections from these hosts are returned without checks, they are proxies
+	// and the client IP is checked once it is known
+	isProxy func(net.IP) bool
+}
+
+// NewAllowListListener returns a listener that closes the connections refused
+// by the allow list for new connections. Connections from hosts accepted by the
+// isProxy function, if not nil, and non TCP connections are never refused
+func NewAllowListListener(listener net.Listener, protocol string, isProxy func(net.IP) bool) net.Listener {
+	return &allowListListener{
+		Listener: listener,
+		protocol: protocol,
+		isProxy:  isProxy,
+	}
+}
+
+// Accept waits for and returns the next connection from an allowed host
+func (l *allowListListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if l.isAllowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func (l *allowListListener) isAllowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if l.isProxy != nil && l.isProxy(tcpAddr.IP) {
+		return true
+	}
+	return IsConnectionAccepted(tcpAddr.IP.String(), l.protocol)
+}
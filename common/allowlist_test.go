@@ -0,0 +1,149 @@
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptAllowList(t *testing.T) {
+	configCopy := Config
+
+	listFile := filepath.Join(os.TempDir(), "accept_allowlist.json")
+	hl := HostListFile{
+		IPAddresses:  []string{"invalid ip"},
+		CIDRNetworks: []string{"invalid network"},
+	}
+	asJSON, err := json.Marshal(hl)
+	require.NoError(t, err)
+	err = os.WriteFile(listFile, asJSON, os.ModePerm)
+	require.NoError(t, err)
+
+	// no allow list configured
+	assert.True(t, IsConnectionAccepted("172.16.1.1", ProtocolSSH))
+	// a list without valid entries would refuse all the connections
+	Config.AcceptAllowListFile = listFile
+	err = Initialize(Config)
+	assert.Error(t, err)
+	Config.AcceptAllowListFile = filepath.Join(os.TempDir(), "missing_accept_allowlist.json")
+	err = Initialize(Config)
+	assert.Error(t, err)
+
+	hl = HostListFile{
+		IPAddresses:  []string{"172.16.1.1"},
+		CIDRNetworks: []string{"192.168.8.0/24"},
+	}
+	asJSON, err = json.Marshal(hl)
+	require.NoError(t, err)
+	err = os.WriteFile(listFile, asJSON, os.ModePerm)
+	require.NoError(t, err)
+
+	Config.AcceptAllowListFile = listFile
+	Config.DefenderConfig = DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 2,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+	}
+	err = Initialize(Config)
+	require.NoError(t, err)
+
+	for _, protocol := range []string{ProtocolSSH, ProtocolFTP, ProtocolWebDAV, ProtocolHTTP} {
+		assert.True(t, IsConnectionAccepted("172.16.1.1", protocol))
+		assert.True(t, IsConnectionAccepted("192.168.8.23", protocol))
+		assert.False(t, IsConnectionAccepted("172.16.1.2", protocol))
+		assert.False(t, IsConnectionAccepted("192.168.9.1", protocol))
+	}
+	// refused connections are not seen by the defender
+	assert.Len(t, GetDefenderHosts(), 0)
+
+	hl.IPAddresses = []string{"172.16.1.2"}
+	asJSON, err = json.Marshal(hl)
+	require.NoError(t, err)
+	err = os.WriteFile(listFile, asJSON, os.ModePerm)
+	require.NoError(t, err)
+	err = ReloadAcceptAllowList()
+	assert.NoError(t, err)
+	assert.False(t, IsConnectionAccepted("172.16.1.1", ProtocolSSH))
+	assert.True(t, IsConnectionAccepted("172.16.1.2", ProtocolSSH))
+	assert.True(t, IsConnectionAccepted("192.168.8.23", ProtocolSSH))
+	// on reload errors the current list is preserved
+	err = os.Remove(listFile)
+	assert.NoError(t, err)
+	err = ReloadAcceptAllowList()
+	assert.Error(t, err)
+	assert.True(t, IsConnectionAccepted("172.16.1.2", ProtocolSSH))
+	assert.False(t, IsConnectionAccepted("172.16.1.1", ProtocolSSH))
+
+	Config = configCopy
+	err = Initialize(Config)
+	assert.NoError(t, err)
+	assert.True(t, IsConnectionAccepted("172.16.1.1", ProtocolSSH))
+	err = ReloadAcceptAllowList()
+	assert.NoError(t, err)
+}
+
+func TestAllowListListener(t *testing.T) {
+	listFile := filepath.Join(os.TempDir(), "accept_allowlist_listener.json")
+	asJSON, err := json.Marshal(HostListFile{
+		IPAddresses: []string{"172.16.1.1"},
+	})
+	require.NoError(t, err)
+	err = os.WriteFile(listFile, asJSON, os.ModePerm)
+	require.NoError(t, err)
+	err = acceptAllowList.load(listFile)
+	require.NoError(t, err)
+	defer func() {
+		err = acceptAllowList.load("")
+		assert.NoError(t, err)
+		err = os.Remove(listFile)
+		assert.NoError(t, err)
+	}()
+
+	accept := func(isProxy func(net.IP) bool) bool {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listener := NewAllowListListener(l, ProtocolFTP, isProxy)
+		defer listener.Close()
+
+		accepted := make(chan bool, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err == nil
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		select {
+		case result := <-accepted:
+			return result
+		case <-time.After(500 * time.Millisecond):
+			// the refused connection is closed within Accept, it is never returned
+			_, err = conn.Read(make([]byte, 1))
+			assert.ErrorIs(t, err, io.EOF)
+			return false
+		}
+	}
+	// 127.0.0.1 is not allowed
+	assert.False(t, accept(nil))
+	// the hosts accepted by the proxy function are not checked
+	assert.True(t, accept(func(ip net.IP) bool {
+		return ip.IsLoopback()
+	}))
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/httpclient"
 	"github.com/drakkan/sftpgo/v2/logger"
 	"github.com/drakkan/sftpgo/v2/metric"
+	"github.com/drakkan/sftpgo/v2/sdk"
 	"github.com/drakkan/sftpgo/v2/util"
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
@@ -40,8 +41,10 @@ const (
 	chmodLogSender    = "Chmod"
 	chtimesLogSender  = "Chtimes"
 	truncateLogSender = "Truncate"
+	copyLogSender     = "Copy"
 	operationDownload = "download"
 	operationUpload   = "upload"
+	operationCopy     = "copy"
 	operationDelete   = "delete"
 	// Pre-download action name
 	OperationPreDownload = "pre-download"
@@ -55,6 +58,8 @@ const (
 	OperationSSHCmd          = "ssh_cmd"
 	chtimesFormat            = "2006-01-02T15:04:05" // YYYY-MM-DDTHH:MM:SS
 	idleTimeoutCheckInterval = 3 * time.Minute
+	// polling interval while waiting for uploads to complete before a quota scan
+	activeUploadsCheckInterval = 100 * time.Millisecond
 )
 
 // Stat flags
@@ -69,6 +74,7 @@ const (
 const (
 	TransferUpload = iota
 	TransferDownload
+	TransferCopy
 )
 
 // Supported protocols
@@ -107,6 +113,8 @@ var (
 	ErrCrtRevoked           = errors.New("your certificate has been revoked")
 	ErrNoCredentials        = errors.New("no credential provided")
 	ErrInternalFailure      = errors.New("internal failure")
+	ErrServerBusy           = errors.New("too many concurrent transfers, please retry later")
+	ErrDownloadChanged      = errors.New("the file changed since the download started, please restart the download")
 	errNoTransfer           = errors.New("requested transfer not found")
 	errTransferMismatch     = errors.New("transfer mismatch")
 )
@@ -123,6 +131,8 @@ var (
 	supportedProtocols    = []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH, ProtocolFTP, ProtocolWebDAV, ProtocolHTTP}
 	// the map key is the protocol, for each protocol we can have multiple rate limiters
 	rateLimiters map[string][]*rateLimiter
+	// nil if there is no server wide limit for concurrent transfers
+	transfersSlots *transfersLimiter
 )
 
 // Initialize sets the common configuration
@@ -133,14 +143,38 @@ func Initialize(c Configuration) error {
 	if Config.IdleTimeout > 0 {
 		startIdleTimeoutTicker(idleTimeoutCheckInterval)
 	}
+	if err := acceptAllowList.load(c.AcceptAllowListFile); err != nil {
+		return fmt.Errorf("accept allow list initialization error: %v", err)
+	}
 	Config.defender = nil
+	stopDefenderListsTicker()
+	stopDefenderURLListsTicker()
 	if c.DefenderConfig.Enabled {
-		defender, err := newInMemoryDefender(&c.DefenderConfig)
+		var defender Defender
+		var err error
+		switch c.DefenderConfig.Driver {
+		case DefenderDriverProvider:
+			defender, err = newProviderDefender(&c.DefenderConfig)
+		case DefenderDriverRedis:
+			defender, err = newRedisDefender(&c.DefenderConfig)
+		default:
+			defender, err = newInMemoryDefender(&c.DefenderConfig)
+		}
 		if err != nil {
 			return fmt.Errorf("defender initialization error: %v", err)
 		}
-		logger.Info(logSender, "", "defender initialized with config %+v", c.DefenderConfig)
+		defenderConfig := c.DefenderConfig
+		defenderConfig.Redis.Password = "[redacted]"
+		defenderConfig.BanHook = util.GetRedactedURL(defenderConfig.BanHook)
+		logger.Info(logSender, "", "defender initialized with config %+v", defenderConfig)
 		Config.defender = defender
+		if c.DefenderConfig.ListsCheckInterval > 0 {
+			startDefenderListsTicker(time.Duration(c.DefenderConfig.ListsCheckInterval)*time.Second, &c.DefenderConfig)
+		}
+		if c.DefenderConfig.ListsRefreshInterval > 0 && (isHostListURL(c.DefenderConfig.BlockListFile) ||
+			isHostListURL(c.DefenderConfig.SafeListFile)) {
+			startDefenderURLListsTicker(time.Duration(c.DefenderConfig.ListsRefreshInterval) * time.Second)
+		}
 	}
 	rateLimiters = make(map[string][]*rateLimiter)
 	for _, rlCfg := range c.RateLimitersConfig {
@@ -154,6 +188,23 @@ func Initialize(c Configuration) error {
 			}
 		}
 	}
+	sink, err := c.TransferEvents.getSink()
+	if err != nil {
+		return fmt.Errorf("transfer events initialization error: %v", err)
+	}
+	InitializeTransferEventSink(sink)
+	transfersSlots = nil
+	if c.MaxConcurrentTransfers > 0 {
+		transfersSlots = newTransfersLimiter(c.MaxConcurrentTransfers,
+			time.Duration(c.TransfersQueueTimeout)*time.Second)
+	}
+	stopQuotaDriftTicker()
+	if c.QuotaDrift.isEnabled() {
+		if err := c.QuotaDrift.validate(); err != nil {
+			return fmt.Errorf("quota drift initialization error: %v", err)
+		}
+		startQuotaDriftTicker(time.Duration(c.QuotaDrift.CheckInterval) * time.Minute)
+	}
 	vfs.SetTempPath(c.TempPath)
 	dataprovider.SetTempPath(c.TempPath)
 	return nil
@@ -165,7 +216,7 @@ func Initialize(c Configuration) error {
 // allowed delay
 func LimitRate(protocol, ip string) (time.Duration, error) {
 	for _, limiter := range rateLimiters[protocol] {
-		if delay, err := limiter.Wait(ip); err != nil {
+		if delay, err := limiter.Wait(ip, protocol); err != nil {
 			logger.Debug(logSender, "", "protocol %v ip %v: %v", protocol, ip, err)
 			return delay, err
 		}
@@ -237,13 +288,51 @@ func GetDefenderScore(ip string) int {
 	return Config.defender.GetScore(ip)
 }
 
-// AddDefenderEvent adds the specified defender event for the given IP
-func AddDefenderEvent(ip string, event HostEvent) {
+// GetDefenderThrottleDelay returns how long to wait before accepting a new
+// connection from the given IP, 0 means no delay
+func GetDefenderThrottleDelay(ip string) time.Duration {
+	if Config.defender == nil {
+		return 0
+	}
+
+	return Config.defender.GetThrottleDelay(ip)
+}
+
+// ThrottleConnection waits for the defender throttling delay for the given IP, if any
+func ThrottleConnection(ip, protocol string) {
+	delay := GetDefenderThrottleDelay(ip)
+	if delay > 0 {
+		logger.Debug(protocol, "", "delaying connection from ip %#v by %v", ip, delay)
+		time.Sleep(delay)
+	}
+}
+
+// ExplainDefenderBan returns why the given IP is banned or, if it is not banned,
+// its current score compared to the ban threshold
+func ExplainDefenderBan(ip string) (*BanExplanation, error) {
+	if Config.defender == nil {
+		return nil, errors.New("defender is disabled")
+	}
+
+	return Config.defender.ExplainBan(ip), nil
+}
+
+// AddDefenderEvent adds the specified defender event for the given IP and protocol
+func AddDefenderEvent(ip, protocol string, event HostEvent) {
 	if Config.defender == nil {
 		return
 	}
 
-	Config.defender.AddEvent(ip, event)
+	Config.defender.AddEvent(ip, protocol, event)
+}
+
+// AddDefenderLoginSuccess notifies the defender about a successful login from the given IP
+func AddDefenderLoginSuccess(ip string) {
+	if Config.defender == nil {
+		return
+	}
+
+	Config.defender.AddLoginSuccess(ip)
 }
 
 // the ticker cannot be started/stopped from multiple goroutines
@@ -283,6 +372,11 @@ type ActiveTransfer interface {
 	GetRealFsPath(fsPath string) string
 }
 
+// streamedTransfer is implemented by the transfers that can be streamed to a storage backend
+type streamedTransfer interface {
+	GetUploadedSize() int64
+}
+
 // ActiveConnection defines the interface for the current active connections
 type ActiveConnection interface {
 	GetID() string
@@ -295,6 +389,7 @@ type ActiveConnection interface {
 	GetLastActivity() time.Time
 	GetCommand() string
 	Disconnect() error
+	SignalTransfersAbort() error
 	AddTransfer(t ActiveTransfer)
 	RemoveTransfer(t ActiveTransfer)
 	GetTransfers() []ConnectionTransfer
@@ -319,6 +414,11 @@ type ConnectionTransfer struct {
 	StartTime     int64  `json:"start_time"`
 	Size          int64  `json:"size"`
 	VirtualPath   string `json:"path"`
+	// number of files copied, set for recursive copies only
+	Files int `json:"files,omitempty"`
+	// bytes already sent to the storage backend, set for uploads streamed
+	// to remote storage backends only
+	UploadedSize *int64 `json:"uploaded_size,omitempty"`
 }
 
 func (t *ConnectionTransfer) getConnectionTransferAsString() string {
@@ -328,6 +428,8 @@ func (t *ConnectionTransfer) getConnectionTransferAsString() string {
 		result += "UL "
 	case operationDownload:
 		result += "DL "
+	case operationCopy:
+		result += fmt.Sprintf("CP Files: %v ", t.Files)
 	}
 	result += fmt.Sprintf("%#v ", t.VirtualPath)
 	if t.Size > 0 {
@@ -335,10 +437,80 @@ func (t *ConnectionTransfer) getConnectionTransferAsString() string {
 		speed := float64(t.Size) / float64(util.GetTimeAsMsSinceEpoch(time.Now())-t.StartTime)
 		result += fmt.Sprintf("Size: %#v Elapsed: %#v Speed: \"%.1f KB/s\"", util.ByteCountIEC(t.Size),
 			util.GetDurationAsString(elapsed), speed)
+		if t.UploadedSize != nil {
+			result += fmt.Sprintf(" Uploaded: %#v", util.ByteCountIEC(*t.UploadedSize))
+		}
 	}
 	return result
 }
 
+// DefaultQuotaConfig defines a system wide quota to apply to users
+// without an explicit quota
+type DefaultQuotaConfig struct {
+	// If enabled, users with quota_size and/or quota_files set to 0 will use the default
+	// values defined here. Set the user quota to -1 to configure a truly unlimited user
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Default maximum size allowed as bytes. 0 means unlimited
+	QuotaSize int64 `json:"quota_size" mapstructure:"quota_size"`
+	// Default maximum number of files allowed. 0 means unlimited
+	QuotaFiles int `json:"quota_files" mapstructure:"quota_files"`
+}
+
+// getQuota returns the quota size and files to enforce for the given user limits.
+// A zero limit is replaced with the default one if enabled, a negative limit
+// means unlimited and so 0 is returned
+func (q *DefaultQuotaConfig) getQuota(quotaSize int64, quotaFiles int) (int64, int) {
+	if q.Enabled {
+		if quotaSize == 0 {
+			quotaSize = q.QuotaSize
+		}
+		if quotaFiles == 0 {
+			quotaFiles = q.QuotaFiles
+		}
+	}
+	if quotaSize < 0 {
+		quotaSize = 0
+	}
+	if quotaFiles < 0 {
+		quotaFiles = 0
+	}
+	return quotaSize, quotaFiles
+}
+
+// BannersConfig defines the banners to show to the clients for each protocol.
+// An empty banner means that the protocol specific default, if any, is used
+type BannersConfig struct {
+	// Banner for SFTP/SCP/SSH clients, sent before authentication completes,
+	// the user specific banner does not apply
+	SSH string `json:"ssh" mapstructure:"ssh"`
+	// Welcome message for FTP clients
+	FTP string `json:"ftp" mapstructure:"ftp"`
+	// Message displayed in the WebClient
+	HTTP string `json:"http" mapstructure:"http"`
+}
+
+func (b *BannersConfig) getBanner(protocol string) string {
+	switch protocol {
+	case ProtocolSFTP, ProtocolSCP, ProtocolSSH:
+		return b.SSH
+	case ProtocolFTP:
+		return b.FTP
+	case ProtocolHTTP:
+		return b.HTTP
+	default:
+		return ""
+	}
+}
+
+// GetBanner returns the banner to show for the given protocol.
+// The banner defined for the user, if any, overrides the configured one
+func GetBanner(protocol string, user *dataprovider.User) string {
+	if user != nil && user.Filters.Banner != "" {
+		return user.Filters.Banner
+	}
+	return Config.Banners.getBanner(protocol)
+}
+
 // Configuration defines configuration parameters common to all supported protocols
 type Configuration struct {
 	// Maximum idle timeout as minutes. If a client is idle for a time that exceeds this setting it will be disconnected.
@@ -397,10 +569,37 @@ type Configuration struct {
 	MaxTotalConnections int `json:"max_total_connections" mapstructure:"max_total_connections"`
 	// Maximum number of concurrent client connections from the same host (IP). 0 means unlimited
 	MaxPerHostConnections int `json:"max_per_host_connections" mapstructure:"max_per_host_connections"`
+	// Maximum number of concurrent uploads and downloads, server wide. 0 means unlimited
+	MaxConcurrentTransfers int `json:"max_concurrent_transfers" mapstructure:"max_concurrent_transfers"`
+	// Maximum time, in seconds, a transfer waits for a free slot if max_concurrent_transfers
+	// is reached. After this time a "server busy" error is returned to the client.
+	// 0 means no wait
+	TransfersQueueTimeout int `json:"transfers_queue_timeout" mapstructure:"transfers_queue_timeout"`
+	// Duration, in seconds, of the slow-start ramp for bandwidth limits. Transfers start
+	// at a fraction of the limit and linearly reach it within this time. 0 means disabled
+	BandwidthRampUp int `json:"bandwidth_ramp_up" mapstructure:"bandwidth_ramp_up"`
+	// Maximum time, in seconds, a user quota scan waits for the user's in-progress uploads
+	// to complete before recalculating the quota. The quota of uploads still in progress
+	// is updated when they complete, so they could be counted twice. New uploads are
+	// refused until the scan completes. If there are still active uploads after this
+	// time the scan fails. 0 means disabled
+	QuotaScanTransfersGrace int `json:"quota_scan_transfers_grace" mapstructure:"quota_scan_transfers_grace"`
+	// Path to a file containing the list of IP addresses and/or networks allowed to connect,
+	// using the same format as the defender lists. Connections from other hosts are refused
+	// before any other check. Leave empty to allow connections from any host
+	AcceptAllowListFile string `json:"accept_allowlist_file" mapstructure:"accept_allowlist_file"`
 	// Defender configuration
 	DefenderConfig DefenderConfig `json:"defender" mapstructure:"defender"`
 	// Rate limiter configurations
-	RateLimitersConfig    []RateLimiterConfig `json:"rate_limiters" mapstructure:"rate_limiters"`
+	RateLimitersConfig []RateLimiterConfig `json:"rate_limiters" mapstructure:"rate_limiters"`
+	// Default quota to apply to users without an explicit quota
+	DefaultQuota DefaultQuotaConfig `json:"default_quota" mapstructure:"default_quota"`
+	// Events to publish for each completed upload or download
+	TransferEvents TransferEventsConfig `json:"transfer_events" mapstructure:"transfer_events"`
+	// Banners to show to the clients for each protocol
+	Banners BannersConfig `json:"banners" mapstructure:"banners"`
+	// Periodic check to detect and fix quota drifts
+	QuotaDrift            QuotaDriftConfig `json:"quota_drift" mapstructure:"quota_drift"`
 	idleTimeoutAsDuration time.Duration
 	idleLoginTimeout      time.Duration
 	defender              Defender
@@ -589,6 +788,46 @@ func (conns *ActiveConnections) GetActiveSessions(username string) int {
 	return numSessions
 }
 
+// HasActiveUploads returns true if the given username has uploads in progress
+func (conns *ActiveConnections) HasActiveUploads(username string) bool {
+	conns.RLock()
+	defer conns.RUnlock()
+
+	for _, c := range conns.connections {
+		if c.GetUsername() != username {
+			continue
+		}
+		for _, t := range c.GetTransfers() {
+			if t.OperationType == operationUpload {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WaitForUserUploads waits, up to the configured quota scan transfers grace, for the
+// in-progress uploads of the given username to complete. The user must have an active
+// quota scan, new uploads are refused until the scan is removed.
+// It returns an error if some uploads are still active after the grace period.
+// It returns immediately if the grace period is not configured
+func (conns *ActiveConnections) WaitForUserUploads(username string) error {
+	if Config.QuotaScanTransfersGrace <= 0 {
+		return nil
+	}
+	if !QuotaScans.blockUserUploads(username) {
+		return fmt.Errorf("no active quota scan for user %#v", username)
+	}
+	deadline := time.Now().Add(time.Duration(Config.QuotaScanTransfersGrace) * time.Second)
+	for conns.HasActiveUploads(username) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("uploads still in progress after %v seconds", Config.QuotaScanTransfersGrace)
+		}
+		time.Sleep(activeUploadsCheckInterval)
+	}
+	return nil
+}
+
 // Add adds a new connection to the active ones
 func (conns *ActiveConnections) Add(c ActiveConnection) {
 	conns.Lock()
@@ -660,6 +899,99 @@ func (conns *ActiveConnections) Close(connectionID string) bool {
 	return result
 }
 
+// CloseUserConnections closes all the active connections for the given username,
+// for any protocol. The active transfers are aborted before disconnecting and the
+// SSH connections associated to the closed channels are closed too, this way a
+// client cannot open new channels.
+// It returns the number of closed connections
+func (conns *ActiveConnections) CloseUserConnections(username string) int {
+	return conns.closeUserConnections(username, func(protocol string) bool {
+		return true
+	})
+}
+
+// CheckSingleSession enforces the single session policy, if any, configured for the
+// given user before adding a new session for the specified protocol.
+// SFTP, SCP and SSH commands are considered the same protocol since they share the
+// same SSH connection. An error is returned if the new session must be refused
+func (conns *ActiveConnections) CheckSingleSession(user *dataprovider.User, protocol string) error {
+	switch user.Filters.SingleSessionPolicy {
+	case sdk.SingleSessionRefuse:
+		numSessions := 0
+		conns.RLock()
+		for _, c := range conns.connections {
+			if c.GetUsername() == user.Username && isSameLoginProtocol(c.GetProtocol(), protocol) {
+				numSessions++
+			}
+		}
+		conns.RUnlock()
+		if numSessions > 0 {
+			return fmt.Errorf("%w: another %v session is active for user %#v", ErrConnectionDenied, protocol, user.Username)
+		}
+	case sdk.SingleSessionEvict:
+		numClosed := conns.closeUserConnections(user.Username, func(p string) bool {
+			return isSameLoginProtocol(p, protocol)
+		})
+		if numClosed > 0 {
+			logger.Info(logSender, "", "closed %v %v session/s for user %#v, single session policy: %v", numClosed,
+				protocol, user.Username, user.Filters.SingleSessionPolicy)
+		}
+	}
+	return nil
+}
+
+func (conns *ActiveConnections) closeUserConnections(username string, isProtocolMatching func(string) bool) int {
+	var toClose []ActiveConnection
+	var sshToClose []*SSHConnection
+
+	conns.RLock()
+	for _, c := range conns.connections {
+		if c.GetUsername() == username && isProtocolMatching(c.GetProtocol()) {
+			toClose = append(toClose, c)
+		}
+	}
+	for _, sshConn := range conns.sshConnections {
+		idToMatch := fmt.Sprintf("_%v_", sshConn.GetID())
+		for _, c := range toClose {
+			if strings.Contains(c.GetID(), idToMatch) {
+				sshToClose = append(sshToClose, sshConn)
+				break
+			}
+		}
+	}
+	conns.RUnlock()
+
+	for _, c := range toClose {
+		errAbort := c.SignalTransfersAbort()
+		err := c.Disconnect()
+		logger.Info(c.GetProtocol(), c.GetID(), "close connection requested for user %#v, transfers abort err: %v, close err: %v",
+			username, errAbort, err)
+	}
+	for _, sshConn := range sshToClose {
+		err := sshConn.Close()
+		logger.Debug(logSender, sshConn.GetID(), "close SSH connection requested for user %#v, close err: %v", username, err)
+	}
+	return len(toClose)
+}
+
+// getLoginProtocol returns the protocol used to login for the given connection protocol
+func getLoginProtocol(protocol string) string {
+	if util.IsStringInSlice(protocol, []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH}) {
+		return ProtocolSSH
+	}
+	return protocol
+}
+
+// isSameLoginProtocol returns true if the given protocols share the same login,
+// SFTP, SCP and SSH commands are all served over SSH
+func isSameLoginProtocol(protocol1, protocol2 string) bool {
+	sshProtocols := []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH}
+	if util.IsStringInSlice(protocol1, sshProtocols) {
+		return util.IsStringInSlice(protocol2, sshProtocols)
+	}
+	return protocol1 == protocol2
+}
+
 // AddSSHConnection adds a new ssh connection to the active ones
 func (conns *ActiveConnections) AddSSHConnection(c *SSHConnection) {
 	conns.Lock()
@@ -722,11 +1054,11 @@ func (conns *ActiveConnections) checkIdles() {
 				logger.Debug(conn.GetProtocol(), conn.GetID(), "close idle connection, idle time: %v, username: %#v close err: %v",
 					time.Since(conn.GetLastActivity()), conn.GetUsername(), err)
 				if isFTPNoAuth {
-					ip := util.GetIPFromRemoteAddress(c.GetRemoteAddress())
-					logger.ConnectionFailedLog("", ip, dataprovider.LoginMethodNoAuthTryed, c.GetProtocol(), "client idle")
+					ip := util.GetIPFromRemoteAddress(conn.GetRemoteAddress())
+					logger.ConnectionFailedLog("", ip, dataprovider.LoginMethodNoAuthTryed, conn.GetProtocol(), "client idle")
 					metric.AddNoAuthTryed()
-					AddDefenderEvent(ip, HostEventNoLoginTried)
-					dataprovider.ExecutePostLoginHook(&dataprovider.User{}, dataprovider.LoginMethodNoAuthTryed, ip, c.GetProtocol(),
+					AddDefenderEvent(ip, conn.GetProtocol(), HostEventNoLoginTried)
+					dataprovider.ExecutePostLoginHook(&dataprovider.User{}, dataprovider.LoginMethodNoAuthTryed, ip, conn.GetProtocol(),
 						dataprovider.ErrNoAuthTryed)
 				}
 			}(c, isUnauthenticatedFTPUser)
@@ -751,8 +1083,9 @@ func (conns *ActiveConnections) GetClientConnections() int32 {
 	return conns.clients.getTotal()
 }
 
-// IsNewConnectionAllowed returns false if the maximum number of concurrent allowed connections is exceeded
-func (conns *ActiveConnections) IsNewConnectionAllowed(ipAddr string) bool {
+// IsNewConnectionAllowed returns false if the maximum number of concurrent allowed connections is exceeded.
+// The protocol is used to score the defender event, if any
+func (conns *ActiveConnections) IsNewConnectionAllowed(ipAddr, protocol string) bool {
 	if Config.MaxTotalConnections == 0 && Config.MaxPerHostConnections == 0 {
 		return true
 	}
@@ -760,7 +1093,7 @@ func (conns *ActiveConnections) IsNewConnectionAllowed(ipAddr string) bool {
 	if Config.MaxPerHostConnections > 0 {
 		if total := conns.clients.getTotalFrom(ipAddr); total > Config.MaxPerHostConnections {
 			logger.Debug(logSender, "", "active connections from %v %v/%v", ipAddr, total, Config.MaxPerHostConnections)
-			AddDefenderEvent(ipAddr, HostEventLimitExceeded)
+			AddDefenderEvent(ipAddr, protocol, HostEventLimitExceeded)
 			return false
 		}
 	}
@@ -790,22 +1123,39 @@ func (conns *ActiveConnections) GetStats() []*ConnectionStatus {
 
 	stats := make([]*ConnectionStatus, 0, len(conns.connections))
 	for _, c := range conns.connections {
-		stat := &ConnectionStatus{
-			Username:       c.GetUsername(),
-			ConnectionID:   c.GetID(),
-			ClientVersion:  c.GetClientVersion(),
-			RemoteAddress:  c.GetRemoteAddress(),
-			ConnectionTime: util.GetTimeAsMsSinceEpoch(c.GetConnectionTime()),
-			LastActivity:   util.GetTimeAsMsSinceEpoch(c.GetLastActivity()),
-			Protocol:       c.GetProtocol(),
-			Command:        c.GetCommand(),
-			Transfers:      c.GetTransfers(),
-		}
-		stats = append(stats, stat)
+		stats = append(stats, getConnectionStatus(c))
 	}
 	return stats
 }
 
+// GetUserStats returns stats for the active connections of the given username
+func (conns *ActiveConnections) GetUserStats(username string) []*ConnectionStatus {
+	conns.RLock()
+	defer conns.RUnlock()
+
+	stats := make([]*ConnectionStatus, 0)
+	for _, c := range conns.connections {
+		if c.GetUsername() == username {
+			stats = append(stats, getConnectionStatus(c))
+		}
+	}
+	return stats
+}
+
+func getConnectionStatus(c ActiveConnection) *ConnectionStatus {
+	return &ConnectionStatus{
+		Username:       c.GetUsername(),
+		ConnectionID:   c.GetID(),
+		ClientVersion:  c.GetClientVersion(),
+		RemoteAddress:  c.GetRemoteAddress(),
+		ConnectionTime: util.GetTimeAsMsSinceEpoch(c.GetConnectionTime()),
+		LastActivity:   util.GetTimeAsMsSinceEpoch(c.GetLastActivity()),
+		Protocol:       c.GetProtocol(),
+		Command:        c.GetCommand(),
+		Transfers:      c.GetTransfers(),
+	}
+}
+
 // ConnectionStatus returns the status for an active connection
 type ConnectionStatus struct {
 	// Logged in username
@@ -873,6 +1223,8 @@ type ActiveQuotaScan struct {
 	Username string `json:"username"`
 	// quota scan start time as unix timestamp in milliseconds
 	StartTime int64 `json:"start_time"`
+	// true if new uploads are refused until the scan completes
+	uploadsBlocked bool
 }
 
 // ActiveVirtualFolderQuotaScan defines an active quota scan for a virtual folder
@@ -918,6 +1270,35 @@ func (s *ActiveScans) AddUserQuotaScan(username string) bool {
 	return true
 }
 
+// blockUserUploads refuses the new uploads for the given user until its quota
+// scan is removed. Returns false if the user has no active quota scan
+func (s *ActiveScans) blockUserUploads(username string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for idx := range s.UserHomeScans {
+		if s.UserHomeScans[idx].Username == username {
+			s.UserHomeScans[idx].uploadsBlocked = true
+			return true
+		}
+	}
+	return false
+}
+
+// areUserUploadsBlocked returns true if the given user has an active quota scan
+// that refuses new uploads
+func (s *ActiveScans) areUserUploadsBlocked(username string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, scan := range s.UserHomeScans {
+		if scan.Username == username {
+			return scan.uploadsBlocked
+		}
+	}
+	return false
+}
+
 // RemoveUserQuotaScan removes a user from the ones with active quota scans.
 // Returns false if the user has no active quota scans
 func (s *ActiveScans) RemoveUserQuotaScan(username string) bool {
@@ -131,7 +131,7 @@ func TestDefenderIntegration(t *testing.T) {
 
 	assert.Nil(t, ReloadDefender())
 
-	AddDefenderEvent(ip, HostEventNoLoginTried)
+	AddDefenderEvent(ip, ProtocolSSH, HostEventNoLoginTried)
 	assert.False(t, IsBanned(ip))
 
 	assert.Nil(t, GetDefenderBanTime(ip))
@@ -139,6 +139,8 @@ func TestDefenderIntegration(t *testing.T) {
 	assert.Equal(t, 0, GetDefenderScore(ip))
 	_, err := GetDefenderHost(ip)
 	assert.Error(t, err)
+	_, err = ExplainDefenderBan(ip)
+	assert.Error(t, err)
 	assert.Nil(t, GetDefenderHosts())
 
 	Config.DefenderConfig = DefenderConfig{
@@ -159,22 +161,27 @@ func TestDefenderIntegration(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, ReloadDefender())
 
-	AddDefenderEvent(ip, HostEventNoLoginTried)
+	AddDefenderEvent(ip, ProtocolSSH, HostEventNoLoginTried)
 	assert.False(t, IsBanned(ip))
 	assert.Equal(t, 2, GetDefenderScore(ip))
 	entry, err := GetDefenderHost(ip)
 	assert.NoError(t, err)
 	asJSON, err := json.Marshal(&entry)
 	assert.NoError(t, err)
-	assert.Equal(t, `{"id":"3132372e312e312e31","ip":"127.1.1.1","score":2}`, string(asJSON), "entry %v", entry)
+	assert.Equal(t, `{"id":"3132372e312e312e31","ip":"127.1.1.1","score":2,"events":{"no_login_tried":1}}`, string(asJSON), "entry %v", entry)
 	assert.True(t, DeleteDefenderHost(ip))
 	assert.Nil(t, GetDefenderBanTime(ip))
 
-	AddDefenderEvent(ip, HostEventLoginFailed)
-	AddDefenderEvent(ip, HostEventNoLoginTried)
+	AddDefenderEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	AddDefenderEvent(ip, ProtocolSSH, HostEventNoLoginTried)
 	assert.True(t, IsBanned(ip))
 	assert.Equal(t, 0, GetDefenderScore(ip))
 	assert.NotNil(t, GetDefenderBanTime(ip))
+	explanation, err := ExplainDefenderBan(ip)
+	assert.NoError(t, err)
+	assert.Equal(t, BanReasonScore, explanation.Reason)
+	assert.Equal(t, 3, explanation.Score)
+	assert.Len(t, explanation.Events, 2)
 	assert.Len(t, GetDefenderHosts(), 1)
 	entry, err = GetDefenderHost(ip)
 	assert.NoError(t, err)
@@ -187,6 +194,63 @@ func TestDefenderIntegration(t *testing.T) {
 	Config = configCopy
 }
 
+func TestAbusiveActivityDetection(t *testing.T) {
+	configCopy := Config
+
+	Config.DefenderConfig = DefenderConfig{
+		Enabled:              true,
+		BanTime:              10,
+		BanTimeIncrement:     50,
+		Threshold:            5,
+		ScoreInvalid:         2,
+		ScoreValid:           1,
+		ScoreAbusiveActivity: 3,
+		AbusiveDownloads:     2,
+		AbusiveListings:      1,
+		ObservationTime:      15,
+		EntriesSoftLimit:     100,
+		EntriesHardLimit:     150,
+	}
+	err := Initialize(Config)
+	require.NoError(t, err)
+
+	ip := "127.1.1.2"
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: userTestUsername,
+			HomeDir:  os.TempDir(),
+		},
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	conn := NewBaseConnection("", ProtocolSFTP, "", ip+":1234", u)
+	_, err = conn.ListDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, GetDefenderScore(ip))
+	_, err = conn.ListDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, GetDefenderScore(ip))
+	// the counter restarts after an abusive activity event
+	_, err = conn.ListDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, GetDefenderScore(ip))
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	for i := 0; i < 2; i++ {
+		tr := NewBaseTransfer(nil, conn, nil, "/p", "/p", "/r", TransferDownload, 0, 0, 0, false, fs)
+		assert.NoError(t, tr.Close())
+	}
+	// uploads are not counted
+	tr := NewBaseTransfer(nil, conn, nil, "/p", "/p", "/r", TransferUpload, 0, 0, 0, false, fs)
+	assert.NoError(t, tr.Close())
+	assert.Equal(t, 3, GetDefenderScore(ip))
+	tr = NewBaseTransfer(nil, conn, nil, "/p", "/p", "/r", TransferDownload, 0, 0, 0, false, fs)
+	assert.NoError(t, tr.Close())
+	assert.True(t, IsBanned(ip))
+
+	Config = configCopy
+}
+
 func TestRateLimitersIntegration(t *testing.T) {
 	// by default defender is nil
 	configCopy := Config
@@ -253,30 +317,30 @@ func TestMaxConnections(t *testing.T) {
 	Config.MaxPerHostConnections = 0
 
 	ipAddr := "192.168.7.8"
-	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 
 	Config.MaxTotalConnections = 1
 	Config.MaxPerHostConnections = perHost
 
-	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 	c := NewBaseConnection("id", ProtocolSFTP, "", "", dataprovider.User{})
 	fakeConn := &fakeConnection{
 		BaseConnection: c,
 	}
 	Connections.Add(fakeConn)
 	assert.Len(t, Connections.GetStats(), 1)
-	assert.False(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.False(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 
 	res := Connections.Close(fakeConn.GetID())
 	assert.True(t, res)
 	assert.Eventually(t, func() bool { return len(Connections.GetStats()) == 0 }, 300*time.Millisecond, 50*time.Millisecond)
 
-	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 	Connections.AddClientConnection(ipAddr)
 	Connections.AddClientConnection(ipAddr)
-	assert.False(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.False(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 	Connections.RemoveClientConnection(ipAddr)
-	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 	Connections.RemoveClientConnection(ipAddr)
 
 	Config.MaxTotalConnections = oldValue
@@ -289,13 +353,13 @@ func TestMaxConnectionPerHost(t *testing.T) {
 
 	ipAddr := "192.168.9.9"
 	Connections.AddClientConnection(ipAddr)
-	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 
 	Connections.AddClientConnection(ipAddr)
-	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.True(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 
 	Connections.AddClientConnection(ipAddr)
-	assert.False(t, Connections.IsNewConnectionAllowed(ipAddr))
+	assert.False(t, Connections.IsNewConnectionAllowed(ipAddr, ProtocolSSH))
 	assert.Equal(t, int32(3), Connections.GetClientConnections())
 
 	Connections.RemoveClientConnection(ipAddr)
@@ -396,7 +460,7 @@ func TestCloseConnection(t *testing.T) {
 	fakeConn := &fakeConnection{
 		BaseConnection: c,
 	}
-	assert.True(t, Connections.IsNewConnectionAllowed("127.0.0.1"))
+	assert.True(t, Connections.IsNewConnectionAllowed("127.0.0.1", ProtocolSSH))
 	Connections.Add(fakeConn)
 	assert.Len(t, Connections.GetStats(), 1)
 	res := Connections.Close(fakeConn.GetID())
@@ -793,3 +857,45 @@ func BenchmarkCompareArgon2Password(b *testing.B) {
 		}
 	}
 }
+
+func TestQuotaDriftConfig(t *testing.T) {
+	c := QuotaDriftConfig{}
+	assert.False(t, c.isEnabled())
+	c.CheckInterval = 10
+	assert.True(t, c.isEnabled())
+	assert.Error(t, c.validate())
+	c.BatchSize = 10
+	c.FilesThreshold = -1
+	assert.Error(t, c.validate())
+	c.FilesThreshold = 1
+	c.SizeThreshold = -1
+	assert.Error(t, c.validate())
+	c.SizeThreshold = 100
+	assert.NoError(t, c.validate())
+
+	assert.False(t, c.isDrift(10, 11, 1000, 1100))
+	assert.False(t, c.isDrift(11, 10, 1100, 1000))
+	assert.True(t, c.isDrift(10, 12, 1000, 1000))
+	assert.True(t, c.isDrift(10, 10, 1000, 1101))
+	assert.True(t, c.isDrift(10, 10, 1101, 1000))
+
+	assert.Equal(t, 10, getNextQuotaDriftOffset(0, 10, 10))
+	assert.Equal(t, 20, getNextQuotaDriftOffset(10, 10, 10))
+	assert.Equal(t, 0, getNextQuotaDriftOffset(20, 3, 10))
+
+	configCopy := Config
+	Config.QuotaDrift = QuotaDriftConfig{
+		CheckInterval: 10,
+	}
+	err := Initialize(Config)
+	assert.Error(t, err)
+	Config.QuotaDrift.BatchSize = 10
+	err = Initialize(Config)
+	assert.NoError(t, err)
+	assert.NotNil(t, quotaDriftTicker)
+
+	Config = configCopy
+	err = Initialize(Config)
+	assert.NoError(t, err)
+	assert.Nil(t, quotaDriftTicker)
+}
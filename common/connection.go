@@ -3,8 +3,10 @@ package common
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +22,35 @@ import (
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
 
+// maximum number of suffixes to try to find a non colliding name for an upload
+const maxUploadCollisionSuffix = 1000
+
+// Supported reasons for a denied rename
+const (
+	RenameDeniedPermission  = "permission_denied"
+	RenameDeniedQuota       = "quota_exceeded"
+	RenameDeniedUnsupported = "unsupported"
+	RenameDeniedError       = "error"
+)
+
+// RenameCheckResult defines the result for a rename pre-flight check
+type RenameCheckResult struct {
+	Allowed bool
+	// Reason for the denial, empty if the rename is allowed
+	Reason string
+	// Err is the error Rename would return to the client
+	Err error
+}
+
+type renameCheck struct {
+	fsSrc        vfs.Fs
+	fsDst        vfs.Fs
+	fsSourcePath string
+	fsTargetPath string
+	// size of the overwritten target file, -1 if the target does not exist
+	initialSize int64
+}
+
 // BaseConnection defines common fields for a connection using any supported protocol
 type BaseConnection struct {
 	// last activity for this connection.
@@ -37,6 +68,10 @@ type BaseConnection struct {
 	sync.RWMutex
 	transferID      uint64
 	activeTransfers []ActiveTransfer
+	// downloads and directory listings within the current minute, they are
+	// used to detect abusive activities
+	downloads activityCounter
+	listings  activityCounter
 }
 
 // NewBaseConnection returns a new BaseConnection
@@ -45,6 +80,7 @@ func NewBaseConnection(id, protocol, localAddr, remoteAddr string, user dataprov
 	if util.IsStringInSlice(protocol, supportedProtocols) {
 		connID = fmt.Sprintf("%v_%v", protocol, id)
 	}
+	user.SetLoginProtocol(getLoginProtocol(protocol))
 	return &BaseConnection{
 		ID:           connID,
 		User:         user,
@@ -82,6 +118,11 @@ func (c *BaseConnection) GetProtocol() string {
 	return c.protocol
 }
 
+// GetBanner returns the banner to show for this connection
+func (c *BaseConnection) GetBanner() string {
+	return GetBanner(c.protocol, &c.User)
+}
+
 // SetProtocol sets the protocol for this connection
 func (c *BaseConnection) SetProtocol(protocol string) {
 	c.protocol = protocol
@@ -112,11 +153,20 @@ func (c *BaseConnection) CloseFS() error {
 
 // AddTransfer associates a new transfer to this connection
 func (c *BaseConnection) AddTransfer(t ActiveTransfer) {
-	c.Lock()
-	defer c.Unlock()
+	limit := Config.DefenderConfig.AbusiveDownloads
+	isAbusive := false
 
+	c.Lock()
 	c.activeTransfers = append(c.activeTransfers, t)
 	c.Log(logger.LevelDebug, "transfer added, id: %v, active transfers: %v", t.GetID(), len(c.activeTransfers))
+	if limit > 0 && t.GetType() == TransferDownload {
+		isAbusive = c.downloads.add(limit)
+	}
+	c.Unlock()
+
+	if isAbusive {
+		c.AddAbusiveActivityEvent(fmt.Sprintf("more than %v downloads within a minute", limit))
+	}
 }
 
 // RemoveTransfer removes the specified transfer from the active ones
@@ -154,14 +204,25 @@ func (c *BaseConnection) GetTransfers() []ConnectionTransfer {
 			operationType = operationDownload
 		case TransferUpload:
 			operationType = operationUpload
+		case TransferCopy:
+			operationType = operationCopy
 		}
-		transfers = append(transfers, ConnectionTransfer{
+		transfer := ConnectionTransfer{
 			ID:            t.GetID(),
 			OperationType: operationType,
 			StartTime:     util.GetTimeAsMsSinceEpoch(t.GetStartTime()),
 			Size:          t.GetSize(),
 			VirtualPath:   t.GetVirtualPath(),
-		})
+		}
+		if ct, ok := t.(*copyTransfer); ok {
+			transfer.Files = ct.GetFilesDone()
+		}
+		if st, ok := t.(streamedTransfer); ok {
+			if uploaded := st.GetUploadedSize(); uploaded >= 0 {
+				transfer.UploadedSize = &uploaded
+			}
+		}
+		transfers = append(transfers, transfer)
 	}
 
 	return transfers
@@ -222,7 +283,66 @@ func (c *BaseConnection) ListDir(virtualPath string) ([]os.FileInfo, error) {
 		c.Log(logger.LevelWarn, "error listing directory: %+v", err)
 		return nil, c.GetFsError(fs, err)
 	}
-	return c.User.AddVirtualDirs(files, virtualPath), nil
+	files = c.filterHiddenEntries(c.User.AddVirtualDirs(files, virtualPath), virtualPath)
+	sortDirEntries(files, c.User.Filters.DirListingSort)
+	if limit := Config.DefenderConfig.AbusiveListings; limit > 0 {
+		c.Lock()
+		isAbusive := c.listings.add(limit)
+		c.Unlock()
+		if isAbusive {
+			c.AddAbusiveActivityEvent(fmt.Sprintf("more than %v directory listings within a minute", limit))
+		}
+	}
+	return files, nil
+}
+
+// filterHiddenEntries removes the entries matching the user hidden patterns
+func (c *BaseConnection) filterHiddenEntries(files []os.FileInfo, virtualPath string) []os.FileInfo {
+	if len(c.User.Filters.HiddenPatterns) == 0 {
+		return files
+	}
+	result := make([]os.FileInfo, 0, len(files))
+	for _, fi := range files {
+		if c.User.IsPathHidden(path.Join(virtualPath, fi.Name())) {
+			continue
+		}
+		result = append(result, fi)
+	}
+	return result
+}
+
+// sortDirEntries sorts the given directory entries based on the specified sort order.
+// Entries with the same sort key are sorted by name so the order is deterministic
+func sortDirEntries(files []os.FileInfo, sortOrder sdk.DirListingSort) {
+	switch sortOrder {
+	case sdk.DirListingSortName:
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Name() < files[j].Name()
+		})
+	case sdk.DirListingSortNameInsensitive:
+		sort.SliceStable(files, func(i, j int) bool {
+			nameI := strings.ToLower(files[i].Name())
+			nameJ := strings.ToLower(files[j].Name())
+			if nameI == nameJ {
+				return files[i].Name() < files[j].Name()
+			}
+			return nameI < nameJ
+		})
+	case sdk.DirListingSortSize:
+		sort.SliceStable(files, func(i, j int) bool {
+			if files[i].Size() == files[j].Size() {
+				return files[i].Name() < files[j].Name()
+			}
+			return files[i].Size() < files[j].Size()
+		})
+	case sdk.DirListingSortModTime:
+		sort.SliceStable(files, func(i, j int) bool {
+			if files[i].ModTime().Equal(files[j].ModTime()) {
+				return files[i].Name() < files[j].Name()
+			}
+			return files[i].ModTime().Before(files[j].ModTime())
+		})
+	}
 }
 
 // CreateDir creates a new directory at the specified fsPath
@@ -359,64 +479,296 @@ func (c *BaseConnection) RemoveDir(virtualPath string) error {
 
 // Rename renames (moves) virtualSourcePath to virtualTargetPath
 func (c *BaseConnection) Rename(virtualSourcePath, virtualTargetPath string) error {
-	fsSrc, fsSourcePath, err := c.GetFsAndResolvedPath(virtualSourcePath)
+	check, _, err := c.checkRename(virtualSourcePath, virtualTargetPath)
 	if err != nil {
 		return err
 	}
-	fsDst, fsTargetPath, err := c.GetFsAndResolvedPath(virtualTargetPath)
+	fsSrc, fsDst := check.fsSrc, check.fsDst
+	fsSourcePath, fsTargetPath := check.fsSourcePath, check.fsTargetPath
+	if err := fsSrc.Rename(fsSourcePath, fsTargetPath); err != nil {
+		c.Log(logger.LevelWarn, "failed to rename %#v -> %#v: %+v", fsSourcePath, fsTargetPath, err)
+		return c.GetFsError(fsSrc, err)
+	}
+	vfs.SetPathPermissions(fsDst, fsTargetPath, c.User.GetUID(), c.User.GetGID())
+	c.updateQuotaAfterRename(fsDst, virtualSourcePath, virtualTargetPath, fsTargetPath, check.initialSize) //nolint:errcheck
+	logger.CommandLog(renameLogSender, fsSourcePath, fsTargetPath, c.User.Username, "", c.ID, c.protocol, -1, -1,
+		"", "", "", -1, c.localAddr, c.remoteAddr)
+	ExecuteActionNotification(&c.User, operationRename, fsSourcePath, virtualSourcePath, fsTargetPath, "", c.protocol, 0, nil)
+
+	return nil
+}
+
+// CanRename checks if virtualSourcePath can be renamed to virtualTargetPath.
+// The same permission and quota checks performed by Rename are executed,
+// but nothing is moved
+func (c *BaseConnection) CanRename(virtualSourcePath, virtualTargetPath string) RenameCheckResult {
+	_, reason, err := c.checkRename(virtualSourcePath, virtualTargetPath)
 	if err != nil {
-		return err
+		return RenameCheckResult{
+			Reason: reason,
+			Err:    err,
+		}
+	}
+	return RenameCheckResult{
+		Allowed: true,
 	}
+}
+
+// checkRename executes the checks required before renaming virtualSourcePath to virtualTargetPath.
+// If the rename is not allowed the denial reason and the error to return to the client are returned
+func (c *BaseConnection) checkRename(virtualSourcePath, virtualTargetPath string) (renameCheck, string, error) {
+	var check renameCheck
+	var err error
+
+	check.fsSrc, check.fsSourcePath, err = c.GetFsAndResolvedPath(virtualSourcePath)
+	if err != nil {
+		return check, RenameDeniedError, err
+	}
+	check.fsDst, check.fsTargetPath, err = c.GetFsAndResolvedPath(virtualTargetPath)
+	if err != nil {
+		return check, RenameDeniedError, err
+	}
+	fsSrc, fsDst := check.fsSrc, check.fsDst
+	fsSourcePath, fsTargetPath := check.fsSourcePath, check.fsTargetPath
 	srcInfo, err := fsSrc.Lstat(fsSourcePath)
 	if err != nil {
-		return c.GetFsError(fsSrc, err)
+		return check, RenameDeniedError, c.GetFsError(fsSrc, err)
 	}
 	if !c.isRenamePermitted(fsSrc, fsDst, fsSourcePath, fsTargetPath, virtualSourcePath, virtualTargetPath, srcInfo) {
-		return c.GetPermissionDeniedError()
+		return check, RenameDeniedPermission, c.GetPermissionDeniedError()
 	}
-	initialSize := int64(-1)
+	check.initialSize = -1
 	if dstInfo, err := fsDst.Lstat(fsTargetPath); err == nil {
 		if dstInfo.IsDir() {
 			c.Log(logger.LevelWarn, "attempted to rename %#v overwriting an existing directory %#v",
 				fsSourcePath, fsTargetPath)
-			return c.GetOpUnsupportedError()
+			return check, RenameDeniedUnsupported, c.GetOpUnsupportedError()
 		}
 		// we are overwriting an existing file/symlink
 		if dstInfo.Mode().IsRegular() {
-			initialSize = dstInfo.Size()
+			check.initialSize = dstInfo.Size()
 		}
 		if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(virtualTargetPath)) {
 			c.Log(logger.LevelDebug, "renaming %#v -> %#v is not allowed. Target exists but the user %#v"+
 				"has no overwrite permission", virtualSourcePath, virtualTargetPath, c.User.Username)
-			return c.GetPermissionDeniedError()
+			return check, RenameDeniedPermission, c.GetPermissionDeniedError()
 		}
 	}
 	if srcInfo.IsDir() {
 		if c.User.HasVirtualFoldersInside(virtualSourcePath) {
 			c.Log(logger.LevelDebug, "renaming the folder %#v is not supported: it has virtual folders inside it",
 				virtualSourcePath)
-			return c.GetOpUnsupportedError()
+			return check, RenameDeniedUnsupported, c.GetOpUnsupportedError()
 		}
 		if err = c.checkRecursiveRenameDirPermissions(fsSrc, fsDst, fsSourcePath, fsTargetPath); err != nil {
 			c.Log(logger.LevelDebug, "error checking recursive permissions before renaming %#v: %+v", fsSourcePath, err)
-			return err
+			if err == c.GetPermissionDeniedError() {
+				return check, RenameDeniedPermission, err
+			}
+			return check, RenameDeniedError, err
 		}
 	}
-	if !c.hasSpaceForRename(fsSrc, virtualSourcePath, virtualTargetPath, initialSize, fsSourcePath) {
+	if !c.hasSpaceForRename(fsSrc, virtualSourcePath, virtualTargetPath, check.initialSize, fsSourcePath) {
 		c.Log(logger.LevelInfo, "denying cross rename due to space limit")
-		return c.GetGenericError(ErrQuotaExceeded)
+		return check, RenameDeniedQuota, c.GetGenericError(ErrQuotaExceeded)
 	}
-	if err := fsSrc.Rename(fsSourcePath, fsTargetPath); err != nil {
-		c.Log(logger.LevelWarn, "failed to rename %#v -> %#v: %+v", fsSourcePath, fsTargetPath, err)
+	return check, "", nil
+}
+
+// HandleUploadCollision applies the user's upload collision policy for an upload to
+// virtualPath that already exists as a regular file.
+// It returns the filesystem and virtual paths to use for the upload, if they differ from the
+// given ones the upload must be handled as a new file. Resumed uploads continue on the
+// existing file for the auto suffix policy
+func (c *BaseConnection) HandleUploadCollision(fs vfs.Fs, fsPath, virtualPath string, isResume bool) (string, string, error) {
+	switch c.User.Filters.UploadCollisionPolicy {
+	case sdk.UploadCollisionReject:
+		c.Log(logger.LevelInfo, "upload to %#v rejected, the file already exists", virtualPath)
+		return "", "", c.GetPermissionDeniedError()
+	case sdk.UploadCollisionAutoSuffix:
+		if isResume {
+			return fsPath, virtualPath, nil
+		}
+		ext := path.Ext(virtualPath)
+		base := strings.TrimSuffix(virtualPath, ext)
+		for i := 1; i <= maxUploadCollisionSuffix; i++ {
+			candidate := fmt.Sprintf("%v(%v)%v", base, i, ext)
+			fsCandidate, err := fs.ResolvePath(candidate)
+			if err != nil {
+				return "", "", c.GetFsError(fs, err)
+			}
+			_, err = fs.Lstat(fsCandidate)
+			if fs.IsNotExist(err) {
+				c.Log(logger.LevelDebug, "upload to existing file %#v saved as %#v", virtualPath, candidate)
+				return fsCandidate, candidate, nil
+			}
+			if err != nil {
+				return "", "", c.GetFsError(fs, err)
+			}
+		}
+		c.Log(logger.LevelWarn, "unable to find a non colliding name for the upload to %#v", virtualPath)
+		return "", "", c.GetGenericError(fmt.Errorf("unable to find a non colliding name for %#v", path.Base(virtualPath)))
+	default:
+		return fsPath, virtualPath, nil
+	}
+}
+
+// Copy copies the regular file virtualSourcePath to virtualTargetPath.
+// If both paths are on the same filesystem and the backend supports it the
+// copy is done natively, otherwise the file contents are streamed from the
+// source to the target
+func (c *BaseConnection) Copy(virtualSourcePath, virtualTargetPath string) error {
+	if path.Clean(virtualSourcePath) == path.Clean(virtualTargetPath) {
+		c.Log(logger.LevelWarn, "copy %#v to itself is not supported", virtualSourcePath)
+		return c.GetOpUnsupportedError()
+	}
+	fsSrc, fsSourcePath, err := c.GetFsAndResolvedPath(virtualSourcePath)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := fsSrc.Lstat(fsSourcePath)
+	if err != nil {
 		return c.GetFsError(fsSrc, err)
 	}
-	vfs.SetPathPermissions(fsDst, fsTargetPath, c.User.GetUID(), c.User.GetGID())
-	c.updateQuotaAfterRename(fsDst, virtualSourcePath, virtualTargetPath, fsTargetPath, initialSize) //nolint:errcheck
-	logger.CommandLog(renameLogSender, fsSourcePath, fsTargetPath, c.User.Username, "", c.ID, c.protocol, -1, -1,
-		"", "", "", -1, c.localAddr, c.remoteAddr)
-	ExecuteActionNotification(&c.User, operationRename, fsSourcePath, virtualSourcePath, fsTargetPath, "", c.protocol, 0, nil)
+	if !srcInfo.Mode().IsRegular() {
+		c.Log(logger.LevelDebug, "cannot copy %#v, only regular files are supported", virtualSourcePath)
+		return c.GetOpUnsupportedError()
+	}
+	_, err = c.copyRegularFile(fsSrc, fsSourcePath, virtualSourcePath, virtualTargetPath, srcInfo.Size(), nil)
+	return err
+}
 
-	return nil
+// copyRegularFile checks permissions and quota and then copies a single regular file.
+// It returns the size of the replaced target file or -1 if the target is a new file
+func (c *BaseConnection) copyRegularFile(fsSrc vfs.Fs, fsSourcePath, virtualSourcePath, virtualTargetPath string,
+	size int64, transfer *copyTransfer) (int64, error) {
+	fsDst, fsTargetPath, err := c.GetFsAndResolvedPath(virtualTargetPath)
+	if err != nil {
+		return -1, err
+	}
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(virtualSourcePath)) ||
+		!c.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualTargetPath)) {
+		return -1, c.GetPermissionDeniedError()
+	}
+	if !c.User.IsFileAllowed(virtualSourcePath) || !c.User.IsFileAllowed(virtualTargetPath) {
+		c.Log(logger.LevelDebug, "copy %#v -> %#v is not allowed", virtualSourcePath, virtualTargetPath)
+		return -1, c.GetPermissionDeniedError()
+	}
+	initialSize := int64(-1)
+	if dstInfo, err := fsDst.Lstat(fsTargetPath); err == nil {
+		if dstInfo.IsDir() {
+			c.Log(logger.LevelWarn, "attempted to overwrite a directory with a file, source: %#v target: %#v",
+				virtualSourcePath, virtualTargetPath)
+			return -1, c.GetOpUnsupportedError()
+		}
+		if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(virtualTargetPath)) {
+			return -1, c.GetPermissionDeniedError()
+		}
+		if dstInfo.Mode().IsRegular() {
+			initialSize = dstInfo.Size()
+		}
+	} else if !fsDst.IsNotExist(err) {
+		return -1, c.GetFsError(fsDst, err)
+	}
+	quotaResult := c.HasSpace(true, false, virtualTargetPath)
+	if !c.hasSpaceForCrossRename(fsSrc, quotaResult, initialSize, fsSourcePath) {
+		c.Log(logger.LevelInfo, "copy not allowed, quota limit will be exceeded, source: %#v target: %#v",
+			virtualSourcePath, virtualTargetPath)
+		return -1, c.GetQuotaExceededError()
+	}
+	if err := c.copyFile(fsSrc, fsDst, fsSourcePath, fsTargetPath, virtualSourcePath, virtualTargetPath, transfer); err != nil {
+		c.Log(logger.LevelWarn, "failed to copy %#v -> %#v: %+v", fsSourcePath, fsTargetPath, err)
+		if initialSize == -1 {
+			// remove the partial target, if any
+			fsDst.Remove(fsTargetPath, false) //nolint:errcheck
+		}
+		return -1, c.GetFsError(fsDst, err)
+	}
+	c.updateQuotaAfterCopy(virtualTargetPath, initialSize, size)
+	logger.CommandLog(copyLogSender, fsSourcePath, fsTargetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "",
+		"", "", size, c.localAddr, c.remoteAddr)
+	return initialSize, nil
+}
+
+// copyFile uses a native copy, if supported, or streams the source file to the target.
+// If a copy transfer is given, the stream copy reports its progress and can be aborted
+func (c *BaseConnection) copyFile(fsSrc, fsDst vfs.Fs, fsSourcePath, fsTargetPath, virtualSourcePath,
+	virtualTargetPath string, transfer *copyTransfer) error {
+	if copier, ok := fsSrc.(vfs.FsCopier); ok && !c.isCrossFoldersRequest(virtualSourcePath, virtualTargetPath) {
+		err := copier.Copy(fsSourcePath, fsTargetPath)
+		if !errors.Is(err, vfs.ErrVfsUnsupported) {
+			if err == nil && transfer != nil {
+				if info, errStat := fsDst.Lstat(fsTargetPath); errStat == nil {
+					transfer.addBytes(info.Size())
+				}
+			}
+			return err
+		}
+		c.Log(logger.LevelDebug, "native copy not supported for %#v, fallback to a stream copy", fsSourcePath)
+	}
+	return c.streamCopy(fsSrc, fsDst, fsSourcePath, fsTargetPath, transfer)
+}
+
+func (c *BaseConnection) streamCopy(fsSrc, fsDst vfs.Fs, fsSourcePath, fsTargetPath string, transfer *copyTransfer) error {
+	srcFile, pipeReader, srcCancelFn, err := fsSrc.Open(fsSourcePath, 0)
+	if err != nil {
+		return err
+	}
+	var reader io.ReadCloser = pipeReader
+	if srcFile != nil {
+		reader = srcFile
+	}
+	defer reader.Close()
+
+	dstFile, pipeWriter, dstCancelFn, err := fsDst.Create(fsTargetPath, 0)
+	if err != nil {
+		if srcCancelFn != nil {
+			srcCancelFn()
+		}
+		return err
+	}
+	var writer io.WriteCloser = pipeWriter
+	if dstFile != nil {
+		writer = dstFile
+	}
+
+	var src io.Reader = reader
+	if transfer != nil {
+		src = &copyProgressReader{Reader: reader, transfer: transfer}
+	}
+	_, err = io.Copy(writer, src)
+	if err != nil {
+		if srcCancelFn != nil {
+			srcCancelFn()
+		}
+		if dstCancelFn != nil {
+			dstCancelFn()
+		}
+		writer.Close() //nolint:errcheck
+		return err
+	}
+	return writer.Close()
+}
+
+func (c *BaseConnection) updateQuotaAfterCopy(virtualTargetPath string, initialSize, size int64) {
+	numFiles := 1
+	if initialSize != -1 {
+		numFiles = 0
+		size -= initialSize
+	}
+	c.updateQuotaForPath(virtualTargetPath, numFiles, size)
+}
+
+func (c *BaseConnection) updateQuotaForPath(virtualPath string, numFiles int, size int64) {
+	vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
+	if err == nil {
+		dataprovider.UpdateVirtualFolderQuota(&vfolder.BaseVirtualFolder, numFiles, size, false) //nolint:errcheck
+		if vfolder.IsIncludedInUserQuota() {
+			dataprovider.UpdateUserQuota(&c.User, numFiles, size, false) //nolint:errcheck
+		}
+	} else {
+		dataprovider.UpdateUserQuota(&c.User, numFiles, size, false) //nolint:errcheck
+	}
 }
 
 // CreateSymlink creates fsTargetPath as a symbolic link to fsSourcePath
@@ -466,6 +818,9 @@ func (c *BaseConnection) getPathForSetStatPerms(fs vfs.Fs, fsPath, virtualPath s
 
 // DoStat execute a Stat if mode = 0, Lstat if mode = 1
 func (c *BaseConnection) DoStat(virtualPath string, mode int) (os.FileInfo, error) {
+	if c.User.IsPathHidden(virtualPath) {
+		return nil, c.GetNotExistError()
+	}
 	// for some vfs we don't create intermediary folders so we cannot simply check
 	// if virtualPath is a virtual folder
 	vfolders := c.User.GetVirtualFoldersInPath(path.Dir(virtualPath))
@@ -494,11 +849,26 @@ func (c *BaseConnection) DoStat(virtualPath string, mode int) (os.FileInfo, erro
 	return info, nil
 }
 
+// getSetstatMode returns the user specific setstat mode, if any, or the global one
+func (c *BaseConnection) getSetstatMode() int {
+	switch c.User.Filters.SetstatMode {
+	case sdk.SetstatModeNormal:
+		return 0
+	case sdk.SetstatModeIgnore:
+		return 1
+	case sdk.SetstatModeIgnoreCloud:
+		return 2
+	default:
+		return Config.SetstatMode
+	}
+}
+
 func (c *BaseConnection) ignoreSetStat(fs vfs.Fs) bool {
-	if Config.SetstatMode == 1 {
+	setstatMode := c.getSetstatMode()
+	if setstatMode == 1 {
 		return true
 	}
-	if Config.SetstatMode == 2 && !vfs.IsLocalOrSFTPFs(fs) && !vfs.IsCryptOsFs(fs) {
+	if setstatMode == 2 && !vfs.IsLocalOrSFTPFs(fs) && !vfs.IsCryptOsFs(fs) {
 		return true
 	}
 	return false
@@ -842,20 +1212,36 @@ func (c *BaseConnection) HasSpace(checkFiles, getUsage bool, requestPath string)
 	}
 	var err error
 	var vfolder vfs.VirtualFolder
+	// empty if the quota to check is the user's one
+	var quotaFolder string
 	vfolder, err = c.User.GetVirtualFolderForPath(path.Dir(requestPath))
 	if err == nil && !vfolder.IsIncludedInUserQuota() {
+		// the folder has its own quota, the user's quota is not checked
 		if vfolder.HasNoQuotaRestrictions(checkFiles) && !getUsage {
 			return result
 		}
+		quotaFolder = vfolder.Name
 		result.QuotaSize = vfolder.QuotaSize
 		result.QuotaFiles = vfolder.QuotaFiles
 		result.UsedFiles, result.UsedSize, err = dataprovider.GetUsedVirtualFolderQuota(vfolder.Name)
 	} else {
-		if c.User.HasNoQuotaRestrictions(checkFiles) && !getUsage {
+		if c.User.Filters.DisableQuotaTracking {
+			// quota is not tracked for this user, it is treated as unlimited
 			return result
 		}
-		result.QuotaSize = c.User.QuotaSize
-		result.QuotaFiles = c.User.QuotaFiles
+		if !getUsage && QuotaScans.areUserUploadsBlocked(c.User.Username) {
+			// the upload would be counted twice: by the scan and on completion
+			c.Log(logger.LevelInfo, "quota scan in progress for user %#v, request path %#v refused",
+				c.User.Username, requestPath)
+			result.HasSpace = false
+			return result
+		}
+		quotaSize, quotaFiles := c.getUserQuota()
+		if quotaSize == 0 && (!checkFiles || quotaFiles == 0) && !getUsage {
+			return result
+		}
+		result.QuotaSize = quotaSize
+		result.QuotaFiles = quotaFiles
 		result.UsedFiles, result.UsedSize, err = dataprovider.GetUsedQuota(c.User.Username)
 	}
 	if err != nil {
@@ -867,14 +1253,24 @@ func (c *BaseConnection) HasSpace(checkFiles, getUsage bool, requestPath string)
 	result.AllowedSize = result.QuotaSize - result.UsedSize
 	if (checkFiles && result.QuotaFiles > 0 && result.UsedFiles >= result.QuotaFiles) ||
 		(result.QuotaSize > 0 && result.UsedSize >= result.QuotaSize) {
-		c.Log(logger.LevelDebug, "quota exceed for user %#v, request path %#v, num files: %v/%v, size: %v/%v check files: %v",
-			c.User.Username, requestPath, result.UsedFiles, result.QuotaFiles, result.UsedSize, result.QuotaSize, checkFiles)
+		c.Log(logger.LevelDebug, "quota exceed for user %#v, virtual folder %#v, request path %#v, num files: %v/%v, size: %v/%v check files: %v",
+			c.User.Username, quotaFolder, requestPath, result.UsedFiles, result.QuotaFiles, result.UsedSize, result.QuotaSize, checkFiles)
 		result.HasSpace = false
 		return result
 	}
 	return result
 }
 
+// getUserQuota returns the quota size and files to enforce for the connection user,
+// the configured default quota is applied to users without an explicit quota.
+// No quota is enforced if quota tracking is disabled for the user
+func (c *BaseConnection) getUserQuota() (int64, int) {
+	if c.User.Filters.DisableQuotaTracking {
+		return 0, 0
+	}
+	return Config.DefaultQuota.getQuota(c.User.QuotaSize, c.User.QuotaFiles)
+}
+
 // returns true if this is a rename on the same fs or local virtual folders
 func (c *BaseConnection) isLocalOrSameFolderRename(virtualSourcePath, virtualTargetPath string) bool {
 	sourceFolder, errSrc := c.User.GetVirtualFolderForPath(virtualSourcePath)
@@ -893,7 +1289,7 @@ func (c *BaseConnection) isLocalOrSameFolderRename(virtualSourcePath, virtualTar
 		}
 		return false
 	}
-	if c.User.FsConfig.Provider != sdk.LocalFilesystemProvider {
+	if c.User.GetFsConfigForPath("/").Provider != sdk.LocalFilesystemProvider {
 		return false
 	}
 	if errSrc == nil {
@@ -1067,6 +1463,38 @@ func (c *BaseConnection) GetOpUnsupportedError() error {
 	}
 }
 
+// activityCounter counts the activities within a one minute window
+type activityCounter struct {
+	windowStart time.Time
+	count       int
+}
+
+// add counts a new activity and returns true if the given limit is exceeded
+// within the current window. The counter restarts after exceeding the limit,
+// so the limit must be exceeded again to report another event
+func (a *activityCounter) add(limit int) bool {
+	now := time.Now()
+	if now.Sub(a.windowStart) > time.Minute {
+		a.windowStart = now
+		a.count = 0
+	}
+	a.count++
+	if a.count > limit {
+		a.windowStart = now
+		a.count = 0
+		return true
+	}
+	return false
+}
+
+// AddAbusiveActivityEvent reports an abusive activity, detected after a successful
+// authentication, to the defender. The event is scored only if configured
+func (c *BaseConnection) AddAbusiveActivityEvent(reason string) {
+	ip := util.GetIPFromRemoteAddress(c.remoteAddr)
+	c.Log(logger.LevelInfo, "abusive activity detected for user %#v, ip %v: %v", c.User.Username, ip, reason)
+	AddDefenderEvent(ip, c.protocol, HostEventAbusiveActivity)
+}
+
 // GetQuotaExceededError returns an appropriate storage limit exceeded error for the connection protocol
 func (c *BaseConnection) GetQuotaExceededError() error {
 	switch c.protocol {
@@ -1079,6 +1507,17 @@ func (c *BaseConnection) GetQuotaExceededError() error {
 	}
 }
 
+// GetServerBusyError returns an appropriate error for the connection protocol if
+// the server wide limit for concurrent transfers is reached
+func (c *BaseConnection) GetServerBusyError() error {
+	switch c.protocol {
+	case ProtocolSFTP:
+		return fmt.Errorf("%w: %v", sftp.ErrSSHFxFailure, ErrServerBusy.Error())
+	default:
+		return ErrServerBusy
+	}
+}
+
 // IsQuotaExceededError returns true if the given error is a quota exceeded error
 func (c *BaseConnection) IsQuotaExceededError(err error) bool {
 	switch c.protocol {
@@ -1136,6 +1575,12 @@ func (c *BaseConnection) GetFsError(fs vfs.Fs, err error) error {
 
 // GetFsAndResolvedPath returns the fs and the fs path matching virtualPath
 func (c *BaseConnection) GetFsAndResolvedPath(virtualPath string) (vfs.Fs, string, error) {
+	// redundant and trailing slashes must not change the matching virtual folder
+	virtualPath = util.RemoveRedundantSlashes(virtualPath)
+	if c.User.IsPathHidden(virtualPath) {
+		c.Log(logger.LevelDebug, "access to hidden path %#v denied", virtualPath)
+		return nil, "", c.GetNotExistError()
+	}
 	fs, err := c.User.GetFilesystemForPath(virtualPath, c.ID)
 	if err != nil {
 		if c.protocol == ProtocolWebDAV && strings.Contains(err.Error(), vfs.ErrSFTPLoop.Error()) {
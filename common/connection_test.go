@@ -1,10 +1,13 @@
 package common
 
 import (
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/drakkan/sftpgo/v2/dataprovider"
+	"github.com/drakkan/sftpgo/v2/kms"
 	"github.com/drakkan/sftpgo/v2/sdk"
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
@@ -36,6 +40,21 @@ func (fs MockOsFs) IsUploadResumeSupported() bool {
 	return !fs.hasVirtualFolders
 }
 
+// mockCopierFs is an OsFs with a configurable native copy result
+type mockCopierFs struct {
+	vfs.Fs
+	copyErr    error
+	copyCalled bool
+}
+
+func (fs *mockCopierFs) Copy(source, target string) error {
+	fs.copyCalled = true
+	if fs.copyErr != nil {
+		return fs.copyErr
+	}
+	return fs.Fs.(vfs.FsCopier).Copy(source, target)
+}
+
 func newMockOsFs(hasVirtualFolders bool, connectionID, rootDir string) vfs.Fs {
 	return &MockOsFs{
 		Fs:                vfs.NewOsFs(connectionID, rootDir, ""),
@@ -99,6 +118,34 @@ func TestSetStatMode(t *testing.T) {
 	Config.SetstatMode = 2
 	err = conn.handleChmod(fs, fakePath, fakePath, nil)
 	assert.NoError(t, err)
+	// the user specific setstat mode takes precedence over the global one
+	attributes := &StatAttributes{
+		Mode:  os.ModePerm,
+		Atime: time.Now(),
+		Mtime: time.Now(),
+	}
+	conn.User.Filters.SetstatMode = sdk.SetstatModeNormal
+	err = conn.handleChmod(fs, fakePath, fakePath, attributes)
+	assert.Error(t, err)
+	err = conn.handleChown(fs, fakePath, fakePath, attributes)
+	assert.Error(t, err)
+	err = conn.handleChtimes(fs, fakePath, fakePath, attributes)
+	assert.Error(t, err)
+
+	Config.SetstatMode = 0
+	conn.User.Filters.SetstatMode = sdk.SetstatModeIgnore
+	err = conn.handleChmod(fs, fakePath, fakePath, nil)
+	assert.NoError(t, err)
+	err = conn.handleChown(fs, fakePath, fakePath, nil)
+	assert.NoError(t, err)
+	err = conn.handleChtimes(fs, fakePath, fakePath, nil)
+	assert.NoError(t, err)
+
+	conn.User.Filters.SetstatMode = sdk.SetstatModeIgnoreCloud
+	err = conn.handleChmod(fs, fakePath, fakePath, nil)
+	assert.NoError(t, err)
+	err = conn.handleChmod(vfs.NewOsFs("", os.TempDir(), ""), fakePath, fakePath, attributes)
+	assert.Error(t, err)
 
 	Config.SetstatMode = oldSetStatMode
 }
@@ -333,3 +380,677 @@ func TestMaxWriteSize(t *testing.T) {
 	assert.EqualError(t, err, ErrOpUnsupported.Error())
 	assert.Equal(t, int64(0), size)
 }
+
+func TestDefaultQuota(t *testing.T) {
+	oldDefaultQuota := Config.DefaultQuota
+	Config.DefaultQuota = DefaultQuotaConfig{
+		Enabled:    true,
+		QuotaSize:  100,
+		QuotaFiles: 10,
+	}
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: userTestUsername,
+			Password: "pwd",
+			HomeDir:  filepath.Join(os.TempDir(), userTestUsername),
+			Status:   1,
+		},
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	err := dataprovider.AddUser(&u)
+	assert.NoError(t, err)
+	user, err := dataprovider.UserExists(userTestUsername)
+	assert.NoError(t, err)
+	err = dataprovider.UpdateUserQuota(&user, 10, 100, true)
+	assert.NoError(t, err)
+	// default quota applied
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	quotaResult := conn.HasSpace(true, false, "/file")
+	assert.False(t, quotaResult.HasSpace)
+	assert.Equal(t, int64(100), quotaResult.QuotaSize)
+	assert.Equal(t, 10, quotaResult.QuotaFiles)
+	// explicit override
+	conn.User.QuotaSize = 1000
+	conn.User.QuotaFiles = 20
+	quotaResult = conn.HasSpace(true, false, "/file")
+	assert.True(t, quotaResult.HasSpace)
+	assert.Equal(t, int64(1000), quotaResult.QuotaSize)
+	assert.Equal(t, 20, quotaResult.QuotaFiles)
+	// the default files limit is applied only if the user has no explicit files limit
+	conn.User.QuotaFiles = 0
+	quotaResult = conn.HasSpace(true, false, "/file")
+	assert.False(t, quotaResult.HasSpace)
+	assert.Equal(t, int64(1000), quotaResult.QuotaSize)
+	assert.Equal(t, 10, quotaResult.QuotaFiles)
+	// explicit unlimited
+	conn.User.QuotaSize = -1
+	conn.User.QuotaFiles = -1
+	quotaResult = conn.HasSpace(true, false, "/file")
+	assert.True(t, quotaResult.HasSpace)
+	assert.Equal(t, int64(0), quotaResult.QuotaSize)
+	assert.Equal(t, 0, quotaResult.QuotaFiles)
+	quotaResult = conn.HasSpace(true, true, "/file")
+	assert.True(t, quotaResult.HasSpace)
+	assert.Equal(t, int64(100), quotaResult.UsedSize)
+	assert.Equal(t, 10, quotaResult.UsedFiles)
+	// default quota disabled
+	Config.DefaultQuota.Enabled = false
+	conn.User.QuotaSize = 0
+	conn.User.QuotaFiles = 0
+	quotaResult = conn.HasSpace(true, false, "/file")
+	assert.True(t, quotaResult.HasSpace)
+	assert.Equal(t, int64(0), quotaResult.QuotaSize)
+	assert.Equal(t, 0, quotaResult.QuotaFiles)
+
+	u.QuotaSize = -2
+	err = dataprovider.UpdateUser(&u)
+	assert.Error(t, err)
+
+	err = dataprovider.DeleteUser(user.Username)
+	assert.NoError(t, err)
+	Config.DefaultQuota = oldDefaultQuota
+}
+
+func TestSymlinksPolicy(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	baseDir := filepath.Join(os.TempDir(), "symlinks_policy")
+	homeDir := filepath.Join(baseDir, "home")
+	outsideDir := filepath.Join(baseDir, "outside")
+	err := os.MkdirAll(filepath.Join(homeDir, "dir"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(outsideDir, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "dir", "file.txt"), []byte("inside"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(outsideDir, "file.txt"), []byte("outside"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.Symlink(filepath.Join(homeDir, "dir"), filepath.Join(homeDir, "link_inside"))
+	assert.NoError(t, err)
+	err = os.Symlink(outsideDir, filepath.Join(homeDir, "link_outside"))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		policy         sdk.SymlinksPolicy
+		insideAllowed  bool
+		outsideAllowed bool
+	}{
+		{policy: "", insideAllowed: true, outsideAllowed: false},
+		{policy: sdk.SymlinksDenyOutsideHome, insideAllowed: true, outsideAllowed: false},
+		{policy: sdk.SymlinksFollow, insideAllowed: true, outsideAllowed: true},
+		{policy: sdk.SymlinksDeny, insideAllowed: false, outsideAllowed: false},
+	}
+	for _, tc := range testCases {
+		u := dataprovider.User{
+			BaseUser: sdk.BaseUser{
+				Username: "user",
+				HomeDir:  homeDir,
+				Filters: sdk.UserFilters{
+					SymlinksPolicy: tc.policy,
+				},
+			},
+		}
+		u.Permissions = make(map[string][]string)
+		u.Permissions["/"] = []string{dataprovider.PermAny}
+		conn := NewBaseConnection("", ProtocolSFTP, "", "", u)
+		// paths without links are always allowed
+		info, err := conn.DoStat("/dir/file.txt", 0)
+		if assert.NoError(t, err, "policy %q", tc.policy) {
+			assert.Equal(t, int64(6), info.Size())
+		}
+		info, err = conn.DoStat("/link_inside/file.txt", 0)
+		if tc.insideAllowed {
+			if assert.NoError(t, err, "policy %q", tc.policy) {
+				assert.Equal(t, int64(6), info.Size())
+			}
+		} else {
+			assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied, "policy %q", tc.policy)
+		}
+		_, err = conn.DoStat("/link_inside", 1)
+		if tc.insideAllowed {
+			assert.NoError(t, err, "policy %q", tc.policy)
+		} else {
+			assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied, "policy %q", tc.policy)
+		}
+		info, err = conn.DoStat("/link_outside/file.txt", 0)
+		if tc.outsideAllowed {
+			if assert.NoError(t, err, "policy %q", tc.policy) {
+				assert.Equal(t, int64(7), info.Size())
+			}
+		} else {
+			assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied, "policy %q", tc.policy)
+		}
+		// new files cannot be created inside denied links
+		_, _, err = conn.GetFsAndResolvedPath("/link_outside/missing/file.txt")
+		if tc.outsideAllowed {
+			assert.NoError(t, err, "policy %q", tc.policy)
+		} else {
+			assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied, "policy %q", tc.policy)
+		}
+	}
+
+	err = os.RemoveAll(baseDir)
+	assert.NoError(t, err)
+}
+
+func TestPathCanonicalization(t *testing.T) {
+	baseDir := filepath.Join(os.TempDir(), "path_canonicalization")
+	homeDir := filepath.Join(baseDir, "home")
+	mappedPath := filepath.Join(baseDir, "vdir")
+	err := os.MkdirAll(filepath.Join(homeDir, "dir"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(mappedPath, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(homeDir, "dir", "file.txt"), []byte("home"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(mappedPath, "file.txt"), []byte("folder"), os.ModePerm)
+	assert.NoError(t, err)
+
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "user",
+			HomeDir:  homeDir,
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					Name:       filepath.Base(mappedPath),
+					MappedPath: mappedPath,
+				},
+				VirtualPath: "/Vdir",
+			},
+		},
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", u)
+	// trailing and redundant slashes are always removed
+	for _, p := range []string{"/dir/", "//dir", "/dir//", "dir/"} {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(p)
+		if assert.NoError(t, err, p) {
+			assert.Equal(t, filepath.Join(homeDir, "dir"), fsPath, p)
+			assert.Equal(t, "/dir", fs.GetRelativePath(fsPath), p)
+		}
+	}
+	for _, p := range []string{"/Vdir/", "/Vdir//file.txt/"} {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(p)
+		if assert.NoError(t, err, p) {
+			assert.True(t, strings.HasPrefix(fsPath, mappedPath), p)
+			assert.Equal(t, path.Clean(p), fs.GetRelativePath(fsPath), p)
+		}
+	}
+	// dot-dot elements are not resolved, the path outside the home dir is rejected
+	_, _, err = conn.GetFsAndResolvedPath("/../vdir/file.txt")
+	assert.Error(t, err)
+	info, err := conn.DoStat("/dir//file.txt/", 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(4), info.Size())
+	}
+	// case variants are different paths without case folding
+	_, fsPath, err := conn.GetFsAndResolvedPath("/DIR/File.TXT")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(homeDir, "DIR", "File.TXT"), fsPath)
+	if runtime.GOOS == "linux" {
+		_, err = conn.DoStat("/DIR/File.TXT", 0)
+		assert.ErrorIs(t, err, conn.GetNotExistError())
+	}
+	// with case folding enabled case variants resolve to the same path,
+	// the mount path of the virtual folders is not modified
+	u.Filters.PathCaseFolding = true
+	conn = NewBaseConnection("", ProtocolSFTP, "", "", u)
+	for _, p := range []string{"/DIR/File.TXT", "/dir/file.txt", "/Dir/FILE.txt/"} {
+		fs, fsPath, err := conn.GetFsAndResolvedPath(p)
+		if assert.NoError(t, err, p) {
+			assert.Equal(t, filepath.Join(homeDir, "dir", "file.txt"), fsPath, p)
+			assert.Equal(t, "/dir/file.txt", fs.GetRelativePath(fsPath), p)
+		}
+		info, err := conn.DoStat(p, 0)
+		if assert.NoError(t, err, p) {
+			assert.Equal(t, int64(4), info.Size(), p)
+		}
+	}
+	fs, fsPath, err := conn.GetFsAndResolvedPath("/Vdir/FILE.TXT")
+	if assert.NoError(t, err) {
+		assert.Equal(t, filepath.Join(mappedPath, "file.txt"), fsPath)
+		assert.Equal(t, "/Vdir/file.txt", fs.GetRelativePath(fsPath))
+		assert.Equal(t, "/Vdir/file.txt", fs.GetRelativePath(filepath.Join(mappedPath, "FILE.TXT")))
+	}
+	info, err = conn.DoStat("/Vdir/File.txt", 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(6), info.Size())
+	}
+	// case folding is applied to the remote backends too
+	s3Fs, err := vfs.NewS3Fs("", os.TempDir(), "/Vdir", vfs.S3FsConfig{
+		S3FsConfig: sdk.S3FsConfig{
+			Bucket:    "bucket",
+			Region:    "us-east-1",
+			KeyPrefix: "prefix/",
+		},
+	})
+	if err == nil {
+		fsPath, err = s3Fs.ResolvePath("/Vdir/Dir/File.TXT/")
+		assert.NoError(t, err)
+		assert.Equal(t, "/prefix/Dir/File.TXT", fsPath)
+		s3Fs.(vfs.FsPathCaseFolder).SetPathCaseFolding(true)
+		fsPath, err = s3Fs.ResolvePath("/Vdir/Dir/File.TXT/")
+		assert.NoError(t, err)
+		assert.Equal(t, "/prefix/dir/file.txt", fsPath)
+		assert.Equal(t, "/Vdir/dir/file.txt", s3Fs.GetRelativePath("/prefix/Dir/File.TXT"))
+	}
+
+	err = os.RemoveAll(baseDir)
+	assert.NoError(t, err)
+}
+
+func TestCopyFile(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "copy_user",
+			HomeDir:  filepath.Join(os.TempDir(), "copy_user"),
+		},
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Permissions["/ro"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	err := os.MkdirAll(filepath.Join(user.GetHomeDir(), "ro"), os.ModePerm)
+	assert.NoError(t, err)
+	content := []byte("copy file content")
+	srcPath := filepath.Join(user.GetHomeDir(), "src")
+	err = os.WriteFile(srcPath, content, os.ModePerm)
+	assert.NoError(t, err)
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	// native copy
+	fs := &mockCopierFs{Fs: vfs.NewOsFs("", user.GetHomeDir(), "")}
+	dstPath := filepath.Join(user.GetHomeDir(), "dst_native")
+	err = conn.copyFile(fs, fs, srcPath, dstPath, "/src", "/dst_native", nil)
+	assert.NoError(t, err)
+	assert.True(t, fs.copyCalled)
+	data, err := os.ReadFile(dstPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	// native copy unsupported, fallback to a stream copy
+	fs = &mockCopierFs{Fs: vfs.NewOsFs("", user.GetHomeDir(), ""), copyErr: vfs.ErrVfsUnsupported}
+	dstPath = filepath.Join(user.GetHomeDir(), "dst_fallback")
+	err = conn.copyFile(fs, fs, srcPath, dstPath, "/src", "/dst_fallback", nil)
+	assert.NoError(t, err)
+	assert.True(t, fs.copyCalled)
+	data, err = os.ReadFile(dstPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	// other native copy errors are returned
+	fs = &mockCopierFs{Fs: vfs.NewOsFs("", user.GetHomeDir(), ""), copyErr: os.ErrPermission}
+	err = conn.copyFile(fs, fs, srcPath, filepath.Join(user.GetHomeDir(), "dst_err"), "/src", "/dst_err", nil)
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "dst_err"))
+	// filesystems without a native copy always use a stream copy
+	mockFs := newMockOsFs(false, "", user.GetHomeDir())
+	_, ok := mockFs.(vfs.FsCopier)
+	assert.False(t, ok)
+	dstPath = filepath.Join(user.GetHomeDir(), "dst_stream")
+	err = conn.copyFile(mockFs, mockFs, srcPath, dstPath, "/src", "/dst_stream", nil)
+	assert.NoError(t, err)
+	data, err = os.ReadFile(dstPath)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	err = conn.streamCopy(mockFs, mockFs, filepath.Join(user.GetHomeDir(), "missing"), dstPath, nil)
+	assert.Error(t, err)
+
+	err = conn.Copy("/src", "/dst")
+	assert.NoError(t, err)
+	data, err = os.ReadFile(filepath.Join(user.GetHomeDir(), "dst"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	// overwrite
+	err = conn.Copy("/dst_native", "/dst")
+	assert.NoError(t, err)
+	err = conn.Copy("/src", "/src")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxOpUnsupported)
+	err = conn.Copy("/ro", "/ro_copy")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxOpUnsupported)
+	err = conn.Copy("/src", "/ro")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxOpUnsupported)
+	err = conn.Copy("/src", "/ro/dst")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+	err = conn.Copy("/missing", "/dst")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxNoSuchFile)
+	conn.User.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload,
+		dataprovider.PermUpload}
+	err = conn.Copy("/src", "/dst")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestCopyTransfer(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "copy_transfer_user",
+			HomeDir:  filepath.Join(os.TempDir(), "copy_transfer_user"),
+		},
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	err := os.MkdirAll(user.GetHomeDir(), os.ModePerm)
+	assert.NoError(t, err)
+	srcPath := filepath.Join(user.GetHomeDir(), "src")
+	err = os.WriteFile(srcPath, []byte("copy transfer content"), os.ModePerm)
+	assert.NoError(t, err)
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	transfer := newCopyTransfer(conn, "/dst")
+	conn.AddTransfer(transfer)
+	fs := newMockOsFs(false, "", user.GetHomeDir())
+	err = conn.streamCopy(fs, fs, srcPath, filepath.Join(user.GetHomeDir(), "dst"), transfer)
+	assert.NoError(t, err)
+	atomic.AddInt32(&transfer.FilesDone, 1)
+	transfers := conn.GetTransfers()
+	if assert.Len(t, transfers, 1) {
+		tr := transfers[0]
+		assert.Equal(t, operationCopy, tr.OperationType)
+		assert.Equal(t, "/dst", tr.VirtualPath)
+		assert.Equal(t, int64(21), tr.Size)
+		assert.Equal(t, 1, tr.Files)
+		assert.True(t, strings.HasPrefix(tr.getConnectionTransferAsString(), "CP Files: 1"))
+	}
+	_, err = transfer.Truncate(srcPath, 0)
+	assert.ErrorIs(t, err, errTransferMismatch)
+	assert.Empty(t, transfer.GetRealFsPath(srcPath))
+	// an aborted copy stops the stream copy
+	err = conn.SignalTransfersAbort()
+	assert.NoError(t, err)
+	err = conn.streamCopy(fs, fs, srcPath, filepath.Join(user.GetHomeDir(), "dst1"), transfer)
+	assert.ErrorIs(t, err, errCopyAborted)
+	conn.RemoveTransfer(transfer)
+	assert.Len(t, conn.GetTransfers(), 0)
+	// the entries created by a failed copy are removed in reverse order
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "partial", "sub"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(user.GetHomeDir(), "partial", "sub", "file"), []byte("data"), os.ModePerm)
+	assert.NoError(t, err)
+	conn.removeCopiedEntries([]copiedEntry{
+		{virtualPath: "/partial", isDir: true},
+		{virtualPath: "/partial/sub", isDir: true},
+		{virtualPath: "/partial/sub/file", size: 4},
+		{virtualPath: "/partial/missing", size: 4},
+	})
+	assert.NoDirExists(t, filepath.Join(user.GetHomeDir(), "partial"))
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestResumeDownload(t *testing.T) {
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "resume_download_user",
+			HomeDir:  filepath.Join(os.TempDir(), "resume_download_user"),
+		},
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Permissions["/nodownload"] = []string{dataprovider.PermListItems}
+	err := os.MkdirAll(filepath.Join(user.GetHomeDir(), "nodownload"), os.ModePerm)
+	assert.NoError(t, err)
+	content := []byte("resumable download content")
+	filePath := filepath.Join(user.GetHomeDir(), "file")
+	err = os.WriteFile(filePath, content, os.ModePerm)
+	assert.NoError(t, err)
+	info, err := os.Stat(filePath)
+	assert.NoError(t, err)
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	validator := DownloadValidator{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	transfer, r, err := conn.ResumeDownload("/file", 10, validator)
+	if assert.NoError(t, err) {
+		assert.Nil(t, r)
+		assert.Len(t, conn.GetTransfers(), 1)
+		data, err := io.ReadAll(transfer.File)
+		assert.NoError(t, err)
+		assert.Equal(t, content[10:], data)
+		err = transfer.Close()
+		assert.NoError(t, err)
+		assert.Len(t, conn.GetTransfers(), 0)
+	}
+	// the validator can be sent to the client and parsed back
+	parsed, err := ParseDownloadValidator(NewDownloadValidator(info).String())
+	assert.NoError(t, err)
+	transfer, _, err = conn.ResumeDownload("/file", 20, parsed)
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(transfer.File)
+		assert.NoError(t, err)
+		assert.Equal(t, content[20:], data)
+		err = transfer.Close()
+		assert.NoError(t, err)
+	}
+	// the file changed, the size is different
+	err = os.WriteFile(filePath, []byte("modified resumable download content"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.Chtimes(filePath, info.ModTime(), info.ModTime())
+	assert.NoError(t, err)
+	_, _, err = conn.ResumeDownload("/file", 10, validator)
+	assert.ErrorIs(t, err, ErrDownloadChanged)
+	assert.Len(t, conn.GetTransfers(), 0)
+	// same size but a different modification time
+	err = os.WriteFile(filePath, []byte("resumable download CONTENT"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.Chtimes(filePath, info.ModTime(), info.ModTime().Add(1*time.Hour))
+	assert.NoError(t, err)
+	_, _, err = conn.ResumeDownload("/file", 10, validator)
+	assert.ErrorIs(t, err, ErrDownloadChanged)
+	// invalid requests
+	_, _, err = conn.ResumeDownload("/file", 10, DownloadValidator{})
+	assert.Error(t, err)
+	for _, value := range []string{"", "a", "a.b.c", "z.1", "1.z", "0.-1"} {
+		_, err = ParseDownloadValidator(value)
+		assert.Error(t, err, value)
+	}
+	_, _, err = conn.ResumeDownload("/file", int64(len(content))+1, validator)
+	assert.Error(t, err)
+	_, _, err = conn.ResumeDownload("/file", -1, validator)
+	assert.Error(t, err)
+	_, _, err = conn.ResumeDownload("/missing", 0, validator)
+	assert.ErrorIs(t, err, conn.GetNotExistError())
+	_, _, err = conn.ResumeDownload("/nodownload/file", 0, validator)
+	assert.ErrorIs(t, err, conn.GetPermissionDeniedError())
+	_, _, err = conn.ResumeDownload("/nodownload", 0, validator)
+	assert.ErrorIs(t, err, conn.GetOpUnsupportedError())
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestProtocolFilesystems(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "protocol_fs_home")
+	davHomeDir := filepath.Join(os.TempDir(), "protocol_fs_dav")
+	ftpHomeDir := filepath.Join(os.TempDir(), "protocol_fs_ftp")
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: userTestUsername,
+			HomeDir:  homeDir,
+		},
+		ProtocolFilesystems: []dataprovider.ProtocolFilesystem{
+			{
+				Protocol: ProtocolWebDAV,
+				HomeDir:  davHomeDir,
+				FsConfig: vfs.Filesystem{
+					Provider: sdk.CryptedFilesystemProvider,
+					CryptConfig: vfs.CryptFsConfig{
+						CryptFsConfig: sdk.CryptFsConfig{
+							Passphrase: kms.NewPlainSecret("secret"),
+						},
+					},
+				},
+			},
+			{
+				Protocol: ProtocolFTP,
+				HomeDir:  ftpHomeDir,
+				FsConfig: vfs.Filesystem{
+					Provider: sdk.LocalFilesystemProvider,
+				},
+			},
+		},
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	for _, dir := range []string{homeDir, davHomeDir, ftpHomeDir} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		assert.NoError(t, err)
+	}
+	// without a login protocol the default filesystem is used
+	assert.Equal(t, homeDir, user.GetHomeDir())
+
+	for _, protocol := range []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH, ProtocolHTTP} {
+		conn := NewBaseConnection("", protocol, "", "", user)
+		fs, err := conn.User.GetFilesystemForPath("/", "")
+		if assert.NoError(t, err, protocol) {
+			assert.True(t, vfs.IsLocalOsFs(fs), protocol)
+			fsPath, err := fs.ResolvePath("/file")
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(homeDir, "file"), fsPath, protocol)
+		}
+		assert.Equal(t, homeDir, conn.User.GetHomeDir(), protocol)
+		assert.Equal(t, sdk.LocalFilesystemProvider, conn.User.GetFsConfigForPath("/").Provider, protocol)
+	}
+	conn := NewBaseConnection("", ProtocolWebDAV, "", "", user)
+	fs, err := conn.User.GetFilesystemForPath("/", "")
+	if assert.NoError(t, err) {
+		assert.True(t, vfs.IsCryptOsFs(fs))
+		fsPath, err := fs.ResolvePath("/file")
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(davHomeDir, "file"), fsPath)
+	}
+	assert.Equal(t, davHomeDir, conn.User.GetHomeDir())
+	assert.Equal(t, sdk.CryptedFilesystemProvider, conn.User.GetFsConfigForPath("/").Provider)
+
+	conn = NewBaseConnection("", ProtocolFTP, "", "", user)
+	fs, err = conn.User.GetFilesystemForPath("/", "")
+	if assert.NoError(t, err) {
+		assert.True(t, vfs.IsLocalOsFs(fs))
+		fsPath, err := fs.ResolvePath("/file")
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(ftpHomeDir, "file"), fsPath)
+	}
+	// the user is copied, the original one is not affected
+	assert.Equal(t, homeDir, user.GetHomeDir())
+	// invalid protocols are ignored
+	user.SetLoginProtocol("unknown")
+	assert.Equal(t, homeDir, user.GetHomeDir())
+	user.SetLoginProtocol(ProtocolWebDAV)
+	assert.Equal(t, davHomeDir, user.GetHomeDir())
+	// the quota scan includes all the filesystems, the shared ones are scanned once
+	err = os.WriteFile(filepath.Join(homeDir, "file"), make([]byte, 10), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(ftpHomeDir, "file"), make([]byte, 20), os.ModePerm)
+	assert.NoError(t, err)
+	user.ProtocolFilesystems = append(user.ProtocolFilesystems, dataprovider.ProtocolFilesystem{
+		Protocol: ProtocolHTTP,
+		HomeDir:  ftpHomeDir,
+		FsConfig: vfs.Filesystem{
+			Provider: sdk.LocalFilesystemProvider,
+		},
+	})
+	numFiles, size, err := user.ScanQuota()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numFiles)
+	assert.Equal(t, int64(30), size)
+
+	for _, dir := range []string{homeDir, davHomeDir, ftpHomeDir} {
+		err = os.RemoveAll(dir)
+		assert.NoError(t, err)
+	}
+}
+
+func TestSortDirEntries(t *testing.T) {
+	now := time.Now()
+	getFiles := func() []os.FileInfo {
+		return []os.FileInfo{
+			vfs.NewFileInfo("b", false, 30, now.Add(-1*time.Hour), false),
+			vfs.NewFileInfo("C", false, 10, now, false),
+			vfs.NewFileInfo("a", true, 0, now.Add(-2*time.Hour), false),
+			vfs.NewFileInfo("B", false, 10, now.Add(-1*time.Hour), false),
+		}
+	}
+	getNames := func(files []os.FileInfo) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return names
+	}
+
+	files := getFiles()
+	sortDirEntries(files, "")
+	assert.Equal(t, []string{"b", "C", "a", "B"}, getNames(files))
+	sortDirEntries(files, sdk.DirListingSortNone)
+	assert.Equal(t, []string{"b", "C", "a", "B"}, getNames(files))
+	sortDirEntries(files, sdk.DirListingSortName)
+	assert.Equal(t, []string{"B", "C", "a", "b"}, getNames(files))
+	files = getFiles()
+	sortDirEntries(files, sdk.DirListingSortNameInsensitive)
+	assert.Equal(t, []string{"a", "B", "b", "C"}, getNames(files))
+	files = getFiles()
+	sortDirEntries(files, sdk.DirListingSortSize)
+	assert.Equal(t, []string{"a", "B", "C", "b"}, getNames(files))
+	files = getFiles()
+	sortDirEntries(files, sdk.DirListingSortModTime)
+	assert.Equal(t, []string{"a", "B", "b", "C"}, getNames(files))
+
+	user := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "sort_user",
+			HomeDir:  filepath.Join(os.TempDir(), "sort_user"),
+		},
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.DirListingSort = sdk.DirListingSortSize
+	err := os.MkdirAll(user.GetHomeDir(), os.ModePerm)
+	assert.NoError(t, err)
+	for idx, name := range []string{"file1", "file2", "file3"} {
+		err = os.WriteFile(filepath.Join(user.GetHomeDir(), name), make([]byte, 10-idx), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	files, err = conn.ListDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file3", "file2", "file1"}, getNames(files))
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestBanners(t *testing.T) {
+	oldBanners := Config.Banners
+	Config.Banners = BannersConfig{
+		SSH:  "ssh banner",
+		FTP:  "ftp banner",
+		HTTP: "http banner",
+	}
+	user := dataprovider.User{}
+	for _, protocol := range []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH} {
+		conn := NewBaseConnection("", protocol, "", "", user)
+		assert.Equal(t, "ssh banner", conn.GetBanner())
+	}
+	conn := NewBaseConnection("", ProtocolFTP, "", "", user)
+	assert.Equal(t, "ftp banner", conn.GetBanner())
+	conn = NewBaseConnection("", ProtocolHTTP, "", "", user)
+	assert.Equal(t, "http banner", conn.GetBanner())
+	conn = NewBaseConnection("", ProtocolWebDAV, "", "", user)
+	assert.Empty(t, conn.GetBanner())
+	assert.Equal(t, "ssh banner", GetBanner(ProtocolSFTP, nil))
+
+	user.Filters.Banner = "user banner"
+	conn = NewBaseConnection("", ProtocolSFTP, "", "", user)
+	assert.Equal(t, "user banner", conn.GetBanner())
+	conn = NewBaseConnection("", ProtocolWebDAV, "", "", user)
+	assert.Equal(t, "user banner", conn.GetBanner())
+
+	Config.Banners = oldBanners
+}
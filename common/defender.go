@@ -3,16 +3,20 @@ package common
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/yl2chen/cidranger"
 
 	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/metric"
 	"github.com/drakkan/sftpgo/v2/util"
 )
 
@@ -25,13 +29,99 @@ const (
 	HostEventUserNotFound
 	HostEventNoLoginTried
 	HostEventLimitExceeded
+	// HostEventAbusiveActivity is generated for authenticated sessions doing
+	// something abusive, for example mass downloads or paths enumeration
+	HostEventAbusiveActivity
 )
 
+// Ban reasons returned within a BanExplanation
+const (
+	BanReasonNone      = "none"
+	BanReasonBlockList = "blocklist"
+	BanReasonScore     = "score"
+)
+
+const hostEventReputation = "reputation"
+
+// Supported defender drivers
+const (
+	DefenderDriverMemory   = "memory"
+	DefenderDriverProvider = "provider"
+	DefenderDriverRedis    = "redis"
+)
+
+// Supported throttling delay curves
+const (
+	ThrottleCurveLinear    = "linear"
+	ThrottleCurveQuadratic = "quadratic"
+)
+
+func getHostEventName(event HostEvent) string {
+	switch event {
+	case HostEventLoginFailed:
+		return "login_failed"
+	case HostEventUserNotFound:
+		return "user_not_found"
+	case HostEventNoLoginTried:
+		return "no_login_tried"
+	case HostEventLimitExceeded:
+		return "limit_exceeded"
+	case HostEventAbusiveActivity:
+		return "abusive_activity"
+	default:
+		return "unknown"
+	}
+}
+
+// BanExplanationEvent defines an event contributing to the score of a host
+type BanExplanationEvent struct {
+	Event string    `json:"event"`
+	Score int       `json:"score"`
+	Time  time.Time `json:"time"`
+}
+
+// BanExplanation describes why a host is banned or, if it is not banned,
+// its current score compared to the ban threshold
+type BanExplanation struct {
+	IP     string `json:"ip"`
+	Banned bool   `json:"banned"`
+	// BanReasonBlockList, BanReasonScore or BanReasonNone if the host is not banned
+	Reason string `json:"reason"`
+	// block list file and matching address or network, set for block list bans
+	BlockListFile  string `json:"blocklist_file,omitempty"`
+	BlockListEntry string `json:"blocklist_entry,omitempty"`
+	// true if the host is in the safe list and so it is never banned
+	SafeListed bool       `json:"safelisted,omitempty"`
+	BanTime    *time.Time `json:"ban_time,omitempty"`
+	// for score bans these are the score and the threshold when the host was banned
+	Score     int                   `json:"score"`
+	Threshold int                   `json:"threshold"`
+	Events    []BanExplanationEvent `json:"events,omitempty"`
+}
+
 // DefenderEntry defines a defender entry
 type DefenderEntry struct {
 	IP      string    `json:"ip"`
 	Score   int       `json:"score,omitempty"`
 	BanTime time.Time `json:"ban_time,omitempty"`
+	// number of events for each event name. For banned hosts these are the
+	// events that caused the ban, otherwise the events within the observation time
+	Events map[string]int `json:"events,omitempty"`
+	// for banned hosts, the event that pushed the score over the threshold
+	LastEvent string `json:"last_event,omitempty"`
+}
+
+// addEvent counts an event with the given name. The events must be added
+// starting from the oldest one, so for banned hosts the last added event is
+// the one that caused the ban
+func (d *DefenderEntry) addEvent(name string) {
+	if d.Events == nil {
+		d.Events = make(map[string]int)
+	}
+	d.Events[name]++
+	if !d.BanTime.IsZero() {
+		d.LastEvent = name
+	}
 }
 
 // GetID returns an unique ID for a defender entry
@@ -50,15 +140,19 @@ func (d *DefenderEntry) GetBanTime() string {
 // MarshalJSON returns the JSON encoding of a DefenderEntry.
 func (d *DefenderEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
-		ID      string `json:"id"`
-		IP      string `json:"ip"`
-		Score   int    `json:"score,omitempty"`
-		BanTime string `json:"ban_time,omitempty"`
+		ID        string         `json:"id"`
+		IP        string         `json:"ip"`
+		Score     int            `json:"score,omitempty"`
+		BanTime   string         `json:"ban_time,omitempty"`
+		Events    map[string]int `json:"events,omitempty"`
+		LastEvent string         `json:"last_event,omitempty"`
 	}{
-		ID:      d.GetID(),
-		IP:      d.IP,
-		Score:   d.Score,
-		BanTime: d.GetBanTime(),
+		ID:        d.GetID(),
+		IP:        d.IP,
+		Score:     d.Score,
+		BanTime:   d.GetBanTime(),
+		Events:    d.Events,
+		LastEvent: d.LastEvent,
 	})
 }
 
@@ -66,10 +160,13 @@ func (d *DefenderEntry) MarshalJSON() ([]byte, error) {
 type Defender interface {
 	GetHosts() []*DefenderEntry
 	GetHost(ip string) (*DefenderEntry, error)
-	AddEvent(ip string, event HostEvent)
+	AddEvent(ip, protocol string, event HostEvent)
+	AddLoginSuccess(ip string)
 	IsBanned(ip string) bool
 	GetBanTime(ip string) *time.Time
 	GetScore(ip string) int
+	GetThrottleDelay(ip string) time.Duration
+	ExplainBan(ip string) *BanExplanation
 	DeleteHost(ip string) bool
 	Reload() error
 }
@@ -78,6 +175,14 @@ type Defender interface {
 type DefenderConfig struct {
 	// Set to true to enable the defender
 	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Defines where the host scores and the banned hosts are stored: "memory",
+	// "provider" or "redis". The "provider" driver stores them inside the data
+	// provider, so the bans survive restarts. The "redis" driver stores them
+	// inside a Redis server, so they can be shared among multiple instances.
+	// Empty means "memory"
+	Driver string `json:"driver" mapstructure:"driver"`
+	// Redis configuration for the "redis" driver
+	Redis DefenderRedisConfig `json:"redis" mapstructure:"redis"`
 	// BanTime is the number of minutes that a host is banned
 	BanTime int `json:"ban_time" mapstructure:"ban_time"`
 	// Percentage increase of the ban time if a banned host tries to connect again
@@ -92,6 +197,17 @@ type DefenderConfig struct {
 	// Score for limit exceeded events, generated from the rate limiters or for max connections
 	// per-host exceeded
 	ScoreLimitExceeded int `json:"score_limit_exceeded" mapstructure:"score_limit_exceeded"`
+	// Score for abusive activities detected for authenticated sessions.
+	// 0 means that these events are ignored
+	ScoreAbusiveActivity int `json:"score_abusive_activity" mapstructure:"score_abusive_activity"`
+	// Maximum number of downloads per minute for a single connection, an abusive
+	// activity event is generated each time it is exceeded. 0 means disabled
+	AbusiveDownloads int `json:"abusive_downloads" mapstructure:"abusive_downloads"`
+	// Maximum number of directory listings per minute for a single connection, an
+	// abusive activity event is generated each time it is exceeded. 0 means disabled
+	AbusiveListings int `json:"abusive_listings" mapstructure:"abusive_listings"`
+	// Scores overrides for specific protocols
+	ProtocolScores []DefenderProtocolScores `json:"protocol_scores" mapstructure:"protocol_scores"`
 	// Defines the time window, in minutes, for tracking client errors.
 	// A host is banned if it has exceeded the defined threshold during
 	// the last observation time minutes
@@ -100,10 +216,102 @@ type DefenderConfig struct {
 	// soft and hard limit
 	EntriesSoftLimit int `json:"entries_soft_limit" mapstructure:"entries_soft_limit"`
 	EntriesHardLimit int `json:"entries_hard_limit" mapstructure:"entries_hard_limit"`
-	// Path to a file containing a list of ip addresses and/or networks to never ban
+	// IPv6 addresses are tracked, scored and banned by subnet using this prefix
+	// length, attackers can easily rotate the addresses within their subnet.
+	// 0 or 128 means that each address is tracked independently
+	IPv6SubnetBits int `json:"ipv6_subnet_bits" mapstructure:"ipv6_subnet_bits"`
+	// Same as IPv6SubnetBits for IPv4 addresses.
+	// 0 or 32 means that each address is tracked independently
+	IPv4SubnetBits int `json:"ipv4_subnet_bits" mapstructure:"ipv4_subnet_bits"`
+	// Path to a file, or HTTP URL, containing a list of ip addresses and/or networks to never ban
 	SafeListFile string `json:"safelist_file" mapstructure:"safelist_file"`
-	// Path to a file containing a list of ip addresses and/or networks to always ban
+	// Path to a file, or HTTP URL, containing a list of ip addresses and/or networks to always ban
 	BlockListFile string `json:"blocklist_file" mapstructure:"blocklist_file"`
+	// Interval, in seconds, between two checks for changes of the safe and
+	// block list files. The lists are reloaded if a file was modified.
+	// 0 means disabled
+	ListsCheckInterval int `json:"lists_check_interval" mapstructure:"lists_check_interval"`
+	// Interval, in seconds, between two downloads of the safe and block lists
+	// defined as HTTP URLs. 0 means that they are downloaded only on startup
+	// and on reload
+	ListsRefreshInterval int `json:"lists_refresh_interval" mapstructure:"lists_refresh_interval"`
+	// Timeout, in seconds, for downloading a list defined as HTTP URL.
+	// 0 means the timeout configured for the HTTP client
+	ListsURLTimeout int `json:"lists_url_timeout" mapstructure:"lists_url_timeout"`
+	// Absolute path to an external program or an HTTP URL to query the reputation
+	// of the hosts not yet known to the defender. The returned score is added to the
+	// local host score, a block decision bans the host.
+	// Leave empty to disable
+	ReputationHook string `json:"reputation_hook" mapstructure:"reputation_hook"`
+	// Time, in seconds, to cache the reputation of a host. The feed score is merged
+	// with the host score once per cache time, so it must be greater than 0 if a
+	// reputation hook is configured
+	ReputationCacheTime int `json:"reputation_cache_time" mapstructure:"reputation_cache_time"`
+	// Absolute path to an external program or an HTTP URL to notify when a host
+	// is banned. The notifications are sent asynchronously.
+	// Leave empty to disable
+	BanHook string `json:"ban_hook" mapstructure:"ban_hook"`
+	// If enabled the ban hook is notified also when a banned host is removed
+	// from the defender, for example using the REST API
+	BanHookOnUnban bool `json:"ban_hook_on_unban" mapstructure:"ban_hook_on_unban"`
+	// Time, in minutes, a host is granted a grace period after a successful
+	// login. Within this period the host is banned only if its score exceeds
+	// LoginGraceThreshold. 0 means disabled
+	LoginGraceTime int `json:"login_grace_time" mapstructure:"login_grace_time"`
+	// Threshold value for banning a client within the login grace period.
+	// It must be greater than Threshold
+	LoginGraceThreshold int `json:"login_grace_threshold" mapstructure:"login_grace_threshold"`
+	// Maximum delay, in milliseconds, before accepting a new connection from a
+	// host whose score reached ThrottleStartScore. The delay increases with the
+	// score up to the ban threshold. 0 means disabled
+	ThrottleMaxDelay int `json:"throttle_max_delay" mapstructure:"throttle_max_delay"`
+	// Score from which new connections are delayed. It must be lower than Threshold
+	ThrottleStartScore int `json:"throttle_start_score" mapstructure:"throttle_start_score"`
+	// How the delay grows with the score: "linear" or "quadratic".
+	// Empty means "linear"
+	ThrottleCurve string `json:"throttle_curve" mapstructure:"throttle_curve"`
+}
+
+// DefenderProtocolScores defines the scores for the specified protocols, they
+// override the global scores. 0 means that the global score is used
+type DefenderProtocolScores struct {
+	// Protocols to which the scores apply
+	Protocols            []string `json:"protocols" mapstructure:"protocols"`
+	ScoreInvalid         int      `json:"score_invalid" mapstructure:"score_invalid"`
+	ScoreValid           int      `json:"score_valid" mapstructure:"score_valid"`
+	ScoreLimitExceeded   int      `json:"score_limit_exceeded" mapstructure:"score_limit_exceeded"`
+	ScoreAbusiveActivity int      `json:"score_abusive_activity" mapstructure:"score_abusive_activity"`
+}
+
+func (s *DefenderProtocolScores) validate(threshold int) error {
+	if len(s.Protocols) == 0 {
+		return errors.New("protocol scores without protocols")
+	}
+	for _, protocol := range s.Protocols {
+		if !util.IsStringInSlice(protocol, supportedProtocols) {
+			return fmt.Errorf("invalid protocol %#v for the protocol scores", protocol)
+		}
+	}
+	scores := []int{s.ScoreInvalid, s.ScoreValid, s.ScoreLimitExceeded, s.ScoreAbusiveActivity}
+	for _, score := range scores {
+		if score < 0 || score >= threshold {
+			return fmt.Errorf("invalid score %v for protocols %+v, it must be >= 0 and < %v", score, s.Protocols, threshold)
+		}
+	}
+	return nil
+}
+
+// DefenderRedisConfig defines the Redis server used by the "redis" defender driver
+type DefenderRedisConfig struct {
+	// Redis server address as host:port
+	Address string `json:"address" mapstructure:"address"`
+	// Password for the Redis AUTH command, leave empty if not required
+	Password string `json:"password" mapstructure:"password"`
+	// Redis database number
+	DB int `json:"db" mapstructure:"db"`
+	// Prefix for the keys, the instances sharing the defender state must use
+	// the same prefix
+	Prefix string `json:"prefix" mapstructure:"prefix"`
 }
 
 type memoryDefender struct {
@@ -113,10 +321,19 @@ type memoryDefender struct {
 	// they are added to banned once the thresold is reached.
 	// A violation from a banned host will increase the ban time
 	// based on the configured BanTimeIncrement
-	hosts     map[string]hostScore // the key is the host IP
-	banned    map[string]time.Time // the key is the host IP
+	hosts  map[string]hostScore // the key is the host IP
+	banned map[string]time.Time // the key is the host IP
+	// the events and the threshold that caused a score based ban
+	banCauses map[string]banCause // the key is the host IP
 	safeList  *HostList
 	blockList *HostList
+	// hosts with a successful login within the last LoginGraceTime minutes,
+	// the value is the grace expiration
+	graced map[string]time.Time // the key is the host IP
+	// nil if no reputation hook is configured
+	reputation *reputationFeed
+	// nil if no ban hook is configured
+	notifier *banNotifier
 }
 
 // HostListFile defines the structure expected for safe/block list files
@@ -131,6 +348,21 @@ type HostList struct {
 	Ranges      cidranger.Ranger
 }
 
+// getMatch returns the listed IP address or network containing ip,
+// or an empty string if ip is not listed
+func (h *HostList) getMatch(ip string) string {
+	if _, ok := h.IPAddresses[ip]; ok {
+		return ip
+	}
+
+	entries, err := h.Ranges.ContainingNetworks(net.ParseIP(ip))
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	network := entries[0].Network()
+	return network.String()
+}
+
 func (h *HostList) isListed(ip string) bool {
 	if _, ok := h.IPAddresses[ip]; ok {
 		return true
@@ -147,6 +379,7 @@ func (h *HostList) isListed(ip string) bool {
 type hostEvent struct {
 	dateTime time.Time
 	score    int
+	name     string
 }
 
 type hostScore struct {
@@ -154,11 +387,42 @@ type hostScore struct {
 	Events     []hostEvent
 }
 
+type banCause struct {
+	score     hostScore
+	threshold int
+}
+
+func getBanExplanationEvents(events []hostEvent) []BanExplanationEvent {
+	result := make([]BanExplanationEvent, 0, len(events))
+	for _, ev := range events {
+		result = append(result, BanExplanationEvent{
+			Event: ev.name,
+			Score: ev.score,
+			Time:  ev.dateTime,
+		})
+	}
+	return result
+}
+
 // validate returns an error if the configuration is invalid
 func (c *DefenderConfig) validate() error {
 	if !c.Enabled {
 		return nil
 	}
+	switch c.Driver {
+	case "":
+		c.Driver = DefenderDriverMemory
+	case DefenderDriverMemory, DefenderDriverProvider:
+	case DefenderDriverRedis:
+		if c.Redis.Address == "" {
+			return errors.New("the redis address is required for the redis defender driver")
+		}
+		if c.Redis.DB < 0 {
+			return fmt.Errorf("invalid redis db %v", c.Redis.DB)
+		}
+	default:
+		return fmt.Errorf("unsupported defender driver %#v", c.Driver)
+	}
 	if c.ScoreInvalid >= c.Threshold {
 		return fmt.Errorf("score_invalid %v cannot be greater than threshold %v", c.ScoreInvalid, c.Threshold)
 	}
@@ -168,6 +432,28 @@ func (c *DefenderConfig) validate() error {
 	if c.ScoreLimitExceeded >= c.Threshold {
 		return fmt.Errorf("score_limit_exceeded %v cannot be greater than threshold %v", c.ScoreLimitExceeded, c.Threshold)
 	}
+	if c.ScoreAbusiveActivity >= c.Threshold {
+		return fmt.Errorf("score_abusive_activity %v cannot be greater than threshold %v", c.ScoreAbusiveActivity, c.Threshold)
+	}
+	if c.AbusiveDownloads < 0 {
+		return fmt.Errorf("invalid abusive_downloads %v", c.AbusiveDownloads)
+	}
+	if c.AbusiveListings < 0 {
+		return fmt.Errorf("invalid abusive_listings %v", c.AbusiveListings)
+	}
+	var protocols []string
+	for idx := range c.ProtocolScores {
+		scores := &c.ProtocolScores[idx]
+		if err := scores.validate(c.Threshold); err != nil {
+			return err
+		}
+		for _, protocol := range scores.Protocols {
+			if util.IsStringInSlice(protocol, protocols) {
+				return fmt.Errorf("duplicate protocol scores for protocol %#v", protocol)
+			}
+			protocols = append(protocols, protocol)
+		}
+	}
 	if c.BanTime <= 0 {
 		return fmt.Errorf("invalid ban_time %v", c.BanTime)
 	}
@@ -183,19 +469,152 @@ func (c *DefenderConfig) validate() error {
 	if c.EntriesHardLimit <= c.EntriesSoftLimit {
 		return fmt.Errorf("invalid entries_hard_limit %v must be > %v", c.EntriesHardLimit, c.EntriesSoftLimit)
 	}
+	if c.IPv6SubnetBits < 0 || c.IPv6SubnetBits > 128 {
+		return fmt.Errorf("invalid ipv6_subnet_bits %v", c.IPv6SubnetBits)
+	}
+	if c.IPv4SubnetBits < 0 || c.IPv4SubnetBits > 32 {
+		return fmt.Errorf("invalid ipv4_subnet_bits %v", c.IPv4SubnetBits)
+	}
+	if c.ListsCheckInterval < 0 {
+		return fmt.Errorf("invalid lists_check_interval %v", c.ListsCheckInterval)
+	}
+	if c.ListsRefreshInterval < 0 {
+		return fmt.Errorf("invalid lists_refresh_interval %v", c.ListsRefreshInterval)
+	}
+	if c.ListsURLTimeout < 0 {
+		return fmt.Errorf("invalid lists_url_timeout %v", c.ListsURLTimeout)
+	}
+	if c.ReputationHook != "" && !strings.HasPrefix(c.ReputationHook, "http") && !filepath.IsAbs(c.ReputationHook) {
+		return fmt.Errorf("invalid reputation_hook %#v, it must be an HTTP URL or an absolute path", c.ReputationHook)
+	}
+	if c.BanHook != "" && !strings.HasPrefix(c.BanHook, "http") && !filepath.IsAbs(c.BanHook) {
+		return fmt.Errorf("invalid ban_hook %#v, it must be an HTTP URL or an absolute path", c.BanHook)
+	}
+	if c.ReputationCacheTime < 0 || (c.ReputationHook != "" && c.ReputationCacheTime == 0) {
+		return fmt.Errorf("invalid reputation_cache_time %v", c.ReputationCacheTime)
+	}
+	if c.LoginGraceTime < 0 {
+		return fmt.Errorf("invalid login_grace_time %v", c.LoginGraceTime)
+	}
+	if c.LoginGraceTime > 0 && c.LoginGraceThreshold <= c.Threshold {
+		return fmt.Errorf("invalid login_grace_threshold %v must be > %v", c.LoginGraceThreshold, c.Threshold)
+	}
+	if c.ThrottleMaxDelay < 0 {
+		return fmt.Errorf("invalid throttle_max_delay %v", c.ThrottleMaxDelay)
+	}
+	if c.ThrottleMaxDelay > 0 {
+		if c.ThrottleStartScore <= 0 || c.ThrottleStartScore >= c.Threshold {
+			return fmt.Errorf("invalid throttle_start_score %v must be > 0 and < %v", c.ThrottleStartScore, c.Threshold)
+		}
+		switch c.ThrottleCurve {
+		case "":
+			c.ThrottleCurve = ThrottleCurveLinear
+		case ThrottleCurveLinear, ThrottleCurveQuadratic:
+		default:
+			return fmt.Errorf("invalid throttle_curve %#v", c.ThrottleCurve)
+		}
+	}
 
 	return nil
 }
 
+// getHostKey returns the key used to track the given IP. The addresses are
+// aggregated by subnet, for example "2001:db8:1:2::/64", based on the
+// configured prefix lengths
+func (c *DefenderConfig) getHostKey(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if ipv4 := parsed.To4(); ipv4 != nil {
+		if c.IPv4SubnetBits <= 0 || c.IPv4SubnetBits >= 32 {
+			return ipv4.String()
+		}
+		return fmt.Sprintf("%v/%d", ipv4.Mask(net.CIDRMask(c.IPv4SubnetBits, 32)), c.IPv4SubnetBits)
+	}
+	if c.IPv6SubnetBits <= 0 || c.IPv6SubnetBits >= 128 {
+		return ip
+	}
+	return fmt.Sprintf("%v/%d", parsed.Mask(net.CIDRMask(c.IPv6SubnetBits, 128)), c.IPv6SubnetBits)
+}
+
+// getEventScore returns the configured score for the given protocol and event,
+// the protocol scores override the global ones
+func (c *DefenderConfig) getEventScore(protocol string, event HostEvent) int {
+	var scores *DefenderProtocolScores
+	for idx := range c.ProtocolScores {
+		if util.IsStringInSlice(protocol, c.ProtocolScores[idx].Protocols) {
+			scores = &c.ProtocolScores[idx]
+			break
+		}
+	}
+	switch event {
+	case HostEventLoginFailed:
+		if scores != nil && scores.ScoreValid > 0 {
+			return scores.ScoreValid
+		}
+		return c.ScoreValid
+	case HostEventLimitExceeded:
+		if scores != nil && scores.ScoreLimitExceeded > 0 {
+			return scores.ScoreLimitExceeded
+		}
+		return c.ScoreLimitExceeded
+	case HostEventUserNotFound, HostEventNoLoginTried:
+		if scores != nil && scores.ScoreInvalid > 0 {
+			return scores.ScoreInvalid
+		}
+		return c.ScoreInvalid
+	case HostEventAbusiveActivity:
+		if scores != nil && scores.ScoreAbusiveActivity > 0 {
+			return scores.ScoreAbusiveActivity
+		}
+		return c.ScoreAbusiveActivity
+	default:
+		return 0
+	}
+}
+
+// getBanTimeIncrement returns the minutes to add to the ban time if a banned
+// host tries to connect again
+func (c *DefenderConfig) getBanTimeIncrement() int {
+	increment := c.BanTime * c.BanTimeIncrement / 100
+	if increment == 0 {
+		increment++
+	}
+	return increment
+}
+
+// getThrottleDelay returns the delay for a host with the given score and ban threshold
+func (c *DefenderConfig) getThrottleDelay(score, threshold int) time.Duration {
+	if score < c.ThrottleStartScore {
+		return 0
+	}
+	// the last score before the ban gets the maximum delay
+	steps := time.Duration(score - c.ThrottleStartScore + 1)
+	totalSteps := time.Duration(threshold - c.ThrottleStartScore)
+	if steps > totalSteps {
+		steps = totalSteps
+	}
+	maxDelay := time.Duration(c.ThrottleMaxDelay) * time.Millisecond
+	if c.ThrottleCurve == ThrottleCurveQuadratic {
+		return maxDelay * steps * steps / (totalSteps * totalSteps)
+	}
+	return maxDelay * steps / totalSteps
+}
+
 func newInMemoryDefender(config *DefenderConfig) (Defender, error) {
 	err := config.validate()
 	if err != nil {
 		return nil, err
 	}
 	defender := &memoryDefender{
-		config: config,
-		hosts:  make(map[string]hostScore),
-		banned: make(map[string]time.Time),
+		config:     config,
+		hosts:      make(map[string]hostScore),
+		banned:     make(map[string]time.Time),
+		banCauses:  make(map[string]banCause),
+		graced:     make(map[string]time.Time),
+		reputation: newReputationFeed(config),
+		notifier:   newBanNotifier(config),
 	}
 
 	if err := defender.Reload(); err != nil {
@@ -207,21 +626,13 @@ func newInMemoryDefender(config *DefenderConfig) (Defender, error) {
 
 // Reload reloads block and safe lists
 func (d *memoryDefender) Reload() error {
-	blockList, err := loadHostListFromFile(d.config.BlockListFile)
+	blockList, safeList, err := loadHostLists(d.config)
 	if err != nil {
 		return err
 	}
 
 	d.Lock()
 	d.blockList = blockList
-	d.Unlock()
-
-	safeList, err := loadHostListFromFile(d.config.SafeListFile)
-	if err != nil {
-		return err
-	}
-
-	d.Lock()
 	d.safeList = safeList
 	d.Unlock()
 
@@ -236,56 +647,70 @@ func (d *memoryDefender) GetHosts() []*DefenderEntry {
 	var result []*DefenderEntry
 	for k, v := range d.banned {
 		if v.After(time.Now()) {
-			result = append(result, &DefenderEntry{
-				IP:      k,
-				BanTime: v,
-			})
+			result = append(result, d.getBannedEntry(k, v))
 		}
 	}
 	for k, v := range d.hosts {
-		score := 0
-		for _, event := range v.Events {
-			if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
-				score += event.score
-			}
-		}
-		if score > 0 {
-			result = append(result, &DefenderEntry{
-				IP:    k,
-				Score: score,
-			})
+		if entry := d.getScoreEntry(k, v); entry != nil {
+			result = append(result, entry)
 		}
 	}
 
 	return result
 }
 
-// GetHost returns a defender host by ip, if any
+// getBannedEntry returns the defender entry for a banned host, including the
+// events that caused the ban if known.
+// The caller must hold the lock
+func (d *memoryDefender) getBannedEntry(key string, banTime time.Time) *DefenderEntry {
+	entry := &DefenderEntry{
+		IP:      key,
+		BanTime: banTime,
+	}
+	if cause, ok := d.banCauses[key]; ok {
+		for _, event := range cause.score.Events {
+			entry.addEvent(event.name)
+		}
+	}
+	return entry
+}
+
+// getScoreEntry returns the defender entry for a host with a score, nil if
+// there are no events within the observation time.
+// The caller must hold the lock
+func (d *memoryDefender) getScoreEntry(key string, hs hostScore) *DefenderEntry {
+	entry := &DefenderEntry{
+		IP: key,
+	}
+	for _, event := range hs.Events {
+		if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
+			entry.Score += event.score
+			entry.addEvent(event.name)
+		}
+	}
+	if entry.Score > 0 {
+		return entry
+	}
+	return nil
+}
+
+// GetHost returns a defender host by ip, if any.
+// If the addresses are aggregated by subnet the subnet is returned
 func (d *memoryDefender) GetHost(ip string) (*DefenderEntry, error) {
+	ip = d.config.getHostKey(ip)
+
 	d.RLock()
 	defer d.RUnlock()
 
 	if banTime, ok := d.banned[ip]; ok {
 		if banTime.After(time.Now()) {
-			return &DefenderEntry{
-				IP:      ip,
-				BanTime: banTime,
-			}, nil
+			return d.getBannedEntry(ip, banTime), nil
 		}
 	}
 
 	if hs, ok := d.hosts[ip]; ok {
-		score := 0
-		for _, event := range hs.Events {
-			if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
-				score += event.score
-			}
-		}
-		if score > 0 {
-			return &DefenderEntry{
-				IP:    ip,
-				Score: score,
-			}, nil
+		if entry := d.getScoreEntry(ip, hs); entry != nil {
+			return entry, nil
 		}
 	}
 
@@ -296,14 +721,13 @@ func (d *memoryDefender) GetHost(ip string) (*DefenderEntry, error) {
 // and increase ban time if the IP is found.
 // This method must be called as soon as the client connects
 func (d *memoryDefender) IsBanned(ip string) bool {
+	key := d.config.getHostKey(ip)
+
 	d.RLock()
 
-	if banTime, ok := d.banned[ip]; ok {
+	if banTime, ok := d.banned[key]; ok {
 		if banTime.After(time.Now()) {
-			increment := d.config.BanTime * d.config.BanTimeIncrement / 100
-			if increment == 0 {
-				increment++
-			}
+			increment := d.config.getBanTimeIncrement()
 
 			d.RUnlock()
 
@@ -312,30 +736,61 @@ func (d *memoryDefender) IsBanned(ip string) bool {
 			// until possible for performance reasons, this method is called each
 			// time a new client connects and it must be as fast as possible
 			d.Lock()
-			d.banned[ip] = banTime.Add(time.Duration(increment) * time.Minute)
+			d.banned[key] = banTime.Add(time.Duration(increment) * time.Minute)
 			d.Unlock()
 
 			return true
 		}
 	}
 
-	defer d.RUnlock()
-
 	if d.blockList != nil && d.blockList.isListed(ip) {
+		d.RUnlock()
 		// permanent ban
 		return true
 	}
+	isSafe := d.safeList != nil && d.safeList.isListed(ip)
 
-	return false
+	d.RUnlock()
+
+	if d.reputation == nil || isSafe {
+		return false
+	}
+	return d.checkReputation(ip)
+}
+
+// checkReputation merges the score returned by the reputation feed with the
+// local host score and returns true if the host is banned as result.
+// Cached scores were already merged so they are ignored
+func (d *memoryDefender) checkReputation(ip string) bool {
+	score, isNew := d.reputation.getScore(ip)
+	if !isNew || score <= 0 {
+		return false
+	}
+
+	key := d.config.getHostKey(ip)
+
+	d.Lock()
+	defer d.Unlock()
+	defer d.updateMetrics()
+
+	// the login grace does not apply to the reputation feed
+	d.addScore(key, hostEventReputation, score, d.config.Threshold)
+	_, ok := d.banned[key]
+	return ok
 }
 
 // DeleteHost removes the specified IP from the defender lists
 func (d *memoryDefender) DeleteHost(ip string) bool {
+	ip = d.config.getHostKey(ip)
+
 	d.Lock()
 	defer d.Unlock()
+	defer d.updateMetrics()
 
 	if _, ok := d.banned[ip]; ok {
 		delete(d.banned, ip)
+		delete(d.banCauses, ip)
+		d.notifier.notifyUnban(ip)
 		return true
 	}
 
@@ -347,41 +802,79 @@ func (d *memoryDefender) DeleteHost(ip string) bool {
 	return false
 }
 
-// AddEvent adds an event for the given IP.
+// AddLoginSuccess grants a grace period to the given IP after a successful login.
+// Within this period the host is banned only if its score exceeds the login
+// grace threshold
+func (d *memoryDefender) AddLoginSuccess(ip string) {
+	if d.config.LoginGraceTime <= 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.safeList != nil && d.safeList.isListed(ip) {
+		return
+	}
+
+	d.graced[d.config.getHostKey(ip)] = time.Now().Add(time.Duration(d.config.LoginGraceTime) * time.Minute)
+	cleanupGraced(d.graced, d.config)
+}
+
+// getThreshold returns the ban threshold for the given host key.
+// The caller must hold the lock
+func (d *memoryDefender) getThreshold(key string) int {
+	if expiration, ok := d.graced[key]; ok {
+		if expiration.After(time.Now()) {
+			return d.config.LoginGraceThreshold
+		}
+		delete(d.graced, key)
+	}
+	return d.config.Threshold
+}
+
+// AddEvent adds an event for the given IP and protocol.
 // This method must be called for clients not yet banned
-func (d *memoryDefender) AddEvent(ip string, event HostEvent) {
+func (d *memoryDefender) AddEvent(ip, protocol string, event HostEvent) {
+	metric.AddDefenderEvent(getHostEventName(event))
+
 	d.Lock()
 	defer d.Unlock()
+	defer d.updateMetrics()
 
 	if d.safeList != nil && d.safeList.isListed(ip) {
 		return
 	}
 
+	key := d.config.getHostKey(ip)
 	// ignore events for already banned hosts
-	if v, ok := d.banned[ip]; ok {
+	if v, ok := d.banned[key]; ok {
 		if v.After(time.Now()) {
 			return
 		}
-		delete(d.banned, ip)
+		delete(d.banned, key)
+		delete(d.banCauses, key)
 	}
 
-	var score int
-
-	switch event {
-	case HostEventLoginFailed:
-		score = d.config.ScoreValid
-	case HostEventLimitExceeded:
-		score = d.config.ScoreLimitExceeded
-	case HostEventUserNotFound, HostEventNoLoginTried:
-		score = d.config.ScoreInvalid
+	score := d.config.getEventScore(protocol, event)
+	if score == 0 && event == HostEventAbusiveActivity {
+		return
 	}
 
+	d.addScore(key, getHostEventName(event), score, d.getThreshold(key))
+}
+
+// addScore adds an event with the given name and score for the specified host
+// key and bans it if the given threshold is reached.
+// The caller must hold the lock
+func (d *memoryDefender) addScore(key, name string, score, threshold int) {
 	ev := hostEvent{
 		dateTime: time.Now(),
 		score:    score,
+		name:     name,
 	}
 
-	if hs, ok := d.hosts[ip]; ok {
+	if hs, ok := d.hosts[key]; ok {
 		hs.Events = append(hs.Events, ev)
 		hs.TotalScore = 0
 
@@ -395,15 +888,31 @@ func (d *memoryDefender) AddEvent(ip string, event HostEvent) {
 		}
 
 		hs.Events = hs.Events[:idx]
-		if hs.TotalScore >= d.config.Threshold {
-			d.banned[ip] = time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
-			delete(d.hosts, ip)
+		if hs.TotalScore >= threshold {
+			d.banned[key] = time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
+			d.banCauses[key] = banCause{score: hs, threshold: threshold}
+			d.notifier.notifyBan(key, hs.TotalScore, d.banned[key], name)
+			metric.AddDefenderBan()
+			delete(d.hosts, key)
 			d.cleanupBanned()
 		} else {
-			d.hosts[ip] = hs
+			d.hosts[key] = hs
+		}
+	} else if ev.score >= threshold {
+		// only a block decision from the reputation feed can exceed the threshold with a single event
+		d.banned[key] = time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
+		d.banCauses[key] = banCause{
+			score: hostScore{
+				TotalScore: ev.score,
+				Events:     []hostEvent{ev},
+			},
+			threshold: threshold,
 		}
+		d.notifier.notifyBan(key, ev.score, d.banned[key], name)
+		metric.AddDefenderBan()
+		d.cleanupBanned()
 	} else {
-		d.hosts[ip] = hostScore{
+		d.hosts[key] = hostScore{
 			TotalScore: ev.score,
 			Events:     []hostEvent{ev},
 		}
@@ -411,6 +920,20 @@ func (d *memoryDefender) AddEvent(ip string, event HostEvent) {
 	}
 }
 
+// updateMetrics sets the metrics for the banned hosts and the hosts with a score.
+// Expired bans are removed lazily so they are not counted.
+// The caller must hold the lock
+func (d *memoryDefender) updateMetrics() {
+	now := time.Now()
+	banned := 0
+	for _, banTime := range d.banned {
+		if banTime.After(now) {
+			banned++
+		}
+	}
+	metric.UpdateDefenderHosts(banned, len(d.hosts))
+}
+
 func (d *memoryDefender) countBanned() int {
 	d.RLock()
 	defer d.RUnlock()
@@ -418,6 +941,13 @@ func (d *memoryDefender) countBanned() int {
 	return len(d.banned)
 }
 
+func (d *memoryDefender) countGraced() int {
+	d.RLock()
+	defer d.RUnlock()
+
+	return len(d.graced)
+}
+
 func (d *memoryDefender) countHosts() int {
 	d.RLock()
 	defer d.RUnlock()
@@ -427,6 +957,8 @@ func (d *memoryDefender) countHosts() int {
 
 // GetBanTime returns the ban time for the given IP or nil if the IP is not banned
 func (d *memoryDefender) GetBanTime(ip string) *time.Time {
+	ip = d.config.getHostKey(ip)
+
 	d.RLock()
 	defer d.RUnlock()
 
@@ -439,6 +971,8 @@ func (d *memoryDefender) GetBanTime(ip string) *time.Time {
 
 // GetScore returns the score for the given IP
 func (d *memoryDefender) GetScore(ip string) int {
+	ip = d.config.getHostKey(ip)
+
 	d.RLock()
 	defer d.RUnlock()
 
@@ -455,8 +989,100 @@ func (d *memoryDefender) GetScore(ip string) int {
 	return score
 }
 
+// GetThrottleDelay returns how long to wait before accepting a new connection
+// from the given IP. The delay starts once the host score reaches the configured
+// throttle start score and grows, following the configured curve, up to the
+// maximum delay just before the ban threshold. Safe listed hosts are never delayed
+func (d *memoryDefender) GetThrottleDelay(ip string) time.Duration {
+	if d.config.ThrottleMaxDelay <= 0 {
+		return 0
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.safeList != nil && d.safeList.isListed(ip) {
+		return 0
+	}
+	key := d.config.getHostKey(ip)
+	hs, ok := d.hosts[key]
+	if !ok {
+		return 0
+	}
+	score := 0
+	for _, event := range hs.Events {
+		if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
+			score += event.score
+		}
+	}
+	threshold := d.config.Threshold
+	if expiration, ok := d.graced[key]; ok && expiration.After(time.Now()) {
+		threshold = d.config.LoginGraceThreshold
+	}
+	return d.config.getThrottleDelay(score, threshold)
+}
+
+// ExplainBan returns why the given IP is banned or, if it is not banned,
+// its current score and the events contributing to it
+func (d *memoryDefender) ExplainBan(ip string) *BanExplanation {
+	d.RLock()
+	defer d.RUnlock()
+
+	now := time.Now()
+	key := d.config.getHostKey(ip)
+	result := &BanExplanation{
+		IP:         ip,
+		Reason:     BanReasonNone,
+		SafeListed: d.safeList != nil && d.safeList.isListed(ip),
+		Threshold:  d.config.Threshold,
+	}
+
+	// the same order used in IsBanned
+	if banTime, ok := d.banned[key]; ok && banTime.After(now) {
+		result.Banned = true
+		result.Reason = BanReasonScore
+		result.BanTime = &banTime
+		if cause, ok := d.banCauses[key]; ok {
+			result.Score = cause.score.TotalScore
+			result.Threshold = cause.threshold
+			result.Events = getBanExplanationEvents(cause.score.Events)
+		}
+		return result
+	}
+
+	if d.blockList != nil {
+		if entry := d.blockList.getMatch(ip); entry != "" {
+			result.Banned = true
+			result.Reason = BanReasonBlockList
+			result.BlockListFile = d.config.BlockListFile
+			result.BlockListEntry = entry
+			return result
+		}
+	}
+
+	if expiration, ok := d.graced[key]; ok && expiration.After(now) {
+		result.Threshold = d.config.LoginGraceThreshold
+	}
+	if hs, ok := d.hosts[key]; ok {
+		var events []hostEvent
+		for _, event := range hs.Events {
+			if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(now) {
+				result.Score += event.score
+				events = append(events, event)
+			}
+		}
+		if len(events) > 0 {
+			result.Events = getBanExplanationEvents(events)
+		}
+	}
+
+	return result
+}
+
 func (d *memoryDefender) cleanupBanned() {
 	if len(d.banned) > d.config.EntriesHardLimit {
+		defer d.cleanupBanCauses()
+
 		kvList := make(kvList, 0, len(d.banned))
 
 		for k, v := range d.banned {
@@ -489,6 +1115,15 @@ func (d *memoryDefender) cleanupBanned() {
 	}
 }
 
+// cleanupBanCauses removes the ban causes for the hosts no longer banned
+func (d *memoryDefender) cleanupBanCauses() {
+	for k := range d.banCauses {
+		if _, ok := d.banned[k]; !ok {
+			delete(d.banCauses, k)
+		}
+	}
+}
+
 func (d *memoryDefender) cleanupHosts() {
 	if len(d.hosts) > d.config.EntriesHardLimit {
 		kvList := make(kvList, 0, len(d.hosts))
@@ -518,6 +1153,65 @@ func (d *memoryDefender) cleanupHosts() {
 	}
 }
 
+// cleanupGraced removes the expired grace periods and, if required, the oldest
+// ones to respect the configured limits
+func cleanupGraced(graced map[string]time.Time, config *DefenderConfig) {
+	if len(graced) > config.EntriesHardLimit {
+		kvList := make(kvList, 0, len(graced))
+
+		for k, v := range graced {
+			if v.Before(time.Now()) {
+				delete(graced, k)
+				continue
+			}
+
+			kvList = append(kvList, kv{
+				Key:   k,
+				Value: v.UnixNano(),
+			})
+		}
+
+		numToRemove := len(graced) - config.EntriesSoftLimit
+
+		if numToRemove <= 0 {
+			return
+		}
+
+		sort.Sort(kvList)
+
+		for idx, kv := range kvList {
+			if idx >= numToRemove {
+				break
+			}
+
+			delete(graced, kv.Key)
+		}
+	}
+}
+
+// loadHostLists loads both the block and the safe list, so the active lists
+// can be replaced only if both are valid
+func loadHostLists(config *DefenderConfig) (*HostList, *HostList, error) {
+	timeout := time.Duration(config.ListsURLTimeout) * time.Second
+	blockList, err := loadHostList(config.BlockListFile, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	safeList, err := loadHostList(config.SafeListFile, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blockList, safeList, nil
+}
+
+// loadHostList loads a host list from a file or from an HTTP URL
+func loadHostList(name string, timeout time.Duration) (*HostList, error) {
+	if isHostListURL(name) {
+		return loadHostListFromURL(name, timeout)
+	}
+	return loadHostListFromFile(name)
+}
+
 func loadHostListFromFile(name string) (*HostList, error) {
 	if name == "" {
 		return nil, nil
@@ -532,7 +1226,7 @@ func loadHostListFromFile(name string) (*HostList, error) {
 	}
 
 	// opinionated max size, you should avoid big host lists
-	if info.Size() > 1048576*5 { // 5MB
+	if info.Size() > maxHostListSize {
 		return nil, fmt.Errorf("host list file %#v is too big: %v bytes", name, info.Size())
 	}
 
@@ -541,9 +1235,15 @@ func loadHostListFromFile(name string) (*HostList, error) {
 		return nil, fmt.Errorf("unable to read input file %#v: %v", name, err)
 	}
 
+	return parseHostList(name, content)
+}
+
+// parseHostList parses a host list as JSON, the invalid IP addresses and
+// networks are skipped
+func parseHostList(name string, content []byte) (*HostList, error) {
 	var hostList HostListFile
 
-	err = json.Unmarshal(content, &hostList)
+	err := json.Unmarshal(content, &hostList)
 	if err != nil {
 		return nil, err
 	}
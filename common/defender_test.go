@@ -1,20 +1,31 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/yl2chen/cidranger"
+
+	"github.com/drakkan/sftpgo/v2/dataprovider"
+	"github.com/drakkan/sftpgo/v2/util"
 )
 
 func TestBasicDefender(t *testing.T) {
@@ -77,13 +88,13 @@ func TestBasicDefender(t *testing.T) {
 	_, err = defender.GetHost("10.8.0.4")
 	assert.Error(t, err)
 
-	defender.AddEvent("172.16.1.4", HostEventLoginFailed)
-	defender.AddEvent("192.168.8.4", HostEventUserNotFound)
-	defender.AddEvent("172.16.1.3", HostEventLimitExceeded)
+	defender.AddEvent("172.16.1.4", ProtocolSSH, HostEventLoginFailed)
+	defender.AddEvent("192.168.8.4", ProtocolSSH, HostEventUserNotFound)
+	defender.AddEvent("172.16.1.3", ProtocolSSH, HostEventLimitExceeded)
 	assert.Equal(t, 0, defender.countHosts())
 
 	testIP := "12.34.56.78"
-	defender.AddEvent(testIP, HostEventLoginFailed)
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLoginFailed)
 	assert.Equal(t, 1, defender.countHosts())
 	assert.Equal(t, 0, defender.countBanned())
 	assert.Equal(t, 1, defender.GetScore(testIP))
@@ -96,16 +107,18 @@ func TestBasicDefender(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 1, host.Score)
 	assert.Empty(t, host.GetBanTime())
+	assert.Equal(t, map[string]int{"login_failed": 1}, host.Events)
+	assert.Empty(t, host.LastEvent)
 	assert.Nil(t, defender.GetBanTime(testIP))
-	defender.AddEvent(testIP, HostEventLimitExceeded)
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLimitExceeded)
 	assert.Equal(t, 1, defender.countHosts())
 	assert.Equal(t, 0, defender.countBanned())
 	assert.Equal(t, 4, defender.GetScore(testIP))
 	if assert.Len(t, defender.GetHosts(), 1) {
 		assert.Equal(t, 4, defender.GetHosts()[0].Score)
 	}
-	defender.AddEvent(testIP, HostEventNoLoginTried)
-	defender.AddEvent(testIP, HostEventNoLoginTried)
+	defender.AddEvent(testIP, ProtocolSSH, HostEventNoLoginTried)
+	defender.AddEvent(testIP, ProtocolSSH, HostEventNoLoginTried)
 	assert.Equal(t, 0, defender.countHosts())
 	assert.Equal(t, 1, defender.countBanned())
 	assert.Equal(t, 0, defender.GetScore(testIP))
@@ -120,17 +133,33 @@ func TestBasicDefender(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 0, host.Score)
 	assert.NotEmpty(t, host.GetBanTime())
+	// the first no_login_tried event banned the host, the second one was ignored
+	assert.Equal(t, map[string]int{
+		"login_failed":   1,
+		"limit_exceeded": 1,
+		"no_login_tried": 1,
+	}, host.Events)
+	assert.Equal(t, "no_login_tried", host.LastEvent)
+	assert.Equal(t, host.Events, defender.GetHosts()[0].Events)
+	assert.Equal(t, host.LastEvent, defender.GetHosts()[0].LastEvent)
+	data, err = json.Marshal(host)
+	assert.NoError(t, err)
+	var jsonHost map[string]interface{}
+	err = json.Unmarshal(data, &jsonHost)
+	assert.NoError(t, err)
+	assert.Equal(t, "no_login_tried", jsonHost["last_event"])
+	assert.Len(t, jsonHost["events"], 3)
 
 	// now test cleanup, testIP is already banned
 	testIP1 := "12.34.56.79"
 	testIP2 := "12.34.56.80"
 	testIP3 := "12.34.56.81"
 
-	defender.AddEvent(testIP1, HostEventNoLoginTried)
-	defender.AddEvent(testIP2, HostEventNoLoginTried)
+	defender.AddEvent(testIP1, ProtocolSSH, HostEventNoLoginTried)
+	defender.AddEvent(testIP2, ProtocolSSH, HostEventNoLoginTried)
 	assert.Equal(t, 2, defender.countHosts())
 	time.Sleep(20 * time.Millisecond)
-	defender.AddEvent(testIP3, HostEventNoLoginTried)
+	defender.AddEvent(testIP3, ProtocolSSH, HostEventNoLoginTried)
 	assert.Equal(t, defender.config.EntriesSoftLimit, defender.countHosts())
 	// testIP1 and testIP2 should be removed
 	assert.Equal(t, defender.config.EntriesSoftLimit, defender.countHosts())
@@ -138,15 +167,15 @@ func TestBasicDefender(t *testing.T) {
 	assert.Equal(t, 0, defender.GetScore(testIP2))
 	assert.Equal(t, 2, defender.GetScore(testIP3))
 
-	defender.AddEvent(testIP3, HostEventNoLoginTried)
-	defender.AddEvent(testIP3, HostEventNoLoginTried)
+	defender.AddEvent(testIP3, ProtocolSSH, HostEventNoLoginTried)
+	defender.AddEvent(testIP3, ProtocolSSH, HostEventNoLoginTried)
 	// IP3 is now banned
 	assert.NotNil(t, defender.GetBanTime(testIP3))
 	assert.Equal(t, 0, defender.countHosts())
 
 	time.Sleep(20 * time.Millisecond)
 	for i := 0; i < 3; i++ {
-		defender.AddEvent(testIP1, HostEventNoLoginTried)
+		defender.AddEvent(testIP1, ProtocolSSH, HostEventNoLoginTried)
 	}
 	assert.Equal(t, 0, defender.countHosts())
 	assert.Equal(t, config.EntriesSoftLimit, defender.countBanned())
@@ -155,9 +184,9 @@ func TestBasicDefender(t *testing.T) {
 	assert.NotNil(t, defender.GetBanTime(testIP1))
 
 	for i := 0; i < 3; i++ {
-		defender.AddEvent(testIP, HostEventNoLoginTried)
+		defender.AddEvent(testIP, ProtocolSSH, HostEventNoLoginTried)
 		time.Sleep(10 * time.Millisecond)
-		defender.AddEvent(testIP3, HostEventNoLoginTried)
+		defender.AddEvent(testIP3, ProtocolSSH, HostEventNoLoginTried)
 	}
 	assert.Equal(t, 0, defender.countHosts())
 	assert.Equal(t, defender.config.EntriesSoftLimit, defender.countBanned())
@@ -211,7 +240,7 @@ func TestExpiredHostBans(t *testing.T) {
 	_, ok := defender.banned[testIP]
 	assert.True(t, ok)
 	// now add an event for an expired banned ip, it should be removed
-	defender.AddEvent(testIP, HostEventLoginFailed)
+	defender.AddEvent(testIP, ProtocolSSH, HostEventLoginFailed)
 	assert.False(t, defender.IsBanned(testIP))
 	entry, err := defender.GetHost(testIP)
 	assert.NoError(t, err)
@@ -405,6 +434,393 @@ func TestDefenderCleanup(t *testing.T) {
 	assert.Equal(t, 0, d.GetScore("3.3.3.4"))
 }
 
+func TestAbusiveActivityEvents(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 2,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+	}
+	d, err := newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	defender := d.(*memoryDefender)
+	ip := "172.16.3.1"
+	// abusive activity events are ignored by default
+	for i := 0; i < 10; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventAbusiveActivity)
+	}
+	assert.Equal(t, 0, defender.countHosts())
+	assert.False(t, defender.IsBanned(ip))
+
+	config.ScoreAbusiveActivity = 2
+	d, err = newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	defender = d.(*memoryDefender)
+	defender.AddEvent(ip, ProtocolSSH, HostEventAbusiveActivity)
+	defender.AddEvent(ip, ProtocolSSH, HostEventAbusiveActivity)
+	assert.Equal(t, 1, defender.countHosts())
+	assert.Equal(t, 0, defender.countBanned())
+	assert.Equal(t, 4, defender.GetScore(ip))
+	assert.False(t, defender.IsBanned(ip))
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventAbusiveActivity)
+	assert.Equal(t, 0, defender.countHosts())
+	assert.Equal(t, 1, defender.countBanned())
+	assert.True(t, defender.IsBanned(ip))
+}
+
+func TestDefenderLoginGrace(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 2,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 1,
+		EntriesHardLimit: 2,
+	}
+	d, err := newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	defender := d.(*memoryDefender)
+	ip := "172.16.4.1"
+	// the grace is disabled by default
+	defender.AddLoginSuccess(ip)
+	assert.Equal(t, 0, defender.countGraced())
+	for i := 0; i < 5; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	}
+	assert.True(t, defender.IsBanned(ip))
+
+	config.LoginGraceTime = 10
+	config.LoginGraceThreshold = 10
+	d, err = newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	defender = d.(*memoryDefender)
+	defender.AddLoginSuccess(ip)
+	assert.Equal(t, 1, defender.countGraced())
+	for i := 0; i < 9; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	}
+	assert.False(t, defender.IsBanned(ip))
+	assert.Equal(t, 9, defender.GetScore(ip))
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	assert.True(t, defender.IsBanned(ip))
+	assert.Equal(t, 0, defender.countHosts())
+	// an expired grace restores the default threshold
+	ip = "172.16.4.2"
+	defender.AddLoginSuccess(ip)
+	defender.Lock()
+	defender.graced[ip] = time.Now().Add(-1 * time.Second)
+	defender.Unlock()
+	for i := 0; i < 4; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	}
+	assert.False(t, defender.IsBanned(ip))
+	assert.Equal(t, 1, defender.countGraced())
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	assert.True(t, defender.IsBanned(ip))
+	// the number of graced hosts is bounded
+	defender.AddLoginSuccess("172.16.4.3")
+	assert.Equal(t, 2, defender.countGraced())
+	time.Sleep(20 * time.Millisecond)
+	defender.AddLoginSuccess("172.16.4.4")
+	assert.Equal(t, config.EntriesSoftLimit, defender.countGraced())
+	defender.RLock()
+	_, ok := defender.graced["172.16.4.4"]
+	defender.RUnlock()
+	assert.True(t, ok)
+	// safe listed hosts are never graced, they are never banned
+	defender.safeList = &HostList{
+		IPAddresses: map[string]bool{"172.16.4.5": true},
+		Ranges:      cidranger.NewPCTrieRanger(),
+	}
+	defender.AddLoginSuccess("172.16.4.5")
+	defender.RLock()
+	_, ok = defender.graced["172.16.4.5"]
+	defender.RUnlock()
+	assert.False(t, ok)
+}
+
+func TestDefenderThrottling(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 2,
+		Threshold:        11,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+	}
+	d, err := newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	ip := "172.16.5.1"
+	for i := 0; i < 5; i++ {
+		d.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	}
+	// throttling is disabled by default
+	assert.Equal(t, time.Duration(0), d.GetThrottleDelay(ip))
+
+	config.ThrottleMaxDelay = 1000
+	config.ThrottleStartScore = 1
+	d, err = newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	defender := d.(*memoryDefender)
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+	var lastDelay time.Duration
+	for i := 1; i < 11; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+		delay := defender.GetThrottleDelay(ip)
+		assert.Greater(t, delay, lastDelay)
+		assert.Equal(t, time.Duration(i)*100*time.Millisecond, delay)
+		lastDelay = delay
+	}
+	assert.False(t, defender.IsBanned(ip))
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	assert.True(t, defender.IsBanned(ip))
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+	// the delay decreases and then disappears as the score decays
+	ip = "172.16.5.2"
+	defender.Lock()
+	defender.hosts[ip] = hostScore{
+		TotalScore: 6,
+		Events: []hostEvent{
+			{
+				dateTime: time.Now().Add(-20 * time.Minute),
+				score:    2,
+			},
+			{
+				dateTime: time.Now().Add(-16 * time.Minute),
+				score:    2,
+			},
+			{
+				dateTime: time.Now(),
+				score:    2,
+			},
+		},
+	}
+	defender.Unlock()
+	assert.Equal(t, 200*time.Millisecond, defender.GetThrottleDelay(ip))
+	defender.Lock()
+	defender.hosts[ip].Events[2].dateTime = time.Now().Add(-15 * time.Minute)
+	defender.Unlock()
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+	// the grace threshold slows down the delay growth
+	ip = "172.16.5.3"
+	config.LoginGraceTime = 10
+	config.LoginGraceThreshold = 21
+	config.ThrottleCurve = ThrottleCurveQuadratic
+	d, err = newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	defender = d.(*memoryDefender)
+	for i := 0; i < 5; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	}
+	assert.Equal(t, 250*time.Millisecond, defender.GetThrottleDelay(ip))
+	defender.AddLoginSuccess(ip)
+	assert.Equal(t, 62500*time.Microsecond, defender.GetThrottleDelay(ip))
+	// safe listed hosts are never delayed
+	defender.safeList = &HostList{
+		IPAddresses: map[string]bool{ip: true},
+		Ranges:      cidranger.NewPCTrieRanger(),
+	}
+	assert.Equal(t, time.Duration(0), defender.GetThrottleDelay(ip))
+}
+
+func TestDefenderExplainBlockList(t *testing.T) {
+	bl := HostListFile{
+		IPAddresses:  []string{"172.16.5.1"},
+		CIDRNetworks: []string{"10.9.0.0/24"},
+	}
+	sl := HostListFile{
+		IPAddresses: []string{"172.16.5.2"},
+	}
+	blFile := filepath.Join(os.TempDir(), "bl_explain.json")
+	slFile := filepath.Join(os.TempDir(), "sl_explain.json")
+	data, err := json.Marshal(bl)
+	assert.NoError(t, err)
+	err = os.WriteFile(blFile, data, os.ModePerm)
+	assert.NoError(t, err)
+	data, err = json.Marshal(sl)
+	assert.NoError(t, err)
+	err = os.WriteFile(slFile, data, os.ModePerm)
+	assert.NoError(t, err)
+
+	config := &DefenderConfig{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 2,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+		SafeListFile:     slFile,
+		BlockListFile:    blFile,
+	}
+	d, err := newInMemoryDefender(config)
+	assert.NoError(t, err)
+	defender := d.(*memoryDefender)
+
+	explanation := defender.ExplainBan("172.16.5.1")
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, BanReasonBlockList, explanation.Reason)
+	assert.Equal(t, blFile, explanation.BlockListFile)
+	assert.Equal(t, "172.16.5.1", explanation.BlockListEntry)
+	assert.Nil(t, explanation.BanTime)
+	assert.Len(t, explanation.Events, 0)
+
+	explanation = defender.ExplainBan("10.9.0.3")
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, BanReasonBlockList, explanation.Reason)
+	assert.Equal(t, blFile, explanation.BlockListFile)
+	assert.Equal(t, "10.9.0.0/24", explanation.BlockListEntry)
+
+	explanation = defender.ExplainBan("10.9.1.3")
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, BanReasonNone, explanation.Reason)
+	assert.Empty(t, explanation.BlockListFile)
+	assert.Empty(t, explanation.BlockListEntry)
+
+	explanation = defender.ExplainBan("172.16.5.2")
+	assert.False(t, explanation.Banned)
+	assert.True(t, explanation.SafeListed)
+
+	err = os.Remove(blFile)
+	assert.NoError(t, err)
+	err = os.Remove(slFile)
+	assert.NoError(t, err)
+}
+
+func TestDefenderExplainScore(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:            true,
+		BanTime:            10,
+		BanTimeIncrement:   2,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+	}
+	d, err := newInMemoryDefender(config)
+	assert.NoError(t, err)
+	defender := d.(*memoryDefender)
+
+	ip := "172.16.6.1"
+	explanation := defender.ExplainBan(ip)
+	assert.Equal(t, ip, explanation.IP)
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, BanReasonNone, explanation.Reason)
+	assert.Equal(t, 0, explanation.Score)
+	assert.Equal(t, 5, explanation.Threshold)
+	assert.Len(t, explanation.Events, 0)
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	explanation = defender.ExplainBan(ip)
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, BanReasonNone, explanation.Reason)
+	assert.Nil(t, explanation.BanTime)
+	assert.Equal(t, 3, explanation.Score)
+	assert.Equal(t, defender.GetScore(ip), explanation.Score)
+	assert.Equal(t, 5, explanation.Threshold)
+	if assert.Len(t, explanation.Events, 2) {
+		assert.Equal(t, "login_failed", explanation.Events[0].Event)
+		assert.Equal(t, 1, explanation.Events[0].Score)
+		assert.False(t, explanation.Events[0].Time.IsZero())
+		assert.Equal(t, "user_not_found", explanation.Events[1].Event)
+		assert.Equal(t, 2, explanation.Events[1].Score)
+	}
+	// events outside the observation time are not reported
+	defender.Lock()
+	hs := defender.hosts[ip]
+	hs.Events[0].dateTime = time.Now().Add(-1 * time.Hour)
+	defender.Unlock()
+	explanation = defender.ExplainBan(ip)
+	assert.Equal(t, 2, explanation.Score)
+	if assert.Len(t, explanation.Events, 1) {
+		assert.Equal(t, "user_not_found", explanation.Events[0].Event)
+	}
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventLimitExceeded)
+	assert.True(t, defender.IsBanned(ip))
+	explanation = defender.ExplainBan(ip)
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, BanReasonScore, explanation.Reason)
+	if assert.NotNil(t, explanation.BanTime) {
+		assert.Equal(t, *defender.GetBanTime(ip), *explanation.BanTime)
+	}
+	assert.Equal(t, 5, explanation.Score)
+	assert.Equal(t, 5, explanation.Threshold)
+	if assert.Len(t, explanation.Events, 2) {
+		assert.Equal(t, "user_not_found", explanation.Events[0].Event)
+		assert.Equal(t, "limit_exceeded", explanation.Events[1].Event)
+		assert.Equal(t, 3, explanation.Events[1].Score)
+	}
+	asJSON, err := json.Marshal(explanation)
+	assert.NoError(t, err)
+	assert.Contains(t, string(asJSON), `"reason":"score"`)
+	assert.NotContains(t, string(asJSON), "blocklist_file")
+	// the ban causes are removed with the ban
+	assert.True(t, defender.DeleteHost(ip))
+	defender.RLock()
+	assert.Len(t, defender.banCauses, 0)
+	defender.RUnlock()
+	explanation = defender.ExplainBan(ip)
+	assert.False(t, explanation.Banned)
+	assert.Len(t, explanation.Events, 0)
+	// expired bans are not explained
+	for i := 0; i < 3; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.True(t, defender.IsBanned(ip))
+	defender.Lock()
+	defender.banned[ip] = time.Now().Add(-1 * time.Second)
+	defender.Unlock()
+	explanation = defender.ExplainBan(ip)
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, BanReasonNone, explanation.Reason)
+	// a login grace changes the threshold
+	config.LoginGraceTime = 10
+	config.LoginGraceThreshold = 10
+	d, err = newInMemoryDefender(config)
+	assert.NoError(t, err)
+	defender = d.(*memoryDefender)
+	defender.AddLoginSuccess(ip)
+	for i := 0; i < 4; i++ {
+		defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	}
+	explanation = defender.ExplainBan(ip)
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, 8, explanation.Score)
+	assert.Equal(t, 10, explanation.Threshold)
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	explanation = defender.ExplainBan(ip)
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, 10, explanation.Score)
+	assert.Equal(t, 10, explanation.Threshold)
+	assert.Len(t, explanation.Events, 5)
+}
+
 func TestDefenderConfig(t *testing.T) {
 	c := DefenderConfig{}
 	err := c.validate()
@@ -422,6 +838,21 @@ func TestDefenderConfig(t *testing.T) {
 	require.Error(t, err)
 
 	c.ScoreLimitExceeded = 2
+	c.ScoreAbusiveActivity = 10
+	err = c.validate()
+	require.Error(t, err)
+
+	c.ScoreAbusiveActivity = 0
+	c.AbusiveDownloads = -1
+	err = c.validate()
+	require.Error(t, err)
+
+	c.AbusiveDownloads = 0
+	c.AbusiveListings = -1
+	err = c.validate()
+	require.Error(t, err)
+
+	c.AbusiveListings = 0
 	c.ScoreValid = 10
 	err = c.validate()
 	require.Error(t, err)
@@ -456,97 +887,458 @@ func TestDefenderConfig(t *testing.T) {
 	c.EntriesHardLimit = 20
 	err = c.validate()
 	require.NoError(t, err)
-}
 
-func BenchmarkDefenderBannedSearch(b *testing.B) {
-	d := getDefenderForBench()
+	c.LoginGraceTime = -1
+	err = c.validate()
+	require.Error(t, err)
 
-	ip, ipnet, err := net.ParseCIDR("10.8.0.0/12") // 1048574 ip addresses
-	if err != nil {
-		panic(err)
-	}
+	c.LoginGraceTime = 10
+	c.LoginGraceThreshold = 10
+	err = c.validate()
+	require.Error(t, err)
 
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		d.banned[ip.String()] = time.Now().Add(10 * time.Minute)
-	}
+	c.LoginGraceThreshold = 20
+	err = c.validate()
+	require.NoError(t, err)
 
-	b.ResetTimer()
+	c.ThrottleMaxDelay = -1
+	err = c.validate()
+	require.Error(t, err)
 
-	for i := 0; i < b.N; i++ {
-		d.IsBanned("192.168.1.1")
-	}
-}
+	c.ThrottleMaxDelay = 1000
+	err = c.validate()
+	require.Error(t, err)
 
-func BenchmarkCleanup(b *testing.B) {
-	d := getDefenderForBench()
+	c.ThrottleStartScore = 10
+	err = c.validate()
+	require.Error(t, err)
 
-	ip, ipnet, err := net.ParseCIDR("192.168.4.0/24")
-	if err != nil {
-		panic(err)
-	}
+	c.ThrottleStartScore = 5
+	c.ThrottleCurve = "cubic"
+	err = c.validate()
+	require.Error(t, err)
 
-	b.ResetTimer()
+	c.ThrottleCurve = ""
+	err = c.validate()
+	require.NoError(t, err)
+	require.Equal(t, ThrottleCurveLinear, c.ThrottleCurve)
 
-	for i := 0; i < b.N; i++ {
-		for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-			d.AddEvent(ip.String(), HostEventLoginFailed)
-			if d.countHosts() > d.config.EntriesHardLimit {
-				panic("too many hosts")
-			}
-			if d.countBanned() > d.config.EntriesSoftLimit {
-				panic("too many ip banned")
-			}
-		}
+	c.ProtocolScores = []DefenderProtocolScores{
+		{
+			ScoreInvalid: 5,
+		},
 	}
-}
+	err = c.validate()
+	require.Error(t, err)
 
-func BenchmarkDefenderBannedSearchWithBlockList(b *testing.B) {
-	d := getDefenderForBench()
+	c.ProtocolScores[0].Protocols = []string{"SMB"}
+	err = c.validate()
+	require.Error(t, err)
 
-	d.blockList = &HostList{
-		IPAddresses: make(map[string]bool),
-		Ranges:      cidranger.NewPCTrieRanger(),
-	}
+	c.ProtocolScores[0].Protocols = []string{ProtocolFTP}
+	c.ProtocolScores[0].ScoreInvalid = 10
+	err = c.validate()
+	require.Error(t, err)
 
-	ip, ipnet, err := net.ParseCIDR("129.8.0.0/12") // 1048574 ip addresses
-	if err != nil {
-		panic(err)
-	}
+	c.ProtocolScores[0].ScoreInvalid = -1
+	err = c.validate()
+	require.Error(t, err)
 
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		d.banned[ip.String()] = time.Now().Add(10 * time.Minute)
-		d.blockList.IPAddresses[ip.String()] = true
-	}
+	c.ProtocolScores[0].ScoreInvalid = 5
+	c.ProtocolScores = append(c.ProtocolScores, DefenderProtocolScores{
+		Protocols:    []string{ProtocolWebDAV, ProtocolFTP},
+		ScoreInvalid: 4,
+	})
+	err = c.validate()
+	require.Error(t, err)
 
-	for i := 0; i < 255; i++ {
-		cidr := fmt.Sprintf("10.8.%v.1/24", i)
-		_, network, _ := net.ParseCIDR(cidr)
-		if err := d.blockList.Ranges.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
-			panic(err)
-		}
-	}
+	c.ProtocolScores[1].Protocols = []string{ProtocolWebDAV}
+	err = c.validate()
+	require.NoError(t, err)
+	c.ProtocolScores = nil
+	require.Equal(t, DefenderDriverMemory, c.Driver)
 
-	b.ResetTimer()
+	c.BanHook = "relative/path"
+	err = c.validate()
+	require.Error(t, err)
+	c.BanHook = ""
 
-	for i := 0; i < b.N; i++ {
-		d.IsBanned("192.168.1.1")
-	}
-}
+	c.IPv6SubnetBits = 129
+	err = c.validate()
+	require.Error(t, err)
+	c.IPv6SubnetBits = -1
+	err = c.validate()
+	require.Error(t, err)
+	c.IPv6SubnetBits = 64
+	c.IPv4SubnetBits = 33
+	err = c.validate()
+	require.Error(t, err)
+	c.IPv4SubnetBits = 24
+	err = c.validate()
+	require.NoError(t, err)
 
-func BenchmarkHostListSearch(b *testing.B) {
-	hostlist := &HostList{
-		IPAddresses: make(map[string]bool),
-		Ranges:      cidranger.NewPCTrieRanger(),
-	}
+	c.ListsCheckInterval = -1
+	err = c.validate()
+	require.Error(t, err)
+	c.ListsCheckInterval = 0
+	c.ListsRefreshInterval = -1
+	err = c.validate()
+	require.Error(t, err)
+	c.ListsRefreshInterval = 0
+	c.ListsURLTimeout = -1
+	err = c.validate()
+	require.Error(t, err)
+	c.ListsURLTimeout = 0
 
-	ip, ipnet, _ := net.ParseCIDR("172.16.0.0/16")
+	c.Driver = "unknown"
+	err = c.validate()
+	require.Error(t, err)
 
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		hostlist.IPAddresses[ip.String()] = true
-	}
+	c.Driver = DefenderDriverRedis
+	err = c.validate()
+	require.Error(t, err)
 
-	for i := 0; i < 255; i++ {
-		cidr := fmt.Sprintf("10.8.%v.1/24", i)
+	c.Redis.Address = "127.0.0.1:6379"
+	c.Redis.DB = -1
+	err = c.validate()
+	require.Error(t, err)
+
+	c.Redis.DB = 1
+	err = c.validate()
+	require.NoError(t, err)
+
+	c.Driver = DefenderDriverProvider
+	err = c.validate()
+	require.NoError(t, err)
+}
+
+func TestProviderDefender(t *testing.T) {
+	bl := HostListFile{
+		IPAddresses: []string{"172.16.6.1"},
+	}
+	sl := HostListFile{
+		IPAddresses: []string{"172.16.6.2"},
+	}
+	blFile := filepath.Join(os.TempDir(), "bl_provider.json")
+	slFile := filepath.Join(os.TempDir(), "sl_provider.json")
+	data, err := json.Marshal(bl)
+	assert.NoError(t, err)
+	err = os.WriteFile(blFile, data, os.ModePerm)
+	assert.NoError(t, err)
+	data, err = json.Marshal(sl)
+	assert.NoError(t, err)
+	err = os.WriteFile(slFile, data, os.ModePerm)
+	assert.NoError(t, err)
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		Driver:             DefenderDriverProvider,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		SafeListFile:       slFile,
+		BlockListFile:      blFile,
+	}
+	d, err := newProviderDefender(config)
+	require.NoError(t, err)
+	defender := d.(*providerDefender)
+
+	assert.True(t, defender.IsBanned("172.16.6.1"))
+	assert.False(t, defender.IsBanned("172.16.6.3"))
+	defender.AddEvent("172.16.6.2", ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 0, defender.GetScore("172.16.6.2"))
+
+	ip := "172.16.6.3"
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 3, defender.GetScore(ip))
+	assert.False(t, defender.IsBanned(ip))
+	assert.Nil(t, defender.GetBanTime(ip))
+	entry, err := defender.GetHost(ip)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, entry.Score)
+		assert.True(t, entry.BanTime.IsZero())
+		assert.Equal(t, map[string]int{"login_failed": 1, "user_not_found": 1}, entry.Events)
+		assert.Empty(t, entry.LastEvent)
+	}
+	explanation := defender.ExplainBan(ip)
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, 3, explanation.Score)
+	assert.Len(t, explanation.Events, 2)
+	found := false
+	for _, h := range defender.GetHosts() {
+		if h.IP == ip {
+			found = true
+			assert.Equal(t, 3, h.Score)
+			assert.Len(t, h.Events, 2)
+		}
+	}
+	assert.True(t, found)
+
+	defender.AddEvent(ip, ProtocolSSH, HostEventLimitExceeded)
+	assert.True(t, defender.IsBanned(ip))
+	assert.Equal(t, 0, defender.GetScore(ip))
+	banTime := defender.GetBanTime(ip)
+	if assert.NotNil(t, banTime) {
+		// the ban time was incremented checking if the host is banned
+		assert.True(t, banTime.After(time.Now().Add(14*time.Minute)))
+	}
+	entry, err = defender.GetHost(ip)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, entry.Score)
+		assert.False(t, entry.BanTime.IsZero())
+		assert.Equal(t, map[string]int{
+			"login_failed":   1,
+			"user_not_found": 1,
+			"limit_exceeded": 1,
+		}, entry.Events)
+		assert.Equal(t, "limit_exceeded", entry.LastEvent)
+	}
+	explanation = defender.ExplainBan(ip)
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, BanReasonScore, explanation.Reason)
+	assert.Equal(t, 6, explanation.Score)
+	assert.Len(t, explanation.Events, 3)
+	// events for banned hosts are ignored
+	defender.AddEvent(ip, ProtocolSSH, HostEventLimitExceeded)
+	explanation = defender.ExplainBan(ip)
+	assert.Len(t, explanation.Events, 3)
+
+	// the state is stored inside the data provider so it survives a new defender
+	d, err = newProviderDefender(config)
+	require.NoError(t, err)
+	assert.True(t, d.IsBanned(ip))
+
+	// an expired ban resets the host score, the hosts are cached so we need a
+	// new defender to load the updated ban time
+	err = dataprovider.SetDefenderBanTime(ip, util.GetTimeAsMsSinceEpoch(time.Now().Add(-1*time.Minute)))
+	assert.NoError(t, err)
+	d, err = newProviderDefender(config)
+	require.NoError(t, err)
+	defender = d.(*providerDefender)
+	assert.False(t, defender.IsBanned(ip))
+	assert.Equal(t, 0, defender.GetScore(ip))
+	_, err = defender.GetHost(ip)
+	assert.Error(t, err)
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 2, defender.GetScore(ip))
+	assert.False(t, defender.IsBanned(ip))
+
+	assert.True(t, defender.DeleteHost(ip))
+	assert.False(t, defender.DeleteHost(ip))
+	_, err = defender.GetHost(ip)
+	assert.Error(t, err)
+	assert.Equal(t, 0, defender.GetScore(ip))
+
+	err = os.Remove(blFile)
+	assert.NoError(t, err)
+	err = os.Remove(slFile)
+	assert.NoError(t, err)
+}
+
+func TestProviderDefenderCleanup(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:          true,
+		Driver:           DefenderDriverProvider,
+		BanTime:          10,
+		BanTimeIncrement: 50,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  1,
+		EntriesSoftLimit: 10,
+		EntriesHardLimit: 20,
+	}
+	d, err := newProviderDefender(config)
+	require.NoError(t, err)
+	defender := d.(*providerDefender)
+
+	ip := "172.16.7.1"
+	defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+	assert.Equal(t, 1, defender.GetScore(ip))
+	// the host is no longer within the observation time
+	err = dataprovider.CleanupDefender(util.GetTimeAsMsSinceEpoch(time.Now().Add(1 * time.Minute)))
+	assert.NoError(t, err)
+	_, err = dataprovider.GetDefenderHostByIP(ip, 0)
+	assert.Error(t, err)
+
+	bannedIP := "172.16.7.2"
+	for i := 0; i < 3; i++ {
+		defender.AddEvent(bannedIP, ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.True(t, defender.IsBanned(bannedIP))
+	// banned hosts and their events are preserved
+	err = dataprovider.CleanupDefender(util.GetTimeAsMsSinceEpoch(time.Now().Add(1 * time.Minute)))
+	assert.NoError(t, err)
+	events, err := dataprovider.GetDefenderEvents(bannedIP, 0)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	defender.lastCleanup = time.Now().Add(-2 * time.Minute)
+	defender.cleanup()
+	assert.True(t, defender.lastCleanup.After(time.Now().Add(-1*time.Minute)))
+
+	assert.True(t, defender.DeleteHost(bannedIP))
+}
+
+func TestProviderDefenderCache(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:          true,
+		Driver:           DefenderDriverProvider,
+		BanTime:          10,
+		BanTimeIncrement: 50,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ObservationTime:  15,
+		EntriesSoftLimit: 2,
+		EntriesHardLimit: 3,
+	}
+	d, err := newProviderDefender(config)
+	require.NoError(t, err)
+	defender := d.(*providerDefender)
+
+	bannedIP := "172.16.9.1"
+	for i := 0; i < 3; i++ {
+		defender.AddEvent(bannedIP, ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.True(t, defender.IsBanned(bannedIP))
+	host, err := dataprovider.IsDefenderHostBanned(bannedIP)
+	assert.NoError(t, err)
+	savedBanTime := host.BanTime
+	// the ban time increments are saved at most once per minute
+	assert.True(t, defender.IsBanned(bannedIP))
+	host, err = dataprovider.IsDefenderHostBanned(bannedIP)
+	assert.NoError(t, err)
+	assert.Equal(t, savedBanTime, host.BanTime)
+	defender.Lock()
+	cached := defender.hosts[bannedIP]
+	assert.Equal(t, config.getBanTimeIncrement(), cached.pendingIncrement)
+	cached.incrementSavedAt = time.Now().Add(-2 * time.Minute)
+	defender.hosts[bannedIP] = cached
+	defender.Unlock()
+	assert.True(t, defender.IsBanned(bannedIP))
+	host, err = dataprovider.IsDefenderHostBanned(bannedIP)
+	assert.NoError(t, err)
+	assert.Equal(t, savedBanTime+int64(2*config.getBanTimeIncrement())*time.Minute.Milliseconds(), host.BanTime)
+	assert.Equal(t, util.GetTimeAsMsSinceEpoch(*defender.GetBanTime(bannedIP)), host.BanTime)
+
+	for i := 2; i <= 5; i++ {
+		ip := fmt.Sprintf("172.16.9.%d", i)
+		defender.AddEvent(ip, ProtocolSSH, HostEventLoginFailed)
+		assert.False(t, defender.IsBanned(ip))
+	}
+	defender.RLock()
+	assert.LessOrEqual(t, len(defender.hosts), config.EntriesHardLimit)
+	// the banned host has the most recent activity
+	_, ok := defender.hosts[bannedIP]
+	defender.RUnlock()
+	assert.True(t, ok)
+	// the removed hosts are loaded again from the data provider
+	for i := 2; i <= 5; i++ {
+		assert.Equal(t, 1, defender.GetScore(fmt.Sprintf("172.16.9.%d", i)))
+	}
+
+	for i := 1; i <= 5; i++ {
+		assert.True(t, defender.DeleteHost(fmt.Sprintf("172.16.9.%d", i)))
+	}
+}
+
+func BenchmarkDefenderBannedSearch(b *testing.B) {
+	d := getDefenderForBench()
+
+	ip, ipnet, err := net.ParseCIDR("10.8.0.0/12") // 1048574 ip addresses
+	if err != nil {
+		panic(err)
+	}
+
+	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
+		d.banned[ip.String()] = time.Now().Add(10 * time.Minute)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		d.IsBanned("192.168.1.1")
+	}
+}
+
+func BenchmarkCleanup(b *testing.B) {
+	d := getDefenderForBench()
+
+	ip, ipnet, err := net.ParseCIDR("192.168.4.0/24")
+	if err != nil {
+		panic(err)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
+			d.AddEvent(ip.String(), ProtocolSSH, HostEventLoginFailed)
+			if d.countHosts() > d.config.EntriesHardLimit {
+				panic("too many hosts")
+			}
+			if d.countBanned() > d.config.EntriesSoftLimit {
+				panic("too many ip banned")
+			}
+		}
+	}
+}
+
+func BenchmarkDefenderBannedSearchWithBlockList(b *testing.B) {
+	d := getDefenderForBench()
+
+	d.blockList = &HostList{
+		IPAddresses: make(map[string]bool),
+		Ranges:      cidranger.NewPCTrieRanger(),
+	}
+
+	ip, ipnet, err := net.ParseCIDR("129.8.0.0/12") // 1048574 ip addresses
+	if err != nil {
+		panic(err)
+	}
+
+	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
+		d.banned[ip.String()] = time.Now().Add(10 * time.Minute)
+		d.blockList.IPAddresses[ip.String()] = true
+	}
+
+	for i := 0; i < 255; i++ {
+		cidr := fmt.Sprintf("10.8.%v.1/24", i)
+		_, network, _ := net.ParseCIDR(cidr)
+		if err := d.blockList.Ranges.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
+			panic(err)
+		}
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		d.IsBanned("192.168.1.1")
+	}
+}
+
+func BenchmarkHostListSearch(b *testing.B) {
+	hostlist := &HostList{
+		IPAddresses: make(map[string]bool),
+		Ranges:      cidranger.NewPCTrieRanger(),
+	}
+
+	ip, ipnet, _ := net.ParseCIDR("172.16.0.0/16")
+
+	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
+		hostlist.IPAddresses[ip.String()] = true
+	}
+
+	for i := 0; i < 255; i++ {
+		cidr := fmt.Sprintf("10.8.%v.1/24", i)
 		_, network, _ := net.ParseCIDR(cidr)
 		if err := hostlist.Ranges.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
 			panic(err)
@@ -600,6 +1392,736 @@ func BenchmarkNetContains(b *testing.B) {
 	}
 }
 
+func TestDefenderBanHook(t *testing.T) {
+	notifications := make(chan DefenderNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification DefenderNotification
+		if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		notifications <- notification
+	}))
+	defer server.Close()
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		BanHook:            server.URL,
+	}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	defender := d.(*memoryDefender)
+
+	getNotification := func() *DefenderNotification {
+		select {
+		case notification := <-notifications:
+			return &notification
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	defender.AddEvent("172.16.12.1", ProtocolSSH, HostEventUserNotFound)
+	defender.AddEvent("172.16.12.1", ProtocolSSH, HostEventLimitExceeded)
+	assert.True(t, defender.IsBanned("172.16.12.1"))
+	notification := getNotification()
+	if assert.NotNil(t, notification) {
+		assert.Equal(t, DefenderActionBan, notification.Action)
+		assert.Equal(t, "172.16.12.1", notification.IP)
+		assert.Equal(t, 5, notification.Score)
+		assert.Equal(t, "limit_exceeded", notification.Event)
+		assert.NotNil(t, notification.BanTime)
+		assert.Greater(t, notification.Timestamp, int64(0))
+	}
+	// unbans are not notified by default
+	assert.True(t, defender.DeleteHost("172.16.12.1"))
+	config.BanHookOnUnban = true
+	d, err = newInMemoryDefender(config)
+	require.NoError(t, err)
+	defender = d.(*memoryDefender)
+	defender.AddEvent("172.16.12.2", ProtocolSSH, HostEventLimitExceeded)
+	defender.AddEvent("172.16.12.2", ProtocolSSH, HostEventLimitExceeded)
+	notification = getNotification()
+	if assert.NotNil(t, notification) {
+		assert.Equal(t, DefenderActionBan, notification.Action)
+		assert.Equal(t, "172.16.12.2", notification.IP)
+		assert.Equal(t, 6, notification.Score)
+	}
+	// removing a host with a score only is not an unban
+	defender.AddEvent("172.16.12.3", ProtocolSSH, HostEventUserNotFound)
+	assert.True(t, defender.DeleteHost("172.16.12.3"))
+	assert.True(t, defender.DeleteHost("172.16.12.2"))
+	notification = getNotification()
+	if assert.NotNil(t, notification) {
+		assert.Equal(t, DefenderActionUnban, notification.Action)
+		assert.Equal(t, "172.16.12.2", notification.IP)
+		assert.Equal(t, 0, notification.Score)
+		assert.Nil(t, notification.BanTime)
+	}
+	assert.Len(t, notifications, 0)
+}
+
+func TestDefenderBanHookErrors(t *testing.T) {
+	banTime := time.Now()
+	notification := &DefenderNotification{
+		Action:    DefenderActionBan,
+		IP:        "172.16.12.4",
+		Score:     6,
+		BanTime:   &banTime,
+		Event:     "user_not_found",
+		Timestamp: time.Now().UnixNano(),
+	}
+	envVars := defenderNotificationAsEnvVars(notification)
+	assert.Contains(t, envVars, "SFTPGO_DEFENDER_IP=172.16.12.4")
+	assert.Contains(t, envVars, "SFTPGO_DEFENDER_SCORE=6")
+	assert.Contains(t, envVars, "SFTPGO_DEFENDER_EVENT=user_not_found")
+	assert.Contains(t, envVars, fmt.Sprintf("SFTPGO_DEFENDER_BAN_TIME=%v", banTime.UTC().Format(time.RFC3339)))
+
+	notifier := newBanNotifier(&DefenderConfig{})
+	assert.Nil(t, notifier)
+	// a nil notifier is a no-op
+	notifier.notifyBan("172.16.12.4", 6, banTime, "user_not_found")
+	notifier.notifyUnban("172.16.12.4")
+
+	notifier = &banNotifier{
+		hook: "relative/path",
+	}
+	err := notifier.sendCommand(notification)
+	assert.Error(t, err)
+	notifier.hook = "http://foo\x7f.com/"
+	err = notifier.sendHTTP(notification)
+	assert.Error(t, err)
+}
+
+func TestDefenderHostKey(t *testing.T) {
+	c := DefenderConfig{}
+	assert.Equal(t, "2001:db8:1:2::1", c.getHostKey("2001:db8:1:2::1"))
+	assert.Equal(t, "192.168.1.1", c.getHostKey("192.168.1.1"))
+	c.IPv6SubnetBits = 64
+	c.IPv4SubnetBits = 32
+	assert.Equal(t, "2001:db8:1:2::/64", c.getHostKey("2001:db8:1:2:a:b:c:d"))
+	assert.Equal(t, "2001:db8:1:2::/64", c.getHostKey("2001:db8:1:2::/64"))
+	assert.Equal(t, "192.168.1.1", c.getHostKey("192.168.1.1"))
+	assert.Equal(t, "192.168.1.1", c.getHostKey("::ffff:192.168.1.1"))
+	assert.Equal(t, "invalid", c.getHostKey("invalid"))
+	c.IPv6SubnetBits = 48
+	c.IPv4SubnetBits = 24
+	assert.Equal(t, "2001:db8:1::/48", c.getHostKey("2001:db8:1:2::1"))
+	assert.Equal(t, "192.168.1.0/24", c.getHostKey("192.168.1.100"))
+	c.IPv6SubnetBits = 128
+	assert.Equal(t, "2001:db8:1:2::1", c.getHostKey("2001:db8:1:2::1"))
+}
+
+func TestDefenderProtocolScores(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:              true,
+		BanTime:              10,
+		BanTimeIncrement:     50,
+		Threshold:            10,
+		ScoreInvalid:         2,
+		ScoreValid:           1,
+		ScoreLimitExceeded:   3,
+		ScoreAbusiveActivity: 1,
+		ObservationTime:      15,
+		EntriesSoftLimit:     10,
+		EntriesHardLimit:     20,
+		ProtocolScores: []DefenderProtocolScores{
+			{
+				Protocols:    []string{ProtocolFTP, ProtocolWebDAV},
+				ScoreInvalid: 5,
+				ScoreValid:   4,
+			},
+		},
+	}
+	err := config.validate()
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, config.getEventScore(ProtocolFTP, HostEventUserNotFound))
+	assert.Equal(t, 5, config.getEventScore(ProtocolWebDAV, HostEventNoLoginTried))
+	assert.Equal(t, 4, config.getEventScore(ProtocolFTP, HostEventLoginFailed))
+	// scores not overridden fall back to the global ones
+	assert.Equal(t, 3, config.getEventScore(ProtocolFTP, HostEventLimitExceeded))
+	assert.Equal(t, 1, config.getEventScore(ProtocolWebDAV, HostEventAbusiveActivity))
+	assert.Equal(t, 2, config.getEventScore(ProtocolSSH, HostEventUserNotFound))
+	assert.Equal(t, 1, config.getEventScore(ProtocolHTTP, HostEventLoginFailed))
+
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	defender := d.(*memoryDefender)
+
+	ip := "172.16.1.1"
+	defender.AddEvent(ip, ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 2, defender.GetScore(ip))
+	defender.AddEvent(ip, ProtocolFTP, HostEventUserNotFound)
+	assert.Equal(t, 7, defender.GetScore(ip))
+	assert.False(t, defender.IsBanned(ip))
+	defender.AddEvent(ip, ProtocolWebDAV, HostEventLoginFailed)
+	assert.True(t, defender.IsBanned(ip))
+}
+
+func TestDefenderSubnetAggregation(t *testing.T) {
+	sl := HostListFile{
+		IPAddresses: []string{"2001:db8:2:2::1"},
+	}
+	slFile := filepath.Join(os.TempDir(), "sl_subnet.json")
+	data, err := json.Marshal(sl)
+	assert.NoError(t, err)
+	err = os.WriteFile(slFile, data, os.ModePerm)
+	assert.NoError(t, err)
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		IPv6SubnetBits:     64,
+		SafeListFile:       slFile,
+	}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	defender := d.(*memoryDefender)
+
+	defender.AddEvent("2001:db8:1:2::1", ProtocolSSH, HostEventUserNotFound)
+	defender.AddEvent("2001:db8:1:2::2", ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 4, defender.GetScore("2001:db8:1:2::3"))
+	assert.False(t, defender.IsBanned("2001:db8:1:2::3"))
+	host, err := defender.GetHost("2001:db8:1:2::4")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2001:db8:1:2::/64", host.IP)
+		assert.Equal(t, 4, host.Score)
+	}
+	defender.AddEvent("2001:db8:1:2::3", ProtocolSSH, HostEventUserNotFound)
+	assert.True(t, defender.IsBanned("2001:db8:1:2::1"))
+	assert.True(t, defender.IsBanned("2001:db8:1:2:ffff:ffff:ffff:ffff"))
+	assert.NotNil(t, defender.GetBanTime("2001:db8:1:2::5"))
+	assert.False(t, defender.IsBanned("2001:db8:1:3::1"))
+	assert.Nil(t, defender.GetBanTime("2001:db8:1:3::1"))
+	explanation := defender.ExplainBan("2001:db8:1:2::6")
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, BanReasonScore, explanation.Reason)
+	assert.Len(t, explanation.Events, 3)
+	hosts := defender.GetHosts()
+	if assert.Len(t, hosts, 1) {
+		assert.Equal(t, "2001:db8:1:2::/64", hosts[0].IP)
+		assert.NotEmpty(t, hosts[0].GetBanTime())
+	}
+	// the subnet can be removed using any address within it or the subnet itself
+	assert.True(t, defender.DeleteHost("2001:db8:1:2::7"))
+	assert.False(t, defender.IsBanned("2001:db8:1:2::1"))
+	defender.AddEvent("2001:db8:1:2::1", ProtocolSSH, HostEventUserNotFound)
+	assert.True(t, defender.DeleteHost("2001:db8:1:2::/64"))
+	assert.Equal(t, 0, defender.GetScore("2001:db8:1:2::1"))
+	// the safe list matches the real address
+	defender.AddEvent("2001:db8:2:2::1", ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 0, defender.GetScore("2001:db8:2:2::1"))
+	defender.AddEvent("2001:db8:2:2::2", ProtocolSSH, HostEventUserNotFound)
+	assert.Equal(t, 2, defender.GetScore("2001:db8:2:2::1"))
+	// IPv4 addresses are tracked independently
+	for i := 1; i <= 3; i++ {
+		defender.AddEvent(fmt.Sprintf("172.16.9.%d", i), ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.False(t, defender.IsBanned("172.16.9.1"))
+	assert.Equal(t, 2, defender.GetScore("172.16.9.1"))
+
+	config.IPv4SubnetBits = 24
+	for i := 1; i <= 3; i++ {
+		defender.AddEvent(fmt.Sprintf("172.16.10.%d", i), ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.True(t, defender.IsBanned("172.16.10.100"))
+	assert.False(t, defender.IsBanned("172.16.11.1"))
+
+	err = os.Remove(slFile)
+	assert.NoError(t, err)
+}
+
+func TestProviderDefenderSubnetAggregation(t *testing.T) {
+	config := &DefenderConfig{
+		Enabled:            true,
+		Driver:             DefenderDriverProvider,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		IPv6SubnetBits:     56,
+	}
+	d, err := newProviderDefender(config)
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		d.AddEvent(fmt.Sprintf("2001:db8:3:%d::1", i), ProtocolSSH, HostEventUserNotFound)
+	}
+	assert.True(t, d.IsBanned("2001:db8:3:ff::1"))
+	assert.False(t, d.IsBanned("2001:db8:3:100::1"))
+	host, err := d.GetHost("2001:db8:3:1::2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2001:db8:3::/56", host.IP)
+	}
+	assert.Len(t, d.ExplainBan("2001:db8:3:1::2").Events, 3)
+	assert.True(t, d.DeleteHost("2001:db8:3::1"))
+	assert.False(t, d.IsBanned("2001:db8:3:1::1"))
+}
+
+func TestDefenderListsReload(t *testing.T) {
+	blFile := filepath.Join(os.TempDir(), "bl_reload.json")
+	data, err := json.Marshal(HostListFile{
+		IPAddresses: []string{"172.16.8.1"},
+	})
+	assert.NoError(t, err)
+	err = os.WriteFile(blFile, data, os.ModePerm)
+	assert.NoError(t, err)
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		BlockListFile:      blFile,
+		ListsCheckInterval: 1,
+	}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	oldDefender := Config.defender
+	Config.defender = d
+	defer func() {
+		Config.defender = oldDefender
+	}()
+
+	checker := defenderListsChecker{}
+	checker.init(config)
+	assert.Len(t, checker.modTimes, 1)
+	checker.check(config)
+	assert.True(t, d.IsBanned("172.16.8.1"))
+	// a malformed edit must not wipe the active list
+	err = os.WriteFile(blFile, []byte("{"), os.ModePerm)
+	assert.NoError(t, err)
+	modTime := time.Now().Add(1 * time.Minute)
+	err = os.Chtimes(blFile, modTime, modTime)
+	assert.NoError(t, err)
+	checker.check(config)
+	assert.True(t, d.IsBanned("172.16.8.1"))
+	assert.False(t, checker.modTimes[blFile].Equal(modTime))
+
+	data, err = json.Marshal(HostListFile{
+		IPAddresses: []string{"172.16.8.2"},
+	})
+	assert.NoError(t, err)
+	err = os.WriteFile(blFile, data, os.ModePerm)
+	assert.NoError(t, err)
+	modTime = time.Now().Add(2 * time.Minute)
+	err = os.Chtimes(blFile, modTime, modTime)
+	assert.NoError(t, err)
+	checker.check(config)
+	assert.False(t, d.IsBanned("172.16.8.1"))
+	assert.True(t, d.IsBanned("172.16.8.2"))
+	assert.True(t, checker.modTimes[blFile].Equal(modTime))
+
+	err = os.Remove(blFile)
+	assert.NoError(t, err)
+	checker.check(config)
+	assert.True(t, d.IsBanned("172.16.8.2"))
+	checker.init(config)
+	assert.Nil(t, checker.modTimes)
+
+	startDefenderListsTicker(10*time.Millisecond, config)
+	time.Sleep(50 * time.Millisecond)
+	stopDefenderListsTicker()
+	assert.Nil(t, defenderListsTicker)
+	assert.True(t, d.IsBanned("172.16.8.2"))
+}
+
+func TestDefenderListsFromURL(t *testing.T) {
+	var status int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bl":
+			switch atomic.LoadInt32(&status) {
+			case 0:
+				fmt.Fprint(w, `{"addresses": ["172.16.13.1", "invalid"], "networks": ["10.9.0.0/24"]}`)
+			case 1:
+				w.WriteHeader(http.StatusInternalServerError)
+			case 2:
+				fmt.Fprint(w, `not a json`)
+			default:
+				fmt.Fprint(w, `{"addresses": ["172.16.13.2"]}`)
+			}
+		case "/big":
+			_, _ = w.Write(make([]byte, maxHostListSize+1))
+		case "/slow":
+			time.Sleep(2 * time.Second)
+			fmt.Fprint(w, `{"addresses": ["172.16.13.3"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		BlockListFile:      server.URL + "/bl",
+		ListsURLTimeout:    1,
+	}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	assert.True(t, d.IsBanned("172.16.13.1"))
+	assert.True(t, d.IsBanned("10.9.0.1"))
+	assert.False(t, d.IsBanned("172.16.13.2"))
+	// the last good copy is used if the download fails or the list is invalid
+	atomic.StoreInt32(&status, 1)
+	err = d.Reload()
+	assert.NoError(t, err)
+	assert.True(t, d.IsBanned("172.16.13.1"))
+	atomic.StoreInt32(&status, 2)
+	err = d.Reload()
+	assert.NoError(t, err)
+	assert.True(t, d.IsBanned("172.16.13.1"))
+	atomic.StoreInt32(&status, 3)
+	err = d.Reload()
+	assert.NoError(t, err)
+	assert.False(t, d.IsBanned("172.16.13.1"))
+	assert.True(t, d.IsBanned("172.16.13.2"))
+	// the URL lists are ignored checking the files for changes
+	checker := defenderListsChecker{}
+	checker.init(config)
+	assert.Len(t, checker.modTimes, 0)
+
+	for _, path := range []string{"/notfound", "/big", "/slow"} {
+		config.BlockListFile = server.URL + path
+		_, err = newInMemoryDefender(config)
+		assert.Error(t, err, path)
+	}
+	// the HTTP client timeout is used
+	config.ListsURLTimeout = 0
+	config.SafeListFile = server.URL + "/slow"
+	config.BlockListFile = ""
+	d, err = newInMemoryDefender(config)
+	require.NoError(t, err)
+	assert.False(t, d.IsBanned("172.16.13.3"))
+
+	assert.True(t, isHostListURL("https://example.com/bl.json"))
+	assert.False(t, isHostListURL("/tmp/bl.json"))
+	assert.False(t, isHostListURL("httpfile.json"))
+
+	startDefenderURLListsTicker(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	stopDefenderURLListsTicker()
+	assert.Nil(t, defenderURLListsTicker)
+}
+
+func TestRedisProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	err := writeRedisCommand(w, "SET", "key", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$0\r\n\r\n", buf.String())
+
+	reply, err := readRedisReply(bufio.NewReader(strings.NewReader("+OK\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("-ERR unknown command\r\n")))
+	var rErr redisError
+	if assert.ErrorAs(t, err, &rErr) {
+		assert.Contains(t, rErr.Error(), "unknown command")
+	}
+	reply, err = readRedisReply(bufio.NewReader(strings.NewReader(":42\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), reply)
+	reply, err = readRedisReply(bufio.NewReader(strings.NewReader("$5\r\nhello\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", reply)
+	reply, err = readRedisReply(bufio.NewReader(strings.NewReader("$-1\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+	reply, err = readRedisReply(bufio.NewReader(strings.NewReader("*2\r\n$1\r\n0\r\n*1\r\n:1\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"0", []interface{}{int64(1)}}, reply)
+	reply, err = readRedisReply(bufio.NewReader(strings.NewReader("*-1\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("\r\n")))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("+OK\n")))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("$a\r\n")))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader(fmt.Sprintf("$%d\r\n", redisMaxBulkLength+1))))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("$5\r\nab")))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("*a\r\n")))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("*2\r\n:1\r\n")))
+	assert.Error(t, err)
+	_, err = readRedisReply(bufio.NewReader(strings.NewReader("?\r\n")))
+	assert.Error(t, err)
+}
+
+func TestRedisClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var commands []string
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				for {
+					reply, err := readRedisReply(reader)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range reply.([]interface{}) {
+						args = append(args, arg.(string))
+					}
+					mu.Lock()
+					commands = append(commands, strings.Join(args, " "))
+					mu.Unlock()
+					switch args[0] {
+					case "AUTH", "SELECT":
+						_, err = conn.Write([]byte("+OK\r\n"))
+					case "GET":
+						_, err = conn.Write([]byte("$-1\r\n"))
+					default:
+						_, err = conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					if err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	client := newRedisClient(listener.Addr().String(), "secret", 2)
+	reply, err := client.do("GET", "key")
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+	_, err = client.do("UNKNOWN")
+	assert.Error(t, err)
+	// the connection is reused after an error reply
+	_, err = client.do("GET", "key")
+	assert.NoError(t, err)
+
+	mu.Lock()
+	assert.Equal(t, []string{"AUTH secret", "SELECT 2", "GET key", "UNKNOWN", "GET key"}, commands)
+	mu.Unlock()
+}
+
+func TestRedisEventMember(t *testing.T) {
+	now := time.Now()
+	member := getRedisEventMember(now, hostEventReputation, 3)
+	ev, err := parseRedisEvent(member)
+	assert.NoError(t, err)
+	assert.Equal(t, now.UnixNano(), ev.Time.UnixNano())
+	assert.Equal(t, hostEventReputation, ev.Event)
+	assert.Equal(t, 3, ev.Score)
+
+	_, err = parseRedisEvent("invalid")
+	assert.Error(t, err)
+	_, err = parseRedisEvent("a|name|1")
+	assert.Error(t, err)
+	_, err = parseRedisEvent("1|name|a")
+	assert.Error(t, err)
+}
+
+func TestRedisDefenderUnavailable(t *testing.T) {
+	bl := HostListFile{
+		IPAddresses: []string{"172.16.7.1"},
+	}
+	blFile := filepath.Join(os.TempDir(), "bl_redis.json")
+	data, err := json.Marshal(bl)
+	assert.NoError(t, err)
+	err = os.WriteFile(blFile, data, os.ModePerm)
+	assert.NoError(t, err)
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		Driver:             DefenderDriverRedis,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		BlockListFile:      blFile,
+		Redis: DefenderRedisConfig{
+			// nothing listens on port 1
+			Address: "127.0.0.1:1",
+		},
+	}
+	d, err := newRedisDefender(config)
+	require.NoError(t, err)
+	// the block list is still enforced while Redis is not available
+	assert.True(t, d.IsBanned("172.16.7.1"))
+	assert.False(t, d.IsBanned("172.16.7.2"))
+	d.AddEvent("172.16.7.2", ProtocolSSH, HostEventLoginFailed)
+	assert.Equal(t, 0, d.GetScore("172.16.7.2"))
+	assert.Nil(t, d.GetBanTime("172.16.7.2"))
+	assert.False(t, d.DeleteHost("172.16.7.2"))
+	_, err = d.GetHost("172.16.7.2")
+	assert.Error(t, err)
+	_, ok := err.(*util.RecordNotFoundError)
+	assert.False(t, ok)
+	assert.Len(t, d.GetHosts(), 0)
+
+	config.Redis.Address = ""
+	_, err = newRedisDefender(config)
+	assert.Error(t, err)
+
+	err = os.Remove(blFile)
+	assert.NoError(t, err)
+}
+
+func TestRedisDefenderScripts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var commands []string
+	var mu sync.Mutex
+	addScoreReply := "*1\r\n:0\r\n"
+	banTime := util.GetTimeAsMsSinceEpoch(time.Now().Add(10 * time.Minute))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				for {
+					reply, err := readRedisReply(reader)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range reply.([]interface{}) {
+						args = append(args, arg.(string))
+					}
+					mu.Lock()
+					response := "+OK\r\n"
+					switch {
+					case args[0] == "EVAL" && args[1] == redisAddScoreScript:
+						commands = append(commands, "addScore "+args[3])
+						response = addScoreReply
+					case args[0] == "EVAL" && args[1] == redisIncrementBanTimeScript:
+						commands = append(commands, "incrementBanTime "+args[3]+" "+args[5])
+						response = ":1\r\n"
+					case args[0] == "GET" && strings.HasPrefix(args[1], "sftpgo:"+redisBanKeyPrefix):
+						value := strconv.FormatInt(banTime, 10)
+						response = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+					case args[0] == "SET":
+						commands = append(commands, "SET "+args[1])
+					}
+					mu.Unlock()
+					if _, err = conn.Write([]byte(response)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	config := &DefenderConfig{
+		Enabled:            true,
+		Driver:             DefenderDriverRedis,
+		BanTime:            10,
+		BanTimeIncrement:   50,
+		Threshold:          5,
+		ScoreInvalid:       2,
+		ScoreValid:         1,
+		ScoreLimitExceeded: 3,
+		ObservationTime:    15,
+		EntriesSoftLimit:   10,
+		EntriesHardLimit:   20,
+		Redis: DefenderRedisConfig{
+			Address: listener.Addr().String(),
+			Prefix:  "sftpgo:",
+		},
+	}
+	d, err := newRedisDefender(config)
+	require.NoError(t, err)
+	redisDefender := d.(*redisDefender)
+	// the script did not ban the host, because the threshold is not reached or
+	// another instance already banned it
+	assert.False(t, redisDefender.addScore("172.16.8.1", getHostEventName(HostEventLoginFailed), 2, 5))
+	member := getRedisEventMember(time.Now(), getHostEventName(HostEventLoginFailed), 5)
+	mu.Lock()
+	addScoreReply = fmt.Sprintf("*2\r\n:1\r\n*1\r\n$%d\r\n%s\r\n", len(member), member)
+	mu.Unlock()
+	assert.True(t, redisDefender.addScore("172.16.8.1", getHostEventName(HostEventLoginFailed), 3, 5))
+	// the ban time increment is saved at most once per minute
+	assert.True(t, d.IsBanned("172.16.8.1"))
+	assert.True(t, d.IsBanned("172.16.8.1"))
+	assert.True(t, d.IsBanned("172.16.8.1"))
+	redisDefender.Lock()
+	increment := redisDefender.increments["172.16.8.1"]
+	assert.Equal(t, 10, increment.pending)
+	increment.savedAt = time.Now().Add(-2 * time.Minute)
+	redisDefender.increments["172.16.8.1"] = increment
+	redisDefender.Unlock()
+	assert.True(t, d.IsBanned("172.16.8.1"))
+
+	mu.Lock()
+	assert.Equal(t, []string{
+		"addScore sftpgo:events:172.16.8.1",
+		"addScore sftpgo:events:172.16.8.1",
+		"SET sftpgo:cause:172.16.8.1",
+		"incrementBanTime sftpgo:ban:172.16.8.1 300000",
+		"incrementBanTime sftpgo:ban:172.16.8.1 900000",
+	}, commands)
+	mu.Unlock()
+}
+
 func getDefenderForBench() *memoryDefender {
 	config := &DefenderConfig{
 		Enabled:          true,
@@ -627,3 +2149,120 @@ func inc(ip net.IP) {
 		}
 	}
 }
+
+func TestDefenderReputationFeed(t *testing.T) {
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		switch r.URL.Query().Get("ip") {
+		case "172.16.4.1":
+			fmt.Fprint(w, `{"block": true}`)
+		case "172.16.4.2":
+			fmt.Fprint(w, `{"score": 3}`)
+		case "172.16.4.3":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "172.16.4.4":
+			fmt.Fprint(w, `not a json`)
+		default:
+			fmt.Fprint(w, `{"score": 0}`)
+		}
+	}))
+	defer server.Close()
+
+	sl := HostListFile{
+		IPAddresses: []string{"172.16.4.5"},
+	}
+	slFile := filepath.Join(os.TempDir(), "sl_reputation.json")
+	data, err := json.Marshal(sl)
+	assert.NoError(t, err)
+	err = os.WriteFile(slFile, data, os.ModePerm)
+	assert.NoError(t, err)
+
+	config := &DefenderConfig{
+		Enabled:             true,
+		BanTime:             10,
+		BanTimeIncrement:    2,
+		Threshold:           5,
+		ScoreInvalid:        2,
+		ScoreValid:          1,
+		ObservationTime:     15,
+		EntriesSoftLimit:    10,
+		EntriesHardLimit:    20,
+		SafeListFile:        slFile,
+		ReputationHook:      server.URL,
+		ReputationCacheTime: 60,
+	}
+	d, err := newInMemoryDefender(config)
+	require.NoError(t, err)
+	defender := d.(*memoryDefender)
+	// block decision
+	assert.True(t, defender.IsBanned("172.16.4.1"))
+	assert.Equal(t, 1, defender.countBanned())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&numRequests))
+	// the score is merged with the local one
+	assert.False(t, defender.IsBanned("172.16.4.2"))
+	assert.Equal(t, 3, defender.GetScore("172.16.4.2"))
+	// cached decisions are not merged again and the feed is not queried
+	assert.False(t, defender.IsBanned("172.16.4.2"))
+	assert.Equal(t, 3, defender.GetScore("172.16.4.2"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&numRequests))
+	defender.AddEvent("172.16.4.2", ProtocolSSH, HostEventUserNotFound)
+	assert.True(t, defender.IsBanned("172.16.4.2"))
+	// allow decision
+	assert.False(t, defender.IsBanned("172.16.4.6"))
+	assert.Equal(t, 0, defender.GetScore("172.16.4.6"))
+	// feed errors fail open
+	assert.False(t, defender.IsBanned("172.16.4.3"))
+	assert.False(t, defender.IsBanned("172.16.4.4"))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&numRequests))
+	// safe listed hosts are never checked
+	assert.False(t, defender.IsBanned("172.16.4.5"))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&numRequests))
+
+	if runtime.GOOS != osWindows {
+		hookCmd := filepath.Join(os.TempDir(), "reputation_hook.sh")
+		content := []byte("#!/bin/sh\n\nif test \"$SFTPGO_REPUTATION_IP\" = \"172.16.4.1\"; then\n" +
+			"echo '{\"block\": true}'\nelse\necho '{\"score\": 0}'\nfi\n")
+		err = os.WriteFile(hookCmd, content, os.ModePerm)
+		assert.NoError(t, err)
+		config.ReputationHook = hookCmd
+		d, err = newInMemoryDefender(config)
+		require.NoError(t, err)
+		defender = d.(*memoryDefender)
+		assert.True(t, defender.IsBanned("172.16.4.1"))
+		assert.False(t, defender.IsBanned("172.16.4.2"))
+		err = os.Remove(hookCmd)
+		assert.NoError(t, err)
+	}
+
+	config.ReputationHook = "relative/path"
+	_, err = newInMemoryDefender(config)
+	assert.Error(t, err)
+	config.ReputationHook = server.URL
+	config.ReputationCacheTime = -1
+	_, err = newInMemoryDefender(config)
+	assert.Error(t, err)
+	config.ReputationCacheTime = 0
+	_, err = newInMemoryDefender(config)
+	assert.Error(t, err)
+	config.ReputationHook = ""
+	_, err = newInMemoryDefender(config)
+	assert.NoError(t, err)
+
+	err = os.Remove(slFile)
+	assert.NoError(t, err)
+}
+
+func TestReputationFeedCacheLimits(t *testing.T) {
+	feed := newReputationFeed(&DefenderConfig{
+		ReputationHook:      "http://127.0.0.1:1",
+		ReputationCacheTime: 60,
+		EntriesSoftLimit:    2,
+		EntriesHardLimit:    4,
+	})
+	for i := 0; i < 10; i++ {
+		feed.add(fmt.Sprintf("192.168.1.%d", i), 1, time.Minute)
+	}
+	assert.LessOrEqual(t, len(feed.cache), 4)
+	assert.Nil(t, newReputationFeed(&DefenderConfig{}))
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/httpclient"
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/util"
+)
+
+// opinionated max size, you should avoid big host lists
+const maxHostListSize = 1048576 * 5 // 5MB
+
+var (
+	defenderListsTicker        *time.Ticker
+	defenderListsTickerDone    chan bool
+	defenderListsCheck         defenderListsChecker
+	defenderURLListsTicker     *time.Ticker
+	defenderURLListsTickerDone chan bool
+	hostListsCache             = hostListCache{
+		contents: make(map[string][]byte),
+	}
+)
+
+// hostListCache keeps the last good copy of the host lists downloaded from
+// HTTP URLs, it is used if a download fails
+type hostListCache struct {
+	sync.RWMutex
+	contents map[string][]byte // the key is the URL
+}
+
+func (c *hostListCache) add(source string, content []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.contents[source] = content
+}
+
+func (c *hostListCache) get(source string) []byte {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.contents[source]
+}
+
+// isHostListURL returns true if the given host list source is an HTTP URL
+func isHostListURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// loadHostListFromURL downloads and parses the host list from the given URL.
+// If the list cannot be downloaded or it is invalid the last good copy, if any,
+// is used
+func loadHostListFromURL(source string, timeout time.Duration) (*HostList, error) {
+	name := util.GetRedactedURL(source)
+	content, err := fetchHostList(source, timeout)
+	if err == nil {
+		var result *HostList
+		result, err = parseHostList(name, content)
+		if err == nil {
+			hostListsCache.add(source, content)
+			return result, nil
+		}
+	}
+	content = hostListsCache.get(source)
+	if content == nil {
+		return nil, fmt.Errorf("unable to load host list from %#v: %w", name, err)
+	}
+	logger.Warn(logSender, "", "unable to load host list from %#v, using the last good copy: %v", name, err)
+	return parseHostList(name, content)
+}
+
+func fetchHostList(source string, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	resp, err := httpclient.GetWithContext(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("wrong http status code: %v, expected 200", resp.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxHostListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxHostListSize {
+		return nil, fmt.Errorf("host list is too big, max allowed size: %v bytes", maxHostListSize)
+	}
+	return content, nil
+}
+
+// defenderListsChecker keeps track of the modification times of the safe and
+// block list files as they were at the last successful load
+type defenderListsChecker struct {
+	sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// getModTimes returns the modification times for the given files, the empty
+// names and the HTTP URLs are ignored
+func (c *defenderListsChecker) getModTimes(names ...string) (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, name := range names {
+		if name == "" || isHostListURL(name) {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[name] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (c *defenderListsChecker) isChanged(modTimes map[string]time.Time) bool {
+	if len(modTimes) != len(c.modTimes) {
+		return true
+	}
+	for name, modTime := range modTimes {
+		if !modTime.Equal(c.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// init stores the modification times for the lists loaded at startup
+func (c *defenderListsChecker) init(config *DefenderConfig) {
+	c.Lock()
+	defer c.Unlock()
+
+	modTimes, err := c.getModTimes(config.BlockListFile, config.SafeListFile)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the modification time for the defender lists: %v", err)
+		modTimes = nil
+	}
+	c.modTimes = modTimes
+}
+
+// check reloads the defender lists if a file was modified since the last
+// successful load. If a list cannot be loaded, for example because it is
+// malformed, the active lists are preserved and the check is repeated
+func (c *defenderListsChecker) check(config *DefenderConfig) {
+	c.Lock()
+	defer c.Unlock()
+
+	modTimes, err := c.getModTimes(config.BlockListFile, config.SafeListFile)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to check the defender lists for changes: %v", err)
+		return
+	}
+	if !c.isChanged(modTimes) {
+		return
+	}
+	logger.Info(logSender, "", "defender lists changed, reloading")
+	if err := ReloadDefender(); err != nil {
+		logger.Warn(logSender, "", "unable to reload the defender lists, the active lists are preserved: %v", err)
+		return
+	}
+	c.modTimes = modTimes
+}
+
+func startDefenderListsTicker(duration time.Duration, config *DefenderConfig) {
+	stopDefenderListsTicker()
+	defenderListsCheck.init(config)
+	defenderListsTicker = time.NewTicker(duration)
+	defenderListsTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-defenderListsTickerDone:
+				return
+			case <-defenderListsTicker.C:
+				defenderListsCheck.check(config)
+			}
+		}
+	}()
+}
+
+func stopDefenderListsTicker() {
+	if defenderListsTicker != nil {
+		defenderListsTicker.Stop()
+		defenderListsTickerDone <- true
+		defenderListsTicker = nil
+	}
+}
+
+// startDefenderURLListsTicker periodically reloads the defender lists, so the
+// lists defined as HTTP URLs are downloaded again
+func startDefenderURLListsTicker(duration time.Duration) {
+	stopDefenderURLListsTicker()
+	defenderURLListsTicker = time.NewTicker(duration)
+	defenderURLListsTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-defenderURLListsTickerDone:
+				return
+			case <-defenderURLListsTicker.C:
+				if err := ReloadDefender(); err != nil {
+					logger.Warn(logSender, "", "unable to refresh the defender lists, the active lists are preserved: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func stopDefenderURLListsTicker() {
+	if defenderURLListsTicker != nil {
+		defenderURLListsTicker.Stop()
+		defenderURLListsTickerDone <- true
+		defenderURLListsTicker = nil
+	}
+}
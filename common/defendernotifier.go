@@ -0,0 +1,163 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/httpclient"
+	"github.com/drakkan/sftpgo/v2/logger"
+)
+
+// Supported defender notification actions
+const (
+	DefenderActionBan   = "ban"
+	DefenderActionUnban = "unban"
+)
+
+// DefenderNotification defines the payload sent to the defender ban hook
+type DefenderNotification struct {
+	Action string `json:"action"`
+	// IP address or, if the addresses are aggregated by subnet, network in CIDR notation
+	IP string `json:"ip"`
+	// score that caused the ban, omitted for unban notifications
+	Score int `json:"score,omitempty"`
+	// ban expiration, omitted for unban notifications
+	BanTime *time.Time `json:"ban_time,omitempty"`
+	// name of the event that caused the ban, omitted for unban notifications
+	Event     string `json:"event,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// banNotifier notifies the defender bans and, optionally, unbans to an
+// external hook. The notifications are sent asynchronously so they never
+// delay the clients
+type banNotifier struct {
+	hook    string
+	onUnban bool
+}
+
+func newBanNotifier(config *DefenderConfig) *banNotifier {
+	if config.BanHook == "" {
+		return nil
+	}
+	return &banNotifier{
+		hook:    config.BanHook,
+		onUnban: config.BanHookOnUnban,
+	}
+}
+
+// notifyBan notifies that the given host key was banned, the caller can use
+// a nil notifier
+func (n *banNotifier) notifyBan(ip string, score int, banTime time.Time, event string) {
+	if n == nil {
+		return
+	}
+	notification := &DefenderNotification{
+		Action:    DefenderActionBan,
+		IP:        ip,
+		Score:     score,
+		BanTime:   &banTime,
+		Event:     event,
+		Timestamp: time.Now().UnixNano(),
+	}
+	go n.send(notification)
+}
+
+// notifyUnban notifies that the given host key was removed from the defender
+// if enabled, the caller can use a nil notifier
+func (n *banNotifier) notifyUnban(ip string) {
+	if n == nil || !n.onUnban {
+		return
+	}
+	notification := &DefenderNotification{
+		Action:    DefenderActionUnban,
+		IP:        ip,
+		Timestamp: time.Now().UnixNano(),
+	}
+	go n.send(notification)
+}
+
+func (n *banNotifier) send(notification *DefenderNotification) {
+	var err error
+	if strings.HasPrefix(n.hook, "http") {
+		err = n.sendHTTP(notification)
+	} else {
+		err = n.sendCommand(notification)
+	}
+	if err != nil {
+		logger.Warn(logSender, "", "unable to notify defender action %#v for host %#v: %v",
+			notification.Action, notification.IP, err)
+	}
+}
+
+func (n *banNotifier) sendHTTP(notification *DefenderNotification) error {
+	u, err := url.Parse(n.hook)
+	if err != nil {
+		return err
+	}
+
+	startTime := time.Now()
+	respCode := 0
+
+	var b bytes.Buffer
+	_ = json.NewEncoder(&b).Encode(notification)
+
+	resp, err := httpclient.RetryablePost(n.hook, "application/json", &b)
+	if err == nil {
+		respCode = resp.StatusCode
+		resp.Body.Close()
+
+		if respCode != http.StatusOK {
+			err = errUnexpectedHTTResponse
+		}
+	}
+
+	logger.Debug(logSender, "", "notified defender action %#v for host %#v to URL: %v status code: %v, elapsed: %v err: %v",
+		notification.Action, notification.IP, u.Redacted(), respCode, time.Since(startTime), err)
+
+	return err
+}
+
+func (n *banNotifier) sendCommand(notification *DefenderNotification) error {
+	if !filepath.IsAbs(n.hook) {
+		return fmt.Errorf("invalid ban hook %#v", n.hook)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, n.hook)
+	cmd.Env = append(os.Environ(), defenderNotificationAsEnvVars(notification)...)
+
+	startTime := time.Now()
+	err := cmd.Run()
+
+	logger.Debug(logSender, "", "executed ban hook %#v for defender action %#v, host %#v, elapsed: %v, error: %v",
+		n.hook, notification.Action, notification.IP, time.Since(startTime), err)
+
+	return err
+}
+
+func defenderNotificationAsEnvVars(notification *DefenderNotification) []string {
+	banTime := ""
+	if notification.BanTime != nil {
+		banTime = notification.BanTime.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		fmt.Sprintf("SFTPGO_DEFENDER_ACTION=%v", notification.Action),
+		fmt.Sprintf("SFTPGO_DEFENDER_IP=%v", notification.IP),
+		fmt.Sprintf("SFTPGO_DEFENDER_SCORE=%v", notification.Score),
+		fmt.Sprintf("SFTPGO_DEFENDER_BAN_TIME=%v", banTime),
+		fmt.Sprintf("SFTPGO_DEFENDER_EVENT=%v", notification.Event),
+		fmt.Sprintf("SFTPGO_DEFENDER_TIMESTAMP=%v", notification.Timestamp),
+	}
+}
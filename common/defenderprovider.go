@@ -0,0 +1,699 @@
+package common
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/dataprovider"
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/metric"
+	"github.com/drakkan/sftpgo/v2/util"
+)
+
+// providerDefender stores the host scores and the banned hosts inside the data
+// provider, so the bans survive restarts. The hosts are loaded lazily from the
+// data provider and cached in memory, the changes are written through.
+// The block and safe lists, the grace periods and the reputation cache are
+// kept in memory
+type providerDefender struct {
+	config *DefenderConfig
+	sync.RWMutex
+	safeList  *HostList
+	blockList *HostList
+	// cached hosts, the key is the host IP
+	hosts map[string]providerHost
+	// hosts with a successful login within the last LoginGraceTime minutes,
+	// the value is the grace expiration
+	graced map[string]time.Time // the key is the host IP
+	// nil if no reputation hook is configured
+	reputation *reputationFeed
+	// nil if no ban hook is configured
+	notifier *banNotifier
+	// the expired hosts and events are removed from the data provider at most
+	// once for each observation time
+	lastCleanup time.Time
+}
+
+// providerHost is the cached state of a host stored inside the data provider
+type providerHost struct {
+	// ban expiration, zero if the host was never banned
+	banTime time.Time
+	// events within the observation time, empty for banned hosts
+	score hostScore
+	// ban time increments, as minutes, not yet saved to the data provider
+	pendingIncrement int
+	// last time the ban time increments were saved to the data provider
+	incrementSavedAt time.Time
+}
+
+// getLastActivity returns the ban expiration for banned hosts and the last
+// event time otherwise
+func (h *providerHost) getLastActivity() time.Time {
+	if !h.banTime.IsZero() {
+		return h.banTime
+	}
+	if len(h.score.Events) > 0 {
+		return h.score.Events[len(h.score.Events)-1].dateTime
+	}
+	return time.Time{}
+}
+
+func newProviderDefender(config *DefenderConfig) (Defender, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	defender := &providerDefender{
+		config:     config,
+		hosts:      make(map[string]providerHost),
+		graced:     make(map[string]time.Time),
+		reputation: newReputationFeed(config),
+		notifier:   newBanNotifier(config),
+	}
+
+	if err := defender.Reload(); err != nil {
+		return nil, err
+	}
+
+	return defender, nil
+}
+
+// Reload reloads block and safe lists
+func (d *providerDefender) Reload() error {
+	blockList, safeList, err := loadHostLists(d.config)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	d.blockList = blockList
+	d.safeList = safeList
+	d.Unlock()
+
+	return nil
+}
+
+// getStartObservationTime returns the start of the observation time window
+// as unix timestamp in milliseconds
+func (d *providerDefender) getStartObservationTime() int64 {
+	t := time.Now().Add(-time.Duration(d.config.ObservationTime) * time.Minute)
+	return util.GetTimeAsMsSinceEpoch(t)
+}
+
+// loadHost adds the given host key to the cache, reading it from the data
+// provider, if it is not already cached. It returns false if the data provider
+// is not available.
+// The caller must not hold the lock
+func (d *providerDefender) loadHost(key string) bool {
+	d.RLock()
+	_, ok := d.hosts[key]
+	d.RUnlock()
+
+	if ok {
+		return true
+	}
+
+	var host providerHost
+	from := d.getStartObservationTime()
+	dbHost, err := dataprovider.GetDefenderHostByIP(key, from)
+	if err == nil {
+		if dbHost.BanTime > 0 {
+			host.banTime = util.GetTimeFromMsecSinceEpoch(dbHost.BanTime)
+		} else if dbHost.Score > 0 {
+			events, err := dataprovider.GetDefenderEvents(key, from)
+			if err != nil {
+				logger.Warn(logSender, "", "unable to get defender events for host %#v: %v", key, err)
+				return false
+			}
+			for _, ev := range events {
+				host.score.TotalScore += ev.Score
+				host.score.Events = append(host.score.Events, hostEvent{
+					dateTime: util.GetTimeFromMsecSinceEpoch(ev.DateTime),
+					score:    ev.Score,
+					name:     ev.Name,
+				})
+			}
+		}
+	} else if _, ok := err.(*util.RecordNotFoundError); !ok {
+		logger.Warn(logSender, "", "unable to get defender host %#v: %v", key, err)
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.hosts[key]; !ok {
+		d.hosts[key] = host
+		d.cleanupHosts(key)
+	}
+	return true
+}
+
+// GetHosts returns hosts that are banned or for which some violations have been detected
+func (d *providerDefender) GetHosts() []*DefenderEntry {
+	hosts, err := dataprovider.GetDefenderHosts(d.getStartObservationTime(), d.config.EntriesHardLimit)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get defender hosts from the data provider: %v", err)
+		return nil
+	}
+
+	var result []*DefenderEntry
+	for idx := range hosts {
+		if entry := d.getEntryFromHost(&hosts[idx]); entry != nil {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// GetHost returns a defender host by ip, if any.
+// If the addresses are aggregated by subnet the subnet is returned
+func (d *providerDefender) GetHost(ip string) (*DefenderEntry, error) {
+	host, err := dataprovider.GetDefenderHostByIP(d.config.getHostKey(ip), d.getStartObservationTime())
+	if err != nil {
+		return nil, err
+	}
+	if entry := d.getEntryFromHost(&host); entry != nil {
+		return entry, nil
+	}
+
+	return nil, util.NewRecordNotFoundError("host not found")
+}
+
+// IsBanned returns true if the specified IP is banned
+// and increase ban time if the IP is found.
+// This method must be called as soon as the client connects
+func (d *providerDefender) IsBanned(ip string) bool {
+	key := d.config.getHostKey(ip)
+	// we fail open if the data provider is not available, the block list is still checked
+	if d.loadHost(key) && d.incrementBanTime(key) {
+		return true
+	}
+
+	d.RLock()
+
+	if d.blockList != nil && d.blockList.isListed(ip) {
+		d.RUnlock()
+		// permanent ban
+		return true
+	}
+	isSafe := d.safeList != nil && d.safeList.isListed(ip)
+
+	d.RUnlock()
+
+	if d.reputation == nil || isSafe {
+		return false
+	}
+	return d.checkReputation(ip)
+}
+
+// incrementBanTime increments the ban time for the given host key and returns
+// true if the host is banned. The increments are saved to the data provider at
+// most once per minute, so a banned host that keeps connecting does not cause
+// a write for each connection.
+// The caller must not hold the lock
+func (d *providerDefender) incrementBanTime(key string) bool {
+	d.RLock()
+	host, ok := d.hosts[key]
+	d.RUnlock()
+
+	if !ok || !host.banTime.After(time.Now()) {
+		return false
+	}
+
+	increment := d.config.getBanTimeIncrement()
+	toSave := 0
+
+	d.Lock()
+	// the host could be updated or removed while we are not holding the lock
+	if host, ok = d.hosts[key]; ok {
+		host.banTime = host.banTime.Add(time.Duration(increment) * time.Minute)
+		host.pendingIncrement += increment
+		if time.Since(host.incrementSavedAt) >= time.Minute {
+			toSave = host.pendingIncrement
+			host.pendingIncrement = 0
+			host.incrementSavedAt = time.Now()
+		}
+		d.hosts[key] = host
+	}
+	d.Unlock()
+
+	if toSave > 0 {
+		if err := dataprovider.UpdateDefenderBanTime(key, toSave); err != nil {
+			logger.Warn(logSender, "", "unable to increment the ban time for host %#v: %v", key, err)
+		}
+	}
+	return true
+}
+
+// checkReputation merges the score returned by the reputation feed with the
+// stored host score and returns true if the host is banned as result.
+// Cached scores were already merged so they are ignored
+func (d *providerDefender) checkReputation(ip string) bool {
+	score, isNew := d.reputation.getScore(ip)
+	if !isNew || score <= 0 {
+		return false
+	}
+
+	key := d.config.getHostKey(ip)
+	if !d.loadHost(key) {
+		return false
+	}
+
+	d.Lock()
+	// the login grace does not apply to the reputation feed
+	event, banTime := d.addScore(key, hostEventReputation, score, d.config.Threshold)
+	d.Unlock()
+
+	d.saveScore(key, event, banTime)
+	return banTime != nil
+}
+
+// DeleteHost removes the specified IP from the defender lists
+func (d *providerDefender) DeleteHost(ip string) bool {
+	ip = d.config.getHostKey(ip)
+
+	d.Lock()
+	delete(d.hosts, ip)
+	d.Unlock()
+
+	_, errBanned := dataprovider.IsDefenderHostBanned(ip)
+	err := dataprovider.DeleteDefenderHost(ip)
+	if err == nil {
+		if errBanned == nil {
+			d.notifier.notifyUnban(ip)
+		}
+		return true
+	}
+	if _, ok := err.(*util.RecordNotFoundError); !ok {
+		logger.Warn(logSender, "", "unable to delete defender host %#v: %v", ip, err)
+	}
+	return false
+}
+
+// AddLoginSuccess grants a grace period to the given IP after a successful login.
+// Within this period the host is banned only if its score exceeds the login
+// grace threshold
+func (d *providerDefender) AddLoginSuccess(ip string) {
+	if d.config.LoginGraceTime <= 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.safeList != nil && d.safeList.isListed(ip) {
+		return
+	}
+
+	d.graced[d.config.getHostKey(ip)] = time.Now().Add(time.Duration(d.config.LoginGraceTime) * time.Minute)
+	cleanupGraced(d.graced, d.config)
+}
+
+// getThreshold returns the ban threshold for the given host key.
+// The caller must hold the lock
+func (d *providerDefender) getThreshold(key string) int {
+	if expiration, ok := d.graced[key]; ok {
+		if expiration.After(time.Now()) {
+			return d.config.LoginGraceThreshold
+		}
+		delete(d.graced, key)
+	}
+	return d.config.Threshold
+}
+
+// AddEvent adds an event for the given IP and protocol.
+// This method must be called for clients not yet banned
+func (d *providerDefender) AddEvent(ip, protocol string, event HostEvent) {
+	metric.AddDefenderEvent(getHostEventName(event))
+
+	d.RLock()
+	isSafe := d.safeList != nil && d.safeList.isListed(ip)
+	d.RUnlock()
+
+	if isSafe {
+		return
+	}
+
+	score := d.config.getEventScore(protocol, event)
+	if score == 0 && event == HostEventAbusiveActivity {
+		return
+	}
+
+	key := d.config.getHostKey(ip)
+	if !d.loadHost(key) {
+		return
+	}
+
+	d.Lock()
+
+	host := d.hosts[key]
+	isBanExpired := false
+	if !host.banTime.IsZero() {
+		// ignore events for already banned hosts
+		if host.banTime.After(time.Now()) {
+			d.Unlock()
+			return
+		}
+		// the ban is expired, the host starts again with no score
+		delete(d.hosts, key)
+		isBanExpired = true
+	}
+	dbEvent, banTime := d.addScore(key, getHostEventName(event), score, d.getThreshold(key))
+
+	d.Unlock()
+
+	if isBanExpired {
+		if err := dataprovider.DeleteDefenderHost(key); err != nil {
+			logger.Warn(logSender, "", "unable to delete defender host %#v: %v", key, err)
+		}
+	}
+	d.saveScore(key, dbEvent, banTime)
+}
+
+// addScore adds an event with the given name and score for the specified host
+// key to the cache and bans the host if the given threshold is reached.
+// It returns the event and, if the host is banned, the ban time to save to the
+// data provider.
+// The caller must hold the lock
+func (d *providerDefender) addScore(key, name string, score, threshold int) (dataprovider.DefenderEvent, *time.Time) {
+	now := time.Now()
+	dbEvent := dataprovider.DefenderEvent{
+		DateTime: util.GetTimeAsMsSinceEpoch(now),
+		Name:     name,
+		Score:    score,
+	}
+
+	host := d.hosts[key]
+	host.score.Events = append(host.score.Events, hostEvent{
+		dateTime: now,
+		score:    score,
+		name:     name,
+	})
+	host.score.TotalScore = 0
+
+	idx := 0
+	for _, event := range host.score.Events {
+		if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(now) {
+			host.score.Events[idx] = event
+			host.score.TotalScore += event.score
+			idx++
+		}
+	}
+	host.score.Events = host.score.Events[:idx]
+
+	if host.score.TotalScore < threshold {
+		d.hosts[key] = host
+		d.cleanupHosts(key)
+		return dbEvent, nil
+	}
+
+	banTime := now.Add(time.Duration(d.config.BanTime) * time.Minute)
+	d.notifier.notifyBan(key, host.score.TotalScore, banTime, name)
+	metric.AddDefenderBan()
+	d.hosts[key] = providerHost{
+		banTime: banTime,
+	}
+	d.cleanupHosts(key)
+	return dbEvent, &banTime
+}
+
+// saveScore saves the given event and, if not nil, the given ban time for the
+// specified host key to the data provider.
+// The caller must not hold the lock
+func (d *providerDefender) saveScore(key string, event dataprovider.DefenderEvent, banTime *time.Time) {
+	defer d.cleanup()
+
+	if err := dataprovider.AddDefenderEvent(key, event); err != nil {
+		logger.Warn(logSender, "", "unable to add defender event for host %#v: %v", key, err)
+		return
+	}
+	if banTime == nil {
+		return
+	}
+	if err := dataprovider.SetDefenderBanTime(key, util.GetTimeAsMsSinceEpoch(*banTime)); err != nil {
+		logger.Warn(logSender, "", "unable to ban defender host %#v: %v", key, err)
+	}
+}
+
+// cleanupHosts removes the expired hosts from the cache and, if required, the
+// hosts with the oldest activity, except the given host key, to respect the
+// configured limits. The removed hosts are still stored inside the data provider
+// and are loaded again if needed.
+// The caller must hold the lock
+func (d *providerDefender) cleanupHosts(keep string) {
+	if len(d.hosts) <= d.config.EntriesHardLimit {
+		return
+	}
+
+	now := time.Now()
+	kvList := make(kvList, 0, len(d.hosts))
+
+	for k, v := range d.hosts {
+		if k == keep {
+			continue
+		}
+		lastActivity := v.getLastActivity()
+		if lastActivity.Add(time.Duration(d.config.ObservationTime) * time.Minute).Before(now) {
+			delete(d.hosts, k)
+			continue
+		}
+
+		kvList = append(kvList, kv{
+			Key:   k,
+			Value: lastActivity.UnixNano(),
+		})
+	}
+
+	// we removed expired hosts, if any, above, this could be enough
+	numToRemove := len(d.hosts) - d.config.EntriesSoftLimit
+
+	if numToRemove <= 0 {
+		return
+	}
+
+	sort.Sort(kvList)
+
+	for idx, kv := range kvList {
+		if idx >= numToRemove {
+			break
+		}
+
+		delete(d.hosts, kv.Key)
+	}
+}
+
+// cleanup removes the expired hosts and events from the data provider.
+// The caller must not hold the lock
+func (d *providerDefender) cleanup() {
+	d.Lock()
+	if time.Since(d.lastCleanup) < time.Duration(d.config.ObservationTime)*time.Minute {
+		d.Unlock()
+		return
+	}
+	d.lastCleanup = time.Now()
+	d.Unlock()
+
+	if err := dataprovider.CleanupDefender(d.getStartObservationTime()); err != nil {
+		logger.Warn(logSender, "", "unable to cleanup the defender hosts: %v", err)
+	}
+}
+
+// GetBanTime returns the ban time for the given IP or nil if the IP is not banned
+func (d *providerDefender) GetBanTime(ip string) *time.Time {
+	key := d.config.getHostKey(ip)
+	if !d.loadHost(key) {
+		return nil
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if host, ok := d.hosts[key]; ok && host.banTime.After(time.Now()) {
+		banTime := host.banTime
+		return &banTime
+	}
+	return nil
+}
+
+// GetScore returns the score for the given IP
+func (d *providerDefender) GetScore(ip string) int {
+	key := d.config.getHostKey(ip)
+	if !d.loadHost(key) {
+		return 0
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	return d.getScore(key)
+}
+
+// getScore returns the score within the observation time for the given host key.
+// Hosts with an expired ban have no score, they start again from zero on the
+// next event.
+// The caller must hold the lock
+func (d *providerDefender) getScore(key string) int {
+	host, ok := d.hosts[key]
+	if !ok || !host.banTime.IsZero() {
+		return 0
+	}
+	score := 0
+	for _, event := range host.score.Events {
+		if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
+			score += event.score
+		}
+	}
+	return score
+}
+
+// GetThrottleDelay returns how long to wait before accepting a new connection
+// from the given IP, see memoryDefender.GetThrottleDelay
+func (d *providerDefender) GetThrottleDelay(ip string) time.Duration {
+	if d.config.ThrottleMaxDelay <= 0 {
+		return 0
+	}
+
+	key := d.config.getHostKey(ip)
+	if !d.loadHost(key) {
+		return 0
+	}
+
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.safeList != nil && d.safeList.isListed(ip) {
+		return 0
+	}
+	threshold := d.config.Threshold
+	if expiration, ok := d.graced[key]; ok && expiration.After(time.Now()) {
+		threshold = d.config.LoginGraceThreshold
+	}
+	return d.config.getThrottleDelay(d.getScore(key), threshold)
+}
+
+// ExplainBan returns why the given IP is banned or, if it is not banned,
+// its current score and the events contributing to it.
+// For score bans the reported threshold is the configured one, the login
+// grace threshold is not stored
+func (d *providerDefender) ExplainBan(ip string) *BanExplanation {
+	d.RLock()
+	defer d.RUnlock()
+
+	result := &BanExplanation{
+		IP:         ip,
+		Reason:     BanReasonNone,
+		SafeListed: d.safeList != nil && d.safeList.isListed(ip),
+		Threshold:  d.config.Threshold,
+	}
+
+	from := d.getStartObservationTime()
+	key := d.config.getHostKey(ip)
+	host, err := dataprovider.GetDefenderHostByIP(key, from)
+	hostFound := err == nil
+
+	// the same order used in IsBanned
+	if hostFound && host.IsBanned() {
+		result.Banned = true
+		result.Reason = BanReasonScore
+		banTime := util.GetTimeFromMsecSinceEpoch(host.BanTime)
+		result.BanTime = &banTime
+		// the host was updated when it was banned, the events within the
+		// observation time at that moment caused the ban
+		result.Score, result.Events = d.getExplanationEvents(key, host.UpdatedAt-d.getObservationTimeAsMs())
+		return result
+	}
+
+	if d.blockList != nil {
+		if entry := d.blockList.getMatch(ip); entry != "" {
+			result.Banned = true
+			result.Reason = BanReasonBlockList
+			result.BlockListFile = d.config.BlockListFile
+			result.BlockListEntry = entry
+			return result
+		}
+	}
+
+	if expiration, ok := d.graced[key]; ok && expiration.After(time.Now()) {
+		result.Threshold = d.config.LoginGraceThreshold
+	}
+	if hostFound && getDefenderHostScore(&host) > 0 {
+		result.Score, result.Events = d.getExplanationEvents(key, from)
+	}
+
+	return result
+}
+
+func (d *providerDefender) getObservationTimeAsMs() int64 {
+	return int64(d.config.ObservationTime) * time.Minute.Milliseconds()
+}
+
+// getExplanationEvents returns the events, and their total score, for the
+// given host key after the given time
+func (d *providerDefender) getExplanationEvents(ip string, from int64) (int, []BanExplanationEvent) {
+	events, err := dataprovider.GetDefenderEvents(ip, from)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get defender events for host %#v: %v", ip, err)
+		return 0, nil
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	score := 0
+	result := make([]BanExplanationEvent, 0, len(events))
+	for _, ev := range events {
+		score += ev.Score
+		result = append(result, BanExplanationEvent{
+			Event: ev.Name,
+			Score: ev.Score,
+			Time:  util.GetTimeFromMsecSinceEpoch(ev.DateTime),
+		})
+	}
+	return score, result
+}
+
+// getDefenderHostScore returns the score for the given host. Hosts with an
+// expired ban have no score, they start again from zero on the next event
+func getDefenderHostScore(host *dataprovider.DefenderHost) int {
+	if host.BanTime > 0 {
+		return 0
+	}
+	return host.Score
+}
+
+// getEntryFromHost returns the defender entry for the given host, nil if the
+// host is not banned and has no score
+func (d *providerDefender) getEntryFromHost(host *dataprovider.DefenderHost) *DefenderEntry {
+	if host.IsBanned() {
+		entry := &DefenderEntry{
+			IP:      host.IP,
+			BanTime: util.GetTimeFromMsecSinceEpoch(host.BanTime),
+		}
+		// see ExplainBan
+		d.addEntryEvents(entry, host.UpdatedAt-d.getObservationTimeAsMs())
+		return entry
+	}
+	if score := getDefenderHostScore(host); score > 0 {
+		entry := &DefenderEntry{
+			IP:    host.IP,
+			Score: score,
+		}
+		d.addEntryEvents(entry, d.getStartObservationTime())
+		return entry
+	}
+	return nil
+}
+
+// addEntryEvents adds the events after the given time to the given entry
+func (d *providerDefender) addEntryEvents(entry *DefenderEntry, from int64) {
+	events, err := dataprovider.GetDefenderEvents(entry.IP, from)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get defender events for host %#v: %v", entry.IP, err)
+		return
+	}
+	for _, ev := range events {
+		entry.addEvent(ev.Name)
+	}
+}
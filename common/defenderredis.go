@@ -0,0 +1,700 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/metric"
+	"github.com/drakkan/sftpgo/v2/util"
+)
+
+const (
+	redisBanKeyPrefix    = "ban:"
+	redisCauseKeyPrefix  = "cause:"
+	redisEventsKeyPrefix = "events:"
+	redisScanCount       = "100"
+)
+
+// redisDefender stores the host scores and the banned hosts inside a Redis
+// server, so multiple instances share the same state. The keys expire using
+// Redis TTLs:
+//
+// - "<prefix>ban:<ip>" contains the ban expiration as unix timestamp in milliseconds
+// - "<prefix>cause:<ip>" contains the events and the threshold that caused a score ban
+// - "<prefix>events:<ip>" is a sorted set with the host events, the set score is
+// the event time as unix timestamp in milliseconds
+//
+// The block and safe lists, the grace periods and the reputation cache are
+// kept in memory
+type redisDefender struct {
+	config *DefenderConfig
+	sync.RWMutex
+	client    *redisClient
+	safeList  *HostList
+	blockList *HostList
+	// hosts with a successful login within the last LoginGraceTime minutes,
+	// the value is the grace expiration
+	graced map[string]time.Time // the key is the host IP
+	// nil if no reputation hook is configured
+	reputation *reputationFeed
+	// nil if no ban hook is configured
+	notifier *banNotifier
+	// ban time increments not yet saved for banned hosts that keep connecting,
+	// the increments are saved at most once per minute for each host
+	increments map[string]redisBanIncrement // the key is the host IP
+}
+
+type redisBanIncrement struct {
+	// the increment, in minutes, not yet saved
+	pending int
+	savedAt time.Time
+}
+
+// redisBanCause is stored as JSON within the cause key
+type redisBanCause struct {
+	Threshold int                   `json:"threshold"`
+	Events    []BanExplanationEvent `json:"events"`
+}
+
+func newRedisDefender(config *DefenderConfig) (Defender, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	defender := &redisDefender{
+		config:     config,
+		client:     newRedisClient(config.Redis.Address, config.Redis.Password, config.Redis.DB),
+		graced:     make(map[string]time.Time),
+		increments: make(map[string]redisBanIncrement),
+		reputation: newReputationFeed(config),
+		notifier:   newBanNotifier(config),
+	}
+
+	if err := defender.Reload(); err != nil {
+		return nil, err
+	}
+
+	return defender, nil
+}
+
+// Reload reloads block and safe lists
+func (d *redisDefender) Reload() error {
+	blockList, safeList, err := loadHostLists(d.config)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	d.blockList = blockList
+	d.safeList = safeList
+	d.Unlock()
+
+	return nil
+}
+
+// getKey returns the Redis key for the given IP, the IP is converted to its
+// host key so the keys for aggregated addresses are shared
+func (d *redisDefender) getKey(keyPrefix, ip string) string {
+	return d.config.Redis.Prefix + keyPrefix + d.config.getHostKey(ip)
+}
+
+// getBanTime returns the ban expiration for the given IP, nil if the host is not banned
+func (d *redisDefender) getBanTime(ip string) (*time.Time, error) {
+	reply, err := d.client.do("GET", d.getKey(redisBanKeyPrefix, ip))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected ban time for host %#v: %v", ip, reply)
+	}
+	msec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	banTime := util.GetTimeFromMsecSinceEpoch(msec)
+	if !banTime.After(time.Now()) {
+		return nil, nil
+	}
+	return &banTime, nil
+}
+
+// incrementBanTime increments the ban time for the given banned IP. The
+// increments are accumulated in memory and saved at most once per minute, so
+// a banned host that keeps connecting does not cause a write for each connection
+func (d *redisDefender) incrementBanTime(ip string) {
+	key := d.config.getHostKey(ip)
+	toSave := 0
+
+	d.Lock()
+	increment := d.increments[key]
+	increment.pending += d.config.getBanTimeIncrement()
+	if time.Since(increment.savedAt) >= time.Minute {
+		toSave = increment.pending
+		increment.pending = 0
+		increment.savedAt = time.Now()
+	}
+	d.increments[key] = increment
+	d.cleanupIncrements()
+	d.Unlock()
+
+	if toSave > 0 {
+		_, err := d.client.do("EVAL", redisIncrementBanTimeScript, "2", d.getKey(redisBanKeyPrefix, ip),
+			d.getKey(redisCauseKeyPrefix, ip), strconv.FormatInt((time.Duration(toSave)*time.Minute).Milliseconds(), 10))
+		if err != nil {
+			logger.Warn(logSender, "", "unable to increment the ban time for host %#v: %v", ip, err)
+		}
+	}
+}
+
+// cleanupIncrements removes the saved increments older than a minute if there
+// are too many. Pending increments for hosts that stopped connecting are lost,
+// this only shortens their ban time. It must be called while holding the lock
+func (d *redisDefender) cleanupIncrements() {
+	if len(d.increments) <= d.config.EntriesSoftLimit {
+		return
+	}
+	for k, v := range d.increments {
+		if time.Since(v.savedAt) >= time.Minute {
+			delete(d.increments, k)
+		}
+	}
+}
+
+// getEvents returns the events within the observation time for the given IP
+func (d *redisDefender) getEvents(ip string) ([]BanExplanationEvent, error) {
+	start := util.GetTimeAsMsSinceEpoch(time.Now().Add(-time.Duration(d.config.ObservationTime) * time.Minute))
+	reply, err := d.client.do("ZRANGEBYSCORE", d.getKey(redisEventsKeyPrefix, ip), fmt.Sprintf("(%d", start), "+inf")
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	members, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected events for host %#v: %v", ip, reply)
+	}
+	events := make([]BanExplanationEvent, 0, len(members))
+	for _, m := range members {
+		member, ok := m.(string)
+		if !ok {
+			continue
+		}
+		ev, err := parseRedisEvent(member)
+		if err != nil {
+			logger.Warn(logSender, "", "invalid defender event %#v for host %#v: %v", member, ip, err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+func (d *redisDefender) getScore(ip string) (int, error) {
+	events, err := d.getEvents(ip)
+	if err != nil {
+		return 0, err
+	}
+	score := 0
+	for _, ev := range events {
+		score += ev.Score
+	}
+	return score, nil
+}
+
+// scanKeys returns, at most, limit keys matching the given key prefix
+func (d *redisDefender) scanKeys(keyPrefix string, limit int) ([]string, error) {
+	var keys []string
+	pattern := d.config.Redis.Prefix + keyPrefix + "*"
+	cursor := "0"
+	for {
+		reply, err := d.client.do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount)
+		if err != nil {
+			return keys, err
+		}
+		result, ok := reply.([]interface{})
+		if !ok || len(result) != 2 {
+			return keys, fmt.Errorf("unexpected scan reply: %v", reply)
+		}
+		cursor, ok = result[0].(string)
+		if !ok {
+			return keys, fmt.Errorf("unexpected scan cursor: %v", result[0])
+		}
+		items, _ := result[1].([]interface{})
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+				if len(keys) >= limit {
+					return keys, nil
+				}
+			}
+		}
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// GetHosts returns hosts that are banned or for which some violations have been detected
+func (d *redisDefender) GetHosts() []*DefenderEntry {
+	var result []*DefenderEntry
+
+	keys, err := d.scanKeys(redisBanKeyPrefix, d.config.EntriesHardLimit)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get banned hosts from redis: %v", err)
+	}
+	for _, key := range keys {
+		ip := strings.TrimPrefix(key, d.config.Redis.Prefix+redisBanKeyPrefix)
+		banTime, err := d.getBanTime(ip)
+		if err == nil && banTime != nil {
+			result = append(result, d.getBannedEntry(ip, *banTime))
+		}
+	}
+
+	keys, err = d.scanKeys(redisEventsKeyPrefix, d.config.EntriesHardLimit)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get host scores from redis: %v", err)
+	}
+	for _, key := range keys {
+		ip := strings.TrimPrefix(key, d.config.Redis.Prefix+redisEventsKeyPrefix)
+		entry, err := d.getScoreEntry(ip)
+		if err == nil && entry != nil {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// getBannedEntry returns the defender entry for a banned host, including the
+// events that caused the ban if known
+func (d *redisDefender) getBannedEntry(ip string, banTime time.Time) *DefenderEntry {
+	entry := &DefenderEntry{
+		IP:      ip,
+		BanTime: banTime,
+	}
+	cause, err := d.getBanCause(ip)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the ban cause for host %#v: %v", ip, err)
+		return entry
+	}
+	if cause != nil {
+		for _, ev := range cause.Events {
+			entry.addEvent(ev.Event)
+		}
+	}
+	return entry
+}
+
+// getScoreEntry returns the defender entry for a host with a score, nil if
+// the host has no score
+func (d *redisDefender) getScoreEntry(ip string) (*DefenderEntry, error) {
+	events, err := d.getEvents(ip)
+	if err != nil {
+		return nil, err
+	}
+	entry := &DefenderEntry{
+		IP: ip,
+	}
+	for _, ev := range events {
+		entry.Score += ev.Score
+		entry.addEvent(ev.Event)
+	}
+	if entry.Score > 0 {
+		return entry, nil
+	}
+	return nil, nil
+}
+
+// GetHost returns a defender host by ip, if any.
+// If the addresses are aggregated by subnet the subnet is returned
+func (d *redisDefender) GetHost(ip string) (*DefenderEntry, error) {
+	ip = d.config.getHostKey(ip)
+	banTime, err := d.getBanTime(ip)
+	if err != nil {
+		return nil, err
+	}
+	if banTime != nil {
+		return d.getBannedEntry(ip, *banTime), nil
+	}
+
+	entry, err := d.getScoreEntry(ip)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return entry, nil
+	}
+
+	return nil, util.NewRecordNotFoundError("host not found")
+}
+
+// IsBanned returns true if the specified IP is banned
+// and increase ban time if the IP is found.
+// This method must be called as soon as the client connects
+func (d *redisDefender) IsBanned(ip string) bool {
+	banTime, err := d.getBanTime(ip)
+	if err != nil {
+		// we fail open, the block list is still checked
+		logger.Warn(logSender, "", "unable to check if host %#v is banned: %v", ip, err)
+	}
+	if banTime != nil {
+		d.incrementBanTime(ip)
+		return true
+	}
+
+	d.RLock()
+
+	if d.blockList != nil && d.blockList.isListed(ip) {
+		d.RUnlock()
+		// permanent ban
+		return true
+	}
+	isSafe := d.safeList != nil && d.safeList.isListed(ip)
+
+	d.RUnlock()
+
+	if d.reputation == nil || isSafe {
+		return false
+	}
+	return d.checkReputation(ip)
+}
+
+// checkReputation merges the score returned by the reputation feed with the
+// shared host score and returns true if the host is banned as result.
+// Cached scores were already merged so they are ignored
+func (d *redisDefender) checkReputation(ip string) bool {
+	score, isNew := d.reputation.getScore(ip)
+	if !isNew || score <= 0 {
+		return false
+	}
+
+	// the login grace does not apply to the reputation feed
+	return d.addScore(ip, hostEventReputation, score, d.config.Threshold)
+}
+
+// DeleteHost removes the specified IP from the defender lists
+func (d *redisDefender) DeleteHost(ip string) bool {
+	banTime, _ := d.getBanTime(ip)
+	reply, err := d.client.do("DEL", d.getKey(redisBanKeyPrefix, ip), d.getKey(redisCauseKeyPrefix, ip),
+		d.getKey(redisEventsKeyPrefix, ip))
+	if err != nil {
+		logger.Warn(logSender, "", "unable to delete defender host %#v: %v", ip, err)
+		return false
+	}
+	d.Lock()
+	delete(d.increments, d.config.getHostKey(ip))
+	d.Unlock()
+
+	deleted, _ := reply.(int64)
+	if deleted > 0 && banTime != nil {
+		d.notifier.notifyUnban(d.config.getHostKey(ip))
+	}
+	return deleted > 0
+}
+
+// AddLoginSuccess grants a grace period to the given IP after a successful login.
+// Within this period the host is banned only if its score exceeds the login
+// grace threshold. The grace periods are not shared among instances
+func (d *redisDefender) AddLoginSuccess(ip string) {
+	if d.config.LoginGraceTime <= 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.safeList != nil && d.safeList.isListed(ip) {
+		return
+	}
+
+	d.graced[d.config.getHostKey(ip)] = time.Now().Add(time.Duration(d.config.LoginGraceTime) * time.Minute)
+	cleanupGraced(d.graced, d.config)
+}
+
+func (d *redisDefender) getThreshold(ip string) int {
+	key := d.config.getHostKey(ip)
+
+	d.Lock()
+	defer d.Unlock()
+
+	if expiration, ok := d.graced[key]; ok {
+		if expiration.After(time.Now()) {
+			return d.config.LoginGraceThreshold
+		}
+		delete(d.graced, key)
+	}
+	return d.config.Threshold
+}
+
+// AddEvent adds an event for the given IP and protocol.
+// This method must be called for clients not yet banned
+func (d *redisDefender) AddEvent(ip, protocol string, event HostEvent) {
+	metric.AddDefenderEvent(getHostEventName(event))
+
+	d.RLock()
+	isSafe := d.safeList != nil && d.safeList.isListed(ip)
+	d.RUnlock()
+
+	if isSafe {
+		return
+	}
+
+	score := d.config.getEventScore(protocol, event)
+	if score == 0 && event == HostEventAbusiveActivity {
+		return
+	}
+
+	// events for already banned hosts are ignored by addScore
+	d.addScore(ip, getHostEventName(event), score, d.getThreshold(ip))
+}
+
+// redisAddScoreScript adds an event to the host events, removes the events
+// outside the observation time and bans the host if the threshold is reached.
+// Running everything inside a script makes the ban decision atomic among the
+// instances, so a host is banned, and notified, once.
+// KEYS: events, ban. ARGV: event time, event member, observation start, observation
+// time, threshold, ban expiration, ban time.
+// It returns 1 and the events that caused the ban if the host was banned by this
+// call, 0 otherwise
+const redisAddScoreScript = `
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return {0}
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+local members = redis.call('ZRANGE', KEYS[1], 0, -1)
+local score = 0
+for _, member in ipairs(members) do
+	score = score + (tonumber(string.match(member, '|(%-?%d+)$')) or 0)
+end
+if score < tonumber(ARGV[5]) then
+	return {0}
+end
+redis.call('SET', KEYS[2], ARGV[6], 'PX', ARGV[7])
+redis.call('DEL', KEYS[1])
+return {1, members}
+`
+
+// redisIncrementBanTimeScript increments the ban time for a banned host.
+// KEYS: ban, cause. ARGV: increment in milliseconds
+const redisIncrementBanTimeScript = `
+local banTime = tonumber(redis.call('GET', KEYS[1]))
+local ttl = redis.call('PTTL', KEYS[1])
+if not banTime or ttl <= 0 then
+	return 0
+end
+local increment = tonumber(ARGV[1])
+redis.call('SET', KEYS[1], string.format('%.0f', banTime + increment), 'PX', ttl + increment)
+redis.call('PEXPIRE', KEYS[2], ttl + increment)
+return 1
+`
+
+// addScore adds an event with the given name and score for the specified IP and
+// bans it if the given threshold is reached. It returns true if the host is banned
+// by this call
+func (d *redisDefender) addScore(ip, name string, score, threshold int) bool {
+	now := time.Now()
+	observationTime := time.Duration(d.config.ObservationTime) * time.Minute
+	start := util.GetTimeAsMsSinceEpoch(now.Add(-observationTime))
+	banTime := now.Add(time.Duration(d.config.BanTime) * time.Minute)
+
+	reply, err := d.client.do("EVAL", redisAddScoreScript, "2", d.getKey(redisEventsKeyPrefix, ip),
+		d.getKey(redisBanKeyPrefix, ip), strconv.FormatInt(util.GetTimeAsMsSinceEpoch(now), 10),
+		getRedisEventMember(now, name, score), strconv.FormatInt(start, 10),
+		strconv.FormatInt(observationTime.Milliseconds(), 10), strconv.Itoa(threshold),
+		strconv.FormatInt(util.GetTimeAsMsSinceEpoch(banTime), 10),
+		strconv.FormatInt(time.Until(banTime).Milliseconds(), 10))
+	if err != nil {
+		logger.Warn(logSender, "", "unable to add defender event for host %#v: %v", ip, err)
+		return false
+	}
+	result, ok := reply.([]interface{})
+	if !ok || len(result) == 0 {
+		logger.Warn(logSender, "", "unexpected reply adding defender event for host %#v: %v", ip, reply)
+		return false
+	}
+	if banned, _ := result[0].(int64); banned != 1 {
+		return false
+	}
+
+	var members []interface{}
+	if len(result) > 1 {
+		members, _ = result[1].([]interface{})
+	}
+	events := make([]BanExplanationEvent, 0, len(members))
+	totalScore := 0
+	for _, m := range members {
+		member, _ := m.(string)
+		ev, err := parseRedisEvent(member)
+		if err != nil {
+			logger.Warn(logSender, "", "invalid defender event %#v for host %#v: %v", member, ip, err)
+			continue
+		}
+		events = append(events, ev)
+		totalScore += ev.Score
+	}
+	d.notifier.notifyBan(d.config.getHostKey(ip), totalScore, banTime, name)
+	metric.AddDefenderBan()
+
+	cause, err := json.Marshal(redisBanCause{
+		Threshold: threshold,
+		Events:    events,
+	})
+	if err == nil {
+		_, err = d.client.do("SET", d.getKey(redisCauseKeyPrefix, ip), string(cause), "PX",
+			strconv.FormatInt(time.Until(banTime).Milliseconds(), 10))
+	}
+	if err != nil {
+		logger.Warn(logSender, "", "unable to save the ban cause for host %#v: %v", ip, err)
+	}
+	return true
+}
+
+// GetBanTime returns the ban time for the given IP or nil if the IP is not banned
+func (d *redisDefender) GetBanTime(ip string) *time.Time {
+	banTime, err := d.getBanTime(ip)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the ban time for host %#v: %v", ip, err)
+		return nil
+	}
+	return banTime
+}
+
+// GetScore returns the score for the given IP
+func (d *redisDefender) GetScore(ip string) int {
+	score, err := d.getScore(ip)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the score for host %#v: %v", ip, err)
+		return 0
+	}
+	return score
+}
+
+// GetThrottleDelay returns how long to wait before accepting a new connection
+// from the given IP, see memoryDefender.GetThrottleDelay
+func (d *redisDefender) GetThrottleDelay(ip string) time.Duration {
+	if d.config.ThrottleMaxDelay <= 0 {
+		return 0
+	}
+
+	d.RLock()
+	isSafe := d.safeList != nil && d.safeList.isListed(ip)
+	threshold := d.config.Threshold
+	if expiration, ok := d.graced[d.config.getHostKey(ip)]; ok && expiration.After(time.Now()) {
+		threshold = d.config.LoginGraceThreshold
+	}
+	d.RUnlock()
+
+	if isSafe {
+		return 0
+	}
+	return d.config.getThrottleDelay(d.GetScore(ip), threshold)
+}
+
+// ExplainBan returns why the given IP is banned or, if it is not banned,
+// its current score and the events contributing to it
+func (d *redisDefender) ExplainBan(ip string) *BanExplanation {
+	d.RLock()
+	result := &BanExplanation{
+		IP:         ip,
+		Reason:     BanReasonNone,
+		SafeListed: d.safeList != nil && d.safeList.isListed(ip),
+		Threshold:  d.config.Threshold,
+	}
+	blockListEntry := ""
+	if d.blockList != nil {
+		blockListEntry = d.blockList.getMatch(ip)
+	}
+	if expiration, ok := d.graced[d.config.getHostKey(ip)]; ok && expiration.After(time.Now()) {
+		result.Threshold = d.config.LoginGraceThreshold
+	}
+	d.RUnlock()
+
+	// the same order used in IsBanned
+	banTime, err := d.getBanTime(ip)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the ban time for host %#v: %v", ip, err)
+	}
+	if banTime != nil {
+		result.Banned = true
+		result.Reason = BanReasonScore
+		result.BanTime = banTime
+		result.Threshold = d.config.Threshold
+		if cause, err := d.getBanCause(ip); err == nil && cause != nil {
+			result.Threshold = cause.Threshold
+			result.Events = cause.Events
+			for _, ev := range cause.Events {
+				result.Score += ev.Score
+			}
+		}
+		return result
+	}
+
+	if blockListEntry != "" {
+		result.Banned = true
+		result.Reason = BanReasonBlockList
+		result.BlockListFile = d.config.BlockListFile
+		result.BlockListEntry = blockListEntry
+		result.Threshold = d.config.Threshold
+		return result
+	}
+
+	events, err := d.getEvents(ip)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get defender events for host %#v: %v", ip, err)
+	}
+	if len(events) > 0 {
+		result.Events = events
+		for _, ev := range events {
+			result.Score += ev.Score
+		}
+	}
+
+	return result
+}
+
+func (d *redisDefender) getBanCause(ip string) (*redisBanCause, error) {
+	reply, err := d.client.do("GET", d.getKey(redisCauseKeyPrefix, ip))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected ban cause for host %#v: %v", ip, reply)
+	}
+	var cause redisBanCause
+	err = json.Unmarshal([]byte(value), &cause)
+	return &cause, err
+}
+
+// getRedisEventMember returns the sorted set member for an event, the time as
+// unix nanoseconds makes it unique
+func getRedisEventMember(t time.Time, name string, score int) string {
+	return fmt.Sprintf("%d|%s|%d", t.UnixNano(), name, score)
+}
+
+func parseRedisEvent(member string) (BanExplanationEvent, error) {
+	var ev BanExplanationEvent
+	parts := strings.Split(member, "|")
+	if len(parts) != 3 {
+		return ev, errors.New("invalid event format")
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ev, err
+	}
+	score, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return ev, err
+	}
+	ev.Time = time.Unix(0, nsec)
+	ev.Event = parts[1]
+	ev.Score = score
+	return ev, nil
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/httpclient"
+	"github.com/drakkan/sftpgo/v2/logger"
+)
+
+const (
+	maxReputationResponseSize = 1048576 // 1MB
+	// failed lookups are cached for this time, at most, to avoid
+	// querying an unavailable feed for each new connection
+	reputationErrorCacheTime = time.Minute
+)
+
+// reputationResponse defines the response expected from the reputation hook.
+// If Block is true the host is banned, otherwise Score is added to the host score
+type reputationResponse struct {
+	Score int  `json:"score"`
+	Block bool `json:"block"`
+}
+
+type reputationEntry struct {
+	score      int
+	expiration time.Time
+}
+
+// reputationFeed queries an external reputation hook and caches its decisions
+type reputationFeed struct {
+	hook      string
+	cacheTime time.Duration
+	threshold int
+	softLimit int
+	hardLimit int
+	sync.Mutex
+	cache map[string]reputationEntry
+}
+
+func newReputationFeed(config *DefenderConfig) *reputationFeed {
+	if config.ReputationHook == "" {
+		return nil
+	}
+	return &reputationFeed{
+		hook:      config.ReputationHook,
+		cacheTime: time.Duration(config.ReputationCacheTime) * time.Second,
+		threshold: config.Threshold,
+		softLimit: config.EntriesSoftLimit,
+		hardLimit: config.EntriesHardLimit,
+		cache:     make(map[string]reputationEntry),
+	}
+}
+
+// getScore returns the score for the given IP. The returned boolean is true if
+// the score was returned from the hook and not from the cache.
+// The feed fails open: on errors a zero score is returned
+func (f *reputationFeed) getScore(ip string) (int, bool) {
+	f.Lock()
+	entry, ok := f.cache[ip]
+	f.Unlock()
+
+	if ok && entry.expiration.After(time.Now()) {
+		return entry.score, false
+	}
+
+	startTime := time.Now()
+	cacheTime := f.cacheTime
+	score, err := f.query(ip)
+	logger.Debug(logSender, "", "reputation hook executed for ip %#v, score: %v, elapsed: %v, error: %v",
+		ip, score, time.Since(startTime), err)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get reputation for ip %#v, the ip is allowed: %v", ip, err)
+		score = 0
+		if cacheTime > reputationErrorCacheTime {
+			cacheTime = reputationErrorCacheTime
+		}
+	}
+	f.add(ip, score, cacheTime)
+	return score, true
+}
+
+func (f *reputationFeed) add(ip string, score int, cacheTime time.Duration) {
+	if cacheTime <= 0 {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.cache) >= f.hardLimit {
+		now := time.Now()
+		for k, v := range f.cache {
+			if v.expiration.Before(now) {
+				delete(f.cache, k)
+			}
+		}
+		for k := range f.cache {
+			if len(f.cache) < f.softLimit {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	f.cache[ip] = reputationEntry{
+		score:      score,
+		expiration: time.Now().Add(cacheTime),
+	}
+}
+
+func (f *reputationFeed) query(ip string) (int, error) {
+	out, err := f.getHookResponse(ip)
+	if err != nil {
+		return 0, err
+	}
+	var resp reputationResponse
+	if err = json.Unmarshal(out, &resp); err != nil {
+		return 0, fmt.Errorf("invalid reputation hook response: %w", err)
+	}
+	if resp.Block {
+		return f.threshold, nil
+	}
+	if resp.Score < 0 {
+		return 0, nil
+	}
+	return resp.Score, nil
+}
+
+func (f *reputationFeed) getHookResponse(ip string) ([]byte, error) {
+	if strings.HasPrefix(f.hook, "http") {
+		u, err := url.Parse(f.hook)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Add("ip", ip)
+		u.RawQuery = q.Encode()
+
+		resp, err := httpclient.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("wrong http status code from reputation hook: %v, expected 200", resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxReputationResponseSize))
+	}
+	if !filepath.IsAbs(f.hook) {
+		return nil, fmt.Errorf("invalid reputation hook %#v", f.hook)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, f.hook)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("SFTPGO_REPUTATION_IP=%v", ip))
+	return cmd.Output()
+}
@@ -0,0 +1,257 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/dataprovider"
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/vfs"
+)
+
+var errCopyAborted = errors.New("copy aborted")
+
+// copyTransfer tracks a recursive server side copy. It is registered within the
+// connection's active transfers so the progress is visible and the copy can be
+// aborted using SignalTransfersAbort
+type copyTransfer struct {
+	ID          uint64
+	FilesDone   int32
+	BytesDone   int64
+	AbortCopy   int32
+	virtualPath string
+	startTime   time.Time
+}
+
+func newCopyTransfer(conn *BaseConnection, virtualPath string) *copyTransfer {
+	return &copyTransfer{
+		ID:          conn.GetTransferID(),
+		virtualPath: virtualPath,
+		startTime:   time.Now(),
+	}
+}
+
+// GetID returns the transfer ID
+func (t *copyTransfer) GetID() uint64 {
+	return t.ID
+}
+
+// GetType returns the transfer type
+func (t *copyTransfer) GetType() int {
+	return TransferCopy
+}
+
+// GetSize returns the number of bytes copied so far
+func (t *copyTransfer) GetSize() int64 {
+	return atomic.LoadInt64(&t.BytesDone)
+}
+
+// GetVirtualPath returns the target directory as visible by the SFTPGo user
+func (t *copyTransfer) GetVirtualPath() string {
+	return t.virtualPath
+}
+
+// GetStartTime returns the start time
+func (t *copyTransfer) GetStartTime() time.Time {
+	return t.startTime
+}
+
+// SignalClose signals that the copy should be aborted
+func (t *copyTransfer) SignalClose() {
+	atomic.StoreInt32(&t.AbortCopy, 1)
+}
+
+// Truncate is not supported for copies
+func (t *copyTransfer) Truncate(fsPath string, size int64) (int64, error) {
+	return 0, errTransferMismatch
+}
+
+// GetRealFsPath returns an empty string, a copy has no open handles
+func (t *copyTransfer) GetRealFsPath(fsPath string) string {
+	return ""
+}
+
+// GetFilesDone returns the number of files copied so far
+func (t *copyTransfer) GetFilesDone() int {
+	return int(atomic.LoadInt32(&t.FilesDone))
+}
+
+func (t *copyTransfer) isAborted() bool {
+	return atomic.LoadInt32(&t.AbortCopy) != 0
+}
+
+func (t *copyTransfer) addBytes(n int64) {
+	atomic.AddInt64(&t.BytesDone, n)
+}
+
+// copyProgressReader updates the copy progress while reading and stops the
+// stream copy as soon as the copy is aborted
+type copyProgressReader struct {
+	io.Reader
+	transfer *copyTransfer
+}
+
+func (r *copyProgressReader) Read(p []byte) (int, error) {
+	if r.transfer.isAborted() {
+		return 0, errCopyAborted
+	}
+	n, err := r.Reader.Read(p)
+	r.transfer.addBytes(int64(n))
+	return n, err
+}
+
+// copiedEntry is a directory or file created by a recursive copy
+type copiedEntry struct {
+	virtualPath string
+	isDir       bool
+	size        int64
+}
+
+// CopyDir recursively copies the directory virtualSourcePath to virtualTargetPath.
+// Directories are recreated and files are copied using Copy semantics, so
+// permissions, allowed patterns and quota are checked for each entry.
+// The copy is listed within the connection's active transfers and it can be
+// aborted using SignalTransfersAbort: if it does not complete, the new files
+// and directories created so far are removed. Existing target files that
+// were already overwritten are left as they are.
+// If virtualSourcePath is a regular file this is the same as Copy
+func (c *BaseConnection) CopyDir(virtualSourcePath, virtualTargetPath string) error {
+	virtualSourcePath = path.Clean(virtualSourcePath)
+	virtualTargetPath = path.Clean(virtualTargetPath)
+	if virtualSourcePath == virtualTargetPath || virtualSourcePath == "/" ||
+		strings.HasPrefix(virtualTargetPath, virtualSourcePath+"/") {
+		c.Log(logger.LevelWarn, "copy %#v to %#v is not supported", virtualSourcePath, virtualTargetPath)
+		return c.GetOpUnsupportedError()
+	}
+	fsSrc, fsSourcePath, err := c.GetFsAndResolvedPath(virtualSourcePath)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := fsSrc.Lstat(fsSourcePath)
+	if err != nil {
+		return c.GetFsError(fsSrc, err)
+	}
+	if srcInfo.Mode().IsRegular() {
+		return c.Copy(virtualSourcePath, virtualTargetPath)
+	}
+	if !srcInfo.IsDir() {
+		c.Log(logger.LevelDebug, "cannot copy %#v, only files and directories are supported", virtualSourcePath)
+		return c.GetOpUnsupportedError()
+	}
+	// a single walk cannot follow the virtual folders mounted inside the source
+	if c.User.HasVirtualFoldersInside(virtualSourcePath) {
+		c.Log(logger.LevelDebug, "cannot copy %#v, the directory contains virtual folders", virtualSourcePath)
+		return c.GetOpUnsupportedError()
+	}
+
+	transfer := newCopyTransfer(c, virtualTargetPath)
+	c.AddTransfer(transfer)
+	defer c.RemoveTransfer(transfer)
+
+	var copied []copiedEntry
+	err = fsSrc.Walk(fsSourcePath, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return c.GetFsError(fsSrc, err)
+		}
+		if transfer.isAborted() {
+			return c.GetGenericError(errCopyAborted)
+		}
+		virtualSrc := fsSrc.GetRelativePath(walkedPath)
+		if virtualSrc != virtualSourcePath && !strings.HasPrefix(virtualSrc, virtualSourcePath+"/") {
+			c.Log(logger.LevelWarn, "unexpected path %#v walking %#v", virtualSrc, virtualSourcePath)
+			return c.GetGenericError(nil)
+		}
+		virtualDst := path.Join(virtualTargetPath, strings.TrimPrefix(virtualSrc, virtualSourcePath))
+		if info.IsDir() {
+			created, err := c.copyDirEntry(virtualSrc, virtualDst)
+			if err != nil {
+				return err
+			}
+			if created {
+				copied = append(copied, copiedEntry{virtualPath: virtualDst, isDir: true})
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			c.Log(logger.LevelDebug, "skipping %#v, only files and directories are copied", virtualSrc)
+			return nil
+		}
+		initialSize, err := c.copyRegularFile(fsSrc, walkedPath, virtualSrc, virtualDst, info.Size(), transfer)
+		if err != nil {
+			return err
+		}
+		if initialSize == -1 {
+			copied = append(copied, copiedEntry{virtualPath: virtualDst, size: info.Size()})
+		}
+		atomic.AddInt32(&transfer.FilesDone, 1)
+		return nil
+	})
+	if err != nil {
+		c.Log(logger.LevelWarn, "copy %#v -> %#v failed after %v files, %v bytes: %v", virtualSourcePath,
+			virtualTargetPath, transfer.GetFilesDone(), transfer.GetSize(), err)
+		c.removeCopiedEntries(copied)
+		return err
+	}
+	c.Log(logger.LevelDebug, "copy %#v -> %#v completed, files: %v, bytes: %v", virtualSourcePath,
+		virtualTargetPath, transfer.GetFilesDone(), transfer.GetSize())
+	return nil
+}
+
+// copyDirEntry creates the target directory, if missing, and returns true if it was created
+func (c *BaseConnection) copyDirEntry(virtualSourcePath, virtualTargetPath string) (bool, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, virtualSourcePath) {
+		return false, c.GetPermissionDeniedError()
+	}
+	fsDst, fsTargetPath, err := c.GetFsAndResolvedPath(virtualTargetPath)
+	if err != nil {
+		return false, err
+	}
+	dstInfo, err := fsDst.Lstat(fsTargetPath)
+	if err == nil {
+		if !dstInfo.IsDir() {
+			c.Log(logger.LevelWarn, "attempted to overwrite a file with a directory, source: %#v target: %#v",
+				virtualSourcePath, virtualTargetPath)
+			return false, c.GetOpUnsupportedError()
+		}
+		return false, nil
+	}
+	if !fsDst.IsNotExist(err) {
+		return false, c.GetFsError(fsDst, err)
+	}
+	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(virtualTargetPath)) {
+		return false, c.GetPermissionDeniedError()
+	}
+	if err := fsDst.Mkdir(fsTargetPath); err != nil {
+		c.Log(logger.LevelWarn, "error creating dir: %#v error: %+v", fsTargetPath, err)
+		return false, c.GetFsError(fsDst, err)
+	}
+	vfs.SetPathPermissions(fsDst, fsTargetPath, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog(mkdirLogSender, fsTargetPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "", -1,
+		c.localAddr, c.remoteAddr)
+	return true, nil
+}
+
+// removeCopiedEntries removes, in reverse order, the entries created by a
+// failed recursive copy and updates the quota accordingly
+func (c *BaseConnection) removeCopiedEntries(entries []copiedEntry) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		fs, fsPath, err := c.GetFsAndResolvedPath(entry.virtualPath)
+		if err != nil {
+			c.Log(logger.LevelWarn, "unable to remove partial copy %#v: %v", entry.virtualPath, err)
+			continue
+		}
+		if err := fs.Remove(fsPath, entry.isDir); err != nil {
+			c.Log(logger.LevelWarn, "unable to remove partial copy %#v: %v", fsPath, err)
+			continue
+		}
+		if !entry.isDir {
+			c.updateQuotaForPath(entry.virtualPath, -1, -entry.size)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package common_test
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -34,6 +35,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/kms"
 	"github.com/drakkan/sftpgo/v2/logger"
 	"github.com/drakkan/sftpgo/v2/sdk"
+	"github.com/drakkan/sftpgo/v2/util"
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
 
@@ -889,6 +891,533 @@ func TestVirtualFoldersQuotaValues(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUsedQuotaBreakdown(t *testing.T) {
+	u := getTestUser()
+	// the quota is tracked only for users with quota restrictions
+	u.QuotaFiles = 100
+	mappedPath1 := filepath.Join(os.TempDir(), "vdir1")
+	vdirPath1 := "/vdir1"
+	folderName1 := filepath.Base(mappedPath1)
+	mappedPath2 := filepath.Join(os.TempDir(), "vdir2")
+	vdirPath2 := "/vdir2"
+	folderName2 := filepath.Base(mappedPath2)
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName1,
+			MappedPath: mappedPath1,
+		},
+		VirtualPath: vdirPath1,
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName2,
+			MappedPath: mappedPath2,
+		},
+		VirtualPath: vdirPath2,
+		QuotaFiles:  0,
+		QuotaSize:   0,
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	testFileSize := int64(131072)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		err = writeSFTPFile(testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = writeSFTPFile(testFileName+"1", testFileSize, client)
+		assert.NoError(t, err)
+		err = writeSFTPFile(path.Join(vdirPath1, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = writeSFTPFile(path.Join(vdirPath2, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+	}
+	user, err = dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	breakdown, err := dataprovider.GetUsedQuotaBreakdown(&user)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*testFileSize, breakdown.HomeUsedQuotaSize)
+	assert.Equal(t, 2, breakdown.HomeUsedQuotaFiles)
+	if assert.Len(t, breakdown.Folders, 2) {
+		assert.Equal(t, folderName1, breakdown.Folders[0].Name)
+		assert.Equal(t, []string{vdirPath1}, breakdown.Folders[0].VirtualPaths)
+		assert.True(t, breakdown.Folders[0].IncludedInUserQuota)
+		assert.Equal(t, testFileSize, breakdown.Folders[0].UsedQuotaSize)
+		assert.Equal(t, 1, breakdown.Folders[0].UsedQuotaFiles)
+		assert.Equal(t, folderName2, breakdown.Folders[1].Name)
+		assert.False(t, breakdown.Folders[1].IncludedInUserQuota)
+		assert.Equal(t, testFileSize, breakdown.Folders[1].UsedQuotaSize)
+		assert.Equal(t, 1, breakdown.Folders[1].UsedQuotaFiles)
+	}
+	assert.Equal(t, 4*testFileSize, breakdown.TotalUsedQuotaSize)
+	assert.Equal(t, 4, breakdown.TotalUsedQuotaFiles)
+	assert.Equal(t, user.UsedQuotaSize+testFileSize, breakdown.TotalUsedQuotaSize)
+	assert.Equal(t, user.UsedQuotaFiles+1, breakdown.TotalUsedQuotaFiles)
+	// the same folder mapped at another virtual path is counted once
+	user.VirtualFolders = append(user.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name: folderName1,
+		},
+		VirtualPath: "/vdir3",
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	breakdown, err = dataprovider.GetUsedQuotaBreakdown(&user)
+	assert.NoError(t, err)
+	if assert.Len(t, breakdown.Folders, 2) {
+		assert.Equal(t, []string{vdirPath1, "/vdir3"}, breakdown.Folders[0].VirtualPaths)
+	}
+	assert.Equal(t, 4*testFileSize, breakdown.TotalUsedQuotaSize)
+	assert.Equal(t, 4, breakdown.TotalUsedQuotaFiles)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName1}, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName2}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath1)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath2)
+	assert.NoError(t, err)
+}
+
+func TestQuotaTrackingDisabledForUser(t *testing.T) {
+	u := getTestUser()
+	u.QuotaFiles = 1
+	u.QuotaSize = 100
+	u.Filters.DisableQuotaTracking = true
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		// the quota limits are not enforced
+		testFileSize := int64(131072)
+		err = writeSFTPFile(testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = writeSFTPFile(testFileName+"1", testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename(testFileName+"1", testFileName+"2")
+		assert.NoError(t, err)
+		err = client.Remove(testFileName)
+		assert.NoError(t, err)
+	}
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, user.UsedQuotaFiles)
+	assert.Equal(t, int64(0), user.UsedQuotaSize)
+	assert.Equal(t, int64(0), user.LastQuotaUpdate)
+	assert.False(t, user.HasQuotaRestrictions())
+
+	_, err = httpdtest.StartQuotaScan(user, http.StatusForbidden)
+	assert.NoError(t, err)
+	user.UsedQuotaFiles = 10
+	_, err = httpdtest.UpdateQuotaUsage(user, "", http.StatusForbidden)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestVirtualFolderQuotaIndependentFromUser(t *testing.T) {
+	testFileSize := int64(131072)
+	u := getTestUser()
+	u.QuotaSize = 10 * testFileSize
+	mappedPath1 := filepath.Join(os.TempDir(), "vdir1")
+	vdirPath1 := "/vdir1"
+	folderName1 := filepath.Base(mappedPath1)
+	mappedPath2 := filepath.Join(os.TempDir(), "vdir2")
+	vdirPath2 := "/vdir2"
+	folderName2 := filepath.Base(mappedPath2)
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName1,
+			MappedPath: mappedPath1,
+		},
+		VirtualPath: vdirPath1,
+		// the folder has its own quota
+		QuotaFiles: 0,
+		QuotaSize:  testFileSize + 1,
+	})
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName2,
+			MappedPath: mappedPath2,
+		},
+		VirtualPath: vdirPath2,
+		// quota is included in the user's one
+		QuotaFiles: -1,
+		QuotaSize:  -1,
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = writeSFTPFile(path.Join(vdirPath1, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		// the folder is full while the user's home has free quota
+		err = writeSFTPFile(path.Join(vdirPath1, testFileName+"1"), testFileSize, client)
+		assert.Error(t, err)
+		_, err = client.Stat(path.Join(vdirPath1, testFileName+"1"))
+		assert.Error(t, err)
+		err = writeSFTPFile(path.Join(vdirPath1, "sub", testFileName), testFileSize, client)
+		assert.Error(t, err)
+		// uploads outside the full folder are allowed
+		err = writeSFTPFile(testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = writeSFTPFile(path.Join(vdirPath2, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, 2*testFileSize, user.UsedQuotaSize)
+		f, _, err := httpdtest.GetFolderByName(folderName1, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, testFileSize, f.UsedQuotaSize)
+		assert.Equal(t, 1, f.UsedQuotaFiles)
+		// free some space inside the folder, the upload is now allowed
+		err = client.Remove(path.Join(vdirPath1, testFileName))
+		assert.NoError(t, err)
+		err = writeSFTPFile(path.Join(vdirPath1, testFileName+"1"), testFileSize, client)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName1}, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName2}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath1)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath2)
+	assert.NoError(t, err)
+}
+
+func TestCloseUserConnections(t *testing.T) {
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	u := getTestUser()
+	u.Username += "_1"
+	u.HomeDir += "_1"
+	user1, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+
+	var clients []*sftp.Client
+	for i := 0; i < 3; i++ {
+		conn, client, err := getSftpClient(user)
+		if assert.NoError(t, err) {
+			defer conn.Close()
+			defer client.Close()
+			clients = append(clients, client)
+		}
+	}
+	conn1, client1, err := getSftpClient(user1)
+	if assert.NoError(t, err) {
+		defer conn1.Close()
+		defer client1.Close()
+	}
+	require.Len(t, clients, 3)
+	assert.Eventually(t, func() bool {
+		return len(common.Connections.GetUserStats(user.Username)) == 3
+	}, 1*time.Second, 50*time.Millisecond)
+	// start an upload and leave it in progress
+	f, err := clients[0].Create(testFileName)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("test data"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		stats := common.Connections.GetUserStats(user.Username)
+		for _, stat := range stats {
+			if len(stat.Transfers) > 0 {
+				return true
+			}
+		}
+		return false
+	}, 1*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, 3, common.Connections.CloseUserConnections(user.Username))
+	assert.Eventually(t, func() bool {
+		return len(common.Connections.GetUserStats(user.Username)) == 0
+	}, 1*time.Second, 50*time.Millisecond)
+	_, err = f.Write([]byte("more data"))
+	assert.Error(t, err)
+	for _, client := range clients {
+		_, err = client.Getwd()
+		assert.Error(t, err)
+	}
+	// the other user is not affected
+	assert.Len(t, common.Connections.GetUserStats(user1.Username), 1)
+	_, err = client1.Getwd()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, common.Connections.CloseUserConnections(user.Username))
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user1, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user1.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestSingleSessionPolicy(t *testing.T) {
+	u := getTestUser()
+	u.Filters.SingleSessionPolicy = sdk.SingleSessionRefuse
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+		assert.Eventually(t, func() bool {
+			return len(common.Connections.GetUserStats(user.Username)) == 1
+		}, 1*time.Second, 50*time.Millisecond)
+		// a second SSH session is refused
+		_, _, err = getSftpClient(user)
+		assert.Error(t, err)
+		// opening more channels using the same SSH connection is allowed
+		client2, err := sftp.NewClient(conn)
+		if assert.NoError(t, err) {
+			_, err = client2.Getwd()
+			assert.NoError(t, err)
+			client2.Close()
+		}
+		_, err = client.Getwd()
+		assert.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		return len(common.Connections.GetUserStats(user.Username)) == 1
+	}, 1*time.Second, 50*time.Millisecond)
+
+	user.Filters.SingleSessionPolicy = sdk.SingleSessionEvict
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	conn1, client1, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn1.Close()
+		defer client1.Close()
+		assert.Eventually(t, func() bool {
+			return len(common.Connections.GetUserStats(user.Username)) == 1
+		}, 1*time.Second, 50*time.Millisecond)
+		// a refused login does not evict the existing session
+		wrongUser := user
+		wrongUser.Password = defaultPassword + "_wrong"
+		_, _, err = getSftpClient(wrongUser)
+		assert.Error(t, err)
+		_, err = client1.Getwd()
+		assert.NoError(t, err)
+		// the new session evicts the existing one
+		conn2, client2, err := getSftpClient(user)
+		if assert.NoError(t, err) {
+			defer conn2.Close()
+			defer client2.Close()
+			_, err = client2.Getwd()
+			assert.NoError(t, err)
+			_, err = client1.Getwd()
+			assert.Error(t, err)
+			assert.Eventually(t, func() bool {
+				return len(common.Connections.GetUserStats(user.Username)) == 1
+			}, 1*time.Second, 50*time.Millisecond)
+		}
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestHomeSkeleton(t *testing.T) {
+	u := getTestUser()
+	mappedPath := filepath.Join(os.TempDir(), "vdir_skeleton")
+	folderName := filepath.Base(mappedPath)
+	vdirPath := "/vdir"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+		},
+		VirtualPath: vdirPath,
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	u.Filters.HomeSkeleton = []string{"/inbox", "/outbox/sub", "/vdir/archive"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		for _, dir := range []string{"/inbox", "/outbox/sub", "/vdir/archive"} {
+			info, err := client.Stat(dir)
+			if assert.NoError(t, err, dir) {
+				assert.True(t, info.IsDir())
+			}
+		}
+		assert.DirExists(t, filepath.Join(mappedPath, "archive"))
+		err = client.RemoveDirectory("/inbox")
+		assert.NoError(t, err)
+		client.Close()
+		conn.Close()
+	}
+	// the skeleton is created only on the first login
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		_, err = client.Stat("/inbox")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = client.Stat("/outbox/sub")
+		assert.NoError(t, err)
+		client.Close()
+		conn.Close()
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+}
+
+func TestVirtualFolderReadReplicas(t *testing.T) {
+	u := getTestUser()
+	mappedPath := filepath.Join(os.TempDir(), "vdir_primary")
+	replicaPath := filepath.Join(os.TempDir(), "vdir_replica")
+	unavailablePath := mappedPath + "_down"
+	folderName := filepath.Base(mappedPath)
+	vdirPath := "/vdir"
+	content := []byte("replicated content")
+	for _, p := range []string{mappedPath, replicaPath} {
+		err := os.MkdirAll(p, os.ModePerm)
+		assert.NoError(t, err)
+		err = os.WriteFile(filepath.Join(p, testFileName), content, os.ModePerm)
+		assert.NoError(t, err)
+	}
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+			FsConfig: vfs.Filesystem{
+				Provider: sdk.LocalFilesystemProvider,
+				OSConfig: vfs.OSFsConfig{
+					ReadReplicas: []string{filepath.Join(os.TempDir(), "missing_replica"), replicaPath},
+				},
+			},
+		},
+		VirtualPath: vdirPath,
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		// the primary is available, writes are allowed
+		err = writeSFTPFile(path.Join(vdirPath, testFileName+"1"), 100, client)
+		assert.NoError(t, err)
+		assert.FileExists(t, filepath.Join(mappedPath, testFileName+"1"))
+		assert.NoFileExists(t, filepath.Join(replicaPath, testFileName+"1"))
+		client.Close()
+		conn.Close()
+	}
+	// simulate a primary outage
+	err = os.Rename(mappedPath, unavailablePath)
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		f, err := client.Open(path.Join(vdirPath, testFileName))
+		if assert.NoError(t, err) {
+			data, err := io.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+			err = f.Close()
+			assert.NoError(t, err)
+		}
+		entries, err := client.ReadDir(vdirPath)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		// writes are denied
+		err = writeSFTPFile(path.Join(vdirPath, testFileName+"2"), 100, client)
+		assert.Error(t, err)
+		err = client.Mkdir(path.Join(vdirPath, "subdir"))
+		assert.Error(t, err)
+		err = client.Remove(path.Join(vdirPath, testFileName))
+		assert.Error(t, err)
+		// the user's home is not affected
+		err = writeSFTPFile(testFileName, 100, client)
+		assert.NoError(t, err)
+		client.Close()
+		conn.Close()
+	}
+	assert.NoDirExists(t, mappedPath)
+	assert.NoFileExists(t, filepath.Join(replicaPath, testFileName+"2"))
+	// the primary is available again
+	err = os.Rename(unavailablePath, mappedPath)
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		entries, err := client.ReadDir(vdirPath)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		err = writeSFTPFile(path.Join(vdirPath, testFileName+"2"), 100, client)
+		assert.NoError(t, err)
+		client.Close()
+		conn.Close()
+	}
+	// read replicas are not supported for users and must differ from the mapped path
+	u = getTestUser()
+	u.Username += "_replicas"
+	u.FsConfig.OSConfig.ReadReplicas = []string{replicaPath}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.AddFolder(vfs.BaseVirtualFolder{
+		Name:       folderName + "1",
+		MappedPath: mappedPath,
+		FsConfig: vfs.Filesystem{
+			OSConfig: vfs.OSFsConfig{
+				ReadReplicas: []string{mappedPath},
+			},
+		},
+	}, http.StatusBadRequest)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.AddFolder(vfs.BaseVirtualFolder{
+		Name:       folderName + "1",
+		MappedPath: mappedPath,
+		FsConfig: vfs.Filesystem{
+			OSConfig: vfs.OSFsConfig{
+				ReadReplicas: []string{"relative"},
+			},
+		},
+	}, http.StatusBadRequest)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(replicaPath)
+	assert.NoError(t, err)
+}
+
 func TestQuotaRenameInsideSameVirtualFolder(t *testing.T) {
 	u := getTestUser()
 	u.QuotaFiles = 100
@@ -1976,6 +2505,148 @@ func TestResolvePathError(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestGetUsersByUsernames(t *testing.T) {
+	var users []dataprovider.User
+	var usernames []string
+	for i := 0; i < 22; i++ {
+		u := getTestUser()
+		u.Username = fmt.Sprintf("%v_batch_%02d", defaultUsername, i)
+		u.HomeDir = filepath.Join(homeBasePath, u.Username)
+		user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+		assert.NoError(t, err)
+		users = append(users, user)
+		usernames = append(usernames, user.Username, user.Username+"_missing")
+	}
+	usernames = append(usernames, users[0].Username)
+
+	result, err := dataprovider.GetUsersByUsernames(usernames)
+	assert.NoError(t, err)
+	if assert.Len(t, result, len(users)) {
+		for _, user := range users {
+			if assert.Contains(t, result, user.Username) {
+				assert.Equal(t, user.ID, result[user.Username].ID)
+				assert.Equal(t, user.HomeDir, result[user.Username].HomeDir)
+			}
+			assert.NotContains(t, result, user.Username+"_missing")
+		}
+	}
+
+	result, err = dataprovider.GetUsersByUsernames([]string{"missing_user"})
+	assert.NoError(t, err)
+	assert.Len(t, result, 0)
+	result, err = dataprovider.GetUsersByUsernames(nil)
+	assert.NoError(t, err)
+	assert.Len(t, result, 0)
+
+	for _, user := range users {
+		_, err = httpdtest.RemoveUser(user, http.StatusOK)
+		assert.NoError(t, err)
+	}
+}
+
+func TestCountEntities(t *testing.T) {
+	getCounts := func() map[string]int64 {
+		counts := make(map[string]int64)
+		for name, filter := range map[string]dataprovider.CountFilter{
+			"users":          dataprovider.CountAll,
+			"active_users":   dataprovider.CountActive,
+			"disabled_users": dataprovider.CountDisabled,
+			"expired_users":  dataprovider.CountExpired,
+		} {
+			count, err := dataprovider.CountUsers(filter)
+			assert.NoError(t, err)
+			counts[name] = count
+		}
+		for name, filter := range map[string]dataprovider.CountFilter{
+			"admins":          dataprovider.CountAll,
+			"active_admins":   dataprovider.CountActive,
+			"disabled_admins": dataprovider.CountDisabled,
+		} {
+			count, err := dataprovider.CountAdmins(filter)
+			assert.NoError(t, err)
+			counts[name] = count
+		}
+		for name, filter := range map[string]dataprovider.CountFilter{
+			"folders":          dataprovider.CountAll,
+			"orphaned_folders": dataprovider.CountOrphaned,
+		} {
+			count, err := dataprovider.CountFolders(filter)
+			assert.NoError(t, err)
+			counts[name] = count
+		}
+		return counts
+	}
+	initialCounts := getCounts()
+	assert.Greater(t, initialCounts["active_admins"], int64(0))
+	// admins are either active or disabled
+	assert.Equal(t, initialCounts["admins"]-initialCounts["active_admins"], initialCounts["disabled_admins"])
+
+	mappedPath := filepath.Join(os.TempDir(), "count_vdir")
+	folderName := filepath.Base(mappedPath)
+	u := getTestUser()
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+		},
+		VirtualPath: "/vdir",
+	})
+	activeUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.Username += "_disabled"
+	u.Status = 0
+	disabledUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u = getTestUser()
+	u.Username += "_expired"
+	u.ExpirationDate = util.GetTimeAsMsSinceEpoch(time.Now().Add(-24 * time.Hour))
+	expiredUser, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	orphanedFolder, _, err := httpdtest.AddFolder(vfs.BaseVirtualFolder{
+		Name:       "count_orphaned",
+		MappedPath: filepath.Join(os.TempDir(), "count_orphaned"),
+	}, http.StatusCreated)
+	assert.NoError(t, err)
+	admin, _, err := httpdtest.AddAdmin(dataprovider.Admin{
+		Username:    "count_admin",
+		Password:    defaultPassword,
+		Status:      0,
+		Permissions: []string{dataprovider.PermAdminAny},
+	}, http.StatusCreated)
+	assert.NoError(t, err)
+
+	counts := getCounts()
+	assert.Equal(t, initialCounts["users"]+3, counts["users"])
+	assert.Equal(t, initialCounts["active_users"]+1, counts["active_users"])
+	assert.Equal(t, initialCounts["disabled_users"]+1, counts["disabled_users"])
+	assert.Equal(t, initialCounts["expired_users"]+1, counts["expired_users"])
+	assert.Equal(t, initialCounts["admins"]+1, counts["admins"])
+	assert.Equal(t, initialCounts["active_admins"], counts["active_admins"])
+	assert.Equal(t, initialCounts["disabled_admins"]+1, counts["disabled_admins"])
+	assert.Equal(t, initialCounts["folders"]+2, counts["folders"])
+	assert.Equal(t, initialCounts["orphaned_folders"]+1, counts["orphaned_folders"])
+
+	_, err = dataprovider.CountUsers(dataprovider.CountOrphaned)
+	assert.Error(t, err)
+	_, err = dataprovider.CountAdmins(dataprovider.CountExpired)
+	assert.Error(t, err)
+	_, err = dataprovider.CountFolders(dataprovider.CountActive)
+	assert.Error(t, err)
+
+	for _, user := range []dataprovider.User{activeUser, disabledUser, expiredUser} {
+		_, err = httpdtest.RemoveUser(user, http.StatusOK)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(orphanedFolder, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveAdmin(admin, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, initialCounts, getCounts())
+}
+
 func TestUserPasswordHashing(t *testing.T) {
 	if config.GetProviderConf().Driver == dataprovider.MemoryDataProviderName {
 		t.Skip("this test is not supported with the memory provider")
@@ -2188,6 +2859,293 @@ func TestPasswordCaching(t *testing.T) {
 	assert.False(t, match)
 }
 
+func TestUsersExpiration(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	hookPath := filepath.Join(os.TempDir(), "expiration_hook.sh")
+	hookOutput := filepath.Join(os.TempDir(), "expiration_hook.out")
+	err := os.WriteFile(hookPath, getExpirationHookScriptContent(hookOutput), 0755)
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.UsersExpiration.WarningDays = -1
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	providerConf.UsersExpiration.WarningDays = 3
+	providerConf.UsersExpiration.DisableExpired = true
+	providerConf.UsersExpiration.Hook = "relative_hook.sh"
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	providerConf.UsersExpiration.Hook = hookPath
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	u := getTestUser()
+	u.Username = "expiring_before_window"
+	u.ExpirationDate = util.GetTimeAsMsSinceEpoch(now.Add(30 * 24 * time.Hour))
+	userBefore, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u.Username = "expiring_within_window"
+	u.ExpirationDate = util.GetTimeAsMsSinceEpoch(now.Add(24 * time.Hour))
+	userWithin, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u.Username = "expired_user"
+	u.ExpirationDate = util.GetTimeAsMsSinceEpoch(now.Add(-24 * time.Hour))
+	userExpired, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	u.Username = "not_expiring"
+	u.ExpirationDate = 0
+	userNotExpiring, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+
+	err = dataprovider.CheckUsersExpiration()
+	assert.NoError(t, err)
+	actions := readExpirationHookOutput(t, hookOutput)
+	assert.Len(t, actions, 2)
+	assert.Equal(t, "expiration_warning", actions[userWithin.Username])
+	assert.Equal(t, "expiration_disable", actions[userExpired.Username])
+
+	user, _, err := httpdtest.GetUserByUsername(userBefore.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, user.Status)
+	user, _, err = httpdtest.GetUserByUsername(userWithin.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, user.Status)
+	user, _, err = httpdtest.GetUserByUsername(userExpired.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, user.Status)
+	user, _, err = httpdtest.GetUserByUsername(userNotExpiring.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, user.Status)
+	// the disabled user is not notified again, the warning is repeated at each check
+	err = os.Remove(hookOutput)
+	assert.NoError(t, err)
+	err = dataprovider.CheckUsersExpiration()
+	assert.NoError(t, err)
+	actions = readExpirationHookOutput(t, hookOutput)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, "expiration_warning", actions[userWithin.Username])
+
+	for _, username := range []string{userBefore.Username, userWithin.Username, userExpired.Username,
+		userNotExpiring.Username} {
+		_, err = httpdtest.RemoveUser(dataprovider.User{BaseUser: sdk.BaseUser{Username: username}}, http.StatusOK)
+		assert.NoError(t, err)
+	}
+	err = os.RemoveAll(userBefore.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.Remove(hookOutput)
+	assert.NoError(t, err)
+	err = os.Remove(hookPath)
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+}
+
+func TestCloneUser(t *testing.T) {
+	mappedPath := filepath.Join(os.TempDir(), "vdir_clone")
+	folderName := filepath.Base(mappedPath)
+	u := getCryptFsUser()
+	u.Description = "source user"
+	u.QuotaSize = 1024 * 1024
+	u.PublicKeys = []string{
+		"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC03jj0D+djk7pxIf/0OhrxrchJTRZklofJ1NoIu4752Sq02mdXmarMVsqJ1cAjV5LBVy3D1F5U6XW4rppkXeVtd04Pxb09ehtH0pRRPaoHHlALiJt8CoMpbKYMA8b3KXPPriGxgGomvtU2T2RMURSwOZbMtpsugfjYSWenyYX+VORYhylWnSXL961LTyC21ehd6d6QnW9G7E5hYMITMY9TuQZz3bROYzXiTsgN0+g6Hn7exFQp50p45StUMfV/SftCMdCxlxuyGny2CrN/vfjO7xxOo2uv7q1qm10Q46KPWJQv+pgZ/OfL+EDjy07n5QVSKHlbx+2nT4Q0EgOSQaCTYwn3YjtABfIxWwgAFdyj6YlPulCL22qU4MYhDcA6PSBwDdf8hvxBfvsiHdM+JcSHvv8/VeJhk6CmnZxGY0fxBupov27z3yEO8nAg8k+6PaUiW1MSUfuGMF/ktB8LOstXsEPXSszuyXiOv4DaryOXUiSn7bmRqKcEFlJusO6aZP0= nicola@p1",
+	}
+	u.Permissions["/sub"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	u.Filters.DeniedProtocols = []string{common.ProtocolFTP}
+	u.Filters.MaxUploadFileSize = 4096
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+		},
+		VirtualPath: "/vdir",
+		QuotaSize:   -1,
+		QuotaFiles:  -1,
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	err = dataprovider.UpdateUserQuota(&user, 2, 100, true)
+	assert.NoError(t, err)
+	err = dataprovider.UpdateLastLogin(&user)
+	assert.NoError(t, err)
+
+	cloneUsername := user.Username + "_clone"
+	clone, err := dataprovider.CloneUser(user.Username, cloneUsername, func(u *dataprovider.User) {
+		u.Password = defaultPassword + "_clone"
+		u.Description = "cloned user"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, cloneUsername, clone.Username)
+	assert.NotEqual(t, user.ID, clone.ID)
+	assert.Equal(t, filepath.Join(filepath.Dir(user.HomeDir), cloneUsername), clone.HomeDir)
+	assert.Equal(t, "cloned user", clone.Description)
+	assert.Len(t, clone.PublicKeys, 0)
+	assert.Equal(t, user.QuotaSize, clone.QuotaSize)
+	assert.Equal(t, 0, clone.UsedQuotaFiles)
+	assert.Equal(t, int64(0), clone.UsedQuotaSize)
+	assert.Equal(t, int64(0), clone.LastLogin)
+	assert.Equal(t, user.Permissions, clone.Permissions)
+	assert.Equal(t, user.Filters.DeniedProtocols, clone.Filters.DeniedProtocols)
+	assert.Equal(t, user.Filters.MaxUploadFileSize, clone.Filters.MaxUploadFileSize)
+	if assert.Len(t, clone.VirtualFolders, 1) {
+		assert.Equal(t, folderName, clone.VirtualFolders[0].Name)
+		assert.Equal(t, "/vdir", clone.VirtualFolders[0].VirtualPath)
+	}
+	// the passphrase is encrypted again using the new username
+	assert.Equal(t, sdk.CryptedFilesystemProvider, clone.FsConfig.Provider)
+	assert.True(t, clone.FsConfig.CryptConfig.Passphrase.IsEncrypted())
+	assert.Equal(t, cloneUsername, clone.FsConfig.CryptConfig.Passphrase.GetAdditionalData())
+	err = clone.FsConfig.CryptConfig.Passphrase.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPassword, clone.FsConfig.CryptConfig.Passphrase.GetPayload())
+	// the source user is unchanged
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, "source user", user.Description)
+	assert.Equal(t, 2, user.UsedQuotaFiles)
+	assert.Len(t, user.PublicKeys, 1)
+	// the stored password is hashed, login using the plain text one
+	clone.Password = defaultPassword + "_clone"
+	conn, client, err := getSftpClient(clone)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = writeSFTPFile(testFileName, 2048, client)
+		assert.NoError(t, err)
+	}
+	_, err = os.Stat(filepath.Join(clone.HomeDir, testFileName))
+	assert.NoError(t, err)
+
+	// the new username must not exist
+	_, err = dataprovider.CloneUser(user.Username, cloneUsername)
+	assert.Error(t, err)
+	_, err = dataprovider.CloneUser("missing_source", cloneUsername+"1")
+	assert.Error(t, err)
+	// no credentials for the clone
+	_, err = dataprovider.CloneUser(user.Username, cloneUsername+"1")
+	assert.Error(t, err)
+	_, err = dataprovider.UserExists(cloneUsername + "1")
+	assert.Error(t, err)
+
+	for _, u := range []dataprovider.User{user, clone} {
+		_, err = httpdtest.RemoveUser(u, http.StatusOK)
+		assert.NoError(t, err)
+		err = os.RemoveAll(u.GetHomeDir())
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+}
+
+func TestQuotaDriftCheck(t *testing.T) {
+	quotaDriftConfig := common.Config.QuotaDrift
+	mappedPath := filepath.Join(os.TempDir(), "vdir_drift")
+	folderName := filepath.Base(mappedPath)
+	u := getTestUser()
+	u.QuotaFiles = 100
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+		},
+		VirtualPath: "/vdir",
+		QuotaSize:   0,
+		QuotaFiles:  0,
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	err = os.MkdirAll(user.GetHomeDir(), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(user.GetHomeDir(), testFileName), []byte("test data"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(mappedPath, os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(mappedPath, testFileName), []byte("folder data"), os.ModePerm)
+	assert.NoError(t, err)
+	// the stored quota drifted from the real usage
+	err = dataprovider.UpdateUserQuota(&user, 10, 1000, true)
+	assert.NoError(t, err)
+	folder := vfs.BaseVirtualFolder{Name: folderName}
+	err = dataprovider.UpdateVirtualFolderQuota(&folder, 20, 2000, true)
+	assert.NoError(t, err)
+
+	common.Config.QuotaDrift = common.QuotaDriftConfig{
+		BatchSize:      100,
+		FilesThreshold: 0,
+		SizeThreshold:  0,
+		AutoCorrect:    false,
+	}
+	// drifts are detected but not corrected
+	err = common.CheckQuotaDrift()
+	assert.NoError(t, err)
+	usedFiles, usedSize, err := dataprovider.GetUsedQuota(user.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, usedFiles)
+	assert.Equal(t, int64(1000), usedSize)
+	usedFiles, usedSize, err = dataprovider.GetUsedVirtualFolderQuota(folderName)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, usedFiles)
+	assert.Equal(t, int64(2000), usedSize)
+	// drifts below the thresholds are ignored
+	common.Config.QuotaDrift.FilesThreshold = 50
+	common.Config.QuotaDrift.SizeThreshold = 5000
+	common.Config.QuotaDrift.AutoCorrect = true
+	err = common.CheckQuotaDrift()
+	assert.NoError(t, err)
+	usedFiles, usedSize, err = dataprovider.GetUsedQuota(user.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, usedFiles)
+	assert.Equal(t, int64(1000), usedSize)
+	// now the drifts are fixed
+	common.Config.QuotaDrift.FilesThreshold = 0
+	common.Config.QuotaDrift.SizeThreshold = 0
+	err = common.CheckQuotaDrift()
+	assert.NoError(t, err)
+	usedFiles, usedSize, err = dataprovider.GetUsedQuota(user.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usedFiles)
+	assert.Equal(t, int64(len("test data")), usedSize)
+	usedFiles, usedSize, err = dataprovider.GetUsedVirtualFolderQuota(folderName)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usedFiles)
+	assert.Equal(t, int64(len("folder data")), usedSize)
+	// a user with a scan in progress is skipped
+	err = dataprovider.UpdateUserQuota(&user, 10, 1000, true)
+	assert.NoError(t, err)
+	assert.True(t, common.QuotaScans.AddUserQuotaScan(user.Username))
+	err = common.CheckQuotaDrift()
+	assert.NoError(t, err)
+	usedFiles, _, err = dataprovider.GetUsedQuota(user.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, usedFiles)
+	assert.True(t, common.QuotaScans.RemoveUserQuotaScan(user.Username))
+
+	common.Config.QuotaDrift = quotaDriftConfig
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(folder, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+}
+
 func TestSyncUploadAction(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -2313,6 +3271,344 @@ func TestGetQuotaError(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUploadCollisionPolicy(t *testing.T) {
+	u := getTestUser()
+	u.Filters.UploadCollisionPolicy = sdk.UploadCollisionReject
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = writeSFTPFile(testFileName, 100, client)
+		assert.NoError(t, err)
+		err = writeSFTPFile(testFileName, 200, client)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(100), info.Size())
+		}
+	}
+
+	user.Filters.UploadCollisionPolicy = sdk.UploadCollisionAutoSuffix
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		ext := path.Ext(testFileName)
+		base := strings.TrimSuffix(testFileName, ext)
+		for i := 1; i <= 3; i++ {
+			err = writeSFTPFileNoCheck(testFileName, int64(100+i), client)
+			assert.NoError(t, err)
+			info, err := client.Stat(fmt.Sprintf("%v(%v)%v", base, i, ext))
+			if assert.NoError(t, err) {
+				assert.Equal(t, int64(100+i), info.Size())
+			}
+		}
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(100), info.Size())
+		}
+		// resumed uploads continue on the existing file
+		f, err := client.OpenFile(testFileName, os.O_WRONLY|os.O_APPEND)
+		if assert.NoError(t, err) {
+			_, err = f.WriteAt([]byte("appended"), 100)
+			assert.NoError(t, err)
+			err = f.Close()
+			assert.NoError(t, err)
+		}
+		info, err = client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(108), info.Size())
+		}
+		// uploading to a suffixed name that already exists generates a new suffix
+		err = writeSFTPFileNoCheck(fmt.Sprintf("%v(1)%v", base, ext), 10, client)
+		assert.NoError(t, err)
+		_, err = client.Stat(fmt.Sprintf("%v(1)(1)%v", base, ext))
+		assert.NoError(t, err)
+	}
+
+	user.Filters.UploadCollisionPolicy = sdk.UploadCollisionOverwrite
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		err = writeSFTPFile(testFileName, 50, client)
+		assert.NoError(t, err)
+		entries, err := client.ReadDir("/")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 5)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestHiddenPatterns(t *testing.T) {
+	u := getTestUser()
+	u.Filters.HiddenPatterns = []string{".*", "Snapshot"}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), ".snapshot"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "visible"), os.ModePerm)
+	assert.NoError(t, err)
+	for _, name := range []string{".DS_Store", filepath.Join(".snapshot", "file"), filepath.Join("visible", "file"),
+		filepath.Join("visible", ".hidden")} {
+		err = os.WriteFile(filepath.Join(user.GetHomeDir(), name), []byte("content"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		entries, err := client.ReadDir("/")
+		if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+			assert.Equal(t, "visible", entries[0].Name())
+		}
+		entries, err = client.ReadDir("/visible")
+		if assert.NoError(t, err) && assert.Len(t, entries, 1) {
+			assert.Equal(t, "file", entries[0].Name())
+		}
+		for _, name := range []string{".DS_Store", ".snapshot", "/.snapshot/file", "/visible/.hidden"} {
+			_, err = client.Stat(name)
+			assert.ErrorIs(t, err, os.ErrNotExist, name)
+		}
+		_, err = client.ReadDir("/.snapshot")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = client.Open("/.snapshot/file")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		err = client.Rename("/visible/file", "/visible/.file")
+		assert.Error(t, err)
+		err = client.Remove("/.DS_Store")
+		assert.Error(t, err)
+		err = writeSFTPFile("/.newfile", 100, client)
+		assert.Error(t, err)
+		err = writeSFTPFile("/visible/newfile", 100, client)
+		assert.NoError(t, err)
+	}
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), ".DS_Store"))
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), "visible", "file"))
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), ".newfile"))
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestQuotaScanExcludes(t *testing.T) {
+	u := getTestUser()
+	mappedPath := filepath.Join(os.TempDir(), "vdir_scan_excludes")
+	folderName := filepath.Base(mappedPath)
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+		},
+		VirtualPath: "/vdir",
+		QuotaFiles:  -1,
+		QuotaSize:   -1,
+	})
+	u.Filters.QuotaScanExcludes = []string{"[a-"}
+	_, _, err := httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.QuotaScanExcludes = []string{"sub/tmp"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.QuotaScanExcludes = []string{"/"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.QuotaScanExcludes = []string{" /cache/ ", "tmp", "/vdir/*.log", ""}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/cache", "tmp", "/vdir/*.log"}, user.Filters.QuotaScanExcludes)
+
+	files := map[string]int{
+		filepath.Join(user.GetHomeDir(), "file"):                 10,
+		filepath.Join(user.GetHomeDir(), "cache", "file"):        100,
+		filepath.Join(user.GetHomeDir(), "cache", "sub", "file"): 100,
+		filepath.Join(user.GetHomeDir(), "sub", "cache", "file"): 20,
+		filepath.Join(user.GetHomeDir(), "sub", "tmp", "file"):   100,
+		filepath.Join(mappedPath, "file"):                        30,
+		filepath.Join(mappedPath, "tmp"):                         100,
+		filepath.Join(mappedPath, "app.log"):                     100,
+		filepath.Join(mappedPath, "logs", "app.log"):             40,
+	}
+	for name, size := range files {
+		err = os.MkdirAll(filepath.Dir(name), os.ModePerm)
+		assert.NoError(t, err)
+		err = os.WriteFile(name, make([]byte, size), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	assert.True(t, user.IsExcludedFromQuotaScan("/cache/sub"))
+	assert.False(t, user.IsExcludedFromQuotaScan("/sub/cache"))
+	assert.True(t, user.IsExcludedFromQuotaScan("/sub/tmp/file"))
+	assert.False(t, user.IsExcludedFromQuotaScan("/vdir/logs/app.log"))
+
+	numFiles, size, err := user.ScanQuota()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(100), size)
+	// without excludes all the files are counted
+	user.Filters.QuotaScanExcludes = nil
+	numFiles, size, err = user.ScanQuota()
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), numFiles)
+	assert.Equal(t, int64(600), size)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+}
+
+func TestQuotaScanWithActiveUploads(t *testing.T) {
+	common.Config.QuotaScanTransfersGrace = 10
+	defer func() {
+		common.Config.QuotaScanTransfersGrace = 0
+	}()
+
+	u := getTestUser()
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	conn, client, err := getSftpClient(user)
+	if assert.NoError(t, err) {
+		defer conn.Close()
+		defer client.Close()
+
+		data := make([]byte, 1024)
+		f, err := client.Create(testFileName)
+		assert.NoError(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		// the scan must wait for the upload to complete
+		time.Sleep(300 * time.Millisecond)
+		assert.Len(t, common.QuotaScans.GetUsersQuotaScans(), 1)
+		// new uploads are refused while the scan waits
+		_, err = client.Create(testFileName + "_blocked")
+		assert.Error(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+		err = f.Close()
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return len(common.QuotaScans.GetUsersQuotaScans()) == 0
+		}, 2*time.Second, 50*time.Millisecond)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, int64(2048), user.UsedQuotaSize)
+		// the scan fails if the upload does not complete within the grace period
+		common.Config.QuotaScanTransfersGrace = 1
+		f, err = client.Create(testFileName + "1")
+		assert.NoError(t, err)
+		_, err = f.Write(data)
+		assert.NoError(t, err)
+		_, err = httpdtest.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return len(common.QuotaScans.GetUsersQuotaScans()) == 0
+		}, 3*time.Second, 50*time.Millisecond)
+		err = f.Close()
+		assert.NoError(t, err)
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, user.UsedQuotaFiles)
+		assert.Equal(t, int64(3072), user.UsedQuotaSize)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestCanRename(t *testing.T) {
+	u := getTestUser()
+	mappedPath := filepath.Join(os.TempDir(), "vdir_can_rename")
+	folderName := filepath.Base(mappedPath)
+	vdirPath := "/vdir"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: mappedPath,
+		},
+		VirtualPath: vdirPath,
+		QuotaFiles:  1,
+	})
+	u.Permissions["/ro"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "ro"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "dir"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(mappedPath, os.ModePerm)
+	assert.NoError(t, err)
+	for _, name := range []string{testFileName, path.Join("dir", "file1"), path.Join("dir", "file2")} {
+		err = os.WriteFile(filepath.Join(user.GetHomeDir(), name), []byte("data"), os.ModePerm)
+		assert.NoError(t, err)
+	}
+
+	conn := common.NewBaseConnection("connID", common.ProtocolSFTP, "", "", user)
+	res := conn.CanRename("/"+testFileName, "/renamed")
+	assert.True(t, res.Allowed)
+	assert.Empty(t, res.Reason)
+	assert.NoError(t, res.Err)
+	// the check must not move anything
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), testFileName))
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "renamed"))
+	res = conn.CanRename("/"+testFileName, path.Join(vdirPath, testFileName))
+	assert.True(t, res.Allowed)
+
+	res = conn.CanRename("/"+testFileName, path.Join("/ro", testFileName))
+	assert.False(t, res.Allowed)
+	assert.Equal(t, common.RenameDeniedPermission, res.Reason)
+	assert.ErrorIs(t, res.Err, sftp.ErrSSHFxPermissionDenied)
+	res = conn.CanRename("/dir", "/ro/dir")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, common.RenameDeniedPermission, res.Reason)
+	// the directory contains 2 files and the virtual folder allows 1 file
+	res = conn.CanRename("/dir", path.Join(vdirPath, "dir"))
+	assert.False(t, res.Allowed)
+	assert.Equal(t, common.RenameDeniedQuota, res.Reason)
+	assert.Contains(t, res.Err.Error(), common.ErrQuotaExceeded.Error())
+	res = conn.CanRename("/"+testFileName, "/dir")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, common.RenameDeniedUnsupported, res.Reason)
+	res = conn.CanRename("/missing", "/renamed")
+	assert.False(t, res.Allowed)
+	assert.Equal(t, common.RenameDeniedError, res.Reason)
+	assert.ErrorIs(t, res.Err, sftp.ErrSSHFxNoSuchFile)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPath)
+	assert.NoError(t, err)
+}
+
 func TestRenameDir(t *testing.T) {
 	u := getTestUser()
 	testDir := "/dir-to-rename"
@@ -2641,6 +3937,133 @@ func TestNonLocalCrossRenameNonLocalBaseUser(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRecursiveCopy(t *testing.T) {
+	u := getTestUser()
+	mappedPathCrypt := filepath.Join(os.TempDir(), "crypt")
+	folderNameCrypt := filepath.Base(mappedPathCrypt)
+	vdirCryptPath := "/vdir/crypt"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name: folderNameCrypt,
+			FsConfig: vfs.Filesystem{
+				Provider: sdk.CryptedFilesystemProvider,
+				CryptConfig: vfs.CryptFsConfig{
+					CryptFsConfig: sdk.CryptFsConfig{
+						Passphrase: kms.NewPlainSecret(defaultPassword),
+					},
+				},
+			},
+			MappedPath: mappedPathCrypt,
+		},
+		VirtualPath: vdirCryptPath,
+	})
+	u.QuotaFiles = 100
+	u.Filters.FilePatterns = []sdk.PatternsFilter{
+		{
+			Path:           "/src/sub1",
+			DeniedPatterns: []string{"*.deny"},
+		},
+	}
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	err = os.MkdirAll(mappedPathCrypt, os.ModePerm)
+	assert.NoError(t, err)
+	// nested source tree: /src/a.dat, /src/sub1/b.dat, /src/sub1/sub2/c.dat
+	files := []string{"/src/a.dat", "/src/sub1/b.dat", "/src/sub1/sub2/c.dat"}
+	var totalSize int64
+	for idx, f := range files {
+		p := filepath.Join(user.GetHomeDir(), filepath.FromSlash(f))
+		err = os.MkdirAll(filepath.Dir(p), os.ModePerm)
+		assert.NoError(t, err)
+		content := bytes.Repeat(testFileContent, idx+1)
+		err = os.WriteFile(p, content, os.ModePerm)
+		assert.NoError(t, err)
+		totalSize += int64(len(content))
+	}
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "src", "empty"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "vdir"), os.ModePerm)
+	assert.NoError(t, err)
+	// get the user with the encrypted secrets
+	user, err = dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	conn := common.NewBaseConnection("copyConnID", common.ProtocolSFTP, "", "", user)
+
+	err = conn.CopyDir("/src", "/dst")
+	assert.NoError(t, err)
+	for idx, f := range files {
+		data, err := os.ReadFile(filepath.Join(user.GetHomeDir(), filepath.FromSlash(strings.Replace(f, "/src", "/dst", 1))))
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat(testFileContent, idx+1), data)
+	}
+	assert.DirExists(t, filepath.Join(user.GetHomeDir(), "dst", "empty"))
+	assert.Len(t, conn.GetTransfers(), 0)
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), user.UsedQuotaFiles)
+	assert.Equal(t, totalSize, user.UsedQuotaSize)
+	// cross backend copy
+	err = conn.CopyDir("/src", path.Join(vdirCryptPath, "dst"))
+	assert.NoError(t, err)
+	for idx, f := range files {
+		info, err := conn.DoStat(path.Join(vdirCryptPath, strings.Replace(f, "/src", "/dst", 1)), 0)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(len(testFileContent)*(idx+1)), info.Size())
+		}
+	}
+	folder, _, err := httpdtest.GetFolderByName(folderNameCrypt, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), folder.UsedQuotaFiles)
+	assert.Equal(t, totalSize, folder.UsedQuotaSize)
+	// copying a directory inside itself is not supported
+	err = conn.CopyDir("/src", "/src/sub1/copy")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxOpUnsupported)
+	err = conn.CopyDir("/", "/copy")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxOpUnsupported)
+	// directories with virtual folders inside cannot be copied
+	err = conn.CopyDir("/vdir", "/vdir_copy")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxOpUnsupported)
+	err = conn.CopyDir("/missing", "/missing_copy")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxNoSuchFile)
+	// a denied file aborts the copy and the partial target is removed
+	err = os.WriteFile(filepath.Join(user.GetHomeDir(), "src", "sub1", "file.deny"), testFileContent, os.ModePerm)
+	assert.NoError(t, err)
+	err = conn.CopyDir("/src", "/dst_denied")
+	assert.ErrorIs(t, err, sftp.ErrSSHFxPermissionDenied)
+	assert.NoDirExists(t, filepath.Join(user.GetHomeDir(), "dst_denied"))
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), user.UsedQuotaFiles)
+	assert.Equal(t, totalSize, user.UsedQuotaSize)
+	err = os.Remove(filepath.Join(user.GetHomeDir(), "src", "sub1", "file.deny"))
+	assert.NoError(t, err)
+	// the quota limit is reached in the middle of the copy
+	user.QuotaFiles = len(files) + 1
+	// the folder passphrase is redacted in API responses
+	user.VirtualFolders[0].FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret(defaultPassword)
+	_, resp, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(resp))
+	user, err = dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	conn = common.NewBaseConnection("copyConnID", common.ProtocolSFTP, "", "", user)
+	err = conn.CopyDir("/src", "/dst_quota")
+	assert.True(t, conn.IsQuotaExceededError(err))
+	assert.NoDirExists(t, filepath.Join(user.GetHomeDir(), "dst_quota"))
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, len(files), user.UsedQuotaFiles)
+	assert.Equal(t, totalSize, user.UsedQuotaSize)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderNameCrypt}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(mappedPathCrypt)
+	assert.NoError(t, err)
+}
+
 func TestProxyProtocol(t *testing.T) {
 	resp, err := httpclient.Get(fmt.Sprintf("http://%v", httpProxyAddr))
 	if assert.NoError(t, err) {
@@ -2778,6 +4201,31 @@ func writeSFTPFileNoCheck(name string, size int64, client *sftp.Client) error {
 	return f.Close()
 }
 
+func getExpirationHookScriptContent(outputPath string) []byte {
+	content := []byte("#!/bin/sh\n\n")
+	content = append(content, []byte(fmt.Sprintf("echo \"${SFTPGO_USER_ACTION}\" >> %v\n", outputPath))...)
+	content = append(content, []byte(fmt.Sprintf("echo \"${SFTPGO_USER}\" >> %v\n", outputPath))...)
+	return content
+}
+
+// readExpirationHookOutput returns the notified actions by username
+func readExpirationHookOutput(t *testing.T, outputPath string) map[string]string {
+	actions := make(map[string]string)
+	content, err := os.ReadFile(outputPath)
+	if !assert.NoError(t, err) {
+		return actions
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Equal(t, 0, len(lines)%2)
+	for idx := 0; idx < len(lines); idx += 2 {
+		var user dataprovider.User
+		err = json.Unmarshal([]byte(lines[idx+1]), &user)
+		assert.NoError(t, err)
+		actions[user.Username] = lines[idx]
+	}
+	return actions
+}
+
 func getUploadScriptContent(movedPath string) []byte {
 	content := []byte("#!/bin/sh\n\n")
 	content = append(content, []byte("sleep 1\n")...)
@@ -0,0 +1,249 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/dataprovider"
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/metric"
+	"github.com/drakkan/sftpgo/v2/vfs"
+)
+
+var (
+	quotaDriftTicker     *time.Ticker
+	quotaDriftTickerDone chan bool
+	quotaDriftCheck      quotaDriftChecker
+	errQuotaDriftUploads = errors.New("uploads started during the scan")
+)
+
+// QuotaDriftConfig defines the periodic check to detect, and optionally fix, the
+// differences between the stored quota usage and the real one.
+// Drifts can happen, for example, after a crash or if the files are modified
+// without using SFTPGo
+type QuotaDriftConfig struct {
+	// Interval, in minutes, between two checks. 0 means disabled
+	CheckInterval int `json:"check_interval" mapstructure:"check_interval"`
+	// Maximum number of users, and of virtual folders, to scan at each check.
+	// Each check continues from where the previous one stopped, so the scans
+	// are spread over multiple checks
+	BatchSize int `json:"batch_size" mapstructure:"batch_size"`
+	// Differences in the number of files up to this value are ignored
+	FilesThreshold int `json:"files_threshold" mapstructure:"files_threshold"`
+	// Differences in the used size, as bytes, up to this value are ignored
+	SizeThreshold int64 `json:"size_threshold" mapstructure:"size_threshold"`
+	// If enabled the stored quota is replaced with the scanned one
+	AutoCorrect bool `json:"auto_correct" mapstructure:"auto_correct"`
+}
+
+func (c *QuotaDriftConfig) isEnabled() bool {
+	return c.CheckInterval > 0
+}
+
+func (c *QuotaDriftConfig) validate() error {
+	if c.BatchSize <= 0 {
+		return fmt.Errorf("invalid quota drift batch size: %v", c.BatchSize)
+	}
+	if c.FilesThreshold < 0 {
+		return fmt.Errorf("invalid quota drift files threshold: %v", c.FilesThreshold)
+	}
+	if c.SizeThreshold < 0 {
+		return fmt.Errorf("invalid quota drift size threshold: %v", c.SizeThreshold)
+	}
+	return nil
+}
+
+func (c *QuotaDriftConfig) isDrift(storedFiles, scannedFiles int, storedSize, scannedSize int64) bool {
+	filesDiff := storedFiles - scannedFiles
+	if filesDiff < 0 {
+		filesDiff = -filesDiff
+	}
+	sizeDiff := storedSize - scannedSize
+	if sizeDiff < 0 {
+		sizeDiff = -sizeDiff
+	}
+	return filesDiff > c.FilesThreshold || sizeDiff > c.SizeThreshold
+}
+
+// quotaDriftChecker keeps track of the position reached by the last check
+type quotaDriftChecker struct {
+	sync.Mutex
+	usersOffset   int
+	foldersOffset int
+}
+
+func startQuotaDriftTicker(duration time.Duration) {
+	stopQuotaDriftTicker()
+	quotaDriftTicker = time.NewTicker(duration)
+	quotaDriftTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-quotaDriftTickerDone:
+				return
+			case <-quotaDriftTicker.C:
+				if err := CheckQuotaDrift(); err != nil {
+					logger.Warn(logSender, "", "unable to check quota drift: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func stopQuotaDriftTicker() {
+	if quotaDriftTicker != nil {
+		quotaDriftTicker.Stop()
+		quotaDriftTickerDone <- true
+		quotaDriftTicker = nil
+	}
+}
+
+// CheckQuotaDrift scans the next batch of users and virtual folders and compares
+// the scanned quota usage with the stored one. The drifts over the configured
+// thresholds are logged and, if auto correction is enabled, fixed
+func CheckQuotaDrift() error {
+	if dataprovider.GetQuotaTracking() == 0 {
+		return nil
+	}
+	quotaDriftCheck.Lock()
+	defer quotaDriftCheck.Unlock()
+
+	batchSize := Config.QuotaDrift.BatchSize
+	users, err := dataprovider.GetUsers(batchSize, quotaDriftCheck.usersOffset, dataprovider.OrderASC)
+	if err != nil {
+		return err
+	}
+	quotaDriftCheck.usersOffset = getNextQuotaDriftOffset(quotaDriftCheck.usersOffset, len(users), batchSize)
+	for idx := range users {
+		checkUserQuotaDrift(users[idx].Username)
+	}
+	folders, err := dataprovider.GetFolders(batchSize, quotaDriftCheck.foldersOffset, dataprovider.OrderASC)
+	if err != nil {
+		return err
+	}
+	quotaDriftCheck.foldersOffset = getNextQuotaDriftOffset(quotaDriftCheck.foldersOffset, len(folders), batchSize)
+	for idx := range folders {
+		checkFolderQuotaDrift(folders[idx].Name)
+	}
+	return nil
+}
+
+// getNextQuotaDriftOffset returns the offset for the next check, we start again
+// from the beginning after the last batch
+func getNextQuotaDriftOffset(offset, scanned, batchSize int) int {
+	if scanned < batchSize {
+		return 0
+	}
+	return offset + scanned
+}
+
+func checkUserQuotaDrift(username string) {
+	if !QuotaScans.AddUserQuotaScan(username) {
+		logger.Debug(logSender, "", "quota drift check skipped for user %#v, another scan is in progress", username)
+		return
+	}
+	defer QuotaScans.RemoveUserQuotaScan(username)
+
+	user, err := dataprovider.UserExists(username)
+	if err != nil {
+		logger.Warn(logSender, "", "quota drift check, unable to get user %#v: %v", username, err)
+		return
+	}
+	if user.Filters.DisableQuotaTracking {
+		return
+	}
+	if dataprovider.GetQuotaTracking() == 2 && !user.HasQuotaRestrictions() {
+		return
+	}
+	// the uploads in progress are not yet included in the stored quota
+	if Connections.HasActiveUploads(username) {
+		logger.Debug(logSender, "", "quota drift check skipped for user %#v, uploads in progress", username)
+		return
+	}
+	numFiles, size, err := user.ScanQuota()
+	if err != nil {
+		logger.Warn(logSender, "", "quota drift check, unable to scan quota for user %#v: %v", username, err)
+		return
+	}
+	usedFiles, usedSize, err := dataprovider.GetUsedQuota(username)
+	if err != nil {
+		logger.Warn(logSender, "", "quota drift check, unable to get the used quota for user %#v: %v", username, err)
+		return
+	}
+	if !Config.QuotaDrift.isDrift(usedFiles, numFiles, usedSize, size) {
+		return
+	}
+	corrected := false
+	if Config.QuotaDrift.AutoCorrect {
+		// the uploads started during the scan reserved their quota, a reset would discard it
+		if Connections.HasActiveUploads(username) {
+			err = errQuotaDriftUploads
+		} else {
+			err = dataprovider.UpdateUserQuota(&user, numFiles, size, true)
+			corrected = err == nil
+		}
+	}
+	logger.Warn(logSender, "", "quota drift detected for user %#v, stored files: %v size: %v, scanned files: %v size: %v, corrected? %v err: %v",
+		username, usedFiles, usedSize, numFiles, size, corrected, err)
+	metric.QuotaDriftDetected(corrected)
+}
+
+func checkFolderQuotaDrift(name string) {
+	if !QuotaScans.AddVFolderQuotaScan(name) {
+		logger.Debug(logSender, "", "quota drift check skipped for folder %#v, another scan is in progress", name)
+		return
+	}
+	defer QuotaScans.RemoveVFolderQuotaScan(name)
+
+	folder, err := dataprovider.GetFolderByName(name)
+	if err != nil {
+		logger.Warn(logSender, "", "quota drift check, unable to get folder %#v: %v", name, err)
+		return
+	}
+	if hasFolderActiveUploads(&folder) {
+		logger.Debug(logSender, "", "quota drift check skipped for folder %#v, uploads in progress", name)
+		return
+	}
+	f := vfs.VirtualFolder{
+		BaseVirtualFolder: folder,
+		VirtualPath:       "/",
+	}
+	numFiles, size, err := f.ScanQuota()
+	if err != nil {
+		logger.Warn(logSender, "", "quota drift check, unable to scan folder %#v: %v", name, err)
+		return
+	}
+	usedFiles, usedSize, err := dataprovider.GetUsedVirtualFolderQuota(name)
+	if err != nil {
+		logger.Warn(logSender, "", "quota drift check, unable to get the used quota for folder %#v: %v", name, err)
+		return
+	}
+	if !Config.QuotaDrift.isDrift(usedFiles, numFiles, usedSize, size) {
+		return
+	}
+	corrected := false
+	if Config.QuotaDrift.AutoCorrect {
+		if hasFolderActiveUploads(&folder) {
+			err = errQuotaDriftUploads
+		} else {
+			err = dataprovider.UpdateVirtualFolderQuota(&folder, numFiles, size, true)
+			corrected = err == nil
+		}
+	}
+	logger.Warn(logSender, "", "quota drift detected for folder %#v, stored files: %v size: %v, scanned files: %v size: %v, corrected? %v err: %v",
+		name, usedFiles, usedSize, numFiles, size, corrected, err)
+	metric.QuotaDriftDetected(corrected)
+}
+
+// hasFolderActiveUploads returns true if a user with access to the given folder
+// has uploads in progress
+func hasFolderActiveUploads(folder *vfs.BaseVirtualFolder) bool {
+	for _, username := range folder.Users {
+		if Connections.HasActiveUploads(username) {
+			return true
+		}
+	}
+	return false
+}
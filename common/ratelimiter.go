@@ -129,8 +129,8 @@ type rateLimiter struct {
 
 // Wait blocks until the limit allows one event to happen
 // or returns an error if the time to wait exceeds the max
-// allowed delay
-func (rl *rateLimiter) Wait(source string) (time.Duration, error) {
+// allowed delay. The protocol is used to score the defender event, if any
+func (rl *rateLimiter) Wait(source, protocol string) (time.Duration, error) {
 	var res *rate.Reservation
 	if rl.globalBucket != nil {
 		res = rl.globalBucket.Reserve()
@@ -149,7 +149,7 @@ func (rl *rateLimiter) Wait(source string) (time.Duration, error) {
 	if delay > rl.maxDelay {
 		res.Cancel()
 		if rl.generateDefenderEvents && rl.globalBucket == nil {
-			AddDefenderEvent(source, HostEventLimitExceeded)
+			AddDefenderEvent(source, protocol, HostEventLimitExceeded)
 		}
 		return delay, fmt.Errorf("rate limit exceed, wait time to respect rate %v, max wait time allowed %v", delay, rl.maxDelay)
 	}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	redisMaxIdleConns  = 10
+	redisTimeout       = 5 * time.Second
+	redisMaxBulkLength = 1048576 * 10 // 10MB
+)
+
+// redisError is an error reply returned by the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis error: " + string(e)
+}
+
+// redisClient is a minimal Redis client implementing the RESP protocol.
+// It supports the few commands used by the defender, the replies are returned
+// as string, int64, []interface{} or nil
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func newRedisClient(address, password string, db int) *redisClient {
+	return &redisClient{
+		address:  address,
+		password: password,
+		db:       db,
+		idle:     make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+// do executes the given command and returns its reply
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	if err != nil {
+		var rErr redisError
+		if !errors.As(err, &rErr) {
+			// the connection state is unknown after network and protocol errors
+			conn.conn.Close()
+			return nil, err
+		}
+	}
+	c.putConn(conn)
+	return reply, err
+}
+
+func (c *redisClient) getConn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", c.address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) putConn(conn *redisConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	if err := writeRedisCommand(c.writer, args...); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+func writeRedisCommand(w *bufio.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRedisLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis protocol error: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis protocol error: invalid bulk length %#v", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		if length > redisMaxBulkLength {
+			return nil, fmt.Errorf("redis protocol error: bulk length %v is too big", length)
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis protocol error: invalid array length %#v", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		result := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("redis protocol error: unexpected reply %#v", line)
+	}
+}
+
+func readRedisLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis protocol error: invalid line %#v", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/v2/dataprovider"
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/util"
+	"github.com/drakkan/sftpgo/v2/vfs"
+)
+
+// DownloadValidator identifies the file version a client started to download.
+// A download can be resumed only if the file still has the same size and
+// modification time. The modification time is compared with a one second
+// precision, not all the storage backends provide a better one.
+// For encrypted filesystems the size is the decrypted one
+type DownloadValidator struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// NewDownloadValidator returns the validator for the given file info
+func NewDownloadValidator(info os.FileInfo) DownloadValidator {
+	return DownloadValidator{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
+
+// ParseDownloadValidator parses a validator in the format returned by String
+func ParseDownloadValidator(value string) (DownloadValidator, error) {
+	var validator DownloadValidator
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return validator, fmt.Errorf("invalid download validator %#v", value)
+	}
+	modTime, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return validator, fmt.Errorf("invalid download validator %#v: %w", value, err)
+	}
+	size, err := strconv.ParseInt(parts[1], 16, 64)
+	if err != nil {
+		return validator, fmt.Errorf("invalid download validator %#v: %w", value, err)
+	}
+	validator.ModTime = time.Unix(modTime, 0)
+	validator.Size = size
+	return validator, validator.validate()
+}
+
+// String returns the validator as an opaque string, it can be used as HTTP ETag
+func (v DownloadValidator) String() string {
+	return fmt.Sprintf("%x.%x", v.ModTime.Unix(), v.Size)
+}
+
+func (v *DownloadValidator) validate() error {
+	if v.Size < 0 || v.ModTime.IsZero() {
+		return errors.New("a download validator requires the size and the modification time")
+	}
+	return nil
+}
+
+func (v *DownloadValidator) matches(info os.FileInfo) bool {
+	return info.Size() == v.Size && info.ModTime().Unix() == v.ModTime.Unix()
+}
+
+// ResumeDownload checks that the file at virtualPath still matches the given
+// validator and opens it for reading starting at offset.
+// ErrDownloadChanged is returned if the file does not match the validator, so
+// the client will not stitch together parts from different file versions.
+// The returned pipe reader is not nil for filesystems without random access,
+// the caller must close the transfer
+func (c *BaseConnection) ResumeDownload(virtualPath string, offset int64,
+	validator DownloadValidator) (*BaseTransfer, *pipeat.PipeReaderAt, error) {
+	virtualPath = util.CleanPath(virtualPath)
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(virtualPath)) {
+		return nil, nil, c.GetPermissionDeniedError()
+	}
+	if !c.User.IsFileAllowed(virtualPath) {
+		c.Log(logger.LevelWarn, "reading file %#v is not allowed", virtualPath)
+		return nil, nil, c.GetPermissionDeniedError()
+	}
+	if err := validator.validate(); err != nil {
+		c.Log(logger.LevelDebug, "unable to resume download for %#v: %v", virtualPath, err)
+		return nil, nil, c.GetGenericError(err)
+	}
+	fs, fsPath, err := c.GetFsAndResolvedPath(virtualPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := fs.Stat(fsPath)
+	if err != nil {
+		return nil, nil, c.GetFsError(fs, err)
+	}
+	if !info.Mode().IsRegular() {
+		c.Log(logger.LevelDebug, "cannot resume download for %#v, it is not a regular file", virtualPath)
+		return nil, nil, c.GetOpUnsupportedError()
+	}
+	if vfs.IsCryptOsFs(fs) {
+		info = fs.(*vfs.CryptFs).ConvertFileInfo(info)
+	}
+	if !validator.matches(info) {
+		c.Log(logger.LevelInfo, "resume download refused for %#v, the file changed, size: %v, modification time: %v",
+			virtualPath, info.Size(), info.ModTime())
+		return nil, nil, ErrDownloadChanged
+	}
+	if offset < 0 || offset > info.Size() {
+		c.Log(logger.LevelDebug, "invalid resume offset %v for %#v, size: %v", offset, virtualPath, info.Size())
+		return nil, nil, c.GetGenericError(fmt.Errorf("invalid resume offset %v", offset))
+	}
+	if err := ExecutePreAction(&c.User, OperationPreDownload, fsPath, virtualPath, c.GetProtocol(), 0, 0); err != nil {
+		c.Log(logger.LevelDebug, "download for file %#v denied by pre action: %v", virtualPath, err)
+		return nil, nil, c.GetPermissionDeniedError()
+	}
+
+	file, r, cancelFn, err := fs.Open(fsPath, offset)
+	if err != nil {
+		c.Log(logger.LevelWarn, "could not open file %#v for reading: %+v", fsPath, err)
+		return nil, nil, c.GetFsError(fs, err)
+	}
+	c.Log(logger.LevelDebug, "resuming download for %#v at offset %v", virtualPath, offset)
+
+	return NewBaseTransfer(file, c, cancelFn, fsPath, fsPath, virtualPath, TransferDownload, 0, 0, 0, false, fs), r, nil
+}
@@ -0,0 +1,173 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/drakkan/sftpgo/v2/sdk"
+	"github.com/drakkan/sftpgo/v2/vfs"
+)
+
+const (
+	// the initial contents checked for NUL bytes to detect binary files
+	textModeSniffLen   = 512
+	textModeTempSuffix = ".sftpgo-textmode"
+)
+
+// lineEndingsReader converts the line endings of the wrapped reader.
+// If the initial contents contain a NUL byte the data is considered
+// binary and it is returned unchanged
+type lineEndingsReader struct {
+	r          *bufio.Reader
+	lineEnding sdk.LineEnding
+	checked    bool
+	isBinary   bool
+	// converting to LF: a CR was read and we don't know the next byte yet
+	pendingCR bool
+	// converting to CRLF: the last byte returned was a CR
+	lastCR bool
+	buf    []byte
+	out    []byte
+	err    error
+}
+
+func newLineEndingsReader(r io.Reader, lineEnding sdk.LineEnding) *lineEndingsReader {
+	return &lineEndingsReader{
+		r:          bufio.NewReaderSize(r, 32768),
+		lineEnding: lineEnding,
+		buf:        make([]byte, 32768),
+	}
+}
+
+func (r *lineEndingsReader) checkBinary() bool {
+	if !r.checked {
+		r.checked = true
+		data, _ := r.r.Peek(textModeSniffLen)
+		r.isBinary = bytes.IndexByte(data, 0) != -1
+	}
+	return r.isBinary
+}
+
+func (r *lineEndingsReader) Read(p []byte) (int, error) {
+	if r.checkBinary() {
+		return r.r.Read(p)
+	}
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.r.Read(r.buf)
+		r.out = r.convert(r.buf[:n])
+		if err != nil {
+			r.err = err
+			if r.pendingCR {
+				r.out = append(r.out, '\r')
+				r.pendingCR = false
+			}
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *lineEndingsReader) convert(data []byte) []byte {
+	out := make([]byte, 0, len(data)+len(data)/8+1)
+	switch r.lineEnding {
+	case sdk.LineEndingLF:
+		for _, b := range data {
+			if r.pendingCR {
+				r.pendingCR = false
+				if b != '\n' {
+					out = append(out, '\r')
+				}
+			}
+			if b == '\r' {
+				r.pendingCR = true
+				continue
+			}
+			out = append(out, b)
+		}
+	case sdk.LineEndingCRLF:
+		for _, b := range data {
+			if b == '\n' && !r.lastCR {
+				out = append(out, '\r')
+			}
+			out = append(out, b)
+			r.lastCR = b == '\r'
+		}
+	default:
+		out = append(out, data...)
+	}
+	return out
+}
+
+type lineEndingsReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewTextModeReader returns a reader that converts the line endings of rc to
+// the specified ones. Binary contents are returned unchanged
+func NewTextModeReader(rc io.ReadCloser, lineEnding sdk.LineEnding) io.ReadCloser {
+	return &lineEndingsReadCloser{
+		Reader: newLineEndingsReader(rc, lineEnding),
+		Closer: rc,
+	}
+}
+
+// normalizeLineEndings rewrites fsPath using the specified line endings.
+// It returns false if the file looks binary and so it was not modified
+func normalizeLineEndings(fs vfs.Fs, fsPath string, lineEnding sdk.LineEnding) (bool, error) {
+	srcFile, pipeReader, srcCancelFn, err := fs.Open(fsPath, 0)
+	if err != nil {
+		return false, err
+	}
+	var reader io.ReadCloser = pipeReader
+	if srcFile != nil {
+		reader = srcFile
+	}
+	defer reader.Close()
+
+	textReader := newLineEndingsReader(reader, lineEnding)
+	if textReader.checkBinary() {
+		if srcCancelFn != nil {
+			srcCancelFn()
+		}
+		return false, nil
+	}
+	tmpPath := fsPath + textModeTempSuffix
+	dstFile, pipeWriter, dstCancelFn, err := fs.Create(tmpPath, 0)
+	if err != nil {
+		if srcCancelFn != nil {
+			srcCancelFn()
+		}
+		return false, err
+	}
+	var writer io.WriteCloser = pipeWriter
+	if dstFile != nil {
+		writer = dstFile
+	}
+	_, err = io.Copy(writer, textReader)
+	if err != nil {
+		if srcCancelFn != nil {
+			srcCancelFn()
+		}
+		if dstCancelFn != nil {
+			dstCancelFn()
+		}
+		writer.Close()            //nolint:errcheck
+		fs.Remove(tmpPath, false) //nolint:errcheck
+		return false, err
+	}
+	if err = writer.Close(); err != nil {
+		fs.Remove(tmpPath, false) //nolint:errcheck
+		return false, err
+	}
+	if err = fs.Rename(tmpPath, fsPath); err != nil {
+		fs.Remove(tmpPath, false) //nolint:errcheck
+		return false, err
+	}
+	return true, nil
+}
@@ -2,6 +2,7 @@ package common
 
 import (
 	"errors"
+	"math"
 	"path"
 	"sync"
 	"sync/atomic"
@@ -13,6 +14,13 @@ import (
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
 
+const (
+	// quota is reserved in blocks of this size to limit the data provider updates
+	quotaReservationBlockSize = 1048576
+	// fraction of the bandwidth limit allowed when a slow-start ramp begins
+	bandwidthRampStartFactor = 0.1
+)
+
 var (
 	// ErrTransferClosed defines the error returned for a closed transfer
 	ErrTransferClosed = errors.New("transfer already closed")
@@ -38,6 +46,23 @@ type BaseTransfer struct { //nolint:maligned
 	isNewFile       bool
 	transferType    int
 	AbortTransfer   int32
+	// throttling state, it is reset each time the wanted bandwidth changes
+	throttleStart     time.Time
+	throttleBytes     int64
+	throttleBandwidth int64
+	// quota reserved, and not yet committed, for this upload
+	quotaReserved int64
+	// the virtual folder whose quota is reserved, nil for the user quota
+	quotaFolder *vfs.BaseVirtualFolder
+	// 1 if this transfer holds a server wide transfer slot
+	hasTransferSlot int32
+	slotMutex       sync.Mutex
+	// checksum for the transferred data, if computed
+	checksum string
+	// 1 if the transfer event was already published
+	eventPublished int32
+	// set for uploads streamed to a storage backend
+	pipeWriter *vfs.PipeWriter
 	sync.Mutex
 	ErrTransfer error
 }
@@ -64,6 +89,8 @@ func NewBaseTransfer(file vfs.File, conn *BaseConnection, cancelFn func(), fsPat
 		AbortTransfer:   0,
 		Fs:              fs,
 	}
+	t.throttleStart = t.start
+	t.throttleBandwidth = t.getWantedBandwidth(t.start)
 
 	conn.AddTransfer(t)
 	return t
@@ -92,6 +119,28 @@ func (t *BaseTransfer) GetSize() int64 {
 	return atomic.LoadInt64(&t.BytesReceived)
 }
 
+// SetPipeWriter sets the pipe used to stream this upload to the storage backend,
+// so the bytes already uploaded are reported within the active transfers
+func (t *BaseTransfer) SetPipeWriter(pipeWriter *vfs.PipeWriter) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.pipeWriter = pipeWriter
+}
+
+// GetUploadedSize returns the bytes already sent to the storage backend for
+// streamed uploads and -1 for the other transfers
+func (t *BaseTransfer) GetUploadedSize() int64 {
+	t.Lock()
+	pipeWriter := t.pipeWriter
+	t.Unlock()
+
+	if pipeWriter == nil {
+		return -1
+	}
+	return pipeWriter.GetUploadedBytes()
+}
+
 // GetStartTime returns the start time
 func (t *BaseTransfer) GetStartTime() time.Time {
 	return t.start
@@ -147,6 +196,8 @@ func (t *BaseTransfer) Truncate(fsPath string, size int64) (int64, error) {
 					t.MaxWriteSize += sizeDiff
 					metric.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
 					atomic.StoreInt64(&t.BytesReceived, 0)
+					// the received bytes are accounted by the truncate quota update
+					t.releaseQuota()
 				}
 				t.Unlock()
 			}
@@ -166,6 +217,105 @@ func (t *BaseTransfer) Truncate(fsPath string, size int64) (int64, error) {
 	return 0, errTransferMismatch
 }
 
+// ReserveQuota reserves the user quota needed for the bytes received so far.
+// For virtual folders with their own quota the folder quota is reserved instead.
+// The quota is reserved in blocks using an atomic data provider update, so
+// concurrent uploads cannot exceed the quota all together, even if they are
+// made by different users sharing the same virtual folder.
+// It returns a quota exceeded error if the needed quota cannot be reserved
+func (t *BaseTransfer) ReserveQuota() error {
+	if t.transferType != TransferUpload || dataprovider.GetQuotaTracking() == 0 {
+		return nil
+	}
+	var quotaFolder *vfs.BaseVirtualFolder
+	var quotaSize int64
+	vfolder, err := t.Connection.User.GetVirtualFolderForPath(path.Dir(t.requestPath))
+	if err == nil && !vfolder.IsIncludedInUserQuota() {
+		quotaFolder = &vfolder.BaseVirtualFolder
+		quotaSize = vfolder.QuotaSize
+	} else {
+		quotaSize, _ = t.Connection.getUserQuota()
+	}
+	if quotaSize <= 0 {
+		return nil
+	}
+	reserve := func(size int64) (bool, error) {
+		if quotaFolder != nil {
+			return dataprovider.ReserveVirtualFolderQuota(quotaFolder, size, quotaSize)
+		}
+		return dataprovider.ReserveUserQuota(&t.Connection.User, size, quotaSize)
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	needed := atomic.LoadInt64(&t.BytesReceived) + t.MinWriteOffset - t.InitialSize - t.quotaReserved
+	if needed <= 0 {
+		return nil
+	}
+	toReserve := needed
+	if toReserve < quotaReservationBlockSize {
+		toReserve = quotaReservationBlockSize
+	}
+	reserved, err := reserve(toReserve)
+	if err == nil && !reserved && toReserve > needed {
+		toReserve = needed
+		reserved, err = reserve(toReserve)
+	}
+	if err != nil {
+		// the quota is checked against the max write size anyway
+		t.Connection.Log(logger.LevelWarn, "unable to reserve quota for path %#v: %v", t.fsPath, err)
+		return nil
+	}
+	if !reserved {
+		t.Connection.Log(logger.LevelDebug, "unable to reserve %v bytes for path %#v, quota exceeded", toReserve, t.fsPath)
+		return t.Connection.GetQuotaExceededError()
+	}
+	t.quotaReserved += toReserve
+	t.quotaFolder = quotaFolder
+	return nil
+}
+
+// AcquireTransferSlot waits for a free slot if a server wide limit for concurrent
+// transfers is configured. The slot is acquired on the first call and it is held
+// until the transfer is closed, subsequent calls are no-op
+func (t *BaseTransfer) AcquireTransferSlot() error {
+	if transfersSlots == nil || atomic.LoadInt32(&t.hasTransferSlot) == 1 {
+		return nil
+	}
+
+	t.slotMutex.Lock()
+	defer t.slotMutex.Unlock()
+
+	if atomic.LoadInt32(&t.hasTransferSlot) == 1 {
+		return nil
+	}
+	if err := transfersSlots.acquire(); err != nil {
+		t.Connection.Log(logger.LevelInfo, "unable to start transfer for path %#v: %v, active transfers: %v, queued: %v",
+			t.requestPath, err, transfersSlots.getActive(), transfersSlots.getQueued())
+		return t.Connection.GetServerBusyError()
+	}
+	atomic.StoreInt32(&t.hasTransferSlot, 1)
+	return nil
+}
+
+func (t *BaseTransfer) releaseTransferSlot() {
+	if atomic.CompareAndSwapInt32(&t.hasTransferSlot, 1, 0) && transfersSlots != nil {
+		transfersSlots.release()
+	}
+}
+
+// releaseQuota releases the quota reserved and not used
+func (t *BaseTransfer) releaseQuota() {
+	if t.quotaReserved > 0 {
+		if t.quotaFolder != nil {
+			dataprovider.UpdateVirtualFolderQuota(t.quotaFolder, 0, -t.quotaReserved, false) //nolint:errcheck
+		} else {
+			dataprovider.UpdateUserQuota(&t.Connection.User, 0, -t.quotaReserved, false) //nolint:errcheck
+		}
+		t.quotaReserved = 0
+	}
+}
+
 // TransferError is called if there is an unexpected error.
 // For example network or client issues
 func (t *BaseTransfer) TransferError(err error) {
@@ -199,6 +349,45 @@ func (t *BaseTransfer) getUploadFileSize() (int64, error) {
 	return fileSize, err
 }
 
+// SetChecksum sets the checksum computed for the transferred data.
+// The checksum must be prefixed with the hash algorithm, for example
+// "sha256:<hex encoded hash>", and it is included in the transfer event
+func (t *BaseTransfer) SetChecksum(checksum string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.checksum = checksum
+}
+
+func (t *BaseTransfer) publishEvent(operation string, size, elapsed int64) {
+	if !atomic.CompareAndSwapInt32(&t.eventPublished, 0, 1) {
+		return
+	}
+	t.Lock()
+	checksum := t.checksum
+	t.Unlock()
+
+	event := &TransferEvent{
+		Timestamp:    time.Now().UnixNano(),
+		Operation:    operation,
+		Username:     t.Connection.User.Username,
+		Path:         t.fsPath,
+		VirtualPath:  t.requestPath,
+		Protocol:     t.Connection.protocol,
+		ConnectionID: t.Connection.ID,
+		RemoteAddr:   t.Connection.remoteAddr,
+		Size:         size,
+		Elapsed:      elapsed,
+		Checksum:     checksum,
+		Status:       1,
+	}
+	if t.ErrTransfer != nil {
+		event.Status = 2
+		event.Error = t.ErrTransfer.Error()
+	}
+	publishTransferEvent(event)
+}
+
 // Close it is called when the transfer is completed.
 // It logs the transfer info, updates the user quota (for uploads)
 // and executes any defined action.
@@ -206,6 +395,7 @@ func (t *BaseTransfer) getUploadFileSize() (int64, error) {
 // we try to delete the temporary file
 func (t *BaseTransfer) Close() error {
 	defer t.Connection.RemoveTransfer(t)
+	defer t.releaseTransferSlot()
 
 	var err error
 	numFiles := 0
@@ -213,6 +403,8 @@ func (t *BaseTransfer) Close() error {
 		numFiles = 1
 	}
 	metric.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
+	metric.TransferSpanCompleted(t.Connection.User.Username, t.Connection.protocol, t.Connection.ID, t.start,
+		atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
 	if t.File != nil && t.Connection.IsQuotaExceededError(t.ErrTransfer) {
 		// if quota is exceeded we try to remove the partial file for uploads to local filesystem
 		err = t.Fs.Remove(t.File.Name(), false)
@@ -239,12 +431,16 @@ func (t *BaseTransfer) Close() error {
 			}
 		}
 	}
+	if t.transferType == TransferUpload && t.ErrTransfer == nil && err == nil {
+		t.normalizeUploadLineEndings()
+	}
 	elapsed := time.Since(t.start).Nanoseconds() / 1000000
 	if t.transferType == TransferDownload {
 		logger.TransferLog(downloadLogSender, t.fsPath, elapsed, atomic.LoadInt64(&t.BytesSent), t.Connection.User.Username,
 			t.Connection.ID, t.Connection.protocol, t.Connection.localAddr, t.Connection.remoteAddr, t.ftpMode)
 		ExecuteActionNotification(&t.Connection.User, operationDownload, t.fsPath, t.requestPath, "", "", t.Connection.protocol,
 			atomic.LoadInt64(&t.BytesSent), t.ErrTransfer)
+		t.publishEvent(operationDownload, atomic.LoadInt64(&t.BytesSent), elapsed)
 	} else {
 		fileSize := atomic.LoadInt64(&t.BytesReceived) + t.MinWriteOffset
 		if statSize, err := t.getUploadFileSize(); err == nil {
@@ -256,6 +452,7 @@ func (t *BaseTransfer) Close() error {
 			t.Connection.ID, t.Connection.protocol, t.Connection.localAddr, t.Connection.remoteAddr, t.ftpMode)
 		ExecuteActionNotification(&t.Connection.User, operationUpload, t.fsPath, t.requestPath, "", "", t.Connection.protocol, fileSize,
 			t.ErrTransfer)
+		t.publishEvent(operationUpload, atomic.LoadInt64(&t.BytesReceived), elapsed)
 	}
 	if t.ErrTransfer != nil {
 		t.Connection.Log(logger.LevelWarn, "transfer error: %v, path: %#v", t.ErrTransfer, t.fsPath)
@@ -266,47 +463,117 @@ func (t *BaseTransfer) Close() error {
 	return err
 }
 
+// normalizeUploadLineEndings converts the line endings of the uploaded file,
+// if required by the user's text mode settings
+func (t *BaseTransfer) normalizeUploadLineEndings() {
+	lineEnding := t.Connection.User.GetUploadLineEnding(t.requestPath)
+	if lineEnding == "" {
+		return
+	}
+	normalized, err := normalizeLineEndings(t.Fs, t.fsPath, lineEnding)
+	if err != nil {
+		t.Connection.Log(logger.LevelWarn, "unable to normalize line endings for %#v: %v", t.fsPath, err)
+		return
+	}
+	if normalized {
+		vfs.SetPathPermissions(t.Fs, t.fsPath, t.Connection.User.GetUID(), t.Connection.User.GetGID())
+	}
+	t.Connection.Log(logger.LevelDebug, "line endings normalization for %#v, line ending: %v, normalized: %v",
+		t.fsPath, lineEnding, normalized)
+}
+
 func (t *BaseTransfer) updateQuota(numFiles int, fileSize int64) bool {
 	// S3 uploads are atomic, if there is an error nothing is uploaded
 	if t.File == nil && t.ErrTransfer != nil {
+		t.releaseQuota()
 		return false
 	}
 	sizeDiff := fileSize - t.InitialSize
 	if t.transferType == TransferUpload && (numFiles != 0 || sizeDiff > 0) {
+		// the reserved quota is already included in the user's or folder's used quota
+		userSizeDiff := sizeDiff
+		folderSizeDiff := sizeDiff
+		if t.quotaFolder != nil {
+			folderSizeDiff -= t.quotaReserved
+		} else {
+			userSizeDiff -= t.quotaReserved
+		}
+		t.quotaReserved = 0
 		vfolder, err := t.Connection.User.GetVirtualFolderForPath(path.Dir(t.requestPath))
 		if err == nil {
 			dataprovider.UpdateVirtualFolderQuota(&vfolder.BaseVirtualFolder, numFiles, //nolint:errcheck
-				sizeDiff, false)
+				folderSizeDiff, false)
 			if vfolder.IsIncludedInUserQuota() {
-				dataprovider.UpdateUserQuota(&t.Connection.User, numFiles, sizeDiff, false) //nolint:errcheck
+				dataprovider.UpdateUserQuota(&t.Connection.User, numFiles, userSizeDiff, false) //nolint:errcheck
 			}
 		} else {
-			dataprovider.UpdateUserQuota(&t.Connection.User, numFiles, sizeDiff, false) //nolint:errcheck
+			dataprovider.UpdateUserQuota(&t.Connection.User, numFiles, userSizeDiff, false) //nolint:errcheck
 		}
 		return true
 	}
+	t.releaseQuota()
 	return false
 }
 
 // HandleThrottle manage bandwidth throttling
 func (t *BaseTransfer) HandleThrottle() {
-	var wantedBandwidth int64
-	var trasferredBytes int64
+	t.handleThrottle(time.Now())
+}
+
+func (t *BaseTransfer) getWantedBandwidth(now time.Time) int64 {
+	uploadBandwidth, downloadBandwidth := t.Connection.User.GetBandwidthAt(now)
 	if t.transferType == TransferDownload {
-		wantedBandwidth = t.Connection.User.DownloadBandwidth
-		trasferredBytes = atomic.LoadInt64(&t.BytesSent)
-	} else {
-		wantedBandwidth = t.Connection.User.UploadBandwidth
-		trasferredBytes = atomic.LoadInt64(&t.BytesReceived)
+		return downloadBandwidth
+	}
+	return uploadBandwidth
+}
+
+func (t *BaseTransfer) handleThrottle(now time.Time) {
+	wantedBandwidth := t.getWantedBandwidth(now)
+	trasferredBytes := t.GetSize()
+	if wantedBandwidth != t.throttleBandwidth {
+		// the bandwidth changed, for example a bandwidth schedule started or ended,
+		// the new limit applies from the current position
+		t.throttleBandwidth = wantedBandwidth
+		t.throttleStart = now
+		t.throttleBytes = trasferredBytes
 	}
 	if wantedBandwidth > 0 {
 		// real and wanted elapsed as milliseconds, bytes as kilobytes
-		realElapsed := time.Since(t.start).Nanoseconds() / 1000000
-		// trasferredBytes / 1024 = KB/s, we multiply for 1000 to get milliseconds
-		wantedElapsed := 1000 * (trasferredBytes / 1024) / wantedBandwidth
+		realElapsed := now.Sub(t.throttleStart).Nanoseconds() / 1000000
+		var wantedElapsed int64
+		if t.throttleBytes == 0 && Config.BandwidthRampUp > 0 {
+			// the limit applies since the transfer start, the rate slowly ramps up to the limit
+			wantedElapsed = getRampedWantedElapsed(trasferredBytes/1024, wantedBandwidth,
+				time.Duration(Config.BandwidthRampUp)*time.Second)
+		} else {
+			// trasferredBytes / 1024 = KB/s, we multiply for 1000 to get milliseconds
+			wantedElapsed = 1000 * ((trasferredBytes - t.throttleBytes) / 1024) / wantedBandwidth
+		}
 		if wantedElapsed > realElapsed {
 			toSleep := time.Duration(wantedElapsed - realElapsed)
 			time.Sleep(toSleep * time.Millisecond)
 		}
 	}
 }
+
+// getRampedWantedElapsed returns the time, in milliseconds, needed to transfer the
+// specified kilobytes if the rate starts at bandwidthRampStartFactor of the bandwidth
+// limit, in KB/s, and linearly increases up to the limit within the ramp duration
+func getRampedWantedElapsed(kiloBytes, bandwidth int64, ramp time.Duration) int64 {
+	rampSecs := ramp.Seconds()
+	// seconds at full bandwidth needed for the transferred data
+	wanted := float64(kiloBytes) / float64(bandwidth)
+	// seconds at full bandwidth equivalent to the whole ramp
+	rampEquivalent := rampSecs * (1 + bandwidthRampStartFactor) / 2
+	var elapsed float64
+	if wanted >= rampEquivalent {
+		elapsed = rampSecs + wanted - rampEquivalent
+	} else {
+		// solve a*x^2 + f*x = wanted, the data allowed after x seconds within the ramp
+		a := (1 - bandwidthRampStartFactor) / (2 * rampSecs)
+		f := bandwidthRampStartFactor
+		elapsed = (-f + math.Sqrt(f*f+4*a*wanted)) / (2 * a)
+	}
+	return int64(elapsed * 1000)
+}
@@ -1,17 +1,29 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/eikenb/pipeat"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/drakkan/sftpgo/v2/dataprovider"
 	"github.com/drakkan/sftpgo/v2/kms"
+	"github.com/drakkan/sftpgo/v2/metric"
 	"github.com/drakkan/sftpgo/v2/sdk"
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
@@ -49,6 +61,497 @@ func TestTransferUpdateQuota(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTransfersSlots(t *testing.T) {
+	transfersSlots = newTransfersLimiter(2, 2*time.Second)
+	defer func() {
+		transfersSlots = nil
+	}()
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	conn := NewBaseConnection("", ProtocolFTP, "", "", dataprovider.User{})
+	var active, maxActive int32
+	numTransfers := 6
+	errs := make([]error, numTransfers)
+	var wg sync.WaitGroup
+	for idx := 0; idx < numTransfers; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			transfer := NewBaseTransfer(nil, conn, nil, "", "", fmt.Sprintf("/file%v", idx), TransferDownload,
+				0, 0, 0, false, fs)
+			errs[idx] = transfer.AcquireTransferSlot()
+			if errs[idx] == nil {
+				current := atomic.AddInt32(&active, 1)
+				for {
+					maxValue := atomic.LoadInt32(&maxActive)
+					if current <= maxValue || atomic.CompareAndSwapInt32(&maxActive, maxValue, current) {
+						break
+					}
+				}
+				// a second call must not acquire another slot
+				assert.NoError(t, transfer.AcquireTransferSlot())
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&active, -1)
+			}
+			assert.NoError(t, transfer.Close())
+		}(idx)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxActive))
+	assert.Equal(t, 0, transfersSlots.getActive())
+	assert.Equal(t, 0, transfersSlots.getQueued())
+	assert.Len(t, conn.GetTransfers(), 0)
+
+	transfersSlots = newTransfersLimiter(1, 0)
+	transfer1 := NewBaseTransfer(nil, conn, nil, "", "", "/file1", TransferDownload, 0, 0, 0, false, fs)
+	transfer2 := NewBaseTransfer(nil, conn, nil, "", "", "/file2", TransferDownload, 0, 0, 0, false, fs)
+	err := transfer1.AcquireTransferSlot()
+	assert.NoError(t, err)
+	err = transfer2.AcquireTransferSlot()
+	assert.ErrorIs(t, err, ErrServerBusy)
+	assert.Equal(t, 1, transfersSlots.getActive())
+	err = transfer1.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, transfersSlots.getActive())
+	err = transfer2.AcquireTransferSlot()
+	assert.NoError(t, err)
+	err = transfer2.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, transfersSlots.getActive())
+
+	conn = NewBaseConnection("", ProtocolSFTP, "", "", dataprovider.User{})
+	transfersSlots = newTransfersLimiter(1, 100*time.Millisecond)
+	transfer1 = NewBaseTransfer(nil, conn, nil, "", "", "/file1", TransferUpload, 0, 0, 0, true, fs)
+	transfer2 = NewBaseTransfer(nil, conn, nil, "", "", "/file2", TransferUpload, 0, 0, 0, true, fs)
+	err = transfer1.AcquireTransferSlot()
+	assert.NoError(t, err)
+	err = transfer2.AcquireTransferSlot()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ErrServerBusy.Error())
+	}
+	assert.Equal(t, 0, transfersSlots.getQueued())
+	transfer1.releaseTransferSlot()
+	transfer2.releaseTransferSlot()
+	assert.Equal(t, 0, transfersSlots.getActive())
+	conn.RemoveTransfer(transfer1)
+	conn.RemoveTransfer(transfer2)
+}
+
+type memoryTransferEventSink struct {
+	sync.Mutex
+	events []*TransferEvent
+}
+
+func (s *memoryTransferEventSink) Publish(event *TransferEvent) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestTransferEvents(t *testing.T) {
+	sink := &memoryTransferEventSink{}
+	InitializeTransferEventSink(sink)
+	defer InitializeTransferEventSink(nil)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "transfer_events_user",
+		},
+	}
+	conn := NewBaseConnection("connID", ProtocolSFTP, "", "127.0.0.1:1234", u)
+	download := NewBaseTransfer(nil, conn, nil, "/fs/file1", "/fs/file1", "/file1", TransferDownload, 0, 0, 0, false, fs)
+	atomic.StoreInt64(&download.BytesSent, 100)
+	download.SetChecksum("sha256:abcd")
+	err := download.Close()
+	assert.NoError(t, err)
+	// a second close must not publish a new event
+	err = download.Close()
+	assert.NoError(t, err)
+
+	upload := NewBaseTransfer(nil, conn, nil, "/fs/file2", "/fs/file2", "/file2", TransferUpload, 0, 0, 0, true, fs)
+	atomic.StoreInt64(&upload.BytesReceived, 50)
+	upload.TransferError(errors.New("upload error"))
+	err = upload.Close()
+	assert.Error(t, err)
+
+	require.Len(t, sink.events, 2)
+	event := sink.events[0]
+	assert.Equal(t, operationDownload, event.Operation)
+	assert.Equal(t, u.Username, event.Username)
+	assert.Equal(t, "/fs/file1", event.Path)
+	assert.Equal(t, "/file1", event.VirtualPath)
+	assert.Equal(t, ProtocolSFTP, event.Protocol)
+	assert.Equal(t, "SFTP_connID", event.ConnectionID)
+	assert.Equal(t, "127.0.0.1:1234", event.RemoteAddr)
+	assert.Equal(t, int64(100), event.Size)
+	assert.GreaterOrEqual(t, event.Elapsed, int64(0))
+	assert.Greater(t, event.Timestamp, int64(0))
+	assert.Equal(t, "sha256:abcd", event.Checksum)
+	assert.Equal(t, 1, event.Status)
+	assert.Empty(t, event.Error)
+	event = sink.events[1]
+	assert.Equal(t, operationUpload, event.Operation)
+	assert.Equal(t, "/fs/file2", event.Path)
+	assert.Equal(t, int64(50), event.Size)
+	assert.Empty(t, event.Checksum)
+	assert.Equal(t, 2, event.Status)
+	assert.Equal(t, "upload error", event.Error)
+}
+
+func TestTransferEventSinks(t *testing.T) {
+	c := TransferEventsConfig{}
+	sink, err := c.getSink()
+	assert.NoError(t, err)
+	assert.Nil(t, sink)
+	c.Sink = "unknown"
+	_, err = c.getSink()
+	assert.Error(t, err)
+	c.Sink = TransferEventSinkHTTP
+	c.Target = "relative/path"
+	_, err = c.getSink()
+	assert.Error(t, err)
+	c.Sink = TransferEventSinkFile
+	_, err = c.getSink()
+	assert.Error(t, err)
+	c.Sink = TransferEventSinkHTTP
+	c.Target = "http://127.0.0.1:8080/events"
+	sink, err = c.getSink()
+	assert.NoError(t, err)
+	assert.IsType(t, &httpTransferEventSink{}, sink)
+	c.Sink = TransferEventSinkLog
+	sink, err = c.getSink()
+	assert.NoError(t, err)
+	err = sink.Publish(&TransferEvent{})
+	assert.NoError(t, err)
+
+	eventsFile := filepath.Join(os.TempDir(), "transfer_events.json")
+	c.Sink = TransferEventSinkFile
+	c.Target = eventsFile
+	sink, err = c.getSink()
+	assert.NoError(t, err)
+	InitializeTransferEventSink(sink)
+	defer InitializeTransferEventSink(nil)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	conn := NewBaseConnection("", ProtocolFTP, "", "", dataprovider.User{})
+	for _, path := range []string{"/file1", "/file2"} {
+		transfer := NewBaseTransfer(nil, conn, nil, "", "", path, TransferDownload, 0, 0, 0, false, fs)
+		err = transfer.Close()
+		assert.NoError(t, err)
+	}
+	content, err := os.ReadFile(eventsFile)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if assert.Len(t, lines, 2) {
+		var event TransferEvent
+		err = json.Unmarshal([]byte(lines[1]), &event)
+		assert.NoError(t, err)
+		assert.Equal(t, "/file2", event.VirtualPath)
+		assert.Equal(t, ProtocolFTP, event.Protocol)
+	}
+	err = os.Remove(eventsFile)
+	assert.NoError(t, err)
+}
+
+func TestTransferOTLPSpans(t *testing.T) {
+	var mu sync.Mutex
+	var requests []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Auth"))
+		var req map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.NoError(t, err)
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	otlpConfig := metric.OTLPConfig{
+		Endpoint:       "ftp://127.0.0.1",
+		ExportInterval: 10,
+	}
+	err := otlpConfig.Initialize(nil)
+	assert.Error(t, err)
+	otlpConfig.Endpoint = collector.URL
+	otlpConfig.ExportInterval = 0
+	err = otlpConfig.Initialize(nil)
+	assert.Error(t, err)
+	otlpConfig.ExportInterval = 10
+	otlpConfig.Headers = map[string]string{"X-Auth": "secret"}
+	err = otlpConfig.Initialize(nil)
+	require.NoError(t, err)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "otlp_user",
+		},
+	}
+	conn := NewBaseConnection("connID", ProtocolFTP, "", "127.0.0.1:1234", u)
+	upload := NewBaseTransfer(nil, conn, nil, "/fs/file", "/fs/file", "/file", TransferUpload, 0, 0, 0, true, fs)
+	atomic.StoreInt64(&upload.BytesReceived, 123)
+	err = upload.Close()
+	assert.NoError(t, err)
+	// stopping the exporter sends the queued spans
+	metric.StopOTLPExporter()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, requests, 1)
+	resourceSpans := requests[0]["resourceSpans"].([]interface{})
+	require.Len(t, resourceSpans, 1)
+	scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	require.Len(t, scopeSpans, 1)
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	require.Len(t, spans, 1)
+	span := spans[0].(map[string]interface{})
+	assert.Equal(t, "upload", span["name"])
+	assert.Len(t, span["traceId"], 32)
+	assert.Len(t, span["spanId"], 16)
+	assert.Equal(t, float64(1), span["status"].(map[string]interface{})["code"])
+	attributes := make(map[string]interface{})
+	for _, attr := range span["attributes"].([]interface{}) {
+		a := attr.(map[string]interface{})
+		value := a["value"].(map[string]interface{})
+		if v, ok := value["stringValue"]; ok {
+			attributes[a["key"].(string)] = v
+		} else {
+			attributes[a["key"].(string)] = value["intValue"]
+		}
+	}
+	assert.Equal(t, u.Username, attributes["sftpgo.username"])
+	assert.Equal(t, ProtocolFTP, attributes["sftpgo.protocol"])
+	assert.Equal(t, "FTP_connID", attributes["sftpgo.connection_id"])
+	assert.Equal(t, "123", attributes["sftpgo.bytes_received"])
+	assert.Equal(t, "0", attributes["sftpgo.bytes_sent"])
+	// spans are not queued with the exporter disabled
+	download := NewBaseTransfer(nil, conn, nil, "/fs/file", "/fs/file", "/file", TransferDownload, 0, 0, 0, false, fs)
+	err = download.Close()
+	assert.NoError(t, err)
+	assert.Len(t, requests, 1)
+}
+
+func TestOTLPExportErrors(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	var messages []string
+	otlpConfig := metric.OTLPConfig{
+		Endpoint:       collector.URL,
+		ExportInterval: 10,
+	}
+	err := otlpConfig.Initialize(func(format string, v ...interface{}) {
+		messages = append(messages, fmt.Sprintf(format, v...))
+	})
+	require.NoError(t, err)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "otlp_user",
+		},
+	}
+	conn := NewBaseConnection("connID", ProtocolFTP, "", "127.0.0.1:1234", u)
+	upload := NewBaseTransfer(nil, conn, nil, "/fs/file", "/fs/file", "/file", TransferUpload, 0, 0, 0, true, fs)
+	err = upload.Close()
+	assert.NoError(t, err)
+	// the export error is reported while stopping the exporter
+	metric.StopOTLPExporter()
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "503")
+}
+
+func TestTransferQuotaReservation(t *testing.T) {
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:  userTestUsername,
+			Password:  "pwd",
+			HomeDir:   filepath.Join(os.TempDir(), userTestUsername),
+			Status:    1,
+			QuotaSize: 2*quotaReservationBlockSize + quotaReservationBlockSize/2,
+		},
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	err := dataprovider.AddUser(&u)
+	assert.NoError(t, err)
+	user, err := dataprovider.UserExists(userTestUsername)
+	assert.NoError(t, err)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", user)
+	uploadSize := int64(2 * quotaReservationBlockSize)
+	transfers := []*BaseTransfer{
+		NewBaseTransfer(nil, conn, nil, "", "", "/file1", TransferUpload, 0, 0, 0, true, fs),
+		NewBaseTransfer(nil, conn, nil, "", "", "/file2", TransferUpload, 0, 0, 0, true, fs),
+	}
+	// each upload fits the quota but the two uploads together exceed it
+	errs := make([]error, len(transfers))
+	var wg sync.WaitGroup
+	for idx := range transfers {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			transfers[idx].BytesReceived = uploadSize
+			errs[idx] = transfers[idx].ReserveQuota()
+		}(idx)
+	}
+	wg.Wait()
+	var failed *BaseTransfer
+	var succeeded *BaseTransfer
+	for idx, err := range errs {
+		if err != nil {
+			assert.True(t, conn.IsQuotaExceededError(err))
+			failed = transfers[idx]
+		} else {
+			succeeded = transfers[idx]
+		}
+	}
+	require.NotNil(t, failed)
+	require.NotNil(t, succeeded)
+	assert.Equal(t, uploadSize, succeeded.quotaReserved)
+	assert.Equal(t, int64(0), failed.quotaReserved)
+	_, usedSize, err := dataprovider.GetUsedQuota(userTestUsername)
+	assert.NoError(t, err)
+	assert.Equal(t, uploadSize, usedSize)
+	// the remaining quota is smaller than a reservation block, only the needed size is reserved
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "/file3", TransferUpload, 0, 0, 0, true, fs)
+	transfer.BytesReceived = 100
+	err = transfer.ReserveQuota()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), transfer.quotaReserved)
+	_, usedSize, err = dataprovider.GetUsedQuota(userTestUsername)
+	assert.NoError(t, err)
+	assert.Equal(t, uploadSize+100, usedSize)
+	// downloads are never reserved
+	download := NewBaseTransfer(nil, conn, nil, "", "", "/file4", TransferDownload, 0, 0, 0, false, fs)
+	download.BytesSent = uploadSize
+	assert.NoError(t, download.ReserveQuota())
+	assert.Equal(t, int64(0), download.quotaReserved)
+	// commit the actual size for the completed upload
+	assert.True(t, succeeded.updateQuota(1, uploadSize-10))
+	assert.Equal(t, int64(0), succeeded.quotaReserved)
+	// release the reservation for the failed uploads
+	assert.False(t, failed.updateQuota(0, 0))
+	assert.False(t, transfer.updateQuota(0, 0))
+	assert.Equal(t, int64(0), transfer.quotaReserved)
+	usedFiles, usedSize, err := dataprovider.GetUsedQuota(userTestUsername)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usedFiles)
+	assert.Equal(t, uploadSize-10, usedSize)
+
+	for _, tr := range []*BaseTransfer{succeeded, failed, transfer, download} {
+		conn.RemoveTransfer(tr)
+	}
+	err = dataprovider.DeleteUser(userTestUsername)
+	assert.NoError(t, err)
+}
+
+func TestTransferFolderQuotaReservation(t *testing.T) {
+	folderName := "sharedfolder"
+	vdirPath := "/vdir"
+	folderQuotaSize := int64(2*quotaReservationBlockSize + quotaReservationBlockSize/2)
+	var conns []*BaseConnection
+	for _, username := range []string{userTestUsername, userTestUsername + "1"} {
+		u := dataprovider.User{
+			BaseUser: sdk.BaseUser{
+				Username: username,
+				Password: "pwd",
+				HomeDir:  filepath.Join(os.TempDir(), username),
+				Status:   1,
+			},
+		}
+		u.Permissions = make(map[string][]string)
+		u.Permissions["/"] = []string{dataprovider.PermAny}
+		u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+			BaseVirtualFolder: vfs.BaseVirtualFolder{
+				Name:       folderName,
+				MappedPath: filepath.Join(os.TempDir(), folderName),
+			},
+			VirtualPath: vdirPath,
+			QuotaSize:   folderQuotaSize,
+		})
+		err := dataprovider.AddUser(&u)
+		assert.NoError(t, err)
+		user, err := dataprovider.UserExists(username)
+		assert.NoError(t, err)
+		conns = append(conns, NewBaseConnection("", ProtocolSFTP, "", "", user))
+	}
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	uploadSize := int64(2 * quotaReservationBlockSize)
+	transfers := []*BaseTransfer{
+		NewBaseTransfer(nil, conns[0], nil, "", "", path.Join(vdirPath, "file1"), TransferUpload, 0, 0, 0, true, fs),
+		NewBaseTransfer(nil, conns[1], nil, "", "", path.Join(vdirPath, "file2"), TransferUpload, 0, 0, 0, true, fs),
+	}
+	// each user can upload to the shared folder but the two uploads together exceed its quota
+	errs := make([]error, len(transfers))
+	var wg sync.WaitGroup
+	for idx := range transfers {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			transfers[idx].BytesReceived = uploadSize
+			errs[idx] = transfers[idx].ReserveQuota()
+		}(idx)
+	}
+	wg.Wait()
+	var failed *BaseTransfer
+	var succeeded *BaseTransfer
+	for idx, err := range errs {
+		if err != nil {
+			assert.True(t, transfers[idx].Connection.IsQuotaExceededError(err))
+			failed = transfers[idx]
+		} else {
+			succeeded = transfers[idx]
+		}
+	}
+	require.NotNil(t, failed)
+	require.NotNil(t, succeeded)
+	assert.Equal(t, uploadSize, succeeded.quotaReserved)
+	assert.NotNil(t, succeeded.quotaFolder)
+	assert.Equal(t, int64(0), failed.quotaReserved)
+	_, usedSize, err := dataprovider.GetUsedVirtualFolderQuota(folderName)
+	assert.NoError(t, err)
+	assert.Equal(t, uploadSize, usedSize)
+	// the folder is not included in the user quota
+	_, usedSize, err = dataprovider.GetUsedQuota(succeeded.Connection.User.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), usedSize)
+	// commit the actual size for the completed upload
+	assert.True(t, succeeded.updateQuota(1, uploadSize-10))
+	assert.Equal(t, int64(0), succeeded.quotaReserved)
+	assert.False(t, failed.updateQuota(0, 0))
+	usedFiles, usedSize, err := dataprovider.GetUsedVirtualFolderQuota(folderName)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, usedFiles)
+	assert.Equal(t, uploadSize-10, usedSize)
+
+	for idx, conn := range conns {
+		conn.RemoveTransfer(transfers[idx])
+		err = dataprovider.DeleteUser(conn.User.Username)
+		assert.NoError(t, err)
+	}
+	err = dataprovider.DeleteFolder(folderName)
+	assert.NoError(t, err)
+}
+
 func TestTransferThrottling(t *testing.T) {
 	u := dataprovider.User{
 		BaseUser: sdk.BaseUser{
@@ -87,6 +590,105 @@ func TestTransferThrottling(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTransferThrottlingSchedules(t *testing.T) {
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username: "test",
+			Filters: sdk.UserFilters{
+				BandwidthSchedules: []sdk.BandwidthSchedule{
+					{
+						From:            "10:00",
+						To:              "11:00",
+						UploadBandwidth: 50,
+					},
+				},
+			},
+		},
+	}
+	now := time.Now()
+	beforeWindow := time.Date(now.Year(), now.Month(), now.Day(), 9, 59, 0, 0, now.Location())
+	insideWindow := time.Date(now.Year(), now.Month(), now.Day(), 10, 0, 0, 0, now.Location())
+	afterWindow := time.Date(now.Year(), now.Month(), now.Day(), 11, 0, 0, 0, now.Location())
+	upload, download := u.GetBandwidthAt(beforeWindow)
+	assert.Equal(t, int64(0), upload)
+	assert.Equal(t, int64(0), download)
+	upload, download = u.GetBandwidthAt(insideWindow)
+	assert.Equal(t, int64(50), upload)
+	assert.Equal(t, int64(0), download)
+
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	testFileSize := int64(65536)
+	conn := NewBaseConnection("id", ProtocolSFTP, "", "", u)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "", TransferUpload, 0, 0, 0, true, fs)
+	// no limits before the window starts
+	transfer.BytesReceived = testFileSize
+	startTime := time.Now()
+	transfer.handleThrottle(beforeWindow)
+	assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+	// the window starts mid-transfer, the bytes already transferred must not be throttled
+	transfer.handleThrottle(insideWindow)
+	assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+	assert.Equal(t, int64(50), transfer.throttleBandwidth)
+	assert.Equal(t, testFileSize, transfer.throttleBytes)
+	// the bytes transferred inside the window are throttled
+	transfer.BytesReceived = 2 * testFileSize
+	wantedElapsed := 1000 * (testFileSize / 1024) / 50
+	// some tolerance
+	wantedElapsed -= wantedElapsed / 10
+	startTime = time.Now()
+	transfer.handleThrottle(insideWindow)
+	elapsed := time.Since(startTime).Nanoseconds() / 1000000
+	assert.GreaterOrEqual(t, elapsed, wantedElapsed, "upload bandwidth throttling not respected")
+	// the window ends mid-transfer, no more limits
+	transfer.BytesReceived = 4 * testFileSize
+	startTime = time.Now()
+	transfer.handleThrottle(afterWindow)
+	assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+	assert.Equal(t, int64(0), transfer.throttleBandwidth)
+	err := transfer.Close()
+	assert.NoError(t, err)
+}
+
+func TestBandwidthRamp(t *testing.T) {
+	ramp := 2 * time.Second
+	assert.Equal(t, int64(0), getRampedWantedElapsed(0, 100, ramp))
+	// at 100 KB/s 20 KB need 200 ms, the rate increases within the ramp
+	d1 := getRampedWantedElapsed(20, 100, ramp) - getRampedWantedElapsed(0, 100, ramp)
+	d2 := getRampedWantedElapsed(60, 100, ramp) - getRampedWantedElapsed(40, 100, ramp)
+	d3 := getRampedWantedElapsed(100, 100, ramp) - getRampedWantedElapsed(80, 100, ramp)
+	assert.Greater(t, d1, int64(400))
+	assert.Greater(t, d1, d2)
+	assert.Greater(t, d2, d3)
+	assert.Greater(t, d3, int64(200))
+	// the ramp ends after 110 KB, the average of the start and the final rate for 2 seconds
+	assert.InDelta(t, 2000, getRampedWantedElapsed(110, 100, ramp), 1)
+	// the rate plateaus at the limit after the ramp
+	assert.InDelta(t, 1000, getRampedWantedElapsed(310, 100, ramp)-getRampedWantedElapsed(210, 100, ramp), 1)
+	assert.InDelta(t, 1000, getRampedWantedElapsed(1110, 100, ramp)-getRampedWantedElapsed(1010, 100, ramp), 1)
+
+	configCopy := Config
+	Config.BandwidthRampUp = 1
+	u := dataprovider.User{
+		BaseUser: sdk.BaseUser{
+			Username:        "test",
+			UploadBandwidth: 64,
+		},
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	conn := NewBaseConnection("id", ProtocolSFTP, "", "", u)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "", TransferUpload, 0, 0, 0, true, fs)
+	// 32 KB need 500 ms at 64 KB/s, about 950 ms with the ramp
+	transfer.BytesReceived = 32768
+	startTime := time.Now()
+	transfer.HandleThrottle()
+	elapsed := time.Since(startTime).Nanoseconds() / 1000000
+	assert.GreaterOrEqual(t, elapsed, int64(850), "upload bandwidth ramp not respected")
+	err := transfer.Close()
+	assert.NoError(t, err)
+
+	Config = configCopy
+}
+
 func TestRealPath(t *testing.T) {
 	testFile := filepath.Join(os.TempDir(), "afile.txt")
 	fs := vfs.NewOsFs("123", os.TempDir(), "")
@@ -297,3 +899,125 @@ func TestFTPMode(t *testing.T) {
 	transfer.SetFtpMode("active")
 	assert.Equal(t, "active", transfer.ftpMode)
 }
+
+func TestLineEndingsReader(t *testing.T) {
+	testCases := []struct {
+		input      string
+		lineEnding sdk.LineEnding
+		expected   string
+	}{
+		{"a\r\nb\r\nc", sdk.LineEndingLF, "a\nb\nc"},
+		{"a\nb\r\n\r\rc\r", sdk.LineEndingLF, "a\nb\n\r\rc\r"},
+		{"a\nb\r\nc\n", sdk.LineEndingCRLF, "a\r\nb\r\nc\r\n"},
+		{"\n\n\r", sdk.LineEndingCRLF, "\r\n\r\n\r"},
+		{"a\r\nb\n", "", "a\r\nb\n"},
+		{"a\r\n\x00b\n", sdk.LineEndingLF, "a\r\n\x00b\n"},
+	}
+	for _, tc := range testCases {
+		// read one byte at a time to check the conversion across reads
+		r := newLineEndingsReader(iotest.OneByteReader(strings.NewReader(tc.input)), tc.lineEnding)
+		data, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(data), "input %q", tc.input)
+		r = newLineEndingsReader(strings.NewReader(tc.input), tc.lineEnding)
+		data, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(data), "input %q", tc.input)
+	}
+	// a NUL byte after the sniffed length does not disable the conversion
+	input := strings.Repeat("a\r\n", textModeSniffLen) + "\x00"
+	data, err := io.ReadAll(NewTextModeReader(io.NopCloser(strings.NewReader(input)), sdk.LineEndingLF))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a\n", textModeSniffLen)+"\x00", string(data))
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "text_mode")
+	err := os.MkdirAll(homeDir, os.ModePerm)
+	assert.NoError(t, err)
+	fs := vfs.NewOsFs("", homeDir, "")
+	textPath := filepath.Join(homeDir, "file.txt")
+	err = os.WriteFile(textPath, []byte("a\nb\n"), os.ModePerm)
+	assert.NoError(t, err)
+	normalized, err := normalizeLineEndings(fs, textPath, sdk.LineEndingCRLF)
+	assert.NoError(t, err)
+	assert.True(t, normalized)
+	data, err := os.ReadFile(textPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a\r\nb\r\n"), data)
+	assert.NoFileExists(t, textPath+textModeTempSuffix)
+
+	binaryPath := filepath.Join(homeDir, "binary.txt")
+	binaryContent := []byte{'a', '\n', 0, 'b', '\n'}
+	err = os.WriteFile(binaryPath, binaryContent, os.ModePerm)
+	assert.NoError(t, err)
+	normalized, err = normalizeLineEndings(fs, binaryPath, sdk.LineEndingCRLF)
+	assert.NoError(t, err)
+	assert.False(t, normalized)
+	data, err = os.ReadFile(binaryPath)
+	assert.NoError(t, err)
+	assert.Equal(t, binaryContent, data)
+
+	_, err = normalizeLineEndings(fs, filepath.Join(homeDir, "missing.txt"), sdk.LineEndingLF)
+	assert.Error(t, err)
+
+	user := dataprovider.User{}
+	user.Filters.TextMode = sdk.TextModeFilter{
+		Extensions: []string{".txt", ".csv"},
+		Upload:     sdk.LineEndingLF,
+	}
+	assert.Equal(t, sdk.LineEndingLF, user.GetUploadLineEnding("/dir/file.txt"))
+	assert.Equal(t, sdk.LineEndingLF, user.GetUploadLineEnding("/dir/file.CSV"))
+	assert.Empty(t, user.GetUploadLineEnding("/dir/file.bin"))
+	assert.Empty(t, user.GetUploadLineEnding("/dir/txt"))
+	assert.Empty(t, user.GetDownloadLineEnding("/dir/file.txt"))
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
+
+func TestTransferUploadProgress(t *testing.T) {
+	r, w, err := pipeat.PipeInDir(os.TempDir())
+	require.NoError(t, err)
+	pipeWriter := vfs.NewPipeWriter(w)
+	stopProgress := pipeWriter.TrackUploadProgress(r, 10*time.Millisecond)
+	// simulate a slow storage backend reading the uploaded data
+	go func() {
+		buf := make([]byte, 10)
+		var readErr error
+		for readErr == nil {
+			_, readErr = r.Read(buf)
+			time.Sleep(5 * time.Millisecond)
+		}
+		stopProgress()
+		r.CloseWithError(nil) //nolint:errcheck
+		pipeWriter.Done(nil)
+	}()
+
+	conn := NewBaseConnection("", ProtocolSFTP, "", "", dataprovider.User{})
+	fs := vfs.NewOsFs("", os.TempDir(), "")
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", "/upload", TransferUpload, 0, 0, 0, true, fs)
+	assert.Equal(t, int64(-1), transfer.GetUploadedSize())
+	transfer.SetPipeWriter(pipeWriter)
+
+	data := []byte(strings.Repeat("a", 100))
+	n, err := pipeWriter.Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Eventually(t, func() bool {
+		transfers := conn.GetTransfers()
+		if len(transfers) != 1 || transfers[0].UploadedSize == nil {
+			return false
+		}
+		return *transfers[0].UploadedSize > 0
+	}, 1*time.Second, 10*time.Millisecond)
+
+	err = pipeWriter.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), pipeWriter.GetUploadedBytes())
+	assert.Equal(t, int64(len(data)), transfer.GetUploadedSize())
+
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Len(t, conn.GetTransfers(), 0)
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/httpclient"
+	"github.com/drakkan/sftpgo/v2/logger"
+)
+
+// Supported sinks for transfer events
+const (
+	TransferEventSinkLog  = "log"
+	TransferEventSinkHTTP = "http"
+	TransferEventSinkFile = "file"
+)
+
+const transferEventLogSender = "TransferEvent"
+
+// TransferEventsConfig defines the configuration for the events published
+// each time an upload or a download completes
+type TransferEventsConfig struct {
+	// Sink for the transfer events. Supported values: "log", "http", "file".
+	// Leave empty to disable
+	Sink string `json:"sink" mapstructure:"sink"`
+	// HTTP URL for the "http" sink or absolute path to a file for the "file" sink.
+	// Ignored for the "log" sink
+	Target string `json:"target" mapstructure:"target"`
+}
+
+func (c *TransferEventsConfig) getSink() (TransferEventSink, error) {
+	switch c.Sink {
+	case "":
+		return nil, nil
+	case TransferEventSinkLog:
+		return &logTransferEventSink{}, nil
+	case TransferEventSinkHTTP:
+		u, err := url.Parse(c.Target)
+		if err != nil || !strings.HasPrefix(u.Scheme, "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %#v for the transfer events http sink", c.Target)
+		}
+		return &httpTransferEventSink{url: c.Target}, nil
+	case TransferEventSinkFile:
+		if !filepath.IsAbs(c.Target) {
+			return nil, fmt.Errorf("invalid path %#v for the transfer events file sink, it must be absolute", c.Target)
+		}
+		return &fileTransferEventSink{path: c.Target}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transfer events sink %#v", c.Sink)
+	}
+}
+
+// TransferEvent defines a completed upload or download
+type TransferEvent struct {
+	Timestamp    int64  `json:"timestamp"`
+	Operation    string `json:"operation"`
+	Username     string `json:"username"`
+	Path         string `json:"path"`
+	VirtualPath  string `json:"virtual_path"`
+	Protocol     string `json:"protocol"`
+	ConnectionID string `json:"connection_id"`
+	RemoteAddr   string `json:"remote_addr"`
+	// bytes transferred
+	Size int64 `json:"size"`
+	// transfer duration as milliseconds
+	Elapsed int64 `json:"elapsed"`
+	// checksum for the transferred data, if computed, prefixed with the hash algorithm,
+	// for example "sha256:<hex encoded hash>"
+	Checksum string `json:"checksum,omitempty"`
+	// 1 means no error, 2 means a transfer error
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// TransferEventSink defines the interface for transfer events consumers
+type TransferEventSink interface {
+	Publish(event *TransferEvent) error
+}
+
+var (
+	transferEventSinkMu sync.RWMutex
+	transferEventSink   TransferEventSink
+)
+
+// InitializeTransferEventSink sets the sink for transfer events,
+// nil disables the events.
+// It replaces the sink defined in the configuration, if any
+func InitializeTransferEventSink(sink TransferEventSink) {
+	transferEventSinkMu.Lock()
+	defer transferEventSinkMu.Unlock()
+
+	transferEventSink = sink
+}
+
+func publishTransferEvent(event *TransferEvent) {
+	transferEventSinkMu.RLock()
+	sink := transferEventSink
+	transferEventSinkMu.RUnlock()
+
+	if sink == nil {
+		return
+	}
+	if err := sink.Publish(event); err != nil {
+		logger.Warn(transferEventLogSender, event.ConnectionID, "unable to publish transfer event for %#v: %v",
+			event.Path, err)
+	}
+}
+
+type logTransferEventSink struct{}
+
+func (s *logTransferEventSink) Publish(event *TransferEvent) error {
+	logger.Info(transferEventLogSender, event.ConnectionID, "operation: %v, user: %#v, path: %#v, protocol: %v, "+
+		"size: %v, elapsed: %v ms, checksum: %#v, status: %v, error: %#v", event.Operation, event.Username,
+		event.Path, event.Protocol, event.Size, event.Elapsed, event.Checksum, event.Status, event.Error)
+	return nil
+}
+
+type httpTransferEventSink struct {
+	url string
+}
+
+// Publish sends the event asynchronously, this way slow endpoints
+// cannot delay the transfer completion
+func (s *httpTransferEventSink) Publish(event *TransferEvent) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(event); err != nil {
+		return err
+	}
+
+	go func() {
+		startTime := time.Now()
+		respCode := 0
+
+		resp, err := httpclient.RetryablePost(s.url, "application/json", &b)
+		if err == nil {
+			respCode = resp.StatusCode
+			resp.Body.Close()
+
+			if respCode != http.StatusOK {
+				err = errUnexpectedHTTResponse
+			}
+		}
+		logger.Debug(transferEventLogSender, event.ConnectionID, "transfer event for %#v sent, status code: %v, "+
+			"elapsed: %v, err: %v", event.Path, respCode, time.Since(startTime), err)
+	}()
+
+	return nil
+}
+
+type fileTransferEventSink struct {
+	sync.Mutex
+	path string
+}
+
+// Publish appends the event, JSON encoded, as a new line to the configured file
+func (s *fileTransferEventSink) Publish(event *TransferEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/metric"
+)
+
+// transfersLimiter limits the number of concurrent transfers server wide.
+// Transfers waiting for a free slot are queued for at most the configured
+// timeout
+type transfersLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	queued  int32
+}
+
+func newTransfersLimiter(maxTransfers int, timeout time.Duration) *transfersLimiter {
+	return &transfersLimiter{
+		slots:   make(chan struct{}, maxTransfers),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free slot. It returns ErrServerBusy if no slot
+// becomes available within the configured timeout
+func (l *transfersLimiter) acquire() error {
+	select {
+	case l.slots <- struct{}{}:
+		l.updateMetrics()
+		return nil
+	default:
+	}
+	if l.timeout <= 0 {
+		return ErrServerBusy
+	}
+
+	atomic.AddInt32(&l.queued, 1)
+	l.updateMetrics()
+	defer func() {
+		atomic.AddInt32(&l.queued, -1)
+		l.updateMetrics()
+	}()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrServerBusy
+	}
+}
+
+func (l *transfersLimiter) release() {
+	select {
+	case <-l.slots:
+	default:
+	}
+	l.updateMetrics()
+}
+
+func (l *transfersLimiter) getActive() int {
+	return len(l.slots)
+}
+
+func (l *transfersLimiter) getQueued() int {
+	return int(atomic.LoadInt32(&l.queued))
+}
+
+func (l *transfersLimiter) updateMetrics() {
+	metric.UpdateTransfersSlots(l.getActive(), l.getQueued())
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/httpd"
 	"github.com/drakkan/sftpgo/v2/kms"
 	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/metric"
 	"github.com/drakkan/sftpgo/v2/sdk/plugin"
 	"github.com/drakkan/sftpgo/v2/sftpd"
 	"github.com/drakkan/sftpgo/v2/telemetry"
@@ -44,6 +45,10 @@ var (
 		Address:          "",
 		Port:             2022,
 		ApplyProxyConfig: true,
+		SecurityProfile:  "",
+		KexAlgorithms:    nil,
+		Ciphers:          nil,
+		MACs:             nil,
 	}
 	defaultFTPDBinding = ftpd.Binding{
 		Address:                    "",
@@ -56,6 +61,8 @@ var (
 		PassiveConnectionsSecurity: 0,
 		ActiveConnectionsSecurity:  0,
 		Debug:                      false,
+		SecurityProfile:            "",
+		MinTLSVersion:              0,
 	}
 	defaultWebDAVDBinding = webdavd.Binding{
 		Address:         "",
@@ -120,28 +127,78 @@ func Init() {
 				ExecuteSync: []string{},
 				Hook:        "",
 			},
-			SetstatMode:           0,
-			TempPath:              "",
-			ProxyProtocol:         0,
-			ProxyAllowed:          []string{},
-			PostConnectHook:       "",
-			MaxTotalConnections:   0,
-			MaxPerHostConnections: 20,
+			SetstatMode:             0,
+			TempPath:                "",
+			ProxyProtocol:           0,
+			ProxyAllowed:            []string{},
+			PostConnectHook:         "",
+			MaxTotalConnections:     0,
+			MaxPerHostConnections:   20,
+			MaxConcurrentTransfers:  0,
+			TransfersQueueTimeout:   10,
+			BandwidthRampUp:         0,
+			QuotaScanTransfersGrace: 0,
+			AcceptAllowListFile:     "",
 			DefenderConfig: common.DefenderConfig{
-				Enabled:            false,
-				BanTime:            30,
-				BanTimeIncrement:   50,
-				Threshold:          15,
-				ScoreInvalid:       2,
-				ScoreValid:         1,
-				ScoreLimitExceeded: 3,
-				ObservationTime:    30,
-				EntriesSoftLimit:   100,
-				EntriesHardLimit:   150,
-				SafeListFile:       "",
-				BlockListFile:      "",
+				Enabled:              false,
+				Driver:               common.DefenderDriverMemory,
+				BanTime:              30,
+				BanTimeIncrement:     50,
+				Threshold:            15,
+				ScoreInvalid:         2,
+				ScoreValid:           1,
+				ScoreLimitExceeded:   3,
+				ScoreAbusiveActivity: 0,
+				AbusiveDownloads:     0,
+				AbusiveListings:      0,
+				ObservationTime:      30,
+				EntriesSoftLimit:     100,
+				EntriesHardLimit:     150,
+				IPv6SubnetBits:       64,
+				IPv4SubnetBits:       32,
+				SafeListFile:         "",
+				BlockListFile:        "",
+				ListsCheckInterval:   0,
+				ListsRefreshInterval: 0,
+				ListsURLTimeout:      10,
+				ReputationHook:       "",
+				ReputationCacheTime:  300,
+				BanHook:              "",
+				BanHookOnUnban:       false,
+				LoginGraceTime:       0,
+				LoginGraceThreshold:  0,
+				ThrottleMaxDelay:     0,
+				ThrottleStartScore:   0,
+				ThrottleCurve:        common.ThrottleCurveLinear,
+				Redis: common.DefenderRedisConfig{
+					Address:  "",
+					Password: "",
+					DB:       0,
+					Prefix:   "sftpgo_defender:",
+				},
 			},
 			RateLimitersConfig: []common.RateLimiterConfig{defaultRateLimiter},
+			DefaultQuota: common.DefaultQuotaConfig{
+				Enabled:    false,
+				QuotaSize:  0,
+				QuotaFiles: 0,
+			},
+			TransferEvents: common.TransferEventsConfig{
+				Sink:   "",
+				Target: "",
+			},
+			Banners: common.BannersConfig{
+				SSH:  "",
+				FTP:  "",
+				HTTP: "",
+			},
+			QuotaDrift: common.QuotaDriftConfig{
+				CheckInterval:  0,
+				BatchSize:      50,
+				FilesThreshold: 0,
+				SizeThreshold:  0,
+				AutoCorrect:    false,
+			},
 		},
 		SFTPD: sftpd.Configuration{
 			Banner:                  defaultSFTPDBanner,
@@ -203,30 +260,36 @@ func Init() {
 			},
 		},
 		ProviderConf: dataprovider.Config{
-			Driver:           "sqlite",
-			Name:             "sftpgo.db",
-			Host:             "",
-			Port:             0,
-			Username:         "",
-			Password:         "",
-			ConnectionString: "",
-			SQLTablesPrefix:  "",
-			SSLMode:          0,
-			TrackQuota:       1,
-			PoolSize:         0,
-			UsersBaseDir:     "",
+			Driver:                  "sqlite",
+			Name:                    "sftpgo.db",
+			Host:                    "",
+			Port:                    0,
+			Username:                "",
+			Password:                "",
+			ConnectionString:        "",
+			SQLTablesPrefix:         "",
+			SSLMode:                 0,
+			TrackQuota:              1,
+			PoolSize:                0,
+			UsersBaseDir:            "",
+			HomeSkeleton:            []string{},
+			DefaultFilesystemFile:   "",
+			AllowedHomeBaseDirs:     []string{},
+			DenyOverlappingHomeDirs: false,
+			MaxUserVirtualFolders:   0,
 			Actions: dataprovider.UserActions{
 				ExecuteOn: []string{},
 				Hook:      "",
 			},
-			ExternalAuthHook:   "",
-			ExternalAuthScope:  0,
-			CredentialsPath:    "credentials",
-			PreLoginHook:       "",
-			PostLoginHook:      "",
-			PostLoginScope:     0,
-			CheckPasswordHook:  "",
-			CheckPasswordScope: 0,
+			ExternalAuthHook:      "",
+			ExternalAuthScope:     0,
+			ExternalAuthCacheTime: 0,
+			CredentialsPath:       "credentials",
+			PreLoginHook:          "",
+			PostLoginHook:         "",
+			PostLoginScope:        0,
+			CheckPasswordHook:     "",
+			CheckPasswordScope:    0,
 			PasswordHashing: dataprovider.PasswordHashing{
 				Argon2Options: dataprovider.Argon2Options{
 					Memory:      65536,
@@ -252,6 +315,16 @@ func Init() {
 			SkipNaturalKeysValidation: false,
 			DelayedQuotaUpdate:        0,
 			CreateDefaultAdmin:        false,
+			UsersExpiration: dataprovider.UsersExpirationConfig{
+				CheckInterval:  0,
+				WarningDays:    7,
+				DisableExpired: false,
+				Hook:           "",
+			},
+			UserPasswordChange: dataprovider.UserPasswordChangeConfig{
+				HistorySize:            0,
+				RequireCurrentPassword: true,
+			},
 		},
 		HTTPDConfig: httpd.Conf{
 			Bindings:           []httpd.Binding{defaultHTTPDBinding},
@@ -291,6 +364,12 @@ func Init() {
 			CertificateFile:    "",
 			CertificateKeyFile: "",
 			TLSCipherSuites:    nil,
+			OTLP: metric.OTLPConfig{
+				Endpoint:       "",
+				ExportInterval: 10,
+				ServiceName:    "sftpgo",
+				Headers:        nil,
+			},
 		},
 		PluginsConfig: nil,
 	}
@@ -415,6 +494,8 @@ func getRedactedGlobalConf() globalConfig {
 	conf.Common.StartupHook = util.GetRedactedURL(conf.Common.StartupHook)
 	conf.Common.PostConnectHook = util.GetRedactedURL(conf.Common.PostConnectHook)
 	conf.SFTPD.KeyboardInteractiveHook = util.GetRedactedURL(conf.SFTPD.KeyboardInteractiveHook)
+	conf.Common.DefenderConfig.Redis.Password = "[redacted]"
+	conf.Common.DefenderConfig.BanHook = util.GetRedactedURL(conf.Common.DefenderConfig.BanHook)
 	conf.HTTPDConfig.SigningPassphrase = "[redacted]"
 	conf.ProviderConf.Password = "[redacted]"
 	conf.ProviderConf.Actions.Hook = util.GetRedactedURL(conf.ProviderConf.Actions.Hook)
@@ -511,6 +592,7 @@ func LoadConfig(configDir, configFile string) error {
 func loadBindingsFromEnv() {
 	for idx := 0; idx < 10; idx++ {
 		getRateLimitersFromEnv(idx)
+		getDefenderProtocolScoresFromEnv(idx)
 		getPluginsFromEnv(idx)
 		getSFTPDBindindFromEnv(idx)
 		getFTPDBindingFromEnv(idx)
@@ -586,6 +668,53 @@ func getRateLimitersFromEnv(idx int) {
 	}
 }
 
+func getDefenderProtocolScoresFromEnv(idx int) {
+	scores := common.DefenderProtocolScores{}
+	if len(globalConf.Common.DefenderConfig.ProtocolScores) > idx {
+		scores = globalConf.Common.DefenderConfig.ProtocolScores[idx]
+	}
+
+	isSet := false
+
+	protocols, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__%v__PROTOCOLS", idx))
+	if ok {
+		scores.Protocols = protocols
+		isSet = true
+	}
+
+	scoreInvalid, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__%v__SCORE_INVALID", idx))
+	if ok {
+		scores.ScoreInvalid = int(scoreInvalid)
+		isSet = true
+	}
+
+	scoreValid, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__%v__SCORE_VALID", idx))
+	if ok {
+		scores.ScoreValid = int(scoreValid)
+		isSet = true
+	}
+
+	scoreLimitExceeded, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__%v__SCORE_LIMIT_EXCEEDED", idx))
+	if ok {
+		scores.ScoreLimitExceeded = int(scoreLimitExceeded)
+		isSet = true
+	}
+
+	scoreAbusiveActivity, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__%v__SCORE_ABUSIVE_ACTIVITY", idx))
+	if ok {
+		scores.ScoreAbusiveActivity = int(scoreAbusiveActivity)
+		isSet = true
+	}
+
+	if isSet {
+		if len(globalConf.Common.DefenderConfig.ProtocolScores) > idx {
+			globalConf.Common.DefenderConfig.ProtocolScores[idx] = scores
+		} else {
+			globalConf.Common.DefenderConfig.ProtocolScores = append(globalConf.Common.DefenderConfig.ProtocolScores, scores)
+		}
+	}
+}
+
 func getPluginsFromEnv(idx int) {
 	pluginConfig := plugin.Config{}
 	if len(globalConf.PluginsConfig) > idx {
@@ -695,6 +824,30 @@ func getSFTPDBindindFromEnv(idx int) {
 		isSet = true
 	}
 
+	securityProfile, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_SFTPD__BINDINGS__%v__SECURITY_PROFILE", idx))
+	if ok {
+		binding.SecurityProfile = securityProfile
+		isSet = true
+	}
+
+	kexAlgorithms, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_SFTPD__BINDINGS__%v__KEX_ALGORITHMS", idx))
+	if ok {
+		binding.KexAlgorithms = kexAlgorithms
+		isSet = true
+	}
+
+	ciphers, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_SFTPD__BINDINGS__%v__CIPHERS", idx))
+	if ok {
+		binding.Ciphers = ciphers
+		isSet = true
+	}
+
+	macs, ok := lookupStringListFromEnv(fmt.Sprintf("SFTPGO_SFTPD__BINDINGS__%v__MACS", idx))
+	if ok {
+		binding.MACs = macs
+		isSet = true
+	}
+
 	if isSet {
 		if len(globalConf.SFTPD.Bindings) > idx {
 			globalConf.SFTPD.Bindings[idx] = binding
@@ -774,6 +927,18 @@ func getFTPDBindingFromEnv(idx int) {
 		isSet = true
 	}
 
+	securityProfile, ok := os.LookupEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__SECURITY_PROFILE", idx))
+	if ok {
+		binding.SecurityProfile = securityProfile
+		isSet = true
+	}
+
+	minTLSVersion, ok := lookupIntFromEnv(fmt.Sprintf("SFTPGO_FTPD__BINDINGS__%v__MIN_TLS_VERSION", idx))
+	if ok {
+		binding.MinTLSVersion = int(minTLSVersion)
+		isSet = true
+	}
+
 	if isSet {
 		if len(globalConf.FTPD.Bindings) > idx {
 			globalConf.FTPD.Bindings[idx] = binding
@@ -978,18 +1143,58 @@ func setViperDefaults() {
 	viper.SetDefault("common.post_connect_hook", globalConf.Common.PostConnectHook)
 	viper.SetDefault("common.max_total_connections", globalConf.Common.MaxTotalConnections)
 	viper.SetDefault("common.max_per_host_connections", globalConf.Common.MaxPerHostConnections)
+	viper.SetDefault("common.max_concurrent_transfers", globalConf.Common.MaxConcurrentTransfers)
+	viper.SetDefault("common.transfers_queue_timeout", globalConf.Common.TransfersQueueTimeout)
+	viper.SetDefault("common.bandwidth_ramp_up", globalConf.Common.BandwidthRampUp)
+	viper.SetDefault("common.quota_scan_transfers_grace", globalConf.Common.QuotaScanTransfersGrace)
+	viper.SetDefault("common.accept_allowlist_file", globalConf.Common.AcceptAllowListFile)
 	viper.SetDefault("common.defender.enabled", globalConf.Common.DefenderConfig.Enabled)
+	viper.SetDefault("common.defender.driver", globalConf.Common.DefenderConfig.Driver)
+	viper.SetDefault("common.defender.redis.address", globalConf.Common.DefenderConfig.Redis.Address)
+	viper.SetDefault("common.defender.redis.password", globalConf.Common.DefenderConfig.Redis.Password)
+	viper.SetDefault("common.defender.redis.db", globalConf.Common.DefenderConfig.Redis.DB)
+	viper.SetDefault("common.defender.redis.prefix", globalConf.Common.DefenderConfig.Redis.Prefix)
 	viper.SetDefault("common.defender.ban_time", globalConf.Common.DefenderConfig.BanTime)
 	viper.SetDefault("common.defender.ban_time_increment", globalConf.Common.DefenderConfig.BanTimeIncrement)
 	viper.SetDefault("common.defender.threshold", globalConf.Common.DefenderConfig.Threshold)
 	viper.SetDefault("common.defender.score_invalid", globalConf.Common.DefenderConfig.ScoreInvalid)
 	viper.SetDefault("common.defender.score_valid", globalConf.Common.DefenderConfig.ScoreValid)
 	viper.SetDefault("common.defender.score_limit_exceeded", globalConf.Common.DefenderConfig.ScoreLimitExceeded)
+	viper.SetDefault("common.defender.score_abusive_activity", globalConf.Common.DefenderConfig.ScoreAbusiveActivity)
+	viper.SetDefault("common.defender.abusive_downloads", globalConf.Common.DefenderConfig.AbusiveDownloads)
+	viper.SetDefault("common.defender.abusive_listings", globalConf.Common.DefenderConfig.AbusiveListings)
 	viper.SetDefault("common.defender.observation_time", globalConf.Common.DefenderConfig.ObservationTime)
 	viper.SetDefault("common.defender.entries_soft_limit", globalConf.Common.DefenderConfig.EntriesSoftLimit)
 	viper.SetDefault("common.defender.entries_hard_limit", globalConf.Common.DefenderConfig.EntriesHardLimit)
+	viper.SetDefault("common.defender.ipv6_subnet_bits", globalConf.Common.DefenderConfig.IPv6SubnetBits)
+	viper.SetDefault("common.defender.ipv4_subnet_bits", globalConf.Common.DefenderConfig.IPv4SubnetBits)
 	viper.SetDefault("common.defender.safelist_file", globalConf.Common.DefenderConfig.SafeListFile)
 	viper.SetDefault("common.defender.blocklist_file", globalConf.Common.DefenderConfig.BlockListFile)
+	viper.SetDefault("common.defender.lists_check_interval", globalConf.Common.DefenderConfig.ListsCheckInterval)
+	viper.SetDefault("common.defender.lists_refresh_interval", globalConf.Common.DefenderConfig.ListsRefreshInterval)
+	viper.SetDefault("common.defender.lists_url_timeout", globalConf.Common.DefenderConfig.ListsURLTimeout)
+	viper.SetDefault("common.defender.reputation_hook", globalConf.Common.DefenderConfig.ReputationHook)
+	viper.SetDefault("common.defender.reputation_cache_time", globalConf.Common.DefenderConfig.ReputationCacheTime)
+	viper.SetDefault("common.defender.ban_hook", globalConf.Common.DefenderConfig.BanHook)
+	viper.SetDefault("common.defender.ban_hook_on_unban", globalConf.Common.DefenderConfig.BanHookOnUnban)
+	viper.SetDefault("common.defender.login_grace_time", globalConf.Common.DefenderConfig.LoginGraceTime)
+	viper.SetDefault("common.defender.login_grace_threshold", globalConf.Common.DefenderConfig.LoginGraceThreshold)
+	viper.SetDefault("common.defender.throttle_max_delay", globalConf.Common.DefenderConfig.ThrottleMaxDelay)
+	viper.SetDefault("common.defender.throttle_start_score", globalConf.Common.DefenderConfig.ThrottleStartScore)
+	viper.SetDefault("common.defender.throttle_curve", globalConf.Common.DefenderConfig.ThrottleCurve)
+	viper.SetDefault("common.default_quota.enabled", globalConf.Common.DefaultQuota.Enabled)
+	viper.SetDefault("common.default_quota.quota_size", globalConf.Common.DefaultQuota.QuotaSize)
+	viper.SetDefault("common.default_quota.quota_files", globalConf.Common.DefaultQuota.QuotaFiles)
+	viper.SetDefault("common.transfer_events.sink", globalConf.Common.TransferEvents.Sink)
+	viper.SetDefault("common.transfer_events.target", globalConf.Common.TransferEvents.Target)
+	viper.SetDefault("common.banners.ssh", globalConf.Common.Banners.SSH)
+	viper.SetDefault("common.banners.ftp", globalConf.Common.Banners.FTP)
+	viper.SetDefault("common.banners.http", globalConf.Common.Banners.HTTP)
+	viper.SetDefault("common.quota_drift.check_interval", globalConf.Common.QuotaDrift.CheckInterval)
+	viper.SetDefault("common.quota_drift.batch_size", globalConf.Common.QuotaDrift.BatchSize)
+	viper.SetDefault("common.quota_drift.files_threshold", globalConf.Common.QuotaDrift.FilesThreshold)
+	viper.SetDefault("common.quota_drift.size_threshold", globalConf.Common.QuotaDrift.SizeThreshold)
+	viper.SetDefault("common.quota_drift.auto_correct", globalConf.Common.QuotaDrift.AutoCorrect)
 	viper.SetDefault("sftpd.max_auth_tries", globalConf.SFTPD.MaxAuthTries)
 	viper.SetDefault("sftpd.banner", globalConf.SFTPD.Banner)
 	viper.SetDefault("sftpd.host_keys", globalConf.SFTPD.HostKeys)
@@ -1042,10 +1247,16 @@ func setViperDefaults() {
 	viper.SetDefault("data_provider.track_quota", globalConf.ProviderConf.TrackQuota)
 	viper.SetDefault("data_provider.pool_size", globalConf.ProviderConf.PoolSize)
 	viper.SetDefault("data_provider.users_base_dir", globalConf.ProviderConf.UsersBaseDir)
+	viper.SetDefault("data_provider.home_skeleton", globalConf.ProviderConf.HomeSkeleton)
+	viper.SetDefault("data_provider.default_filesystem_file", globalConf.ProviderConf.DefaultFilesystemFile)
+	viper.SetDefault("data_provider.allowed_home_base_dirs", globalConf.ProviderConf.AllowedHomeBaseDirs)
+	viper.SetDefault("data_provider.deny_overlapping_home_dirs", globalConf.ProviderConf.DenyOverlappingHomeDirs)
+	viper.SetDefault("data_provider.max_user_virtual_folders", globalConf.ProviderConf.MaxUserVirtualFolders)
 	viper.SetDefault("data_provider.actions.execute_on", globalConf.ProviderConf.Actions.ExecuteOn)
 	viper.SetDefault("data_provider.actions.hook", globalConf.ProviderConf.Actions.Hook)
 	viper.SetDefault("data_provider.external_auth_hook", globalConf.ProviderConf.ExternalAuthHook)
 	viper.SetDefault("data_provider.external_auth_scope", globalConf.ProviderConf.ExternalAuthScope)
+	viper.SetDefault("data_provider.external_auth_cache_time", globalConf.ProviderConf.ExternalAuthCacheTime)
 	viper.SetDefault("data_provider.credentials_path", globalConf.ProviderConf.CredentialsPath)
 	viper.SetDefault("data_provider.prefer_database_credentials", globalConf.ProviderConf.PreferDatabaseCredentials)
 	viper.SetDefault("data_provider.pre_login_hook", globalConf.ProviderConf.PreLoginHook)
@@ -1065,6 +1276,13 @@ func setViperDefaults() {
 	viper.SetDefault("data_provider.skip_natural_keys_validation", globalConf.ProviderConf.SkipNaturalKeysValidation)
 	viper.SetDefault("data_provider.delayed_quota_update", globalConf.ProviderConf.DelayedQuotaUpdate)
 	viper.SetDefault("data_provider.create_default_admin", globalConf.ProviderConf.CreateDefaultAdmin)
+	viper.SetDefault("data_provider.users_expiration.check_interval", globalConf.ProviderConf.UsersExpiration.CheckInterval)
+	viper.SetDefault("data_provider.users_expiration.warning_days", globalConf.ProviderConf.UsersExpiration.WarningDays)
+	viper.SetDefault("data_provider.users_expiration.disable_expired", globalConf.ProviderConf.UsersExpiration.DisableExpired)
+	viper.SetDefault("data_provider.users_expiration.hook", globalConf.ProviderConf.UsersExpiration.Hook)
+	viper.SetDefault("data_provider.user_password_change.history_size", globalConf.ProviderConf.UserPasswordChange.HistorySize)
+	viper.SetDefault("data_provider.user_password_change.require_current_password",
+		globalConf.ProviderConf.UserPasswordChange.RequireCurrentPassword)
 	viper.SetDefault("httpd.templates_path", globalConf.HTTPDConfig.TemplatesPath)
 	viper.SetDefault("httpd.static_files_path", globalConf.HTTPDConfig.StaticFilesPath)
 	viper.SetDefault("httpd.backups_path", globalConf.HTTPDConfig.BackupsPath)
@@ -1091,6 +1309,10 @@ func setViperDefaults() {
 	viper.SetDefault("telemetry.certificate_file", globalConf.TelemetryConfig.CertificateFile)
 	viper.SetDefault("telemetry.certificate_key_file", globalConf.TelemetryConfig.CertificateKeyFile)
 	viper.SetDefault("telemetry.tls_cipher_suites", globalConf.TelemetryConfig.TLSCipherSuites)
+	viper.SetDefault("telemetry.otlp.endpoint", globalConf.TelemetryConfig.OTLP.Endpoint)
+	viper.SetDefault("telemetry.otlp.export_interval", globalConf.TelemetryConfig.OTLP.ExportInterval)
+	viper.SetDefault("telemetry.otlp.service_name", globalConf.TelemetryConfig.OTLP.ServiceName)
+	viper.SetDefault("telemetry.otlp.headers", globalConf.TelemetryConfig.OTLP.Headers)
 }
 
 func lookupBoolFromEnv(envName string) (bool, bool) {
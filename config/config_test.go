@@ -484,6 +484,41 @@ func TestRateLimitersFromEnv(t *testing.T) {
 	require.Equal(t, 150, limiters[1].EntriesHardLimit)
 }
 
+func TestDefenderProtocolScoresFromEnv(t *testing.T) {
+	reset()
+
+	os.Setenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__PROTOCOLS", "FTP, DAV")
+	os.Setenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_INVALID", "5")
+	os.Setenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_VALID", "4")
+	os.Setenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_LIMIT_EXCEEDED", "6")
+	os.Setenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_ABUSIVE_ACTIVITY", "7")
+	os.Setenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__3__PROTOCOLS", "HTTP")
+	t.Cleanup(func() {
+		os.Unsetenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__PROTOCOLS")
+		os.Unsetenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_INVALID")
+		os.Unsetenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_VALID")
+		os.Unsetenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_LIMIT_EXCEEDED")
+		os.Unsetenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__0__SCORE_ABUSIVE_ACTIVITY")
+		os.Unsetenv("SFTPGO_COMMON__DEFENDER__PROTOCOL_SCORES__3__PROTOCOLS")
+	})
+
+	configDir := ".."
+	err := config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	scores := config.GetCommonConfig().DefenderConfig.ProtocolScores
+	require.Len(t, scores, 2)
+	protocols := scores[0].Protocols
+	require.Len(t, protocols, 2)
+	require.True(t, util.IsStringInSlice(common.ProtocolFTP, protocols))
+	require.True(t, util.IsStringInSlice(common.ProtocolWebDAV, protocols))
+	require.Equal(t, 5, scores[0].ScoreInvalid)
+	require.Equal(t, 4, scores[0].ScoreValid)
+	require.Equal(t, 6, scores[0].ScoreLimitExceeded)
+	require.Equal(t, 7, scores[0].ScoreAbusiveActivity)
+	require.Equal(t, []string{common.ProtocolHTTP}, scores[1].Protocols)
+	require.Equal(t, 0, scores[1].ScoreInvalid)
+}
+
 func TestSFTPDBindingsFromEnv(t *testing.T) {
 	reset()
 
@@ -492,12 +527,18 @@ func TestSFTPDBindingsFromEnv(t *testing.T) {
 	os.Setenv("SFTPGO_SFTPD__BINDINGS__0__APPLY_PROXY_CONFIG", "false")
 	os.Setenv("SFTPGO_SFTPD__BINDINGS__3__ADDRESS", "127.0.1.1")
 	os.Setenv("SFTPGO_SFTPD__BINDINGS__3__PORT", "2203")
+	os.Setenv("SFTPGO_SFTPD__BINDINGS__3__SECURITY_PROFILE", "strong")
+	os.Setenv("SFTPGO_SFTPD__BINDINGS__3__CIPHERS", "aes128-gcm@openssh.com,aes256-gcm@openssh.com")
+	os.Setenv("SFTPGO_SFTPD__BINDINGS__3__MACS", "hmac-sha2-256-etm@openssh.com")
 	t.Cleanup(func() {
 		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__0__ADDRESS")
 		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__0__PORT")
 		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__0__APPLY_PROXY_CONFIG")
 		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__3__ADDRESS")
 		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__3__PORT")
+		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__3__SECURITY_PROFILE")
+		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__3__CIPHERS")
+		os.Unsetenv("SFTPGO_SFTPD__BINDINGS__3__MACS")
 	})
 
 	configDir := ".."
@@ -511,6 +552,12 @@ func TestSFTPDBindingsFromEnv(t *testing.T) {
 	require.Equal(t, 2203, bindings[1].Port)
 	require.Equal(t, "127.0.1.1", bindings[1].Address)
 	require.True(t, bindings[1].ApplyProxyConfig) // default value
+	require.Empty(t, bindings[0].SecurityProfile)
+	require.Equal(t, "strong", bindings[1].SecurityProfile)
+	require.Len(t, bindings[1].Ciphers, 2)
+	require.Equal(t, "aes256-gcm@openssh.com", bindings[1].Ciphers[1])
+	require.Len(t, bindings[1].MACs, 1)
+	require.Nil(t, bindings[1].KexAlgorithms)
 }
 
 func TestFTPDBindingsFromEnv(t *testing.T) {
@@ -530,6 +577,8 @@ func TestFTPDBindingsFromEnv(t *testing.T) {
 	os.Setenv("SFTPGO_FTPD__BINDINGS__9__CLIENT_AUTH_TYPE", "2")
 	os.Setenv("SFTPGO_FTPD__BINDINGS__9__DEBUG", "1")
 	os.Setenv("SFTPGO_FTPD__BINDINGS__9__ACTIVE_CONNECTIONS_SECURITY", "1")
+	os.Setenv("SFTPGO_FTPD__BINDINGS__9__SECURITY_PROFILE", "strong")
+	os.Setenv("SFTPGO_FTPD__BINDINGS__9__MIN_TLS_VERSION", "13")
 
 	t.Cleanup(func() {
 		os.Unsetenv("SFTPGO_FTPD__BINDINGS__0__ADDRESS")
@@ -546,6 +595,8 @@ func TestFTPDBindingsFromEnv(t *testing.T) {
 		os.Unsetenv("SFTPGO_FTPD__BINDINGS__9__CLIENT_AUTH_TYPE")
 		os.Unsetenv("SFTPGO_FTPD__BINDINGS__9__DEBUG")
 		os.Unsetenv("SFTPGO_FTPD__BINDINGS__9__ACTIVE_CONNECTIONS_SECURITY")
+		os.Unsetenv("SFTPGO_FTPD__BINDINGS__9__SECURITY_PROFILE")
+		os.Unsetenv("SFTPGO_FTPD__BINDINGS__9__MIN_TLS_VERSION")
 	})
 
 	configDir := ".."
@@ -575,6 +626,9 @@ func TestFTPDBindingsFromEnv(t *testing.T) {
 	require.Equal(t, 0, bindings[1].PassiveConnectionsSecurity)
 	require.Equal(t, 1, bindings[1].ActiveConnectionsSecurity)
 	require.True(t, bindings[1].Debug)
+	require.Equal(t, 0, bindings[0].MinTLSVersion)
+	require.Equal(t, "strong", bindings[1].SecurityProfile)
+	require.Equal(t, 13, bindings[1].MinTLSVersion)
 }
 
 func TestWebDAVBindingsFromEnv(t *testing.T) {
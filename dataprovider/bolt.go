@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -23,11 +24,13 @@ const (
 )
 
 var (
-	usersBucket     = []byte("users")
-	foldersBucket   = []byte("folders")
-	adminsBucket    = []byte("admins")
-	dbVersionBucket = []byte("db_version")
-	dbVersionKey    = []byte("version")
+	usersBucket         = []byte("users")
+	foldersBucket       = []byte("folders")
+	adminsBucket        = []byte("admins")
+	usersMetadataBucket = []byte("users_metadata")
+	defenderHostsBucket = []byte("defender_hosts")
+	dbVersionBucket     = []byte("db_version")
+	dbVersionKey        = []byte("version")
 )
 
 // BoltProvider auth provider for bolt key/value store
@@ -83,6 +86,22 @@ func initializeBoltProvider(basePath string) error {
 			providerLog(logger.LevelWarn, "error creating admins bucket: %v", err)
 			return err
 		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(usersMetadataBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating users metadata bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(defenderHostsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating defender hosts bucket: %v", err)
+			return err
+		}
 		err = dbHandle.Update(func(tx *bolt.Tx) error {
 			_, e := tx.CreateBucketIfNotExists(dbVersionBucket)
 			return e
@@ -182,6 +201,54 @@ func (p *BoltProvider) updateLastLogin(username string) error {
 	})
 }
 
+func (p *BoltProvider) getUserPasswordHistory(username string) ([]string, error) {
+	var history []string
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		u := bucket.Get([]byte(username))
+		if u == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		history = user.PasswordHistory
+		return nil
+	})
+	return history, err
+}
+
+func (p *BoltProvider) updateUserPassword(username, password string, history []string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist, unable to update the password", username))
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		user.Password = password
+		user.PasswordHistory = history
+		user.Version++
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
 func (p *BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, err := getUsersBucket(tx)
@@ -216,6 +283,40 @@ func (p *BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64,
 	})
 }
 
+func (p *BoltProvider) reserveQuota(username string, sizeAdd, maxSize int64) (bool, error) {
+	reserved := false
+	err := p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist, unable to reserve quota", username))
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if user.UsedQuotaSize+sizeAdd > maxSize {
+			return nil
+		}
+		user.UsedQuotaSize += sizeAdd
+		user.LastQuotaUpdate = util.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(username), buf)
+		reserved = err == nil
+		return err
+	})
+	providerLog(logger.LevelDebug, "quota reservation for user %#v, size: %v max size: %v, reserved? %v err: %v",
+		username, sizeAdd, maxSize, reserved, err)
+	return reserved, err
+}
+
 func (p *BoltProvider) getUsedQuota(username string) (int, int64, error) {
 	user, err := p.userExists(username)
 	if err != nil {
@@ -314,6 +415,32 @@ func (p *BoltProvider) deleteAdmin(admin *Admin) error {
 	})
 }
 
+func (p *BoltProvider) countAdmins(filter CountFilter) (int64, error) {
+	var count int64
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAdminsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if filter == CountAll {
+			count = int64(bucket.Stats().KeyN)
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var admin Admin
+			if err := json.Unmarshal(v, &admin); err != nil {
+				return err
+			}
+			if filter.matchesAdmin(&admin) {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
 func (p *BoltProvider) getAdmins(limit int, offset int, order string) ([]Admin, error) {
 	admins := make([]Admin, 0, limit)
 
@@ -435,13 +562,15 @@ func (p *BoltProvider) addUser(user *User) error {
 		user.UsedQuotaSize = 0
 		user.UsedQuotaFiles = 0
 		user.LastLogin = 0
+		user.PasswordHistory = nil
+		user.Version = 1
 		for idx := range user.VirtualFolders {
 			err = addUserToFolderMapping(&user.VirtualFolders[idx].BaseVirtualFolder, user, folderBucket)
 			if err != nil {
 				return err
 			}
 		}
-		buf, err := json.Marshal(user)
+		buf, err := marshalUserWithoutMetadata(user)
 		if err != nil {
 			return err
 		}
@@ -472,6 +601,10 @@ func (p *BoltProvider) updateUser(user *User) error {
 		if err != nil {
 			return err
 		}
+		if user.Version > 0 && oldUser.Version != user.Version {
+			return util.NewConflictError(fmt.Sprintf("user %#v was modified by someone else, version %v is outdated",
+				user.Username, user.Version))
+		}
 		for idx := range oldUser.VirtualFolders {
 			err = removeUserFromFolderMapping(&oldUser.VirtualFolders[idx], &oldUser, folderBucket)
 			if err != nil {
@@ -489,7 +622,9 @@ func (p *BoltProvider) updateUser(user *User) error {
 		user.UsedQuotaSize = oldUser.UsedQuotaSize
 		user.UsedQuotaFiles = oldUser.UsedQuotaFiles
 		user.LastLogin = oldUser.LastLogin
-		buf, err := json.Marshal(user)
+		user.PasswordHistory = oldUser.PasswordHistory
+		user.Version = oldUser.Version + 1
+		buf, err := marshalUserWithoutMetadata(user)
 		if err != nil {
 			return err
 		}
@@ -519,10 +654,74 @@ func (p *BoltProvider) deleteUser(user *User) error {
 		if exists == nil {
 			return util.NewRecordNotFoundError(fmt.Sprintf("user %#v does not exist", user.Username))
 		}
+		metadataBucket, err := getUsersMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		if err := metadataBucket.Delete([]byte(user.Username)); err != nil {
+			return err
+		}
 		return bucket.Delete([]byte(user.Username))
 	})
 }
 
+func (p *BoltProvider) renameUser(oldUsername string, renamedUser *User) error {
+	newUsername := renamedUser.Username
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(oldUsername)); u == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", oldUsername))
+		}
+		if bucket.Get([]byte(newUsername)) != nil {
+			return util.NewValidationError(fmt.Sprintf("username %#v already exists", newUsername))
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if len(user.VirtualFolders) > 0 {
+			folderBucket, err := getFoldersBucket(tx)
+			if err != nil {
+				return err
+			}
+			for idx := range user.VirtualFolders {
+				err = renameUserInFolderMapping(&user.VirtualFolders[idx], oldUsername, newUsername, folderBucket)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		metadataBucket, err := getUsersMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		if m := metadataBucket.Get([]byte(oldUsername)); m != nil {
+			if err := metadataBucket.Put([]byte(newUsername), m); err != nil {
+				return err
+			}
+			if err := metadataBucket.Delete([]byte(oldUsername)); err != nil {
+				return err
+			}
+		}
+		user.Username = newUsername
+		user.FsConfig = renamedUser.FsConfig
+		user.ProtocolFilesystems = renamedUser.ProtocolFilesystems
+		buf, err := marshalUserWithoutMetadata(&user)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(newUsername), buf); err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(oldUsername))
+	})
+}
+
 func (p *BoltProvider) dumpUsers() ([]User, error) {
 	users := make([]User, 0, 100)
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
@@ -534,6 +733,10 @@ func (p *BoltProvider) dumpUsers() ([]User, error) {
 		if err != nil {
 			return err
 		}
+		metadataBucket, err := getUsersMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
 		cursor := bucket.Cursor()
 		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
 			user, err := joinUserAndFolders(v, folderBucket)
@@ -544,6 +747,12 @@ func (p *BoltProvider) dumpUsers() ([]User, error) {
 			if err != nil {
 				return err
 			}
+			if m := metadataBucket.Get(k); m != nil {
+				err = json.Unmarshal(m, &user.Metadata)
+				if err != nil {
+					return err
+				}
+			}
 			users = append(users, user)
 		}
 		return err
@@ -604,6 +813,188 @@ func (p *BoltProvider) getUsers(limit int, offset int, order string) ([]User, er
 	return users, err
 }
 
+func (p *BoltProvider) getUserMetadata(username string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		if u := bucket.Get([]byte(username)); u == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+		}
+		metadataBucket, err := getUsersMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		m := metadataBucket.Get([]byte(username))
+		if m == nil {
+			return nil
+		}
+		return json.Unmarshal(m, &metadata)
+	})
+	return metadata, err
+}
+
+func (p *BoltProvider) setUserMetadata(username string, metadata map[string]string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		if u := bucket.Get([]byte(username)); u == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+		}
+		metadataBucket, err := getUsersMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		if len(metadata) == 0 {
+			return metadataBucket.Delete([]byte(username))
+		}
+		buf, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		return metadataBucket.Put([]byte(username), buf)
+	})
+}
+
+func (p *BoltProvider) getUsersByUsernames(usernames []string) ([]User, error) {
+	users := make([]User, 0, len(usernames))
+	sortedUsernames := make([]string, len(usernames))
+	copy(sortedUsernames, usernames)
+	sort.Strings(sortedUsernames)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		folderBucket, err := getFoldersBucket(tx)
+		if err != nil {
+			return err
+		}
+		for _, username := range sortedUsernames {
+			u := bucket.Get([]byte(username))
+			if u == nil {
+				continue
+			}
+			user, err := joinUserAndFolders(u, folderBucket)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return nil
+	})
+	return users, err
+}
+
+func (p *BoltProvider) countUsers(filter CountFilter) (int64, error) {
+	var count int64
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		if filter == CountAll {
+			count = int64(bucket.Stats().KeyN)
+			return nil
+		}
+		now := util.GetTimeAsMsSinceEpoch(time.Now())
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			if filter.matchesUser(&user, now) {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (p *BoltProvider) getExpiringUsers(expirationBefore int64) ([]User, error) {
+	users := make([]User, 0, 10)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		folderBucket, err := getFoldersBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			if user.Status != 1 || user.ExpirationDate <= 0 || user.ExpirationDate > expirationBefore {
+				continue
+			}
+			user, err = joinUserAndFolders(v, folderBucket)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return nil
+	})
+	return users, err
+}
+
+func (p *BoltProvider) getUsersByMetadata(key, value string, limit, offset int, order string) ([]User, error) {
+	users := make([]User, 0, limit)
+	var err error
+	if limit <= 0 {
+		return users, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		folderBucket, err := getFoldersBucket(tx)
+		if err != nil {
+			return err
+		}
+		metadataBucket, err := getUsersMetadataBucket(tx)
+		if err != nil {
+			return err
+		}
+		var usernames []string
+		cursor := metadataBucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var metadata map[string]string
+			if err := json.Unmarshal(v, &metadata); err != nil {
+				return err
+			}
+			if isMetadataMatching(metadata, key, value) {
+				usernames = append(usernames, string(k))
+			}
+		}
+		for _, username := range getOrderedPage(usernames, limit, offset, order) {
+			u := bucket.Get([]byte(username))
+			if u == nil {
+				continue
+			}
+			user, err := joinUserAndFolders(u, folderBucket)
+			if err != nil {
+				return err
+			}
+			user.PrepareForRendering()
+			users = append(users, user)
+		}
+		return nil
+	})
+	return users, err
+}
+
 func (p *BoltProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	folders := make([]vfs.BaseVirtualFolder, 0, 50)
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
@@ -678,6 +1069,67 @@ func (p *BoltProvider) getFolders(limit, offset int, order string) ([]vfs.BaseVi
 	return folders, err
 }
 
+func (p *BoltProvider) getOrphanedFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error) {
+	folders := make([]vfs.BaseVirtualFolder, 0, limit)
+	var err error
+	if limit <= 0 {
+		return folders, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getFoldersBucket(tx)
+		if err != nil {
+			return err
+		}
+		orphaned := make(map[string]vfs.BaseVirtualFolder)
+		var names []string
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var folder vfs.BaseVirtualFolder
+			err = json.Unmarshal(v, &folder)
+			if err != nil {
+				return err
+			}
+			if len(folder.Users) == 0 {
+				orphaned[folder.Name] = folder
+				names = append(names, folder.Name)
+			}
+		}
+		for _, name := range getOrderedPage(names, limit, offset, order) {
+			folder := orphaned[name]
+			folder.PrepareForRendering()
+			folders = append(folders, folder)
+		}
+		return nil
+	})
+	return folders, err
+}
+
+func (p *BoltProvider) countFolders(filter CountFilter) (int64, error) {
+	var count int64
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getFoldersBucket(tx)
+		if err != nil {
+			return err
+		}
+		if filter == CountAll {
+			count = int64(bucket.Stats().KeyN)
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var folder vfs.BaseVirtualFolder
+			if err := json.Unmarshal(v, &folder); err != nil {
+				return err
+			}
+			if len(folder.Users) == 0 {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
 func (p *BoltProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
 	var folder vfs.BaseVirtualFolder
 	err := p.dbHandle.View(func(tx *bolt.Tx) error {
@@ -824,6 +1276,220 @@ func (p *BoltProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int6
 	})
 }
 
+func (p *BoltProvider) reserveFolderQuota(name string, sizeAdd, maxSize int64) (bool, error) {
+	reserved := false
+	err := p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getFoldersBucket(tx)
+		if err != nil {
+			return err
+		}
+		var f []byte
+		if f = bucket.Get([]byte(name)); f == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("folder %#v does not exist, unable to reserve quota", name))
+		}
+		var folder vfs.BaseVirtualFolder
+		err = json.Unmarshal(f, &folder)
+		if err != nil {
+			return err
+		}
+		if folder.UsedQuotaSize+sizeAdd > maxSize {
+			return nil
+		}
+		folder.UsedQuotaSize += sizeAdd
+		folder.LastQuotaUpdate = util.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(folder)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(folder.Name), buf)
+		reserved = err == nil
+		return err
+	})
+	providerLog(logger.LevelDebug, "quota reservation for folder %#v, size: %v max size: %v, reserved? %v err: %v",
+		name, sizeAdd, maxSize, reserved, err)
+	return reserved, err
+}
+
+func (p *BoltProvider) getDefenderHosts(from int64, limit int) ([]DefenderHost, error) {
+	hosts := make([]DefenderHost, 0, 30)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var host DefenderHost
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+			if host.UpdatedAt >= from || host.IsBanned() {
+				hosts = append(hosts, host.getWithoutEvents(from))
+			}
+		}
+		return nil
+	})
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].UpdatedAt > hosts[j].UpdatedAt
+	})
+	if len(hosts) > limit {
+		hosts = hosts[:limit]
+	}
+	return hosts, err
+}
+
+func (p *BoltProvider) getDefenderHostByIP(ip string, from int64) (DefenderHost, error) {
+	var host DefenderHost
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, err = getDefenderHostInternal(ip, bucket)
+		return err
+	})
+	if err != nil {
+		return host, err
+	}
+	return host.getWithoutEvents(from), nil
+}
+
+func (p *BoltProvider) isDefenderHostBanned(ip string) (DefenderHost, error) {
+	host, err := p.getDefenderHostByIP(ip, 0)
+	if err != nil {
+		if _, ok := err.(*util.RecordNotFoundError); ok {
+			return host, util.NewRecordNotFoundError(fmt.Sprintf("host %#v is not banned", ip))
+		}
+		return host, err
+	}
+	if !host.IsBanned() {
+		return host, util.NewRecordNotFoundError(fmt.Sprintf("host %#v is not banned", ip))
+	}
+	return host, nil
+}
+
+func (p *BoltProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, err := getDefenderHostInternal(ip, bucket)
+		if err != nil {
+			return err
+		}
+		host.BanTime += int64(minutes) * time.Minute.Milliseconds()
+		return putDefenderHost(&host, bucket)
+	})
+}
+
+func (p *BoltProvider) deleteDefenderHost(ip string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Get([]byte(ip)) == nil {
+			return util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+		}
+		return bucket.Delete([]byte(ip))
+	})
+}
+
+func (p *BoltProvider) addDefenderEvent(ip string, event DefenderEvent) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, err := getDefenderHostInternal(ip, bucket)
+		if err != nil {
+			if _, ok := err.(*util.RecordNotFoundError); !ok {
+				return err
+			}
+			host = DefenderHost{
+				IP: ip,
+			}
+		}
+		host.UpdatedAt = event.DateTime
+		host.Events = append(host.Events, event)
+		return putDefenderHost(&host, bucket)
+	})
+}
+
+func (p *BoltProvider) getDefenderEvents(ip string, from int64) ([]DefenderEvent, error) {
+	var events []DefenderEvent
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, err := getDefenderHostInternal(ip, bucket)
+		if err != nil {
+			if _, ok := err.(*util.RecordNotFoundError); ok {
+				return nil
+			}
+			return err
+		}
+		events = host.getEvents(from)
+		return nil
+	})
+	return events, err
+}
+
+func (p *BoltProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, err := getDefenderHostInternal(ip, bucket)
+		if err != nil {
+			return err
+		}
+		host.BanTime = banTime
+		host.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+		return putDefenderHost(&host, bucket)
+	})
+}
+
+func (p *BoltProvider) cleanupDefender(from int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		now := util.GetTimeAsMsSinceEpoch(time.Now())
+		var toDelete []DefenderHost
+		var toUpdate []DefenderHost
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var host DefenderHost
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+			if host.isExpired(from, now) {
+				toDelete = append(toDelete, host)
+			} else if host.BanTime < now && len(host.getEvents(from)) < len(host.Events) {
+				host.removeEventsBefore(from)
+				toUpdate = append(toUpdate, host)
+			}
+		}
+		// the bucket cannot be modified while iterating
+		for idx := range toDelete {
+			if err := bucket.Delete([]byte(toDelete[idx].IP)); err != nil {
+				return err
+			}
+		}
+		for idx := range toUpdate {
+			if err := putDefenderHost(&toUpdate[idx], bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (p *BoltProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	folder, err := p.getFolderByName(name)
 	if err != nil {
@@ -988,6 +1654,28 @@ func removeUserFromFolderMapping(folder *vfs.VirtualFolder, user *User, bucket *
 	return err
 }
 
+func renameUserInFolderMapping(folder *vfs.VirtualFolder, oldUsername, newUsername string, bucket *bolt.Bucket) error {
+	var f []byte
+	if f = bucket.Get([]byte(folder.Name)); f == nil {
+		return nil
+	}
+	var baseFolder vfs.BaseVirtualFolder
+	err := json.Unmarshal(f, &baseFolder)
+	if err != nil {
+		return err
+	}
+	for idx, u := range baseFolder.Users {
+		if u == oldUsername {
+			baseFolder.Users[idx] = newUsername
+		}
+	}
+	buf, err := json.Marshal(baseFolder)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(folder.Name), buf)
+}
+
 func getAdminsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	var err error
 
@@ -1007,6 +1695,52 @@ func getUsersBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	return bucket, err
 }
 
+func getUsersMetadataBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(usersMetadataBucket)
+	if bucket == nil {
+		err = errors.New("unable to find users metadata bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+// marshalUserWithoutMetadata returns the JSON representation of the given user,
+// metadata are stored inside their own bucket
+func marshalUserWithoutMetadata(user *User) ([]byte, error) {
+	metadata := user.Metadata
+	user.Metadata = nil
+	buf, err := json.Marshal(user)
+	user.Metadata = metadata
+	return buf, err
+}
+
+func getDefenderHostsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(defenderHostsBucket)
+	if bucket == nil {
+		err = errors.New("unable to find defender hosts bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getDefenderHostInternal(ip string, bucket *bolt.Bucket) (DefenderHost, error) {
+	var host DefenderHost
+	h := bucket.Get([]byte(ip))
+	if h == nil {
+		return host, util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	err := json.Unmarshal(h, &host)
+	return host, err
+}
+
+func putDefenderHost(host *DefenderHost, bucket *bolt.Bucket) error {
+	buf, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(host.IP), buf)
+}
+
 func getFoldersBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	var err error
 	bucket := tx.Bucket(foldersBucket)
@@ -0,0 +1,86 @@
+package dataprovider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+var cachedExternalAuths externalAuthCache
+
+func init() {
+	cachedExternalAuths = externalAuthCache{
+		cache: make(map[string]cachedExternalAuth),
+	}
+}
+
+type cachedExternalAuth struct {
+	username   string
+	expiration time.Time
+}
+
+// externalAuthCache stores successful external authentications for
+// the configured cache time. The key is an hash of the provided credentials,
+// the value is the SFTPGo user returned by the external auth hook
+type externalAuthCache struct {
+	sync.RWMutex
+	cache map[string]cachedExternalAuth
+}
+
+func (c *externalAuthCache) getKey(username, password, pkey, keyboardInteractive, ip, protocol, tlsCert string) string {
+	h := sha256.New()
+	for _, val := range []string{username, password, pkey, keyboardInteractive, ip, protocol, tlsCert} {
+		h.Write([]byte(val))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *externalAuthCache) Add(key, username string) {
+	if config.ExternalAuthCacheTime <= 0 || username == "" {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for k, v := range c.cache {
+		if v.expiration.Before(now) {
+			delete(c.cache, k)
+		}
+	}
+	c.cache[key] = cachedExternalAuth{
+		username:   username,
+		expiration: now.Add(time.Duration(config.ExternalAuthCacheTime) * time.Second),
+	}
+}
+
+// Get returns the SFTPGo username for the given key if a valid cached entry is found
+func (c *externalAuthCache) Get(key string) (string, bool) {
+	if config.ExternalAuthCacheTime <= 0 {
+		return "", false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	cached, ok := c.cache[key]
+	if !ok || cached.expiration.Before(time.Now()) {
+		return "", false
+	}
+	return cached.username, true
+}
+
+// Remove removes all the cached entries for the given SFTPGo user
+func (c *externalAuthCache) Remove(username string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for k, v := range c.cache {
+		if v.username == username {
+			delete(c.cache, k)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"crypto/subtle"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -101,6 +103,48 @@ const (
 	OrderDESC = "DESC"
 )
 
+// CountFilter defines the optional filter to apply when counting users, admins and folders
+type CountFilter int
+
+// Supported count filters
+const (
+	// all the entities, supported for users, admins and folders
+	CountAll CountFilter = iota
+	// enabled and not expired users, enabled admins
+	CountActive
+	// disabled users and admins
+	CountDisabled
+	// users with an expiration date in the past, regardless of their status
+	CountExpired
+	// folders not referenced by any user
+	CountOrphaned
+)
+
+func (f CountFilter) matchesUser(user *User, now int64) bool {
+	isExpired := user.ExpirationDate > 0 && user.ExpirationDate < now
+	switch f {
+	case CountActive:
+		return user.Status == 1 && !isExpired
+	case CountDisabled:
+		return user.Status == 0
+	case CountExpired:
+		return isExpired
+	default:
+		return true
+	}
+}
+
+func (f CountFilter) matchesAdmin(admin *Admin) bool {
+	switch f {
+	case CountActive:
+		return admin.Status == 1
+	case CountDisabled:
+		return admin.Status == 0
+	default:
+		return true
+	}
+}
+
 var (
 	// SupportedProviders defines the supported data providers
 	SupportedProviders = []string{SQLiteDataProviderName, PGSQLDataProviderName, MySQLDataProviderName,
@@ -121,11 +165,23 @@ var (
 	// ErrNoInitRequired defines the error returned by InitProvider if no inizialization/update is required
 	ErrNoInitRequired = errors.New("the data provider is up to date")
 	// ErrInvalidCredentials defines the error to return if the supplied credentials are invalid
-	ErrInvalidCredentials   = errors.New("invalid credentials")
-	isAdminCreated          = int32(0)
-	validTLSUsernames       = []string{string(sdk.TLSUsernameNone), string(sdk.TLSUsernameCN)}
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	isAdminCreated        = int32(0)
+	validTLSUsernames     = []string{string(sdk.TLSUsernameNone), string(sdk.TLSUsernameCN)}
+	validSetstatModes     = []string{string(sdk.SetstatModeNormal), string(sdk.SetstatModeIgnore),
+		string(sdk.SetstatModeIgnoreCloud)}
+	validCollisionPolicies = []string{string(sdk.UploadCollisionOverwrite), string(sdk.UploadCollisionReject),
+		string(sdk.UploadCollisionAutoSuffix)}
+	validSymlinksPolicies = []string{string(sdk.SymlinksFollow), string(sdk.SymlinksDeny),
+		string(sdk.SymlinksDenyOutsideHome)}
+	validDirListingSorts = []string{string(sdk.DirListingSortNone), string(sdk.DirListingSortName),
+		string(sdk.DirListingSortNameInsensitive), string(sdk.DirListingSortSize), string(sdk.DirListingSortModTime)}
+	validSingleSessionPolicies = []string{string(sdk.SingleSessionNone), string(sdk.SingleSessionRefuse),
+		string(sdk.SingleSessionEvict)}
+	validLineEndings        = []string{string(sdk.LineEndingLF), string(sdk.LineEndingCRLF)}
 	config                  Config
 	provider                Provider
+	defaultFilesystem       *vfs.Filesystem
 	sqlPlaceholders         []string
 	internalHashPwdPrefixes = []string{argonPwdPrefix, bcryptPwdPrefix}
 	hashPwdPrefixes         = []string{argonPwdPrefix, bcryptPwdPrefix, pbkdf2SHA1Prefix, pbkdf2SHA256Prefix,
@@ -141,6 +197,9 @@ var (
 	sqlTableFolders         = "folders"
 	sqlTableFoldersMapping  = "folders_mapping"
 	sqlTableAdmins          = "admins"
+	sqlTableUsersMetadata   = "users_metadata"
+	sqlTableDefenderHosts   = "defender_hosts"
+	sqlTableDefenderEvents  = "defender_events"
 	sqlTableSchemaVersion   = "schema_version"
 	argon2Params            *argon2id.Params
 	lastLoginMinDelay       = 10 * time.Minute
@@ -181,6 +240,22 @@ type PasswordValidationRules struct {
 	MinEntropy float64 `json:"min_entropy" mapstructure:"min_entropy"`
 }
 
+// UserPasswordChangeConfig defines the rules for the password changes made by the users themselves
+type UserPasswordChangeConfig struct {
+	// Number of previous passwords that cannot be reused. 0 means that only the
+	// current password cannot be reused
+	HistorySize int `json:"history_size" mapstructure:"history_size"`
+	// If enabled the users must provide their current password to set a new one
+	RequireCurrentPassword bool `json:"require_current_password" mapstructure:"require_current_password"`
+}
+
+func (c *UserPasswordChangeConfig) validate() error {
+	if c.HistorySize < 0 {
+		return fmt.Errorf("invalid password history size: %v", c.HistorySize)
+	}
+	return nil
+}
+
 // PasswordValidation defines the password validation rules for admins and protocol users
 type PasswordValidation struct {
 	// Password validation rules for SFTPGo admin users
@@ -246,6 +321,24 @@ type Config struct {
 	// a valid absolute path, then the user home dir will be automatically
 	// defined as the path obtained joining the base dir and the username
 	UsersBaseDir string `json:"users_base_dir" mapstructure:"users_base_dir"`
+	// Directories, as virtual paths, to create on the first login of users
+	// without a specific home skeleton, for example "/inbox", "/outbox"
+	HomeSkeleton []string `json:"home_skeleton" mapstructure:"home_skeleton"`
+	// Path to a JSON file with the filesystem configuration to use for users and folders
+	// added using the REST API without an explicit filesystem. The path can be absolute
+	// or relative to the configuration directory. Leave empty to use the local filesystem
+	DefaultFilesystemFile string `json:"default_filesystem_file" mapstructure:"default_filesystem_file"`
+	// Absolute paths. If not empty, the home directory of users with a local or
+	// encrypted filesystem must be one of these directories or a directory inside them.
+	// Leave empty to allow any home directory
+	AllowedHomeBaseDirs []string `json:"allowed_home_base_dirs" mapstructure:"allowed_home_base_dirs"`
+	// If enabled, a user with a local or encrypted filesystem cannot be saved if
+	// its home directory is the same as, or nested with, the home directory of
+	// another user with a local or encrypted filesystem
+	DenyOverlappingHomeDirs bool `json:"deny_overlapping_home_dirs" mapstructure:"deny_overlapping_home_dirs"`
+	// Default maximum number of virtual folders per user, it can be overridden
+	// per-user. 0 means unlimited
+	MaxUserVirtualFolders int `json:"max_user_virtual_folders" mapstructure:"max_user_virtual_folders"`
 	// Actions to execute on user add, update, delete.
 	// Update action will not be fired for internal updates such as the last login or the user quota fields.
 	Actions UserActions `json:"actions" mapstructure:"actions"`
@@ -266,6 +359,10 @@ type Config struct {
 	// you can combine the scopes, for example 3 means password and public key, 5 password and keyboard
 	// interactive and so on
 	ExternalAuthScope int `json:"external_auth_scope" mapstructure:"external_auth_scope"`
+	// ExternalAuthCacheTime defines the time, in seconds, to cache successful external authentications.
+	// Within this time a login with the same credentials, from the same IP and protocol, will not
+	// invoke the external auth hook again. 0 means no cache
+	ExternalAuthCacheTime int `json:"external_auth_cache_time" mapstructure:"external_auth_cache_time"`
 	// CredentialsPath defines the directory for storing user provided credential files such as
 	// Google Cloud Storage credentials. It can be a path relative to the config dir or an
 	// absolute path
@@ -336,6 +433,11 @@ type Config struct {
 	// on first start.
 	// You can also create the first admin user by using the web interface or by loading initial data.
 	CreateDefaultAdmin bool `json:"create_default_admin" mapstructure:"create_default_admin"`
+	// UsersExpiration defines the periodic check to notify the users about to
+	// expire and to disable the expired ones
+	UsersExpiration UsersExpirationConfig `json:"users_expiration" mapstructure:"users_expiration"`
+	// UserPasswordChange defines the rules for the self-service password changes
+	UserPasswordChange UserPasswordChangeConfig `json:"user_password_change" mapstructure:"user_password_change"`
 }
 
 // BackupData defines the structure for the backup/restore files
@@ -383,28 +485,51 @@ type Provider interface {
 	validateUserAndTLSCert(username, protocol string, tlsCert *x509.Certificate) (User, error)
 	updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error
 	getUsedQuota(username string) (int, int64, error)
+	reserveQuota(username string, sizeAdd, maxSize int64) (bool, error)
 	userExists(username string) (User, error)
 	addUser(user *User) error
 	updateUser(user *User) error
 	deleteUser(user *User) error
+	renameUser(oldUsername string, user *User) error
 	getUsers(limit int, offset int, order string) ([]User, error)
 	dumpUsers() ([]User, error)
 	updateLastLogin(username string) error
+	getUserMetadata(username string) (map[string]string, error)
+	setUserMetadata(username string, metadata map[string]string) error
+	getUsersByMetadata(key, value string, limit, offset int, order string) ([]User, error)
+	getUsersByUsernames(usernames []string) ([]User, error)
+	countUsers(filter CountFilter) (int64, error)
+	getExpiringUsers(expirationBefore int64) ([]User, error)
+	getUserPasswordHistory(username string) ([]string, error)
+	updateUserPassword(username, password string, history []string) error
 	getFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error)
+	getOrphanedFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error)
 	getFolderByName(name string) (vfs.BaseVirtualFolder, error)
 	addFolder(folder *vfs.BaseVirtualFolder) error
 	updateFolder(folder *vfs.BaseVirtualFolder) error
 	deleteFolder(folder *vfs.BaseVirtualFolder) error
 	updateFolderQuota(name string, filesAdd int, sizeAdd int64, reset bool) error
 	getUsedFolderQuota(name string) (int, int64, error)
+	reserveFolderQuota(name string, sizeAdd, maxSize int64) (bool, error)
 	dumpFolders() ([]vfs.BaseVirtualFolder, error)
+	countFolders(filter CountFilter) (int64, error)
 	adminExists(username string) (Admin, error)
 	addAdmin(admin *Admin) error
 	updateAdmin(admin *Admin) error
 	deleteAdmin(admin *Admin) error
 	getAdmins(limit int, offset int, order string) ([]Admin, error)
 	dumpAdmins() ([]Admin, error)
+	countAdmins(filter CountFilter) (int64, error)
 	validateAdminAndPass(username, password, ip string) (Admin, error)
+	getDefenderHosts(from int64, limit int) ([]DefenderHost, error)
+	getDefenderHostByIP(ip string, from int64) (DefenderHost, error)
+	isDefenderHostBanned(ip string) (DefenderHost, error)
+	updateDefenderBanTime(ip string, minutes int) error
+	deleteDefenderHost(ip string) error
+	addDefenderEvent(ip string, event DefenderEvent) error
+	getDefenderEvents(ip string, from int64) ([]DefenderEvent, error)
+	setDefenderBanTime(ip string, banTime int64) error
+	cleanupDefender(from int64) error
 	checkAvailability() error
 	close() error
 	reloadConfig() error
@@ -438,6 +563,26 @@ func Initialize(cnf Config, basePath string, checkAdmins bool) error {
 	if err = validateHooks(); err != nil {
 		return err
 	}
+	if err = config.UsersExpiration.validate(); err != nil {
+		return err
+	}
+	if err = config.UserPasswordChange.validate(); err != nil {
+		return err
+	}
+	if config.MaxUserVirtualFolders < 0 {
+		return fmt.Errorf("invalid max user virtual folders: %v", config.MaxUserVirtualFolders)
+	}
+	if config.HomeSkeleton, err = validateHomeSkeleton(config.HomeSkeleton); err != nil {
+		return err
+	}
+	if config.AllowedHomeBaseDirs, err = validateAllowedHomeBaseDirs(config.AllowedHomeBaseDirs); err != nil {
+		return err
+	}
+	if err = loadDefaultFilesystem(basePath); err != nil {
+		logger.WarnToConsole("Unable to load the default filesystem: %v", err)
+		providerLog(logger.LevelWarn, "unable to load the default filesystem: %v", err)
+		return err
+	}
 	err = createProvider(basePath)
 	if err != nil {
 		return err
@@ -473,6 +618,7 @@ func Initialize(cnf Config, basePath string, checkAdmins bool) error {
 	}
 	atomic.StoreInt32(&isAdminCreated, int32(len(admins)))
 	startAvailabilityTimer()
+	startExpirationCheckTimer()
 	delayedQuotaUpdater.start()
 	return nil
 }
@@ -491,6 +637,9 @@ func validateHooks() error {
 	if config.CheckPasswordHook != "" && !strings.HasPrefix(config.CheckPasswordHook, "http") {
 		hooks = append(hooks, config.CheckPasswordHook)
 	}
+	if config.UsersExpiration.Hook != "" && !strings.HasPrefix(config.UsersExpiration.Hook, "http") {
+		hooks = append(hooks, config.UsersExpiration.Hook)
+	}
 
 	for _, hook := range hooks {
 		if !filepath.IsAbs(hook) {
@@ -526,6 +675,79 @@ func initializeHashingAlgo(cnf *Config) error {
 	return nil
 }
 
+func validateHomeSkeleton(dirs []string) ([]string, error) {
+	var skeleton []string
+	for _, dir := range dirs {
+		if !path.IsAbs(dir) {
+			return nil, util.NewValidationError(fmt.Sprintf("invalid home skeleton dir %#v, it must be an absolute path", dir))
+		}
+		cleaned := util.CleanPath(dir)
+		if cleaned == "/" {
+			return nil, util.NewValidationError("the root directory cannot be part of the home skeleton")
+		}
+		if !util.IsStringInSlice(cleaned, skeleton) {
+			skeleton = append(skeleton, cleaned)
+		}
+	}
+	return skeleton, nil
+}
+
+func validateAllowedHomeBaseDirs(dirs []string) ([]string, error) {
+	var baseDirs []string
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return nil, util.NewValidationError(fmt.Sprintf("invalid allowed home base dir %#v, it must be an absolute path", dir))
+		}
+		cleaned := filepath.Clean(dir)
+		if !util.IsStringInSlice(cleaned, baseDirs) {
+			baseDirs = append(baseDirs, cleaned)
+		}
+	}
+	return baseDirs, nil
+}
+
+func loadDefaultFilesystem(basePath string) error {
+	defaultFilesystem = nil
+	if config.DefaultFilesystemFile == "" {
+		return nil
+	}
+	fsPath := config.DefaultFilesystemFile
+	if !filepath.IsAbs(fsPath) {
+		fsPath = filepath.Join(basePath, fsPath)
+	}
+	content, err := os.ReadFile(fsPath)
+	if err != nil {
+		return err
+	}
+	var fs vfs.Filesystem
+	if err = json.Unmarshal(content, &fs); err != nil {
+		return fmt.Errorf("invalid default filesystem %#v: %w", fsPath, err)
+	}
+	fs.SetEmptySecretsIfNil()
+	if fs.HasRedactedSecret() {
+		return fmt.Errorf("invalid default filesystem %#v: redacted secrets are not allowed", fsPath)
+	}
+	// the secrets are encrypted for each user or folder using its own additional data,
+	// so we validate a copy and we keep the configured secrets as they are
+	fsCopy := fs.GetACopy()
+	helper := vfs.BaseVirtualFolder{Name: "default_filesystem"}
+	if err = fsCopy.Validate(&helper); err != nil {
+		return fmt.Errorf("invalid default filesystem %#v: %w", fsPath, err)
+	}
+	defaultFilesystem = &fs
+	providerLog(logger.LevelDebug, "default filesystem loaded from %#v, provider: %v", fsPath, fs.Provider)
+	return nil
+}
+
+// GetDefaultFilesystem returns a copy of the configured default filesystem.
+// The returned bool is false if no default filesystem is configured
+func GetDefaultFilesystem() (vfs.Filesystem, bool) {
+	if defaultFilesystem == nil {
+		return vfs.Filesystem{}, false
+	}
+	return defaultFilesystem.GetACopy(), true
+}
+
 func validateSQLTablesPrefix() error {
 	if config.SQLTablesPrefix != "" {
 		for _, char := range config.SQLTablesPrefix {
@@ -537,9 +759,13 @@ func validateSQLTablesPrefix() error {
 		sqlTableFolders = config.SQLTablesPrefix + sqlTableFolders
 		sqlTableFoldersMapping = config.SQLTablesPrefix + sqlTableFoldersMapping
 		sqlTableAdmins = config.SQLTablesPrefix + sqlTableAdmins
+		sqlTableUsersMetadata = config.SQLTablesPrefix + sqlTableUsersMetadata
+		sqlTableDefenderHosts = config.SQLTablesPrefix + sqlTableDefenderHosts
+		sqlTableDefenderEvents = config.SQLTablesPrefix + sqlTableDefenderEvents
 		sqlTableSchemaVersion = config.SQLTablesPrefix + sqlTableSchemaVersion
-		providerLog(logger.LevelDebug, "sql table for users %#v, folders %#v folders mapping %#v admins %#v schema version %#v",
-			sqlTableUsers, sqlTableFolders, sqlTableFoldersMapping, sqlTableAdmins, sqlTableSchemaVersion)
+		providerLog(logger.LevelDebug, "sql table for users %#v, folders %#v folders mapping %#v admins %#v users metadata %#v "+
+			"defender hosts %#v defender events %#v schema version %#v", sqlTableUsers, sqlTableFolders, sqlTableFoldersMapping,
+			sqlTableAdmins, sqlTableUsersMetadata, sqlTableDefenderHosts, sqlTableDefenderEvents, sqlTableSchemaVersion)
 	}
 	return nil
 }
@@ -810,6 +1036,8 @@ func UpdateLastLogin(user *User) error {
 func UpdateUserQuota(user *User, filesAdd int, sizeAdd int64, reset bool) error {
 	if config.TrackQuota == 0 {
 		return util.NewMethodDisabledError(trackQuotaDisabledError)
+	} else if user.Filters.DisableQuotaTracking {
+		return nil
 	} else if config.TrackQuota == 2 && !reset && !user.HasQuotaRestrictions() {
 		return nil
 	}
@@ -826,6 +1054,30 @@ func UpdateUserQuota(user *User, filesAdd int, sizeAdd int64, reset bool) error
 	return nil
 }
 
+// ReserveUserQuota atomically adds sizeAdd to the used quota for the given user
+// only if the resulting used size does not exceed maxSize.
+// It returns false, without any change, if the quota cannot be reserved.
+// A reservation must be committed or released using UpdateUserQuota with the
+// difference between the actual and the reserved size
+func ReserveUserQuota(user *User, sizeAdd, maxSize int64) (bool, error) {
+	if config.TrackQuota == 0 {
+		return false, util.NewMethodDisabledError(trackQuotaDisabledError)
+	} else if user.Filters.DisableQuotaTracking {
+		return true, nil
+	} else if config.TrackQuota == 2 && !user.HasQuotaRestrictions() {
+		return true, nil
+	}
+	if sizeAdd <= 0 || maxSize <= 0 {
+		return true, nil
+	}
+	if config.DelayedQuotaUpdate > 0 {
+		// pending updates are not yet stored inside the data provider
+		_, pendingSize := delayedQuotaUpdater.getUserPendingQuota(user.Username)
+		maxSize -= pendingSize
+	}
+	return provider.reserveQuota(user.Username, sizeAdd, maxSize)
+}
+
 // UpdateVirtualFolderQuota updates the quota for the given virtual folder adding filesAdd and sizeAdd.
 // If reset is true filesAdd and sizeAdd indicates the total files and the total size instead of the difference.
 func UpdateVirtualFolderQuota(vfolder *vfs.BaseVirtualFolder, filesAdd int, sizeAdd int64, reset bool) error {
@@ -845,6 +1097,28 @@ func UpdateVirtualFolderQuota(vfolder *vfs.BaseVirtualFolder, filesAdd int, size
 	return nil
 }
 
+// ReserveVirtualFolderQuota atomically adds sizeAdd to the used quota for the given
+// virtual folder only if the resulting used size does not exceed maxSize.
+// The same folder can be mapped to multiple users, so the reservation is shared
+// among all the users uploading to it.
+// It returns false, without any change, if the quota cannot be reserved.
+// A reservation must be committed or released using UpdateVirtualFolderQuota with
+// the difference between the actual and the reserved size
+func ReserveVirtualFolderQuota(vfolder *vfs.BaseVirtualFolder, sizeAdd, maxSize int64) (bool, error) {
+	if config.TrackQuota == 0 {
+		return false, util.NewMethodDisabledError(trackQuotaDisabledError)
+	}
+	if sizeAdd <= 0 || maxSize <= 0 {
+		return true, nil
+	}
+	if config.DelayedQuotaUpdate > 0 {
+		// pending updates are not yet stored inside the data provider
+		_, pendingSize := delayedQuotaUpdater.getFolderPendingQuota(vfolder.Name)
+		maxSize -= pendingSize
+	}
+	return provider.reserveFolderQuota(vfolder.Name, sizeAdd, maxSize)
+}
+
 // GetUsedQuota returns the used quota for the given SFTP user.
 func GetUsedQuota(username string) (int, int64, error) {
 	if config.TrackQuota == 0 {
@@ -871,6 +1145,86 @@ func GetUsedVirtualFolderQuota(name string) (int, int64, error) {
 	return files + delayedFiles, size + delayedSize, err
 }
 
+// FolderQuotaUsage defines the used quota for a virtual folder mapped to a user
+type FolderQuotaUsage struct {
+	Name string `json:"name"`
+	// virtual paths where the folder is mapped
+	VirtualPaths   []string `json:"virtual_paths"`
+	UsedQuotaSize  int64    `json:"used_quota_size"`
+	UsedQuotaFiles int      `json:"used_quota_files"`
+	// true if the folder usage is included in the user's quota
+	IncludedInUserQuota bool `json:"included_in_user_quota"`
+}
+
+// QuotaBreakdown defines the used quota for a user split between
+// its home directory and its virtual folders
+type QuotaBreakdown struct {
+	HomeUsedQuotaSize   int64              `json:"home_used_quota_size"`
+	HomeUsedQuotaFiles  int                `json:"home_used_quota_files"`
+	Folders             []FolderQuotaUsage `json:"folders"`
+	TotalUsedQuotaSize  int64              `json:"total_used_quota_size"`
+	TotalUsedQuotaFiles int                `json:"total_used_quota_files"`
+}
+
+// GetUsedQuotaBreakdown returns the used quota for the given user split between
+// its home directory and its virtual folders. The breakdown is computed from
+// the stored quota values, no scan is done. The home directory usage is the user
+// used quota minus the usage of the folders included in the user quota.
+// A folder mapped at multiple virtual paths is counted once
+func GetUsedQuotaBreakdown(user *User) (QuotaBreakdown, error) {
+	var result QuotaBreakdown
+	userFiles, userSize, err := GetUsedQuota(user.Username)
+	if err != nil {
+		return result, err
+	}
+	folders := make(map[string]*FolderQuotaUsage)
+	for idx := range user.VirtualFolders {
+		vfolder := &user.VirtualFolders[idx]
+		if f, ok := folders[vfolder.Name]; ok {
+			f.VirtualPaths = append(f.VirtualPaths, vfolder.VirtualPath)
+			f.IncludedInUserQuota = f.IncludedInUserQuota || vfolder.IsIncludedInUserQuota()
+			continue
+		}
+		files, size, err := GetUsedVirtualFolderQuota(vfolder.Name)
+		if err != nil {
+			return result, err
+		}
+		folders[vfolder.Name] = &FolderQuotaUsage{
+			Name:                vfolder.Name,
+			VirtualPaths:        []string{vfolder.VirtualPath},
+			UsedQuotaSize:       size,
+			UsedQuotaFiles:      files,
+			IncludedInUserQuota: vfolder.IsIncludedInUserQuota(),
+		}
+	}
+	result.HomeUsedQuotaSize = userSize
+	result.HomeUsedQuotaFiles = userFiles
+	result.Folders = make([]FolderQuotaUsage, 0, len(folders))
+	for _, f := range folders {
+		if f.IncludedInUserQuota {
+			result.HomeUsedQuotaSize -= f.UsedQuotaSize
+			result.HomeUsedQuotaFiles -= f.UsedQuotaFiles
+		}
+		result.Folders = append(result.Folders, *f)
+	}
+	sort.Slice(result.Folders, func(i, j int) bool {
+		return result.Folders[i].Name < result.Folders[j].Name
+	})
+	if result.HomeUsedQuotaSize < 0 {
+		result.HomeUsedQuotaSize = 0
+	}
+	if result.HomeUsedQuotaFiles < 0 {
+		result.HomeUsedQuotaFiles = 0
+	}
+	result.TotalUsedQuotaSize = result.HomeUsedQuotaSize
+	result.TotalUsedQuotaFiles = result.HomeUsedQuotaFiles
+	for _, f := range result.Folders {
+		result.TotalUsedQuotaSize += f.UsedQuotaSize
+		result.TotalUsedQuotaFiles += f.UsedQuotaFiles
+	}
+	return result, nil
+}
+
 // HasAdmin returns true if the first admin has been created
 // and so SFTPGo is ready to be used
 func HasAdmin() bool {
@@ -912,24 +1266,158 @@ func UserExists(username string) (User, error) {
 
 // AddUser adds a new SFTPGo user.
 func AddUser(user *User) error {
+	if err := validateUserMetadata(user.Metadata); err != nil {
+		return err
+	}
 	err := provider.addUser(user)
+	if err == nil && len(user.Metadata) > 0 {
+		err = provider.setUserMetadata(user.Username, user.Metadata)
+	}
 	if err == nil {
 		executeAction(operationAdd, user)
 	}
 	return err
 }
 
+// CloneUser adds a new user, named newUsername, with the same permissions, filters,
+// filesystem config and virtual folders of the source user.
+// The clone has its own home directory, blank quota usage and last login and
+// no credentials, the overrides are applied before adding it and so they can be
+// used to set a password or public keys and to customize any other field
+func CloneUser(source, newUsername string, overrides ...func(*User)) (User, error) {
+	if _, err := provider.userExists(newUsername); err == nil {
+		return User{}, util.NewValidationError(fmt.Sprintf("username %#v already exists", newUsername))
+	} else if _, ok := err.(*util.RecordNotFoundError); !ok {
+		return User{}, err
+	}
+	sourceUser, err := provider.userExists(source)
+	if err != nil {
+		return User{}, err
+	}
+	user := sourceUser.getACopy()
+	// the secrets are bound to the source username, they must be encrypted again
+	if err := addCredentialsToUser(&user); err != nil {
+		return User{}, err
+	}
+	if err := user.FsConfig.DecryptSecrets(); err != nil {
+		return User{}, err
+	}
+	for idx := range user.ProtocolFilesystems {
+		p := &user.ProtocolFilesystems[idx]
+		if err := p.FsConfig.DecryptSecrets(); err != nil {
+			return User{}, err
+		}
+		p.HomeDir = filepath.Join(filepath.Dir(p.HomeDir), newUsername)
+	}
+	user.ID = 0
+	user.Username = newUsername
+	user.HomeDir = filepath.Join(filepath.Dir(sourceUser.HomeDir), newUsername)
+	user.Password = ""
+	user.PublicKeys = nil
+	user.Filters.TLSCertFingerprints = nil
+	user.UsedQuotaSize = 0
+	user.UsedQuotaFiles = 0
+	user.LastQuotaUpdate = 0
+	user.LastLogin = 0
+	user.Metadata = nil
+	for _, override := range overrides {
+		override(&user)
+	}
+	if err := AddUser(&user); err != nil {
+		return User{}, err
+	}
+	return provider.userExists(user.Username)
+}
+
 // UpdateUser updates an existing SFTPGo user.
+// User metadata are replaced only if not nil
 func UpdateUser(user *User) error {
+	if err := validateUserMetadata(user.Metadata); err != nil {
+		return err
+	}
 	err := provider.updateUser(user)
+	if err == nil && user.Metadata != nil {
+		err = provider.setUserMetadata(user.Username, user.Metadata)
+	}
 	if err == nil {
 		webDAVUsersCache.swap(user)
 		cachedPasswords.Remove(user.Username)
+		cachedExternalAuths.Remove(user.Username)
 		executeAction(operationUpdate, user)
 	}
 	return err
 }
 
+// IsCurrentPasswordRequired returns true if the users must provide their current
+// password to change it
+func IsCurrentPasswordRequired() bool {
+	return config.UserPasswordChange.RequireCurrentPassword
+}
+
+// ChangeUserPassword sets a new password for the given user enforcing the configured
+// password policy. The current password is verified if required or if provided.
+// The new password cannot match the current one or the ones in the history
+func ChangeUserPassword(username, currentPassword, newPassword, ip, protocol string) error {
+	if config.UserPasswordChange.RequireCurrentPassword || currentPassword != "" {
+		if _, err := CheckUserAndPass(username, currentPassword, ip, protocol); err != nil {
+			return util.NewValidationError("current password does not match")
+		}
+	}
+	user, err := provider.userExists(username)
+	if err != nil {
+		return err
+	}
+	if !user.CanChangePassword() {
+		return util.NewMethodDisabledError("password change is not allowed for this user")
+	}
+	if newPassword == "" {
+		return util.NewValidationError("the new password cannot be empty")
+	}
+	if currentPassword != "" && currentPassword == newPassword {
+		return util.NewValidationError("the new password must be different from the current one")
+	}
+	if config.PasswordValidation.Users.MinEntropy > 0 {
+		if err := passwordvalidator.Validate(newPassword, config.PasswordValidation.Users.MinEntropy); err != nil {
+			return util.NewValidationError(err.Error())
+		}
+	}
+	history, err := provider.getUserPasswordHistory(username)
+	if err != nil {
+		return err
+	}
+	for _, hash := range append([]string{user.Password}, history...) {
+		if hash == "" {
+			continue
+		}
+		match, _ := comparePasswordAndHash(&User{BaseUser: sdk.BaseUser{Username: username, Password: hash}}, newPassword)
+		if match {
+			return util.NewValidationError("the new password cannot be the same as a previous one")
+		}
+	}
+	var newHistory []string
+	if config.UserPasswordChange.HistorySize > 0 {
+		if user.Password != "" {
+			newHistory = append(newHistory, user.Password)
+		}
+		newHistory = append(newHistory, history...)
+		if len(newHistory) > config.UserPasswordChange.HistorySize {
+			newHistory = newHistory[:config.UserPasswordChange.HistorySize]
+		}
+	}
+	user.Password = newPassword
+	if err := createUserPasswordHash(&user); err != nil {
+		return err
+	}
+	if err := provider.updateUserPassword(username, user.Password, newHistory); err != nil {
+		return err
+	}
+	RemoveCachedWebDAVUser(username)
+	cachedPasswords.Remove(username)
+	cachedExternalAuths.Remove(username)
+	executeAction(operationUpdate, &user)
+	return nil
+}
+
 // DeleteUser deletes an existing SFTPGo user.
 func DeleteUser(username string) error {
 	user, err := provider.userExists(username)
@@ -941,11 +1429,113 @@ func DeleteUser(username string) error {
 		RemoveCachedWebDAVUser(user.Username)
 		delayedQuotaUpdater.resetUserQuota(username)
 		cachedPasswords.Remove(username)
+		cachedExternalAuths.Remove(username)
 		executeAction(operationDelete, &user)
 	}
 	return err
 }
 
+// RenameUser changes the username for an existing SFTPGo user.
+// Quota, last login, metadata and virtual folders mapping are preserved.
+// An error is returned if the new username is already in use
+func RenameUser(oldUsername, newUsername string) error {
+	if newUsername == "" {
+		return util.NewValidationError("username is mandatory")
+	}
+	if !config.SkipNaturalKeysValidation && !usernameRegex.MatchString(newUsername) {
+		return util.NewValidationError(fmt.Sprintf("username %#v is not valid, the following characters are allowed: a-zA-Z0-9-_.~",
+			newUsername))
+	}
+	if oldUsername == newUsername {
+		return util.NewValidationError("the new username must be different from the current one")
+	}
+	if _, err := provider.userExists(newUsername); err == nil {
+		return util.NewValidationError(fmt.Sprintf("username %#v already exists", newUsername))
+	} else if _, ok := err.(*util.RecordNotFoundError); !ok {
+		return err
+	}
+	renamedUser, err := getRenamedUser(oldUsername, newUsername)
+	if err != nil {
+		return err
+	}
+	err = provider.renameUser(oldUsername, &renamedUser)
+	if err != nil {
+		return err
+	}
+	RemoveCachedWebDAVUser(oldUsername)
+	delayedQuotaUpdater.renameUser(oldUsername, newUsername)
+	cachedPasswords.Remove(oldUsername)
+	cachedExternalAuths.Remove(oldUsername)
+	user, err := provider.userExists(newUsername)
+	if err == nil {
+		executeAction(operationUpdate, &user)
+	}
+	return nil
+}
+
+// getRenamedUser returns the given user with the new username and the filesystem
+// secrets encrypted again, they use the username as additional data
+func getRenamedUser(oldUsername, newUsername string) (User, error) {
+	user, err := provider.userExists(oldUsername)
+	if err != nil {
+		return user, err
+	}
+	if err := addCredentialsToUser(&user); err != nil {
+		return user, err
+	}
+	if err := user.FsConfig.DecryptSecrets(); err != nil {
+		return user, err
+	}
+	for idx := range user.ProtocolFilesystems {
+		if err := user.ProtocolFilesystems[idx].FsConfig.DecryptSecrets(); err != nil {
+			return user, err
+		}
+	}
+	user.Username = newUsername
+	if err := validateFilesystemConfig(&user.FsConfig, &user); err != nil {
+		return user, err
+	}
+	for idx := range user.ProtocolFilesystems {
+		if err := validateFilesystemConfig(&user.ProtocolFilesystems[idx].FsConfig, &user); err != nil {
+			return user, err
+		}
+	}
+	return user, saveGCSCredentials(&user.FsConfig, &user)
+}
+
+// GetUserMetadata returns the metadata associated to the given user
+func GetUserMetadata(username string) (map[string]string, error) {
+	return provider.getUserMetadata(username)
+}
+
+// SetUserMetadata replaces the metadata associated to the given user
+func SetUserMetadata(username string, metadata map[string]string) error {
+	if err := validateUserMetadata(metadata); err != nil {
+		return err
+	}
+	return provider.setUserMetadata(username, metadata)
+}
+
+// GetUsersByMetadata returns an array of users having the given metadata key respecting limit and offset.
+// If value is not empty only the users with a matching value are returned
+func GetUsersByMetadata(key, value string, limit, offset int, order string) ([]User, error) {
+	return provider.getUsersByMetadata(key, value, limit, offset, order)
+}
+
+// GetUsersByUsernames returns the users matching the given usernames as a map keyed by username.
+// Usernames that do not exist are not included in the returned map
+func GetUsersByUsernames(usernames []string) (map[string]User, error) {
+	result := make(map[string]User)
+	users, err := provider.getUsersByUsernames(util.RemoveDuplicates(usernames))
+	if err != nil {
+		return result, err
+	}
+	for _, user := range users {
+		result[user.Username] = user
+	}
+	return result, nil
+}
+
 // ReloadConfig reloads provider configuration.
 // Currently only implemented for memory provider, allows to reload the users
 // from the configured file, if defined
@@ -953,6 +1543,39 @@ func ReloadConfig() error {
 	return provider.reloadConfig()
 }
 
+// CountUsers returns the number of users matching the specified filter.
+// Supported filters: CountAll, CountActive, CountDisabled, CountExpired
+func CountUsers(filter CountFilter) (int64, error) {
+	switch filter {
+	case CountAll, CountActive, CountDisabled, CountExpired:
+		return provider.countUsers(filter)
+	default:
+		return 0, util.NewValidationError(fmt.Sprintf("unsupported count filter for users: %v", filter))
+	}
+}
+
+// CountAdmins returns the number of admins matching the specified filter.
+// Supported filters: CountAll, CountActive, CountDisabled
+func CountAdmins(filter CountFilter) (int64, error) {
+	switch filter {
+	case CountAll, CountActive, CountDisabled:
+		return provider.countAdmins(filter)
+	default:
+		return 0, util.NewValidationError(fmt.Sprintf("unsupported count filter for admins: %v", filter))
+	}
+}
+
+// CountFolders returns the number of folders matching the specified filter.
+// Supported filters: CountAll, CountOrphaned
+func CountFolders(filter CountFilter) (int64, error) {
+	switch filter {
+	case CountAll, CountOrphaned:
+		return provider.countFolders(filter)
+	default:
+		return 0, util.NewValidationError(fmt.Sprintf("unsupported count filter for folders: %v", filter))
+	}
+}
+
 // GetAdmins returns an array of admins respecting limit and offset
 func GetAdmins(limit, offset int, order string) ([]Admin, error) {
 	return provider.getAdmins(limit, offset, order)
@@ -1005,6 +1628,53 @@ func GetFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error
 	return provider.getFolders(limit, offset, order)
 }
 
+// GetOrphanedFolders returns an array of folders, not referenced by any user,
+// respecting limit and offset
+func GetOrphanedFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error) {
+	return provider.getOrphanedFolders(limit, offset, order)
+}
+
+// DeleteOrphanedFolders deletes all the folders not referenced by any user.
+// It returns the names of the deleted folders
+func DeleteOrphanedFolders() ([]string, error) {
+	const batchSize = 100
+	var deleted []string
+	offset := 0
+
+	for {
+		folders, err := provider.getOrphanedFolders(batchSize, offset, OrderASC)
+		if err != nil {
+			return deleted, err
+		}
+		for idx := range folders {
+			// the folder could be mapped to a user after the listing
+			folder, err := provider.getFolderByName(folders[idx].Name)
+			if err != nil {
+				if _, ok := err.(*util.RecordNotFoundError); ok {
+					continue
+				}
+				return deleted, err
+			}
+			if len(folder.Users) > 0 {
+				offset++
+				continue
+			}
+			if err := provider.deleteFolder(&folder); err != nil {
+				return deleted, err
+			}
+			delayedQuotaUpdater.resetFolderQuota(folder.Name)
+			deleted = append(deleted, folder.Name)
+		}
+		if len(folders) < batchSize {
+			break
+		}
+	}
+	if len(deleted) > 0 {
+		providerLog(logger.LevelInfo, "deleted %v orphaned folders: %+v", len(deleted), deleted)
+	}
+	return deleted, nil
+}
+
 // DumpData returns all users and folders
 func DumpData() (BackupData, error) {
 	var data BackupData
@@ -1058,6 +1728,7 @@ func Close() error {
 		availabilityTickerDone <- true
 		availabilityTicker = nil
 	}
+	stopExpirationCheckTimer()
 	return provider.close()
 }
 
@@ -1180,6 +1851,10 @@ func validateUserVirtualFolders(user *User) error {
 		user.VirtualFolders = []vfs.VirtualFolder{}
 		return nil
 	}
+	if maxFolders := user.GetMaxVirtualFolders(); maxFolders > 0 && len(user.VirtualFolders) > maxFolders {
+		return util.NewValidationError(fmt.Sprintf("too many virtual folders: %v, the maximum allowed is %v",
+			len(user.VirtualFolders), maxFolders))
+	}
 	var virtualFolders []vfs.VirtualFolder
 	mappedPaths := make(map[string]bool)
 	virtualPaths := make(map[string]bool)
@@ -1345,6 +2020,30 @@ func checkEmptyFiltersStruct(user *User) {
 	}
 }
 
+func validateTextModeFilter(filter *sdk.TextModeFilter) error {
+	var extensions []string
+	for _, ext := range filter.Extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") || len(ext) == 1 || strings.ContainsAny(ext, "/\\*?[") {
+			return util.NewValidationError(fmt.Sprintf("invalid text mode extension %#v", ext))
+		}
+		extensions = append(extensions, ext)
+	}
+	filter.Extensions = util.RemoveDuplicates(extensions)
+	for _, lineEnding := range []sdk.LineEnding{filter.Upload, filter.Download} {
+		if lineEnding != "" && !util.IsStringInSlice(string(lineEnding), validLineEndings) {
+			return util.NewValidationError(fmt.Sprintf("invalid text mode line ending: %#v", lineEnding))
+		}
+	}
+	if (filter.Upload != "" || filter.Download != "") && len(filter.Extensions) == 0 {
+		return util.NewValidationError("text mode requires at least one file extension")
+	}
+	return nil
+}
+
 func validateFilters(user *User) error {
 	checkEmptyFiltersStruct(user)
 	for _, IPMask := range user.Filters.DeniedIP {
@@ -1380,14 +2079,141 @@ func validateFilters(user *User) error {
 			return util.NewValidationError(fmt.Sprintf("invalid TLS username: %#v", user.Filters.TLSUsername))
 		}
 	}
+	if user.Filters.SetstatMode != "" {
+		if !util.IsStringInSlice(string(user.Filters.SetstatMode), validSetstatModes) {
+			return util.NewValidationError(fmt.Sprintf("invalid setstat mode: %#v", user.Filters.SetstatMode))
+		}
+	}
+	if user.Filters.UploadCollisionPolicy != "" {
+		if !util.IsStringInSlice(string(user.Filters.UploadCollisionPolicy), validCollisionPolicies) {
+			return util.NewValidationError(fmt.Sprintf("invalid upload collision policy: %#v",
+				user.Filters.UploadCollisionPolicy))
+		}
+	}
+	if user.Filters.SymlinksPolicy != "" {
+		if !util.IsStringInSlice(string(user.Filters.SymlinksPolicy), validSymlinksPolicies) {
+			return util.NewValidationError(fmt.Sprintf("invalid symlinks policy: %#v", user.Filters.SymlinksPolicy))
+		}
+	}
+	var hiddenPatterns []string
+	for _, pattern := range user.Filters.HiddenPatterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, "abc"); err != nil || strings.Contains(pattern, "/") {
+			return util.NewValidationError(fmt.Sprintf("invalid hidden pattern %#v", pattern))
+		}
+		hiddenPatterns = append(hiddenPatterns, strings.ToLower(pattern))
+	}
+	user.Filters.HiddenPatterns = util.RemoveDuplicates(hiddenPatterns)
+	var fingerprints []string
+	for _, fingerprint := range user.Filters.TLSCertFingerprints {
+		// fingerprints are often displayed as colon separated hex bytes
+		fingerprint = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if fingerprint == "" {
+			continue
+		}
+		if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+			return util.NewValidationError(fmt.Sprintf("invalid TLS certificate fingerprint %#v", fingerprint))
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	user.Filters.TLSCertFingerprints = util.RemoveDuplicates(fingerprints)
+	if user.Filters.MaxVirtualFolders < -1 {
+		return util.NewValidationError(fmt.Sprintf("invalid max virtual folders: %v", user.Filters.MaxVirtualFolders))
+	}
+	var quotaScanExcludes []string
+	for _, pattern := range user.Filters.QuotaScanExcludes {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "/") {
+			pattern = path.Clean(pattern)
+		}
+		if _, err := path.Match(pattern, "abc"); err != nil || pattern == "/" ||
+			(!strings.HasPrefix(pattern, "/") && strings.Contains(pattern, "/")) {
+			return util.NewValidationError(fmt.Sprintf("invalid quota scan exclude pattern %#v", pattern))
+		}
+		quotaScanExcludes = append(quotaScanExcludes, pattern)
+	}
+	user.Filters.QuotaScanExcludes = util.RemoveDuplicates(quotaScanExcludes)
+	if user.Filters.DirListingSort != "" {
+		if !util.IsStringInSlice(string(user.Filters.DirListingSort), validDirListingSorts) {
+			return util.NewValidationError(fmt.Sprintf("invalid directory listing sort: %#v",
+				user.Filters.DirListingSort))
+		}
+	}
+	if user.Filters.SingleSessionPolicy != "" {
+		if !util.IsStringInSlice(string(user.Filters.SingleSessionPolicy), validSingleSessionPolicies) {
+			return util.NewValidationError(fmt.Sprintf("invalid single session policy: %#v",
+				user.Filters.SingleSessionPolicy))
+		}
+	}
+	if err := validateTextModeFilter(&user.Filters.TextMode); err != nil {
+		return err
+	}
+	skeleton, err := validateHomeSkeleton(user.Filters.HomeSkeleton)
+	if err != nil {
+		return err
+	}
+	user.Filters.HomeSkeleton = skeleton
+	var profiles []string
+	for _, profile := range user.Filters.SecurityProfiles {
+		profile = strings.TrimSpace(profile)
+		if profile == "" {
+			return util.NewValidationError("empty security profiles are not allowed")
+		}
+		if !util.IsStringInSlice(profile, profiles) {
+			profiles = append(profiles, profile)
+		}
+	}
+	user.Filters.SecurityProfiles = profiles
 	for _, opts := range user.Filters.WebClient {
 		if !util.IsStringInSlice(opts, sdk.WebClientOptions) {
 			return util.NewValidationError(fmt.Sprintf("invalid web client options %#v", opts))
 		}
 	}
+	if err := validateBandwidthSchedules(user); err != nil {
+		return err
+	}
 	return validateFiltersPatternExtensions(user)
 }
 
+func validateBandwidthSchedules(user *User) error {
+	type timeRange struct {
+		from int
+		to   int
+	}
+	ranges := make([]timeRange, 0, len(user.Filters.BandwidthSchedules))
+	for idx := range user.Filters.BandwidthSchedules {
+		schedule := &user.Filters.BandwidthSchedules[idx]
+		from, to, err := schedule.GetTimeRange()
+		if err != nil {
+			return util.NewValidationError(fmt.Sprintf("invalid bandwidth schedule: %v", err))
+		}
+		if from >= to {
+			return util.NewValidationError(fmt.Sprintf("invalid bandwidth schedule %#v-%#v: the start time must be before the end time",
+				schedule.From, schedule.To))
+		}
+		if schedule.UploadBandwidth < 0 || schedule.DownloadBandwidth < 0 {
+			return util.NewValidationError(fmt.Sprintf("invalid bandwidth schedule %#v-%#v: negative bandwidth",
+				schedule.From, schedule.To))
+		}
+		for _, r := range ranges {
+			if from < r.to && r.from < to {
+				return util.NewValidationError(fmt.Sprintf("bandwidth schedule %#v-%#v overlaps with another schedule",
+					schedule.From, schedule.To))
+			}
+		}
+		ranges = append(ranges, timeRange{from: from, to: to})
+		schedule.From = fmt.Sprintf("%02d:%02d", from/60, from%60)
+		schedule.To = fmt.Sprintf("%02d:%02d", to/60, to%60)
+	}
+	return nil
+}
+
 func saveGCSCredentials(fsConfig *vfs.Filesystem, helper vfs.ValidatorHelper) error {
 	if fsConfig.Provider != sdk.GCSFilesystemProvider {
 		return nil
@@ -1429,6 +2255,48 @@ func saveGCSCredentials(fsConfig *vfs.Filesystem, helper vfs.ValidatorHelper) er
 	return nil
 }
 
+func validateUserMetadata(metadata map[string]string) error {
+	for k, v := range metadata {
+		if k == "" {
+			return util.NewValidationError("metadata keys cannot be empty")
+		}
+		if len(k) > 255 {
+			return util.NewValidationError(fmt.Sprintf("metadata key %#v is too long, max allowed length: 255", k))
+		}
+		if len(v) > 512 {
+			return util.NewValidationError(fmt.Sprintf("the value for metadata key %#v is too long, max allowed length: 512", k))
+		}
+	}
+	return nil
+}
+
+func isMetadataMatching(metadata map[string]string, key, value string) bool {
+	val, ok := metadata[key]
+	if !ok {
+		return false
+	}
+	return value == "" || val == value
+}
+
+// getOrderedPage returns the page defined by limit and offset from the given ordered names
+func getOrderedPage(names []string, limit, offset int, order string) []string {
+	if order != OrderASC {
+		reversed := make([]string, 0, len(names))
+		for i := len(names) - 1; i >= 0; i-- {
+			reversed = append(reversed, names[i])
+		}
+		names = reversed
+	}
+	if offset >= len(names) {
+		return nil
+	}
+	names = names[offset:]
+	if len(names) > limit {
+		names = names[:limit]
+	}
+	return names
+}
+
 func validateBaseParams(user *User) error {
 	if user.Username == "" {
 		return util.NewValidationError("username is mandatory")
@@ -1446,9 +2314,127 @@ func validateBaseParams(user *User) error {
 	if !filepath.IsAbs(user.HomeDir) {
 		return util.NewValidationError(fmt.Sprintf("home_dir must be an absolute path, actual value: %v", user.HomeDir))
 	}
+	if user.QuotaSize < -1 {
+		return util.NewValidationError(fmt.Sprintf("invalid quota_size: %v", user.QuotaSize))
+	}
+	if user.QuotaFiles < -1 {
+		return util.NewValidationError(fmt.Sprintf("invalid quota_files: %v", user.QuotaFiles))
+	}
 	return nil
 }
 
+func hasLocalHomeDir(user *User) bool {
+	return user.FsConfig.Provider == sdk.LocalFilesystemProvider || user.FsConfig.Provider == sdk.CryptedFilesystemProvider
+}
+
+// isHomeDirAllowed returns true if homeDir is inside one of the allowed
+// base directories or if no restriction is configured
+func isHomeDirAllowed(homeDir string) bool {
+	if len(config.AllowedHomeBaseDirs) == 0 {
+		return true
+	}
+	for _, baseDir := range config.AllowedHomeBaseDirs {
+		prefix := baseDir
+		if !strings.HasSuffix(prefix, string(os.PathSeparator)) {
+			prefix += string(os.PathSeparator)
+		}
+		if homeDir == baseDir || strings.HasPrefix(homeDir, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFilesystemConfig identifies the filesystem type from the configured
+// provider and runs the matching validation. An unknown provider is rejected
+// instead of silently saving the configuration as a local filesystem
+func validateFilesystemConfig(fsConfig *vfs.Filesystem, helper vfs.ValidatorHelper) error {
+	if fsConfig.Provider.Name() == "" {
+		return util.NewValidationError(fmt.Sprintf("unsupported filesystem provider: %v", fsConfig.Provider))
+	}
+	return fsConfig.Validate(helper)
+}
+
+// validateProtocolFilesystems validates the protocol specific home directories
+// and filesystems, each one independently from the default ones
+func validateProtocolFilesystems(user *User) error {
+	if len(user.ProtocolFilesystems) == 0 {
+		user.ProtocolFilesystems = nil
+		return nil
+	}
+	var protocols []string
+	for idx := range user.ProtocolFilesystems {
+		p := &user.ProtocolFilesystems[idx]
+		if !util.IsStringInSlice(p.Protocol, ValidProtocols) {
+			return util.NewValidationError(fmt.Sprintf("invalid protocol filesystem protocol: %#v", p.Protocol))
+		}
+		if util.IsStringInSlice(p.Protocol, protocols) {
+			return util.NewValidationError(fmt.Sprintf("duplicated filesystem for protocol %#v", p.Protocol))
+		}
+		protocols = append(protocols, p.Protocol)
+		if p.HomeDir == "" || !filepath.IsAbs(p.HomeDir) {
+			return util.NewValidationError(fmt.Sprintf("home_dir for protocol %#v must be an absolute path, actual value: %#v",
+				p.Protocol, p.HomeDir))
+		}
+		p.HomeDir = filepath.Clean(p.HomeDir)
+		// the GCS credentials file is shared by all the filesystems of a user
+		if p.FsConfig.Provider == sdk.GCSFilesystemProvider {
+			return util.NewValidationError(fmt.Sprintf("GCS is not supported as filesystem for protocol %#v", p.Protocol))
+		}
+		if err := validateFilesystemConfig(&p.FsConfig, user); err != nil {
+			return err
+		}
+		if len(p.FsConfig.OSConfig.ReadReplicas) > 0 {
+			return util.NewValidationError("read replicas are supported for virtual folders only")
+		}
+		if p.FsConfig.Provider == sdk.LocalFilesystemProvider || p.FsConfig.Provider == sdk.CryptedFilesystemProvider {
+			if !isHomeDirAllowed(p.HomeDir) {
+				return util.NewValidationError(fmt.Sprintf("home_dir %#v for protocol %#v is not inside one of the allowed base directories",
+					p.HomeDir, p.Protocol))
+			}
+		}
+	}
+	return nil
+}
+
+// validateUserHomeDir checks the home directory against the allowed base
+// directories and, if configured, against the home directories of the other users
+func validateUserHomeDir(user *User) error {
+	if !hasLocalHomeDir(user) {
+		return nil
+	}
+	homeDir := filepath.Clean(user.HomeDir)
+	if !isHomeDirAllowed(homeDir) {
+		return util.NewValidationError(fmt.Sprintf("home_dir %#v is not inside one of the allowed base directories",
+			user.HomeDir))
+	}
+	if !config.DenyOverlappingHomeDirs {
+		return nil
+	}
+	const batchSize = 100
+	offset := 0
+	for {
+		users, err := provider.getUsers(batchSize, offset, OrderASC)
+		if err != nil {
+			return err
+		}
+		for idx := range users {
+			other := &users[idx]
+			if other.Username == user.Username || !hasLocalHomeDir(other) {
+				continue
+			}
+			if isMappedDirOverlapped(homeDir, filepath.Clean(other.HomeDir), true) {
+				return util.NewValidationError(fmt.Sprintf("home_dir %#v overlaps with the home dir of the user %#v",
+					user.HomeDir, other.Username))
+			}
+		}
+		if len(users) < batchSize {
+			return nil
+		}
+		offset += batchSize
+	}
+}
+
 func createUserPasswordHash(user *User) error {
 	if user.Password != "" && !user.IsPasswordHashed() {
 		if config.PasswordValidation.Users.MinEntropy > 0 {
@@ -1476,6 +2462,7 @@ func createUserPasswordHash(user *User) error {
 // ValidateFolder returns an error if the folder is not valid
 // FIXME: this should be defined as Folder struct method
 func ValidateFolder(folder *vfs.BaseVirtualFolder) error {
+	folder.FsConfig.SetEmptySecretsIfNil()
 	if folder.Name == "" {
 		return util.NewValidationError("folder name is mandatory")
 	}
@@ -1494,9 +2481,12 @@ func ValidateFolder(folder *vfs.BaseVirtualFolder) error {
 	if folder.HasRedactedSecret() {
 		return errors.New("cannot save a folder with a redacted secret")
 	}
-	if err := folder.FsConfig.Validate(folder); err != nil {
+	if err := validateFilesystemConfig(&folder.FsConfig, folder); err != nil {
 		return err
 	}
+	if util.IsStringInSlice(folder.MappedPath, folder.FsConfig.OSConfig.ReadReplicas) {
+		return util.NewValidationError(fmt.Sprintf("the folder mapped path %#v cannot be a read replica", folder.MappedPath))
+	}
 	return saveGCSCredentials(&folder.FsConfig, folder)
 }
 
@@ -1514,7 +2504,16 @@ func ValidateUser(user *User) error {
 	if user.hasRedactedSecret() {
 		return errors.New("cannot save a user with a redacted secret")
 	}
-	if err := user.FsConfig.Validate(user); err != nil {
+	if err := validateFilesystemConfig(&user.FsConfig, user); err != nil {
+		return err
+	}
+	if len(user.FsConfig.OSConfig.ReadReplicas) > 0 {
+		return util.NewValidationError("read replicas are supported for virtual folders only")
+	}
+	if err := validateUserHomeDir(user); err != nil {
+		return err
+	}
+	if err := validateProtocolFilesystems(user); err != nil {
 		return err
 	}
 	if err := validateUserVirtualFolders(user); err != nil {
@@ -1554,6 +2553,15 @@ func isPasswordOK(user *User, password string) (bool, error) {
 		}
 	}
 
+	match, err := comparePasswordAndHash(user, password)
+	if err == nil && match {
+		cachedPasswords.Add(user.Username, password)
+	}
+	return match, err
+}
+
+// comparePasswordAndHash checks the given password against the hashed password of the user
+func comparePasswordAndHash(user *User, password string) (bool, error) {
 	match := false
 	var err error
 	if strings.HasPrefix(user.Password, argonPwdPrefix) {
@@ -1578,9 +2586,6 @@ func isPasswordOK(user *User, password string) (bool, error) {
 			return match, err
 		}
 	}
-	if err == nil && match {
-		cachedPasswords.Add(user.Username, password)
-	}
 	return match, err
 }
 
@@ -2213,6 +3218,8 @@ func executePreLoginHook(username, loginMethod, ip, protocol string) (User, erro
 	u.UsedQuotaFiles = userUsedQuotaFiles
 	u.LastQuotaUpdate = userLastQuotaUpdate
 	u.LastLogin = userLastLogin
+	// the hook response is authoritative, it must not be rejected as a stale update
+	u.Version = 0
 	if userID == 0 {
 		err = provider.addUser(&u)
 	} else {
@@ -2380,6 +3387,20 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 		return user, err
 	}
 
+	var certKey string
+	if tlsCert != nil {
+		certKey = string(tlsCert.Raw)
+	}
+	cacheKey := cachedExternalAuths.getKey(username, password, pkey, keyboardInteractive, ip, protocol, certKey)
+	if cachedUsername, ok := cachedExternalAuths.Get(cacheKey); ok {
+		cachedUser, err := provider.userExists(cachedUsername)
+		if err == nil {
+			providerLog(logger.LevelDebug, "external auth for user %#v found in cache, SFTPGo user: %#v",
+				username, cachedUsername)
+			return cachedUser, nil
+		}
+	}
+
 	startTime := time.Now()
 	out, err := getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip, protocol, tlsCert, userAsJSON)
 	if err != nil {
@@ -2392,6 +3413,7 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 		if u.ID == 0 {
 			return u, util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
 		}
+		cachedExternalAuths.Add(cacheKey, u.Username)
 		return u, nil
 	}
 	err = json.Unmarshal(out, &user)
@@ -2416,10 +3438,12 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 		user.UsedQuotaFiles = u.UsedQuotaFiles
 		user.LastQuotaUpdate = u.LastQuotaUpdate
 		user.LastLogin = u.LastLogin
+		user.Version = 0
 		err = provider.updateUser(&user)
 		if err == nil {
 			webDAVUsersCache.swap(&user)
 			cachedPasswords.Add(user.Username, password)
+			cachedExternalAuths.Add(cacheKey, user.Username)
 		}
 		return user, err
 	}
@@ -2427,6 +3451,7 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 	if err != nil {
 		return user, err
 	}
+	cachedExternalAuths.Add(cacheKey, user.Username)
 	return provider.userExists(user.Username)
 }
 
@@ -2477,6 +3502,7 @@ func doPluginAuth(username, password string, pubKey []byte, ip, protocol string,
 		user.UsedQuotaFiles = u.UsedQuotaFiles
 		user.LastQuotaUpdate = u.LastQuotaUpdate
 		user.LastLogin = u.LastLogin
+		user.Version = 0
 		err = provider.updateUser(&user)
 		if err == nil {
 			webDAVUsersCache.swap(&user)
@@ -0,0 +1,132 @@
+package dataprovider
+
+import (
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/util"
+)
+
+// DefenderEvent defines an event contributing to the score of a defender host
+type DefenderEvent struct {
+	// event date time as unix timestamp in milliseconds
+	DateTime int64  `json:"date_time"`
+	Name     string `json:"name"`
+	Score    int    `json:"score"`
+}
+
+// DefenderHost defines a host tracked by the defender
+type DefenderHost struct {
+	ID int64  `json:"-"`
+	IP string `json:"ip"`
+	// ban expiration as unix timestamp in milliseconds, 0 means never banned
+	BanTime int64 `json:"ban_time"`
+	// last event as unix timestamp in milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+	// sum of the scores for the events after the requested time,
+	// it is not stored
+	Score int `json:"score,omitempty"`
+	// the events are only stored inside the host for the bolt and memory providers
+	Events []DefenderEvent `json:"events,omitempty"`
+}
+
+// IsBanned returns true if the host ban is not yet expired
+func (h *DefenderHost) IsBanned() bool {
+	return h.BanTime > util.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+// getScore returns the sum of the scores for the events after the given time
+func (h *DefenderHost) getScore(from int64) int {
+	score := 0
+	for _, ev := range h.Events {
+		if ev.DateTime >= from {
+			score += ev.Score
+		}
+	}
+	return score
+}
+
+// getEvents returns the events after the given time
+func (h *DefenderHost) getEvents(from int64) []DefenderEvent {
+	var events []DefenderEvent
+	for _, ev := range h.Events {
+		if ev.DateTime >= from {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// getWithoutEvents returns a copy of the host with the score computed for the
+// events after the given time and without the events
+func (h *DefenderHost) getWithoutEvents(from int64) DefenderHost {
+	return DefenderHost{
+		ID:        h.ID,
+		IP:        h.IP,
+		BanTime:   h.BanTime,
+		UpdatedAt: h.UpdatedAt,
+		Score:     h.getScore(from),
+	}
+}
+
+// removeEventsBefore removes the events before the given time
+func (h *DefenderHost) removeEventsBefore(from int64) {
+	h.Events = h.getEvents(from)
+}
+
+// isExpired returns true if the host is not banned and it has no events after
+// the given time
+func (h *DefenderHost) isExpired(from, now int64) bool {
+	return h.BanTime < now && h.UpdatedAt < from
+}
+
+// GetDefenderHosts returns the banned hosts and the hosts with events after the
+// given time, the score is computed using the events after the given time.
+// The most recently updated hosts are returned first
+func GetDefenderHosts(from int64, limit int) ([]DefenderHost, error) {
+	return provider.getDefenderHosts(from, limit)
+}
+
+// GetDefenderHostByIP returns the defender host with the given IP, the score is
+// computed using the events after the given time
+func GetDefenderHostByIP(ip string, from int64) (DefenderHost, error) {
+	return provider.getDefenderHostByIP(ip, from)
+}
+
+// IsDefenderHostBanned returns the defender host with the given IP if it is banned,
+// a RecordNotFoundError otherwise
+func IsDefenderHostBanned(ip string) (DefenderHost, error) {
+	return provider.isDefenderHostBanned(ip)
+}
+
+// UpdateDefenderBanTime increments the ban time for the given IP by the given minutes
+func UpdateDefenderBanTime(ip string, minutes int) error {
+	return provider.updateDefenderBanTime(ip, minutes)
+}
+
+// DeleteDefenderHost removes the given IP and its events
+func DeleteDefenderHost(ip string) error {
+	return provider.deleteDefenderHost(ip)
+}
+
+// AddDefenderEvent adds an event for the given IP, the host is added if missing
+func AddDefenderEvent(ip string, event DefenderEvent) error {
+	return provider.addDefenderEvent(ip, event)
+}
+
+// GetDefenderEvents returns the events after the given time for the given IP,
+// the oldest events are returned first
+func GetDefenderEvents(ip string, from int64) ([]DefenderEvent, error) {
+	return provider.getDefenderEvents(ip, from)
+}
+
+// SetDefenderBanTime sets the ban expiration, as unix timestamp in milliseconds,
+// for the given IP
+func SetDefenderBanTime(ip string, banTime int64) error {
+	return provider.setDefenderBanTime(ip, banTime)
+}
+
+// CleanupDefender removes the events before the given time for the hosts not
+// banned and the hosts not banned without events after the given time
+func CleanupDefender(from int64) error {
+	return provider.cleanupDefender(from)
+}
@@ -36,6 +36,10 @@ type memoryProviderHandle struct {
 	admins map[string]Admin
 	// slice with ordered admins
 	adminsUsernames []string
+	// map for users metadata, username is the key
+	usersMetadata map[string]map[string]string
+	// map for defender hosts, the IP is the key
+	defenderHosts map[string]DefenderHost
 }
 
 // MemoryProvider auth provider for a memory store
@@ -60,6 +64,8 @@ func initializeMemoryProvider(basePath string) {
 			vfoldersNames:   []string{},
 			admins:          make(map[string]Admin),
 			adminsUsernames: []string{},
+			usersMetadata:   make(map[string]map[string]string),
+			defenderHosts:   make(map[string]DefenderHost),
 			configFile:      configFile,
 		},
 	}
@@ -152,6 +158,36 @@ func (p *MemoryProvider) updateLastLogin(username string) error {
 	return nil
 }
 
+func (p *MemoryProvider) getUserPasswordHistory(username string) ([]string, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return nil, err
+	}
+	return user.PasswordHistory, nil
+}
+
+func (p *MemoryProvider) updateUserPassword(username, password string, history []string) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	user.PasswordHistory = history
+	user.Version++
+	p.dbHandle.users[user.Username] = user
+	return nil
+}
+
 func (p *MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -177,6 +213,28 @@ func (p *MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int6
 	return nil
 }
 
+func (p *MemoryProvider) reserveQuota(username string, sizeAdd, maxSize int64) (bool, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return false, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to reserve quota for user %#v error: %v", username, err)
+		return false, err
+	}
+	reserved := user.UsedQuotaSize+sizeAdd <= maxSize
+	if reserved {
+		user.UsedQuotaSize += sizeAdd
+		user.LastQuotaUpdate = util.GetTimeAsMsSinceEpoch(time.Now())
+		p.dbHandle.users[user.Username] = user
+	}
+	providerLog(logger.LevelDebug, "quota reservation for user %#v, size: %v max size: %v, reserved? %v",
+		username, sizeAdd, maxSize, reserved)
+	return reserved, nil
+}
+
 func (p *MemoryProvider) getUsedQuota(username string) (int, int64, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -214,6 +272,8 @@ func (p *MemoryProvider) addUser(user *User) error {
 	user.UsedQuotaSize = 0
 	user.UsedQuotaFiles = 0
 	user.LastLogin = 0
+	user.PasswordHistory = nil
+	user.Version = 1
 	user.VirtualFolders = p.joinVirtualFoldersFields(user)
 	p.dbHandle.users[user.Username] = user.getACopy()
 	p.dbHandle.usernames = append(p.dbHandle.usernames, user.Username)
@@ -239,6 +299,10 @@ func (p *MemoryProvider) updateUser(user *User) error {
 	if err != nil {
 		return err
 	}
+	if user.Version > 0 && u.Version != user.Version {
+		return util.NewConflictError(fmt.Sprintf("user %#v was modified by someone else, version %v is outdated",
+			user.Username, user.Version))
+	}
 	for _, oldFolder := range u.VirtualFolders {
 		p.removeUserFromFolderMapping(oldFolder.Name, u.Username)
 	}
@@ -247,6 +311,8 @@ func (p *MemoryProvider) updateUser(user *User) error {
 	user.UsedQuotaSize = u.UsedQuotaSize
 	user.UsedQuotaFiles = u.UsedQuotaFiles
 	user.LastLogin = u.LastLogin
+	user.PasswordHistory = u.PasswordHistory
+	user.Version = u.Version + 1
 	user.ID = u.ID
 	// pre-login and external auth hook will use the passed *user so save a copy
 	p.dbHandle.users[user.Username] = user.getACopy()
@@ -267,6 +333,7 @@ func (p *MemoryProvider) deleteUser(user *User) error {
 		p.removeUserFromFolderMapping(oldFolder.Name, u.Username)
 	}
 	delete(p.dbHandle.users, user.Username)
+	delete(p.dbHandle.usersMetadata, user.Username)
 	// this could be more efficient
 	p.dbHandle.usernames = make([]string, 0, len(p.dbHandle.users))
 	for username := range p.dbHandle.users {
@@ -276,6 +343,42 @@ func (p *MemoryProvider) deleteUser(user *User) error {
 	return nil
 }
 
+func (p *MemoryProvider) renameUser(oldUsername string, renamedUser *User) error {
+	newUsername := renamedUser.Username
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	u, err := p.userExistsInternal(oldUsername)
+	if err != nil {
+		return err
+	}
+	if _, err := p.userExistsInternal(newUsername); err == nil {
+		return util.NewValidationError(fmt.Sprintf("username %#v already exists", newUsername))
+	}
+	for _, folder := range u.VirtualFolders {
+		p.renameUserInFolderMapping(folder.Name, oldUsername, newUsername)
+	}
+	u.Username = newUsername
+	u.FsConfig = renamedUser.FsConfig.GetACopy()
+	u.ProtocolFilesystems = renamedUser.getACopy().ProtocolFilesystems
+	p.dbHandle.users[newUsername] = u
+	delete(p.dbHandle.users, oldUsername)
+	if metadata, ok := p.dbHandle.usersMetadata[oldUsername]; ok {
+		p.dbHandle.usersMetadata[newUsername] = metadata
+		delete(p.dbHandle.usersMetadata, oldUsername)
+	}
+	for idx, username := range p.dbHandle.usernames {
+		if username == oldUsername {
+			p.dbHandle.usernames[idx] = newUsername
+			break
+		}
+	}
+	sort.Strings(p.dbHandle.usernames)
+	return nil
+}
+
 func (p *MemoryProvider) dumpUsers() ([]User, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -291,11 +394,159 @@ func (p *MemoryProvider) dumpUsers() ([]User, error) {
 		if err != nil {
 			return users, err
 		}
+		if metadata, ok := p.dbHandle.usersMetadata[username]; ok {
+			user.Metadata = make(map[string]string)
+			for k, v := range metadata {
+				user.Metadata[k] = v
+			}
+		}
 		users = append(users, user)
 	}
 	return users, err
 }
 
+func (p *MemoryProvider) getUserMetadata(username string) (map[string]string, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.users[username]; !ok {
+		return nil, util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+	}
+	metadata := make(map[string]string)
+	for k, v := range p.dbHandle.usersMetadata[username] {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+func (p *MemoryProvider) setUserMetadata(username string, metadata map[string]string) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.users[username]; !ok {
+		return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+	}
+	if len(metadata) == 0 {
+		delete(p.dbHandle.usersMetadata, username)
+		return nil
+	}
+	m := make(map[string]string)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	p.dbHandle.usersMetadata[username] = m
+	return nil
+}
+
+func (p *MemoryProvider) getUsersByMetadata(key, value string, limit, offset int, order string) ([]User, error) {
+	users := make([]User, 0, limit)
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return users, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return users, nil
+	}
+	var usernames []string
+	for _, username := range p.dbHandle.usernames {
+		if isMetadataMatching(p.dbHandle.usersMetadata[username], key, value) {
+			usernames = append(usernames, username)
+		}
+	}
+	for _, username := range getOrderedPage(usernames, limit, offset, order) {
+		u := p.dbHandle.users[username]
+		user := u.getACopy()
+		user.PrepareForRendering()
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (p *MemoryProvider) getUsersByUsernames(usernames []string) ([]User, error) {
+	users := make([]User, 0, len(usernames))
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return users, errMemoryProviderClosed
+	}
+	sortedUsernames := make([]string, len(usernames))
+	copy(sortedUsernames, usernames)
+	sort.Strings(sortedUsernames)
+	for _, username := range sortedUsernames {
+		if u, ok := p.dbHandle.users[username]; ok {
+			users = append(users, u.getACopy())
+		}
+	}
+	return users, nil
+}
+
+func (p *MemoryProvider) countUsers(filter CountFilter) (int64, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, errMemoryProviderClosed
+	}
+	var count int64
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	for _, user := range p.dbHandle.users {
+		if filter.matchesUser(&user, now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (p *MemoryProvider) getExpiringUsers(expirationBefore int64) ([]User, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	users := make([]User, 0, 10)
+	for _, username := range p.dbHandle.usernames {
+		u := p.dbHandle.users[username]
+		if u.Status == 1 && u.ExpirationDate > 0 && u.ExpirationDate <= expirationBefore {
+			users = append(users, u.getACopy())
+		}
+	}
+	return users, nil
+}
+
+func (p *MemoryProvider) countAdmins(filter CountFilter) (int64, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, errMemoryProviderClosed
+	}
+	var count int64
+	for _, admin := range p.dbHandle.admins {
+		if filter.matchesAdmin(&admin) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (p *MemoryProvider) countFolders(filter CountFilter) (int64, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, errMemoryProviderClosed
+	}
+	var count int64
+	for _, folder := range p.dbHandle.vfolders {
+		if filter != CountOrphaned || len(folder.Users) == 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
 func (p *MemoryProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -531,6 +782,170 @@ func (p *MemoryProvider) updateFolderQuota(name string, filesAdd int, sizeAdd in
 	return nil
 }
 
+func (p *MemoryProvider) reserveFolderQuota(name string, sizeAdd, maxSize int64) (bool, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return false, errMemoryProviderClosed
+	}
+	folder, err := p.folderExistsInternal(name)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to reserve quota for folder %#v error: %v", name, err)
+		return false, err
+	}
+	reserved := folder.UsedQuotaSize+sizeAdd <= maxSize
+	if reserved {
+		folder.UsedQuotaSize += sizeAdd
+		folder.LastQuotaUpdate = util.GetTimeAsMsSinceEpoch(time.Now())
+		p.dbHandle.vfolders[name] = folder
+	}
+	providerLog(logger.LevelDebug, "quota reservation for folder %#v, size: %v max size: %v, reserved? %v",
+		name, sizeAdd, maxSize, reserved)
+	return reserved, nil
+}
+
+func (p *MemoryProvider) getDefenderHosts(from int64, limit int) ([]DefenderHost, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	hosts := make([]DefenderHost, 0, len(p.dbHandle.defenderHosts))
+	for _, host := range p.dbHandle.defenderHosts {
+		if host.UpdatedAt >= from || host.IsBanned() {
+			hosts = append(hosts, host.getWithoutEvents(from))
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].UpdatedAt > hosts[j].UpdatedAt
+	})
+	if len(hosts) > limit {
+		hosts = hosts[:limit]
+	}
+	return hosts, nil
+}
+
+func (p *MemoryProvider) getDefenderHostByIP(ip string, from int64) (DefenderHost, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return DefenderHost{}, errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok {
+		return DefenderHost{}, util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	return host.getWithoutEvents(from), nil
+}
+
+func (p *MemoryProvider) isDefenderHostBanned(ip string) (DefenderHost, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return DefenderHost{}, errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok || !host.IsBanned() {
+		return DefenderHost{}, util.NewRecordNotFoundError(fmt.Sprintf("host %#v is not banned", ip))
+	}
+	return host.getWithoutEvents(0), nil
+}
+
+func (p *MemoryProvider) updateDefenderBanTime(ip string, minutes int) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok {
+		return util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	host.BanTime += int64(minutes) * time.Minute.Milliseconds()
+	p.dbHandle.defenderHosts[ip] = host
+	return nil
+}
+
+func (p *MemoryProvider) deleteDefenderHost(ip string) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.defenderHosts[ip]; !ok {
+		return util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	delete(p.dbHandle.defenderHosts, ip)
+	return nil
+}
+
+func (p *MemoryProvider) addDefenderEvent(ip string, event DefenderEvent) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok {
+		host = DefenderHost{
+			IP: ip,
+		}
+	}
+	host.UpdatedAt = event.DateTime
+	host.Events = append(host.Events, event)
+	p.dbHandle.defenderHosts[ip] = host
+	return nil
+}
+
+func (p *MemoryProvider) getDefenderEvents(ip string, from int64) ([]DefenderEvent, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return nil, errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok {
+		return nil, nil
+	}
+	return host.getEvents(from), nil
+}
+
+func (p *MemoryProvider) setDefenderBanTime(ip string, banTime int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok {
+		return util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	host.BanTime = banTime
+	host.UpdatedAt = util.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.defenderHosts[ip] = host
+	return nil
+}
+
+func (p *MemoryProvider) cleanupDefender(from int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	for ip, host := range p.dbHandle.defenderHosts {
+		if host.isExpired(from, now) {
+			delete(p.dbHandle.defenderHosts, ip)
+			continue
+		}
+		if host.BanTime < now {
+			host.removeEventsBefore(from)
+			p.dbHandle.defenderHosts[ip] = host
+		}
+	}
+	return nil
+}
+
 func (p *MemoryProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -572,6 +987,21 @@ func (p *MemoryProvider) removeUserFromFolderMapping(folderName, username string
 	}
 }
 
+func (p *MemoryProvider) renameUserInFolderMapping(folderName, oldUsername, newUsername string) {
+	folder, err := p.folderExistsInternal(folderName)
+	if err == nil {
+		usernames := make([]string, 0, len(folder.Users))
+		for _, user := range folder.Users {
+			if user == oldUsername {
+				user = newUsername
+			}
+			usernames = append(usernames, user)
+		}
+		folder.Users = usernames
+		p.dbHandle.vfolders[folder.Name] = folder
+	}
+}
+
 func (p *MemoryProvider) updateFoldersMappingInternal(folder vfs.BaseVirtualFolder) {
 	p.dbHandle.vfolders[folder.Name] = folder
 	if !util.IsStringInSlice(folder.Name, p.dbHandle.vfoldersNames) {
@@ -659,6 +1089,31 @@ func (p *MemoryProvider) getFolders(limit, offset int, order string) ([]vfs.Base
 	return folders, err
 }
 
+func (p *MemoryProvider) getOrphanedFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error) {
+	folders := make([]vfs.BaseVirtualFolder, 0, limit)
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return folders, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return folders, nil
+	}
+	var names []string
+	for _, name := range p.dbHandle.vfoldersNames {
+		if len(p.dbHandle.vfolders[name].Users) == 0 {
+			names = append(names, name)
+		}
+	}
+	for _, name := range getOrderedPage(names, limit, offset, order) {
+		f := p.dbHandle.vfolders[name]
+		folder := f.GetACopy()
+		folder.PrepareForRendering()
+		folders = append(folders, folder)
+	}
+	return folders, nil
+}
+
 func (p *MemoryProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -809,6 +1264,7 @@ func (p *MemoryProvider) clear() {
 	p.dbHandle.vfolders = make(map[string]vfs.BaseVirtualFolder)
 	p.dbHandle.admins = make(map[string]Admin)
 	p.dbHandle.adminsUsernames = []string{}
+	p.dbHandle.usersMetadata = make(map[string]map[string]string)
 }
 
 func (p *MemoryProvider) reloadConfig() error {
@@ -908,6 +1364,10 @@ func (p *MemoryProvider) restoreFolders(dump *BackupData) error {
 func (p *MemoryProvider) restoreUsers(dump *BackupData) error {
 	for _, user := range dump.Users {
 		user := user // pin
+		if err := validateUserMetadata(user.Metadata); err != nil {
+			providerLog(logger.LevelWarn, "invalid metadata for user %#v: %v", user.Username, err)
+			return err
+		}
 		u, err := p.userExists(user.Username)
 		if err == nil {
 			user.ID = u.ID
@@ -923,6 +1383,14 @@ func (p *MemoryProvider) restoreUsers(dump *BackupData) error {
 				return err
 			}
 		}
+		// like UpdateUser, the metadata of an existing user are replaced only if not nil
+		if user.Metadata != nil {
+			err = p.setUserMetadata(user.Username, user.Metadata)
+			if err != nil {
+				providerLog(logger.LevelWarn, "error restoring metadata for user %#v: %v", user.Username, err)
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -45,6 +45,33 @@ CREATE INDEX "{{prefix}}folders_mapping_folder_id_idx" ON "{{folders_mapping}}"
 CREATE INDEX "{{prefix}}folders_mapping_user_id_idx" ON "{{folders_mapping}}" ("user_id");
 INSERT INTO {{schema_version}} (version) VALUES (10);
 `
+	pgsqlV11SQL = `CREATE TABLE "{{users_metadata}}" ("id" serial NOT NULL PRIMARY KEY, "meta_key" varchar(255) NOT NULL,
+"meta_value" varchar(512) NOT NULL, "user_id" integer NOT NULL);
+ALTER TABLE "{{users_metadata}}" ADD CONSTRAINT "{{prefix}}unique_user_metadata" UNIQUE ("user_id", "meta_key");
+ALTER TABLE "{{users_metadata}}" ADD CONSTRAINT "{{prefix}}users_metadata_user_id_fk_users_id"
+FOREIGN KEY ("user_id") REFERENCES "{{users}}" ("id") MATCH SIMPLE ON UPDATE NO ACTION ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+CREATE INDEX "{{prefix}}users_metadata_key_value_idx" ON "{{users_metadata}}" ("meta_key", "meta_value");
+`
+	pgsqlV11DownSQL = `DROP TABLE "{{users_metadata}}" CASCADE;`
+	pgsqlV12SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "password_history" text NULL;`
+	pgsqlV12DownSQL = `ALTER TABLE "{{users}}" DROP COLUMN "password_history" CASCADE;`
+	pgsqlV13SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "version" bigint DEFAULT 1 NOT NULL;`
+	pgsqlV13DownSQL = `ALTER TABLE "{{users}}" DROP COLUMN "version" CASCADE;`
+	pgsqlV14SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "protocol_filesystems" text NULL;`
+	pgsqlV14DownSQL = `ALTER TABLE "{{users}}" DROP COLUMN "protocol_filesystems" CASCADE;`
+	pgsqlV15SQL     = `CREATE TABLE "{{defender_hosts}}" ("id" bigserial NOT NULL PRIMARY KEY, "ip" varchar(50) NOT NULL UNIQUE,
+"ban_time" bigint NOT NULL, "updated_at" bigint NOT NULL);
+CREATE TABLE "{{defender_events}}" ("id" bigserial NOT NULL PRIMARY KEY, "date_time" bigint NOT NULL,
+"name" varchar(50) NOT NULL, "score" integer NOT NULL, "host_id" bigint NOT NULL);
+ALTER TABLE "{{defender_events}}" ADD CONSTRAINT "{{prefix}}defender_events_host_id_fk_defender_hosts_id"
+FOREIGN KEY ("host_id") REFERENCES "{{defender_hosts}}" ("id") MATCH SIMPLE ON UPDATE NO ACTION ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+CREATE INDEX "{{prefix}}defender_hosts_updated_at_idx" ON "{{defender_hosts}}" ("updated_at");
+CREATE INDEX "{{prefix}}defender_hosts_ban_time_idx" ON "{{defender_hosts}}" ("ban_time");
+CREATE INDEX "{{prefix}}defender_events_date_time_idx" ON "{{defender_events}}" ("date_time");
+CREATE INDEX "{{prefix}}defender_events_host_id_idx" ON "{{defender_events}}" ("host_id");
+`
+	pgsqlV15DownSQL = `DROP TABLE "{{defender_events}}" CASCADE;
+DROP TABLE "{{defender_hosts}}" CASCADE;`
 )
 
 // PGSQLProvider auth provider for PostgreSQL database
@@ -112,6 +139,10 @@ func (p *PGSQLProvider) updateQuota(username string, filesAdd int, sizeAdd int64
 	return sqlCommonUpdateQuota(username, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p *PGSQLProvider) reserveQuota(username string, sizeAdd, maxSize int64) (bool, error) {
+	return sqlCommonReserveQuota(username, sizeAdd, maxSize, p.dbHandle)
+}
+
 func (p *PGSQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
@@ -136,6 +167,10 @@ func (p *PGSQLProvider) deleteUser(user *User) error {
 	return sqlCommonDeleteUser(user, p.dbHandle)
 }
 
+func (p *PGSQLProvider) renameUser(oldUsername string, user *User) error {
+	return sqlCommonRenameUser(oldUsername, user, p.dbHandle)
+}
+
 func (p *PGSQLProvider) dumpUsers() ([]User, error) {
 	return sqlCommonDumpUsers(p.dbHandle)
 }
@@ -144,6 +179,46 @@ func (p *PGSQLProvider) getUsers(limit int, offset int, order string) ([]User, e
 	return sqlCommonGetUsers(limit, offset, order, p.dbHandle)
 }
 
+func (p *PGSQLProvider) getUserMetadata(username string) (map[string]string, error) {
+	return sqlCommonGetUserMetadata(username, p.dbHandle)
+}
+
+func (p *PGSQLProvider) setUserMetadata(username string, metadata map[string]string) error {
+	return sqlCommonSetUserMetadata(username, metadata, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getUsersByUsernames(usernames []string) ([]User, error) {
+	return sqlCommonGetUsersByUsernames(usernames, p.dbHandle)
+}
+
+func (p *PGSQLProvider) countUsers(filter CountFilter) (int64, error) {
+	return sqlCommonCountUsers(filter, p.dbHandle)
+}
+
+func (p *PGSQLProvider) countAdmins(filter CountFilter) (int64, error) {
+	return sqlCommonCountAdmins(filter, p.dbHandle)
+}
+
+func (p *PGSQLProvider) countFolders(filter CountFilter) (int64, error) {
+	return sqlCommonCountFolders(filter, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getExpiringUsers(expirationBefore int64) ([]User, error) {
+	return sqlCommonGetExpiringUsers(expirationBefore, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getUserPasswordHistory(username string) ([]string, error) {
+	return sqlCommonGetUserPasswordHistory(username, p.dbHandle)
+}
+
+func (p *PGSQLProvider) updateUserPassword(username, password string, history []string) error {
+	return sqlCommonUpdateUserPassword(username, password, history, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getUsersByMetadata(key, value string, limit, offset int, order string) ([]User, error) {
+	return sqlCommonGetUsersByMetadata(key, value, limit, offset, order, p.dbHandle)
+}
+
 func (p *PGSQLProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return sqlCommonDumpFolders(p.dbHandle)
 }
@@ -152,6 +227,10 @@ func (p *PGSQLProvider) getFolders(limit, offset int, order string) ([]vfs.BaseV
 	return sqlCommonGetFolders(limit, offset, order, p.dbHandle)
 }
 
+func (p *PGSQLProvider) getOrphanedFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetOrphanedFolders(limit, offset, order, p.dbHandle)
+}
+
 func (p *PGSQLProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -174,6 +253,46 @@ func (p *PGSQLProvider) updateFolderQuota(name string, filesAdd int, sizeAdd int
 	return sqlCommonUpdateFolderQuota(name, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p *PGSQLProvider) reserveFolderQuota(name string, sizeAdd, maxSize int64) (bool, error) {
+	return sqlCommonReserveFolderQuota(name, sizeAdd, maxSize, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getDefenderHosts(from int64, limit int) ([]DefenderHost, error) {
+	return sqlCommonGetDefenderHosts(from, limit, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getDefenderHostByIP(ip string, from int64) (DefenderHost, error) {
+	return sqlCommonGetDefenderHostByIP(ip, from, p.dbHandle)
+}
+
+func (p *PGSQLProvider) isDefenderHostBanned(ip string) (DefenderHost, error) {
+	return sqlCommonIsDefenderHostBanned(ip, p.dbHandle)
+}
+
+func (p *PGSQLProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return sqlCommonUpdateDefenderBanTime(ip, minutes, p.dbHandle)
+}
+
+func (p *PGSQLProvider) deleteDefenderHost(ip string) error {
+	return sqlCommonDeleteDefenderHost(ip, p.dbHandle)
+}
+
+func (p *PGSQLProvider) addDefenderEvent(ip string, event DefenderEvent) error {
+	return sqlCommonAddDefenderEvent(ip, event, p.dbHandle)
+}
+
+func (p *PGSQLProvider) getDefenderEvents(ip string, from int64) ([]DefenderEvent, error) {
+	return sqlCommonGetDefenderEvents(ip, from, p.dbHandle)
+}
+
+func (p *PGSQLProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return sqlCommonSetDefenderBanTime(ip, banTime, p.dbHandle)
+}
+
+func (p *PGSQLProvider) cleanupDefender(from int64) error {
+	return sqlCommonCleanupDefender(from, p.dbHandle)
+}
+
 func (p *PGSQLProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
 }
@@ -251,6 +370,16 @@ func (p *PGSQLProvider) migrateDatabase() error {
 		providerLog(logger.LevelError, "%v", err)
 		logger.ErrorToConsole("%v", err)
 		return err
+	case version == 10:
+		return updatePGSQLDatabaseFromV10(p.dbHandle)
+	case version == 11:
+		return updatePGSQLDatabaseFromV11(p.dbHandle)
+	case version == 12:
+		return updatePGSQLDatabaseFromV12(p.dbHandle)
+	case version == 13:
+		return updatePGSQLDatabaseFromV13(p.dbHandle)
+	case version == 14:
+		return updatePGSQLDatabaseFromV14(p.dbHandle)
 	default:
 		if version > sqlDatabaseVersion {
 			providerLog(logger.LevelWarn, "database version %v is newer than the supported one: %v", version,
@@ -272,5 +401,163 @@ func (p *PGSQLProvider) revertDatabase(targetVersion int) error {
 		return errors.New("current version match target version, nothing to do")
 	}
 
-	return errors.New("the current version cannot be reverted")
+	switch dbVersion.Version {
+	case 11:
+		return downgradePGSQLDatabaseFromV11(p.dbHandle)
+	case 12:
+		return downgradePGSQLDatabaseFromV12(p.dbHandle)
+	case 13:
+		return downgradePGSQLDatabaseFromV13(p.dbHandle)
+	case 14:
+		return downgradePGSQLDatabaseFromV14(p.dbHandle)
+	case 15:
+		return downgradePGSQLDatabaseFromV15(p.dbHandle)
+	default:
+		return fmt.Errorf("database version not handled: %v", dbVersion.Version)
+	}
+}
+
+func updatePGSQLDatabaseFromV10(dbHandle *sql.DB) error {
+	if err := updatePGSQLDatabaseFrom10To11(dbHandle); err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV11(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV11(dbHandle *sql.DB) error {
+	if err := updatePGSQLDatabaseFrom11To12(dbHandle); err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV12(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV12(dbHandle *sql.DB) error {
+	if err := updatePGSQLDatabaseFrom12To13(dbHandle); err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV13(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV13(dbHandle *sql.DB) error {
+	if err := updatePGSQLDatabaseFrom13To14(dbHandle); err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV14(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV14(dbHandle *sql.DB) error {
+	return updatePGSQLDatabaseFrom14To15(dbHandle)
+}
+
+func downgradePGSQLDatabaseFromV11(dbHandle *sql.DB) error {
+	return downgradePGSQLDatabaseFrom11To10(dbHandle)
+}
+
+func downgradePGSQLDatabaseFromV12(dbHandle *sql.DB) error {
+	if err := downgradePGSQLDatabaseFrom12To11(dbHandle); err != nil {
+		return err
+	}
+	return downgradePGSQLDatabaseFromV11(dbHandle)
+}
+
+func downgradePGSQLDatabaseFromV13(dbHandle *sql.DB) error {
+	if err := downgradePGSQLDatabaseFrom13To12(dbHandle); err != nil {
+		return err
+	}
+	return downgradePGSQLDatabaseFromV12(dbHandle)
+}
+
+func downgradePGSQLDatabaseFromV14(dbHandle *sql.DB) error {
+	if err := downgradePGSQLDatabaseFrom14To13(dbHandle); err != nil {
+		return err
+	}
+	return downgradePGSQLDatabaseFromV13(dbHandle)
+}
+
+func downgradePGSQLDatabaseFromV15(dbHandle *sql.DB) error {
+	if err := downgradePGSQLDatabaseFrom15To14(dbHandle); err != nil {
+		return err
+	}
+	return downgradePGSQLDatabaseFromV14(dbHandle)
+}
+
+func updatePGSQLDatabaseFrom10To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 10 -> 11")
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	sql := strings.ReplaceAll(pgsqlV11SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{users_metadata}}", sqlTableUsersMetadata)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	if config.Driver == CockroachDataProviderName {
+		sql = strings.ReplaceAll(sql, "DEFERRABLE INITIALLY DEFERRED", "")
+	}
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 11)
+}
+
+func downgradePGSQLDatabaseFrom11To10(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 11 -> 10")
+	providerLog(logger.LevelInfo, "downgrading database version: 11 -> 10")
+	sql := strings.ReplaceAll(pgsqlV11DownSQL, "{{users_metadata}}", sqlTableUsersMetadata)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 10)
+}
+
+func updatePGSQLDatabaseFrom11To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 11 -> 12")
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	sql := strings.ReplaceAll(pgsqlV12SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 12)
+}
+
+func downgradePGSQLDatabaseFrom12To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 12 -> 11")
+	providerLog(logger.LevelInfo, "downgrading database version: 12 -> 11")
+	sql := strings.ReplaceAll(pgsqlV12DownSQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 11)
+}
+
+func updatePGSQLDatabaseFrom12To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 12 -> 13")
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	sql := strings.ReplaceAll(pgsqlV13SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 13)
+}
+
+func downgradePGSQLDatabaseFrom13To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 13 -> 12")
+	providerLog(logger.LevelInfo, "downgrading database version: 13 -> 12")
+	sql := strings.ReplaceAll(pgsqlV13DownSQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 12)
+}
+
+func updatePGSQLDatabaseFrom13To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 13 -> 14")
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	sql := strings.ReplaceAll(pgsqlV14SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 14)
+}
+
+func downgradePGSQLDatabaseFrom14To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 14 -> 13")
+	providerLog(logger.LevelInfo, "downgrading database version: 14 -> 13")
+	sql := strings.ReplaceAll(pgsqlV14DownSQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 13)
+}
+
+func updatePGSQLDatabaseFrom14To15(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 14 -> 15")
+	providerLog(logger.LevelInfo, "updating database version: 14 -> 15")
+	sql := strings.ReplaceAll(pgsqlV15SQL, "{{defender_hosts}}", sqlTableDefenderHosts)
+	sql = strings.ReplaceAll(sql, "{{defender_events}}", sqlTableDefenderEvents)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	if config.Driver == CockroachDataProviderName {
+		sql = strings.ReplaceAll(sql, "DEFERRABLE INITIALLY DEFERRED", "")
+	}
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 15)
+}
+
+func downgradePGSQLDatabaseFrom15To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 15 -> 14")
+	providerLog(logger.LevelInfo, "downgrading database version: 15 -> 14")
+	sql := strings.ReplaceAll(pgsqlV15DownSQL, "{{defender_events}}", sqlTableDefenderEvents)
+	sql = strings.ReplaceAll(sql, "{{defender_hosts}}", sqlTableDefenderHosts)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 14)
 }
@@ -91,6 +91,17 @@ func (q *quotaUpdater) updateUserQuota(username string, files int, size int64) {
 	q.pendingUserQuotaUpdates[username] = obj
 }
 
+// renameUser moves the pending quota updates, if any, to the new username
+func (q *quotaUpdater) renameUser(oldUsername, newUsername string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if obj, ok := q.pendingUserQuotaUpdates[oldUsername]; ok {
+		q.pendingUserQuotaUpdates[newUsername] = obj
+		delete(q.pendingUserQuotaUpdates, oldUsername)
+	}
+}
+
 func (q *quotaUpdater) getUserPendingQuota(username string) (int, int64) {
 	q.RLock()
 	defer q.RUnlock()
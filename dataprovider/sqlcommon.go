@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,7 +20,7 @@ import (
 )
 
 const (
-	sqlDatabaseVersion     = 10
+	sqlDatabaseVersion     = 15
 	defaultSQLQueryTimeout = 10 * time.Second
 	longSQLQueryTimeout    = 60 * time.Second
 )
@@ -282,6 +283,30 @@ func sqlCommonUpdateQuota(username string, filesAdd int, sizeAdd int64, reset bo
 	return err
 }
 
+func sqlCommonReserveQuota(username string, sizeAdd, maxSize int64, dbHandle *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getReserveQuotaQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, sizeAdd, util.GetTimeAsMsSinceEpoch(time.Now()), username, sizeAdd, maxSize)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error reserving quota for user %#v: %v", username, err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	providerLog(logger.LevelDebug, "quota reservation for user %#v, size: %v max size: %v, reserved? %v",
+		username, sizeAdd, maxSize, affected > 0)
+	return affected > 0, nil
+}
+
 func sqlCommonGetUsedQuota(username string, dbHandle *sql.DB) (int, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -303,6 +328,41 @@ func sqlCommonGetUsedQuota(username string, dbHandle *sql.DB) (int, int64, error
 	return usedFiles, usedSize, err
 }
 
+func sqlCommonCountUsers(filter CountFilter, dbHandle *sql.DB) (int64, error) {
+	var args []interface{}
+	if filter == CountActive || filter == CountExpired {
+		args = append(args, util.GetTimeAsMsSinceEpoch(time.Now()))
+	}
+	return sqlCommonCount(getCountUsersQuery(filter), dbHandle, args...)
+}
+
+func sqlCommonCountAdmins(filter CountFilter, dbHandle *sql.DB) (int64, error) {
+	return sqlCommonCount(getCountAdminsQuery(filter), dbHandle)
+}
+
+func sqlCommonCountFolders(filter CountFilter, dbHandle *sql.DB) (int64, error) {
+	return sqlCommonCount(getCountFoldersQuery(filter), dbHandle)
+}
+
+func sqlCommonCount(q string, dbHandle *sql.DB, args ...interface{}) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var count int64
+	err = stmt.QueryRowContext(ctx, args...).Scan(&count)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error executing count query %#v: %v", q, err)
+		return 0, err
+	}
+	return count, nil
+}
+
 func sqlCommonUpdateLastLogin(username string, dbHandle *sql.DB) error {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -322,6 +382,52 @@ func sqlCommonUpdateLastLogin(username string, dbHandle *sql.DB) error {
 	return err
 }
 
+func sqlCommonGetUserPasswordHistory(username string, dbHandle sqlQuerier) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUserPasswordHistoryQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var history sql.NullString
+	err = stmt.QueryRowContext(ctx, username).Scan(&history)
+	if err == sql.ErrNoRows {
+		return nil, util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+	}
+	if err != nil || !history.Valid || history.String == "" {
+		return nil, err
+	}
+	var result []string
+	err = json.Unmarshal([]byte(history.String), &result)
+	return result, err
+}
+
+func sqlCommonUpdateUserPassword(username, password string, history []string, dbHandle *sql.DB) error {
+	historyAsJSON, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateUserPasswordQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, password, string(historyAsJSON), username)
+	if err == nil {
+		providerLog(logger.LevelDebug, "password updated for user %#v", username)
+	} else {
+		providerLog(logger.LevelWarn, "error updating password for user %#v: %v", username, err)
+	}
+	return err
+}
+
 func sqlCommonAddUser(user *User, dbHandle *sql.DB) error {
 	err := ValidateUser(user)
 	if err != nil {
@@ -354,9 +460,13 @@ func sqlCommonAddUser(user *User, dbHandle *sql.DB) error {
 		if err != nil {
 			return err
 		}
+		protocolFilesystems, err := user.GetProtocolFilesystemsAsJSON()
+		if err != nil {
+			return err
+		}
 		_, err = stmt.ExecContext(ctx, user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 			user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate, string(filters),
-			string(fsConfig), user.AdditionalInfo, user.Description)
+			string(fsConfig), user.AdditionalInfo, user.Description, string(protocolFilesystems))
 		if err != nil {
 			return err
 		}
@@ -372,7 +482,7 @@ func sqlCommonUpdateUser(user *User, dbHandle *sql.DB) error {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
 
-	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+	err = sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
 		q := getUpdateUserQuery()
 		stmt, err := tx.PrepareContext(ctx, q)
 		if err != nil {
@@ -396,14 +506,34 @@ func sqlCommonUpdateUser(user *User, dbHandle *sql.DB) error {
 		if err != nil {
 			return err
 		}
-		_, err = stmt.ExecContext(ctx, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
-			user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate,
-			string(filters), string(fsConfig), user.AdditionalInfo, user.Description, user.ID)
+		protocolFilesystems, err := user.GetProtocolFilesystemsAsJSON()
+		if err != nil {
+			return err
+		}
+		res, err := stmt.ExecContext(ctx, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions,
+			user.QuotaSize, user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status,
+			user.ExpirationDate, string(filters), string(fsConfig), user.AdditionalInfo, user.Description, string(protocolFilesystems),
+			user.ID, user.Version, user.Version)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
 		if err != nil {
 			return err
 		}
+		if affected == 0 {
+			if err := sqlCommonCheckUserExists(ctx, user.Username, tx); err != nil {
+				return err
+			}
+			return util.NewConflictError(fmt.Sprintf("user %#v was modified by someone else, version %v is outdated",
+				user.Username, user.Version))
+		}
 		return generateVirtualFoldersMapping(ctx, user, tx)
 	})
+	if err == nil && user.Version > 0 {
+		user.Version++
+	}
+	return err
 }
 
 func sqlCommonDeleteUser(user *User, dbHandle *sql.DB) error {
@@ -420,6 +550,44 @@ func sqlCommonDeleteUser(user *User, dbHandle *sql.DB) error {
 	return err
 }
 
+// sqlCommonRenameUser changes the username for an existing user and replaces
+// the filesystems, their secrets are bound to the username.
+// Folders mapping and metadata reference the user id so they are preserved
+func sqlCommonRenameUser(oldUsername string, user *User, dbHandle *sql.DB) error {
+	fsConfig, err := user.GetFsConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	protocolFilesystems, err := user.GetProtocolFilesystemsAsJSON()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		if err := sqlCommonCheckUserExists(ctx, oldUsername, tx); err != nil {
+			return err
+		}
+		err := sqlCommonCheckUserExists(ctx, user.Username, tx)
+		if err == nil {
+			return util.NewValidationError(fmt.Sprintf("username %#v already exists", user.Username))
+		}
+		if _, ok := err.(*util.RecordNotFoundError); !ok {
+			return err
+		}
+		q := getRenameUserQuery()
+		stmt, err := tx.PrepareContext(ctx, q)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+			return err
+		}
+		defer stmt.Close()
+		_, err = stmt.ExecContext(ctx, user.Username, string(fsConfig), string(protocolFilesystems), oldUsername)
+		return err
+	})
+}
+
 func sqlCommonDumpUsers(dbHandle sqlQuerier) ([]User, error) {
 	users := make([]User, 0, 100)
 	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
@@ -452,7 +620,11 @@ func sqlCommonDumpUsers(dbHandle sqlQuerier) ([]User, error) {
 	if err != nil {
 		return users, err
 	}
-	return getUsersWithVirtualFolders(ctx, users, dbHandle)
+	users, err = getUsersWithVirtualFolders(ctx, users, dbHandle)
+	if err != nil {
+		return users, err
+	}
+	return getUsersWithMetadata(ctx, users, dbHandle)
 }
 
 func sqlCommonGetUsers(limit int, offset int, order string, dbHandle sqlQuerier) ([]User, error) {
@@ -486,6 +658,226 @@ func sqlCommonGetUsers(limit int, offset int, order string, dbHandle sqlQuerier)
 	return getUsersWithVirtualFolders(ctx, users, dbHandle)
 }
 
+func sqlCommonGetUsersByUsernames(usernames []string, dbHandle sqlQuerier) ([]User, error) {
+	users := make([]User, 0, len(usernames))
+	if len(usernames) == 0 {
+		return users, nil
+	}
+	sortedUsernames := make([]string, len(usernames))
+	copy(sortedUsernames, usernames)
+	sort.Strings(sortedUsernames)
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	// the IN clause is built using the available placeholders, so we query the users in chunks
+	chunkSize := len(sqlPlaceholders)
+	for start := 0; start < len(sortedUsernames); start += chunkSize {
+		end := start + chunkSize
+		if end > len(sortedUsernames) {
+			end = len(sortedUsernames)
+		}
+		chunk, err := sqlCommonGetUsersChunk(ctx, sortedUsernames[start:end], dbHandle)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, chunk...)
+	}
+	return users, nil
+}
+
+func sqlCommonGetUsersChunk(ctx context.Context, usernames []string, dbHandle sqlQuerier) ([]User, error) {
+	users := make([]User, 0, len(usernames))
+	q := getUsersByUsernamesQuery(len(usernames))
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, 0, len(usernames))
+	for _, username := range usernames {
+		args = append(args, username)
+	}
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := getUserFromDbRow(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		return users, err
+	}
+	return getUsersWithVirtualFolders(ctx, users, dbHandle)
+}
+
+func sqlCommonGetExpiringUsers(expirationBefore int64, dbHandle sqlQuerier) ([]User, error) {
+	users := make([]User, 0, 10)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getExpiringUsersQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx, expirationBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := getUserFromDbRow(rows)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		return users, err
+	}
+	return getUsersWithVirtualFolders(ctx, users, dbHandle)
+}
+
+func sqlCommonCheckUserExists(ctx context.Context, username string, dbHandle sqlQuerier) error {
+	var u string
+	q := checkUsernameQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRowContext(ctx, username)
+	err = row.Scan(&u)
+	if err == sql.ErrNoRows {
+		return util.NewRecordNotFoundError(fmt.Sprintf("username %#v does not exist", username))
+	}
+	return err
+}
+
+func sqlCommonGetUserMetadata(username string, dbHandle sqlQuerier) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	if err := sqlCommonCheckUserExists(ctx, username, dbHandle); err != nil {
+		return nil, err
+	}
+	q := getUserMetadataQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return metadata, err
+		}
+		metadata[key] = value
+	}
+	return metadata, rows.Err()
+}
+
+func sqlCommonClearUserMetadata(ctx context.Context, username string, dbHandle sqlQuerier) error {
+	q := getClearUserMetadataQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, username)
+	return err
+}
+
+func sqlCommonAddUserMetadata(ctx context.Context, username, key, value string, dbHandle sqlQuerier) error {
+	q := getAddUserMetadataQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, key, value, username)
+	return err
+}
+
+func sqlCommonSetUserMetadata(username string, metadata map[string]string, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	return sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		if err := sqlCommonCheckUserExists(ctx, username, tx); err != nil {
+			return err
+		}
+		if err := sqlCommonClearUserMetadata(ctx, username, tx); err != nil {
+			return err
+		}
+		for key, value := range metadata {
+			if err := sqlCommonAddUserMetadata(ctx, username, key, value, tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sqlCommonGetUsersByMetadata(key, value string, limit, offset int, order string, dbHandle sqlQuerier) ([]User, error) {
+	users := make([]User, 0, limit)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUsersByMetadataQuery(order, value != "")
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var rows *sql.Rows
+	if value != "" {
+		rows, err = stmt.QueryContext(ctx, key, value, limit, offset)
+	} else {
+		rows, err = stmt.QueryContext(ctx, key, limit, offset)
+	}
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := getUserFromDbRow(rows)
+		if err != nil {
+			return users, err
+		}
+		u.PrepareForRendering()
+		users = append(users, u)
+	}
+	err = rows.Err()
+	if err != nil {
+		return users, err
+	}
+	return getUsersWithVirtualFolders(ctx, users, dbHandle)
+}
+
 func getAdminFromDbRow(row sqlScanner) (Admin, error) {
 	var admin Admin
 	var email, filters, additionalInfo, permissions, description sql.NullString
@@ -537,11 +929,12 @@ func getUserFromDbRow(row sqlScanner) (User, error) {
 	var filters sql.NullString
 	var fsConfig sql.NullString
 	var additionalInfo, description sql.NullString
+	var protocolFilesystems sql.NullString
 
 	err := row.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 		&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
 		&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
-		&additionalInfo, &description)
+		&additionalInfo, &description, &user.Version, &protocolFilesystems)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return user, util.NewRecordNotFoundError(err.Error())
@@ -590,6 +983,13 @@ func getUserFromDbRow(row sqlScanner) (User, error) {
 	if description.Valid {
 		user.Description = description.String
 	}
+	if protocolFilesystems.Valid {
+		var list []ProtocolFilesystem
+		err = json.Unmarshal([]byte(protocolFilesystems.String), &list)
+		if err == nil {
+			user.ProtocolFilesystems = list
+		}
+	}
 	user.SetEmptySecretsIfNil()
 	return user, err
 }
@@ -786,10 +1186,17 @@ func sqlCommonDumpFolders(dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error)
 }
 
 func sqlCommonGetFolders(limit, offset int, order string, dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetFoldersWithQuery(getFoldersQuery(order), limit, offset, dbHandle)
+}
+
+func sqlCommonGetOrphanedFolders(limit, offset int, order string, dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetFoldersWithQuery(getOrphanedFoldersQuery(order), limit, offset, dbHandle)
+}
+
+func sqlCommonGetFoldersWithQuery(q string, limit, offset int, dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error) {
 	folders := make([]vfs.BaseVirtualFolder, 0, limit)
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
-	q := getFoldersQuery(order)
 	stmt, err := dbHandle.PrepareContext(ctx, q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
@@ -889,6 +1296,49 @@ func getUserWithVirtualFolders(ctx context.Context, user User, dbHandle sqlQueri
 	return users[0], err
 }
 
+// getUsersWithMetadata adds the metadata to the given users, the metadata are
+// not loaded for the other users queries
+func getUsersWithMetadata(ctx context.Context, users []User, dbHandle sqlQuerier) ([]User, error) {
+	if len(users) == 0 {
+		return users, nil
+	}
+	q := getDumpUsersMetadataQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usersMetadata := make(map[int64]map[string]string)
+	for rows.Next() {
+		var userID int64
+		var key, value string
+		err = rows.Scan(&userID, &key, &value)
+		if err != nil {
+			return users, err
+		}
+		if _, ok := usersMetadata[userID]; !ok {
+			usersMetadata[userID] = make(map[string]string)
+		}
+		usersMetadata[userID][key] = value
+	}
+	err = rows.Err()
+	if err != nil {
+		return users, err
+	}
+	for idx := range users {
+		ref := &users[idx]
+		ref.Metadata = usersMetadata[ref.ID]
+	}
+	return users, nil
+}
+
 func getUsersWithVirtualFolders(ctx context.Context, users []User, dbHandle sqlQuerier) ([]User, error) {
 	var err error
 	usersVirtualFolders := make(map[int64][]vfs.VirtualFolder)
@@ -1009,6 +1459,30 @@ func sqlCommonUpdateFolderQuota(name string, filesAdd int, sizeAdd int64, reset
 	return err
 }
 
+func sqlCommonReserveFolderQuota(name string, sizeAdd, maxSize int64, dbHandle *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getReserveFolderQuotaQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, sizeAdd, util.GetTimeAsMsSinceEpoch(time.Now()), name, sizeAdd, maxSize)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error reserving quota for folder %#v: %v", name, err)
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	providerLog(logger.LevelDebug, "quota reservation for folder %#v, size: %v max size: %v, reserved? %v",
+		name, sizeAdd, maxSize, affected > 0)
+	return affected > 0, nil
+}
+
 func sqlCommonGetFolderUsedQuota(mappedPath string, dbHandle *sql.DB) (int, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -1030,6 +1504,250 @@ func sqlCommonGetFolderUsedQuota(mappedPath string, dbHandle *sql.DB) (int, int6
 	return usedFiles, usedSize, err
 }
 
+func sqlCommonGetDefenderHosts(from int64, limit int, dbHandle sqlQuerier) ([]DefenderHost, error) {
+	hosts := make([]DefenderHost, 0, 30)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDefenderHostsQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, from, from, util.GetTimeAsMsSinceEpoch(time.Now()), limit)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get defender hosts: %v", err)
+		return hosts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		host, err := getDefenderHostFromDbRow(rows)
+		if err != nil {
+			return hosts, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+func sqlCommonGetDefenderHostByIP(ip string, from int64, dbHandle sqlQuerier) (DefenderHost, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDefenderHostQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return DefenderHost{}, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRowContext(ctx, from, ip)
+	host, err := getDefenderHostFromDbRow(row)
+	if err == sql.ErrNoRows {
+		return host, util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	return host, err
+}
+
+func sqlCommonIsDefenderHostBanned(ip string, dbHandle sqlQuerier) (DefenderHost, error) {
+	var host DefenderHost
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDefenderBannedHostQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return host, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRowContext(ctx, ip, util.GetTimeAsMsSinceEpoch(time.Now()))
+	err = row.Scan(&host.ID, &host.IP, &host.BanTime, &host.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return host, util.NewRecordNotFoundError(fmt.Sprintf("host %#v is not banned", ip))
+	}
+	return host, err
+}
+
+func sqlCommonUpdateDefenderBanTime(ip string, minutes int, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateDefenderBanTimeQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, int64(minutes)*time.Minute.Milliseconds(), ip)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating ban time for defender host %#v: %v", ip, err)
+	}
+	return err
+}
+
+func sqlCommonSetDefenderBanTime(ip string, banTime int64, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getSetDefenderBanTimeQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, banTime, util.GetTimeAsMsSinceEpoch(time.Now()), ip)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error setting ban time for defender host %#v: %v", ip, err)
+	}
+	return err
+}
+
+func sqlCommonDeleteDefenderHost(ip string, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDeleteDefenderHostQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, ip)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error deleting defender host %#v: %v", ip, err)
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return util.NewRecordNotFoundError(fmt.Sprintf("host %#v not found", ip))
+	}
+	return nil
+}
+
+func sqlCommonAddDefenderHostOrUpdate(ctx context.Context, ip string, updatedAt int64, dbHandle sqlQuerier) (int64, error) {
+	var hostID int64
+	q := getDefenderHostIDQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return hostID, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRowContext(ctx, ip).Scan(&hostID)
+	if err == nil {
+		q = getUpdateDefenderHostQuery()
+		updateStmt, err := dbHandle.PrepareContext(ctx, q)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+			return hostID, err
+		}
+		defer updateStmt.Close()
+		_, err = updateStmt.ExecContext(ctx, updatedAt, hostID)
+		return hostID, err
+	}
+	if err != sql.ErrNoRows {
+		return hostID, err
+	}
+	q = getAddDefenderHostQuery()
+	insertStmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return hostID, err
+	}
+	defer insertStmt.Close()
+	_, err = insertStmt.ExecContext(ctx, ip, updatedAt)
+	if err != nil {
+		return hostID, err
+	}
+	// LastInsertId is not supported by PostgreSQL so we read the id back
+	err = stmt.QueryRowContext(ctx, ip).Scan(&hostID)
+	return hostID, err
+}
+
+func sqlCommonAddDefenderEvent(ip string, event DefenderEvent, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+
+	err := sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		hostID, err := sqlCommonAddDefenderHostOrUpdate(ctx, ip, event.DateTime, tx)
+		if err != nil {
+			return err
+		}
+		q := getAddDefenderEventQuery()
+		stmt, err := tx.PrepareContext(ctx, q)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+			return err
+		}
+		defer stmt.Close()
+		_, err = stmt.ExecContext(ctx, event.DateTime, event.Name, event.Score, hostID)
+		return err
+	})
+	if err != nil {
+		providerLog(logger.LevelWarn, "error adding defender event for host %#v: %v", ip, err)
+	}
+	return err
+}
+
+func sqlCommonGetDefenderEvents(ip string, from int64, dbHandle sqlQuerier) ([]DefenderEvent, error) {
+	var events []DefenderEvent
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDefenderEventsQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, ip, from)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get defender events for host %#v: %v", ip, err)
+		return events, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event DefenderEvent
+		if err := rows.Scan(&event.DateTime, &event.Name, &event.Score); err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func sqlCommonCleanupDefender(from int64, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+
+	now := util.GetTimeAsMsSinceEpoch(time.Now())
+	err := sqlCommonExecuteTx(ctx, dbHandle, func(tx *sql.Tx) error {
+		q := getCleanupDefenderEventsQuery()
+		_, err := tx.ExecContext(ctx, q, from, now)
+		if err != nil {
+			return err
+		}
+		q = getCleanupDefenderHostsQuery()
+		_, err = tx.ExecContext(ctx, q, from, now)
+		return err
+	})
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to cleanup defender hosts: %v", err)
+	}
+	return err
+}
+
+func getDefenderHostFromDbRow(row sqlScanner) (DefenderHost, error) {
+	var host DefenderHost
+	err := row.Scan(&host.ID, &host.IP, &host.BanTime, &host.UpdatedAt, &host.Score)
+	return host, err
+}
+
 func sqlCommonGetDatabaseVersion(dbHandle *sql.DB, showInitWarn bool) (schemaVersion, error) {
 	var result schemaVersion
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
@@ -43,6 +43,30 @@ CREATE INDEX "{{prefix}}folders_mapping_folder_id_idx" ON "{{folders_mapping}}"
 CREATE INDEX "{{prefix}}folders_mapping_user_id_idx" ON "{{folders_mapping}}" ("user_id");
 INSERT INTO {{schema_version}} (version) VALUES (10);
 `
+	sqliteV11SQL = `CREATE TABLE "{{users_metadata}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"meta_key" varchar(255) NOT NULL, "meta_value" varchar(512) NOT NULL, "user_id" integer NOT NULL REFERENCES "{{users}}" ("id")
+ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED, CONSTRAINT "{{prefix}}unique_user_metadata" UNIQUE ("user_id", "meta_key"));
+CREATE INDEX "{{prefix}}users_metadata_key_value_idx" ON "{{users_metadata}}" ("meta_key", "meta_value");
+`
+	sqliteV11DownSQL = `DROP TABLE "{{users_metadata}}";`
+	sqliteV12SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "password_history" text NULL;`
+	sqliteV12DownSQL = `ALTER TABLE "{{users}}" DROP COLUMN "password_history";`
+	sqliteV13SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "version" bigint DEFAULT 1 NOT NULL;`
+	sqliteV13DownSQL = `ALTER TABLE "{{users}}" DROP COLUMN "version";`
+	sqliteV14SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "protocol_filesystems" text NULL;`
+	sqliteV14DownSQL = `ALTER TABLE "{{users}}" DROP COLUMN "protocol_filesystems";`
+	sqliteV15SQL     = `CREATE TABLE "{{defender_hosts}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"ip" varchar(50) NOT NULL UNIQUE, "ban_time" bigint NOT NULL, "updated_at" bigint NOT NULL);
+CREATE TABLE "{{defender_events}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "date_time" bigint NOT NULL,
+"name" varchar(50) NOT NULL, "score" integer NOT NULL, "host_id" integer NOT NULL REFERENCES "{{defender_hosts}}" ("id")
+ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED);
+CREATE INDEX "{{prefix}}defender_hosts_updated_at_idx" ON "{{defender_hosts}}" ("updated_at");
+CREATE INDEX "{{prefix}}defender_hosts_ban_time_idx" ON "{{defender_hosts}}" ("ban_time");
+CREATE INDEX "{{prefix}}defender_events_date_time_idx" ON "{{defender_events}}" ("date_time");
+CREATE INDEX "{{prefix}}defender_events_host_id_idx" ON "{{defender_events}}" ("host_id");
+`
+	sqliteV15DownSQL = `DROP TABLE "{{defender_events}}";
+DROP TABLE "{{defender_hosts}}";`
 )
 
 // SQLiteProvider auth provider for SQLite database
@@ -102,6 +126,10 @@ func (p *SQLiteProvider) updateQuota(username string, filesAdd int, sizeAdd int6
 	return sqlCommonUpdateQuota(username, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p *SQLiteProvider) reserveQuota(username string, sizeAdd, maxSize int64) (bool, error) {
+	return sqlCommonReserveQuota(username, sizeAdd, maxSize, p.dbHandle)
+}
+
 func (p *SQLiteProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
@@ -126,6 +154,10 @@ func (p *SQLiteProvider) deleteUser(user *User) error {
 	return sqlCommonDeleteUser(user, p.dbHandle)
 }
 
+func (p *SQLiteProvider) renameUser(oldUsername string, user *User) error {
+	return sqlCommonRenameUser(oldUsername, user, p.dbHandle)
+}
+
 func (p *SQLiteProvider) dumpUsers() ([]User, error) {
 	return sqlCommonDumpUsers(p.dbHandle)
 }
@@ -134,6 +166,46 @@ func (p *SQLiteProvider) getUsers(limit int, offset int, order string) ([]User,
 	return sqlCommonGetUsers(limit, offset, order, p.dbHandle)
 }
 
+func (p *SQLiteProvider) getUserMetadata(username string) (map[string]string, error) {
+	return sqlCommonGetUserMetadata(username, p.dbHandle)
+}
+
+func (p *SQLiteProvider) setUserMetadata(username string, metadata map[string]string) error {
+	return sqlCommonSetUserMetadata(username, metadata, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getUsersByUsernames(usernames []string) ([]User, error) {
+	return sqlCommonGetUsersByUsernames(usernames, p.dbHandle)
+}
+
+func (p *SQLiteProvider) countUsers(filter CountFilter) (int64, error) {
+	return sqlCommonCountUsers(filter, p.dbHandle)
+}
+
+func (p *SQLiteProvider) countAdmins(filter CountFilter) (int64, error) {
+	return sqlCommonCountAdmins(filter, p.dbHandle)
+}
+
+func (p *SQLiteProvider) countFolders(filter CountFilter) (int64, error) {
+	return sqlCommonCountFolders(filter, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getExpiringUsers(expirationBefore int64) ([]User, error) {
+	return sqlCommonGetExpiringUsers(expirationBefore, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getUserPasswordHistory(username string) ([]string, error) {
+	return sqlCommonGetUserPasswordHistory(username, p.dbHandle)
+}
+
+func (p *SQLiteProvider) updateUserPassword(username, password string, history []string) error {
+	return sqlCommonUpdateUserPassword(username, password, history, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getUsersByMetadata(key, value string, limit, offset int, order string) ([]User, error) {
+	return sqlCommonGetUsersByMetadata(key, value, limit, offset, order, p.dbHandle)
+}
+
 func (p *SQLiteProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return sqlCommonDumpFolders(p.dbHandle)
 }
@@ -142,6 +214,10 @@ func (p *SQLiteProvider) getFolders(limit, offset int, order string) ([]vfs.Base
 	return sqlCommonGetFolders(limit, offset, order, p.dbHandle)
 }
 
+func (p *SQLiteProvider) getOrphanedFolders(limit, offset int, order string) ([]vfs.BaseVirtualFolder, error) {
+	return sqlCommonGetOrphanedFolders(limit, offset, order, p.dbHandle)
+}
+
 func (p *SQLiteProvider) getFolderByName(name string) (vfs.BaseVirtualFolder, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -164,6 +240,46 @@ func (p *SQLiteProvider) updateFolderQuota(name string, filesAdd int, sizeAdd in
 	return sqlCommonUpdateFolderQuota(name, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p *SQLiteProvider) reserveFolderQuota(name string, sizeAdd, maxSize int64) (bool, error) {
+	return sqlCommonReserveFolderQuota(name, sizeAdd, maxSize, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getDefenderHosts(from int64, limit int) ([]DefenderHost, error) {
+	return sqlCommonGetDefenderHosts(from, limit, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getDefenderHostByIP(ip string, from int64) (DefenderHost, error) {
+	return sqlCommonGetDefenderHostByIP(ip, from, p.dbHandle)
+}
+
+func (p *SQLiteProvider) isDefenderHostBanned(ip string) (DefenderHost, error) {
+	return sqlCommonIsDefenderHostBanned(ip, p.dbHandle)
+}
+
+func (p *SQLiteProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return sqlCommonUpdateDefenderBanTime(ip, minutes, p.dbHandle)
+}
+
+func (p *SQLiteProvider) deleteDefenderHost(ip string) error {
+	return sqlCommonDeleteDefenderHost(ip, p.dbHandle)
+}
+
+func (p *SQLiteProvider) addDefenderEvent(ip string, event DefenderEvent) error {
+	return sqlCommonAddDefenderEvent(ip, event, p.dbHandle)
+}
+
+func (p *SQLiteProvider) getDefenderEvents(ip string, from int64) ([]DefenderEvent, error) {
+	return sqlCommonGetDefenderEvents(ip, from, p.dbHandle)
+}
+
+func (p *SQLiteProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return sqlCommonSetDefenderBanTime(ip, banTime, p.dbHandle)
+}
+
+func (p *SQLiteProvider) cleanupDefender(from int64) error {
+	return sqlCommonCleanupDefender(from, p.dbHandle)
+}
+
 func (p *SQLiteProvider) getUsedFolderQuota(name string) (int, int64, error) {
 	return sqlCommonGetFolderUsedQuota(name, p.dbHandle)
 }
@@ -235,6 +351,16 @@ func (p *SQLiteProvider) migrateDatabase() error {
 		providerLog(logger.LevelError, "%v", err)
 		logger.ErrorToConsole("%v", err)
 		return err
+	case version == 10:
+		return updateSQLiteDatabaseFromV10(p.dbHandle)
+	case version == 11:
+		return updateSQLiteDatabaseFromV11(p.dbHandle)
+	case version == 12:
+		return updateSQLiteDatabaseFromV12(p.dbHandle)
+	case version == 13:
+		return updateSQLiteDatabaseFromV13(p.dbHandle)
+	case version == 14:
+		return updateSQLiteDatabaseFromV14(p.dbHandle)
 	default:
 		if version > sqlDatabaseVersion {
 			providerLog(logger.LevelWarn, "database version %v is newer than the supported one: %v", version,
@@ -256,7 +382,20 @@ func (p *SQLiteProvider) revertDatabase(targetVersion int) error {
 		return errors.New("current version match target version, nothing to do")
 	}
 
-	return errors.New("the current version cannot be reverted")
+	switch dbVersion.Version {
+	case 11:
+		return downgradeSQLiteDatabaseFromV11(p.dbHandle)
+	case 12:
+		return downgradeSQLiteDatabaseFromV12(p.dbHandle)
+	case 13:
+		return downgradeSQLiteDatabaseFromV13(p.dbHandle)
+	case 14:
+		return downgradeSQLiteDatabaseFromV14(p.dbHandle)
+	case 15:
+		return downgradeSQLiteDatabaseFromV15(p.dbHandle)
+	default:
+		return fmt.Errorf("database version not handled: %v", dbVersion.Version)
+	}
 }
 
 /*func setPragmaFK(dbHandle *sql.DB, value string) error {
@@ -268,3 +407,142 @@ func (p *SQLiteProvider) revertDatabase(targetVersion int) error {
 	_, err := dbHandle.ExecContext(ctx, sql)
 	return err
 }*/
+
+func updateSQLiteDatabaseFromV10(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom10To11(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV11(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV11(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom11To12(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV12(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV12(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom12To13(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV13(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV13(dbHandle *sql.DB) error {
+	if err := updateSQLiteDatabaseFrom13To14(dbHandle); err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV14(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV14(dbHandle *sql.DB) error {
+	return updateSQLiteDatabaseFrom14To15(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV11(dbHandle *sql.DB) error {
+	return downgradeSQLiteDatabaseFrom11To10(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV12(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom12To11(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV11(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV13(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom13To12(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV12(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV14(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom14To13(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV13(dbHandle)
+}
+
+func downgradeSQLiteDatabaseFromV15(dbHandle *sql.DB) error {
+	if err := downgradeSQLiteDatabaseFrom15To14(dbHandle); err != nil {
+		return err
+	}
+	return downgradeSQLiteDatabaseFromV14(dbHandle)
+}
+
+func updateSQLiteDatabaseFrom10To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 10 -> 11")
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	sql := strings.ReplaceAll(sqliteV11SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{users_metadata}}", sqlTableUsersMetadata)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 11)
+}
+
+func downgradeSQLiteDatabaseFrom11To10(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 11 -> 10")
+	providerLog(logger.LevelInfo, "downgrading database version: 11 -> 10")
+	sql := strings.ReplaceAll(sqliteV11DownSQL, "{{users_metadata}}", sqlTableUsersMetadata)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 10)
+}
+
+func updateSQLiteDatabaseFrom11To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 11 -> 12")
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	sql := strings.ReplaceAll(sqliteV12SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 12)
+}
+
+func downgradeSQLiteDatabaseFrom12To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 12 -> 11")
+	providerLog(logger.LevelInfo, "downgrading database version: 12 -> 11")
+	sql := strings.ReplaceAll(sqliteV12DownSQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 11)
+}
+
+func updateSQLiteDatabaseFrom12To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 12 -> 13")
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	sql := strings.ReplaceAll(sqliteV13SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 13)
+}
+
+func downgradeSQLiteDatabaseFrom13To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 13 -> 12")
+	providerLog(logger.LevelInfo, "downgrading database version: 13 -> 12")
+	sql := strings.ReplaceAll(sqliteV13DownSQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 12)
+}
+
+func updateSQLiteDatabaseFrom13To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 13 -> 14")
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	sql := strings.ReplaceAll(sqliteV14SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 14)
+}
+
+func downgradeSQLiteDatabaseFrom14To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 14 -> 13")
+	providerLog(logger.LevelInfo, "downgrading database version: 14 -> 13")
+	sql := strings.ReplaceAll(sqliteV14DownSQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 13)
+}
+
+func updateSQLiteDatabaseFrom14To15(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 14 -> 15")
+	providerLog(logger.LevelInfo, "updating database version: 14 -> 15")
+	sql := strings.ReplaceAll(sqliteV15SQL, "{{defender_hosts}}", sqlTableDefenderHosts)
+	sql = strings.ReplaceAll(sql, "{{defender_events}}", sqlTableDefenderEvents)
+	sql = strings.ReplaceAll(sql, "{{prefix}}", config.SQLTablesPrefix)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 15)
+}
+
+func downgradeSQLiteDatabaseFrom15To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("downgrading database version: 15 -> 14")
+	providerLog(logger.LevelInfo, "downgrading database version: 15 -> 14")
+	sql := strings.ReplaceAll(sqliteV15DownSQL, "{{defender_events}}", sqlTableDefenderEvents)
+	sql = strings.ReplaceAll(sql, "{{defender_hosts}}", sqlTableDefenderHosts)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, []string{sql}, 14)
+}
@@ -11,14 +11,14 @@ import (
 const (
 	selectUserFields = "id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,used_quota_size," +
 		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem," +
-		"additional_info,description"
+		"additional_info,description,version,protocol_filesystems"
 	selectFolderFields = "id,path,used_quota_size,used_quota_files,last_quota_update,name,description,filesystem"
 	selectAdminFields  = "id,username,password,status,email,permissions,filters,additional_info,description"
 )
 
 func getSQLPlaceholders() []string {
 	var placeholders []string
-	for i := 1; i <= 20; i++ {
+	for i := 1; i <= 21; i++ {
 		if config.Driver == PGSQLDataProviderName || config.Driver == CockroachDataProviderName {
 			placeholders = append(placeholders, fmt.Sprintf("$%v", i))
 		} else {
@@ -37,6 +37,17 @@ func getAdminsQuery(order string) string {
 		order, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
+func getCountAdminsQuery(filter CountFilter) string {
+	switch filter {
+	case CountActive:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v WHERE status = 1`, sqlTableAdmins)
+	case CountDisabled:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v WHERE status = 0`, sqlTableAdmins)
+	default:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v`, sqlTableAdmins)
+	}
+}
+
 func getDumpAdminsQuery() string {
 	return fmt.Sprintf(`SELECT %v FROM %v`, selectAdminFields, sqlTableAdmins)
 }
@@ -61,11 +72,49 @@ func getUserByUsernameQuery() string {
 	return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v`, selectUserFields, sqlTableUsers, sqlPlaceholders[0])
 }
 
+func getUsersByUsernamesQuery(numArgs int) string {
+	var sb strings.Builder
+	for idx := 0; idx < numArgs; idx++ {
+		if sb.Len() == 0 {
+			sb.WriteString("(")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(sqlPlaceholders[idx])
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(")")
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE username IN %v ORDER BY username`, selectUserFields, sqlTableUsers, sb.String())
+}
+
 func getUsersQuery(order string) string {
 	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY username %v LIMIT %v OFFSET %v`, selectUserFields, sqlTableUsers,
 		order, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
+// getCountUsersQuery returns the count query for the specified filter. The
+// CountActive and CountExpired queries require the current time as argument
+func getCountUsersQuery(filter CountFilter) string {
+	switch filter {
+	case CountActive:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v WHERE status = 1 AND (expiration_date = 0 OR expiration_date >= %v)`,
+			sqlTableUsers, sqlPlaceholders[0])
+	case CountDisabled:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v WHERE status = 0`, sqlTableUsers)
+	case CountExpired:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v WHERE expiration_date > 0 AND expiration_date < %v`,
+			sqlTableUsers, sqlPlaceholders[0])
+	default:
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v`, sqlTableUsers)
+	}
+}
+
+func getExpiringUsersQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE status = 1 AND expiration_date > 0 AND expiration_date <= %v ORDER BY username`,
+		selectUserFields, sqlTableUsers, sqlPlaceholders[0])
+}
+
 func getDumpUsersQuery() string {
 	return fmt.Sprintf(`SELECT %v FROM %v`, selectUserFields, sqlTableUsers)
 }
@@ -83,10 +132,25 @@ func getUpdateQuotaQuery(reset bool) string {
 		WHERE username = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
 }
 
+func getReserveQuotaQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET used_quota_size = used_quota_size + %v,last_quota_update = %v
+		WHERE username = %v AND used_quota_size + %v <= %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
 func getUpdateLastLoginQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET last_login = %v WHERE username = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
+func getUserPasswordHistoryQuery() string {
+	return fmt.Sprintf(`SELECT password_history FROM %v WHERE username = %v`, sqlTableUsers, sqlPlaceholders[0])
+}
+
+func getUpdateUserPasswordQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET password = %v,password_history = %v,version = version + 1 WHERE username = %v`, sqlTableUsers,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
 func getQuotaQuery() string {
 	return fmt.Sprintf(`SELECT used_quota_size,used_quota_files FROM %v WHERE username = %v`, sqlTableUsers,
 		sqlPlaceholders[0])
@@ -95,26 +159,66 @@ func getQuotaQuery() string {
 func getAddUserQuery() string {
 	return fmt.Sprintf(`INSERT INTO %v (username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,
 		used_quota_size,used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,status,last_login,expiration_date,filters,
-		filesystem,additional_info,description)
-		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v,%v)`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1],
+		filesystem,additional_info,description,protocol_filesystems)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v,%v,%v)`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1],
 		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
 		sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13],
-		sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17])
+		sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18])
 }
 
 func getUpdateUserQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET password=%v,public_keys=%v,home_dir=%v,uid=%v,gid=%v,max_sessions=%v,quota_size=%v,
 		quota_files=%v,permissions=%v,upload_bandwidth=%v,download_bandwidth=%v,status=%v,expiration_date=%v,filters=%v,filesystem=%v,
-		additional_info=%v,description=%v WHERE id = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
-		sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
-		sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15],
-		sqlPlaceholders[16], sqlPlaceholders[17])
+		additional_info=%v,description=%v,protocol_filesystems=%v,version=version+1 WHERE id = %v AND (%v = 0 OR version = %v)`,
+		sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10],
+		sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16],
+		sqlPlaceholders[17], sqlPlaceholders[18], sqlPlaceholders[19], sqlPlaceholders[20])
 }
 
 func getDeleteUserQuery() string {
 	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, sqlTableUsers, sqlPlaceholders[0])
 }
 
+func getRenameUserQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET username = %v,filesystem = %v,protocol_filesystems = %v WHERE username = %v`, sqlTableUsers,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+}
+
+func checkUsernameQuery() string {
+	return fmt.Sprintf(`SELECT username FROM %v WHERE username = %v`, sqlTableUsers, sqlPlaceholders[0])
+}
+
+func getUserMetadataQuery() string {
+	return fmt.Sprintf(`SELECT m.meta_key,m.meta_value FROM %v m INNER JOIN %v u ON m.user_id = u.id WHERE u.username = %v`,
+		sqlTableUsersMetadata, sqlTableUsers, sqlPlaceholders[0])
+}
+
+func getDumpUsersMetadataQuery() string {
+	return fmt.Sprintf(`SELECT user_id,meta_key,meta_value FROM %v`, sqlTableUsersMetadata)
+}
+
+func getClearUserMetadataQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = (SELECT id FROM %v WHERE username = %v)`, sqlTableUsersMetadata,
+		sqlTableUsers, sqlPlaceholders[0])
+}
+
+func getAddUserMetadataQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (meta_key,meta_value,user_id) VALUES (%v,%v,(SELECT id FROM %v WHERE username = %v))`,
+		sqlTableUsersMetadata, sqlPlaceholders[0], sqlPlaceholders[1], sqlTableUsers, sqlPlaceholders[2])
+}
+
+func getUsersByMetadataQuery(order string, matchValue bool) string {
+	if matchValue {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE id IN (SELECT user_id FROM %v WHERE meta_key = %v AND meta_value = %v)
+			ORDER BY username %v LIMIT %v OFFSET %v`, selectUserFields, sqlTableUsers, sqlTableUsersMetadata, sqlPlaceholders[0],
+			sqlPlaceholders[1], order, sqlPlaceholders[2], sqlPlaceholders[3])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id IN (SELECT user_id FROM %v WHERE meta_key = %v)
+		ORDER BY username %v LIMIT %v OFFSET %v`, selectUserFields, sqlTableUsers, sqlTableUsersMetadata, sqlPlaceholders[0],
+		order, sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
 func getFolderByNameQuery() string {
 	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectFolderFields, sqlTableFolders, sqlPlaceholders[0])
 }
@@ -154,6 +258,30 @@ func getFoldersQuery(order string) string {
 		order, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
+func getOrphanedFoldersQuery(order string) string {
+	fields := strings.Split(selectFolderFields, ",")
+	for idx := range fields {
+		fields[idx] = "f." + fields[idx]
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v f LEFT JOIN %v fm ON f.id = fm.folder_id WHERE fm.folder_id IS NULL
+		ORDER BY f.name %v LIMIT %v OFFSET %v`, strings.Join(fields, ","), sqlTableFolders, sqlTableFoldersMapping,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getCountFoldersQuery(filter CountFilter) string {
+	if filter == CountOrphaned {
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %v f LEFT JOIN %v fm ON f.id = fm.folder_id WHERE fm.folder_id IS NULL`,
+			sqlTableFolders, sqlTableFoldersMapping)
+	}
+	return fmt.Sprintf(`SELECT COUNT(*) FROM %v`, sqlTableFolders)
+}
+
+func getReserveFolderQuotaQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET used_quota_size = used_quota_size + %v,last_quota_update = %v
+		WHERE name = %v AND used_quota_size + %v <= %v`, sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
 func getUpdateFolderQuotaQuery(reset bool) string {
 	if reset {
 		return fmt.Sprintf(`UPDATE %v SET used_quota_size = %v,used_quota_files = %v,last_quota_update = %v
@@ -203,6 +331,73 @@ func getRelatedUsersForFoldersQuery(folders []vfs.BaseVirtualFolder) string {
 		WHERE fm.folder_id IN %v ORDER BY fm.folder_id`, sqlTableFoldersMapping, sqlTableUsers, sb.String())
 }
 
+func getDefenderHostsQuery() string {
+	return fmt.Sprintf(`SELECT h.id,h.ip,h.ban_time,h.updated_at,COALESCE(SUM(e.score),0) FROM %v h LEFT JOIN %v e
+		ON h.id = e.host_id AND e.date_time >= %v WHERE h.updated_at >= %v OR h.ban_time > %v
+		GROUP BY h.id,h.ip,h.ban_time,h.updated_at ORDER BY h.updated_at DESC LIMIT %v`, sqlTableDefenderHosts,
+		sqlTableDefenderEvents, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+}
+
+func getDefenderHostQuery() string {
+	return fmt.Sprintf(`SELECT h.id,h.ip,h.ban_time,h.updated_at,COALESCE(SUM(e.score),0) FROM %v h LEFT JOIN %v e
+		ON h.id = e.host_id AND e.date_time >= %v WHERE h.ip = %v GROUP BY h.id,h.ip,h.ban_time,h.updated_at`,
+		sqlTableDefenderHosts, sqlTableDefenderEvents, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDefenderBannedHostQuery() string {
+	return fmt.Sprintf(`SELECT id,ip,ban_time,updated_at FROM %v WHERE ip = %v AND ban_time > %v`,
+		sqlTableDefenderHosts, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDefenderHostIDQuery() string {
+	return fmt.Sprintf(`SELECT id FROM %v WHERE ip = %v`, sqlTableDefenderHosts, sqlPlaceholders[0])
+}
+
+func getUpdateDefenderBanTimeQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET ban_time = ban_time + %v WHERE ip = %v`, sqlTableDefenderHosts,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getSetDefenderBanTimeQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET ban_time = %v,updated_at = %v WHERE ip = %v`, sqlTableDefenderHosts,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteDefenderHostQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE ip = %v`, sqlTableDefenderHosts, sqlPlaceholders[0])
+}
+
+func getAddDefenderHostQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (ip,ban_time,updated_at) VALUES (%v,0,%v)`, sqlTableDefenderHosts,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getUpdateDefenderHostQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET updated_at = %v WHERE id = %v`, sqlTableDefenderHosts,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddDefenderEventQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (date_time,name,score,host_id) VALUES (%v,%v,%v,%v)`, sqlTableDefenderEvents,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+}
+
+func getDefenderEventsQuery() string {
+	return fmt.Sprintf(`SELECT e.date_time,e.name,e.score FROM %v e INNER JOIN %v h ON e.host_id = h.id
+		WHERE h.ip = %v AND e.date_time >= %v ORDER BY e.date_time ASC`, sqlTableDefenderEvents, sqlTableDefenderHosts,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getCleanupDefenderEventsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE date_time < %v AND host_id IN (SELECT id FROM %v WHERE ban_time < %v)`,
+		sqlTableDefenderEvents, sqlPlaceholders[0], sqlTableDefenderHosts, sqlPlaceholders[1])
+}
+
+func getCleanupDefenderHostsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE updated_at < %v AND ban_time < %v`, sqlTableDefenderHosts,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
 func getDatabaseVersionQuery() string {
 	return fmt.Sprintf("SELECT version from %v LIMIT 1", sqlTableSchemaVersion)
 }
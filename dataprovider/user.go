@@ -2,7 +2,9 @@ package dataprovider
 
 import (
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -67,6 +69,27 @@ var (
 	errNoMatchingVirtualFolder = errors.New("no matching virtual folder found")
 )
 
+// ProtocolFilesystem defines the home directory and the filesystem to use, instead
+// of the default ones, for the connections using the specified login protocol
+type ProtocolFilesystem struct {
+	// Login protocol, for example SSH, FTP, DAV, HTTP
+	Protocol string `json:"protocol"`
+	// Root directory for the protocol. For local and encrypted filesystems
+	// this is where the files are stored
+	HomeDir string `json:"home_dir"`
+	// Filesystem configuration details
+	FsConfig vfs.Filesystem `json:"filesystem"`
+}
+
+// GetACopy returns a copy
+func (p *ProtocolFilesystem) GetACopy() ProtocolFilesystem {
+	return ProtocolFilesystem{
+		Protocol: p.Protocol,
+		HomeDir:  p.HomeDir,
+		FsConfig: p.FsConfig.GetACopy(),
+	}
+}
+
 // User defines a SFTPGo user
 type User struct {
 	sdk.BaseUser
@@ -74,8 +97,51 @@ type User struct {
 	VirtualFolders []vfs.VirtualFolder `json:"virtual_folders,omitempty"`
 	// Filesystem configuration details
 	FsConfig vfs.Filesystem `json:"filesystem"`
+	// Home directories and filesystems to use for specific login protocols.
+	// The default ones are used for the protocols not listed here
+	ProtocolFilesystems []ProtocolFilesystem `json:"protocol_filesystems,omitempty"`
+	// Arbitrary key/value metadata, for example identifiers used by external integrations.
+	// Metadata are stored separately and are not loaded while authenticating users
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// hashes of the previous passwords, most recent first. They are updated by the
+	// self-service password change and are never exposed
+	PasswordHistory []string `json:"password_history,omitempty"`
+	// incremented on each update. If greater than zero an update is rejected if
+	// this value does not match the stored one, so concurrent modifications are
+	// not lost. Zero means that the stored user is overwritten
+	Version int64 `json:"version"`
 	// we store the filesystem here using the base path as key.
 	fsCache map[string]vfs.Fs `json:"-"`
+	// protocol used to login, it selects the protocol specific filesystem, if any
+	loginProtocol string
+}
+
+// SetLoginProtocol sets the protocol used to login, for example SSH, FTP, DAV, HTTP.
+// The matching protocol specific home directory and filesystem, if any, are used
+// instead of the default ones. It must be called before creating the filesystems
+func (u *User) SetLoginProtocol(protocol string) {
+	if util.IsStringInSlice(protocol, ValidProtocols) {
+		u.loginProtocol = protocol
+	}
+}
+
+func (u *User) getProtocolFilesystem() *ProtocolFilesystem {
+	if u.loginProtocol == "" {
+		return nil
+	}
+	for idx := range u.ProtocolFilesystems {
+		if u.ProtocolFilesystems[idx].Protocol == u.loginProtocol {
+			return &u.ProtocolFilesystems[idx]
+		}
+	}
+	return nil
+}
+
+func (u *User) getRootFsConfig() *vfs.Filesystem {
+	if p := u.getProtocolFilesystem(); p != nil {
+		return &p.FsConfig
+	}
+	return &u.FsConfig
 }
 
 // GetFilesystem returns the base filesystem for this user
@@ -84,30 +150,51 @@ func (u *User) GetFilesystem(connectionID string) (fs vfs.Fs, err error) {
 	if err != nil {
 		return fs, err
 	}
+	u.setSymlinksPolicy(fs)
+	u.setPathCaseFolding(fs)
 	u.fsCache = make(map[string]vfs.Fs)
 	u.fsCache["/"] = fs
 	return fs, err
 }
 
+func (u *User) setSymlinksPolicy(fs vfs.Fs) {
+	if u.Filters.SymlinksPolicy == "" {
+		return
+	}
+	if policer, ok := fs.(vfs.FsSymlinksPolicer); ok {
+		policer.SetSymlinksPolicy(u.Filters.SymlinksPolicy)
+	}
+}
+
+func (u *User) setPathCaseFolding(fs vfs.Fs) {
+	if !u.Filters.PathCaseFolding {
+		return
+	}
+	if caseFolder, ok := fs.(vfs.FsPathCaseFolder); ok {
+		caseFolder.SetPathCaseFolding(true)
+	}
+}
+
 func (u *User) getRootFs(connectionID string) (fs vfs.Fs, err error) {
-	switch u.FsConfig.Provider {
+	fsConfig := u.getRootFsConfig()
+	switch fsConfig.Provider {
 	case sdk.S3FilesystemProvider:
-		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), "", u.FsConfig.S3Config)
+		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), "", fsConfig.S3Config)
 	case sdk.GCSFilesystemProvider:
-		config := u.FsConfig.GCSConfig
+		config := fsConfig.GCSConfig
 		config.CredentialFile = u.GetGCSCredentialsFilePath()
 		return vfs.NewGCSFs(connectionID, u.GetHomeDir(), "", config)
 	case sdk.AzureBlobFilesystemProvider:
-		return vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), "", u.FsConfig.AzBlobConfig)
+		return vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), "", fsConfig.AzBlobConfig)
 	case sdk.CryptedFilesystemProvider:
-		return vfs.NewCryptFs(connectionID, u.GetHomeDir(), "", u.FsConfig.CryptConfig)
+		return vfs.NewCryptFs(connectionID, u.GetHomeDir(), "", fsConfig.CryptConfig)
 	case sdk.SFTPFilesystemProvider:
-		forbiddenSelfUsers, err := u.getForbiddenSFTPSelfUsers(u.FsConfig.SFTPConfig.Username)
+		forbiddenSelfUsers, err := u.getForbiddenSFTPSelfUsers(fsConfig.SFTPConfig.Username)
 		if err != nil {
 			return nil, err
 		}
 		forbiddenSelfUsers = append(forbiddenSelfUsers, u.Username)
-		return vfs.NewSFTPFs(connectionID, "", u.GetHomeDir(), forbiddenSelfUsers, u.FsConfig.SFTPConfig)
+		return vfs.NewSFTPFs(connectionID, "", u.GetHomeDir(), forbiddenSelfUsers, fsConfig.SFTPConfig)
 	default:
 		return vfs.NewOsFs(connectionID, u.GetHomeDir(), ""), nil
 	}
@@ -143,9 +230,55 @@ func (u *User) CheckFsRoot(connectionID string) error {
 				v.VirtualPath, fsPath, err)
 		}
 	}
+	if u.LastLogin == 0 {
+		u.createHomeSkeleton(connectionID)
+	}
 	return nil
 }
 
+// GetHomeSkeleton returns the directories to create on the first login
+func (u *User) GetHomeSkeleton() []string {
+	if len(u.Filters.HomeSkeleton) > 0 {
+		return u.Filters.HomeSkeleton
+	}
+	return config.HomeSkeleton
+}
+
+// createHomeSkeleton creates the missing skeleton directories.
+// Cloud based filesystems have no real directories so they are skipped
+func (u *User) createHomeSkeleton(connectionID string) {
+	for _, dir := range u.GetHomeSkeleton() {
+		fs, err := u.GetFilesystemForPath(dir, connectionID)
+		if err != nil {
+			continue
+		}
+		if !vfs.IsLocalOrCryptoFs(fs) && !vfs.IsSFTPFs(fs) {
+			continue
+		}
+		fsPath, err := fs.ResolvePath(dir)
+		if err != nil {
+			logger.Warn(logSender, connectionID, "unable to resolve home skeleton dir %#v for user %#v: %v",
+				dir, u.Username, err)
+			continue
+		}
+		if _, err = fs.Stat(fsPath); err == nil {
+			continue
+		}
+		// MkdirAll creates the missing parents for local filesystems
+		err = fs.MkdirAll(fsPath, u.GetUID(), u.GetGID())
+		if err == nil {
+			if _, err = fs.Stat(fsPath); fs.IsNotExist(err) {
+				err = fs.Mkdir(fsPath)
+				if err == nil {
+					vfs.SetPathPermissions(fs, fsPath, u.GetUID(), u.GetGID())
+				}
+			}
+		}
+		logger.Debug(logSender, connectionID, "create home skeleton dir %#v for user %#v, path %#v, err: %v",
+			dir, u.Username, fsPath, err)
+	}
+}
+
 // isFsEqual returns true if the fs has the same configuration
 func (u *User) isFsEqual(other *User) bool {
 	if u.FsConfig.Provider == sdk.LocalFilesystemProvider && u.GetHomeDir() != other.GetHomeDir() {
@@ -154,6 +287,16 @@ func (u *User) isFsEqual(other *User) bool {
 	if !u.FsConfig.IsEqual(&other.FsConfig) {
 		return false
 	}
+	if len(u.ProtocolFilesystems) != len(other.ProtocolFilesystems) {
+		return false
+	}
+	for idx := range u.ProtocolFilesystems {
+		p := &u.ProtocolFilesystems[idx]
+		p1 := &other.ProtocolFilesystems[idx]
+		if p.Protocol != p1.Protocol || p.HomeDir != p1.HomeDir || !p.FsConfig.IsEqual(&p1.FsConfig) {
+			return false
+		}
+	}
 	if len(u.VirtualFolders) != len(other.VirtualFolders) {
 		return false
 	}
@@ -182,7 +325,11 @@ func (u *User) isFsEqual(other *User) bool {
 // hideConfidentialData hides user confidential data
 func (u *User) hideConfidentialData() {
 	u.Password = ""
+	u.PasswordHistory = nil
 	u.FsConfig.HideConfidentialData()
+	for idx := range u.ProtocolFilesystems {
+		u.ProtocolFilesystems[idx].FsConfig.HideConfidentialData()
+	}
 }
 
 // GetSubDirPermissions returns permissions for sub directories
@@ -222,6 +369,9 @@ func (u *User) RenderAsJSON(reload bool) ([]byte, error) {
 func (u *User) PrepareForRendering() {
 	u.hideConfidentialData()
 	u.FsConfig.SetNilSecretsIfEmpty()
+	for idx := range u.ProtocolFilesystems {
+		u.ProtocolFilesystems[idx].FsConfig.SetNilSecretsIfEmpty()
+	}
 	for idx := range u.VirtualFolders {
 		folder := &u.VirtualFolders[idx]
 		folder.PrepareForRendering()
@@ -232,6 +382,11 @@ func (u *User) hasRedactedSecret() bool {
 	if u.FsConfig.HasRedactedSecret() {
 		return true
 	}
+	for idx := range u.ProtocolFilesystems {
+		if u.ProtocolFilesystems[idx].FsConfig.HasRedactedSecret() {
+			return true
+		}
+	}
 
 	for idx := range u.VirtualFolders {
 		folder := &u.VirtualFolders[idx]
@@ -273,6 +428,40 @@ func (u *User) IsTLSUsernameVerificationEnabled() bool {
 	return false
 }
 
+// IsTLSCertificateRequired returns true if the user can only login, using FTP
+// and WebDAV, providing a TLS client certificate
+func (u *User) IsTLSCertificateRequired() bool {
+	return u.Filters.TLSCertRequired || len(u.Filters.TLSCertFingerprints) > 0
+}
+
+// CheckTLSCertificate returns an error if a TLS client certificate is required
+// for this user and the given one is missing or it does not match the allowed
+// fingerprints, if any
+func (u *User) CheckTLSCertificate(tlsCert *x509.Certificate) error {
+	if !u.IsTLSCertificateRequired() {
+		return nil
+	}
+	if tlsCert == nil {
+		return fmt.Errorf("a TLS client certificate is required for user %#v", u.Username)
+	}
+	if len(u.Filters.TLSCertFingerprints) == 0 {
+		return nil
+	}
+	fingerprint := GetTLSCertificateFingerprint(tlsCert)
+	if !util.IsStringInSlice(fingerprint, u.Filters.TLSCertFingerprints) {
+		return fmt.Errorf("TLS client certificate with fingerprint %#v is not allowed for user %#v", fingerprint,
+			u.Username)
+	}
+	return nil
+}
+
+// GetTLSCertificateFingerprint returns the SHA256 fingerprint, as lowercase
+// hex string, for the given certificate
+func GetTLSCertificateFingerprint(tlsCert *x509.Certificate) string {
+	hash := sha256.Sum256(tlsCert.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
 // SetEmptySecrets sets to empty any user secret
 func (u *User) SetEmptySecrets() {
 	u.FsConfig.S3Config.AccessSecret = kms.NewEmptySecret()
@@ -282,6 +471,9 @@ func (u *User) SetEmptySecrets() {
 	u.FsConfig.CryptConfig.Passphrase = kms.NewEmptySecret()
 	u.FsConfig.SFTPConfig.Password = kms.NewEmptySecret()
 	u.FsConfig.SFTPConfig.PrivateKey = kms.NewEmptySecret()
+	for idx := range u.ProtocolFilesystems {
+		u.ProtocolFilesystems[idx].FsConfig.SetEmptySecretsIfNil()
+	}
 	for idx := range u.VirtualFolders {
 		folder := &u.VirtualFolders[idx]
 		folder.FsConfig.SetEmptySecretsIfNil()
@@ -348,7 +540,7 @@ func (u *User) GetFsConfigForPath(virtualPath string) vfs.Filesystem {
 		}
 	}
 
-	return u.FsConfig
+	return *u.getRootFsConfig()
 }
 
 // GetFilesystemForPath returns the filesystem for the given path
@@ -372,6 +564,8 @@ func (u *User) GetFilesystemForPath(virtualPath, connectionID string) (vfs.Fs, e
 			}
 			fs, err := folder.GetFilesystem(connectionID, forbiddenSelfUsers)
 			if err == nil {
+				u.setSymlinksPolicy(fs)
+				u.setPathCaseFolding(fs)
 				u.fsCache[folder.VirtualPath] = fs
 			}
 			return fs, err
@@ -404,24 +598,35 @@ func (u *User) GetVirtualFolderForPath(virtualPath string) (vfs.VirtualFolder, e
 	return folder, errNoMatchingVirtualFolder
 }
 
-// ScanQuota scans the user home dir and virtual folders, included in its quota,
-// and returns the number of files and their size
+// ScanQuota scans the user home dirs, the default one and the protocol specific
+// ones, and virtual folders, included in its quota, and returns the number of
+// files and their size
 func (u *User) ScanQuota() (int, int64, error) {
-	fs, err := u.getRootFs("")
-	if err != nil {
-		return 0, 0, err
-	}
-	defer fs.Close()
-	numFiles, size, err := fs.ScanRootDirContents()
-	if err != nil {
-		return numFiles, size, err
+	var numFiles int
+	var size int64
+	for _, protocol := range u.getQuotaScanProtocols() {
+		user := *u
+		user.loginProtocol = protocol
+		num, s, err := user.scanRootFs()
+		if err != nil {
+			return numFiles, size, err
+		}
+		numFiles += num
+		size += s
 	}
 	for idx := range u.VirtualFolders {
 		v := &u.VirtualFolders[idx]
 		if !v.IsIncludedInUserQuota() {
 			continue
 		}
-		num, s, err := v.ScanQuota()
+		var num int
+		var s int64
+		var err error
+		if len(u.Filters.QuotaScanExcludes) > 0 {
+			num, s, err = v.ScanQuotaWithExcludes(u.IsExcludedFromQuotaScan)
+		} else {
+			num, s, err = v.ScanQuota()
+		}
 		if err != nil {
 			return numFiles, size, err
 		}
@@ -432,6 +637,54 @@ func (u *User) ScanQuota() (int, int64, error) {
 	return numFiles, size, nil
 }
 
+// getQuotaScanProtocols returns the login protocols whose root filesystem must
+// be scanned, an empty string means the default filesystem. The default filesystem
+// is not returned if every protocol has its own and the protocols sharing the same
+// home dir and filesystem are returned once
+func (u *User) getQuotaScanProtocols() []string {
+	var protocols []string
+	var scanned []ProtocolFilesystem
+	if len(u.ProtocolFilesystems) < len(ValidProtocols) {
+		// the protocol specific filesystems are validated, so at least
+		// a protocol uses the default filesystem
+		protocols = append(protocols, "")
+		scanned = append(scanned, ProtocolFilesystem{
+			HomeDir:  u.HomeDir,
+			FsConfig: u.FsConfig,
+		})
+	}
+	for idx := range u.ProtocolFilesystems {
+		p := &u.ProtocolFilesystems[idx]
+		isScanned := false
+		for _, other := range scanned {
+			if filepath.Clean(p.HomeDir) == filepath.Clean(other.HomeDir) && p.FsConfig.IsEqual(&other.FsConfig) {
+				isScanned = true
+				break
+			}
+		}
+		if !isScanned {
+			protocols = append(protocols, p.Protocol)
+			scanned = append(scanned, *p)
+		}
+	}
+	return protocols
+}
+
+// scanRootFs returns the number of files and their size for the root
+// filesystem of the user login protocol
+func (u *User) scanRootFs() (int, int64, error) {
+	fs, err := u.getRootFs("")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fs.Close()
+
+	if len(u.Filters.QuotaScanExcludes) > 0 {
+		return vfs.ScanDirContentsWithExcludes(fs, "/", u.IsExcludedFromQuotaScan)
+	}
+	return fs.ScanRootDirContents()
+}
+
 // GetVirtualFoldersInPath returns the virtual folders inside virtualPath including
 // any parents
 func (u *User) GetVirtualFoldersInPath(virtualPath string) map[string]bool {
@@ -696,12 +949,100 @@ func (u *User) isFilePatternAllowed(virtualPath string) bool {
 	return true
 }
 
+// IsPathHidden returns true if virtualPath, or one of its parent directories,
+// matches one of the hidden patterns
+func (u *User) IsPathHidden(virtualPath string) bool {
+	if len(u.Filters.HiddenPatterns) == 0 {
+		return false
+	}
+	for _, name := range strings.Split(strings.ToLower(path.Clean(virtualPath)), "/") {
+		if name == "" {
+			continue
+		}
+		for _, pattern := range u.Filters.HiddenPatterns {
+			if matched, err := path.Match(pattern, name); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetMaxVirtualFolders returns the maximum number of virtual folders allowed for
+// this user, 0 means unlimited
+func (u *User) GetMaxVirtualFolders() int {
+	switch {
+	case u.Filters.MaxVirtualFolders > 0:
+		return u.Filters.MaxVirtualFolders
+	case u.Filters.MaxVirtualFolders == -1:
+		return 0
+	default:
+		return config.MaxUserVirtualFolders
+	}
+}
+
+// IsExcludedFromQuotaScan returns true if virtualPath, or one of its parent
+// directories, matches one of the quota scan excludes
+func (u *User) IsExcludedFromQuotaScan(virtualPath string) bool {
+	virtualPath = path.Clean(virtualPath)
+	for _, pattern := range u.Filters.QuotaScanExcludes {
+		if strings.HasPrefix(pattern, "/") {
+			for p := virtualPath; p != "/" && p != "."; p = path.Dir(p) {
+				if matched, err := path.Match(pattern, p); err == nil && matched {
+					return true
+				}
+			}
+			continue
+		}
+		for _, name := range strings.Split(virtualPath, "/") {
+			if name == "" {
+				continue
+			}
+			if matched, err := path.Match(pattern, name); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetUploadLineEnding returns the line ending to use for the uploaded file
+// virtualPath or an empty string if the file must not be normalized
+func (u *User) GetUploadLineEnding(virtualPath string) sdk.LineEnding {
+	if u.Filters.TextMode.Upload == "" || !u.isTextModeFile(virtualPath) {
+		return ""
+	}
+	return u.Filters.TextMode.Upload
+}
+
+// GetDownloadLineEnding returns the line ending to use for the downloaded file
+// virtualPath or an empty string if the file must not be normalized
+func (u *User) GetDownloadLineEnding(virtualPath string) sdk.LineEnding {
+	if u.Filters.TextMode.Download == "" || !u.isTextModeFile(virtualPath) {
+		return ""
+	}
+	return u.Filters.TextMode.Download
+}
+
+func (u *User) isTextModeFile(virtualPath string) bool {
+	ext := strings.ToLower(path.Ext(virtualPath))
+	if ext == "" {
+		return false
+	}
+	return util.IsStringInSlice(ext, u.Filters.TextMode.Extensions)
+}
+
 // CanManagePublicKeys return true if this user is allowed to manage public keys
 // from the web client. Used in web client UI
 func (u *User) CanManagePublicKeys() bool {
 	return !util.IsStringInSlice(sdk.WebClientPubKeyChangeDisabled, u.Filters.WebClient)
 }
 
+// CanChangePassword returns true if this user is allowed to change its own password
+func (u *User) CanChangePassword() bool {
+	return !util.IsStringInSlice(sdk.WebClientPasswordChangeDisabled, u.Filters.WebClient)
+}
+
 // CanAddFilesFromWeb returns true if the client can add files from the web UI.
 // The specified target is the directory where the files must be uploaded
 func (u *User) CanAddFilesFromWeb(target string) bool {
@@ -753,6 +1094,15 @@ func (u *User) GetSignature() string {
 	return base64.StdEncoding.EncodeToString(signature[:])
 }
 
+// IsSecurityProfileAllowed returns true if the user can login using
+// a binding with the specified security profile
+func (u *User) IsSecurityProfileAllowed(profile string) bool {
+	if len(u.Filters.SecurityProfiles) == 0 {
+		return true
+	}
+	return util.IsStringInSlice(profile, u.Filters.SecurityProfiles)
+}
+
 // IsLoginFromAddrAllowed returns true if the login is allowed from the specified remoteAddr.
 // If AllowedIP is defined only the specified IP/Mask can login.
 // If DeniedIP is defined the specified IP/Mask cannot login.
@@ -808,6 +1158,11 @@ func (u *User) GetFsConfigAsJSON() ([]byte, error) {
 	return json.Marshal(u.FsConfig)
 }
 
+// GetProtocolFilesystemsAsJSON returns the protocol specific filesystems as json byte array
+func (u *User) GetProtocolFilesystemsAsJSON() ([]byte, error) {
+	return json.Marshal(u.ProtocolFilesystems)
+}
+
 // GetUID returns a validate uid, suitable for use with os.Chown
 func (u *User) GetUID() int {
 	if u.UID <= 0 || u.UID > math.MaxInt32 {
@@ -826,17 +1181,26 @@ func (u *User) GetGID() int {
 
 // GetHomeDir returns the shortest path name equivalent to the user's home directory
 func (u *User) GetHomeDir() string {
+	if p := u.getProtocolFilesystem(); p != nil {
+		return filepath.Clean(p.HomeDir)
+	}
 	return filepath.Clean(u.HomeDir)
 }
 
 // HasQuotaRestrictions returns true if there is a quota restriction on number of files or size or both
 func (u *User) HasQuotaRestrictions() bool {
+	if u.Filters.DisableQuotaTracking {
+		return false
+	}
 	return u.QuotaFiles > 0 || u.QuotaSize > 0
 }
 
 // GetQuotaSummary returns used quota and limits if defined
 func (u *User) GetQuotaSummary() string {
 	var result string
+	if u.Filters.DisableQuotaTracking {
+		return "Quota tracking disabled"
+	}
 	result = "Files: " + strconv.Itoa(u.UsedQuotaFiles)
 	if u.QuotaFiles > 0 {
 		result += "/" + strconv.Itoa(u.QuotaFiles)
@@ -876,6 +1240,18 @@ func (u *User) GetPermissionsAsString() string {
 	return result
 }
 
+// GetBandwidthAt returns the upload and download bandwidth limits to apply at the given time.
+// The first active bandwidth schedule wins, if none is active the user's default limits are returned
+func (u *User) GetBandwidthAt(t time.Time) (int64, int64) {
+	for idx := range u.Filters.BandwidthSchedules {
+		schedule := &u.Filters.BandwidthSchedules[idx]
+		if schedule.IsActiveAt(t) {
+			return schedule.UploadBandwidth, schedule.DownloadBandwidth
+		}
+	}
+	return u.UploadBandwidth, u.DownloadBandwidth
+}
+
 // GetBandwidthAsString returns bandwidth limits if defines
 func (u *User) GetBandwidthAsString() string {
 	result := "DL: "
@@ -959,6 +1335,9 @@ func (u *User) GetDeniedIPAsString() string {
 // SetEmptySecretsIfNil sets the secrets to empty if nil
 func (u *User) SetEmptySecretsIfNil() {
 	u.FsConfig.SetEmptySecretsIfNil()
+	for idx := range u.ProtocolFilesystems {
+		u.ProtocolFilesystems[idx].FsConfig.SetEmptySecretsIfNil()
+	}
 	for idx := range u.VirtualFolders {
 		vfolder := &u.VirtualFolders[idx]
 		vfolder.FsConfig.SetEmptySecretsIfNil()
@@ -974,6 +1353,10 @@ func (u *User) getACopy() User {
 		vfolder := u.VirtualFolders[idx].GetACopy()
 		virtualFolders = append(virtualFolders, vfolder)
 	}
+	var protocolFilesystems []ProtocolFilesystem
+	for idx := range u.ProtocolFilesystems {
+		protocolFilesystems = append(protocolFilesystems, u.ProtocolFilesystems[idx].GetACopy())
+	}
 	permissions := make(map[string][]string)
 	for k, v := range u.Permissions {
 		perms := make([]string, len(v))
@@ -983,6 +1366,7 @@ func (u *User) getACopy() User {
 	filters := sdk.UserFilters{}
 	filters.MaxUploadFileSize = u.Filters.MaxUploadFileSize
 	filters.TLSUsername = u.Filters.TLSUsername
+	filters.SetstatMode = u.Filters.SetstatMode
 	filters.AllowedIP = make([]string, len(u.Filters.AllowedIP))
 	copy(filters.AllowedIP, u.Filters.AllowedIP)
 	filters.DeniedIP = make([]string, len(u.Filters.DeniedIP))
@@ -999,6 +1383,36 @@ func (u *User) getACopy() User {
 	filters.DisableFsChecks = u.Filters.DisableFsChecks
 	filters.WebClient = make([]string, len(u.Filters.WebClient))
 	copy(filters.WebClient, u.Filters.WebClient)
+	filters.BandwidthSchedules = make([]sdk.BandwidthSchedule, len(u.Filters.BandwidthSchedules))
+	copy(filters.BandwidthSchedules, u.Filters.BandwidthSchedules)
+	filters.HomeSkeleton = make([]string, len(u.Filters.HomeSkeleton))
+	copy(filters.HomeSkeleton, u.Filters.HomeSkeleton)
+	filters.SecurityProfiles = make([]string, len(u.Filters.SecurityProfiles))
+	copy(filters.SecurityProfiles, u.Filters.SecurityProfiles)
+	filters.UploadCollisionPolicy = u.Filters.UploadCollisionPolicy
+	filters.SymlinksPolicy = u.Filters.SymlinksPolicy
+	filters.PathCaseFolding = u.Filters.PathCaseFolding
+	filters.DirListingSort = u.Filters.DirListingSort
+	filters.HiddenPatterns = make([]string, len(u.Filters.HiddenPatterns))
+	copy(filters.HiddenPatterns, u.Filters.HiddenPatterns)
+	filters.QuotaScanExcludes = make([]string, len(u.Filters.QuotaScanExcludes))
+	copy(filters.QuotaScanExcludes, u.Filters.QuotaScanExcludes)
+	filters.MaxVirtualFolders = u.Filters.MaxVirtualFolders
+	filters.TLSCertRequired = u.Filters.TLSCertRequired
+	filters.TLSCertFingerprints = make([]string, len(u.Filters.TLSCertFingerprints))
+	copy(filters.TLSCertFingerprints, u.Filters.TLSCertFingerprints)
+	filters.Banner = u.Filters.Banner
+	filters.DisableQuotaTracking = u.Filters.DisableQuotaTracking
+	filters.SingleSessionPolicy = u.Filters.SingleSessionPolicy
+	filters.TextMode.Extensions = make([]string, len(u.Filters.TextMode.Extensions))
+	copy(filters.TextMode.Extensions, u.Filters.TextMode.Extensions)
+	filters.TextMode.Upload = u.Filters.TextMode.Upload
+	filters.TextMode.Download = u.Filters.TextMode.Download
+	var passwordHistory []string
+	if len(u.PasswordHistory) > 0 {
+		passwordHistory = make([]string, len(u.PasswordHistory))
+		copy(passwordHistory, u.PasswordHistory)
+	}
 
 	return User{
 		BaseUser: sdk.BaseUser{
@@ -1025,8 +1439,11 @@ func (u *User) getACopy() User {
 			AdditionalInfo:    u.AdditionalInfo,
 			Description:       u.Description,
 		},
-		VirtualFolders: virtualFolders,
-		FsConfig:       u.FsConfig.GetACopy(),
+		VirtualFolders:      virtualFolders,
+		FsConfig:            u.FsConfig.GetACopy(),
+		ProtocolFilesystems: protocolFilesystems,
+		PasswordHistory:     passwordHistory,
+		Version:             u.Version,
 	}
 }
 
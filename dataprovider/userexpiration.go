@@ -0,0 +1,163 @@
+package dataprovider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/httpclient"
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/util"
+)
+
+const (
+	operationExpirationWarning = "expiration_warning"
+	operationExpirationDisable = "expiration_disable"
+)
+
+var (
+	expirationCheckTicker     *time.Ticker
+	expirationCheckTickerDone chan bool
+)
+
+// UsersExpirationConfig defines the periodic check for expiring and expired users
+type UsersExpirationConfig struct {
+	// Interval, in minutes, between two checks. 0 means disabled
+	CheckInterval int `json:"check_interval" mapstructure:"check_interval"`
+	// Enabled users expiring within this number of days are notified using the hook
+	// at each check. 0 means no warnings
+	WarningDays int `json:"warning_days" mapstructure:"warning_days"`
+	// If enabled, expired users are disabled and the hook is notified
+	DisableExpired bool `json:"disable_expired" mapstructure:"disable_expired"`
+	// Absolute path to an external program or an HTTP URL to notify about
+	// expiring and disabled users. Leave empty to disable notifications
+	Hook string `json:"hook" mapstructure:"hook"`
+}
+
+func (c *UsersExpirationConfig) isEnabled() bool {
+	return c.CheckInterval > 0 && (c.WarningDays > 0 || c.DisableExpired)
+}
+
+func (c *UsersExpirationConfig) validate() error {
+	if c.CheckInterval < 0 {
+		return fmt.Errorf("invalid users expiration check interval: %v", c.CheckInterval)
+	}
+	if c.WarningDays < 0 {
+		return fmt.Errorf("invalid users expiration warning days: %v", c.WarningDays)
+	}
+	return nil
+}
+
+func startExpirationCheckTimer() {
+	if !config.UsersExpiration.isEnabled() {
+		return
+	}
+	expirationCheckTicker = time.NewTicker(time.Duration(config.UsersExpiration.CheckInterval) * time.Minute)
+	expirationCheckTickerDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-expirationCheckTickerDone:
+				return
+			case <-expirationCheckTicker.C:
+				if err := CheckUsersExpiration(); err != nil {
+					providerLog(logger.LevelWarn, "unable to check users expiration: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func stopExpirationCheckTimer() {
+	if expirationCheckTicker != nil {
+		expirationCheckTicker.Stop()
+		expirationCheckTickerDone <- true
+		expirationCheckTicker = nil
+	}
+}
+
+// CheckUsersExpiration notifies the enabled users expiring within the configured
+// warning window and, if configured, disables the expired ones.
+// Expired users cannot login in any case
+func CheckUsersExpiration() error {
+	now := time.Now()
+	nowAsMs := util.GetTimeAsMsSinceEpoch(now)
+	expirationBefore := nowAsMs
+	if config.UsersExpiration.WarningDays > 0 {
+		window := time.Duration(config.UsersExpiration.WarningDays) * 24 * time.Hour
+		expirationBefore = util.GetTimeAsMsSinceEpoch(now.Add(window))
+	}
+	users, err := provider.getExpiringUsers(expirationBefore)
+	if err != nil {
+		return err
+	}
+	for idx := range users {
+		user := &users[idx]
+		if user.ExpirationDate < nowAsMs {
+			if !config.UsersExpiration.DisableExpired {
+				continue
+			}
+			user.Status = 0
+			if err := UpdateUser(user); err != nil {
+				providerLog(logger.LevelWarn, "unable to disable expired user %#v: %v", user.Username, err)
+				continue
+			}
+			providerLog(logger.LevelInfo, "user %#v expired on %v and it was disabled", user.Username,
+				user.GetExpirationDateAsString())
+			executeExpirationHook(operationExpirationDisable, user)
+			continue
+		}
+		if config.UsersExpiration.WarningDays > 0 {
+			executeExpirationHook(operationExpirationWarning, user)
+		}
+	}
+	return nil
+}
+
+func executeExpirationHook(operation string, user *User) {
+	hook := config.UsersExpiration.Hook
+	if hook == "" {
+		return
+	}
+	userAsJSON, err := user.RenderAsJSON(false)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to serialize user as JSON for operation %#v: %v", operation, err)
+		return
+	}
+	startTime := time.Now()
+	if strings.HasPrefix(hook, "http") {
+		var url *url.URL
+		url, err := url.Parse(hook)
+		if err != nil {
+			providerLog(logger.LevelWarn, "invalid users expiration hook %#v: %v", hook, err)
+			return
+		}
+		q := url.Query()
+		q.Add("action", operation)
+		url.RawQuery = q.Encode()
+		respCode := 0
+		resp, err := httpclient.RetryablePost(url.String(), "application/json", bytes.NewBuffer(userAsJSON))
+		if err == nil {
+			respCode = resp.StatusCode
+			resp.Body.Close()
+		}
+		providerLog(logger.LevelDebug, "users expiration hook notified operation %#v for user %#v, status code: %v, elapsed: %v err: %v",
+			operation, user.Username, respCode, time.Since(startTime), err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SFTPGO_USER_ACTION=%v", operation),
+		fmt.Sprintf("SFTPGO_USER=%v", string(userAsJSON)))
+	err = cmd.Run()
+	providerLog(logger.LevelDebug, "users expiration hook executed for operation %#v, user %#v, elapsed: %v, error: %v",
+		operation, user.Username, time.Since(startTime), err)
+}
@@ -2,6 +2,7 @@
 package ftpd
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"path/filepath"
@@ -62,8 +63,14 @@ type Binding struct {
 	// on active data connections, so change the default value only if you are on a trusted/internal network
 	ActiveConnectionsSecurity int `json:"active_connections_security" mapstructure:"active_connections_security"`
 	// Debug enables the FTP debug mode. In debug mode, every FTP command will be logged
-	Debug   bool `json:"debug" mapstructure:"debug"`
-	ciphers []uint16
+	Debug bool `json:"debug" mapstructure:"debug"`
+	// Name of the security profile for this binding. Users restricted to some
+	// security profiles can only login using the bindings with a matching profile
+	SecurityProfile string `json:"security_profile" mapstructure:"security_profile"`
+	// Minimum TLS version allowed for this binding. Supported values: 12 (TLS 1.2), 13 (TLS 1.3).
+	// 0 means TLS 1.2
+	MinTLSVersion int `json:"min_tls_version" mapstructure:"min_tls_version"`
+	ciphers       []uint16
 }
 
 func (b *Binding) setCiphers() {
@@ -87,6 +94,13 @@ func (b *Binding) IsValid() bool {
 	return b.Port > 0
 }
 
+func (b *Binding) getMinTLSVersion() uint16 {
+	if b.MinTLSVersion == 13 {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
+
 func (b *Binding) checkSecuritySettings() error {
 	if b.PassiveConnectionsSecurity < 0 || b.PassiveConnectionsSecurity > 1 {
 		return fmt.Errorf("invalid passive_connections_security: %v", b.PassiveConnectionsSecurity)
@@ -94,6 +108,9 @@ func (b *Binding) checkSecuritySettings() error {
 	if b.ActiveConnectionsSecurity < 0 || b.ActiveConnectionsSecurity > 1 {
 		return fmt.Errorf("invalid active_connections_security: %v", b.ActiveConnectionsSecurity)
 	}
+	if b.MinTLSVersion != 0 && b.MinTLSVersion != 12 && b.MinTLSVersion != 13 {
+		return fmt.Errorf("invalid min_tls_version: %v", b.MinTLSVersion)
+	}
 	return nil
 }
 
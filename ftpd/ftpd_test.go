@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -1942,6 +1943,84 @@ func TestUploadOverwriteVfolder(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTextModeLineEndings(t *testing.T) {
+	u := getTestUser()
+	u.Filters.TextMode = sdk.TextModeFilter{
+		Extensions: []string{".txt"},
+		Upload:     sdk.LineEndingLF,
+		Download:   sdk.LineEndingCRLF,
+	}
+	// the quota is tracked only for users with quota restrictions
+	u.QuotaFiles = 100
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	client, err := getFTPClient(user, true, nil)
+	if assert.NoError(t, err) {
+		textContent := []byte("line1\r\nline2\r\n")
+		normalizedContent := []byte("line1\nline2\n")
+		binaryContent := []byte("line1\r\n\x00line2\r\n")
+		textFilePath := filepath.Join(homeBasePath, "text_file.txt")
+		binaryFilePath := filepath.Join(homeBasePath, "binary_file.txt")
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = os.WriteFile(textFilePath, textContent, os.ModePerm)
+		assert.NoError(t, err)
+		err = os.WriteFile(binaryFilePath, binaryContent, os.ModePerm)
+		assert.NoError(t, err)
+		// configured extensions are normalized, the match is case insensitive
+		err = ftpUploadFile(textFilePath, "file.txt", int64(len(normalizedContent)), client, 0)
+		assert.NoError(t, err)
+		data, err := os.ReadFile(filepath.Join(user.GetHomeDir(), "file.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, normalizedContent, data)
+		err = ftpUploadFile(textFilePath, "FILE.TXT", int64(len(normalizedContent)), client, 0)
+		assert.NoError(t, err)
+		// other extensions and binary contents are not modified
+		err = ftpUploadFile(textFilePath, "file.dat", int64(len(textContent)), client, 0)
+		assert.NoError(t, err)
+		data, err = os.ReadFile(filepath.Join(user.GetHomeDir(), "file.dat"))
+		assert.NoError(t, err)
+		assert.Equal(t, textContent, data)
+		err = ftpUploadFile(binaryFilePath, "binary.txt", int64(len(binaryContent)), client, 0)
+		assert.NoError(t, err)
+		data, err = os.ReadFile(filepath.Join(user.GetHomeDir(), "binary.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, binaryContent, data)
+		// the quota reflects the normalized sizes
+		user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, user.UsedQuotaFiles)
+		assert.Equal(t, int64(2*len(normalizedContent)+len(textContent)+len(binaryContent)), user.UsedQuotaSize)
+		// downloads are converted to CRLF
+		err = ftpDownloadFile("file.txt", localDownloadPath, int64(len(textContent)), client, 0)
+		assert.NoError(t, err)
+		data, err = os.ReadFile(localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, textContent, data)
+		err = ftpDownloadFile("binary.txt", localDownloadPath, int64(len(binaryContent)), client, 0)
+		assert.NoError(t, err)
+		err = os.WriteFile(filepath.Join(user.GetHomeDir(), "unix.dat"), normalizedContent, os.ModePerm)
+		assert.NoError(t, err)
+		err = ftpDownloadFile("unix.dat", localDownloadPath, int64(len(normalizedContent)), client, 0)
+		assert.NoError(t, err)
+		// resumed downloads are not converted
+		err = ftpDownloadFile("file.txt", localDownloadPath, int64(len(normalizedContent)-2), client, 2)
+		assert.NoError(t, err)
+
+		err = client.Quit()
+		assert.NoError(t, err)
+		err = os.Remove(textFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(binaryFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestAllocateAvailable(t *testing.T) {
 	u := getTestUser()
 	mappedPath := filepath.Join(os.TempDir(), "vdir")
@@ -2594,6 +2673,59 @@ func TestClientCertificateAndPwdAuth(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestClientCertificateRequired(t *testing.T) {
+	u := getTestUser()
+	u.Username = tlsClient1Username
+	u.Filters.TLSCertRequired = true
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	tlsConfig := &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true, // use this for tests only
+		MinVersion:         tls.VersionTLS12,
+	}
+	_, err = getFTPClient(user, true, tlsConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "a TLS client certificate is required")
+	}
+	tlsCert, err := tls.X509KeyPair([]byte(client1Crt), []byte(client1Key))
+	assert.NoError(t, err)
+	tlsConfig.Certificates = append(tlsConfig.Certificates, tlsCert)
+	client, err := getFTPClient(user, true, tlsConfig)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+
+	user.Filters.TLSCertRequired = false
+	user.Filters.TLSCertFingerprints = []string{hex.EncodeToString(make([]byte, sha256.Size))}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, err = getFTPClient(user, true, tlsConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not allowed for user")
+	}
+	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	assert.NoError(t, err)
+	user.Filters.TLSCertFingerprints = []string{dataprovider.GetTLSCertificateFingerprint(x509Cert)}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getFTPClient(user, true, tlsConfig)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestExternatAuthWithClientCert(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -340,6 +340,11 @@ func (c *Connection) downloadFile(fs vfs.Fs, fsPath, ftpPath string, offset int6
 		0, 0, 0, false, fs)
 	baseTransfer.SetFtpMode(c.getFTPMode())
 	t := newTransfer(baseTransfer, nil, r, offset)
+	if offset == 0 {
+		if lineEnding := c.User.GetDownloadLineEnding(ftpPath); lineEnding != "" {
+			t.reader = common.NewTextModeReader(t.reader, lineEnding)
+		}
+	}
 
 	return t, nil
 }
@@ -374,6 +379,21 @@ func (c *Connection) uploadFile(fs vfs.Fs, fsPath, ftpPath string, flags int) (f
 		return nil, c.GetOpUnsupportedError()
 	}
 
+	newFsPath, virtualPath, err := c.HandleUploadCollision(fs, fsPath, ftpPath, flags&os.O_TRUNC == 0)
+	if err != nil {
+		return nil, err
+	}
+	if virtualPath != ftpPath {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualPath)) {
+			return nil, fmt.Errorf("%w, no upload permission", ftpserver.ErrFileNameNotAllowed)
+		}
+		filePath = newFsPath
+		if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+			filePath = fs.GetAtomicUploadPath(newFsPath)
+		}
+		return c.handleFTPUploadToNewFile(fs, newFsPath, filePath, virtualPath)
+	}
+
 	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(ftpPath)) {
 		return nil, fmt.Errorf("%w, no overwrite permission", ftpserver.ErrFileNameNotAllowed)
 	}
@@ -408,6 +408,17 @@ func TestInitialization(t *testing.T) {
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "invalid active_connections_security")
 	}
+	binding.ActiveConnectionsSecurity = 1
+	binding.MinTLSVersion = 11
+	server = NewServer(c, configDir, binding, 0)
+	_, err = server.GetSettings()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid min_tls_version")
+	}
+	binding.MinTLSVersion = 0
+	assert.Equal(t, uint16(tls.VersionTLS12), binding.getMinTLSVersion())
+	binding.MinTLSVersion = 13
+	assert.Equal(t, uint16(tls.VersionTLS13), binding.getMinTLSVersion())
 	binding = Binding{
 		Port:           2121,
 		ForcePassiveIP: "192.168.1",
@@ -448,7 +459,7 @@ func TestServerGetSettings(t *testing.T) {
 	oldConfig := common.Config
 
 	binding := Binding{
-		Port:             2121,
+		Port:             0,
 		ApplyProxyConfig: true,
 	}
 	c := &Configuration{
@@ -464,6 +475,11 @@ func TestServerGetSettings(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 10000, settings.PassiveTransferPortRange.Start)
 	assert.Equal(t, 11000, settings.PassiveTransferPortRange.End)
+	// without a proxy the listener refuses the hosts not in the allow list
+	_, ok := settings.Listener.(*proxyproto.Listener)
+	assert.False(t, ok)
+	err = settings.Listener.Close()
+	assert.NoError(t, err)
 
 	common.Config.ProxyProtocol = 1
 	common.Config.ProxyAllowed = []string{"invalid"}
@@ -496,14 +512,17 @@ func TestServerGetSettings(t *testing.T) {
 	server.binding.Port = 9021
 	settings, err = server.GetSettings()
 	assert.NoError(t, err)
-	assert.NotNil(t, settings.Listener)
+	if assert.NotNil(t, settings.Listener) {
+		err = settings.Listener.Close()
+		assert.NoError(t, err)
+	}
 
 	listener, err := net.Listen("tcp", ":0")
 	assert.NoError(t, err)
 	listener, err = server.WrapPassiveListener(listener)
 	assert.NoError(t, err)
 
-	_, ok := listener.(*proxyproto.Listener)
+	_, ok = listener.(*proxyproto.Listener)
 	assert.True(t, ok)
 
 	err = os.Remove(certPath)
@@ -30,6 +30,8 @@ type Server struct {
 	tlsConfig        *tls.Config
 	mu               sync.RWMutex
 	verifiedTLSConns map[uint32]bool
+	// client certificates presented by the FTP connections, the key is the connection ID
+	tlsCerts map[uint32]*x509.Certificate
 }
 
 // NewServer returns a new FTP server driver
@@ -42,6 +44,7 @@ func NewServer(config *Configuration, configDir string, binding Binding, id int)
 		binding:          binding,
 		ID:               id,
 		verifiedTLSConns: make(map[uint32]bool),
+		tlsCerts:         make(map[uint32]*x509.Certificate),
 	}
 	if config.BannerFile != "" {
 		bannerFilePath := config.BannerFile
@@ -79,6 +82,21 @@ func (s *Server) cleanTLSConnVerification(id uint32) {
 	defer s.mu.Unlock()
 
 	delete(s.verifiedTLSConns, id)
+	delete(s.tlsCerts, id)
+}
+
+func (s *Server) setTLSCert(id uint32, tlsCert *x509.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tlsCerts[id] = tlsCert
+}
+
+func (s *Server) getTLSCert(id uint32) *x509.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.tlsCerts[id]
 }
 
 // GetSettings returns FTP server settings
@@ -96,23 +114,6 @@ func (s *Server) GetSettings() (*ftpserver.Settings, error) {
 			End:   s.config.PassivePortRange.End,
 		}
 	}
-	var ftpListener net.Listener
-	if s.binding.HasProxy() {
-		listener, err := net.Listen("tcp", s.binding.GetAddress())
-		if err != nil {
-			logger.Warn(logSender, "", "error starting listener on address %v: %v", s.binding.GetAddress(), err)
-			return nil, err
-		}
-		ftpListener, err = common.Config.GetProxyListener(listener)
-		if err != nil {
-			logger.Warn(logSender, "", "error enabling proxy listener: %v", err)
-			return nil, err
-		}
-		if s.binding.TLSMode == 2 && s.tlsConfig != nil {
-			ftpListener = tls.NewListener(ftpListener, s.tlsConfig)
-		}
-	}
-
 	if s.binding.TLSMode < 0 || s.binding.TLSMode > 2 {
 		return nil, errors.New("unsupported TLS mode")
 	}
@@ -121,6 +122,29 @@ func (s *Server) GetSettings() (*ftpserver.Settings, error) {
 		return nil, errors.New("to enable TLS you need to provide a certificate")
 	}
 
+	ftpListener, err := net.Listen("tcp", s.binding.GetAddress())
+	if err != nil {
+		logger.Warn(logSender, "", "error starting listener on address %v: %v", s.binding.GetAddress(), err)
+		return nil, err
+	}
+	if s.binding.HasProxy() {
+		proxyListener, err := common.Config.GetProxyListener(ftpListener)
+		if err != nil {
+			ftpListener.Close()
+			logger.Warn(logSender, "", "error enabling proxy listener: %v", err)
+			return nil, err
+		}
+		ftpListener = proxyListener
+	} else {
+		// the refused connections are closed before the greeting and the TLS handshake.
+		// Behind a proxy the client IP is only known after reading the proxy header,
+		// it is checked when the client connects
+		ftpListener = common.NewAllowListListener(ftpListener, common.ProtocolFTP, nil)
+	}
+	if s.binding.TLSMode == 2 && s.tlsConfig != nil {
+		ftpListener = tls.NewListener(ftpListener, s.tlsConfig)
+	}
+
 	return &ftpserver.Settings{
 		Listener:                 ftpListener,
 		ListenAddr:               s.binding.GetAddress(),
@@ -146,11 +170,15 @@ func (s *Server) ClientConnected(cc ftpserver.ClientContext) (string, error) {
 	cc.SetDebug(s.binding.Debug)
 	ipAddr := util.GetIPFromRemoteAddress(cc.RemoteAddr().String())
 	common.Connections.AddClientConnection(ipAddr)
+	if !common.IsConnectionAccepted(ipAddr, common.ProtocolFTP) {
+		return "Access denied: client IP not allowed", common.ErrConnectionDenied
+	}
 	if common.IsBanned(ipAddr) {
 		logger.Log(logger.LevelDebug, common.ProtocolFTP, "", "connection refused, ip %#v is banned", ipAddr)
 		return "Access denied: banned client IP", common.ErrConnectionDenied
 	}
-	if !common.Connections.IsNewConnectionAllowed(ipAddr) {
+	common.ThrottleConnection(ipAddr, common.ProtocolFTP)
+	if !common.Connections.IsNewConnectionAllowed(ipAddr, common.ProtocolFTP) {
 		logger.Log(logger.LevelDebug, common.ProtocolFTP, "", "connection refused, configured limit reached")
 		return "Access denied: max allowed connection exceeded", common.ErrConnectionDenied
 	}
@@ -169,6 +197,9 @@ func (s *Server) ClientConnected(cc ftpserver.ClientContext) (string, error) {
 		clientContext: cc,
 	}
 	common.Connections.Add(connection)
+	if banner := connection.GetBanner(); banner != "" {
+		return banner, nil
+	}
 	return s.initialMsg, nil
 }
 
@@ -224,6 +255,7 @@ func (s *Server) VerifyConnection(cc ftpserver.ClientContext, user string, tlsCo
 	if tlsConn != nil {
 		state := tlsConn.ConnectionState()
 		if len(state.PeerCertificates) > 0 {
+			s.setTLSCert(cc.ID(), state.PeerCertificates[0])
 			ipAddr := util.GetIPFromRemoteAddress(cc.RemoteAddr().String())
 			dbUser, err := dataprovider.CheckUserBeforeTLSAuth(user, ipAddr, common.ProtocolFTP, state.PeerCertificates[0])
 			if err != nil {
@@ -263,7 +295,7 @@ func (s *Server) buildTLSConfig() {
 	if certMgr != nil {
 		s.tlsConfig = &tls.Config{
 			GetCertificate:           certMgr.GetCertificateFunc(),
-			MinVersion:               tls.VersionTLS12,
+			MinVersion:               s.binding.getMinTLSVersion(),
 			CipherSuites:             s.binding.ciphers,
 			PreferServerCipherSuites: true,
 		}
@@ -329,10 +361,19 @@ func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext
 		logger.Debug(logSender, connectionID, "cannot login user %#v, protocol FTP is not allowed", user.Username)
 		return nil, fmt.Errorf("protocol FTP is not allowed for user %#v", user.Username)
 	}
+	if !user.IsSecurityProfileAllowed(s.binding.SecurityProfile) {
+		logger.Debug(logSender, connectionID, "cannot login user %#v, security profile %#v is not allowed",
+			user.Username, s.binding.SecurityProfile)
+		return nil, fmt.Errorf("security profile %#v is not allowed for user %#v", s.binding.SecurityProfile, user.Username)
+	}
 	if !user.IsLoginMethodAllowed(loginMethod, nil) {
 		logger.Debug(logSender, connectionID, "cannot login user %#v, %v login method is not allowed", user.Username, loginMethod)
 		return nil, fmt.Errorf("login method %v is not allowed for user %#v", loginMethod, user.Username)
 	}
+	if err := user.CheckTLSCertificate(s.getTLSCert(cc.ID())); err != nil {
+		logger.Debug(logSender, connectionID, "cannot login user %#v: %v", user.Username, err)
+		return nil, err
+	}
 	if user.MaxSessions > 0 {
 		activeSessions := common.Connections.GetActiveSessions(user.Username)
 		if activeSessions >= user.MaxSessions {
@@ -346,12 +387,20 @@ func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext
 		logger.Debug(logSender, connectionID, "cannot login user %#v, remote address is not allowed: %v", user.Username, remoteAddr)
 		return nil, fmt.Errorf("login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
 	}
+	user.SetLoginProtocol(common.ProtocolFTP)
 	err := user.CheckFsRoot(connectionID)
 	if err != nil {
 		errClose := user.CloseFs()
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v close fs error: %v", err, errClose)
 		return nil, common.ErrInternalFailure
 	}
+	// enforced as last check, so a refused login cannot close the existing sessions
+	if err := common.Connections.CheckSingleSession(&user, common.ProtocolFTP); err != nil {
+		errClose := user.CloseFs()
+		logger.Debug(logSender, connectionID, "authentication refused for user %#v: %v, close fs error: %v",
+			user.Username, err, errClose)
+		return nil, err
+	}
 	connection := &Connection{
 		BaseConnection: common.NewBaseConnection(fmt.Sprintf("%v_%v", s.ID, cc.ID()), common.ProtocolFTP,
 			cc.LocalAddr().String(), remoteAddr, user),
@@ -375,7 +424,9 @@ func updateLoginMetrics(user *dataprovider.User, ip, loginMethod string, err err
 		if _, ok := err.(*util.RecordNotFoundError); ok {
 			event = common.HostEventUserNotFound
 		}
-		common.AddDefenderEvent(ip, event)
+		common.AddDefenderEvent(ip, common.ProtocolFTP, event)
+	} else if err == nil {
+		common.AddDefenderLoginSuccess(ip)
 	}
 	metric.AddLoginResult(loginMethod, err)
 	dataprovider.ExecutePostLoginHook(user, loginMethod, ip, common.ProtocolFTP, err)
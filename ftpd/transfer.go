@@ -30,6 +30,7 @@ func newTransfer(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 		reader = baseTransfer.File
 	} else if pipeWriter != nil {
 		writer = pipeWriter
+		baseTransfer.SetPipeWriter(pipeWriter)
 	} else if pipeReader != nil {
 		reader = pipeReader
 	}
@@ -45,6 +46,10 @@ func newTransfer(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 // Read reads the contents to downloads.
 func (t *transfer) Read(p []byte) (n int, err error) {
 	t.Connection.UpdateLastActivity()
+	if err = t.AcquireTransferSlot(); err != nil {
+		t.TransferError(err)
+		return 0, err
+	}
 
 	n, err = t.reader.Read(p)
 	atomic.AddInt64(&t.BytesSent, int64(n))
@@ -60,6 +65,10 @@ func (t *transfer) Read(p []byte) (n int, err error) {
 // Write writes the uploaded contents.
 func (t *transfer) Write(p []byte) (n int, err error) {
 	t.Connection.UpdateLastActivity()
+	if err = t.AcquireTransferSlot(); err != nil {
+		t.TransferError(err)
+		return 0, err
+	}
 
 	n, err = t.writer.Write(p)
 	atomic.AddInt64(&t.BytesReceived, int64(n))
@@ -67,6 +76,9 @@ func (t *transfer) Write(p []byte) (n int, err error) {
 	if t.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&t.BytesReceived) > t.MaxWriteSize {
 		err = t.Connection.GetQuotaExceededError()
 	}
+	if err == nil {
+		err = t.ReserveQuota()
+	}
 	if err != nil {
 		t.TransferError(err)
 		return
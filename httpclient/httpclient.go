@@ -1,6 +1,7 @@
 package httpclient
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -193,6 +194,16 @@ func Get(url string) (*http.Response, error) {
 	return GetHTTPClient().Do(req)
 }
 
+// GetWithContext issues a GET to the specified URL using the given context
+func GetWithContext(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	addHeaders(req, url)
+	return GetHTTPClient().Do(req)
+}
+
 // Post issues a POST to the specified URL
 func Post(url string, contentType string, body io.Reader) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodPost, url, body)
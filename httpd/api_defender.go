@@ -36,6 +36,20 @@ func getDefenderHostByID(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, host)
 }
 
+func explainDefenderHostByID(w http.ResponseWriter, r *http.Request) {
+	ip, err := getIPFromID(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	explanation, err := common.ExplainDefenderBan(ip)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, explanation)
+}
+
 func deleteDefenderHostByID(w http.ResponseWriter, r *http.Request) {
 	ip, err := getIPFromID(r)
 	if err != nil {
@@ -115,6 +129,10 @@ func getIPFromID(r *http.Request) (string, error) {
 		return "", errors.New("invalid host id")
 	}
 	ip := string(decoded)
+	// the defender can track the hosts aggregated by subnet
+	if _, _, err := net.ParseCIDR(ip); err == nil {
+		return ip, nil
+	}
 	err = validateIPAddress(ip)
 	if err != nil {
 		return "", err
@@ -27,6 +27,10 @@ func getFolders(w http.ResponseWriter, r *http.Request) {
 func addFolder(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	var folder vfs.BaseVirtualFolder
+	// the default filesystem, if any, is overridden by the filesystem in the request
+	if fs, ok := dataprovider.GetDefaultFilesystem(); ok {
+		folder.FsConfig = fs
+	}
 	err := render.DecodeJSON(r.Body, &folder)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/go-chi/render"
@@ -191,6 +192,7 @@ func uploadUserFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var renamedFiles []string
 	for _, f := range files {
 		file, err := f.Open()
 		if err != nil {
@@ -205,6 +207,10 @@ func uploadUserFiles(w http.ResponseWriter, r *http.Request) {
 			sendAPIResponse(w, r, err, fmt.Sprintf("Unable to write file %#v", f.Filename), getMappedStatusCode(err))
 			return
 		}
+		if t, ok := writer.(*httpdFile); ok && t.GetVirtualPath() != filePath {
+			// the upload collision policy changed the file name
+			renamedFiles = append(renamedFiles, fmt.Sprintf("%#v saved as %#v", f.Filename, path.Base(t.GetVirtualPath())))
+		}
 		_, err = io.Copy(writer, file)
 		if err != nil {
 			writer.Close() //nolint:errcheck
@@ -217,6 +223,11 @@ func uploadUserFiles(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if len(renamedFiles) > 0 {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("Upload completed, %v", strings.Join(renamedFiles, ", ")),
+			http.StatusCreated)
+		return
+	}
 	sendAPIResponse(w, r, nil, "Upload completed", http.StatusCreated)
 }
 
@@ -363,25 +374,20 @@ func changeUserPassword(w http.ResponseWriter, r *http.Request) {
 }
 
 func doChangeUserPassword(r *http.Request, currentPassword, newPassword, confirmNewPassword string) error {
-	if currentPassword == "" || newPassword == "" || confirmNewPassword == "" {
-		return util.NewValidationError("please provide the current password and the new one two times")
+	if newPassword == "" || confirmNewPassword == "" {
+		return util.NewValidationError("please provide the new password two times")
+	}
+	if currentPassword == "" && dataprovider.IsCurrentPasswordRequired() {
+		return util.NewValidationError("please provide the current password")
 	}
 	if newPassword != confirmNewPassword {
 		return util.NewValidationError("the two password fields do not match")
 	}
-	if currentPassword == newPassword {
-		return util.NewValidationError("the new password must be different from the current one")
-	}
 	claims, err := getTokenClaims(r)
 	if err != nil || claims.Username == "" {
 		return errors.New("invalid token claims")
 	}
-	user, err := dataprovider.CheckUserAndPass(claims.Username, currentPassword, util.GetIPFromRemoteAddress(r.RemoteAddr),
-		common.ProtocolHTTP)
-	if err != nil {
-		return util.NewValidationError("current password does not match")
-	}
-	user.Password = newPassword
 
-	return dataprovider.UpdateUser(&user)
+	return dataprovider.ChangeUserPassword(claims.Username, currentPassword, newPassword,
+		util.GetIPFromRemoteAddress(r.RemoteAddr), common.ProtocolHTTP)
 }
@@ -266,6 +266,7 @@ func RestoreUsers(users []dataprovider.User, inputFile string, mode, scanQuota i
 				continue
 			}
 			user.ID = u.ID
+			user.Version = 0
 			err = dataprovider.UpdateUser(&user)
 			user.Password = redactedSecret
 			logger.Debug(logSender, "", "restoring existing user: %+v, dump file: %#v, error: %v", user, inputFile, err)
@@ -280,7 +281,7 @@ func RestoreUsers(users []dataprovider.User, inputFile string, mode, scanQuota i
 		if err != nil {
 			return err
 		}
-		if scanQuota == 1 || (scanQuota == 2 && user.HasQuotaRestrictions()) {
+		if !user.Filters.DisableQuotaTracking && (scanQuota == 1 || (scanQuota == 2 && user.HasQuotaRestrictions())) {
 			if common.QuotaScans.AddUserQuotaScan(user.Username) {
 				logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
 				go doUserQuotaScan(user) //nolint:errcheck
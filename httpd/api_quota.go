@@ -131,6 +131,10 @@ func doUpdateUserQuotaUsage(w http.ResponseWriter, r *http.Request, username str
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	if user.Filters.DisableQuotaTracking {
+		sendAPIResponse(w, r, nil, "Quota tracking is disabled for this user", http.StatusForbidden)
+		return
+	}
 	if mode == quotaUpdateModeAdd && !user.HasQuotaRestrictions() && dataprovider.GetQuotaTracking() == 2 {
 		sendAPIResponse(w, r, errors.New("this user has no quota restrictions, only reset mode is supported"),
 			"", http.StatusBadRequest)
@@ -188,6 +192,10 @@ func doStartUserQuotaScan(w http.ResponseWriter, r *http.Request, username strin
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	if user.Filters.DisableQuotaTracking {
+		sendAPIResponse(w, r, nil, "Quota tracking is disabled for this user", http.StatusForbidden)
+		return
+	}
 	if !common.QuotaScans.AddUserQuotaScan(user.Username) {
 		sendAPIResponse(w, r, err, "Another scan is already in progress", http.StatusConflict)
 		return
@@ -216,11 +224,21 @@ func doStartFolderQuotaScan(w http.ResponseWriter, r *http.Request, name string)
 
 func doUserQuotaScan(user dataprovider.User) error {
 	defer common.QuotaScans.RemoveUserQuotaScan(user.Username)
+	if err := common.Connections.WaitForUserUploads(user.Username); err != nil {
+		logger.Warn(logSender, "", "unable to scan quota for user %#v: %v", user.Username, err)
+		return err
+	}
 	numFiles, size, err := user.ScanQuota()
 	if err != nil {
 		logger.Warn(logSender, "", "error scanning user quota %#v: %v", user.Username, err)
 		return err
 	}
+	if common.Config.QuotaScanTransfersGrace > 0 && common.Connections.HasActiveUploads(user.Username) {
+		// an upload checked its quota just before the new uploads were refused
+		err = errors.New("uploads started during the scan")
+		logger.Warn(logSender, "", "unable to scan quota for user %#v: %v", user.Username, err)
+		return err
+	}
 	err = dataprovider.UpdateUserQuota(&user, numFiles, size, true)
 	logger.Debug(logSender, "", "user quota scanned, user: %#v, error: %v", user.Username, err)
 	return err
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-chi/render"
 
 	"github.com/drakkan/sftpgo/v2/common"
 	"github.com/drakkan/sftpgo/v2/dataprovider"
 	"github.com/drakkan/sftpgo/v2/kms"
+	"github.com/drakkan/sftpgo/v2/logger"
 	"github.com/drakkan/sftpgo/v2/sdk"
 	"github.com/drakkan/sftpgo/v2/vfs"
 )
@@ -22,7 +24,12 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users, err := dataprovider.GetUsers(limit, offset, order)
+	var users []dataprovider.User
+	if metadataKey := r.URL.Query().Get("metadata_key"); metadataKey != "" {
+		users, err = dataprovider.GetUsersByMetadata(metadataKey, r.URL.Query().Get("metadata_value"), limit, offset, order)
+	} else {
+		users, err = dataprovider.GetUsers(limit, offset, order)
+	}
 	if err == nil {
 		render.JSON(w, r, users)
 	} else {
@@ -41,7 +48,13 @@ func renderUser(w http.ResponseWriter, r *http.Request, username string, status
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	user.Metadata, err = dataprovider.GetUserMetadata(username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
 	user.PrepareForRendering()
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, user.Version))
 	if status != http.StatusOK {
 		ctx := context.WithValue(r.Context(), render.StatusCtxKey, status)
 		render.JSON(w, r.WithContext(ctx), user)
@@ -53,6 +66,10 @@ func renderUser(w http.ResponseWriter, r *http.Request, username string, status
 func addUser(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	var user dataprovider.User
+	// the default filesystem, if any, is overridden by the filesystem in the request
+	if fs, ok := dataprovider.GetDefaultFilesystem(); ok {
+		user.FsConfig = fs
+	}
 	err := render.DecodeJSON(r.Body, &user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
@@ -130,6 +147,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	currentCryptoPassphrase := user.FsConfig.CryptConfig.Passphrase
 	currentSFTPPassword := user.FsConfig.SFTPConfig.Password
 	currentSFTPKey := user.FsConfig.SFTPConfig.PrivateKey
+	currentProtocolFilesystems := user.ProtocolFilesystems
 
 	user.Permissions = make(map[string][]string)
 	user.FsConfig.S3Config = vfs.S3FsConfig{}
@@ -138,6 +156,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
 	user.VirtualFolders = nil
+	user.ProtocolFilesystems = nil
 	err = render.DecodeJSON(r.Body, &user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
@@ -145,6 +164,12 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user.ID = userID
 	user.Username = username
+	// optimistic concurrency is opt-in, the expected version is read from the If-Match header
+	user.Version, err = getExpectedVersion(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
 	user.SetEmptySecretsIfNil()
 	// we use new Permissions if passed otherwise the old ones
 	if len(user.Permissions) == 0 {
@@ -152,6 +177,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 	updateEncryptedSecrets(&user.FsConfig, currentS3AccessSecret, currentAzAccountKey, currentAzSASUrl,
 		currentGCSCredentials, currentCryptoPassphrase, currentSFTPPassword, currentSFTPKey)
+	updateProtocolFilesystemsSecrets(&user, currentProtocolFilesystems)
 	err = dataprovider.UpdateUser(&user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -163,6 +189,46 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func getUserMetadata(w http.ResponseWriter, r *http.Request) {
+	username := getURLParam(r, "username")
+	metadata, err := dataprovider.GetUserMetadata(username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, metadata)
+}
+
+// getExpectedVersion returns the version set in the If-Match header or 0 if the header is not set
+func getExpectedVersion(r *http.Request) (int64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		return 0, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(ifMatch, `"`), 10, 64)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid If-Match header %#v", ifMatch)
+	}
+	return version, nil
+}
+
+func updateUserMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	username := getURLParam(r, "username")
+	var metadata map[string]string
+	err := render.DecodeJSON(r.Body, &metadata)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.SetUserMetadata(username, metadata)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, err, "User metadata updated", http.StatusOK)
+}
+
 func deleteUser(w http.ResponseWriter, r *http.Request) {
 	username := getURLParam(r, "username")
 	err := dataprovider.DeleteUser(username)
@@ -174,10 +240,44 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 	disconnectUser(username)
 }
 
+func getUserConnections(w http.ResponseWriter, r *http.Request) {
+	username := getURLParam(r, "username")
+	render.JSON(w, r, common.Connections.GetUserStats(username))
+}
+
+func closeUserConnections(w http.ResponseWriter, r *http.Request) {
+	claims, err := getTokenClaims(r)
+	if err != nil || claims.Username == "" {
+		sendAPIResponse(w, r, err, "Invalid token claims", http.StatusBadRequest)
+		return
+	}
+	username := getURLParam(r, "username")
+	numClosed := common.Connections.CloseUserConnections(username)
+	logger.Info(logSender, "", "admin %#v requested to close all the connections for user %#v, closed connections: %v",
+		claims.Username, username, numClosed)
+	if numClosed == 0 {
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return
+	}
+	sendAPIResponse(w, r, nil, fmt.Sprintf("%v connections closed", numClosed), http.StatusOK)
+}
+
 func disconnectUser(username string) {
-	for _, stat := range common.Connections.GetStats() {
-		if stat.Username == username {
-			common.Connections.Close(stat.ConnectionID)
+	common.Connections.CloseUserConnections(username)
+}
+
+// updateProtocolFilesystemsSecrets keeps the stored secrets, for the same protocol,
+// if the updated protocol filesystems have redacted secrets
+func updateProtocolFilesystemsSecrets(user *dataprovider.User, currentFilesystems []dataprovider.ProtocolFilesystem) {
+	for idx := range user.ProtocolFilesystems {
+		p := &user.ProtocolFilesystems[idx]
+		for _, current := range currentFilesystems {
+			if current.Protocol != p.Protocol {
+				continue
+			}
+			updateEncryptedSecrets(&p.FsConfig, current.FsConfig.S3Config.AccessSecret, current.FsConfig.AzBlobConfig.AccountKey,
+				current.FsConfig.AzBlobConfig.SASURL, current.FsConfig.GCSConfig.Credentials, current.FsConfig.CryptConfig.Passphrase,
+				current.FsConfig.SFTPConfig.Password, current.FsConfig.SFTPConfig.PrivateKey)
 		}
 	}
 }
@@ -51,6 +51,9 @@ func getRespStatus(err error) int {
 	if _, ok := err.(*util.RecordNotFoundError); ok {
 		return http.StatusNotFound
 	}
+	if _, ok := err.(*util.ConflictError); ok {
+		return http.StatusConflict
+	}
 	if os.IsNotExist(err) {
 		return http.StatusBadRequest
 	}
@@ -64,6 +67,8 @@ func getMappedStatusCode(err error) int {
 		statusCode = http.StatusForbidden
 	case os.ErrNotExist:
 		statusCode = http.StatusNotFound
+	case common.ErrDownloadChanged:
+		statusCode = http.StatusPreconditionFailed
 	default:
 		statusCode = http.StatusInternalServerError
 	}
@@ -192,8 +197,9 @@ func getZipEntryName(entryPath, baseDir string) string {
 
 func downloadFile(w http.ResponseWriter, r *http.Request, connection *Connection, name string, info os.FileInfo) (int, error) {
 	var err error
+	etag := fmt.Sprintf("%q", common.NewDownloadValidator(info).String())
 	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" && checkIfRange(r, info.ModTime()) == condFalse {
+	if rangeHeader != "" && checkIfRange(r, info.ModTime(), etag) == condFalse {
 		rangeHeader = ""
 	}
 	offset := int64(0)
@@ -209,13 +215,20 @@ func downloadFile(w http.ResponseWriter, r *http.Request, connection *Connection
 		}
 		responseStatus = http.StatusPartialContent
 	}
-	reader, err := connection.getFileReader(name, offset, r.Method)
+	var reader io.ReadCloser
+	// the ETag returned by a previous download allows to safely resume it
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" && r.Method == http.MethodGet {
+		reader, err = connection.getResumedFileReader(name, offset, ifMatch)
+	} else {
+		reader, err = connection.getFileReader(name, offset, r.Method)
+	}
 	if err != nil {
 		return getMappedStatusCode(err), fmt.Errorf("unable to read file %#v: %v", name, err)
 	}
 	defer reader.Close()
 
 	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag)
 	if checkPreconditions(w, r, info.ModTime()) {
 		return 0, fmt.Errorf("%v", http.StatusText(http.StatusPreconditionFailed))
 	}
@@ -289,7 +302,7 @@ func checkIfModifiedSince(r *http.Request, modtime time.Time) condResult {
 	return condTrue
 }
 
-func checkIfRange(r *http.Request, modtime time.Time) condResult {
+func checkIfRange(r *http.Request, modtime time.Time, etag string) condResult {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		return condNone
 	}
@@ -297,6 +310,12 @@ func checkIfRange(r *http.Request, modtime time.Time) condResult {
 	if ir == "" {
 		return condNone
 	}
+	if strings.HasPrefix(ir, `"`) {
+		if ir == etag {
+			return condTrue
+		}
+		return condFalse
+	}
 	if modtime.IsZero() {
 		return condFalse
 	}
@@ -369,7 +388,9 @@ func updateLoginMetrics(user *dataprovider.User, ip string, err error) {
 		if _, ok := err.(*util.RecordNotFoundError); ok {
 			event = common.HostEventUserNotFound
 		}
-		common.AddDefenderEvent(ip, event)
+		common.AddDefenderEvent(ip, common.ProtocolHTTP, event)
+	} else if err == nil {
+		common.AddDefenderLoginSuccess(ip)
 	}
 	metric.AddLoginResult(dataprovider.LoginMethodPassword, err)
 	dataprovider.ExecutePostLoginHook(user, dataprovider.LoginMethodPassword, ip, common.ProtocolHTTP, err)
@@ -380,6 +401,12 @@ func checkHTTPClientUser(user *dataprovider.User, r *http.Request, connectionID
 		logger.Debug(logSender, connectionID, "cannot login user %#v, protocol HTTP is not allowed", user.Username)
 		return fmt.Errorf("protocol HTTP is not allowed for user %#v", user.Username)
 	}
+	// HTTP bindings have no security profile
+	if !user.IsSecurityProfileAllowed("") {
+		logger.Debug(logSender, connectionID, "cannot login user %#v, restricted to security profiles %v",
+			user.Username, user.Filters.SecurityProfiles)
+		return fmt.Errorf("user %#v is restricted to security profiles %v", user.Username, user.Filters.SecurityProfiles)
+	}
 	if !user.IsLoginMethodAllowed(dataprovider.LoginMethodPassword, nil) {
 		logger.Debug(logSender, connectionID, "cannot login user %#v, password login method is not allowed", user.Username)
 		return fmt.Errorf("login method password is not allowed for user %#v", user.Username)
@@ -28,6 +28,7 @@ func newHTTPDFile(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 		reader = baseTransfer.File
 	} else if pipeWriter != nil {
 		writer = pipeWriter
+		baseTransfer.SetPipeWriter(pipeWriter)
 	} else if pipeReader != nil {
 		reader = pipeReader
 	}
@@ -46,6 +47,10 @@ func (f *httpdFile) Read(p []byte) (n int, err error) {
 	}
 
 	f.Connection.UpdateLastActivity()
+	if err = f.AcquireTransferSlot(); err != nil {
+		f.TransferError(err)
+		return 0, err
+	}
 
 	n, err = f.reader.Read(p)
 	atomic.AddInt64(&f.BytesSent, int64(n))
@@ -65,6 +70,10 @@ func (f *httpdFile) Write(p []byte) (n int, err error) {
 	}
 
 	f.Connection.UpdateLastActivity()
+	if err = f.AcquireTransferSlot(); err != nil {
+		f.TransferError(err)
+		return 0, err
+	}
 
 	n, err = f.writer.Write(p)
 	atomic.AddInt64(&f.BytesReceived, int64(n))
@@ -72,6 +81,9 @@ func (f *httpdFile) Write(p []byte) (n int, err error) {
 	if f.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&f.BytesReceived) > f.MaxWriteSize {
 		err = common.ErrQuotaExceeded
 	}
+	if err == nil {
+		err = f.ReserveQuota()
+	}
 	if err != nil {
 		f.TransferError(err)
 		return
@@ -116,6 +116,28 @@ func (c *Connection) getFileReader(name string, offset int64, method string) (io
 	return newHTTPDFile(baseTransfer, nil, r), nil
 }
 
+// getResumedFileReader returns a reader starting at offset if the file still
+// matches the given ETag, common.ErrDownloadChanged is returned otherwise
+func (c *Connection) getResumedFileReader(name string, offset int64, etag string) (io.ReadCloser, error) {
+	c.UpdateLastActivity()
+
+	etag = strings.TrimSpace(etag)
+	if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 2 {
+		// weak or invalid validators
+		return nil, common.ErrDownloadChanged
+	}
+	validator, err := common.ParseDownloadValidator(etag[1 : len(etag)-1])
+	if err != nil {
+		c.Log(logger.LevelDebug, "unable to resume download for %#v: %v", name, err)
+		return nil, common.ErrDownloadChanged
+	}
+	baseTransfer, r, err := c.ResumeDownload(name, offset, validator)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPDFile(baseTransfer, nil, r), nil
+}
+
 func (c *Connection) getFileWriter(name string) (io.WriteCloser, error) {
 	c.UpdateLastActivity()
 
@@ -152,6 +174,21 @@ func (c *Connection) getFileWriter(name string) (io.WriteCloser, error) {
 		return nil, c.GetOpUnsupportedError()
 	}
 
+	fsPath, virtualPath, err := c.HandleUploadCollision(fs, p, name, false)
+	if err != nil {
+		return nil, err
+	}
+	if virtualPath != name {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualPath)) {
+			return nil, c.GetPermissionDeniedError()
+		}
+		filePath = fsPath
+		if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+			filePath = fs.GetAtomicUploadPath(fsPath)
+		}
+		return c.handleUploadFile(fs, fsPath, filePath, virtualPath, true, 0)
+	}
+
 	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(name)) {
 		return nil, c.GetPermissionDeniedError()
 	}
@@ -379,10 +379,28 @@ func TestBasicUserHandling(t *testing.T) {
 	user.Filters.TLSUsername = sdk.TLSUsernameCN
 	user.Filters.WebClient = append(user.Filters.WebClient, sdk.WebClientPubKeyChangeDisabled,
 		sdk.WebClientWriteDisabled)
+	user.Filters.SetstatMode = sdk.SetstatModeIgnoreCloud
+	user.Filters.HomeSkeleton = []string{"/inbox", "/outbox"}
+	user.Filters.SecurityProfiles = []string{"strong"}
+	user.Filters.UploadCollisionPolicy = sdk.UploadCollisionAutoSuffix
+	user.Filters.DirListingSort = sdk.DirListingSortNameInsensitive
+	user.Filters.HiddenPatterns = []string{".*", "*.tmp"}
+	user.Filters.TLSCertRequired = true
+	user.Filters.TLSCertFingerprints = []string{
+		"3A:6C:5D:0E:8B:84:AB:4E:76:3F:8E:5A:21:54:20:C6:EE:6D:66:8D:90:93:80:2C:2C:6E:0F:8F:B4:55:7C:7D",
+	}
+	user.Filters.Banner = "Authorized access only"
+	user.Filters.SingleSessionPolicy = sdk.SingleSessionEvict
+	user.Filters.TextMode = sdk.TextModeFilter{
+		Extensions: []string{".txt", ".csv"},
+		Upload:     sdk.LineEndingLF,
+		Download:   sdk.LineEndingCRLF,
+	}
 	originalUser := user
 	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
 	assert.NoError(t, err)
 	assert.Equal(t, originalUser.ID, user.ID)
+	assert.Equal(t, sdk.SetstatModeIgnoreCloud, user.Filters.SetstatMode)
 
 	user, _, err = httpdtest.GetUserByUsername(defaultUsername, http.StatusOK)
 	assert.NoError(t, err)
@@ -390,6 +408,217 @@ func TestBasicUserHandling(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUserMetadata(t *testing.T) {
+	u := getTestUser()
+	u.Metadata = map[string]string{
+		"department":  "sales",
+		"cost_center": "42",
+	}
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	assert.Equal(t, u.Metadata, user.Metadata)
+	u1 := getTestUser()
+	u1.Username = defaultUsername + "1"
+	u1.Metadata = map[string]string{
+		"department": "support",
+	}
+	user1, resp, err := httpdtest.AddUser(u1, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+
+	users, _, err := httpdtest.GetUsersByMetadata("department", "", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	users, _, err = httpdtest.GetUsersByMetadata("department", "sales", http.StatusOK)
+	assert.NoError(t, err)
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, user.Username, users[0].Username)
+	}
+	users, _, err = httpdtest.GetUsersByMetadata("cost_center", "", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	users, _, err = httpdtest.GetUsersByMetadata("missing", "", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, users, 0)
+	// updating the user without metadata must not change the existing ones
+	user.Metadata = nil
+	user.AdditionalInfo = "info"
+	_, resp, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(resp))
+	metadata, _, err := httpdtest.GetUserMetadata(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, u.Metadata, metadata)
+
+	resp, err = httpdtest.UpdateUserMetadata(user.Username, map[string]string{"department": "support"}, http.StatusOK)
+	assert.NoError(t, err, string(resp))
+	users, _, err = httpdtest.GetUsersByMetadata("department", "support", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	users, _, err = httpdtest.GetUsersByMetadata("cost_center", "", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, users, 0)
+	// metadata must be included in dumps and restored
+	response, _, err := httpdtest.Dumpdata("", "1", "0", http.StatusOK)
+	assert.NoError(t, err)
+	backupData, err := json.Marshal(response)
+	assert.NoError(t, err)
+	var dump dataprovider.BackupData
+	err = json.Unmarshal(backupData, &dump)
+	assert.NoError(t, err)
+	found := false
+	for _, u := range dump.Users {
+		if u.Username == user.Username {
+			found = true
+			assert.Equal(t, map[string]string{"department": "support"}, u.Metadata)
+		}
+	}
+	assert.True(t, found)
+	resp, err = httpdtest.UpdateUserMetadata(user.Username, map[string]string{"cost_center": "1"}, http.StatusOK)
+	assert.NoError(t, err, string(resp))
+	_, resp, err = httpdtest.LoaddataFromPostBody(backupData, "0", "0", http.StatusOK)
+	assert.NoError(t, err, string(resp))
+	metadata, _, err = httpdtest.GetUserMetadata(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"department": "support"}, metadata)
+
+	resp, err = httpdtest.UpdateUserMetadata(user.Username, map[string]string{"": "value"}, http.StatusBadRequest)
+	assert.NoError(t, err, string(resp))
+	resp, err = httpdtest.UpdateUserMetadata(user.Username, map[string]string{"key": strings.Repeat("a", 513)},
+		http.StatusBadRequest)
+	assert.NoError(t, err, string(resp))
+	_, err = httpdtest.UpdateUserMetadata("missing user", map[string]string{"key": "value"}, http.StatusNotFound)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetUserMetadata("missing user", http.StatusNotFound)
+	assert.NoError(t, err)
+
+	resp, err = httpdtest.UpdateUserMetadata(user.Username, map[string]string{}, http.StatusOK)
+	assert.NoError(t, err, string(resp))
+	metadata, _, err = httpdtest.GetUserMetadata(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, metadata, 0)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user1, http.StatusOK)
+	assert.NoError(t, err)
+	// metadata must be removed together with the user
+	users, _, err = httpdtest.GetUsersByMetadata("department", "", http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, users, 0)
+}
+
+func TestRenameUser(t *testing.T) {
+	folderName := "vfolder_rename"
+	u := getTestUser()
+	u.Metadata = map[string]string{
+		"department": "sales",
+	}
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderName,
+			MappedPath: filepath.Join(os.TempDir(), folderName),
+		},
+		VirtualPath: "/vdir",
+	})
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	err = dataprovider.UpdateUserQuota(&user, 2, 100, true)
+	assert.NoError(t, err)
+	err = dataprovider.UpdateLastLogin(&user)
+	assert.NoError(t, err)
+	u1 := getTestUser()
+	u1.Username = defaultUsername + "1"
+	user1, resp, err := httpdtest.AddUser(u1, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	// the new username is already in use
+	err = dataprovider.RenameUser(user.Username, user1.Username)
+	if assert.Error(t, err) {
+		assert.IsType(t, &util.ValidationError{}, err)
+	}
+	err = dataprovider.RenameUser(user.Username, "invalid user")
+	if assert.Error(t, err) {
+		assert.IsType(t, &util.ValidationError{}, err)
+	}
+	err = dataprovider.RenameUser(user.Username, user.Username)
+	assert.Error(t, err)
+	err = dataprovider.RenameUser("missing_user", "renamed_user")
+	if assert.Error(t, err) {
+		assert.IsType(t, &util.RecordNotFoundError{}, err)
+	}
+
+	newUsername := defaultUsername + "_renamed"
+	err = dataprovider.RenameUser(user.Username, newUsername)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusNotFound)
+	assert.NoError(t, err)
+	renamedUser, _, err := httpdtest.GetUserByUsername(newUsername, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, renamedUser.ID)
+	assert.Equal(t, 2, renamedUser.UsedQuotaFiles)
+	assert.Equal(t, int64(100), renamedUser.UsedQuotaSize)
+	assert.Greater(t, renamedUser.LastLogin, int64(0))
+	if assert.Len(t, renamedUser.VirtualFolders, 1) {
+		assert.Equal(t, folderName, renamedUser.VirtualFolders[0].Name)
+		assert.Equal(t, "/vdir", renamedUser.VirtualFolders[0].VirtualPath)
+	}
+	folder, _, err := httpdtest.GetFolderByName(folderName, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{newUsername}, folder.Users)
+	metadata, _, err := httpdtest.GetUserMetadata(newUsername, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, u.Metadata, metadata)
+	// the old username can be reused now
+	err = dataprovider.RenameUser(user1.Username, user.Username)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(renamedUser, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: folderName}, http.StatusOK)
+	assert.NoError(t, err)
+}
+
+func TestRenameUserEncryptedFs(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = sdk.CryptedFilesystemProvider
+	u.FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("crypt passphrase")
+	u.ProtocolFilesystems = []dataprovider.ProtocolFilesystem{
+		{
+			Protocol: common.ProtocolWebDAV,
+			HomeDir:  filepath.Join(homeBasePath, "dav_rename"),
+			FsConfig: vfs.Filesystem{
+				Provider: sdk.CryptedFilesystemProvider,
+			},
+		},
+	}
+	u.ProtocolFilesystems[0].FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("dav passphrase")
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+
+	newUsername := defaultUsername + "_crypt_renamed"
+	err = dataprovider.RenameUser(user.Username, newUsername)
+	assert.NoError(t, err)
+	renamedUser, err := dataprovider.UserExists(newUsername)
+	assert.NoError(t, err)
+	assert.Equal(t, kms.SecretStatusSecretBox, renamedUser.FsConfig.CryptConfig.Passphrase.GetStatus())
+	assert.Equal(t, newUsername, renamedUser.FsConfig.CryptConfig.Passphrase.GetAdditionalData())
+	err = renamedUser.FsConfig.DecryptSecrets()
+	assert.NoError(t, err)
+	assert.Equal(t, "crypt passphrase", renamedUser.FsConfig.CryptConfig.Passphrase.GetPayload())
+	if assert.Len(t, renamedUser.ProtocolFilesystems, 1) {
+		fsConfig := renamedUser.ProtocolFilesystems[0].FsConfig
+		assert.Equal(t, newUsername, fsConfig.CryptConfig.Passphrase.GetAdditionalData())
+		err = fsConfig.DecryptSecrets()
+		assert.NoError(t, err)
+		assert.Equal(t, "dav passphrase", fsConfig.CryptConfig.Passphrase.GetPayload())
+	}
+
+	_, err = httpdtest.RemoveUser(renamedUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(renamedUser.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestHTTPUserAuthentication(t *testing.T) {
 	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
 	assert.NoError(t, err)
@@ -968,6 +1197,127 @@ func TestAddUserInvalidFilters(t *testing.T) {
 	u.Filters.WebClient = []string{"not a valid web client options"}
 	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
+	u.Filters.WebClient = nil
+	u.Filters.SetstatMode = "invalid"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.SetstatMode = ""
+	u.Filters.HomeSkeleton = []string{"relative/path"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.HomeSkeleton = []string{"/inbox", "/"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.HomeSkeleton = nil
+	u.Filters.SecurityProfiles = []string{" "}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.SecurityProfiles = nil
+	u.Filters.UploadCollisionPolicy = "rename"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.UploadCollisionPolicy = ""
+	u.Filters.DirListingSort = "random"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.DirListingSort = ""
+	u.Filters.HiddenPatterns = []string{"[-]"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.HiddenPatterns = []string{"dir/*"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.HiddenPatterns = nil
+	u.Filters.TLSCertFingerprints = []string{"not hex"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TLSCertFingerprints = []string{"3a6c5d0e"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TLSCertFingerprints = nil
+	u.Filters.SingleSessionPolicy = "invalid"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.SingleSessionPolicy = ""
+	u.Filters.TextMode.Upload = sdk.LineEndingLF
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TextMode.Extensions = []string{"txt"}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TextMode.Extensions = []string{".txt"}
+	u.Filters.TextMode.Download = "invalid"
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.TextMode = sdk.TextModeFilter{}
+	u.Filters.BandwidthSchedules = []sdk.BandwidthSchedule{
+		{
+			From: "9:00",
+			To:   "25:00",
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.BandwidthSchedules = []sdk.BandwidthSchedule{
+		{
+			From: "18:00",
+			To:   "09:00",
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.BandwidthSchedules = []sdk.BandwidthSchedule{
+		{
+			From:            "09:00",
+			To:              "18:00",
+			UploadBandwidth: -1,
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.BandwidthSchedules = []sdk.BandwidthSchedule{
+		{
+			From: "09:00",
+			To:   "18:00",
+		},
+		{
+			From: "17:30",
+			To:   "24:00",
+		},
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+}
+
+func TestUserBandwidthSchedules(t *testing.T) {
+	u := getTestUser()
+	u.UploadBandwidth = 1024
+	u.Filters.BandwidthSchedules = []sdk.BandwidthSchedule{
+		{
+			From:              "9:00",
+			To:                "18:00",
+			UploadBandwidth:   128,
+			DownloadBandwidth: 256,
+		},
+		{
+			From:            "18:00",
+			To:              "24:00",
+			UploadBandwidth: 512,
+		},
+	}
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	if assert.Len(t, user.Filters.BandwidthSchedules, 2) {
+		assert.Equal(t, "09:00", user.Filters.BandwidthSchedules[0].From)
+		assert.Equal(t, "24:00", user.Filters.BandwidthSchedules[1].To)
+	}
+	user.Filters.BandwidthSchedules = user.Filters.BandwidthSchedules[:1]
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Len(t, user.Filters.BandwidthSchedules, 1)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
 }
 
 func TestAddUserInvalidFsConfig(t *testing.T) {
@@ -1111,6 +1461,145 @@ func TestAddUserInvalidFsConfig(t *testing.T) {
 	}
 }
 
+func TestFilesystemConfigValidation(t *testing.T) {
+	testCases := []struct {
+		provider sdk.FilesystemProvider
+		valid    func(*vfs.Filesystem)
+		invalid  func(*vfs.Filesystem)
+		errMsg   string
+	}{
+		{
+			provider: sdk.LocalFilesystemProvider,
+			valid:    func(fs *vfs.Filesystem) {},
+			invalid: func(fs *vfs.Filesystem) {
+				fs.OSConfig.ReadReplicas = []string{"relative"}
+			},
+			errMsg: "could not validate osconfig",
+		},
+		{
+			provider: sdk.S3FilesystemProvider,
+			valid: func(fs *vfs.Filesystem) {
+				fs.S3Config.Bucket = "testbucket"
+				fs.S3Config.Region = "us-east-1"
+				fs.S3Config.AccessKey = "access-key"
+				fs.S3Config.AccessSecret = kms.NewPlainSecret("access-secret")
+			},
+			invalid: func(fs *vfs.Filesystem) {
+				fs.S3Config.Region = "us-east-1"
+			},
+			errMsg: "could not validate s3config",
+		},
+		{
+			provider: sdk.GCSFilesystemProvider,
+			valid: func(fs *vfs.Filesystem) {
+				fs.GCSConfig.Bucket = "testbucket"
+				fs.GCSConfig.AutomaticCredentials = 1
+			},
+			invalid: func(fs *vfs.Filesystem) {
+				fs.GCSConfig.AutomaticCredentials = 1
+			},
+			errMsg: "could not validate GCS config",
+		},
+		{
+			provider: sdk.AzureBlobFilesystemProvider,
+			valid: func(fs *vfs.Filesystem) {
+				fs.AzBlobConfig.Container = "container"
+				fs.AzBlobConfig.AccountName = "account"
+				fs.AzBlobConfig.AccountKey = kms.NewPlainSecret("key")
+			},
+			invalid: func(fs *vfs.Filesystem) {
+				fs.AzBlobConfig.AccountName = "account"
+			},
+			errMsg: "could not validate Azure Blob config",
+		},
+		{
+			provider: sdk.CryptedFilesystemProvider,
+			valid: func(fs *vfs.Filesystem) {
+				fs.CryptConfig.Passphrase = kms.NewPlainSecret("passphrase")
+			},
+			invalid: func(fs *vfs.Filesystem) {},
+			errMsg:  "could not validate Crypt fs config",
+		},
+		{
+			provider: sdk.SFTPFilesystemProvider,
+			valid: func(fs *vfs.Filesystem) {
+				fs.SFTPConfig.Endpoint = "127.0.0.1:2222"
+				fs.SFTPConfig.Username = "sftp_user"
+				fs.SFTPConfig.Password = kms.NewPlainSecret("sftp_pwd")
+			},
+			invalid: func(fs *vfs.Filesystem) {
+				fs.SFTPConfig.Username = "sftp_user"
+				fs.SFTPConfig.Password = kms.NewPlainSecret("sftp_pwd")
+			},
+			errMsg: "could not validate SFTP fs config",
+		},
+	}
+	for _, tc := range testCases {
+		u := getTestUser()
+		u.FsConfig = vfs.Filesystem{Provider: tc.provider}
+		tc.invalid(&u.FsConfig)
+		_, resp, err := httpdtest.AddUser(u, http.StatusBadRequest)
+		if assert.NoError(t, err, tc.provider.Name()) {
+			assert.Contains(t, string(resp), tc.errMsg, tc.provider.Name())
+		}
+		folder := vfs.BaseVirtualFolder{
+			Name:       "fs_validation_folder",
+			MappedPath: filepath.Join(os.TempDir(), "fs_validation_folder"),
+			FsConfig:   vfs.Filesystem{Provider: tc.provider},
+		}
+		tc.invalid(&folder.FsConfig)
+		_, resp, err = httpdtest.AddFolder(folder, http.StatusBadRequest)
+		if assert.NoError(t, err, tc.provider.Name()) {
+			assert.Contains(t, string(resp), tc.errMsg, tc.provider.Name())
+		}
+
+		u.FsConfig = vfs.Filesystem{Provider: tc.provider}
+		tc.valid(&u.FsConfig)
+		user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+		if assert.NoError(t, err, tc.provider.Name()) {
+			assert.Equal(t, tc.provider, user.FsConfig.Provider)
+			_, err = httpdtest.RemoveUser(user, http.StatusOK)
+			assert.NoError(t, err)
+		}
+		folder.FsConfig = vfs.Filesystem{Provider: tc.provider}
+		tc.valid(&folder.FsConfig)
+		f, _, err := httpdtest.AddFolder(folder, http.StatusCreated)
+		if assert.NoError(t, err, tc.provider.Name()) {
+			assert.Equal(t, tc.provider, f.FsConfig.Provider)
+			_, err = httpdtest.RemoveFolder(f, http.StatusOK)
+			assert.NoError(t, err)
+		}
+	}
+	// unknown providers are rejected and not saved as local filesystems
+	u := getTestUser()
+	u.FsConfig.Provider = sdk.FilesystemProvider(100)
+	_, resp, err := httpdtest.AddUser(u, http.StatusBadRequest)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(resp), "unsupported filesystem provider")
+	}
+	folder := vfs.BaseVirtualFolder{
+		Name:       "fs_validation_folder",
+		MappedPath: filepath.Join(os.TempDir(), "fs_validation_folder"),
+		FsConfig:   vfs.Filesystem{Provider: sdk.FilesystemProvider(-1)},
+	}
+	_, resp, err = httpdtest.AddFolder(folder, http.StatusBadRequest)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(resp), "unsupported filesystem provider")
+	}
+	u.FsConfig.Provider = sdk.LocalFilesystemProvider
+	u.ProtocolFilesystems = []dataprovider.ProtocolFilesystem{
+		{
+			Protocol: "FTP",
+			HomeDir:  filepath.Join(os.TempDir(), "ftp_home"),
+			FsConfig: vfs.Filesystem{Provider: sdk.FilesystemProvider(100)},
+		},
+	}
+	_, resp, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(resp), "unsupported filesystem provider")
+	}
+}
+
 func TestUserRedactedPassword(t *testing.T) {
 	u := getTestUser()
 	u.FsConfig.Provider = sdk.S3FilesystemProvider
@@ -1356,6 +1845,9 @@ func TestUpdateUserEmptyPassword(t *testing.T) {
 	assert.NoError(t, err)
 	userNoPwd, _, err := httpdtest.UpdateUserWithJSON(user, http.StatusOK, "", asJSON)
 	assert.NoError(t, err)
+	// the version is incremented on each update
+	assert.Equal(t, user.Version+1, userNoPwd.Version)
+	user.Version = userNoPwd.Version
 	assert.Equal(t, user, userNoPwd) // the password is hidden so the user must be equal
 	// check the password within the data provider
 	dbUser, err = dataprovider.UserExists(u.Username)
@@ -1977,6 +2469,97 @@ func TestUserCryptFs(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUserProtocolFilesystems(t *testing.T) {
+	davHomeDir := filepath.Join(homeBasePath, "dav_home")
+	u := getTestUser()
+	u.ProtocolFilesystems = []dataprovider.ProtocolFilesystem{
+		{
+			Protocol: "SFTP",
+			HomeDir:  davHomeDir,
+		},
+	}
+	_, resp, err := httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "invalid protocol filesystem protocol")
+	u.ProtocolFilesystems[0].Protocol = common.ProtocolWebDAV
+	u.ProtocolFilesystems[0].HomeDir = "relative"
+	_, resp, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "must be an absolute path")
+	u.ProtocolFilesystems[0].HomeDir = davHomeDir
+	u.ProtocolFilesystems[0].FsConfig.Provider = sdk.GCSFilesystemProvider
+	u.ProtocolFilesystems[0].FsConfig.GCSConfig.Bucket = "bucket"
+	u.ProtocolFilesystems[0].FsConfig.GCSConfig.AutomaticCredentials = 1
+	_, resp, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "GCS is not supported")
+	// each protocol filesystem is validated independently
+	u.ProtocolFilesystems[0].FsConfig = vfs.Filesystem{
+		Provider: sdk.CryptedFilesystemProvider,
+	}
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.ProtocolFilesystems[0].FsConfig.CryptConfig.Passphrase = kms.NewPlainSecret("dav passphrase")
+	u.ProtocolFilesystems = append(u.ProtocolFilesystems, dataprovider.ProtocolFilesystem{
+		Protocol: common.ProtocolWebDAV,
+		HomeDir:  davHomeDir,
+	})
+	_, resp, err = httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "duplicated filesystem")
+	u.ProtocolFilesystems[1].Protocol = common.ProtocolFTP
+	u.ProtocolFilesystems[1].HomeDir = filepath.Join(homeBasePath, "ftp_home") + "/"
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	if assert.Len(t, user.ProtocolFilesystems, 2) {
+		assert.Equal(t, filepath.Join(homeBasePath, "ftp_home"), user.ProtocolFilesystems[1].HomeDir)
+		assert.Equal(t, sdk.LocalFilesystemProvider, user.ProtocolFilesystems[1].FsConfig.Provider)
+		secret := user.ProtocolFilesystems[0].FsConfig.CryptConfig.Passphrase
+		assert.Equal(t, kms.SecretStatusSecretBox, secret.GetStatus())
+		assert.NotEmpty(t, secret.GetPayload())
+		assert.Empty(t, secret.GetAdditionalData())
+		assert.Empty(t, secret.GetKey())
+	}
+	// the stored secret is preserved if not modified
+	initialPayload := user.ProtocolFilesystems[0].FsConfig.CryptConfig.Passphrase.GetPayload()
+	user.ProtocolFilesystems[0].FsConfig.CryptConfig.Passphrase.SetKey("fake key")
+	user, resp, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(resp))
+	if assert.Len(t, user.ProtocolFilesystems, 2) {
+		assert.Equal(t, initialPayload, user.ProtocolFilesystems[0].FsConfig.CryptConfig.Passphrase.GetPayload())
+	}
+	// the home directory and the filesystem are resolved based on the login protocol
+	dbUser, err := dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	assert.Equal(t, user.GetHomeDir(), dbUser.GetHomeDir())
+	dbUser.SetLoginProtocol(common.ProtocolWebDAV)
+	assert.Equal(t, davHomeDir, dbUser.GetHomeDir())
+	fs, err := dbUser.GetFilesystem("")
+	if assert.NoError(t, err) {
+		assert.True(t, vfs.IsCryptOsFs(fs))
+	}
+	err = dbUser.CloseFs()
+	assert.NoError(t, err)
+	dbUser, err = dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	dbUser.SetLoginProtocol(common.ProtocolSSH)
+	fs, err = dbUser.GetFilesystem("")
+	if assert.NoError(t, err) {
+		assert.True(t, vfs.IsLocalOsFs(fs))
+		assert.Equal(t, user.GetHomeDir(), dbUser.GetHomeDir())
+	}
+	// protocol filesystems can be removed
+	user.ProtocolFilesystems = nil
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Len(t, user.ProtocolFilesystems, 0)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestUserSFTPFs(t *testing.T) {
 	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
 	assert.NoError(t, err)
@@ -2795,6 +3378,82 @@ func TestUpdateFolderQuotaUsage(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestOrphanedFolders(t *testing.T) {
+	folderNames := []string{"orphaned_vdir1", "orphaned_vdir2", "mapped_vdir"}
+	for _, name := range folderNames {
+		_, _, err := httpdtest.AddFolder(vfs.BaseVirtualFolder{
+			Name:       name,
+			MappedPath: filepath.Join(os.TempDir(), name),
+		}, http.StatusCreated)
+		assert.NoError(t, err)
+	}
+	u := getTestUser()
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			Name:       folderNames[2],
+			MappedPath: filepath.Join(os.TempDir(), folderNames[2]),
+		},
+		VirtualPath: "/vdir",
+	})
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+
+	folders, err := dataprovider.GetOrphanedFolders(100, 0, dataprovider.OrderASC)
+	assert.NoError(t, err)
+	names := make([]string, 0, len(folders))
+	for _, folder := range folders {
+		assert.Len(t, folder.Users, 0)
+		names = append(names, folder.Name)
+	}
+	assert.Contains(t, names, folderNames[0])
+	assert.Contains(t, names, folderNames[1])
+	assert.NotContains(t, names, folderNames[2])
+	// pagination and ordering
+	if assert.Len(t, names, 2) {
+		folders, err = dataprovider.GetOrphanedFolders(1, 0, dataprovider.OrderDESC)
+		assert.NoError(t, err)
+		if assert.Len(t, folders, 1) {
+			assert.Equal(t, folderNames[1], folders[0].Name)
+		}
+		folders, err = dataprovider.GetOrphanedFolders(1, 1, dataprovider.OrderDESC)
+		assert.NoError(t, err)
+		if assert.Len(t, folders, 1) {
+			assert.Equal(t, folderNames[0], folders[0].Name)
+		}
+		folders, err = dataprovider.GetOrphanedFolders(1, 2, dataprovider.OrderDESC)
+		assert.NoError(t, err)
+		assert.Len(t, folders, 0)
+	}
+
+	deleted, err := dataprovider.DeleteOrphanedFolders()
+	assert.NoError(t, err)
+	assert.Contains(t, deleted, folderNames[0])
+	assert.Contains(t, deleted, folderNames[1])
+	assert.NotContains(t, deleted, folderNames[2])
+	_, _, err = httpdtest.GetFolderByName(folderNames[0], http.StatusNotFound)
+	assert.NoError(t, err)
+	_, _, err = httpdtest.GetFolderByName(folderNames[1], http.StatusNotFound)
+	assert.NoError(t, err)
+	folder, _, err := httpdtest.GetFolderByName(folderNames[2], http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{user.Username}, folder.Users)
+	// once the user is removed the folder becomes orphaned
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	folders, err = dataprovider.GetOrphanedFolders(100, 0, dataprovider.OrderASC)
+	assert.NoError(t, err)
+	if assert.Len(t, folders, 1) {
+		assert.Equal(t, folderNames[2], folders[0].Name)
+	}
+	deleted, err = dataprovider.DeleteOrphanedFolders()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{folderNames[2]}, deleted)
+	_, _, err = httpdtest.GetFolderByName(folderNames[2], http.StatusNotFound)
+	assert.NoError(t, err)
+}
+
 func TestGetVersion(t *testing.T) {
 	_, _, err := httpdtest.GetVersion(http.StatusOK)
 	assert.NoError(t, err)
@@ -2830,6 +3489,39 @@ func TestCloseActiveConnection(t *testing.T) {
 	assert.Len(t, common.Connections.GetStats(), 0)
 }
 
+func TestCloseUserConnections(t *testing.T) {
+	_, err := httpdtest.CloseUserConnections(defaultUsername, http.StatusNotFound)
+	assert.NoError(t, err)
+	user := getTestUser()
+	user1 := getTestUser()
+	user1.Username = defaultUsername + "1"
+	c := common.NewBaseConnection("connID", common.ProtocolSFTP, "", "", user)
+	c1 := common.NewBaseConnection("connID1", common.ProtocolFTP, "", "", user)
+	c2 := common.NewBaseConnection("connID2", common.ProtocolWebDAV, "", "", user1)
+	for _, conn := range []*common.BaseConnection{c, c1, c2} {
+		common.Connections.Add(&fakeConnection{
+			BaseConnection: conn,
+		})
+	}
+	connections, _, err := httpdtest.GetUserConnections(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, connections, 2)
+	for _, conn := range connections {
+		assert.Equal(t, user.Username, conn.Username)
+	}
+	_, err = httpdtest.CloseUserConnections(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	connections, _, err = httpdtest.GetUserConnections(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, connections, 0)
+	connections, _, err = httpdtest.GetUserConnections(user1.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, connections, 1)
+	_, err = httpdtest.CloseUserConnections(user1.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, common.Connections.GetStats(), 0)
+}
+
 func TestCloseConnectionAfterUserUpdateDelete(t *testing.T) {
 	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
 	assert.NoError(t, err)
@@ -2848,62 +3540,259 @@ func TestCloseConnectionAfterUserUpdateDelete(t *testing.T) {
 	assert.Len(t, common.Connections.GetStats(), 2)
 	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "1")
 	assert.NoError(t, err)
-	assert.Len(t, common.Connections.GetStats(), 0)
+	assert.Len(t, common.Connections.GetStats(), 0)
+
+	common.Connections.Add(fakeConn)
+	common.Connections.Add(fakeConn1)
+	assert.Len(t, common.Connections.GetStats(), 2)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, common.Connections.GetStats(), 0)
+}
+
+func TestSkipNaturalKeysValidation(t *testing.T) {
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.SkipNaturalKeysValidation = true
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	u := getTestUser()
+	u.Username = "user@example.com"
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	user.AdditionalInfo = "info"
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+
+	a := getTestAdmin()
+	a.Username = "admin@example.com"
+	admin, _, err := httpdtest.AddAdmin(a, http.StatusCreated)
+	assert.NoError(t, err)
+	admin.Email = admin.Username
+	admin, _, err = httpdtest.UpdateAdmin(admin, http.StatusOK)
+	assert.NoError(t, err)
+	admin, _, err = httpdtest.GetAdminByUsername(admin.Username, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveAdmin(admin, http.StatusOK)
+	assert.NoError(t, err)
+
+	f := vfs.BaseVirtualFolder{
+		Name:       "文件夹",
+		MappedPath: filepath.Clean(os.TempDir()),
+	}
+	folder, resp, err := httpdtest.AddFolder(f, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	folder.Description = folder.Name
+	folder, resp, err = httpdtest.UpdateFolder(folder, http.StatusOK)
+	assert.NoError(t, err, string(resp))
+	folder, resp, err = httpdtest.GetFolderByName(folder.Name, http.StatusOK)
+	assert.NoError(t, err, string(resp))
+	_, err = httpdtest.RemoveFolder(folder, http.StatusOK)
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	providerConf.CredentialsPath = credentialsPath
+	err = os.RemoveAll(credentialsPath)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+}
+
+func TestUserBaseDir(t *testing.T) {
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.UsersBaseDir = homeBasePath
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+	u := getTestUser()
+	u.HomeDir = ""
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	if assert.Error(t, err) {
+		assert.EqualError(t, err, "home dir mismatch")
+	}
+	assert.Equal(t, filepath.Join(providerConf.UsersBaseDir, u.Username), user.HomeDir)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	providerConf.CredentialsPath = credentialsPath
+	err = os.RemoveAll(credentialsPath)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+}
+
+func TestDefaultFilesystem(t *testing.T) {
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	defaultFsFile := filepath.Join(os.TempDir(), "default_fs.json")
+	providerConf.DefaultFilesystemFile = defaultFsFile
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	err = os.WriteFile(defaultFsFile, []byte("invalid json"), os.ModePerm)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	err = os.WriteFile(defaultFsFile, []byte(`{"provider":4,"cryptconfig":{}}`), os.ModePerm)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	err = os.WriteFile(defaultFsFile, []byte(`{"provider":4,"cryptconfig":{"passphrase":{"status":"Redacted"}}}`),
+		os.ModePerm)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	err = os.WriteFile(defaultFsFile, []byte(`{"provider":4,"cryptconfig":{"passphrase":{"status":"Plain","payload":"defpass"}}}`),
+		os.ModePerm)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	token, err := getJWTAPITokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
+	assert.NoError(t, err)
+	// the default filesystem is applied to a user without an explicit filesystem
+	u := map[string]interface{}{
+		"username":    defaultUsername,
+		"password":    defaultPassword,
+		"home_dir":    filepath.Join(homeBasePath, defaultUsername),
+		"status":      1,
+		"permissions": map[string][]string{"/": {dataprovider.PermAny}},
+	}
+	asJSON, err := json.Marshal(u)
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPost, userPath, bytes.NewBuffer(asJSON))
+	assert.NoError(t, err)
+	setBearerForReq(req, token)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, rr)
+	user, _, err := httpdtest.GetUserByUsername(defaultUsername, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, sdk.CryptedFilesystemProvider, user.FsConfig.Provider)
+	assert.Equal(t, kms.SecretStatusSecretBox, user.FsConfig.CryptConfig.Passphrase.GetStatus())
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	// an explicit filesystem overrides the default one
+	user, _, err = httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, sdk.LocalFilesystemProvider, user.FsConfig.Provider)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	// the same for folders
+	folderName := "default_fs_folder"
+	f := map[string]interface{}{
+		"name":        folderName,
+		"mapped_path": filepath.Join(os.TempDir(), folderName),
+	}
+	asJSON, err = json.Marshal(f)
+	assert.NoError(t, err)
+	req, err = http.NewRequest(http.MethodPost, folderPath, bytes.NewBuffer(asJSON))
+	assert.NoError(t, err)
+	setBearerForReq(req, token)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, rr)
+	folder, _, err := httpdtest.GetFolderByName(folderName, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, sdk.CryptedFilesystemProvider, folder.FsConfig.Provider)
+	_, err = httpdtest.RemoveFolder(folder, http.StatusOK)
+	assert.NoError(t, err)
+	folder, _, err = httpdtest.AddFolder(vfs.BaseVirtualFolder{
+		Name:       folderName,
+		MappedPath: filepath.Join(os.TempDir(), folderName),
+	}, http.StatusCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, sdk.LocalFilesystemProvider, folder.FsConfig.Provider)
+	_, err = httpdtest.RemoveFolder(folder, http.StatusOK)
+	assert.NoError(t, err)
 
-	common.Connections.Add(fakeConn)
-	common.Connections.Add(fakeConn1)
-	assert.Len(t, common.Connections.GetStats(), 2)
-	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	err = os.Remove(defaultFsFile)
+	assert.NoError(t, err)
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	providerConf.CredentialsPath = credentialsPath
+	err = os.RemoveAll(credentialsPath)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
 	assert.NoError(t, err)
-	assert.Len(t, common.Connections.GetStats(), 0)
 }
 
-func TestSkipNaturalKeysValidation(t *testing.T) {
+func TestHomeDirRestrictions(t *testing.T) {
 	err := dataprovider.Close()
 	assert.NoError(t, err)
 	err = config.LoadConfig(configDir, "")
 	assert.NoError(t, err)
 	providerConf := config.GetProviderConf()
-	providerConf.SkipNaturalKeysValidation = true
+	providerConf.AllowedHomeBaseDirs = []string{"relative_dir"}
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	allowedBaseDir := filepath.Join(homeBasePath, "allowed_homes")
+	providerConf.AllowedHomeBaseDirs = []string{allowedBaseDir, allowedBaseDir + string(os.PathSeparator)}
+	providerConf.DenyOverlappingHomeDirs = true
 	err = dataprovider.Initialize(providerConf, configDir, true)
 	assert.NoError(t, err)
 
 	u := getTestUser()
-	u.Username = "user@example.com"
-	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	u.HomeDir = filepath.Join(homeBasePath, "not_allowed", defaultUsername)
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
-	user.AdditionalInfo = "info"
-	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	u.HomeDir = filepath.Join(homeBasePath, "allowed_homes_suffix", defaultUsername)
+	_, _, err = httpdtest.AddUser(u, http.StatusBadRequest)
 	assert.NoError(t, err)
-	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	u.HomeDir = filepath.Join(allowedBaseDir, defaultUsername)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
 	assert.NoError(t, err)
-	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	// updating the same user with the same home dir must work
+	user.AdditionalInfo = "updated info"
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
 	assert.NoError(t, err)
 
-	a := getTestAdmin()
-	a.Username = "admin@example.com"
-	admin, _, err := httpdtest.AddAdmin(a, http.StatusCreated)
+	u1 := getTestUser()
+	u1.Username = altAdminUsername
+	u1.HomeDir = user.HomeDir
+	_, _, err = httpdtest.AddUser(u1, http.StatusBadRequest)
 	assert.NoError(t, err)
-	admin.Email = admin.Username
-	admin, _, err = httpdtest.UpdateAdmin(admin, http.StatusOK)
+	u1.HomeDir = filepath.Join(user.HomeDir, "sub")
+	_, _, err = httpdtest.AddUser(u1, http.StatusBadRequest)
 	assert.NoError(t, err)
-	admin, _, err = httpdtest.GetAdminByUsername(admin.Username, http.StatusOK)
+	u1.HomeDir = allowedBaseDir
+	_, _, err = httpdtest.AddUser(u1, http.StatusBadRequest)
 	assert.NoError(t, err)
-	_, err = httpdtest.RemoveAdmin(admin, http.StatusOK)
+	u1.HomeDir = filepath.Join(allowedBaseDir, u1.Username)
+	user1, _, err := httpdtest.AddUser(u1, http.StatusCreated)
+	assert.NoError(t, err)
+	// the overlap check applies to updates too
+	user1.HomeDir = filepath.Join(user.HomeDir, "sub")
+	_, _, err = httpdtest.UpdateUser(user1, http.StatusBadRequest, "")
 	assert.NoError(t, err)
 
-	f := vfs.BaseVirtualFolder{
-		Name:       "文件夹",
-		MappedPath: filepath.Clean(os.TempDir()),
-	}
-	folder, resp, err := httpdtest.AddFolder(f, http.StatusCreated)
-	assert.NoError(t, err, string(resp))
-	folder.Description = folder.Name
-	folder, resp, err = httpdtest.UpdateFolder(folder, http.StatusOK)
-	assert.NoError(t, err, string(resp))
-	folder, resp, err = httpdtest.GetFolderByName(folder.Name, http.StatusOK)
-	assert.NoError(t, err, string(resp))
-	_, err = httpdtest.RemoveFolder(folder, http.StatusOK)
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpdtest.RemoveUser(user1, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(allowedBaseDir)
 	assert.NoError(t, err)
 
 	err = dataprovider.Close()
@@ -2918,24 +3807,83 @@ func TestSkipNaturalKeysValidation(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestUserBaseDir(t *testing.T) {
+func TestMaxUserVirtualFolders(t *testing.T) {
 	err := dataprovider.Close()
 	assert.NoError(t, err)
 	err = config.LoadConfig(configDir, "")
 	assert.NoError(t, err)
 	providerConf := config.GetProviderConf()
-	providerConf.UsersBaseDir = homeBasePath
+	providerConf.MaxUserVirtualFolders = -1
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	providerConf.MaxUserVirtualFolders = 2
 	err = dataprovider.Initialize(providerConf, configDir, true)
 	assert.NoError(t, err)
-	u := getTestUser()
-	u.HomeDir = ""
-	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
-	if assert.Error(t, err) {
-		assert.EqualError(t, err, "home dir mismatch")
+
+	getFolder := func(idx int) vfs.VirtualFolder {
+		folderName := fmt.Sprintf("vfolder%v", idx)
+		return vfs.VirtualFolder{
+			BaseVirtualFolder: vfs.BaseVirtualFolder{
+				Name:       folderName,
+				MappedPath: filepath.Join(os.TempDir(), folderName),
+			},
+			VirtualPath: fmt.Sprintf("/vdir%v", idx),
+		}
 	}
-	assert.Equal(t, filepath.Join(providerConf.UsersBaseDir, u.Username), user.HomeDir)
+
+	u := getTestUser()
+	u.VirtualFolders = []vfs.VirtualFolder{getFolder(1), getFolder(2), getFolder(3)}
+	_, resp, err := httpdtest.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "too many virtual folders")
+	u.VirtualFolders = u.VirtualFolders[:2]
+	user, resp, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err, string(resp))
+	assert.Len(t, user.VirtualFolders, 2)
+	// the limit applies to updates too and the existing mapping must be preserved
+	user.VirtualFolders = append(user.VirtualFolders, getFolder(3))
+	_, resp, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "too many virtual folders")
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, user.VirtualFolders, 2)
+	// the per-user limit overrides the global one
+	user.Filters.MaxVirtualFolders = -2
+	_, _, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	// -1 means unlimited
+	user.Filters.MaxVirtualFolders = -1
+	user.VirtualFolders = append(user.VirtualFolders, getFolder(3))
+	user, resp, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(resp))
+	assert.Len(t, user.VirtualFolders, 3)
+	// 0 means the global limit
+	user.Filters.MaxVirtualFolders = 0
+	_, resp, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "too many virtual folders")
+	user.VirtualFolders = user.VirtualFolders[:2]
+	user.Filters.MaxVirtualFolders = 3
+	user.VirtualFolders = append(user.VirtualFolders, getFolder(3))
+	user, resp, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err, string(resp))
+	assert.Len(t, user.VirtualFolders, 3)
+	user.VirtualFolders = append(user.VirtualFolders, getFolder(4))
+	_, resp, err = httpdtest.UpdateUser(user, http.StatusBadRequest, "")
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "too many virtual folders")
+
 	_, err = httpdtest.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
+	for idx := 1; idx <= 3; idx++ {
+		_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: getFolder(idx).Name}, http.StatusOK)
+		assert.NoError(t, err)
+	}
+	// the rejected mapping must not create the folder
+	_, err = httpdtest.RemoveFolder(vfs.BaseVirtualFolder{Name: getFolder(4).Name}, http.StatusNotFound)
+	assert.NoError(t, err)
+
 	err = dataprovider.Close()
 	assert.NoError(t, err)
 	err = config.LoadConfig(configDir, "")
@@ -3246,6 +4194,8 @@ func TestDefenderAPI(t *testing.T) {
 	require.NoError(t, err)
 
 	ip := "::1"
+	// IPv6 hosts are aggregated by /64 subnet
+	hostKey := "::/64"
 
 	response, _, err := httpdtest.GetBanTime(ip, http.StatusOK)
 	require.NoError(t, err)
@@ -3269,7 +4219,7 @@ func TestDefenderAPI(t *testing.T) {
 	_, err = httpdtest.RemoveDefenderHostByIP(ip, http.StatusNotFound)
 	require.NoError(t, err)
 
-	common.AddDefenderEvent(ip, common.HostEventNoLoginTried)
+	common.AddDefenderEvent(ip, common.ProtocolSSH, common.HostEventNoLoginTried)
 	response, _, err = httpdtest.GetScore(ip, http.StatusOK)
 	require.NoError(t, err)
 	score, ok = response["score"]
@@ -3282,14 +4232,21 @@ func TestDefenderAPI(t *testing.T) {
 		host := hosts[0]
 		assert.Empty(t, host.GetBanTime())
 		assert.Equal(t, 2, host.Score)
-		assert.Equal(t, ip, host.IP)
+		assert.Equal(t, hostKey, host.IP)
 	}
 	host, _, err := httpdtest.GetDefenderHostByIP(ip, http.StatusOK)
 	assert.NoError(t, err)
 	assert.Empty(t, host.GetBanTime())
 	assert.Equal(t, 2, host.Score)
+	explanation, _, err := httpdtest.ExplainDefenderHostByIP(ip, http.StatusOK)
+	assert.NoError(t, err)
+	assert.False(t, explanation.Banned)
+	assert.Equal(t, common.BanReasonNone, explanation.Reason)
+	assert.Equal(t, 2, explanation.Score)
+	assert.Equal(t, 3, explanation.Threshold)
+	assert.Len(t, explanation.Events, 1)
 
-	common.AddDefenderEvent(ip, common.HostEventNoLoginTried)
+	common.AddDefenderEvent(ip, common.ProtocolSSH, common.HostEventNoLoginTried)
 	response, _, err = httpdtest.GetBanTime(ip, http.StatusOK)
 	require.NoError(t, err)
 	banTime, ok = response["date_time"]
@@ -3301,12 +4258,19 @@ func TestDefenderAPI(t *testing.T) {
 		host := hosts[0]
 		assert.NotEmpty(t, host.GetBanTime())
 		assert.Equal(t, 0, host.Score)
-		assert.Equal(t, ip, host.IP)
+		assert.Equal(t, hostKey, host.IP)
 	}
 	host, _, err = httpdtest.GetDefenderHostByIP(ip, http.StatusOK)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, host.GetBanTime())
 	assert.Equal(t, 0, host.Score)
+	explanation, _, err = httpdtest.ExplainDefenderHostByIP(ip, http.StatusOK)
+	assert.NoError(t, err)
+	assert.True(t, explanation.Banned)
+	assert.Equal(t, common.BanReasonScore, explanation.Reason)
+	assert.NotNil(t, explanation.BanTime)
+	assert.Equal(t, 4, explanation.Score)
+	assert.Len(t, explanation.Events, 2)
 
 	err = httpdtest.UnbanIP(ip, http.StatusOK)
 	require.NoError(t, err)
@@ -3317,8 +4281,8 @@ func TestDefenderAPI(t *testing.T) {
 	host, _, err = httpdtest.GetDefenderHostByIP(ip, http.StatusNotFound)
 	assert.NoError(t, err)
 
-	common.AddDefenderEvent(ip, common.HostEventNoLoginTried)
-	common.AddDefenderEvent(ip, common.HostEventNoLoginTried)
+	common.AddDefenderEvent(ip, common.ProtocolSSH, common.HostEventNoLoginTried)
+	common.AddDefenderEvent(ip, common.ProtocolSSH, common.HostEventNoLoginTried)
 	hosts, _, err = httpdtest.GetDefenderHosts(http.StatusOK)
 	require.NoError(t, err)
 	assert.Len(t, hosts, 1)
@@ -3333,6 +4297,8 @@ func TestDefenderAPI(t *testing.T) {
 
 	host, _, err = httpdtest.GetDefenderHostByIP("invalid_ip", http.StatusBadRequest)
 	assert.NoError(t, err)
+	_, _, err = httpdtest.ExplainDefenderHostByIP("invalid_ip", http.StatusBadRequest)
+	assert.NoError(t, err)
 	_, err = httpdtest.RemoveDefenderHostByIP("invalid_ip", http.StatusBadRequest)
 	assert.NoError(t, err)
 
@@ -3876,6 +4842,101 @@ func TestWebAPIChangeUserPwdMock(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestWebAPIChangeUserPwdPolicyMock(t *testing.T) {
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.UserPasswordChange.HistorySize = -1
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.Error(t, err)
+	providerConf.UserPasswordChange.HistorySize = 2
+	providerConf.UserPasswordChange.RequireCurrentPassword = true
+	providerConf.PasswordValidation.Users.MinEntropy = 50
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	u := getTestUser()
+	u.Password = "Pk7#wRz2!qLm9xTe"
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	token, err := getJWTAPIUserTokenFromTestServer(defaultUsername, u.Password)
+	assert.NoError(t, err)
+
+	changePwd := func(currentPwd, newPwd string) *httptest.ResponseRecorder {
+		pwd := make(map[string]string)
+		pwd["current_password"] = currentPwd
+		pwd["new_password"] = newPwd
+		asJSON, err := json.Marshal(pwd)
+		assert.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, userPwdPath, bytes.NewBuffer(asJSON))
+		assert.NoError(t, err)
+		setBearerForReq(req, token)
+		return executeRequest(req)
+	}
+	newPwd1 := "Vn4$hJq8@tYc3sWb"
+	newPwd2 := "Za6!mKe1#rXu5gDp"
+	rr := changePwd(u.Password, "weakpwd")
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	assert.Contains(t, rr.Body.String(), "insecure password")
+	rr = changePwd(u.Password+"_wrong", newPwd1)
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	assert.Contains(t, rr.Body.String(), "current password does not match")
+	rr = changePwd("", newPwd1)
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	assert.Contains(t, rr.Body.String(), "please provide the current password")
+	rr = changePwd(u.Password, newPwd1)
+	checkResponseCode(t, http.StatusOK, rr)
+	rr = changePwd(newPwd1, newPwd2)
+	checkResponseCode(t, http.StatusOK, rr)
+	// both the previous passwords are in the history
+	rr = changePwd(newPwd2, newPwd1)
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	assert.Contains(t, rr.Body.String(), "cannot be the same as a previous one")
+	rr = changePwd(newPwd2, u.Password)
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	assert.Contains(t, rr.Body.String(), "cannot be the same as a previous one")
+	// the history is never exposed
+	user, _, err = httpdtest.GetUserByUsername(user.Username, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, user.PasswordHistory, 0)
+	// the history is preserved updating the user
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	rr = changePwd(newPwd2, newPwd1)
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	assert.Contains(t, rr.Body.String(), "cannot be the same as a previous one")
+	_, err = getJWTAPIUserTokenFromTestServer(defaultUsername, newPwd1)
+	assert.Error(t, err)
+	// the password change can be disabled per-user
+	user.Filters.WebClient = []string{sdk.WebClientPasswordChangeDisabled}
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	token, err = getJWTAPIUserTokenFromTestServer(defaultUsername, newPwd2)
+	assert.NoError(t, err)
+	rr = changePwd(newPwd2, "Qb2@nFs7$wLc4hYe")
+	checkResponseCode(t, http.StatusForbidden, rr)
+	err = dataprovider.ChangeUserPassword(user.Username, newPwd2, "Qb2@nFs7$wLc4hYe", "127.0.0.1", common.ProtocolHTTP)
+	assert.Error(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	providerConf.CredentialsPath = credentialsPath
+	err = os.RemoveAll(credentialsPath)
+	assert.NoError(t, err)
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+}
+
 func TestLoginInvalidPasswordMock(t *testing.T) {
 	_, err := getJWTAPITokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass+"1")
 	assert.Error(t, err)
@@ -4013,6 +5074,79 @@ func TestUpdateAdminMock(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, rr)
 }
 
+func TestUpdateUserConcurrentModificationMock(t *testing.T) {
+	token, err := getJWTAPITokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
+	assert.NoError(t, err)
+	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), user.Version)
+
+	getUser := func() (dataprovider.User, string) {
+		req, _ := http.NewRequest(http.MethodGet, path.Join(userPath, user.Username), nil)
+		setBearerForReq(req, token)
+		rr := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, rr)
+		var u dataprovider.User
+		err := render.DecodeJSON(rr.Body, &u)
+		assert.NoError(t, err)
+		return u, rr.Header().Get("ETag")
+	}
+	updateUser := func(u dataprovider.User, etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPut, path.Join(userPath, u.Username), bytes.NewBuffer(getUserAsJSON(t, u)))
+		setBearerForReq(req, token)
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+		return executeRequest(req)
+	}
+	// two admins read the same user
+	user1, etag1 := getUser()
+	user2, etag2 := getUser()
+	assert.Equal(t, `"1"`, etag1)
+	assert.Equal(t, etag1, etag2)
+	user1.AdditionalInfo = "first update"
+	rr := updateUser(user1, etag1)
+	checkResponseCode(t, http.StatusOK, rr)
+	// the stale update is rejected
+	user2.AdditionalInfo = "second update"
+	rr = updateUser(user2, etag2)
+	checkResponseCode(t, http.StatusConflict, rr)
+	updatedUser, etag := getUser()
+	assert.Equal(t, "first update", updatedUser.AdditionalInfo)
+	assert.Equal(t, int64(2), updatedUser.Version)
+	assert.Equal(t, `"2"`, etag)
+	// re-read and retry
+	updatedUser.AdditionalInfo = "second update"
+	rr = updateUser(updatedUser, etag)
+	checkResponseCode(t, http.StatusOK, rr)
+	// without If-Match the user is overwritten
+	rr = updateUser(user2, "")
+	checkResponseCode(t, http.StatusOK, rr)
+	rr = updateUser(user2, "invalid")
+	checkResponseCode(t, http.StatusBadRequest, rr)
+	// the same check applies to the data provider
+	u1, err := dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	u2, err := dataprovider.UserExists(user.Username)
+	assert.NoError(t, err)
+	u1.Description = "desc"
+	err = dataprovider.UpdateUser(&u1)
+	assert.NoError(t, err)
+	err = dataprovider.UpdateUser(&u2)
+	if assert.Error(t, err) {
+		_, ok := err.(*util.ConflictError)
+		assert.True(t, ok, "unexpected error: %v", err)
+	}
+	u1.Description = "desc updated"
+	err = dataprovider.UpdateUser(&u1)
+	assert.NoError(t, err)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestUpdateUserMock(t *testing.T) {
 	token, err := getJWTAPITokenFromTestServer(defaultTokenAuthUser, defaultTokenAuthPass)
 	assert.NoError(t, err)
@@ -5772,6 +6906,56 @@ func TestWebGetFiles(t *testing.T) {
 	setBearerForReq(req, webAPIToken)
 	rr = executeRequest(req)
 	checkResponseCode(t, http.StatusRequestedRangeNotSatisfiable, rr)
+	// a download can be resumed using the returned ETag
+	req, _ = http.NewRequest(http.MethodGet, userFilesPath+"?path="+testFileName, nil)
+	setBearerForReq(req, webAPIToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	req, _ = http.NewRequest(http.MethodGet, userFilesPath+"?path="+testFileName, nil)
+	req.Header.Set("Range", "bytes=2-")
+	req.Header.Set("If-Match", etag)
+	setBearerForReq(req, webAPIToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusPartialContent, rr)
+	assert.Equal(t, testFileContents[2:], rr.Body.Bytes())
+	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath+"?path="+testFileName, nil)
+	req.Header.Set("Range", "bytes=2-")
+	req.Header.Set("If-Range", etag)
+	setJWTCookieForReq(req, webToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusPartialContent, rr)
+	assert.Equal(t, testFileContents[2:], rr.Body.Bytes())
+	for _, value := range []string{`"invalid"`, "W/" + etag} {
+		req, _ = http.NewRequest(http.MethodGet, userFilesPath+"?path="+testFileName, nil)
+		req.Header.Set("Range", "bytes=2-")
+		req.Header.Set("If-Match", value)
+		setBearerForReq(req, webAPIToken)
+		rr = executeRequest(req)
+		checkResponseCode(t, http.StatusPreconditionFailed, rr)
+	}
+	// the file changed, the download cannot be resumed
+	info, err := os.Stat(filepath.Join(user.GetHomeDir(), testFileName))
+	assert.NoError(t, err)
+	modTime := info.ModTime().Add(2 * time.Second)
+	err = os.Chtimes(filepath.Join(user.GetHomeDir(), testFileName), modTime, modTime)
+	assert.NoError(t, err)
+	req, _ = http.NewRequest(http.MethodGet, userFilesPath+"?path="+testFileName, nil)
+	req.Header.Set("Range", "bytes=2-")
+	req.Header.Set("If-Match", etag)
+	setBearerForReq(req, webAPIToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusPreconditionFailed, rr)
+	// with If-Range the whole file is returned
+	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath+"?path="+testFileName, nil)
+	req.Header.Set("Range", "bytes=2-")
+	req.Header.Set("If-Range", etag)
+	setJWTCookieForReq(req, webToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr)
+	assert.Equal(t, testFileContents, rr.Body.Bytes())
+	assert.NotEqual(t, etag, rr.Header().Get("ETag"))
 
 	req, _ = http.NewRequest(http.MethodHead, webClientFilesPath+"?path="+testFileName, nil)
 	req.Header.Set("Range", "bytes=2-")
@@ -5976,6 +7160,60 @@ func TestWebDirsAPI(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, rr)
 }
 
+func TestWebUploadCollisionPolicy(t *testing.T) {
+	u := getTestUser()
+	u.Filters.UploadCollisionPolicy = sdk.UploadCollisionAutoSuffix
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	webAPIToken, err := getJWTAPIUserTokenFromTestServer(defaultUsername, defaultPassword)
+	assert.NoError(t, err)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("filename", "file.txt")
+	assert.NoError(t, err)
+	_, err = part.Write([]byte("file content"))
+	assert.NoError(t, err)
+	err = writer.Close()
+	assert.NoError(t, err)
+	reader := bytes.NewReader(body.Bytes())
+
+	req, err := http.NewRequest(http.MethodPost, userFilesPath, reader)
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	setBearerForReq(req, webAPIToken)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, rr)
+	assert.NotContains(t, rr.Body.String(), "saved as")
+	_, err = reader.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	req, err = http.NewRequest(http.MethodPost, userFilesPath, reader)
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	setBearerForReq(req, webAPIToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, rr)
+	assert.Contains(t, rr.Body.String(), `\"file.txt\" saved as \"file(1).txt\"`)
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), "file(1).txt"))
+
+	user.Filters.UploadCollisionPolicy = sdk.UploadCollisionReject
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, err = reader.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	req, err = http.NewRequest(http.MethodPost, userFilesPath, reader)
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	setBearerForReq(req, webAPIToken)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, rr)
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestWebFilesAPI(t *testing.T) {
 	user, _, err := httpdtest.AddUser(getTestUser(), http.StatusCreated)
 	assert.NoError(t, err)
@@ -7602,6 +8840,7 @@ func TestWebUserAddMock(t *testing.T) {
 	form.Set("description", user.Description)
 	form.Add("hooks", "external_auth_disabled")
 	form.Set("disable_fs_checks", "checked")
+	form.Set("disable_quota_tracking", "checked")
 	b, contentType, _ := getMultipartFormData(form, "", "")
 	// test invalid url escape
 	req, _ = http.NewRequest(http.MethodPost, webUserPath+"?a=%2", &b)
@@ -7766,6 +9005,8 @@ func TestWebUserAddMock(t *testing.T) {
 	assert.False(t, newUser.Filters.Hooks.PreLoginDisabled)
 	assert.False(t, newUser.Filters.Hooks.CheckPasswordDisabled)
 	assert.True(t, newUser.Filters.DisableFsChecks)
+	assert.True(t, newUser.Filters.DisableQuotaTracking)
+	assert.Equal(t, "Quota tracking disabled", newUser.GetQuotaSummary())
 	assert.True(t, util.IsStringInSlice(testPubKey, newUser.PublicKeys))
 	if val, ok := newUser.Permissions["/subdir"]; ok {
 		assert.True(t, util.IsStringInSlice(dataprovider.PermListItems, val))
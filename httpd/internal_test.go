@@ -1403,7 +1403,7 @@ func TestRequestHeaderErrors(t *testing.T) {
 	assert.Equal(t, condNone, res)
 
 	req, _ = http.NewRequest(http.MethodPost, webClientFilesPath, nil)
-	res = checkIfRange(req, time.Now())
+	res = checkIfRange(req, time.Now(), "")
 	assert.Equal(t, condNone, res)
 
 	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath, nil)
@@ -1413,11 +1413,16 @@ func TestRequestHeaderErrors(t *testing.T) {
 
 	req, _ = http.NewRequest(http.MethodGet, webClientFilesPath, nil)
 	req.Header.Set("If-Range", time.Now().Format(http.TimeFormat))
-	res = checkIfRange(req, time.Time{})
+	res = checkIfRange(req, time.Time{}, "")
 	assert.Equal(t, condFalse, res)
 
 	req.Header.Set("If-Range", "invalid if range date")
-	res = checkIfRange(req, time.Now())
+	res = checkIfRange(req, time.Now(), "")
+	assert.Equal(t, condFalse, res)
+	req.Header.Set("If-Range", `"etag"`)
+	res = checkIfRange(req, time.Now(), `"etag"`)
+	assert.Equal(t, condTrue, res)
+	res = checkIfRange(req, time.Now(), `"other"`)
 	assert.Equal(t, condFalse, res)
 	modTime := getFileObjectModTime(time.Time{})
 	assert.Empty(t, modTime)
@@ -1542,7 +1547,11 @@ func TestChangeUserPwd(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodPost, webChangeClientPwdPath, nil)
 	err := doChangeUserPassword(req, "", "", "")
 	if assert.Error(t, err) {
-		assert.Contains(t, err.Error(), "please provide the current password and the new one two times")
+		assert.Contains(t, err.Error(), "please provide the new password two times")
+	}
+	err = doChangeUserPassword(req, "", "b", "b")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "please provide the current password")
 	}
 	err = doChangeUserPassword(req, "a", "b", "c")
 	if assert.Error(t, err) {
@@ -77,9 +77,25 @@ func (s *httpdServer) listenAndServe() error {
 			httpServer.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
 			httpServer.TLSConfig.VerifyConnection = s.verifyTLSConnection
 		}
-		return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, true, logSender)
+		return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, true, logSender, s.wrapListener)
 	}
-	return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, false, logSender)
+	return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, false, logSender, s.wrapListener)
+}
+
+// wrapListener refuses the connections not included in the allow list before
+// the TLS handshake. The client IP for the connections from the hosts allowed
+// to set the proxy headers is checked for each request
+func (s *httpdServer) wrapListener(listener net.Listener) net.Listener {
+	return common.NewAllowListListener(listener, common.ProtocolHTTP, s.isProxyAddress)
+}
+
+func (s *httpdServer) isProxyAddress(ip net.IP) bool {
+	for _, allow := range s.binding.allowHeadersFrom {
+		if allow(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *httpdServer) verifyTLSConnection(state tls.ConnectionState) error {
@@ -174,6 +190,7 @@ func (s *httpdServer) handleWebClientLoginPost(w http.ResponseWriter, r *http.Re
 	}
 
 	defer user.CloseFs() //nolint:errcheck
+	user.SetLoginProtocol(common.ProtocolHTTP)
 	err = user.CheckFsRoot(connectionID)
 	if err != nil {
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v", err)
@@ -347,6 +364,7 @@ func (s *httpdServer) getUserToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	defer user.CloseFs() //nolint:errcheck
+	user.SetLoginProtocol(common.ProtocolHTTP)
 	err = user.CheckFsRoot(connectionID)
 	if err != nil {
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v", err)
@@ -505,11 +523,15 @@ func (s *httpdServer) checkConnection(next http.Handler) http.Handler {
 				}
 			}
 		}
+		if !common.IsConnectionAccepted(ipAddr, common.ProtocolHTTP) {
+			s.sendForbiddenResponse(w, r, "your IP address is not allowed")
+			return
+		}
 
 		common.Connections.AddClientConnection(ipAddr)
 		defer common.Connections.RemoveClientConnection(ipAddr)
 
-		if !common.Connections.IsNewConnectionAllowed(ipAddr) {
+		if !common.Connections.IsNewConnectionAllowed(ipAddr, common.ProtocolHTTP) {
 			logger.Log(logger.LevelDebug, common.ProtocolHTTP, "", "connection refused, configured limit reached")
 			s.sendForbiddenResponse(w, r, "configured connections limit reached")
 			return
@@ -518,6 +540,7 @@ func (s *httpdServer) checkConnection(next http.Handler) http.Handler {
 			s.sendForbiddenResponse(w, r, "your IP address is banned")
 			return
 		}
+		common.ThrottleConnection(ipAddr, common.ProtocolHTTP)
 		if delay, err := common.LimitRate(common.ProtocolHTTP, ipAddr); err != nil {
 			delay += 499999999 * time.Nanosecond
 			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", delay.Seconds()))
@@ -636,6 +659,12 @@ func (s *httpdServer) initializeRouter() {
 		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath+"/{username}", getUserByUsername)
 		router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Put(userPath+"/{username}", updateUser)
 		router.With(checkPerm(dataprovider.PermAdminDeleteUsers)).Delete(userPath+"/{username}", deleteUser)
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath+"/{username}/metadata", getUserMetadata)
+		router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Put(userPath+"/{username}/metadata", updateUserMetadata)
+		router.With(checkPerm(dataprovider.PermAdminViewConnections)).Get(userPath+"/{username}/connections",
+			getUserConnections)
+		router.With(checkPerm(dataprovider.PermAdminCloseConnections)).Delete(userPath+"/{username}/connections",
+			closeUserConnections)
 		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(folderPath, getFolders)
 		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(folderPath+"/{name}", getFolderByName)
 		router.With(checkPerm(dataprovider.PermAdminAddUsers)).Post(folderPath, addFolder)
@@ -650,6 +679,8 @@ func (s *httpdServer) initializeRouter() {
 		router.With(checkPerm(dataprovider.PermAdminChangeUsers)).Put(quotasBasePath+"/folders/{name}/usage", updateFolderQuotaUsage)
 		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHosts, getDefenderHosts)
 		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHosts+"/{id}", getDefenderHostByID)
+		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHosts+"/{id}/explanation",
+			explainDefenderHostByID)
 		router.With(checkPerm(dataprovider.PermAdminManageDefender)).Delete(defenderHosts+"/{id}", deleteDefenderHostByID)
 		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderBanTime, getBanTime)
 		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderScore, getScore)
@@ -668,7 +699,7 @@ func (s *httpdServer) initializeRouter() {
 		router.Use(jwtAuthenticatorAPIUser)
 
 		router.Get(userLogoutPath, s.logout)
-		router.Put(userPwdPath, changeUserPassword)
+		router.With(checkHTTPUserPerm(sdk.WebClientPasswordChangeDisabled)).Put(userPwdPath, changeUserPassword)
 		router.With(checkHTTPUserPerm(sdk.WebClientPubKeyChangeDisabled)).Get(userPublicKeysPath, getUserPublicKeys)
 		router.With(checkHTTPUserPerm(sdk.WebClientPubKeyChangeDisabled)).Put(userPublicKeysPath, setUserPublicKeys)
 		// compatibility layer to remove in v2.3
@@ -736,7 +767,8 @@ func (s *httpdServer) initializeRouter() {
 				Delete(webClientDirsPath, deleteUserDir)
 			router.With(s.refreshCookie).Get(webClientDownloadZipPath, handleWebClientDownloadZip)
 			router.With(s.refreshCookie).Get(webClientCredentialsPath, handleClientGetCredentials)
-			router.Post(webChangeClientPwdPath, handleWebClientChangePwdPost)
+			router.With(checkHTTPUserPerm(sdk.WebClientPasswordChangeDisabled)).
+				Post(webChangeClientPwdPath, handleWebClientChangePwdPost)
 			router.With(checkHTTPUserPerm(sdk.WebClientPubKeyChangeDisabled)).
 				Post(webChangeClientKeysPath, handleWebClientManageKeysPost)
 		})
@@ -658,6 +658,7 @@ func getFiltersFromUserPostFields(r *http.Request) sdk.UserFilters {
 		filters.Hooks.CheckPasswordDisabled = true
 	}
 	filters.DisableFsChecks = len(r.Form.Get("disable_fs_checks")) > 0
+	filters.DisableQuotaTracking = len(r.Form.Get("disable_quota_tracking")) > 0
 	return filters
 }
 
@@ -774,6 +775,8 @@ func getFsConfigFromPostFields(r *http.Request) (vfs.Filesystem, error) {
 	var fs vfs.Filesystem
 	fs.Provider = sdk.GetProviderByName(r.Form.Get("fs_provider"))
 	switch fs.Provider {
+	case sdk.LocalFilesystemProvider:
+		fs.OSConfig.ReadReplicas = getSliceFromDelimitedValues(r.Form.Get("os_read_replicas"), "\n")
 	case sdk.S3FilesystemProvider:
 		config, err := getS3Config(r)
 		if err != nil {
@@ -1449,6 +1452,13 @@ func handleWebUpdateUserPost(w http.ResponseWriter, r *http.Request) {
 	}
 	updatedUser.ID = user.ID
 	updatedUser.Username = user.Username
+	if r.Form.Get("user_version") != "" {
+		updatedUser.Version, err = strconv.ParseInt(r.Form.Get("user_version"), 10, 64)
+		if err != nil {
+			renderUserPage(w, r, &user, userPageModeUpdate, fmt.Sprintf("invalid user version: %v", err))
+			return
+		}
+	}
 	updatedUser.SetEmptySecretsIfNil()
 	if updatedUser.Password == redactedSecret {
 		updatedUser.Password = user.Password
@@ -1456,6 +1466,8 @@ func handleWebUpdateUserPost(w http.ResponseWriter, r *http.Request) {
 	updateEncryptedSecrets(&updatedUser.FsConfig, user.FsConfig.S3Config.AccessSecret, user.FsConfig.AzBlobConfig.AccountKey,
 		user.FsConfig.AzBlobConfig.SASURL, user.FsConfig.GCSConfig.Credentials, user.FsConfig.CryptConfig.Passphrase,
 		user.FsConfig.SFTPConfig.Password, user.FsConfig.SFTPConfig.PrivateKey)
+	// protocol specific filesystems are not editable from the web form
+	updatedUser.ProtocolFilesystems = user.ProtocolFilesystems
 
 	err = dataprovider.UpdateUser(&updatedUser)
 	if err == nil {
@@ -82,6 +82,7 @@ type filesPage struct {
 	CanDelete     bool
 	CanDownload   bool
 	Error         string
+	Banner        string
 	Paths         []dirMapping
 }
 
@@ -93,11 +94,12 @@ type clientMessagePage struct {
 
 type credentialsPage struct {
 	baseClientPage
-	PublicKeys    []string
-	ChangePwdURL  string
-	ManageKeysURL string
-	PwdError      string
-	KeyError      string
+	PublicKeys         []string
+	ChangePwdURL       string
+	ManageKeysURL      string
+	PwdError           string
+	KeyError           string
+	CurrentPwdRequired bool
 }
 
 func getFileObjectURL(baseDir, name string) string {
@@ -213,6 +215,7 @@ func renderFilesPage(w http.ResponseWriter, r *http.Request, dirName, error stri
 		CanRename:      user.CanRenameFromWeb(dirName, dirName),
 		CanDelete:      user.CanDeleteFromWeb(dirName),
 		CanDownload:    user.HasPerm(dataprovider.PermDownload, dirName),
+		Banner:         common.GetBanner(common.ProtocolHTTP, &user),
 	}
 	paths := []dirMapping{}
 	if dirName != "/" {
@@ -237,11 +240,12 @@ func renderFilesPage(w http.ResponseWriter, r *http.Request, dirName, error stri
 
 func renderCredentialsPage(w http.ResponseWriter, r *http.Request, pwdError string, keyError string) {
 	data := credentialsPage{
-		baseClientPage: getBaseClientPageData(pageClientCredentialsTitle, webClientCredentialsPath, r),
-		ChangePwdURL:   webChangeClientPwdPath,
-		ManageKeysURL:  webChangeClientKeysPath,
-		PwdError:       pwdError,
-		KeyError:       keyError,
+		baseClientPage:     getBaseClientPageData(pageClientCredentialsTitle, webClientCredentialsPath, r),
+		ChangePwdURL:       webChangeClientPwdPath,
+		ManageKeysURL:      webChangeClientKeysPath,
+		PwdError:           pwdError,
+		KeyError:           keyError,
+		CurrentPwdRequired: dataprovider.IsCurrentPasswordRequired(),
 	}
 	user, err := dataprovider.UserExists(data.LoggedUser.Username)
 	if err != nil {
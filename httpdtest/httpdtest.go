@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -241,6 +242,70 @@ func GetUsers(limit, offset int64, expectedStatusCode int) ([]dataprovider.User,
 	return users, body, err
 }
 
+// GetUsersByMetadata returns the users having the given metadata key and, if not empty, value
+// and checks the received HTTP Status code against expectedStatusCode.
+func GetUsersByMetadata(key, value string, expectedStatusCode int) ([]dataprovider.User, []byte, error) {
+	var users []dataprovider.User
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(userPath))
+	if err != nil {
+		return users, body, err
+	}
+	q := url.Query()
+	q.Add("metadata_key", key)
+	if value != "" {
+		q.Add("metadata_value", value)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "", getDefaultToken())
+	if err != nil {
+		return users, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &users)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return users, body, err
+}
+
+// GetUserMetadata returns the metadata for the given username and checks the received HTTP Status code
+// against expectedStatusCode.
+func GetUserMetadata(username string, expectedStatusCode int) (map[string]string, []byte, error) {
+	var metadata map[string]string
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, url.PathEscape(username), "metadata"),
+		nil, "", getDefaultToken())
+	if err != nil {
+		return metadata, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &metadata)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return metadata, body, err
+}
+
+// UpdateUserMetadata replaces the metadata for the given username and checks the received HTTP Status code
+// against expectedStatusCode.
+func UpdateUserMetadata(username string, metadata map[string]string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	asJSON, _ := json.Marshal(metadata)
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(userPath, url.PathEscape(username), "metadata"),
+		bytes.NewBuffer(asJSON), "application/json", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
 // AddAdmin adds a new user and checks the received HTTP Status code against expectedStatusCode.
 func AddAdmin(admin dataprovider.Admin, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
 	var newAdmin dataprovider.Admin
@@ -452,6 +517,39 @@ func CloseConnection(connectionID string, expectedStatusCode int) ([]byte, error
 	return body, err
 }
 
+// GetUserConnections returns the active connections for the given username
+func GetUserConnections(username string, expectedStatusCode int) ([]common.ConnectionStatus, []byte, error) {
+	var connections []common.ConnectionStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, url.PathEscape(username), "connections"),
+		nil, "", getDefaultToken())
+	if err != nil {
+		return connections, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &connections)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return connections, body, err
+}
+
+// CloseUserConnections closes all the active connections for the given username
+func CloseUserConnections(username string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, url.PathEscape(username), "connections"),
+		nil, "", getDefaultToken())
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
 // AddFolder adds a new folder and checks the received HTTP Status code against expectedStatusCode
 func AddFolder(folder vfs.BaseVirtualFolder, expectedStatusCode int) (vfs.BaseVirtualFolder, []byte, error) {
 	var newFolder vfs.BaseVirtualFolder
@@ -689,6 +787,26 @@ func GetDefenderHostByIP(ip string, expectedStatusCode int) (common.DefenderEntr
 	return host, body, err
 }
 
+// ExplainDefenderHostByIP returns why the host with the given IP is banned or its current score
+func ExplainDefenderHostByIP(ip string, expectedStatusCode int) (common.BanExplanation, []byte, error) {
+	var explanation common.BanExplanation
+	var body []byte
+	id := hex.EncodeToString([]byte(ip))
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(defenderHosts, id, "explanation"),
+		nil, "", getDefaultToken())
+	if err != nil {
+		return explanation, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &explanation)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return explanation, body, err
+}
+
 // RemoveDefenderHostByIP removes the host with the given IP from the defender list
 func RemoveDefenderHostByIP(ip string, expectedStatusCode int) ([]byte, error) {
 	var body []byte
@@ -982,12 +1100,35 @@ func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if err := compareFsConfig(&expected.FsConfig, &actual.FsConfig); err != nil {
 		return err
 	}
+	if err := compareUserProtocolFilesystems(expected, actual); err != nil {
+		return err
+	}
 	if err := compareUserVirtualFolders(expected, actual); err != nil {
 		return err
 	}
 	return compareEqualsUserFields(expected, actual)
 }
 
+func compareUserProtocolFilesystems(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(actual.ProtocolFilesystems) != len(expected.ProtocolFilesystems) {
+		return errors.New("protocol filesystems len mismatch")
+	}
+	for idx := range expected.ProtocolFilesystems {
+		p := &expected.ProtocolFilesystems[idx]
+		p1 := &actual.ProtocolFilesystems[idx]
+		if p.Protocol != p1.Protocol {
+			return errors.New("protocol filesystem protocol mismatch")
+		}
+		if filepath.Clean(p.HomeDir) != p1.HomeDir {
+			return errors.New("protocol filesystem home dir mismatch")
+		}
+		if err := compareFsConfig(&p.FsConfig, &p1.FsConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func compareUserVirtualFolders(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(actual.VirtualFolders) != len(expected.VirtualFolders) {
 		return errors.New("virtual folders len mismatch")
@@ -1032,6 +1173,14 @@ func compareFsConfig(expected *vfs.Filesystem, actual *vfs.Filesystem) error {
 	if err := checkEncryptedSecret(expected.CryptConfig.Passphrase, actual.CryptConfig.Passphrase); err != nil {
 		return err
 	}
+	if len(expected.OSConfig.ReadReplicas) != len(actual.OSConfig.ReadReplicas) {
+		return errors.New("fs read replicas mismatch")
+	}
+	for _, replica := range expected.OSConfig.ReadReplicas {
+		if !util.IsStringInSlice(replica, actual.OSConfig.ReadReplicas) {
+			return errors.New("fs read replicas content mismatch")
+		}
+	}
 	return compareSFTPFsConfig(expected, actual)
 }
 
@@ -1267,15 +1416,119 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 	if expected.Filters.TLSUsername != actual.Filters.TLSUsername {
 		return errors.New("TLSUsername mismatch")
 	}
+	if expected.Filters.SetstatMode != actual.Filters.SetstatMode {
+		return errors.New("setstat mode mismatch")
+	}
+	if expected.Filters.MaxVirtualFolders != actual.Filters.MaxVirtualFolders {
+		return errors.New("max virtual folders mismatch")
+	}
+	if expected.Filters.SymlinksPolicy != actual.Filters.SymlinksPolicy {
+		return errors.New("symlinks policy mismatch")
+	}
+	if expected.Filters.PathCaseFolding != actual.Filters.PathCaseFolding {
+		return errors.New("path case folding mismatch")
+	}
+	if expected.Filters.UploadCollisionPolicy != actual.Filters.UploadCollisionPolicy {
+		return errors.New("upload collision policy mismatch")
+	}
+	if expected.Filters.DirListingSort != actual.Filters.DirListingSort {
+		return errors.New("directory listing sort mismatch")
+	}
+	if expected.Filters.Banner != actual.Filters.Banner {
+		return errors.New("banner mismatch")
+	}
+	if expected.Filters.DisableQuotaTracking != actual.Filters.DisableQuotaTracking {
+		return errors.New("disable quota tracking mismatch")
+	}
+	if expected.Filters.SingleSessionPolicy != actual.Filters.SingleSessionPolicy {
+		return errors.New("single session policy mismatch")
+	}
+	if expected.Filters.TextMode.Upload != actual.Filters.TextMode.Upload ||
+		expected.Filters.TextMode.Download != actual.Filters.TextMode.Download {
+		return errors.New("text mode line endings mismatch")
+	}
+	if len(expected.Filters.TextMode.Extensions) != len(actual.Filters.TextMode.Extensions) {
+		return errors.New("text mode extensions mismatch")
+	}
+	for _, ext := range expected.Filters.TextMode.Extensions {
+		if !util.IsStringInSlice(ext, actual.Filters.TextMode.Extensions) {
+			return errors.New("text mode extensions content mismatch")
+		}
+	}
+	if expected.Filters.TLSCertRequired != actual.Filters.TLSCertRequired {
+		return errors.New("TLS certificate required mismatch")
+	}
+	if len(expected.Filters.TLSCertFingerprints) != len(actual.Filters.TLSCertFingerprints) {
+		return errors.New("TLS certificate fingerprints mismatch")
+	}
+	for _, fingerprint := range expected.Filters.TLSCertFingerprints {
+		fingerprint = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if !util.IsStringInSlice(fingerprint, actual.Filters.TLSCertFingerprints) {
+			return errors.New("TLS certificate fingerprints content mismatch")
+		}
+	}
+	if len(expected.Filters.HiddenPatterns) != len(actual.Filters.HiddenPatterns) {
+		return errors.New("hidden patterns mismatch")
+	}
+	for _, pattern := range expected.Filters.HiddenPatterns {
+		if !util.IsStringInSlice(strings.ToLower(strings.TrimSpace(pattern)), actual.Filters.HiddenPatterns) {
+			return errors.New("hidden patterns content mismatch")
+		}
+	}
+	expectedScanExcludes := getNormalizedQuotaScanExcludes(expected.Filters.QuotaScanExcludes)
+	actualScanExcludes := getNormalizedQuotaScanExcludes(actual.Filters.QuotaScanExcludes)
+	if len(expectedScanExcludes) != len(actualScanExcludes) {
+		return errors.New("quota scan excludes mismatch")
+	}
+	for _, pattern := range expectedScanExcludes {
+		if !util.IsStringInSlice(pattern, actualScanExcludes) {
+			return errors.New("quota scan excludes content mismatch")
+		}
+	}
+	if len(expected.Filters.SecurityProfiles) != len(actual.Filters.SecurityProfiles) {
+		return errors.New("security profiles mismatch")
+	}
+	for _, profile := range expected.Filters.SecurityProfiles {
+		if !util.IsStringInSlice(profile, actual.Filters.SecurityProfiles) {
+			return errors.New("security profiles content mismatch")
+		}
+	}
+	if len(expected.Filters.HomeSkeleton) != len(actual.Filters.HomeSkeleton) {
+		return errors.New("home skeleton mismatch")
+	}
+	for _, dir := range expected.Filters.HomeSkeleton {
+		if !util.IsStringInSlice(dir, actual.Filters.HomeSkeleton) {
+			return errors.New("home skeleton content mismatch")
+		}
+	}
 	if len(expected.Filters.WebClient) != len(actual.Filters.WebClient) {
 		return errors.New("WebClient filter mismatch")
 	}
+	if len(expected.Filters.BandwidthSchedules) != len(actual.Filters.BandwidthSchedules) {
+		return errors.New("bandwidth schedules mismatch")
+	}
 	if err := compareUserFilterSubStructs(expected, actual); err != nil {
 		return err
 	}
 	return compareUserFilePatternsFilters(expected, actual)
 }
 
+// getNormalizedQuotaScanExcludes applies the same normalization done by the server
+func getNormalizedQuotaScanExcludes(patterns []string) []string {
+	var result []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "/") {
+			pattern = path.Clean(pattern)
+		}
+		result = append(result, pattern)
+	}
+	return util.RemoveDuplicates(result)
+}
+
 func checkFilterMatch(expected []string, actual []string) bool {
 	if len(expected) != len(actual) {
 		return false
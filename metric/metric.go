@@ -38,6 +38,58 @@ var (
 		Help: "Total number of logged in users",
 	})
 
+	// activeTransfersSlots is the metric that reports the number of transfers holding
+	// a server wide transfer slot
+	activeTransfersSlots = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_transfers_slots_active",
+		Help: "Number of transfers holding a server wide transfer slot",
+	})
+
+	// queuedTransfers is the metric that reports the number of transfers waiting
+	// for a free server wide transfer slot
+	queuedTransfers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_transfers_queued",
+		Help: "Number of transfers waiting for a free server wide transfer slot",
+	})
+
+	// defenderBannedHosts is the metric that reports the number of hosts banned by the defender
+	defenderBannedHosts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_defender_banned_hosts",
+		Help: "Number of hosts banned by the defender",
+	})
+
+	// defenderHosts is the metric that reports the number of hosts with a score tracked by the defender
+	defenderHosts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "sftpgo_defender_hosts",
+		Help: "Number of hosts with a score tracked by the defender",
+	})
+
+	// totalDefenderBans is the metric that reports the total number of bans issued by the defender
+	totalDefenderBans = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_defender_bans_total",
+		Help: "The total number of bans issued by the defender",
+	})
+
+	// totalDefenderEvents is the metric that reports the total number of events
+	// added to the defender by event type
+	totalDefenderEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_defender_events_total",
+		Help: "The total number of events added to the defender",
+	}, []string{"event"})
+
+	// totalQuotaDrifts is the metric that reports the total number of detected differences
+	// between the stored quota usage and the scanned one
+	totalQuotaDrifts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_quota_drifts_total",
+		Help: "The total number of detected quota drifts",
+	})
+
+	// totalQuotaDriftsCorrected is the metric that reports the total number of corrected quota drifts
+	totalQuotaDriftsCorrected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_quota_drifts_corrected_total",
+		Help: "The total number of corrected quota drifts",
+	})
+
 	// totalUploads is the metric that reports the total number of successful uploads
 	totalUploads = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_uploads_total",
@@ -901,3 +953,33 @@ func HTTPRequestServed(status int) {
 func UpdateActiveConnectionsSize(size int) {
 	activeConnections.Set(float64(size))
 }
+
+// UpdateTransfersSlots sets the metrics for active and queued transfers
+func UpdateTransfersSlots(active, queued int) {
+	activeTransfersSlots.Set(float64(active))
+	queuedTransfers.Set(float64(queued))
+}
+
+// QuotaDriftDetected updates the metrics after a quota drift is detected
+func QuotaDriftDetected(corrected bool) {
+	totalQuotaDrifts.Inc()
+	if corrected {
+		totalQuotaDriftsCorrected.Inc()
+	}
+}
+
+// UpdateDefenderHosts sets the metrics for the banned hosts and the hosts with a score
+func UpdateDefenderHosts(banned, hosts int) {
+	defenderBannedHosts.Set(float64(banned))
+	defenderHosts.Set(float64(hosts))
+}
+
+// AddDefenderBan increments the metric for the bans issued by the defender
+func AddDefenderBan() {
+	totalDefenderBans.Inc()
+}
+
+// AddDefenderEvent increments the metric for the defender events of the given type
+func AddDefenderEvent(event string) {
+	totalDefenderEvents.WithLabelValues(event).Inc()
+}
@@ -69,3 +69,18 @@ func HTTPRequestServed(status int) {}
 
 // UpdateActiveConnectionsSize sets the metric for active connections
 func UpdateActiveConnectionsSize(size int) {}
+
+// UpdateTransfersSlots sets the metrics for active and queued transfers
+func UpdateTransfersSlots(active, queued int) {}
+
+// QuotaDriftDetected updates the metrics after a quota drift is detected
+func QuotaDriftDetected(corrected bool) {}
+
+// UpdateDefenderHosts sets the metrics for the banned hosts and the hosts with a score
+func UpdateDefenderHosts(banned, hosts int) {}
+
+// AddDefenderBan increments the metric for the bans issued by the defender
+func AddDefenderBan() {}
+
+// AddDefenderEvent increments the metric for the defender events of the given type
+func AddDefenderEvent(event string) {}
@@ -0,0 +1,323 @@
+package metric
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/v2/version"
+)
+
+const (
+	otlpTracesPath      = "/v1/traces"
+	otlpScopeName       = "github.com/drakkan/sftpgo"
+	otlpMaxQueuedSpans  = 2048
+	otlpSpanKindServer  = 2
+	otlpStatusCodeOK    = 1
+	otlpStatusCodeError = 2
+	// minimum interval between two logged export errors
+	otlpErrorLogInterval = 5 * time.Minute
+)
+
+var (
+	otlpEnabled  int32
+	otlpExporter *spansExporter
+)
+
+// OTLPConfig defines the configuration to export transfer spans to an
+// OpenTelemetry collector using the OTLP/HTTP protocol with JSON encoding
+type OTLPConfig struct {
+	// Base URL for the collector, for example "http://127.0.0.1:4318".
+	// Spans are sent to the "/v1/traces" path. Empty means disabled
+	Endpoint string `json:"endpoint" mapstructure:"endpoint"`
+	// Interval, in seconds, between two exports
+	ExportInterval int `json:"export_interval" mapstructure:"export_interval"`
+	// Service name reported within the exported resource
+	ServiceName string `json:"service_name" mapstructure:"service_name"`
+	// Additional HTTP headers to send to the collector, for example for authentication
+	Headers map[string]string `json:"headers" mapstructure:"headers"`
+}
+
+// IsEnabled returns true if the OTLP exporter is configured
+func (c *OTLPConfig) IsEnabled() bool {
+	return c.Endpoint != ""
+}
+
+func (c *OTLPConfig) validate() error {
+	if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+		return fmt.Errorf("invalid OTLP endpoint %#v, it must be an HTTP or HTTPS URL", c.Endpoint)
+	}
+	if c.ExportInterval <= 0 {
+		return fmt.Errorf("invalid OTLP export interval: %v", c.ExportInterval)
+	}
+	if c.ServiceName == "" {
+		c.ServiceName = "sftpgo"
+	}
+	return nil
+}
+
+// Initialize starts the OTLP exporter, if configured.
+// A running exporter is stopped before applying the new configuration.
+// Export errors are reported using logError, at most once every five minutes,
+// this package cannot use the logger package that depends on it
+func (c OTLPConfig) Initialize(logError func(format string, v ...interface{})) error {
+	StopOTLPExporter()
+	if !c.IsEnabled() {
+		return nil
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	otlpExporter = newSpansExporter(c, logError)
+	atomic.StoreInt32(&otlpEnabled, 1)
+	return nil
+}
+
+// StopOTLPExporter stops the OTLP exporter, if running, after sending the queued spans
+func StopOTLPExporter() {
+	if atomic.CompareAndSwapInt32(&otlpEnabled, 1, 0) {
+		otlpExporter.stop()
+	}
+}
+
+// TransferSpanCompleted queues a span for a completed upload or download.
+// It does nothing if the OTLP exporter is disabled
+func TransferSpanCompleted(username, protocol, connectionID string, start time.Time, bytesSent, bytesReceived int64,
+	transferKind int, err error) {
+	if atomic.LoadInt32(&otlpEnabled) == 0 {
+		return
+	}
+	name := "download"
+	if transferKind == 0 {
+		name = "upload"
+	}
+	s := otlpSpan{
+		TraceID:           newOTLPID(16),
+		SpanID:            newOTLPID(8),
+		Name:              name,
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			newOTLPStringAttribute("sftpgo.username", username),
+			newOTLPStringAttribute("sftpgo.protocol", protocol),
+			newOTLPStringAttribute("sftpgo.connection_id", connectionID),
+			newOTLPIntAttribute("sftpgo.bytes_sent", bytesSent),
+			newOTLPIntAttribute("sftpgo.bytes_received", bytesReceived),
+		},
+		Status: otlpStatus{Code: otlpStatusCodeOK},
+	}
+	if err != nil {
+		s.Status = otlpStatus{Code: otlpStatusCodeError, Message: err.Error()}
+	}
+	otlpExporter.add(s)
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func newOTLPStringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func newOTLPIntAttribute(key string, value int64) otlpAttribute {
+	// int64 values are encoded as strings in OTLP JSON
+	val := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpAnyValue{IntValue: &val}}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// spansExporter queues the spans and periodically sends them to the collector.
+// If the collector cannot keep up the oldest spans are dropped
+type spansExporter struct {
+	sync.Mutex
+	config     OTLPConfig
+	httpClient *http.Client
+	spans      []otlpSpan
+	done       chan bool
+	wg         sync.WaitGroup
+	logError   func(format string, v ...interface{})
+	// the following fields are used only within the export loop
+	lastErrorLog  time.Time
+	failedExports int
+}
+
+func newSpansExporter(config OTLPConfig, logError func(format string, v ...interface{})) *spansExporter {
+	e := &spansExporter{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		done:     make(chan bool),
+		logError: logError,
+	}
+	e.wg.Add(1)
+	go e.loop()
+	return e
+}
+
+func (e *spansExporter) add(s otlpSpan) {
+	e.Lock()
+	defer e.Unlock()
+
+	if len(e.spans) >= otlpMaxQueuedSpans {
+		e.spans = e.spans[1:]
+	}
+	e.spans = append(e.spans, s)
+}
+
+func (e *spansExporter) loop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(e.config.ExportInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			e.export(true)
+			return
+		case <-ticker.C:
+			e.export(false)
+		}
+	}
+}
+
+// export sends the queued spans and logs the errors, rate limited unless force is true
+func (e *spansExporter) export(force bool) {
+	err := e.flush()
+	if err == nil {
+		return
+	}
+	e.failedExports++
+	if e.logError == nil || (!force && time.Since(e.lastErrorLog) < otlpErrorLogInterval) {
+		return
+	}
+	e.logError("unable to export spans to the OTLP collector, failed exports since the last report: %v, last error: %v",
+		e.failedExports, err)
+	e.failedExports = 0
+	e.lastErrorLog = time.Now()
+}
+
+func (e *spansExporter) stop() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *spansExporter) flush() error {
+	e.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(e.getTracesRequest(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(e.config.Endpoint, "/")+otlpTracesPath,
+		bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected OTLP collector response: " + resp.Status)
+	}
+	return nil
+}
+
+func (e *spansExporter) getTracesRequest(spans []otlpSpan) otlpTracesRequest {
+	return otlpTracesRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{
+						newOTLPStringAttribute("service.name", e.config.ServiceName),
+						newOTLPStringAttribute("service.version", version.Get().Version),
+					},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{
+							Name:    otlpScopeName,
+							Version: version.Get().Version,
+						},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func newOTLPID(size int) string {
+	b := make([]byte, size)
+	rand.Read(b) //nolint:errcheck
+	return hex.EncodeToString(b)
+}
@@ -1,20 +1,23 @@
 package sdk
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/drakkan/sftpgo/v2/util"
 )
 
 // Web Client/user REST API restrictions
 const (
-	WebClientPubKeyChangeDisabled = "publickey-change-disabled"
-	WebClientWriteDisabled        = "write-disabled"
+	WebClientPubKeyChangeDisabled   = "publickey-change-disabled"
+	WebClientWriteDisabled          = "write-disabled"
+	WebClientPasswordChangeDisabled = "password-change-disabled"
 )
 
 var (
 	// WebClientOptions defines the available options for the web client interface/user REST API
-	WebClientOptions = []string{WebClientPubKeyChangeDisabled, WebClientWriteDisabled}
+	WebClientOptions = []string{WebClientPubKeyChangeDisabled, WebClientWriteDisabled, WebClientPasswordChangeDisabled}
 )
 
 // TLSUsername defines the TLS certificate attribute to use as username
@@ -26,6 +29,103 @@ const (
 	TLSUsernameCN   TLSUsername = "CommonName"
 )
 
+// SetstatMode defines how setstat requests are handled for a user
+type SetstatMode string
+
+// Supported setstat modes, an empty value means that the global setstat mode is used
+const (
+	// requests for changing permissions, owner/group and access/modification times are executed
+	SetstatModeNormal SetstatMode = "normal"
+	// requests for changing permissions, owner/group and access/modification times are silently ignored
+	SetstatModeIgnore SetstatMode = "ignore"
+	// setstat requests are silently ignored for cloud filesystems and executed for local/SFTP filesystems
+	SetstatModeIgnoreCloud SetstatMode = "ignore_cloud"
+)
+
+// UploadCollisionPolicy defines how uploads to existing files are handled for a user
+type UploadCollisionPolicy string
+
+// Supported upload collision policies, an empty value means overwrite
+const (
+	// existing files are overwritten
+	UploadCollisionOverwrite UploadCollisionPolicy = "overwrite"
+	// uploads to existing files are rejected
+	UploadCollisionReject UploadCollisionPolicy = "reject"
+	// uploads to existing files are saved using a new name, for example "file(1).txt"
+	UploadCollisionAutoSuffix UploadCollisionPolicy = "auto_suffix"
+)
+
+// SingleSessionPolicy defines how a new session is handled if the user
+// already has an active session for the same protocol
+type SingleSessionPolicy string
+
+// Supported single session policies, an empty value means that multiple sessions are allowed
+const (
+	// multiple sessions for the same protocol are allowed
+	SingleSessionNone SingleSessionPolicy = "none"
+	// the new session is refused
+	SingleSessionRefuse SingleSessionPolicy = "refuse"
+	// the existing sessions are closed and the new one is allowed
+	SingleSessionEvict SingleSessionPolicy = "evict"
+)
+
+// SymlinksPolicy defines how symbolic links are followed on local filesystems
+type SymlinksPolicy string
+
+// Supported symlinks policies, an empty value means deny outside home
+const (
+	// symbolic links are followed even if they point outside the home directory
+	SymlinksFollow SymlinksPolicy = "follow"
+	// paths traversing a symbolic link are denied
+	SymlinksDeny SymlinksPolicy = "deny"
+	// symbolic links are followed only if they point inside the home directory,
+	// or inside the virtual folder root for virtual folders
+	SymlinksDenyOutsideHome SymlinksPolicy = "deny_outside_home"
+)
+
+// LineEnding defines a line ending style for text files
+type LineEnding string
+
+// Supported line endings
+const (
+	// Unix style line endings
+	LineEndingLF LineEnding = "lf"
+	// Windows style line endings
+	LineEndingCRLF LineEnding = "crlf"
+)
+
+// TextModeFilter defines the line endings normalization for text files.
+// Files are normalized only if their extension is listed and their
+// initial contents do not look binary
+type TextModeFilter struct {
+	// file extensions, including the leading dot, for example ".txt".
+	// The match is case insensitive
+	Extensions []string `json:"extensions,omitempty"`
+	// line ending for uploaded files, empty means no conversion
+	Upload LineEnding `json:"upload,omitempty"`
+	// line ending for downloaded files, empty means no conversion.
+	// Only applied to FTP downloads starting from the beginning of the
+	// file, the other protocols serve the files unchanged
+	Download LineEnding `json:"download,omitempty"`
+}
+
+// DirListingSort defines the sort order for directory listings
+type DirListingSort string
+
+// Supported directory listing sort orders, an empty value means no sort
+const (
+	// entries are returned in the order provided by the storage backend
+	DirListingSortNone DirListingSort = "none"
+	// entries are sorted by name
+	DirListingSortName DirListingSort = "name"
+	// entries are sorted by name ignoring case
+	DirListingSortNameInsensitive DirListingSort = "name_insensitive"
+	// entries are sorted by size, smaller first
+	DirListingSortSize DirListingSort = "size"
+	// entries are sorted by modification time, older first
+	DirListingSortModTime DirListingSort = "mtime"
+)
+
 // DirectoryPermissions defines permissions for a directory virtual path
 type DirectoryPermissions struct {
 	Path        string
@@ -83,6 +183,53 @@ type HooksFilter struct {
 	CheckPasswordDisabled bool `json:"check_password_disabled"`
 }
 
+// BandwidthSchedule defines upload and download bandwidth limits for a daily time window.
+// From and To are expressed as "HH:MM", 24-hour format, using the server local time.
+// The window includes From and excludes To, so "24:00" can be used to define a window
+// ending at midnight. A window cannot span midnight, define two windows instead
+type BandwidthSchedule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Maximum upload bandwidth as KB/s, 0 means unlimited
+	UploadBandwidth int64 `json:"upload_bandwidth"`
+	// Maximum download bandwidth as KB/s, 0 means unlimited
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+}
+
+// GetTimeRange returns the window start and end as minutes since midnight
+func (s *BandwidthSchedule) GetTimeRange() (int, int, error) {
+	from, err := parseScheduleTime(s.From)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseScheduleTime(s.To)
+	if err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+// IsActiveAt returns true if the window includes the given time of day
+func (s *BandwidthSchedule) IsActiveAt(t time.Time) bool {
+	from, to, err := s.GetTimeRange()
+	if err != nil {
+		return false
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	return minutes >= from && minutes < to
+}
+
+func parseScheduleTime(val string) (int, error) {
+	if val == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %#v, the expected format is HH:MM", val)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
 // UserFilters defines additional restrictions for a user
 // TODO: rename to UserOptions in v3
 type UserFilters struct {
@@ -120,6 +267,64 @@ type UserFilters struct {
 	DisableFsChecks bool `json:"disable_fs_checks,omitempty"`
 	// WebClient related configuration options
 	WebClient []string `json:"web_client,omitempty"`
+	// bandwidth limits for specific time windows, they override
+	// the user's upload and download bandwidth while active.
+	// The first matching window is used
+	BandwidthSchedules []BandwidthSchedule `json:"bandwidth_schedules,omitempty"`
+	// user specific override for the global setstat mode.
+	// If empty the global setting is used
+	SetstatMode SetstatMode `json:"setstat_mode,omitempty"`
+	// directories, as virtual paths, to create on the first login.
+	// If empty the skeleton defined in the data provider configuration is used
+	HomeSkeleton []string `json:"home_skeleton,omitempty"`
+	// if not empty the user can only login using the SFTP/FTP bindings
+	// with one of these security profiles
+	SecurityProfiles []string `json:"security_profiles,omitempty"`
+	// defines how uploads to existing files are handled.
+	// If empty existing files are overwritten
+	UploadCollisionPolicy UploadCollisionPolicy `json:"upload_collision_policy,omitempty"`
+	// defines the sort order for directory listings.
+	// If empty the entries are returned in the order provided by the storage backend
+	DirListingSort DirListingSort `json:"dir_listing_sort,omitempty"`
+	// shell like patterns, for example ".*" or ".DS_Store", for files and directories
+	// to hide. Hidden entries are not listed and cannot be accessed using their path.
+	// The patterns are matched, case insensitive, against each path component
+	HiddenPatterns []string `json:"hidden_patterns,omitempty"`
+	// banner to show to this user. If set it overrides the banner configured
+	// for the protocol. It is not applicable to FTP since the welcome message
+	// is sent before the user is known
+	Banner string `json:"banner,omitempty"`
+	// if true the used quota is not tracked for this user and the user quota
+	// limits are not enforced. Useful for storage backends that enforce their own quota.
+	// Virtual folders with their own quota are still tracked
+	DisableQuotaTracking bool `json:"disable_quota_tracking,omitempty"`
+	// defines how a new session is handled if another session for the same protocol
+	// is already active. If empty multiple sessions are allowed.
+	// Only SSH and FTP sessions are checked
+	SingleSessionPolicy SingleSessionPolicy `json:"single_session_policy,omitempty"`
+	// opt-in line endings normalization for text files
+	TextMode TextModeFilter `json:"text_mode,omitempty"`
+	// defines how symbolic links are followed on local and encrypted filesystems.
+	// If empty links pointing outside the home directory are denied
+	SymlinksPolicy SymlinksPolicy `json:"symlinks_policy,omitempty"`
+	// if enabled the paths are lower cased before resolving them on the storage
+	// backends, useful for case-insensitive backends. Trailing and redundant slashes
+	// are always removed
+	PathCaseFolding bool `json:"path_case_folding,omitempty"`
+	// shell like patterns for the files and directories to skip while scanning the
+	// user quota. Patterns starting with "/" are matched against the virtual path,
+	// the other ones against each path component
+	QuotaScanExcludes []string `json:"quota_scan_excludes,omitempty"`
+	// maximum number of virtual folders for this user. 0 means the global
+	// default defined in the data provider configuration, -1 means unlimited
+	MaxVirtualFolders int `json:"max_virtual_folders"`
+	// if true FTP and WebDAV logins require a TLS client certificate,
+	// in addition to the configured login methods
+	TLSCertRequired bool `json:"tls_cert_required,omitempty"`
+	// SHA256 fingerprints, as hex strings, of the TLS client certificates
+	// allowed for FTP and WebDAV logins. If not empty a matching client
+	// certificate is required
+	TLSCertFingerprints []string `json:"tls_cert_fingerprints,omitempty"`
 }
 
 type BaseUser struct {
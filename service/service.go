@@ -14,6 +14,7 @@ import (
 	"github.com/drakkan/sftpgo/v2/dataprovider"
 	"github.com/drakkan/sftpgo/v2/httpd"
 	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/metric"
 	"github.com/drakkan/sftpgo/v2/sdk/plugin"
 	"github.com/drakkan/sftpgo/v2/util"
 	"github.com/drakkan/sftpgo/v2/version"
@@ -136,6 +137,15 @@ func (s *Service) Start() error {
 		return err
 	}
 
+	otlpConfig := config.GetTelemetryConfig().OTLP
+	if err := otlpConfig.Initialize(func(format string, v ...interface{}) {
+		logger.Warn(logSender, "", format, v...)
+	}); err != nil {
+		logger.Error(logSender, "", "error initializing OTLP exporter: %v", err)
+		logger.ErrorToConsole("error initializing OTLP exporter: %v", err)
+		return err
+	}
+
 	s.startServices()
 	go common.Config.ExecuteStartupHook() //nolint:errcheck
 
@@ -227,6 +237,7 @@ func (s *Service) Wait() {
 		registerSignals()
 	}
 	<-s.Shutdown
+	metric.StopOTLPExporter()
 }
 
 // Stop terminates the service unblocking the Wait method
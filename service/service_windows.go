@@ -136,6 +136,10 @@ loop:
 			if err != nil {
 				logger.Warn(logSender, "", "error reloading telemetry cert manager: %v", err)
 			}
+			err = common.ReloadAcceptAllowList()
+			if err != nil {
+				logger.Warn(logSender, "", "error reloading the accept allow list: %v", err)
+			}
 			err = common.ReloadDefender()
 			if err != nil {
 				logger.Warn(logSender, "", "error reloading defender's lists: %v", err)
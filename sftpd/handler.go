@@ -150,6 +150,22 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
 
+	isResume := getOSOpenFlags(request.Pflags())&os.O_TRUNC == 0
+	fsPath, virtualPath, err := c.HandleUploadCollision(fs, p, request.Filepath, isResume)
+	if err != nil {
+		return nil, err
+	}
+	if virtualPath != request.Filepath {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualPath)) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		filePath = fsPath
+		if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+			filePath = fs.GetAtomicUploadPath(fsPath)
+		}
+		return c.handleSFTPUploadToNewFile(fs, fsPath, filePath, virtualPath, errForRead)
+	}
+
 	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(request.Filepath)) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
@@ -308,6 +308,24 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return err
 	}
 
+	fsPath, virtualPath, err := c.connection.HandleUploadCollision(fs, p, uploadFilePath, false)
+	if err != nil {
+		c.sendErrorMessage(fs, err)
+		return err
+	}
+	if virtualPath != uploadFilePath {
+		if !c.connection.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualPath)) {
+			c.connection.Log(logger.LevelWarn, "cannot upload file: %#v, permission denied", virtualPath)
+			c.sendErrorMessage(fs, common.ErrPermissionDenied)
+			return common.ErrPermissionDenied
+		}
+		filePath = fsPath
+		if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+			filePath = fs.GetAtomicUploadPath(fsPath)
+		}
+		return c.handleUploadFile(fs, fsPath, filePath, sizeToRead, true, 0, virtualPath)
+	}
+
 	if !c.connection.User.HasPerm(dataprovider.PermOverwrite, uploadFilePath) {
 		c.connection.Log(logger.LevelWarn, "cannot overwrite file: %#v, permission denied", uploadFilePath)
 		c.sendErrorMessage(fs, common.ErrPermissionDenied)
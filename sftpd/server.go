@@ -45,6 +45,14 @@ type Binding struct {
 	Port int `json:"port" mapstructure:"port"`
 	// Apply the proxy configuration, if any, for this binding
 	ApplyProxyConfig bool `json:"apply_proxy_config" mapstructure:"apply_proxy_config"`
+	// Name of the security profile for this binding. Users restricted to some
+	// security profiles can only login using the bindings with a matching profile
+	SecurityProfile string `json:"security_profile" mapstructure:"security_profile"`
+	// KexAlgorithms, Ciphers and MACs override the global settings for this binding.
+	// Empty means the global settings are used
+	KexAlgorithms []string `json:"kex_algorithms" mapstructure:"kex_algorithms"`
+	Ciphers       []string `json:"ciphers" mapstructure:"ciphers"`
+	MACs          []string `json:"macs" mapstructure:"macs"`
 }
 
 // GetAddress returns the binding address
@@ -62,6 +70,55 @@ func (b *Binding) HasProxy() bool {
 	return b.ApplyProxyConfig && common.Config.ProxyProtocol > 0
 }
 
+// getServerConfig returns a copy of the given server config with the security
+// options overridden for this binding. The authentication callbacks are wrapped
+// to enforce the users security profiles
+func (b *Binding) getServerConfig(serverConfig *ssh.ServerConfig) *ssh.ServerConfig {
+	config := *serverConfig
+	if len(b.KexAlgorithms) > 0 {
+		config.KeyExchanges = b.KexAlgorithms
+	}
+	if len(b.Ciphers) > 0 {
+		config.Ciphers = b.Ciphers
+	}
+	if len(b.MACs) > 0 {
+		config.MACs = b.MACs
+	}
+	if publicKeyCallback := config.PublicKeyCallback; publicKeyCallback != nil {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+			return b.checkSecurityProfile(publicKeyCallback(conn, pubKey))
+		}
+	}
+	if passwordCallback := config.PasswordCallback; passwordCallback != nil {
+		config.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			return b.checkSecurityProfile(passwordCallback(conn, pass))
+		}
+	}
+	if keyboardInteractiveCallback := config.KeyboardInteractiveCallback; keyboardInteractiveCallback != nil {
+		config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return b.checkSecurityProfile(keyboardInteractiveCallback(conn, client))
+		}
+	}
+	return &config
+}
+
+func (b *Binding) checkSecurityProfile(sp *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	if err != nil || sp == nil {
+		return sp, err
+	}
+	var user dataprovider.User
+	if err := json.Unmarshal([]byte(sp.Extensions["sftpgo_user"]), &user); err != nil {
+		return nil, err
+	}
+	if !user.IsSecurityProfileAllowed(b.SecurityProfile) {
+		logger.Debug(logSender, "", "cannot login user %#v, security profile %#v is not allowed, binding: %v",
+			user.Username, b.SecurityProfile, b.GetAddress())
+		return nil, &authenticationError{err: fmt.Sprintf("security profile %#v is not allowed for user %#v",
+			b.SecurityProfile, user.Username)}
+	}
+	return sp, nil
+}
+
 // Configuration for the SFTP server
 type Configuration struct {
 	// Identification string used by the server
@@ -237,7 +294,7 @@ func (c *Configuration) Initialize(configDir string) error {
 				listener = proxyListener
 			}
 
-			exitChannel <- c.serve(listener, serverConfig)
+			exitChannel <- c.serve(listener, binding.getServerConfig(serverConfig))
 		}(binding)
 	}
 
@@ -288,6 +345,7 @@ func (c *Configuration) configureSecurityOptions(serverConfig *ssh.ServerConfig)
 }
 
 func (c *Configuration) configureLoginBanner(serverConfig *ssh.ServerConfig, configDir string) {
+	var fileBanner string
 	if len(c.LoginBannerFile) > 0 {
 		bannerFilePath := c.LoginBannerFile
 		if !filepath.IsAbs(bannerFilePath) {
@@ -295,15 +353,26 @@ func (c *Configuration) configureLoginBanner(serverConfig *ssh.ServerConfig, con
 		}
 		bannerContent, err := os.ReadFile(bannerFilePath)
 		if err == nil {
-			banner := string(bannerContent)
-			serverConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
-				return banner
-			}
+			fileBanner = string(bannerContent)
 		} else {
 			logger.WarnToConsole("unable to read SFTPD login banner file: %v", err)
 			logger.Warn(logSender, "", "unable to read login banner file: %v", err)
 		}
 	}
+	serverConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
+		return getLoginBanner(fileBanner)
+	}
+}
+
+// getLoginBanner returns the configured SSH banner or the login banner file
+// contents. The banner is sent before the authentication completes, so the
+// user specific banner does not apply: it would reveal the account existence
+func getLoginBanner(fileBanner string) string {
+	banner := common.GetBanner(common.ProtocolSSH, nil)
+	if banner == "" {
+		return fileBanner
+	}
+	return banner
 }
 
 func (c *Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.ServerConfig) {
@@ -338,11 +407,15 @@ func (c *Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.Serve
 }
 
 func canAcceptConnection(ip string) bool {
+	if !common.IsConnectionAccepted(ip, common.ProtocolSSH) {
+		return false
+	}
 	if common.IsBanned(ip) {
 		logger.Log(logger.LevelDebug, common.ProtocolSSH, "", "connection refused, ip %#v is banned", ip)
 		return false
 	}
-	if !common.Connections.IsNewConnectionAllowed(ip) {
+	common.ThrottleConnection(ip, common.ProtocolSSH)
+	if !common.Connections.IsNewConnectionAllowed(ip, common.ProtocolSSH) {
 		logger.Log(logger.LevelDebug, common.ProtocolSSH, "", "connection refused, configured limit reached")
 		return false
 	}
@@ -395,6 +468,14 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 	loginType := sconn.Permissions.Extensions["sftpgo_login_method"]
 	connectionID := hex.EncodeToString(sconn.SessionID())
 
+	// the single session policy is enforced after a successful authentication, the public key
+	// callback is also invoked for unsigned queries and other login checks may still fail
+	if err = common.Connections.CheckSingleSession(&user, common.ProtocolSSH); err != nil {
+		logger.Debug(logSender, connectionID, "connection refused for user %#v: %v", user.Username, err)
+		return
+	}
+
+	user.SetLoginProtocol(common.ProtocolSSH)
 	if err = user.CheckFsRoot(connectionID); err != nil {
 		errClose := user.CloseFs()
 		logger.Warn(logSender, connectionID, "unable to check fs root: %v close fs error: %v", err, errClose)
@@ -531,7 +612,7 @@ func checkAuthError(ip string, err error) {
 					if strings.Contains(err.Error(), "not found") {
 						event = common.HostEventUserNotFound
 					}
-					common.AddDefenderEvent(ip, event)
+					common.AddDefenderEvent(ip, common.ProtocolSSH, event)
 					break
 				}
 			}
@@ -539,7 +620,7 @@ func checkAuthError(ip string, err error) {
 	} else {
 		logger.ConnectionFailedLog("", ip, dataprovider.LoginMethodNoAuthTryed, common.ProtocolSSH, err.Error())
 		metric.AddNoAuthTryed()
-		common.AddDefenderEvent(ip, common.HostEventNoLoginTried)
+		common.AddDefenderEvent(ip, common.ProtocolSSH, common.HostEventNoLoginTried)
 		dataprovider.ExecutePostLoginHook(&dataprovider.User{}, dataprovider.LoginMethodNoAuthTryed, ip, common.ProtocolSSH, err)
 	}
 }
@@ -885,8 +966,10 @@ func updateLoginMetrics(user *dataprovider.User, ip, method string, err error) {
 			if _, ok := err.(*util.RecordNotFoundError); ok {
 				event = common.HostEventUserNotFound
 			}
-			common.AddDefenderEvent(ip, event)
+			common.AddDefenderEvent(ip, common.ProtocolSSH, event)
 		}
+	} else {
+		common.AddDefenderLoginSuccess(ip)
 	}
 	metric.AddLoginResult(method, err)
 	dataprovider.ExecutePostLoginHook(user, method, ip, common.ProtocolSSH, err)
@@ -199,6 +199,12 @@ func TestMain(m *testing.M) {
 			Port:             2022,
 			ApplyProxyConfig: true,
 		},
+		{
+			Port:             2228,
+			ApplyProxyConfig: true,
+			SecurityProfile:  "strong",
+			Ciphers:          []string{"aes128-gcm@openssh.com"},
+		},
 	}
 	sftpdConf.KexAlgorithms = []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256",
 		"ecdh-sha2-nistp384"}
@@ -236,6 +242,7 @@ func TestMain(m *testing.M) {
 	}()
 
 	waitTCPListening(sftpdConf.Bindings[0].GetAddress())
+	waitTCPListening(sftpdConf.Bindings[1].GetAddress())
 	waitTCPListening(httpdConf.Bindings[0].GetAddress())
 
 	sftpdConf.Bindings = []sftpd.Binding{
@@ -412,6 +419,48 @@ func TestBasicSFTPHandling(t *testing.T) {
 	assert.NotEmpty(t, sshCommands)
 }
 
+func TestLoginBanner(t *testing.T) {
+	u := getTestUser(false)
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	getBanner := func() string {
+		var banner string
+		config := &ssh.ClientConfig{
+			User: user.Username,
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				return nil
+			},
+			Auth: []ssh.AuthMethod{ssh.Password(defaultPassword)},
+			BannerCallback: func(message string) error {
+				banner = message
+				return nil
+			},
+		}
+		conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		return banner
+	}
+	assert.Equal(t, "simple login banner\n", getBanner())
+
+	common.Config.Banners.SSH = "configured banner"
+	assert.Equal(t, "configured banner", getBanner())
+
+	user.Filters.Banner = "user banner"
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	// the user banner is never sent before the authentication
+	assert.Equal(t, "configured banner", getBanner())
+	common.Config.Banners.SSH = ""
+	assert.Equal(t, "simple login banner\n", getBanner())
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestBasicSFTPFsHandling(t *testing.T) {
 	usePubKey := true
 	baseUser, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
@@ -2944,6 +2993,125 @@ func TestExternalAuthDifferentUsername(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSecurityProfiles(t *testing.T) {
+	strongAddr := "127.0.0.1:2228"
+	for _, usePubKey := range []bool{true, false} {
+		user, _, err := httpdtest.AddUser(getTestUser(usePubKey), http.StatusCreated)
+		assert.NoError(t, err)
+		// no restrictions, the user can login using any binding
+		for _, addr := range []string{sftpServerAddr, strongAddr} {
+			conn, client, err := getSftpClientWithAddr(user, usePubKey, addr)
+			if assert.NoError(t, err, addr) {
+				assert.NoError(t, checkBasicSFTP(client))
+				client.Close()
+				conn.Close()
+			}
+		}
+		user.Filters.SecurityProfiles = []string{"strong"}
+		user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+		assert.NoError(t, err)
+		_, _, err = getSftpClientWithAddr(user, usePubKey, sftpServerAddr)
+		assert.Error(t, err)
+		conn, client, err := getSftpClientWithAddr(user, usePubKey, strongAddr)
+		if assert.NoError(t, err) {
+			assert.NoError(t, checkBasicSFTP(client))
+			client.Close()
+			conn.Close()
+		}
+		_, err = httpdtest.RemoveUser(user, http.StatusOK)
+		assert.NoError(t, err)
+		err = os.RemoveAll(user.GetHomeDir())
+		assert.NoError(t, err)
+	}
+	// the strong binding only allows the configured ciphers
+	config := &ssh.ClientConfig{
+		User: defaultUsername,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.Password(defaultPassword)},
+		Config: ssh.Config{
+			Ciphers: []string{"aes256-ctr"},
+		},
+	}
+	_, err := ssh.Dial("tcp", strongAddr, config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no common algorithm")
+	}
+}
+
+func TestLoginExternalAuthCache(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	err = os.WriteFile(extAuthPath, getExtAuthScriptContent(u, false, false, ""), os.ModePerm)
+	assert.NoError(t, err)
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.ExternalAuthScope = 0
+	providerConf.ExternalAuthCacheTime = 60
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+
+	conn, client, err := getSftpClient(u, usePubKey)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+		conn.Close()
+	}
+	// now the hook rejects all the users, the successful authentication is cached
+	rejectedUser := getTestUser(usePubKey)
+	rejectedUser.Username += "_rejected"
+	err = os.WriteFile(extAuthPath, getExtAuthScriptContent(rejectedUser, false, false, ""), os.ModePerm)
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(u, usePubKey)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+		conn.Close()
+	}
+	// different credentials are not cached
+	u.Password = defaultPassword + "_mod"
+	conn, client, err = getSftpClient(u, usePubKey)
+	if !assert.Error(t, err) {
+		client.Close()
+		conn.Close()
+	}
+	u.Password = defaultPassword
+	// updating the user invalidates the cache
+	user, _, err := httpdtest.GetUserByUsername(defaultUsername, http.StatusOK)
+	assert.NoError(t, err)
+	user.AdditionalInfo = "updated"
+	_, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	conn, client, err = getSftpClient(u, usePubKey)
+	if !assert.Error(t, err) {
+		client.Close()
+		conn.Close()
+	}
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir, true)
+	assert.NoError(t, err)
+	err = os.Remove(extAuthPath)
+	assert.NoError(t, err)
+}
+
 func TestLoginExternalAuth(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -7914,6 +8082,29 @@ func TestSSHCopyRemoveNonLocalFs(t *testing.T) {
 		assert.Error(t, err)
 		_, err = runSSHCommand(fmt.Sprintf("sftpgo-remove %v", testDir), sftpUser, usePubKey)
 		assert.Error(t, err)
+		// regular files can be copied
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		out, err := runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, path.Join(testDir, testFileName)),
+			sftpUser, usePubKey)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "OK\n", string(out))
+		}
+		info, err := client.Stat(path.Join(testDir, testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, path.Join(testDir, testFileName)),
+			sftpUser, usePubKey)
+		assert.Error(t, err)
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", "missing", testFileName+".copy"), sftpUser, usePubKey)
+		assert.Error(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
 	}
 
 	_, err = httpdtest.RemoveUser(sftpUser, http.StatusOK)
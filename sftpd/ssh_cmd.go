@@ -128,7 +128,7 @@ func (c *sshCommand) handleSFTPGoCopy() error {
 		return c.sendErrorResponse(err)
 	}
 	if !c.isLocalCopy(sshSourcePath, sshDestPath) {
-		return c.sendErrorResponse(errUnsupportedConfig)
+		return c.handleSFTPGoFileCopy(fsSrc, fsDst, sshSourcePath, sshDestPath, fsSourcePath, fsDestPath)
 	}
 
 	if err := c.checkCopyDestination(fsDst, fsDestPath); err != nil {
@@ -189,6 +189,29 @@ func (c *sshCommand) handleSFTPGoCopy() error {
 	return nil
 }
 
+// handleSFTPGoFileCopy handles copies involving non local filesystems,
+// only regular files are supported
+func (c *sshCommand) handleSFTPGoFileCopy(fsSrc, fsDst vfs.Fs, sshSourcePath, sshDestPath, fsSourcePath, fsDestPath string) error {
+	fi, err := fsSrc.Lstat(fsSourcePath)
+	if err != nil {
+		return c.sendErrorResponse(c.connection.GetFsError(fsSrc, err))
+	}
+	if !fi.Mode().IsRegular() {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	if err := c.checkCopyDestination(fsDst, fsDestPath); err != nil {
+		return c.sendErrorResponse(c.connection.GetFsError(fsDst, err))
+	}
+	c.connection.Log(logger.LevelDebug, "requested file copy %#v -> %#v sftp paths %#v -> %#v",
+		fsSourcePath, fsDestPath, sshSourcePath, sshDestPath)
+	if err := c.connection.Copy(sshSourcePath, sshDestPath); err != nil {
+		return c.sendErrorResponse(err)
+	}
+	c.connection.channel.Write([]byte("OK\n")) //nolint:errcheck
+	c.sendExitStatus(nil)
+	return nil
+}
+
 func (c *sshCommand) handleSFTPGoRemove() error {
 	sshDestPath, err := c.getRemovePath()
 	if err != nil {
@@ -637,7 +660,7 @@ func (c *sshCommand) getRemovePath() (string, error) {
 func (c *sshCommand) isLocalPath(virtualPath string) bool {
 	folder, err := c.connection.User.GetVirtualFolderForPath(virtualPath)
 	if err != nil {
-		return c.connection.User.FsConfig.Provider == sdk.LocalFilesystemProvider
+		return c.connection.User.GetFsConfigForPath("/").Provider == sdk.LocalFilesystemProvider
 	}
 	return folder.FsConfig.Provider == sdk.LocalFilesystemProvider
 }
@@ -37,6 +37,7 @@ func newSubsystemChannel(reader io.Reader, writer io.Writer) *subsystemChannel {
 
 // ServeSubSystemConnection handles a connection as SSH subsystem
 func ServeSubSystemConnection(user *dataprovider.User, connectionID string, reader io.Reader, writer io.Writer) error {
+	user.SetLoginProtocol(common.ProtocolSSH)
 	err := user.CheckFsRoot(connectionID)
 	if err != nil {
 		errClose := user.CloseFs()
@@ -63,6 +63,7 @@ func newTransfer(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 		}
 	} else if pipeWriter != nil {
 		writer = pipeWriter
+		baseTransfer.SetPipeWriter(pipeWriter)
 	} else if pipeReader != nil {
 		if errForRead == nil {
 			reader = pipeReader
@@ -91,6 +92,10 @@ func newTransfer(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 // It handles download bandwidth throttling too
 func (t *transfer) ReadAt(p []byte, off int64) (n int, err error) {
 	t.Connection.UpdateLastActivity()
+	if err = t.AcquireTransferSlot(); err != nil {
+		t.TransferError(err)
+		return 0, err
+	}
 
 	n, err = t.readerAt.ReadAt(p, off)
 	atomic.AddInt64(&t.BytesSent, int64(n))
@@ -109,6 +114,10 @@ func (t *transfer) ReadAt(p []byte, off int64) (n int, err error) {
 // It handles upload bandwidth throttling too
 func (t *transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	t.Connection.UpdateLastActivity()
+	if err = t.AcquireTransferSlot(); err != nil {
+		t.TransferError(err)
+		return 0, err
+	}
 	if off < t.MinWriteOffset {
 		err := fmt.Errorf("invalid write offset: %v minimum valid value: %v", off, t.MinWriteOffset)
 		t.TransferError(err)
@@ -121,6 +130,9 @@ func (t *transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	if t.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&t.BytesReceived) > t.MaxWriteSize {
 		err = common.ErrQuotaExceeded
 	}
+	if err == nil {
+		err = t.ReserveQuota()
+	}
 	if err != nil {
 		t.TransferError(err)
 		return
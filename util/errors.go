@@ -35,6 +35,23 @@ func NewRecordNotFoundError(error string) *RecordNotFoundError {
 	}
 }
 
+// ConflictError raised if a record was modified after it was read, the caller
+// can read it again and retry
+type ConflictError struct {
+	err string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflict: %s", e.err)
+}
+
+// NewConflictError returns a conflict error
+func NewConflictError(error string) *ConflictError {
+	return &ConflictError{
+		err: error,
+	}
+}
+
 // MethodDisabledError raised if a method is disabled in config file.
 // For example, if user management is disabled, this error is raised
 // every time a user operation is done using the REST API
@@ -353,6 +353,18 @@ func CleanPath(p string) string {
 	return path.Clean(p)
 }
 
+// RemoveRedundantSlashes returns an absolute POSIX (/) path without duplicate
+// and trailing slashes. Unlike CleanPath, dot and dot-dot elements are preserved
+func RemoveRedundantSlashes(p string) string {
+	var elems []string
+	for _, elem := range strings.Split(filepath.ToSlash(p), "/") {
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	return "/" + strings.Join(elems, "/")
+}
+
 // LoadTemplate parses the given template paths.
 // it behaves like template.Must but it writes a log before exiting
 // you can optionally provide a base template (e.g. to define some custom functions)
@@ -432,8 +444,11 @@ func GenerateRandomBytes(length int) []byte {
 }
 
 // HTTPListenAndServe is a wrapper for ListenAndServe that support both tcp
-// and Unix-domain sockets
-func HTTPListenAndServe(srv *http.Server, address string, port int, isTLS bool, logSender string) error {
+// and Unix-domain sockets. The listener is wrapped using the given function,
+// if not nil, before serving
+func HTTPListenAndServe(srv *http.Server, address string, port int, isTLS bool, logSender string,
+	wrapListener func(net.Listener) net.Listener,
+) error {
 	var listener net.Listener
 	var err error
 
@@ -460,6 +475,10 @@ func HTTPListenAndServe(srv *http.Server, address string, port int, isTLS bool,
 
 	defer listener.Close()
 
+	if wrapListener != nil {
+		listener = wrapListener(listener)
+	}
+
 	if isTLS {
 		return srv.ServeTLS(listener, "", "")
 	}
@@ -45,6 +45,8 @@ type AzureBlobFs struct {
 	containerURL   azblob.ContainerURL
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	// if true the resolved paths are lower cased
+	pathCaseFolding bool
 }
 
 func init() {
@@ -153,6 +155,11 @@ func (fs *AzureBlobFs) Name() string {
 	return fmt.Sprintf("Azure Blob container %#v", fs.config.Container)
 }
 
+// SetPathCaseFolding enables or disables the case folding for the resolved paths
+func (fs *AzureBlobFs) SetPathCaseFolding(enabled bool) {
+	fs.pathCaseFolding = enabled
+}
+
 // ConnectionID returns the connection ID associated to this Fs implementation
 func (fs *AzureBlobFs) ConnectionID() string {
 	return fs.connectionID
@@ -264,7 +271,9 @@ func (fs *AzureBlobFs) Create(name string, flag int) (File, *PipeWriter, func(),
 		// if we shutdown Azurite while uploading it hangs, so we use our own wrapper for
 		// the low level functions
 		_, err := azblob.UploadStreamToBlockBlob(ctx, r, blobBlockURL, uploadOptions)*/
+		stopProgress := p.TrackUploadProgress(r, uploadProgressInterval)
 		err := fs.handleMultipartUpload(ctx, r, &blobBlockURL, &headers)
+		stopProgress()
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, r.GetReadedBytes(), err)
@@ -296,6 +305,25 @@ func (fs *AzureBlobFs) Rename(source, target string) error {
 			return fmt.Errorf("cannot rename non empty directory: %#v", source)
 		}
 	}
+	if err := fs.copyBlob(source, target); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// Copy copies the regular file source to target using a server side copy
+func (fs *AzureBlobFs) Copy(source, target string) error {
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return ErrVfsUnsupported
+	}
+	return fs.copyBlob(source, target)
+}
+
+func (fs *AzureBlobFs) copyBlob(source, target string) error {
 	dstBlobURL := fs.containerURL.NewBlobURL(target)
 	srcURL := fs.containerURL.NewBlobURL(source).URL()
 
@@ -334,7 +362,7 @@ func (fs *AzureBlobFs) Rename(source, target string) error {
 		return err
 	}
 	metric.AZCopyObjectCompleted(nil)
-	return fs.Remove(source, fi.IsDir())
+	return nil
 }
 
 // Remove removes the named file or (empty) directory.
@@ -623,6 +651,7 @@ func (fs *AzureBlobFs) GetRelativePath(name string) string {
 		}
 		rel = path.Clean("/" + strings.TrimPrefix(rel, "/"+fs.config.KeyPrefix))
 	}
+	rel = foldPathCase(rel, fs.pathCaseFolding)
 	if fs.mountPath != "" {
 		rel = path.Join(fs.mountPath, rel)
 	}
@@ -694,12 +723,8 @@ func (*AzureBlobFs) HasVirtualFolders() bool {
 
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs *AzureBlobFs) ResolvePath(virtualPath string) (string, error) {
-	if fs.mountPath != "" {
-		virtualPath = strings.TrimPrefix(virtualPath, fs.mountPath)
-	}
-	if !path.IsAbs(virtualPath) {
-		virtualPath = path.Clean("/" + virtualPath)
-	}
+	// dot-dot elements must not escape the key prefix
+	virtualPath = path.Clean(canonicalizeVirtualPath(virtualPath, fs.mountPath, fs.pathCaseFolding))
 	return fs.Join(fs.config.KeyPrefix, strings.TrimPrefix(virtualPath, "/")), nil
 }
 
@@ -24,6 +24,7 @@ type Filesystem struct {
 	AzBlobConfig   AzBlobFsConfig         `json:"azblobconfig,omitempty"`
 	CryptConfig    CryptFsConfig          `json:"cryptconfig,omitempty"`
 	SFTPConfig     SFTPFsConfig           `json:"sftpconfig,omitempty"`
+	OSConfig       OSFsConfig             `json:"osconfig,omitempty"`
 }
 
 // SetEmptySecretsIfNil sets the secrets to empty if nil
@@ -95,7 +96,7 @@ func (f *Filesystem) IsEqual(other *Filesystem) bool {
 	case sdk.SFTPFilesystemProvider:
 		return f.SFTPConfig.isEqual(&other.SFTPConfig)
 	default:
-		return true
+		return f.OSConfig.isEqual(&other.OSConfig)
 	}
 }
 
@@ -114,6 +115,7 @@ func (f *Filesystem) Validate(helper ValidatorHelper) error {
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
+		f.OSConfig = OSFsConfig{}
 		return nil
 	case sdk.GCSFilesystemProvider:
 		if err := f.GCSConfig.Validate(helper.GetGCSCredentialsFilePath()); err != nil {
@@ -123,6 +125,7 @@ func (f *Filesystem) Validate(helper ValidatorHelper) error {
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
+		f.OSConfig = OSFsConfig{}
 		return nil
 	case sdk.AzureBlobFilesystemProvider:
 		if err := f.AzBlobConfig.Validate(); err != nil {
@@ -135,6 +138,7 @@ func (f *Filesystem) Validate(helper ValidatorHelper) error {
 		f.GCSConfig = GCSFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
+		f.OSConfig = OSFsConfig{}
 		return nil
 	case sdk.CryptedFilesystemProvider:
 		if err := f.CryptConfig.Validate(); err != nil {
@@ -147,6 +151,7 @@ func (f *Filesystem) Validate(helper ValidatorHelper) error {
 		f.GCSConfig = GCSFsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.SFTPConfig = SFTPFsConfig{}
+		f.OSConfig = OSFsConfig{}
 		return nil
 	case sdk.SFTPFilesystemProvider:
 		if err := f.SFTPConfig.Validate(); err != nil {
@@ -159,8 +164,12 @@ func (f *Filesystem) Validate(helper ValidatorHelper) error {
 		f.GCSConfig = GCSFsConfig{}
 		f.AzBlobConfig = AzBlobFsConfig{}
 		f.CryptConfig = CryptFsConfig{}
+		f.OSConfig = OSFsConfig{}
 		return nil
 	default:
+		if err := f.OSConfig.Validate(); err != nil {
+			return util.NewValidationError(fmt.Sprintf("could not validate osconfig: %v", err))
+		}
 		f.Provider = sdk.LocalFilesystemProvider
 		f.S3Config = S3FsConfig{}
 		f.GCSConfig = GCSFsConfig{}
@@ -221,6 +230,33 @@ func (f *Filesystem) HideConfidentialData() {
 	}
 }
 
+// DecryptSecrets decrypts the encrypted filesystem secrets, if any.
+// Plain secrets are encrypted again, using the current additional data, on validation
+func (f *Filesystem) DecryptSecrets() error {
+	var secrets []*kms.Secret
+	switch f.Provider {
+	case sdk.S3FilesystemProvider:
+		secrets = append(secrets, f.S3Config.AccessSecret)
+	case sdk.GCSFilesystemProvider:
+		secrets = append(secrets, f.GCSConfig.Credentials)
+	case sdk.AzureBlobFilesystemProvider:
+		secrets = append(secrets, f.AzBlobConfig.AccountKey, f.AzBlobConfig.SASURL)
+	case sdk.CryptedFilesystemProvider:
+		secrets = append(secrets, f.CryptConfig.Passphrase)
+	case sdk.SFTPFilesystemProvider:
+		secrets = append(secrets, f.SFTPConfig.Password, f.SFTPConfig.PrivateKey)
+	}
+	for _, secret := range secrets {
+		if secret == nil {
+			continue
+		}
+		if err := secret.TryDecrypt(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetACopy returns a filesystem copy
 func (f *Filesystem) GetACopy() Filesystem {
 	f.SetEmptySecretsIfNil()
@@ -288,5 +324,9 @@ func (f *Filesystem) GetACopy() Filesystem {
 		fs.SFTPConfig.Fingerprints = make([]string, len(f.SFTPConfig.Fingerprints))
 		copy(fs.SFTPConfig.Fingerprints, f.SFTPConfig.Fingerprints)
 	}
+	if len(f.OSConfig.ReadReplicas) > 0 {
+		fs.OSConfig.ReadReplicas = make([]string, len(f.OSConfig.ReadReplicas))
+		copy(fs.OSConfig.ReadReplicas, f.OSConfig.ReadReplicas)
+	}
 	return fs
 }
@@ -190,6 +190,9 @@ func (v *VirtualFolder) GetFilesystem(connectionID string, forbiddenSelfUsers []
 	case sdk.SFTPFilesystemProvider:
 		return NewSFTPFs(connectionID, v.VirtualPath, v.MappedPath, forbiddenSelfUsers, v.FsConfig.SFTPConfig)
 	default:
+		if len(v.FsConfig.OSConfig.ReadReplicas) > 0 {
+			return NewReplicatedFs(connectionID, v.MappedPath, v.VirtualPath, v.FsConfig.OSConfig.ReadReplicas), nil
+		}
 		return NewOsFs(connectionID, v.MappedPath, v.VirtualPath), nil
 	}
 }
@@ -205,6 +208,18 @@ func (v *VirtualFolder) ScanQuota() (int, int64, error) {
 	return fs.ScanRootDirContents()
 }
 
+// ScanQuotaWithExcludes is like ScanQuota but the files and directories for which
+// isExcluded returns true are not counted. isExcluded receives the virtual path
+func (v *VirtualFolder) ScanQuotaWithExcludes(isExcluded func(virtualPath string) bool) (int, int64, error) {
+	fs, err := v.GetFilesystem("", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fs.Close()
+
+	return ScanDirContentsWithExcludes(fs, v.VirtualPath, isExcluded)
+}
+
 // IsIncludedInUserQuota returns true if the virtual folder is included in user quota
 func (v *VirtualFolder) IsIncludedInUserQuota() bool {
 	return v.QuotaFiles == -1 && v.QuotaSize == -1
@@ -42,6 +42,8 @@ type GCSFs struct {
 	svc            *storage.Client
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	// if true the resolved paths are lower cased
+	pathCaseFolding bool
 }
 
 func init() {
@@ -104,6 +106,11 @@ func (fs *GCSFs) Name() string {
 	return fmt.Sprintf("GCSFs bucket %#v", fs.config.Bucket)
 }
 
+// SetPathCaseFolding enables or disables the case folding for the resolved paths
+func (fs *GCSFs) SetPathCaseFolding(enabled bool) {
+	fs.pathCaseFolding = enabled
+}
+
 // ConnectionID returns the connection ID associated to this Fs implementation
 func (fs *GCSFs) ConnectionID() string {
 	return fs.connectionID
@@ -187,11 +194,13 @@ func (fs *GCSFs) Create(name string, flag int) (File, *PipeWriter, func(), error
 	go func() {
 		defer cancelFn()
 
+		stopProgress := p.TrackUploadProgress(r, uploadProgressInterval)
 		n, err := io.Copy(objectWriter, r)
 		closeErr := objectWriter.Close()
 		if err == nil {
 			err = closeErr
 		}
+		stopProgress()
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
@@ -225,7 +234,32 @@ func (fs *GCSFs) Rename(source, target string) error {
 			target += "/"
 		}
 	}
-	src := fs.svc.Bucket(fs.config.Bucket).Object(realSourceName)
+	var contentType string
+	if fi.IsDir() {
+		contentType = dirMimeType
+	} else {
+		contentType = mime.TypeByExtension(path.Ext(source))
+	}
+	if err := fs.copyObject(realSourceName, target, contentType); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// Copy copies the regular file source to target using a server side copy
+func (fs *GCSFs) Copy(source, target string) error {
+	realSourceName, fi, err := fs.getObjectStat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return ErrVfsUnsupported
+	}
+	return fs.copyObject(realSourceName, target, mime.TypeByExtension(path.Ext(source)))
+}
+
+func (fs *GCSFs) copyObject(source, target, contentType string) error {
+	src := fs.svc.Bucket(fs.config.Bucket).Object(source)
 	dst := fs.svc.Bucket(fs.config.Bucket).Object(target)
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
@@ -233,21 +267,12 @@ func (fs *GCSFs) Rename(source, target string) error {
 	if fs.config.StorageClass != "" {
 		copier.StorageClass = fs.config.StorageClass
 	}
-	var contentType string
-	if fi.IsDir() {
-		contentType = dirMimeType
-	} else {
-		contentType = mime.TypeByExtension(path.Ext(source))
-	}
 	if contentType != "" {
 		copier.ContentType = contentType
 	}
-	_, err = copier.Run(ctx)
+	_, err := copier.Run(ctx)
 	metric.GCSCopyObjectCompleted(err)
-	if err != nil {
-		return err
-	}
-	return fs.Remove(source, fi.IsDir())
+	return err
 }
 
 // Remove removes the named file or (empty) directory.
@@ -517,6 +542,7 @@ func (fs *GCSFs) GetRelativePath(name string) string {
 		}
 		rel = path.Clean("/" + strings.TrimPrefix(rel, "/"+fs.config.KeyPrefix))
 	}
+	rel = foldPathCase(rel, fs.pathCaseFolding)
 	if fs.mountPath != "" {
 		rel = path.Join(fs.mountPath, rel)
 	}
@@ -588,12 +614,8 @@ func (GCSFs) HasVirtualFolders() bool {
 
 // ResolvePath returns the matching filesystem path for the specified virtual path
 func (fs *GCSFs) ResolvePath(virtualPath string) (string, error) {
-	if fs.mountPath != "" {
-		virtualPath = strings.TrimPrefix(virtualPath, fs.mountPath)
-	}
-	if !path.IsAbs(virtualPath) {
-		virtualPath = path.Clean("/" + virtualPath)
-	}
+	// dot-dot elements must not escape the key prefix
+	virtualPath = path.Clean(canonicalizeVirtualPath(virtualPath, fs.mountPath, fs.pathCaseFolding))
 	return fs.Join(fs.config.KeyPrefix, strings.TrimPrefix(virtualPath, "/")), nil
 }
 
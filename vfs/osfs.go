@@ -16,6 +16,7 @@ import (
 	"github.com/rs/xid"
 
 	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/sdk"
 )
 
 const (
@@ -38,6 +39,10 @@ type OsFs struct {
 	rootDir      string
 	// if not empty this fs is mouted as virtual folder in the specified path
 	mountPath string
+	// how symbolic links are followed while resolving paths
+	symlinksPolicy sdk.SymlinksPolicy
+	// if true the resolved paths are lower cased
+	pathCaseFolding bool
 }
 
 // NewOsFs returns an OsFs object that allows to interact with local Os filesystem
@@ -50,6 +55,17 @@ func NewOsFs(connectionID, rootDir, mountPath string) Fs {
 	}
 }
 
+// SetSymlinksPolicy sets how symbolic links are followed while resolving paths.
+// An empty policy means that links pointing outside the root dir are denied
+func (fs *OsFs) SetSymlinksPolicy(policy sdk.SymlinksPolicy) {
+	fs.symlinksPolicy = policy
+}
+
+// SetPathCaseFolding enables or disables the case folding for the resolved paths
+func (fs *OsFs) SetPathCaseFolding(enabled bool) {
+	fs.pathCaseFolding = enabled
+}
+
 // Name returns the name for the Fs implementation
 func (fs *OsFs) Name() string {
 	return fs.name
@@ -98,6 +114,18 @@ func (*OsFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
 	return f, nil, nil, err
 }
 
+// Copy copies the regular file source to target
+func (fs *OsFs) Copy(source, target string) error {
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return ErrVfsUnsupported
+	}
+	return fscopy.Copy(source, target)
+}
+
 // Rename renames (moves) source to target
 func (fs *OsFs) Rename(source, target string) error {
 	err := os.Rename(source, target)
@@ -263,7 +291,7 @@ func (fs *OsFs) GetRelativePath(name string) string {
 	if rel == "." || strings.HasPrefix(rel, "..") {
 		rel = ""
 	}
-	return path.Join(virtualPath, filepath.ToSlash(rel))
+	return path.Join(virtualPath, foldPathCase(filepath.ToSlash(rel), fs.pathCaseFolding))
 }
 
 // Walk walks the file tree rooted at root, calling walkFn for each file or
@@ -282,10 +310,15 @@ func (fs *OsFs) ResolvePath(virtualPath string) (string, error) {
 	if !filepath.IsAbs(fs.rootDir) {
 		return "", fmt.Errorf("invalid root path: %v", fs.rootDir)
 	}
-	if fs.mountPath != "" {
-		virtualPath = strings.TrimPrefix(virtualPath, fs.mountPath)
-	}
+	virtualPath = canonicalizeVirtualPath(virtualPath, fs.mountPath, fs.pathCaseFolding)
 	r := filepath.Clean(filepath.Join(fs.rootDir, virtualPath))
+	if fs.symlinksPolicy == sdk.SymlinksDeny {
+		if err := fs.checkNoSymlinks(r); err != nil {
+			fsLog(fs, logger.LevelWarn, "Invalid path resolution, original path %#v resolved %#v err: %v",
+				virtualPath, r, err)
+			return "", err
+		}
+	}
 	p, err := filepath.EvalSymlinks(r)
 	if err != nil && !os.IsNotExist(err) {
 		return "", err
@@ -298,6 +331,9 @@ func (fs *OsFs) ResolvePath(virtualPath string) (string, error) {
 		}
 		return r, err
 	}
+	if fs.symlinksPolicy == sdk.SymlinksFollow {
+		return r, nil
+	}
 
 	err = fs.isSubDir(p)
 	if err != nil {
@@ -351,6 +387,9 @@ func (fs *OsFs) findNonexistentDirs(filePath string) ([]string, error) {
 	if err != nil {
 		return results, err
 	}
+	if fs.symlinksPolicy == sdk.SymlinksFollow {
+		return results, nil
+	}
 	err = fs.isSubDir(p)
 	if err != nil {
 		fsLog(fs, logger.LevelWarn, "error finding non existing dir: %v", err)
@@ -382,10 +421,43 @@ func (fs *OsFs) findFirstExistingDir(path string) (string, error) {
 	if !fileInfo.IsDir() {
 		return "", fmt.Errorf("resolved path is not a dir: %#v", p)
 	}
+	if fs.symlinksPolicy == sdk.SymlinksFollow {
+		return p, nil
+	}
 	err = fs.isSubDir(p)
 	return p, err
 }
 
+// checkNoSymlinks returns an error if a component of fsPath, below the root dir,
+// is a symbolic link. The root dir itself can be a link
+func (fs *OsFs) checkNoSymlinks(fsPath string) error {
+	rel, err := filepath.Rel(fs.rootDir, fsPath)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return &pathResolutionError{err: fmt.Sprintf("path %#v is not inside %#v", fsPath, fs.rootDir)}
+	}
+	current := fs.rootDir
+	for _, name := range strings.Split(rel, string(os.PathSeparator)) {
+		current = filepath.Join(current, name)
+		info, err := os.Lstat(current)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return &pathResolutionError{err: fmt.Sprintf("path %#v traverses the symbolic link %#v", fsPath, current)}
+		}
+	}
+	return nil
+}
+
 func (fs *OsFs) isSubDir(sub string) error {
 	// fs.rootDir must exist and it is already a validated absolute path
 	parent, err := filepath.EvalSymlinks(fs.rootDir)
@@ -0,0 +1,337 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/v2/logger"
+	"github.com/drakkan/sftpgo/v2/sdk"
+)
+
+// replicaHealthCheckInterval defines how often the availability of the primary
+// root directory is checked
+const replicaHealthCheckInterval = 10 * time.Second
+
+// ErrPrimaryUnavailable is returned for write operations if the primary
+// root directory for a filesystem with read replicas is not available
+var ErrPrimaryUnavailable = errors.New("the storage is temporarily read-only, please retry later")
+
+// ReplicatedFs is a local Fs with one or more read-only replicas.
+// Writes are always sent to the primary root directory, reads are
+// served from the first available replica if the primary root
+// directory is not available
+type ReplicatedFs struct {
+	*OsFs
+	replicas []*OsFs
+	mu       sync.Mutex
+	// primary availability as detected by the last health check
+	primaryAvailable bool
+	lastCheck        time.Time
+}
+
+// NewReplicatedFs returns a local Fs with the given read-only replicas
+func NewReplicatedFs(connectionID, rootDir, mountPath string, replicas []string) Fs {
+	fs := &ReplicatedFs{
+		OsFs: NewOsFs(connectionID, rootDir, mountPath).(*OsFs),
+	}
+	for _, replica := range replicas {
+		fs.replicas = append(fs.replicas, NewOsFs(connectionID, replica, mountPath).(*OsFs))
+	}
+	return fs
+}
+
+func (fs *ReplicatedFs) isPrimaryAvailable() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if time.Since(fs.lastCheck) < replicaHealthCheckInterval {
+		return fs.primaryAvailable
+	}
+	available := isDirAvailable(fs.rootDir)
+	if available != fs.primaryAvailable && !fs.lastCheck.IsZero() {
+		fsLog(fs, logger.LevelInfo, "primary root dir %#v availability changed, available: %v", fs.rootDir, available)
+	}
+	fs.primaryAvailable = available
+	fs.lastCheck = time.Now()
+	return available
+}
+
+// setPrimaryUnavailable forces the primary root directory as unavailable until the next health check
+func (fs *ReplicatedFs) setPrimaryUnavailable(err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fsLog(fs, logger.LevelWarn, "primary root dir %#v is not available: %v", fs.rootDir, err)
+	fs.primaryAvailable = false
+	fs.lastCheck = time.Now()
+}
+
+// getReadFs returns the filesystem to use for reads and the given name translated for it
+func (fs *ReplicatedFs) getReadFs(name string) (*OsFs, string, error) {
+	if fs.isPrimaryAvailable() {
+		return fs.OsFs, name, nil
+	}
+	rel, err := filepath.Rel(fs.rootDir, filepath.Clean(name))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, replica := range fs.replicas {
+		if isDirAvailable(replica.rootDir) {
+			fsLog(fs, logger.LevelDebug, "primary root dir %#v not available, using replica %#v for %#v",
+				fs.rootDir, replica.rootDir, name)
+			return replica, filepath.Join(replica.rootDir, rel), nil
+		}
+	}
+	return nil, "", ErrPrimaryUnavailable
+}
+
+// isPrimaryError returns true if the given error, returned from the primary
+// root directory, could mean the primary is not available
+func (fs *ReplicatedFs) isPrimaryError(readFs *OsFs, err error) bool {
+	if readFs != fs.OsFs || err == nil || fs.IsNotExist(err) || fs.IsPermission(err) {
+		return false
+	}
+	return !isDirAvailable(fs.rootDir)
+}
+
+func (fs *ReplicatedFs) checkWrite() error {
+	if !fs.isPrimaryAvailable() {
+		return ErrPrimaryUnavailable
+	}
+	return nil
+}
+
+func (fs *ReplicatedFs) toPrimaryPath(readFs *OsFs, name string) string {
+	if readFs == fs.OsFs {
+		return name
+	}
+	rel, err := filepath.Rel(readFs.rootDir, name)
+	if err != nil {
+		return name
+	}
+	return filepath.Join(fs.rootDir, rel)
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *ReplicatedFs) Stat(name string) (os.FileInfo, error) {
+	readFs, p, err := fs.getReadFs(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readFs.Stat(p)
+	if fs.isPrimaryError(readFs, err) {
+		fs.setPrimaryUnavailable(err)
+		return fs.Stat(name)
+	}
+	return info, err
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *ReplicatedFs) Lstat(name string) (os.FileInfo, error) {
+	readFs, p, err := fs.getReadFs(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := readFs.Lstat(p)
+	if fs.isPrimaryError(readFs, err) {
+		fs.setPrimaryUnavailable(err)
+		return fs.Lstat(name)
+	}
+	return info, err
+}
+
+// Open opens the named file for reading
+func (fs *ReplicatedFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	readFs, p, err := fs.getReadFs(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, r, cancelFn, err := readFs.Open(p, offset)
+	if fs.isPrimaryError(readFs, err) {
+		fs.setPrimaryUnavailable(err)
+		return fs.Open(name, offset)
+	}
+	return f, r, cancelFn, err
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *ReplicatedFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	readFs, p, err := fs.getReadFs(dirname)
+	if err != nil {
+		return nil, err
+	}
+	list, err := readFs.ReadDir(p)
+	if fs.isPrimaryError(readFs, err) {
+		fs.setPrimaryUnavailable(err)
+		return fs.ReadDir(dirname)
+	}
+	return list, err
+}
+
+// Readlink returns the destination of the named symbolic link
+// as absolute virtual path
+func (fs *ReplicatedFs) Readlink(name string) (string, error) {
+	readFs, p, err := fs.getReadFs(name)
+	if err != nil {
+		return "", err
+	}
+	return readFs.Readlink(p)
+}
+
+// GetMimeType returns the content type
+func (fs *ReplicatedFs) GetMimeType(name string) (string, error) {
+	readFs, p, err := fs.getReadFs(name)
+	if err != nil {
+		return "", err
+	}
+	return readFs.GetMimeType(p)
+}
+
+// SetSymlinksPolicy sets how symbolic links are followed for the primary
+// root directory and for the replicas
+func (fs *ReplicatedFs) SetSymlinksPolicy(policy sdk.SymlinksPolicy) {
+	fs.OsFs.SetSymlinksPolicy(policy)
+	for _, replica := range fs.replicas {
+		replica.SetSymlinksPolicy(policy)
+	}
+}
+
+// SetPathCaseFolding enables or disables the case folding for the resolved paths
+// for the primary root directory and for the replicas
+func (fs *ReplicatedFs) SetPathCaseFolding(enabled bool) {
+	fs.OsFs.SetPathCaseFolding(enabled)
+	for _, replica := range fs.replicas {
+		replica.SetPathCaseFolding(enabled)
+	}
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path.
+// The returned path is always relative to the primary root directory
+func (fs *ReplicatedFs) ResolvePath(virtualPath string) (string, error) {
+	readFs, _, err := fs.getReadFs(fs.rootDir)
+	if err != nil {
+		return "", err
+	}
+	p, err := readFs.ResolvePath(virtualPath)
+	if err != nil {
+		return p, err
+	}
+	return fs.toPrimaryPath(readFs, p), nil
+}
+
+// CheckRootPath creates the primary root directory if it does not exists and
+// no replica is available. A missing primary root directory is considered
+// unavailable if a replica exists
+func (fs *ReplicatedFs) CheckRootPath(username string, uid int, gid int) bool {
+	if fs.isPrimaryAvailable() {
+		return true
+	}
+	for _, replica := range fs.replicas {
+		if isDirAvailable(replica.rootDir) {
+			fsLog(fs, logger.LevelWarn, "primary root dir %#v for user %#v is not available, only reads are allowed",
+				fs.rootDir, username)
+			return true
+		}
+	}
+	return fs.OsFs.CheckRootPath(username, uid, gid)
+}
+
+// Create creates or opens the named file for writing
+func (fs *ReplicatedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if err := fs.checkWrite(); err != nil {
+		return nil, nil, nil, err
+	}
+	return fs.OsFs.Create(name, flag)
+}
+
+// Rename renames (moves) source to target
+func (fs *ReplicatedFs) Rename(source, target string) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Rename(source, target)
+}
+
+// Copy copies the regular file source to target on the primary
+func (fs *ReplicatedFs) Copy(source, target string) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Copy(source, target)
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *ReplicatedFs) Remove(name string, isDir bool) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Remove(name, isDir)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *ReplicatedFs) Mkdir(name string) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Mkdir(name)
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents,
+// and returns nil, or else returns an error
+func (fs *ReplicatedFs) MkdirAll(name string, uid int, gid int) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.MkdirAll(name, uid, gid)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs *ReplicatedFs) Symlink(source, target string) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Symlink(source, target)
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (fs *ReplicatedFs) Chown(name string, uid int, gid int) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs *ReplicatedFs) Chmod(name string, mode os.FileMode) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file
+func (fs *ReplicatedFs) Chtimes(name string, atime, mtime time.Time) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Chtimes(name, atime, mtime)
+}
+
+// Truncate changes the size of the named file
+func (fs *ReplicatedFs) Truncate(name string, size int64) error {
+	if err := fs.checkWrite(); err != nil {
+		return err
+	}
+	return fs.OsFs.Truncate(name, size)
+}
+
+func isDirAvailable(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.IsDir()
+}
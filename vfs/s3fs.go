@@ -42,6 +42,8 @@ type S3Fs struct {
 	svc            *s3.S3
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	// if true the resolved paths are lower cased
+	pathCaseFolding bool
 }
 
 func init() {
@@ -122,6 +124,11 @@ func (fs *S3Fs) Name() string {
 	return fmt.Sprintf("S3Fs bucket %#v", fs.config.Bucket)
 }
 
+// SetPathCaseFolding enables or disables the case folding for the resolved paths
+func (fs *S3Fs) SetPathCaseFolding(enabled bool) {
+	fs.pathCaseFolding = enabled
+}
+
 // ConnectionID returns the connection ID associated to this Fs implementation
 func (fs *S3Fs) ConnectionID() string {
 	return fs.connectionID
@@ -232,6 +239,7 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 	uploader := s3manager.NewUploaderWithClient(fs.svc)
 	go func() {
 		defer cancelFn()
+		stopProgress := p.TrackUploadProgress(r, uploadProgressInterval)
 		key := name
 		var contentType string
 		if flag == -1 {
@@ -249,6 +257,7 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 			u.Concurrency = fs.config.UploadConcurrency
 			u.PartSize = fs.config.UploadPartSize
 		})
+		stopProgress()
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, response: %v, readed bytes: %v, err: %+v",
@@ -298,9 +307,28 @@ func (fs *S3Fs) Rename(source, target string) error {
 	} else {
 		contentType = mime.TypeByExtension(path.Ext(source))
 	}
+	if err := fs.copyObject(copySource, target, contentType); err != nil {
+		return err
+	}
+	return fs.Remove(source, fi.IsDir())
+}
+
+// Copy copies the regular file source to target using a server side copy
+func (fs *S3Fs) Copy(source, target string) error {
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return ErrVfsUnsupported
+	}
+	return fs.copyObject(fs.Join(fs.config.Bucket, source), target, mime.TypeByExtension(path.Ext(source)))
+}
+
+func (fs *S3Fs) copyObject(copySource, target, contentType string) error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
-	_, err = fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+	_, err := fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
 		Bucket:       aws.String(fs.config.Bucket),
 		CopySource:   aws.String(pathEscape(copySource)),
 		Key:          aws.String(target),
@@ -316,10 +344,7 @@ func (fs *S3Fs) Rename(source, target string) error {
 		Key:    aws.String(target),
 	})
 	metric.S3CopyObjectCompleted(err)
-	if err != nil {
-		return err
-	}
-	return fs.Remove(source, fi.IsDir())
+	return err
 }
 
 // Remove removes the named file or (empty) directory.
@@ -569,6 +594,7 @@ func (fs *S3Fs) GetRelativePath(name string) string {
 		}
 		rel = path.Clean("/" + strings.TrimPrefix(rel, "/"+fs.config.KeyPrefix))
 	}
+	rel = foldPathCase(rel, fs.pathCaseFolding)
 	if fs.mountPath != "" {
 		rel = path.Join(fs.mountPath, rel)
 	}
@@ -624,12 +650,8 @@ func (*S3Fs) HasVirtualFolders() bool {
 
 // ResolvePath returns the matching filesystem path for the specified virtual path
 func (fs *S3Fs) ResolvePath(virtualPath string) (string, error) {
-	if fs.mountPath != "" {
-		virtualPath = strings.TrimPrefix(virtualPath, fs.mountPath)
-	}
-	if !path.IsAbs(virtualPath) {
-		virtualPath = path.Clean("/" + virtualPath)
-	}
+	// dot-dot elements must not escape the key prefix
+	virtualPath = path.Clean(canonicalizeVirtualPath(virtualPath, fs.mountPath, fs.pathCaseFolding))
 	return fs.Join("/", fs.config.KeyPrefix, virtualPath), nil
 }
 
@@ -155,6 +155,8 @@ type SFTPFs struct {
 	sshClient    *ssh.Client
 	sftpClient   *sftp.Client
 	err          chan error
+	// if true the resolved paths are lower cased
+	pathCaseFolding bool
 }
 
 // NewSFTPFs returns an SFTPFs object that allows to interact with an SFTP server
@@ -196,6 +198,11 @@ func (fs *SFTPFs) Name() string {
 	return fmt.Sprintf("%v %#v", sftpFsName, fs.config.Endpoint)
 }
 
+// SetPathCaseFolding enables or disables the case folding for the resolved paths
+func (fs *SFTPFs) SetPathCaseFolding(enabled bool) {
+	fs.pathCaseFolding = enabled
+}
+
 // ConnectionID returns the connection ID associated to this Fs implementation
 func (fs *SFTPFs) ConnectionID() string {
 	return fs.connectionID
@@ -474,6 +481,7 @@ func (fs *SFTPFs) GetRelativePath(name string) string {
 		}
 		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.config.Prefix))
 	}
+	rel = foldPathCase(rel, fs.pathCaseFolding)
 	if fs.mountPath != "" {
 		rel = path.Join(fs.mountPath, rel)
 	}
@@ -512,12 +520,8 @@ func (*SFTPFs) HasVirtualFolders() bool {
 
 // ResolvePath returns the matching filesystem path for the specified virtual path
 func (fs *SFTPFs) ResolvePath(virtualPath string) (string, error) {
-	if fs.mountPath != "" {
-		virtualPath = strings.TrimPrefix(virtualPath, fs.mountPath)
-	}
-	if !path.IsAbs(virtualPath) {
-		virtualPath = path.Clean("/" + virtualPath)
-	}
+	// dot-dot elements must not escape the configured prefix
+	virtualPath = path.Clean(canonicalizeVirtualPath(virtualPath, fs.mountPath, fs.pathCaseFolding))
 	fsPath := fs.Join(fs.config.Prefix, virtualPath)
 	if fs.config.Prefix != "/" && fsPath != "/" {
 		// we need to check if this path is a symlink outside the given prefix
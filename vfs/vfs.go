@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/eikenb/pipeat"
@@ -22,7 +23,11 @@ import (
 	"github.com/drakkan/sftpgo/v2/util"
 )
 
-const dirMimeType = "inode/directory"
+const (
+	dirMimeType = "inode/directory"
+	// interval between two progress updates for the uploads to remote storage backends
+	uploadProgressInterval = 2 * time.Second
+)
 
 var (
 	validAzAccessTier = []string{"", "Archive", "Hot", "Cool"}
@@ -98,6 +103,28 @@ type Fs interface {
 	Close() error
 }
 
+// FsCopier is an optional interface for filesystem backends that can copy
+// a file without streaming its contents through SFTPGo, for example using a
+// server side copy. Implementations must return ErrVfsUnsupported if they
+// cannot natively copy the requested file, the caller will fallback to a
+// stream copy in this case
+type FsCopier interface {
+	Copy(source, target string) error
+}
+
+// FsSymlinksPolicer is implemented by the filesystems backed by local storage
+// that allow to configure how symbolic links are followed
+type FsSymlinksPolicer interface {
+	SetSymlinksPolicy(policy sdk.SymlinksPolicy)
+}
+
+// FsPathCaseFolder is implemented by the filesystems that can fold the case of
+// the resolved paths. This is useful for case-insensitive backends: the same
+// file is always resolved to the same path whatever case the clients use
+type FsPathCaseFolder interface {
+	SetPathCaseFolding(enabled bool)
+}
+
 // File defines an interface representing a SFTPGo file
 type File interface {
 	io.Reader
@@ -439,6 +466,44 @@ func (c *AzBlobFsConfig) Validate() error {
 	return nil
 }
 
+// OSFsConfig defines the configuration for the local filesystem
+type OSFsConfig struct {
+	// Absolute paths for read-only replicas of the local filesystem root.
+	// Reads are served from the first available replica if the root is
+	// not available, writes always require the root. Supported for virtual
+	// folders only
+	ReadReplicas []string `json:"read_replicas,omitempty"`
+}
+
+func (c *OSFsConfig) isEqual(other *OSFsConfig) bool {
+	if len(c.ReadReplicas) != len(other.ReadReplicas) {
+		return false
+	}
+	for idx := range c.ReadReplicas {
+		if c.ReadReplicas[idx] != other.ReadReplicas[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *OSFsConfig) Validate() error {
+	var replicas []string
+	for _, replica := range c.ReadReplicas {
+		cleaned := filepath.Clean(replica)
+		if !filepath.IsAbs(cleaned) {
+			return fmt.Errorf("invalid read replica %#v, it must be an absolute path", replica)
+		}
+		if util.IsStringInSlice(cleaned, replicas) {
+			return fmt.Errorf("duplicated read replica %#v", replica)
+		}
+		replicas = append(replicas, cleaned)
+	}
+	c.ReadReplicas = replicas
+	return nil
+}
+
 // CryptFsConfig defines the configuration to store local files as encrypted
 type CryptFsConfig struct {
 	sdk.CryptFsConfig
@@ -481,9 +546,12 @@ func (c *CryptFsConfig) Validate() error {
 
 // PipeWriter defines a wrapper for pipeat.PipeWriterAt.
 type PipeWriter struct {
-	writer *pipeat.PipeWriterAt
-	err    error
-	done   chan bool
+	// bytes read from the pipe by the goroutine uploading to the storage backend,
+	// updated periodically while the upload is in progress
+	uploadedBytes int64
+	writer        *pipeat.PipeWriterAt
+	err           error
+	done          chan bool
 }
 
 // NewPipeWriter initializes a new PipeWriter
@@ -509,6 +577,37 @@ func (p *PipeWriter) Done(err error) {
 	p.done <- true
 }
 
+// TrackUploadProgress updates the uploaded bytes, at the specified interval, reading
+// them from r, the pipe reader used to upload the data to the storage backend.
+// The returned function stops the updates: it must be called when the upload
+// ends and before Done, so the final value is available after Close
+func (p *PipeWriter) TrackUploadProgress(r *pipeat.PipeReaderAt, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				atomic.StoreInt64(&p.uploadedBytes, r.GetReadedBytes())
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		atomic.StoreInt64(&p.uploadedBytes, r.GetReadedBytes())
+	}
+}
+
+// GetUploadedBytes returns the bytes already sent to the storage backend
+func (p *PipeWriter) GetUploadedBytes() int64 {
+	return atomic.LoadInt64(&p.uploadedBytes)
+}
+
 // WriteAt is a wrapper for pipeat WriteAt
 func (p *PipeWriter) WriteAt(data []byte, off int64) (int, error) {
 	return p.writer.WriteAt(data, off)
@@ -528,6 +627,25 @@ func IsDirectory(fs Fs, path string) (bool, error) {
 	return fileInfo.IsDir(), err
 }
 
+// canonicalizeVirtualPath returns the path, relative to the filesystem root, for
+// the given virtual path. Redundant and trailing slashes are removed before
+// stripping the mount path and the result is lower cased if caseFolding is true.
+// Dot-dot elements are preserved, backends without a local root must clean the result
+func canonicalizeVirtualPath(virtualPath, mountPath string, caseFolding bool) string {
+	virtualPath = util.RemoveRedundantSlashes(virtualPath)
+	if mountPath != "" {
+		virtualPath = util.RemoveRedundantSlashes(strings.TrimPrefix(virtualPath, mountPath))
+	}
+	return foldPathCase(virtualPath, caseFolding)
+}
+
+func foldPathCase(p string, caseFolding bool) string {
+	if caseFolding {
+		return strings.ToLower(p)
+	}
+	return p
+}
+
 // IsLocalOsFs returns true if fs is a local filesystem implementation
 func IsLocalOsFs(fs Fs) bool {
 	return fs.Name() == osFsName
@@ -584,6 +702,40 @@ func IsLocalOrCryptoFs(fs Fs) bool {
 	return IsLocalOsFs(fs) || IsCryptOsFs(fs)
 }
 
+// ScanDirContentsWithExcludes returns the number of files and their size for the
+// directory mapped to virtualRoot. The files and directories for which isExcluded
+// returns true are not counted. isExcluded receives the virtual path.
+// On local filesystems the excluded directories are not descended
+func ScanDirContentsWithExcludes(fs Fs, virtualRoot string, isExcluded func(virtualPath string) bool) (int, int64, error) {
+	root, err := fs.ResolvePath(virtualRoot)
+	if err != nil {
+		return 0, 0, err
+	}
+	canSkipDirs := IsLocalOrCryptoFs(fs)
+	numFiles := 0
+	size := int64(0)
+	err = fs.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info == nil || walkedPath == root {
+			return nil
+		}
+		if isExcluded(fs.GetRelativePath(walkedPath)) {
+			if info.IsDir() && canSkipDirs {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			numFiles++
+		}
+		return nil
+	})
+	return numFiles, size, err
+}
+
 // SetPathPermissions calls fs.Chown.
 // It does nothing for local filesystem on windows
 func SetPathPermissions(fs Fs, path string, uid int, gid int) {
@@ -39,6 +39,7 @@ func newWebDavFile(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter
 		reader = baseTransfer.File
 	} else if pipeWriter != nil {
 		writer = pipeWriter
+		baseTransfer.SetPipeWriter(pipeWriter)
 	} else if pipeReader != nil {
 		reader = pipeReader
 	}
@@ -157,6 +158,10 @@ func (f *webDavFile) Read(p []byte) (n int, err error) {
 	}
 
 	f.Connection.UpdateLastActivity()
+	if err = f.AcquireTransferSlot(); err != nil {
+		f.TransferError(err)
+		return 0, err
+	}
 
 	// the file is read sequentially we don't need to check for concurrent reads and so
 	// lock the transfer while opening the remote file
@@ -197,6 +202,10 @@ func (f *webDavFile) Write(p []byte) (n int, err error) {
 	}
 
 	f.Connection.UpdateLastActivity()
+	if err = f.AcquireTransferSlot(); err != nil {
+		f.TransferError(err)
+		return 0, err
+	}
 
 	n, err = f.writer.Write(p)
 	atomic.AddInt64(&f.BytesReceived, int64(n))
@@ -204,6 +213,9 @@ func (f *webDavFile) Write(p []byte) (n int, err error) {
 	if f.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&f.BytesReceived) > f.MaxWriteSize {
 		err = common.ErrQuotaExceeded
 	}
+	if err == nil {
+		err = f.ReserveQuota()
+	}
 	if err != nil {
 		f.TransferError(err)
 		return
@@ -186,6 +186,21 @@ func (c *Connection) putFile(fs vfs.Fs, fsPath, virtualPath string) (webdav.File
 		return nil, c.GetOpUnsupportedError()
 	}
 
+	newFsPath, newVirtualPath, err := c.HandleUploadCollision(fs, fsPath, virtualPath, false)
+	if err != nil {
+		return nil, err
+	}
+	if newVirtualPath != virtualPath {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(newVirtualPath)) {
+			return nil, c.GetPermissionDeniedError()
+		}
+		filePath = newFsPath
+		if common.Config.IsAtomicUploadEnabled() && fs.IsAtomicUploadSupported() {
+			filePath = fs.GetAtomicUploadPath(newFsPath)
+		}
+		return c.handleUploadToNewFile(fs, newFsPath, filePath, newVirtualPath)
+	}
+
 	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(virtualPath)) {
 		return nil, c.GetPermissionDeniedError()
 	}
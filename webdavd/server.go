@@ -74,11 +74,11 @@ func (s *webDavServer) listenAndServe(compressor *middleware.Compressor) error {
 				httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
 			}
 		}
-		return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, true, logSender)
+		return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, true, logSender, s.wrapListener)
 	}
 	s.binding.EnableHTTPS = false
 	serviceStatus.Bindings = append(serviceStatus.Bindings, s.binding)
-	return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, false, logSender)
+	return util.HTTPListenAndServe(httpServer, s.binding.Address, s.binding.Port, false, logSender, s.wrapListener)
 }
 
 func (s *webDavServer) verifyTLSConnection(state tls.ConnectionState) error {
@@ -130,6 +130,22 @@ func (s *webDavServer) checkRequestMethod(ctx context.Context, r *http.Request,
 	return false
 }
 
+// wrapListener refuses the connections not included in the allow list before
+// the TLS handshake. The client IP for the connections from the hosts allowed
+// to set the proxy headers is checked for each request
+func (s *webDavServer) wrapListener(listener net.Listener) net.Listener {
+	return common.NewAllowListListener(listener, common.ProtocolWebDAV, s.isProxyAddress)
+}
+
+func (s *webDavServer) isProxyAddress(ip net.IP) bool {
+	for _, allow := range s.binding.allowHeadersFrom {
+		if allow(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ServeHTTP implements the http.Handler interface
 func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer func() {
@@ -140,11 +156,15 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	ipAddr := s.checkRemoteAddress(r)
+	if !common.IsConnectionAccepted(ipAddr, common.ProtocolWebDAV) {
+		http.Error(w, common.ErrConnectionDenied.Error(), http.StatusForbidden)
+		return
+	}
 
 	common.Connections.AddClientConnection(ipAddr)
 	defer common.Connections.RemoveClientConnection(ipAddr)
 
-	if !common.Connections.IsNewConnectionAllowed(ipAddr) {
+	if !common.Connections.IsNewConnectionAllowed(ipAddr, common.ProtocolWebDAV) {
 		logger.Log(logger.LevelDebug, common.ProtocolWebDAV, "", "connection refused, configured limit reached")
 		http.Error(w, common.ErrConnectionDenied.Error(), http.StatusServiceUnavailable)
 		return
@@ -153,6 +173,7 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, common.ErrConnectionDenied.Error(), http.StatusForbidden)
 		return
 	}
+	common.ThrottleConnection(ipAddr, common.ProtocolWebDAV)
 	delay, err := common.LimitRate(common.ProtocolWebDAV, ipAddr)
 	if err != nil {
 		delay += 499999999 * time.Nanosecond
@@ -182,6 +203,7 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user.SetLoginProtocol(common.ProtocolWebDAV)
 	if !isCached {
 		err = user.CheckFsRoot(connectionID)
 	} else {
@@ -304,10 +326,24 @@ func (s *webDavServer) validateUser(user *dataprovider.User, r *http.Request, lo
 		logger.Debug(logSender, connectionID, "cannot login user %#v, protocol DAV is not allowed", user.Username)
 		return connID, fmt.Errorf("protocol DAV is not allowed for user %#v", user.Username)
 	}
+	// WebDAV bindings have no security profile
+	if !user.IsSecurityProfileAllowed("") {
+		logger.Debug(logSender, connectionID, "cannot login user %#v, restricted to security profiles %v",
+			user.Username, user.Filters.SecurityProfiles)
+		return connID, fmt.Errorf("user %#v is restricted to security profiles %v", user.Username, user.Filters.SecurityProfiles)
+	}
 	if !user.IsLoginMethodAllowed(loginMethod, nil) {
 		logger.Debug(logSender, connectionID, "cannot login user %#v, %v login method is not allowed", user.Username, loginMethod)
 		return connID, fmt.Errorf("login method %v is not allowed for user %#v", loginMethod, user.Username)
 	}
+	var tlsCert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		tlsCert = r.TLS.PeerCertificates[0]
+	}
+	if err := user.CheckTLSCertificate(tlsCert); err != nil {
+		logger.Debug(logSender, connectionID, "cannot login user %#v: %v", user.Username, err)
+		return connID, err
+	}
 	if user.MaxSessions > 0 {
 		activeSessions := common.Connections.GetActiveSessions(user.Username)
 		if activeSessions >= user.MaxSessions {
@@ -374,7 +410,9 @@ func updateLoginMetrics(user *dataprovider.User, ip, loginMethod string, err err
 		if _, ok := err.(*util.RecordNotFoundError); ok {
 			event = common.HostEventUserNotFound
 		}
-		common.AddDefenderEvent(ip, event)
+		common.AddDefenderEvent(ip, common.ProtocolWebDAV, event)
+	} else if err == nil {
+		common.AddDefenderLoginSuccess(ip)
 	}
 	metric.AddLoginResult(loginMethod, err)
 	dataprovider.ExecutePostLoginHook(user, loginMethod, ip, common.ProtocolWebDAV, err)
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -2181,6 +2182,53 @@ func TestClientCertificateAuth(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestClientCertificateRequired(t *testing.T) {
+	u := getTestUser()
+	u.Username = tlsClient1Username
+	u.Filters.TLSCertRequired = true
+	user, _, err := httpdtest.AddUser(u, http.StatusCreated)
+	assert.NoError(t, err)
+	tlsConfig := &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true, // use this for tests only
+		MinVersion:         tls.VersionTLS12,
+	}
+	// missing client certificate
+	client := getWebDavClient(user, false, nil)
+	assert.Error(t, checkBasicFunc(client))
+	client = getWebDavClient(user, true, tlsConfig)
+	assert.Error(t, checkBasicFunc(client))
+
+	tlsCert, err := tls.X509KeyPair([]byte(client1Crt), []byte(client1Key))
+	assert.NoError(t, err)
+	tlsConfig.Certificates = append(tlsConfig.Certificates, tlsCert)
+	client = getWebDavClient(user, true, tlsConfig)
+	assert.NoError(t, checkBasicFunc(client))
+	// a certificate not matching the allowed fingerprints
+	user.Filters.TLSCertRequired = false
+	user.Filters.TLSCertFingerprints = []string{strings.Repeat("ab", 32)}
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client = getWebDavClient(user, true, tlsConfig)
+	assert.Error(t, checkBasicFunc(client))
+	// a matching certificate
+	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	assert.NoError(t, err)
+	user.Filters.TLSCertFingerprints = append(user.Filters.TLSCertFingerprints,
+		dataprovider.GetTLSCertificateFingerprint(x509Cert))
+	user, _, err = httpdtest.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client = getWebDavClient(user, true, tlsConfig)
+	assert.NoError(t, checkBasicFunc(client))
+	client = getWebDavClient(user, false, nil)
+	assert.Error(t, checkBasicFunc(client))
+
+	_, err = httpdtest.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestWrongClientCertificate(t *testing.T) {
 	u := getTestUser()
 	u.Username = tlsClient2Username